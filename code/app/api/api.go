@@ -0,0 +1,319 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api holds the types the image API sends and receives, shared by
+// the server and its clients.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Image is an uploaded image and where to find it.
+type Image struct {
+	// ID is what the image is stored and requested by. Name is the same,
+	// kept for older clients.
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// OriginalName is what the file was called when it was uploaded, and
+	// OriginalFormat the type it was if it was converted to another.
+	OriginalName   string    `json:"originalName"`
+	OriginalFormat string    `json:"originalFormat,omitempty"`
+	Original       string    `json:"original"`
+	Thumbnail      string    `json:"thumbnail"`
+	ThumbnailURL   string    `json:"thumbnailUrl"`
+	Content        string    `json:"content"`
+	SizeBytes      int64     `json:"sizeBytes,omitempty"`
+	ContentType    string    `json:"contentType,omitempty"`
+	Width          int       `json:"width,omitempty"`
+	Height         int       `json:"height,omitempty"`
+	Created        time.Time `json:"created"`
+	Updated        time.Time `json:"updated"`
+	// FrameCount is how many frames a GIF has, and Animated whether that
+	// is more than one.
+	FrameCount int  `json:"frameCount,omitempty"`
+	Animated   bool `json:"animated,omitempty"`
+	// Labels name what is in the image, most confident first, once it has
+	// been labelled.
+	Labels []string `json:"labels,omitempty"`
+	// DominantColor, as #rrggbb, and BlurHash are for showing a
+	// placeholder until the image loads, once they have been worked out.
+	DominantColor string `json:"dominantColor,omitempty"`
+	BlurHash      string `json:"blurHash,omitempty"`
+	// Tags and Metadata are what the client keeps with the image.
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Expires is when the image is deleted, if it was given a time to
+	// live.
+	Expires *time.Time `json:"expires,omitempty"`
+	// MD5 and CRC32C are the checksums of the original, base64 encoded as
+	// Cloud Storage reports them, when they are known.
+	MD5    string `json:"md5,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+	// Generation is that of the original, which changes whenever it is
+	// overwritten. Sent back in an If-Match, it makes a change to the image
+	// conditional on nobody having changed it since. It is a string, as
+	// with Cloud Storage, since it may be too big for a JavaScript number.
+	Generation int64 `json:"generation,string,omitempty"`
+	// ETag is that of the original's contents, only known to the server.
+	ETag string `json:"-"`
+	// Deduplicated is set when an upload wasn't stored because this image
+	// already had the same content.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// SimilarTo are the images an upload looks like, closest first, as a
+	// warning that it may be a copy of one of them.
+	SimilarTo []string `json:"similarTo,omitempty"`
+	// PerceptualHash is the hash of what the original looks like, only
+	// known to the server.
+	PerceptualHash string `json:"-"`
+}
+
+// JSON marshalls the content of Image to json.
+func (i Image) JSON() (string, error) {
+	bytes, err := json.Marshal(i)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of Image to json.
+func (i Image) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(i)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+type Images []Image
+
+// JSON marshalls the content of Images to json.
+func (is Images) JSON() (string, error) {
+	bytes, err := json.Marshal(is)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of Images to json.
+func (is Images) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(is)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// ImagePage is one page of a listing of images, plus the token needed to
+// fetch the next one.
+type ImagePage struct {
+	Images        Images `json:"images"`
+	NextPageToken string `json:"nextPageToken"`
+	// Folders are the prefixes of the images nested below this level, when
+	// listing with a delimiter. Only the first page has them.
+	Folders []string `json:"folders,omitempty"`
+}
+
+// JSON marshalls the content of ImagePage to json.
+func (p ImagePage) JSON() (string, error) {
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of ImagePage to json.
+func (p ImagePage) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// ErrorMessage is the body of every error response.
+type ErrorMessage struct {
+	Error string `json:"error"`
+	// Code says what kind of error it is, such as not_found, for programs
+	// to go by.
+	Code string `json:"code,omitempty"`
+	// RequestID identifies the request in the server's logs.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// JSON marshalls the content of ErrorMessage to json.
+func (e ErrorMessage) JSON() (string, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of ErrorMessage to json as a byte array.
+func (e ErrorMessage) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// InvalidType is the response to an upload of a type that isn't allowed.
+type InvalidType struct {
+	Text    string `json:"text"`
+	Details string `json:"details"`
+	// Allowed are the types that are, sorted. A type like image/* allows
+	// every subtype.
+	Allowed []string `json:"allowed"`
+}
+
+// JSON marshalls the content of InvalidType to json.
+func (i InvalidType) JSON() (string, error) {
+	bytes, err := json.Marshal(i)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of InvalidType to json.
+func (i InvalidType) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(i)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// Message is a structure for communicating additional data to API consumer.
+type Message struct {
+	Text    string `json:"text"`
+	Details string `json:"details"`
+}
+
+// JSON marshalls the content of a todo to json.
+func (m Message) JSON() (string, error) {
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of a todo to json as a byte array.
+func (m Message) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// Envelope is the body of every /api/v2 response: the data on success, the
+// error on failure, and what the server has to say about the request.
+type Envelope struct {
+	Data  json.RawMessage `json:"data"`
+	Error *EnvelopeError  `json:"error"`
+	Meta  EnvelopeMeta    `json:"meta"`
+}
+
+// EnvelopeError says what went wrong with a /api/v2 request.
+type EnvelopeError struct {
+	// Code is one of the codes ErrorMessage has, such as not_found.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+}
+
+// EnvelopeMeta is about the request rather than its data.
+type EnvelopeMeta struct {
+	RequestID string `json:"requestId,omitempty"`
+	// NextPageToken is only set for listings, where it is empty on the
+	// last page.
+	NextPageToken *string `json:"nextPageToken,omitempty"`
+	// Folders are as for ImagePage.
+	Folders []string `json:"folders,omitempty"`
+}
+
+// JSON marshalls the content of Envelope to json.
+func (e Envelope) JSON() (string, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of Envelope to json.
+func (e Envelope) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// Problem is an error response in the RFC 7807 form, sent to clients that
+// accept application/problem+json.
+type Problem struct {
+	// Type identifies the kind of problem, and Title names it.
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Instance is the id of the request, as in the server's logs.
+	Instance string `json:"instance,omitempty"`
+	// Code is the code ErrorMessage would have had.
+	Code string `json:"code,omitempty"`
+}
+
+// JSON marshalls the content of Problem to json.
+func (p Problem) JSON() (string, error) {
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of Problem to json.
+func (p Problem) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// The codes error bodies carry, so that clients can tell failures apart
+// without parsing messages.
+const (
+	codeInvalidArgument = "invalid_argument"
+	codeNotFound        = "not_found"
+	codeGone            = "gone"
+	codeConflict        = "conflict"
+	codePrecondition    = "failed_precondition"
+	codeTooLarge        = "too_large"
+	codeUnsupportedType = "unsupported_type"
+	codeUnprocessable   = "unprocessable"
+	codeInternal        = "internal"
+	codeUnimplemented   = "unimplemented"
+	codeUpstream        = "upstream"
+	codeUnavailable     = "unavailable"
+)
+
+// apiError is an error that knows how it should be answered: with which
+// status, and which code in the body.
+type apiError struct {
+	Status int
+	Code   string
+	Err    error
+}
+
+func (e *apiError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// invalidArgument blames err on the request, for a 400.
+func invalidArgument(err error) error {
+	return &apiError{Status: http.StatusBadRequest, Code: codeInvalidArgument, Err: err}
+}
+
+// tooLarge is a 413 for an upload over the limit.
+func tooLarge(err error) error {
+	return &apiError{Status: http.StatusRequestEntityTooLarge, Code: codeTooLarge, Err: err}
+}
+
+// unprocessable is a 422 for an image that can't be worked on, such as
+// one that can't be decoded.
+func unprocessable(err error) error {
+	return &apiError{Status: http.StatusUnprocessableEntity, Code: codeUnprocessable, Err: err}
+}
+
+// notImplemented is a 501 for something the server can't do, such as
+// resizing an animated image.
+func notImplemented(err error) error {
+	return &apiError{Status: http.StatusNotImplemented, Code: codeUnimplemented, Err: err}
+}
+
+// badGateway is a 502 for a server we depend on that let us down.
+func badGateway(err error) error {
+	return &apiError{Status: http.StatusBadGateway, Code: codeUpstream, Err: err}
+}
+
+// classify turns err into an apiError, going by the storage errors it
+// wraps. Errors it knows nothing about are the server's fault.
+func classify(err error) error {
+	var ae *apiError
+	switch {
+	case errors.As(err, &ae):
+		return err
+	case errors.Is(err, ErrNotFound):
+		return &apiError{Status: http.StatusNotFound, Code: codeNotFound, Err: err}
+	case errors.Is(err, ErrExpired):
+		return &apiError{Status: http.StatusGone, Code: codeGone, Err: err}
+	case errors.Is(err, ErrConflict):
+		return &apiError{Status: http.StatusConflict, Code: codeConflict, Err: err}
+	case errors.Is(err, ErrPrecondition):
+		return &apiError{Status: http.StatusPreconditionFailed, Code: codePrecondition, Err: err}
+	case errors.Is(err, ErrVersioningDisabled):
+		return &apiError{Status: http.StatusNotImplemented, Code: codeUnimplemented, Err: err}
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrInvalidPageToken):
+		return invalidArgument(err)
+	default:
+		return &apiError{Status: http.StatusInternalServerError, Code: codeInternal, Err: err}
+	}
+}
+
+// errorCode is the code for an error answered with status that didn't say
+// which it was.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidArgument
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusGone:
+		return codeGone
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusPreconditionFailed:
+		return codePrecondition
+	case http.StatusRequestEntityTooLarge:
+		return codeTooLarge
+	case http.StatusUnsupportedMediaType:
+		return codeUnsupportedType
+	case http.StatusUnprocessableEntity:
+		return codeUnprocessable
+	case http.StatusInternalServerError:
+		return codeInternal
+	case http.StatusNotImplemented:
+		return codeUnimplemented
+	case http.StatusBadGateway:
+		return codeUpstream
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// downStorage fails to list or read anything.
+type downStorage struct {
+	*MemoryStorage
+}
+
+func (d downStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	return nil, "", errors.New("storage is down")
+}
+
+func (d downStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	return nil, errors.New("storage is down")
+}
+
+func TestClassify(t *testing.T) {
+	type test struct {
+		err    error
+		status int
+		code   string
+	}
+
+	tests := map[string]test{
+		"not found":     {err: fmt.Errorf("reading a: %w", ErrNotFound), status: http.StatusNotFound, code: codeNotFound},
+		"conflict":      {err: ErrConflict, status: http.StatusConflict, code: codeConflict},
+		"invalid name":  {err: ErrInvalidName, status: http.StatusBadRequest, code: codeInvalidArgument},
+		"invalid token": {err: ErrInvalidPageToken, status: http.StatusBadRequest, code: codeInvalidArgument},
+		"already known": {err: tooLarge(errors.New("big")), status: http.StatusRequestEntityTooLarge, code: codeTooLarge},
+		"unknown":       {err: errors.New("disk on fire"), status: http.StatusInternalServerError, code: codeInternal},
+	}
+
+	for name, c := range tests {
+		var ae *apiError
+		if !errors.As(classify(c.err), &ae) {
+			t.Fatalf("%s: expected an apiError", name)
+		}
+		if ae.Status != c.status || ae.Code != c.code {
+			t.Fatalf("%s: expected: %v %v, got: %v %v", name, c.status, c.code, ae.Status, ae.Code)
+		}
+		if ae.Error() != c.err.Error() {
+			t.Fatalf("%s: expected: %v, got: %v", name, c.err, ae)
+		}
+	}
+}
+
+func TestHandlerErrorStatus(t *testing.T) {
+	old := maxUploadBytes
+	maxUploadBytes = int64(2 * len(testPNG(t)))
+	defer func() { maxUploadBytes = old }()
+
+	type test struct {
+		name    string
+		storage Storage
+		req     func() *http.Request
+		status  int
+		// code is checked when the response has an error body.
+		code string
+	}
+
+	tests := []test{
+		{
+			name:   "list bad limit",
+			req:    func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/v1/image?limit=0", nil) },
+			status: http.StatusBadRequest, code: codeInvalidArgument,
+		},
+		{
+			name:   "list bad sort",
+			req:    func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/v1/image?sort=colour", nil) },
+			status: http.StatusBadRequest, code: codeInvalidArgument,
+		},
+		{
+			name: "list bad page token",
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/api/v1/image?sort=size&pageToken=!!!!", nil)
+			},
+			status: http.StatusBadRequest, code: codeInvalidArgument,
+		},
+		{
+			name:    "list storage down",
+			storage: downStorage{newTestMemoryStorage(t)},
+			req:     func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/v1/image", nil) },
+			status:  http.StatusInternalServerError, code: codeInternal,
+		},
+		{
+			name: "create not a form",
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/api/v1/image", strings.NewReader("just bytes"))
+			},
+			status: http.StatusBadRequest, code: codeInvalidArgument,
+		},
+		{
+			name: "create without a file",
+			req: func() *http.Request {
+				return newMultipartRequest(t, http.MethodPost, "/api/v1/image")
+			},
+			status: http.StatusBadRequest, code: codeInvalidArgument,
+		},
+		{
+			name: "create too large",
+			req: func() *http.Request {
+				return newUploadRequest(t, http.MethodPost, "/api/v1/image", "big.png", "image/png", make([]byte, 4*len(testPNG(t))))
+			},
+			status: http.StatusRequestEntityTooLarge, code: codeTooLarge,
+		},
+		{
+			name: "create bad name",
+			req: func() *http.Request {
+				return newUploadRequest(t, http.MethodPost, "/api/v1/image", "..", "image/png", testPNG(t))
+			},
+			status: http.StatusBadRequest, code: codeInvalidArgument,
+		},
+		{
+			name: "create disallowed type",
+			req: func() *http.Request {
+				return newUploadRequest(t, http.MethodPost, "/api/v1/image", "evil.exe", "image/png", []byte("MZ"))
+			},
+			status: http.StatusUnsupportedMediaType,
+		},
+		{
+			name: "create conflict",
+			req: func() *http.Request {
+				return newUploadRequest(t, http.MethodPost, "/api/v1/image?force=true", "a.png", "image/png", testPNG(t))
+			},
+			status: http.StatusConflict,
+		},
+		{
+			name:   "read missing",
+			req:    func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/v1/image/missing", nil) },
+			status: http.StatusNotFound,
+		},
+		{
+			name:    "read storage down",
+			storage: downStorage{newTestMemoryStorage(t, "a.png")},
+			req:     func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil) },
+			status:  http.StatusInternalServerError, code: codeInternal,
+		},
+		{
+			name: "update without a file",
+			req: func() *http.Request {
+				return newMultipartRequest(t, http.MethodPut, "/api/v1/image/a")
+			},
+			status: http.StatusBadRequest, code: codeInvalidArgument,
+		},
+		{
+			name: "update missing",
+			req: func() *http.Request {
+				return newUploadRequest(t, http.MethodPut, "/api/v1/image/missing", "a.png", "image/png", testPNG(t))
+			},
+			status: http.StatusNotFound,
+		},
+		{
+			name: "update disallowed type",
+			req: func() *http.Request {
+				return newUploadRequest(t, http.MethodPut, "/api/v1/image/a", "evil.exe", "image/png", []byte("MZ"))
+			},
+			status: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:   "delete missing",
+			req:    func() *http.Request { return httptest.NewRequest(http.MethodDelete, "/api/v1/image/missing", nil) },
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range tests {
+		storage := c.storage
+		if storage == nil {
+			storage = newTestMemoryStorage(t, "a.png")
+		}
+		server := NewServer(storage)
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, c.req())
+
+		if w.Code != c.status {
+			t.Fatalf("%s: expected: %v, got: %v %s", c.name, c.status, w.Code, w.Body.String())
+		}
+		if c.code == "" {
+			continue
+		}
+		got := ErrorMessage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: could not unmarshal response %q: %s", c.name, w.Body.String(), err)
+		}
+		if got.Code != c.code {
+			t.Fatalf("%s: expected: %v, got: %v", c.name, c.code, got.Code)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"scalar-attempt/api"
+)
+
+// The image routes are served under both prefixes. v1 answers as it always
+// has, for the demo frontends; v2 answers the same requests with the same
+// handlers, but wraps what they write in an Envelope.
+const (
+	v1ImagePath = "/api/v1/image"
+	v2ImagePath = "/api/v2/image"
+)
+
+// The codes v2 gives errors v1 answers without one. v1 bodies keep going
+// without them.
+const (
+	codeUnauthenticated  = "unauthenticated"
+	codePermissionDenied = "permission_denied"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeRateLimited      = "rate_limited"
+	codeUnknown          = "unknown"
+)
+
+// Envelope and its parts are shared with clients of the API.
+type (
+	Envelope      = api.Envelope
+	EnvelopeError = api.EnvelopeError
+	EnvelopeMeta  = api.EnvelopeMeta
+)
+
+// isV2 reports whether path is one of the /api/v2/image routes: the
+// collection itself, an image below it, or a custom method on it.
+func isV2(path string) bool {
+	rest := strings.TrimPrefix(path, v2ImagePath)
+	return len(rest) < len(path) && (rest == "" || rest[0] == '/' || rest[0] == ':')
+}
+
+// apiV2 serves /api/v2/image by handing the request on as the matching
+// /api/v1/image one, so that every route and middleware serves both, and
+// putting what comes back in an Envelope.
+func (s *Server) apiV2(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isV2(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		list := r.Method == http.MethodGet && r.URL.Path == v2ImagePath
+		v1 := r.WithContext(r.Context())
+		u := *r.URL
+		u.Path = v1ImagePath + strings.TrimPrefix(u.Path, v2ImagePath)
+		if u.RawPath != "" {
+			u.RawPath = v1ImagePath + strings.TrimPrefix(u.RawPath, v2ImagePath)
+		}
+		v1.URL = &u
+
+		ew := &envelopeWriter{ResponseWriter: w, list: list, requestID: requestIDFrom(r.Context())}
+		defer ew.Close()
+		next.ServeHTTP(ew, v1)
+	})
+}
+
+// envelopeWriter holds back a JSON response, or one with no content, and
+// sends it on in an Envelope once the handler is done. Anything else, such
+// as the bytes of an image or an NDJSON listing, goes straight through.
+type envelopeWriter struct {
+	http.ResponseWriter
+	list      bool
+	requestID string
+
+	status    int
+	buffering bool
+	buf       []byte
+}
+
+func (ew *envelopeWriter) WriteHeader(status int) {
+	if ew.status != 0 {
+		return
+	}
+	ew.status = status
+
+	h := ew.Header()
+	for _, name := range []string{"Location", "Content-Location"} {
+		if l := h.Get(name); strings.HasPrefix(l, v1ImagePath) {
+			h.Set(name, v2ImagePath+strings.TrimPrefix(l, v1ImagePath))
+		}
+	}
+
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if status == http.StatusNoContent || (status != http.StatusNotModified && mt == "application/json") {
+		ew.buffering = true
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *envelopeWriter) Write(p []byte) (int, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.buffering {
+		ew.buf = append(ew.buf, p...)
+		return len(p), nil
+	}
+
+	return ew.ResponseWriter.Write(p)
+}
+
+// Flush passes a streamed response on as it comes. A response held back
+// for its envelope can't be flushed until it is complete.
+func (ew *envelopeWriter) Flush() {
+	if ew.buffering {
+		return
+	}
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (ew *envelopeWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// Close sends the response that was held back, in its envelope.
+func (ew *envelopeWriter) Close() {
+	if !ew.buffering {
+		return
+	}
+	ew.buffering = false
+	body := ew.buf
+	ew.buf = nil
+
+	// A body that isn't JSON after all is sent as it is rather than
+	// mangled.
+	if len(body) > 0 && !json.Valid(body) {
+		ew.ResponseWriter.WriteHeader(ew.status)
+		ew.ResponseWriter.Write(body)
+		return
+	}
+
+	status := ew.status
+	if status == http.StatusNoContent {
+		status = http.StatusOK
+	}
+	env := ew.envelope(status, body)
+	b, err := env.JSONBytes()
+	if err != nil {
+		weblog(err.Error())
+		status = http.StatusInternalServerError
+		b = []byte(`{"data":null,"error":{"code":"internal","message":"could not write response"},"meta":{}}`)
+	}
+
+	h := ew.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	ew.ResponseWriter.WriteHeader(status)
+	ew.ResponseWriter.Write(b)
+}
+
+// envelope puts body, a v1 response sent with status, in an Envelope.
+func (ew *envelopeWriter) envelope(status int, body []byte) Envelope {
+	env := Envelope{Data: json.RawMessage("null"), Meta: EnvelopeMeta{RequestID: ew.Header().Get(requestIDHeader)}}
+	if env.Meta.RequestID == "" {
+		env.Meta.RequestID = ew.requestID
+	}
+
+	// The fields of the v1 bodies the envelope takes apart: ErrorMessage,
+	// Message and InvalidType for errors, and ImagePage for listings.
+	var v1 struct {
+		Error         string          `json:"error"`
+		Code          string          `json:"code"`
+		Text          string          `json:"text"`
+		Details       string          `json:"details"`
+		Images        json.RawMessage `json:"images"`
+		NextPageToken string          `json:"nextPageToken"`
+		Folders       []string        `json:"folders"`
+	}
+	if len(body) > 0 {
+		json.Unmarshal(body, &v1)
+	}
+
+	if status >= http.StatusBadRequest {
+		e := &EnvelopeError{Code: v1.Code, Message: v1.Error, Details: v1.Details}
+		if e.Code == "" {
+			e.Code = envelopeCode(status)
+		}
+		if e.Message == "" {
+			e.Message = v1.Text
+		}
+		if e.Message == "" {
+			e.Message = http.StatusText(status)
+		}
+		env.Error = e
+		return env
+	}
+
+	if ew.list {
+		env.Data = v1.Images
+		if len(env.Data) == 0 || string(env.Data) == "null" {
+			env.Data = json.RawMessage("[]")
+		}
+		env.Meta.NextPageToken = &v1.NextPageToken
+		env.Meta.Folders = v1.Folders
+		return env
+	}
+	if len(body) > 0 {
+		env.Data = body
+	}
+
+	return env
+}
+
+// envelopeCode is the code for an error answered with status that didn't
+// say which it was.
+func envelopeCode(status int) string {
+	if code := errorCode(status); code != "" {
+		return code
+	}
+
+	switch status {
+	case http.StatusUnauthorized:
+		return codeUnauthenticated
+	case http.StatusForbidden:
+		return codePermissionDenied
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	default:
+		return codeUnknown
+	}
+}
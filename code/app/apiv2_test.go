@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serveV2 sends a request to server and decodes the envelope it answers
+// with.
+func serveV2(t *testing.T, server http.Handler, method, target string) (*httptest.ResponseRecorder, Envelope) {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set(requestIDHeader, "req-1")
+	w := httptest.NewRecorder()
+	requestID(server).ServeHTTP(w, r)
+
+	var env Envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("%s %s: expected an envelope, got: %q", method, target, w.Body.String())
+	}
+	if env.Meta.RequestID != "req-1" {
+		t.Fatalf("%s %s: expected the request id, got: %+v", method, target, env.Meta)
+	}
+
+	return w, env
+}
+
+func TestV2List(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png", "b.png", "c.png"))
+
+	w, env := serveV2(t, server, http.MethodGet, "/api/v2/image?limit=2")
+	if w.Code != http.StatusOK || env.Error != nil {
+		t.Fatalf("expected: %v, got: %v %+v", http.StatusOK, w.Code, env.Error)
+	}
+	var images Images
+	if err := json.Unmarshal(env.Data, &images); err != nil || len(images) != 2 || images[0].Name != "a" {
+		t.Fatalf("expected a and b, got: %s", env.Data)
+	}
+	if env.Meta.NextPageToken == nil || *env.Meta.NextPageToken == "" {
+		t.Fatalf("expected a next page token, got: %+v", env.Meta)
+	}
+
+	_, env = serveV2(t, server, http.MethodGet, "/api/v2/image?limit=2&pageToken="+*env.Meta.NextPageToken)
+	if env.Meta.NextPageToken == nil || *env.Meta.NextPageToken != "" {
+		t.Fatalf("expected the last page to say so, got: %+v", env.Meta)
+	}
+
+	// Lists always have pagination metadata, even when empty.
+	_, env = serveV2(t, NewServer(NewMemoryStorage()), http.MethodGet, "/api/v2/image")
+	if string(env.Data) != "[]" || env.Meta.NextPageToken == nil {
+		t.Fatalf("expected an empty page, got: %s %+v", env.Data, env.Meta)
+	}
+}
+
+func TestV2Image(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png", "b.png"))
+
+	w, env := serveV2(t, server, http.MethodGet, "/api/v2/image/a")
+	var img Image
+	if err := json.Unmarshal(env.Data, &img); w.Code != http.StatusOK || err != nil || img.Name != "a" {
+		t.Fatalf("expected a, got: %v %s", w.Code, env.Data)
+	}
+	if env.Meta.NextPageToken != nil {
+		t.Fatalf("expected no pagination for a single image, got: %+v", env.Meta)
+	}
+
+	// Deleting has no content in v1, which v2 sends as null data.
+	w, env = serveV2(t, server, http.MethodDelete, "/api/v2/image/b")
+	if w.Code != http.StatusOK || string(env.Data) != "null" || env.Error != nil {
+		t.Fatalf("expected: %v, got: %v %q", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// The bytes of an image aren't wrapped.
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/image/a/content", nil)
+	rw := httptest.NewRecorder()
+	server.ServeHTTP(rw, r)
+	if rw.Code != http.StatusOK || !bytes.Equal(rw.Body.Bytes(), testPNG(t)) {
+		t.Fatalf("expected the original, got: %v %d bytes", rw.Code, rw.Body.Len())
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	server.RequireAPIKey([]string{"secret"}, false)
+
+	tests := map[string]struct {
+		method, target string
+		status         int
+		code           string
+	}{
+		"missing":        {http.MethodGet, "/api/v2/image/nope", http.StatusNotFound, codeNotFound},
+		"bad page token": {http.MethodGet, "/api/v2/image?pageToken=???", http.StatusBadRequest, codeInvalidArgument},
+		"no key":         {http.MethodDelete, "/api/v2/image/a", http.StatusUnauthorized, codeUnauthenticated},
+	}
+	for name, test := range tests {
+		w, env := serveV2(t, server, test.method, test.target)
+		if w.Code != test.status || env.Error == nil || env.Error.Code != test.code || env.Error.Message == "" {
+			t.Errorf("%s: expected: %v %s, got: %v %q", name, test.status, test.code, w.Code, w.Body.String())
+		}
+		if string(env.Data) != "null" {
+			t.Errorf("%s: expected no data, got: %s", name, env.Data)
+		}
+	}
+}
+
+func TestV1Unchanged(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	var page ImagePage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Images) != 1 || bytes.Contains(w.Body.Bytes(), []byte(`"meta"`)) {
+		t.Fatalf("expected a v1 page, got: %q", w.Body.String())
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// apiKeyHeader carries the key callers authenticate with.
+const apiKeyHeader = "X-API-Key"
+
+// ErrUnauthorized is returned to callers without a valid API key.
+var ErrUnauthorized = errors.New("a valid API key is required")
+
+// errNoAdminKeys is returned by the admin endpoints when there are no API
+// keys to let anyone in with.
+var errNoAdminKeys = errors.New("this endpoint is only served with API_KEYS set")
+
+// RequireAPIKey turns away API requests that don't carry one of keys in the
+// X-API-Key header. Only requests that change images need one unless reads
+// is set. The static files and health endpoints are always open, as are
+// Cloud Storage notifications, which Pub/Sub can't put a key on.
+func (s *Server) RequireAPIKey(keys []string, reads bool) {
+	// Keys are compared by hash so the comparison takes as long whatever
+	// the length of the key offered.
+	sums := make([][sha256.Size]byte, len(keys))
+	for i, k := range keys {
+		sums[i] = sha256.Sum256([]byte(k))
+	}
+
+	s.keyForReads = reads
+	s.validKey = func(key string) bool {
+		sum := sha256.Sum256([]byte(key))
+		ok := 0
+		for i := range sums {
+			ok |= subtle.ConstantTimeCompare(sum[:], sums[i][:])
+		}
+		return ok == 1
+	}
+
+	s.router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isStatic(r) || r.Method == http.MethodOptions || r.URL.Path == gcsEventsPath || (!reads && isRead(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if key := r.Header.Get(apiKeyHeader); key == "" || !s.validKey(key) {
+				writeErrorMsg(w, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// requireAdminKey checks that r carries a valid API key, which the admin
+// endpoints need even when reads don't. Without API_KEYS they aren't
+// served at all. It reports whether r may go on, having written a 404 or
+// 401 if not.
+func (s *Server) requireAdminKey(w http.ResponseWriter, r *http.Request) bool {
+	if s.validKey == nil {
+		writeErrorMsg(w, http.StatusNotFound, errNoAdminKeys)
+		return false
+	}
+	if key := r.Header.Get(apiKeyHeader); key == "" || !s.validKey(key) {
+		writeErrorMsg(w, http.StatusUnauthorized, ErrUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// isStatic reports whether r was routed to the static file catch-all.
+func isStatic(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+
+	tpl, err := route.GetPathTemplate()
+	return err == nil && tpl == "/"
+}
+
+// isRead reports whether r only looks at images. Verifying an image,
+// taking in a notification and GraphQL queries are POSTs, but only read
+// them; GraphQL mutations are checked by their handler.
+func isRead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead ||
+		(r.Method == http.MethodPost && (strings.HasSuffix(r.URL.Path, ":verify") || r.URL.Path == gcsEventsPath || r.URL.Path == graphqlPath))
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	type test struct {
+		method string
+		target string
+		key    string
+		reads  bool
+		want   int
+	}
+
+	tests := []test{
+		{method: http.MethodDelete, target: "/api/v1/image/a", want: http.StatusUnauthorized},
+		{method: http.MethodDelete, target: "/api/v1/image/a", key: "wrong", want: http.StatusUnauthorized},
+		{method: http.MethodDelete, target: "/api/v1/image/a", key: "secret", want: http.StatusNoContent},
+		{method: http.MethodDelete, target: "/api/v1/image/a", key: "other", want: http.StatusNoContent},
+		{method: http.MethodPost, target: "/api/v1/trash/a:restore", want: http.StatusUnauthorized},
+		{method: http.MethodGet, target: "/api/v1/image", want: http.StatusOK},
+		{method: http.MethodGet, target: "/api/v1/image", reads: true, want: http.StatusUnauthorized},
+		{method: http.MethodGet, target: "/api/v1/image", key: "secret", reads: true, want: http.StatusOK},
+		{method: http.MethodGet, target: "/healthz", reads: true, want: http.StatusOK},
+		{method: http.MethodGet, target: "/", reads: true, want: http.StatusOK},
+	}
+
+	for _, c := range tests {
+		server := NewServer(newTestMemoryStorage(t, "a.png"))
+		server.RequireAPIKey([]string{"secret", "other"}, c.reads)
+
+		r := httptest.NewRequest(c.method, c.target, nil)
+		if c.key != "" {
+			r.Header.Set(apiKeyHeader, c.key)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("%s %s with key %q expected: %v, got: %v", c.method, c.target, c.key, c.want, w.Code)
+		}
+
+		if w.Code == http.StatusUnauthorized {
+			var msg ErrorMessage
+			if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+				t.Fatalf("expected a JSON error, got: %s", w.Body.String())
+			}
+		}
+	}
+}
+
+func TestRequireAdminKey(t *testing.T) {
+	for _, target := range []struct{ method, path string }{
+		{http.MethodGet, "/api/v1/admin/config"},
+		{http.MethodPost, modePath},
+		{http.MethodPost, cleanupPath},
+	} {
+		// Without API keys, nobody gets in.
+		server := NewServer(newTestMemoryStorage(t))
+		server.ServeConfig(Config{})
+		r := httptest.NewRequest(target.method, target.path, nil)
+		r.Header.Set(apiKeyHeader, "secret")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s %s expected: %v, got: %v", target.method, target.path, http.StatusNotFound, w.Code)
+		}
+
+		// Even when reads don't need one, these do.
+		server.RequireAPIKey([]string{"secret"}, false)
+		for _, key := range []string{"", "wrong"} {
+			r := httptest.NewRequest(target.method, target.path, nil)
+			if key != "" {
+				r.Header.Set(apiKeyHeader, key)
+			}
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("%s %s with key %q expected: %v, got: %v", target.method, target.path, key, http.StatusUnauthorized, w.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxBatchDelete caps how many ids one batch delete can name.
+var maxBatchDelete = 100
+
+// batchDeleteWorkers is how many deletes a batch runs at once.
+const batchDeleteWorkers = 8
+
+const (
+	deleteStatusDeleted  = "deleted"
+	deleteStatusNotFound = "not found"
+	deleteStatusError    = "error"
+)
+
+// BatchDeleteRequest names the images to delete. Filenames are accepted
+// too, and resolve to the id they were uploaded as.
+type BatchDeleteRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// DeleteResult is the outcome of deleting one image in a batch.
+type DeleteResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchDeleteResults is the response to a batch delete, with results in the
+// order the ids were given.
+type BatchDeleteResults struct {
+	Deleted  int            `json:"deleted"`
+	NotFound int            `json:"notFound"`
+	Failed   int            `json:"failed"`
+	Results  []DeleteResult `json:"results"`
+}
+
+// JSON marshalls the content of BatchDeleteResults to json.
+func (b BatchDeleteResults) JSON() (string, error) {
+	bytes, err := json.Marshal(b)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of BatchDeleteResults to json.
+func (b BatchDeleteResults) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(b)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+func (s *Server) batchDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	req := BatchDeleteRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxBatchDelete {
+		writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("want 1 to %d ids, got: %d", maxBatchDelete, len(req.IDs)))
+		return
+	}
+
+	results := make([]DeleteResult, len(req.IDs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < batchDeleteWorkers && n < len(req.IDs); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = s.batchDeleteOne(r.Context(), req.IDs[i])
+			}
+		}()
+	}
+	for i := range req.IDs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	resp := BatchDeleteResults{Results: results}
+	for _, res := range results {
+		switch res.Status {
+		case deleteStatusDeleted:
+			resp.Deleted++
+		case deleteStatusNotFound:
+			resp.NotFound++
+		default:
+			resp.Failed++
+		}
+	}
+
+	writeJSON(w, resp, http.StatusOK)
+}
+
+// batchDeleteOne deletes the image id names, falling back to treating it as
+// a filename if there is no image with that exact id.
+func (s *Server) batchDeleteOne(ctx context.Context, id string) DeleteResult {
+	deleted := id
+	err := s.deleteImage(ctx, deleted, 0)
+	if err == ErrNotFound && imageID(id) != id {
+		deleted = imageID(id)
+		err = s.deleteImage(ctx, deleted, 0)
+	}
+
+	switch {
+	case err == nil:
+		s.notify(ctx, ImageEvent{Action: actionDeleted, ID: deleted})
+		return DeleteResult{ID: id, Status: deleteStatusDeleted}
+	case err == ErrNotFound:
+		return DeleteResult{ID: id, Status: deleteStatusNotFound}
+	default:
+		weblog(fmt.Sprintf("error deleting %s: %s", id, err))
+		return DeleteResult{ID: id, Status: deleteStatusError, Error: err.Error()}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// brokenDeleteStorage fails to delete one particular image.
+type brokenDeleteStorage struct {
+	*MemoryStorage
+	broken string
+}
+
+func (b brokenDeleteStorage) Delete(ctx context.Context, id string, generation int64) error {
+	if id == b.broken {
+		return errors.New("storage is having a bad day")
+	}
+
+	return b.MemoryStorage.Delete(ctx, id, generation)
+}
+
+func TestBatchDelete(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png", "c.png", "v1.2.png")
+	server := NewServer(brokenDeleteStorage{ms, "c"})
+
+	body := `{"ids": ["a.png", "b", "c", "missing", "v1.2"]}`
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/image:batchDelete", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	got := BatchDeleteResults{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+
+	want := BatchDeleteResults{
+		Deleted:  3,
+		NotFound: 1,
+		Failed:   1,
+		Results: []DeleteResult{
+			{ID: "a.png", Status: deleteStatusDeleted},
+			{ID: "b", Status: deleteStatusDeleted},
+			{ID: "c", Status: deleteStatusError, Error: "storage is having a bad day"},
+			{ID: "missing", Status: deleteStatusNotFound},
+			{ID: "v1.2", Status: deleteStatusDeleted},
+		},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected: %+v, got: %+v", want, got)
+	}
+
+	fs, _, err := ms.List(context.Background(), "", 100, "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(fs) != filesPerImage || !strings.HasPrefix(fs[0].Name, "processed/c/") {
+		t.Fatalf("expected only c to be left, got: %v", fs)
+	}
+}
+
+func TestBatchDeleteBadRequest(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	tooMany := make([]string, maxBatchDelete+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%q", fmt.Sprint(i))
+	}
+
+	for _, body := range []string{`not json`, `{"ids": []}`, `{"ids": [` + strings.Join(tooMany, ",") + `]}`} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/image:batchDelete", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// actionReset tells a subscriber that changes were missed, so that what it
+// knows of the images has to be read afresh.
+const actionReset = "reset"
+
+// eventBufferSize is how many changes a subscriber can fall behind by
+// before it is dropped for being too slow.
+const eventBufferSize = 64
+
+// eventReplayWindow is how many of the latest changes are kept for those
+// who come back after missing them.
+const eventReplayWindow = 256
+
+// errBusClosed is returned to those subscribing once the server is
+// shutting down.
+var errBusClosed = errors.New("server is shutting down")
+
+// busEvent is a change to an image as it is handed to subscribers.
+type busEvent struct {
+	seq    uint64
+	scope  string
+	action string
+	image  Image
+}
+
+// subscriber follows the changes in one scope. Its events are closed once
+// it is unsubscribed or dropped, with evicted set if it was dropped for
+// falling behind.
+type subscriber struct {
+	scope   string
+	events  chan busEvent
+	evicted bool
+}
+
+// eventBus hands every change made through this process to those following
+// the scope it was made in, the tenant and user, and keeps the latest for
+// those who come back after missing them. Its zero value is ready to use.
+type eventBus struct {
+	mu     sync.Mutex
+	epoch  string
+	seq    uint64
+	recent []busEvent
+	subs   map[*subscriber]bool
+	closed bool
+}
+
+// init makes up the epoch that tells the ids of this process apart from
+// those of any other. It must be called with mu held.
+func (b *eventBus) init() {
+	if b.epoch == "" {
+		b.epoch = uuid.NewString()[:8]
+		b.subs = map[*subscriber]bool{}
+	}
+}
+
+// id is how the change numbered seq is known to clients.
+func (b *eventBus) id(seq uint64) string {
+	return fmt.Sprintf("%s-%d", b.epoch, seq)
+}
+
+// publish hands a change to img in scope to its subscribers. One whose
+// buffer is full is dropped rather than holding up the rest, as it can
+// catch up from the replay window once it comes back.
+func (b *eventBus) publish(scope, action string, img Image) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.init()
+	b.seq++
+	e := busEvent{seq: b.seq, scope: scope, action: action, image: img}
+	b.recent = append(b.recent, e)
+	if len(b.recent) > eventReplayWindow {
+		b.recent = b.recent[len(b.recent)-eventReplayWindow:]
+	}
+
+	for sub := range b.subs {
+		if sub.scope != scope {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			sub.evicted = true
+			b.drop(sub)
+		}
+	}
+}
+
+// subscribe follows the changes in scope. Those after lastID, the id of the
+// last change the caller saw if it had subscribed before, are returned to
+// be handed on ahead of the rest. If some of them are no longer kept, or
+// lastID is from another process, a single reset stands in for them.
+func (b *eventBus) subscribe(scope, lastID string) (*subscriber, []busEvent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil, errBusClosed
+	}
+	b.init()
+	sub := &subscriber{scope: scope, events: make(chan busEvent, eventBufferSize)}
+	b.subs[sub] = true
+
+	if lastID == "" {
+		return sub, nil, nil
+	}
+	seq, ok := b.parseID(lastID)
+	switch {
+	case !ok || seq > b.seq:
+		return sub, []busEvent{{seq: b.seq, scope: scope, action: actionReset}}, nil
+	case seq < b.seq && (len(b.recent) == 0 || b.recent[0].seq > seq+1):
+		return sub, []busEvent{{seq: b.seq, scope: scope, action: actionReset}}, nil
+	}
+
+	var missed []busEvent
+	for _, e := range b.recent {
+		if e.seq > seq && e.scope == scope {
+			missed = append(missed, e)
+		}
+	}
+	return sub, missed, nil
+}
+
+// parseID returns the number of the change id names, if it is one of this
+// process's.
+func (b *eventBus) parseID(id string) (uint64, bool) {
+	epoch, n, ok := strings.Cut(id, "-")
+	if !ok || epoch != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(n, 10, 64)
+	return seq, err == nil
+}
+
+// latest returns the last change to image id in scope that is still kept,
+// if there is one.
+func (b *eventBus) latest(scope, id string) (busEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := len(b.recent) - 1; i >= 0; i-- {
+		if e := b.recent[i]; e.scope == scope && e.image.ID == id {
+			return e, true
+		}
+	}
+	return busEvent{}, false
+}
+
+// unsubscribe stops sub following changes, if it hasn't been dropped
+// already.
+func (b *eventBus) unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs[sub] {
+		b.drop(sub)
+	}
+}
+
+// drop removes sub and closes its events. It must be called with mu held.
+func (b *eventBus) drop(sub *subscriber) {
+	delete(b.subs, sub)
+	close(sub.events)
+}
+
+// close drops every subscriber and turns away any more, so that streams
+// end when the server shuts down rather than holding it up.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		b.drop(sub)
+	}
+}
+
+// CloseEvents ends every stream of changes, for when the server is shutting
+// down.
+func (s *Server) CloseEvents() {
+	s.events.close()
+}
+
+// broadcast hands e to the bus along with the image it is about, read
+// afresh if the caller didn't have it. A deleted image is only known by
+// its id.
+func (s *Server) broadcast(ctx context.Context, e ImageEvent) {
+	img := Image{ID: e.ID, Name: e.ID}
+	switch {
+	case e.image != nil:
+		img = *e.image
+	case e.Action != actionDeleted:
+		fs, err := s.storage.Read(ctx, e.ID)
+		if err != nil {
+			weblog(fmt.Sprintf("error reading %s for its %s event: %s", e.ID, e.Action, err))
+			break
+		}
+		if is, _ := NewImages(fs); len(is) > 0 {
+			img = is[0]
+		}
+	}
+
+	s.events.publish(scopeOf(ctx), e.Action, img)
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBusScope(t *testing.T) {
+	b := &eventBus{}
+	sub, missed, err := b.subscribe("t/", "")
+	if err != nil || len(missed) > 0 {
+		t.Fatalf("expected a fresh subscription, got: %v %v", missed, err)
+	}
+	defer b.unsubscribe(sub)
+
+	b.publish("other/", actionCreated, Image{ID: "x"})
+	b.publish("t/", actionCreated, Image{ID: "a"})
+	if e := <-sub.events; e.action != actionCreated || e.image.ID != "a" {
+		t.Fatalf("expected a to be created, got: %+v", e)
+	}
+	if len(sub.events) > 0 {
+		t.Fatalf("expected changes in other scopes to be left out, got: %+v", <-sub.events)
+	}
+}
+
+func TestBusReplay(t *testing.T) {
+	b := &eventBus{}
+	for _, id := range []string{"a", "b", "c"} {
+		b.publish("t/", actionCreated, Image{ID: id})
+	}
+	b.publish("other/", actionDeleted, Image{ID: "x"})
+
+	sub, missed, _ := b.subscribe("t/", b.id(1))
+	b.unsubscribe(sub)
+	if len(missed) != 2 || missed[0].image.ID != "b" || missed[1].image.ID != "c" {
+		t.Fatalf("expected b and c to be replayed, got: %+v", missed)
+	}
+	if _, missed, _ := b.subscribe("t/", b.id(4)); len(missed) != 0 {
+		t.Fatalf("expected nothing missed, got: %+v", missed)
+	}
+
+	for i := 0; i < eventReplayWindow; i++ {
+		b.publish("t/", actionUpdated, Image{ID: "a"})
+	}
+	for _, last := range []string{b.id(1), "elsewhere-3", b.id(b.seq + 1), "junk"} {
+		sub, missed, _ := b.subscribe("t/", last)
+		b.unsubscribe(sub)
+		if len(missed) != 1 || missed[0].action != actionReset || missed[0].seq != b.seq {
+			t.Fatalf("Last-Event-ID %s: expected a reset, got: %+v", last, missed)
+		}
+	}
+}
+
+func TestBusEviction(t *testing.T) {
+	b := &eventBus{}
+	slow, _, _ := b.subscribe("t/", "")
+	fast, _, _ := b.subscribe("t/", "")
+	defer b.unsubscribe(fast)
+
+	for i := 0; i <= eventBufferSize; i++ {
+		b.publish("t/", actionCreated, Image{ID: fmt.Sprint(i)})
+		<-fast.events
+	}
+
+	n := 0
+	for range slow.events {
+		n++
+	}
+	if n != eventBufferSize || !slow.evicted {
+		t.Fatalf("expected the slow subscriber to be dropped after %d events, got %d", eventBufferSize, n)
+	}
+	if fast.evicted || len(b.subs) != 1 {
+		t.Fatalf("expected the fast subscriber to be kept")
+	}
+	// Unsubscribing once dropped is harmless.
+	b.unsubscribe(slow)
+}
+
+func TestBusClose(t *testing.T) {
+	b := &eventBus{}
+	sub, _, _ := b.subscribe("t/", "")
+	b.close()
+
+	if _, ok := <-sub.events; ok || sub.evicted {
+		t.Fatalf("expected the subscriber to be let go")
+	}
+	if _, _, err := b.subscribe("t/", ""); err != errBusClosed {
+		t.Fatalf("expected: %v, got: %v", errBusClosed, err)
+	}
+	b.publish("t/", actionCreated, Image{ID: "a"})
+	b.unsubscribe(sub)
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// chaosPath is where chaos is configured. It is never slowed down or
+// failed itself, so that chaos can always be turned off again.
+const chaosPath = "/api/v1/admin/chaos"
+
+// maxChaosLatency bounds the delay chaos can add to a request.
+const maxChaosLatency = time.Minute
+
+// maxChaosBodyBytes bounds the body of a chaos config.
+const maxChaosBodyBytes = 16 << 10
+
+// ChaosConfig says how requests should misbehave. Requests to paths
+// starting with one of Paths, or to any path if there are none, are
+// delayed by between MinLatency and MaxLatency and then fail with a 503
+// one time in 1/ErrorRate.
+type ChaosConfig struct {
+	ErrorRate  float64  `json:"errorRate"`
+	MinLatency string   `json:"minLatency,omitempty"`
+	MaxLatency string   `json:"maxLatency,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+}
+
+// JSON marshalls the content of ChaosConfig to json.
+func (c ChaosConfig) JSON() (string, error) {
+	bytes, err := c.JSONBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of ChaosConfig to json.
+func (c ChaosConfig) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// chaosRules is a ChaosConfig checked and ready to apply.
+type chaosRules struct {
+	config   ChaosConfig
+	min, max time.Duration
+}
+
+// chaos holds the rules in force, or nil for none.
+type chaos struct {
+	rules atomic.Pointer[chaosRules]
+}
+
+// EnableChaos lets /api/v1/admin/chaos make requests slow or fail on
+// purpose. Until it is called the endpoint answers 404 and requests don't
+// pass through chaos at all.
+func (s *Server) EnableChaos() {
+	s.chaos = &chaos{}
+	s.Use(s.chaos.middleware)
+}
+
+// newChaosRules checks c, filling in whichever of the latencies is missing
+// from the other.
+func newChaosRules(c ChaosConfig) (*chaosRules, error) {
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return nil, fmt.Errorf("invalid errorRate %v: want a number from 0 to 1", c.ErrorRate)
+	}
+
+	rules := &chaosRules{config: c}
+	for _, l := range []struct {
+		name string
+		v    string
+		d    *time.Duration
+	}{{"minLatency", c.MinLatency, &rules.min}, {"maxLatency", c.MaxLatency, &rules.max}} {
+		if l.v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(l.v)
+		if err != nil || d < 0 || d > maxChaosLatency {
+			return nil, fmt.Errorf("invalid %s %q: want a duration like 200ms, at most %s", l.name, l.v, maxChaosLatency)
+		}
+		*l.d = d
+	}
+	if c.MaxLatency == "" {
+		rules.max = rules.min
+	}
+	if rules.max < rules.min {
+		return nil, fmt.Errorf("invalid maxLatency %q: want at least minLatency %q", c.MaxLatency, c.MinLatency)
+	}
+
+	for _, p := range c.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("invalid path %q: want a path starting with /", p)
+		}
+	}
+
+	return rules, nil
+}
+
+// applies reports whether the rules cover path.
+func (r *chaosRules) applies(path string) bool {
+	if strings.HasPrefix(path, chaosPath) {
+		return false
+	}
+	if len(r.config.Paths) == 0 {
+		return true
+	}
+
+	for _, p := range r.config.Paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay picks how long to hold a request up for.
+func (r *chaosRules) delay() time.Duration {
+	if r.max == r.min {
+		return r.min
+	}
+
+	return r.min + time.Duration(rand.Int63n(int64(r.max-r.min)+1))
+}
+
+func (c *chaos) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := c.rules.Load()
+		if rules == nil || !rules.applies(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if d := rules.delay(); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				// The caller gave up, so there's no one to answer.
+				t.Stop()
+				return
+			}
+		}
+
+		if rules.config.ErrorRate > 0 && rand.Float64() < rules.config.ErrorRate {
+			writeErrorMsg(w, http.StatusServiceUnavailable, errors.New("failed on purpose by chaos"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// chaosHandler shows the chaos in force, replaces it or, with a DELETE,
+// stops it.
+func (s *Server) chaosHandler(w http.ResponseWriter, r *http.Request) {
+	if s.chaos == nil {
+		writeErrorMsg(w, http.StatusNotFound, errors.New("chaos not enabled, set ENABLE_CHAOS=true"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		c := ChaosConfig{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxChaosBodyBytes)).Decode(&c); err != nil {
+			writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+			return
+		}
+		rules, err := newChaosRules(c)
+		if err != nil {
+			writeError(w, invalidArgument(err))
+			return
+		}
+		s.chaos.rules.Store(rules)
+		logJSON(SeverityWarning, LogEntry{Message: fmt.Sprintf("chaos set to error rate %v, latency %s to %s, paths %v", c.ErrorRate, rules.min, rules.max, c.Paths)})
+	case http.MethodDelete:
+		s.chaos.rules.Store(nil)
+		logJSON(SeverityWarning, LogEntry{Message: "chaos reset"})
+	}
+
+	c := ChaosConfig{}
+	if rules := s.chaos.rules.Load(); rules != nil {
+		c = rules.config
+	}
+	writeJSON(w, c, http.StatusOK)
+}
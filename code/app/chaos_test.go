@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func chaosRequest(t *testing.T, server *Server, method, body string) ChaosConfig {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(method, chaosPath, strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s expected: %v, got: %v %s", method, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	c := ChaosConfig{}
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	return c
+}
+
+func TestChaosDisabled(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, chaosPath, strings.NewReader(`{"errorRate": 1}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	server.EnableChaos()
+
+	if c := chaosRequest(t, server, http.MethodGet, ""); c.ErrorRate != 0 || len(c.Paths) != 0 {
+		t.Fatalf("expected no chaos to start with, got: %+v", c)
+	}
+
+	c := chaosRequest(t, server, http.MethodPost, `{"errorRate": 1, "paths": ["/api/v1/image"]}`)
+	if c.ErrorRate != 1 || len(c.Paths) != 1 {
+		t.Fatalf("expected the config back, got: %+v", c)
+	}
+	if got := chaosRequest(t, server, http.MethodGet, ""); got.ErrorRate != 1 {
+		t.Fatalf("expected the config to be kept, got: %+v", got)
+	}
+
+	for target, status := range map[string]int{
+		"/api/v1/image":   http.StatusServiceUnavailable,
+		"/api/v1/image/a": http.StatusServiceUnavailable,
+		"/api/v1/stats":   http.StatusOK,
+		"/healthz":        http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != status {
+			t.Fatalf("%s expected: %v, got: %v", target, status, w.Code)
+		}
+	}
+
+	chaosRequest(t, server, http.MethodPost, `{"minLatency": "50ms", "maxLatency": "60ms"}`)
+	start := time.Now()
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Fatalf("expected the request to be delayed, took: %s", took)
+	}
+
+	if c := chaosRequest(t, server, http.MethodDelete, ""); c.ErrorRate != 0 || c.MinLatency != "" {
+		t.Fatalf("expected the config to be reset, got: %+v", c)
+	}
+}
+
+func TestChaosInvalid(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	server.EnableChaos()
+
+	for _, body := range []string{
+		`{"errorRate": 1.5}`,
+		`{"errorRate": -0.1}`,
+		`{"minLatency": "soon"}`,
+		`{"minLatency": "2s", "maxLatency": "1s"}`,
+		`{"maxLatency": "1h"}`,
+		`{"paths": ["api/v1/image"]}`,
+		`{"errorRate": `,
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, chaosPath, strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s expected: %v, got: %v", body, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// hashHeader gives the checksums of content that is served, in the form
+// Cloud Storage uses, like crc32c=n03x6A==,md5=Ojk9c3dhfxgoKVVHYwFbHQ==.
+const hashHeader = "X-Goog-Hash"
+
+// castagnoli is the table CRC32C is computed with.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksums are those of an object's contents, base64 encoded as Cloud
+// Storage reports them. Either can be missing: composite objects have no
+// MD5, and files stored on disk no CRC32C.
+type Checksums struct {
+	MD5    string `json:"md5,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// newChecksums encodes md5 and, when hasCRC32C is set, crc32c.
+func newChecksums(md5 []byte, crc32c uint32, hasCRC32C bool) Checksums {
+	c := Checksums{}
+	if len(md5) > 0 {
+		c.MD5 = base64.StdEncoding.EncodeToString(md5)
+	}
+	if hasCRC32C {
+		b := []byte{byte(crc32c >> 24), byte(crc32c >> 16), byte(crc32c >> 8), byte(crc32c)}
+		c.CRC32C = base64.StdEncoding.EncodeToString(b)
+	}
+
+	return c
+}
+
+// sumContents computes both checksums of what r reads.
+func sumContents(r io.Reader) (Checksums, error) {
+	m, c := md5.New(), crc32.New(castagnoli)
+	if _, err := io.Copy(io.MultiWriter(m, c), r); err != nil {
+		return Checksums{}, err
+	}
+
+	return newChecksums(m.Sum(nil), c.Sum32(), true), nil
+}
+
+// empty reports whether c has neither checksum.
+func (c Checksums) empty() bool {
+	return c.MD5 == "" && c.CRC32C == ""
+}
+
+// hashHeader is the value of an x-goog-hash header giving c.
+func (c Checksums) hashHeader() string {
+	hs := []string{}
+	if c.CRC32C != "" {
+		hs = append(hs, "crc32c="+c.CRC32C)
+	}
+	if c.MD5 != "" {
+		hs = append(hs, "md5="+c.MD5)
+	}
+
+	return strings.Join(hs, ",")
+}
+
+// Verification is the outcome of checking an image's contents against the
+// checksums stored for them. Only the checksums that are stored are
+// compared, and it passes when there is at least one and they all match.
+type Verification struct {
+	ID       string    `json:"id"`
+	Passed   bool      `json:"passed"`
+	Stored   Checksums `json:"stored"`
+	Computed Checksums `json:"computed"`
+}
+
+// JSON marshalls the content of Verification to json.
+func (v Verification) JSON() (string, error) {
+	bytes, err := v.JSONBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of Verification to json.
+func (v Verification) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// verify compares computed with stored.
+func verify(id string, stored, computed Checksums) Verification {
+	v := Verification{ID: id, Stored: stored, Computed: computed}
+	v.Passed = !stored.empty() &&
+		(stored.MD5 == "" || stored.MD5 == computed.MD5) &&
+		(stored.CRC32C == "" || stored.CRC32C == computed.CRC32C)
+
+	return v
+}
+
+// verifyHandler reads the original of an image back from storage and
+// checks it against the checksums stored with it. A mismatch is still a
+// 200: the check worked, and the body says it failed.
+func (s *Server) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	obj, err := s.storage.Open(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to open image %s: %w", id, err))
+		return
+	}
+	defer obj.Close()
+
+	computed, err := sumContents(obj)
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read image %s: %w", id, err))
+		return
+	}
+
+	v := verify(id, obj.Checksums, computed)
+	if !v.Passed {
+		logJSON(SeverityWarning, LogEntry{Message: fmt.Sprintf("image %s failed verification: stored %+v, computed %+v", id, v.Stored, v.Computed)})
+	}
+	writeJSON(w, v, http.StatusOK)
+}
+
+// contentMD5 decodes a Content-MD5 header, returning nil when there isn't
+// one.
+func contentMD5(h string) ([]byte, error) {
+	if h == "" {
+		return nil, nil
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(h)
+	if err != nil || len(sum) != md5.Size {
+		return nil, invalidArgument(fmt.Errorf("invalid Content-MD5 %q: want the base64 of an MD5", h))
+	}
+
+	return sum, nil
+}
+
+// checkContentMD5 fails with a 400 if file, which it rewinds, doesn't have
+// the MD5 want. Nothing is checked when want is empty.
+func checkContentMD5(file multipart.File, want []byte) (int, error) {
+	if len(want) == 0 {
+		return 0, nil
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return http.StatusBadRequest, fmt.Errorf("Content-MD5 mismatch: got %s, want %s",
+			base64.StdEncoding.EncodeToString(got), base64.StdEncoding.EncodeToString(want))
+	}
+
+	return 0, nil
+}
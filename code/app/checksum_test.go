@@ -0,0 +1,174 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+)
+
+// testPNGSums are the checksums of testPNG, as Cloud Storage reports them.
+var testPNGSums = Checksums{MD5: "Qhi4S3Jo0lTiAwN1lUufyA==", CRC32C: "QVZg3w=="}
+
+func TestChecksums(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	if got, err := sumContents(bytes.NewReader(testPNG(t))); err != nil || got != testPNGSums {
+		t.Fatalf("expected: %+v, got: %+v %v", testPNGSums, got, err)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil))
+	image := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &image); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if image.MD5 != testPNGSums.MD5 || image.CRC32C != testPNGSums.CRC32C {
+		t.Fatalf("expected: %+v, got: %s %s", testPNGSums, image.MD5, image.CRC32C)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a/content", nil))
+	if h, want := w.Header().Get(hashHeader), "crc32c=QVZg3w==,md5=Qhi4S3Jo0lTiAwN1lUufyA=="; h != want {
+		t.Fatalf("expected: %s, got: %s", want, h)
+	}
+}
+
+func verifyRequest(t *testing.T, server *Server, id string) (*httptest.ResponseRecorder, Verification) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/image/"+id+":verify", nil))
+	v := Verification{}
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+	}
+	return w, v
+}
+
+func TestVerify(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+
+	if w, v := verifyRequest(t, server, "a"); w.Code != http.StatusOK || !v.Passed || v.Stored != testPNGSums || v.Computed != testPNGSums {
+		t.Fatalf("expected a to pass, got: %v %+v", w.Code, v)
+	}
+
+	// Flip a byte of b behind the checksums' back.
+	obj := ms.objects["processed/b/original.png"]
+	data := append([]byte{}, obj.data...)
+	data[len(data)/2] ^= 0xff
+	obj.data = data
+	ms.objects["processed/b/original.png"] = obj
+
+	w, v := verifyRequest(t, server, "b")
+	if w.Code != http.StatusOK || v.Passed {
+		t.Fatalf("expected b to fail, got: %v %+v", w.Code, v)
+	}
+	if v.Stored != testPNGSums || v.Computed.MD5 == testPNGSums.MD5 || v.Computed.CRC32C == testPNGSums.CRC32C {
+		t.Fatalf("expected both checksums to differ, got: %+v", v)
+	}
+
+	if w, _ := verifyRequest(t, server, "missing"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+
+	// Checking doesn't change anything, so it goes on while writes can't.
+	server.SetMode(ModeReadOnly)
+	if w, _ := verifyRequest(t, server, "a"); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+}
+
+func TestVerifyWithoutChecksums(t *testing.T) {
+	if v := verify("a", Checksums{}, testPNGSums); v.Passed {
+		t.Fatalf("expected nothing to compare to fail, got: %+v", v)
+	}
+	if v := verify("a", Checksums{MD5: testPNGSums.MD5}, testPNGSums); !v.Passed {
+		t.Fatalf("expected the MD5 alone to be enough, got: %+v", v)
+	}
+}
+
+// newMD5UploadRequest is a form uploading content as filename, with md5 as
+// the part's Content-MD5. It is stored even if the content already is.
+func newMD5UploadRequest(t *testing.T, filename, md5 string, content []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="myFile"; filename="`+filename+`"`)
+	h.Set("Content-Type", "image/png")
+	h.Set("Content-MD5", md5)
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatalf("could not create multipart part: %s", err)
+	}
+	part.Write(content)
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/image?force=true", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestContentMD5(t *testing.T) {
+	ms := NewMemoryStorage()
+	server := NewServer(ms)
+	png := testPNG(t)
+	sum := md5.Sum(png)
+	good := base64.StdEncoding.EncodeToString(sum[:])
+	other := md5.Sum([]byte("something else"))
+	wrong := base64.StdEncoding.EncodeToString(other[:])
+
+	raw := func(id, md5 string) *http.Request {
+		r := newRawPutRequest("/api/v1/image/"+id, "image/png", png)
+		r.Header.Set("Content-MD5", md5)
+		return r
+	}
+	tests := map[string]struct {
+		req    *http.Request
+		id     string
+		status int
+	}{
+		"raw":            {raw("raw", good), "raw", http.StatusCreated},
+		"raw, wrong":     {raw("raw-wrong", wrong), "raw-wrong", http.StatusBadRequest},
+		"raw, malformed": {raw("raw-bad", "not an md5"), "raw-bad", http.StatusBadRequest},
+		"form":           {newMD5UploadRequest(t, "form.png", good, png), "form", http.StatusCreated},
+		"form, wrong":    {newMD5UploadRequest(t, "form-wrong.png", wrong, png), "form-wrong", http.StatusBadRequest},
+	}
+	for name, tc := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, tc.req)
+		if w.Code != tc.status {
+			t.Fatalf("%s expected: %v, got: %v %s", name, tc.status, w.Code, w.Body.String())
+		}
+
+		_, err := ms.Read(context.Background(), tc.id)
+		if stored := err == nil; stored != (tc.status == http.StatusCreated) {
+			t.Fatalf("%s: expected stored: %v, got: %v", name, !stored, err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client talks to the image API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/iterator"
+
+	"scalar-attempt/api"
+)
+
+// Client makes requests to the image API at a base URL.
+type Client struct {
+	base string
+	http *http.Client
+}
+
+// New returns a Client for the API served at base, such as
+// https://scaler.example.com. Requests are made with hc, which can add
+// authentication; nil uses http.DefaultClient.
+func New(base string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	return &Client{base: strings.TrimRight(base, "/"), http: hc}
+}
+
+// Error is a response the API answered with an error status.
+type Error struct {
+	StatusCode int
+	// Message is the error the API gave, and Details any more it had to
+	// say about it.
+	Message string
+	Details string
+	// Code is the kind of error the API said it was, such as not_found,
+	// when it said.
+	Code string
+	// RequestID finds the request in the server's logs.
+	RequestID string
+	// Allowed are the types the API takes, when it turned down an upload
+	// for its type.
+	Allowed []string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("scaler: %d %s", e.StatusCode, e.Message)
+	if e.Details != "" {
+		msg += ": " + e.Details
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request %s)", e.RequestID)
+	}
+	return msg
+}
+
+// ListOptions narrow and order a listing. The zero value lists every
+// image by name.
+type ListOptions struct {
+	// Prefix and Query keep only the images whose id starts with, or
+	// contains, them.
+	Prefix string
+	Query  string
+	// Sort is name, size or updated, and Order asc or desc.
+	Sort  string
+	Order string
+	// PageSize is how many images are fetched at a time.
+	PageSize int
+}
+
+// ImageIterator walks through a listing, fetching pages as they are needed.
+type ImageIterator struct {
+	ctx   context.Context
+	c     *Client
+	query url.Values
+	buf   api.Images
+	token string
+	done  bool
+}
+
+// List returns an iterator over the images matching opts.
+func (c *Client) List(ctx context.Context, opts ListOptions) *ImageIterator {
+	q := url.Values{}
+	for k, v := range map[string]string{"prefix": opts.Prefix, "q": opts.Query, "sort": opts.Sort, "order": opts.Order} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if opts.PageSize > 0 {
+		q.Set("limit", strconv.Itoa(opts.PageSize))
+	}
+
+	return &ImageIterator{ctx: ctx, c: c, query: q}
+}
+
+// Next returns the next image, or iterator.Done when there are no more.
+func (it *ImageIterator) Next() (api.Image, error) {
+	for len(it.buf) == 0 {
+		if it.done {
+			return api.Image{}, iterator.Done
+		}
+		if err := it.fetch(); err != nil {
+			return api.Image{}, err
+		}
+	}
+
+	img := it.buf[0]
+	it.buf = it.buf[1:]
+	return img, nil
+}
+
+func (it *ImageIterator) fetch() error {
+	q := url.Values{}
+	for k, v := range it.query {
+		q[k] = v
+	}
+	if it.token != "" {
+		q.Set("pageToken", it.token)
+	}
+
+	var page api.ImagePage
+	if err := it.c.do(it.ctx, http.MethodGet, "/api/v1/image?"+q.Encode(), nil, "", &page); err != nil {
+		return err
+	}
+
+	it.buf = page.Images
+	it.token = page.NextPageToken
+	it.done = page.NextPageToken == ""
+	return nil
+}
+
+// Get returns image id.
+func (c *Client) Get(ctx context.Context, id string) (api.Image, error) {
+	var img api.Image
+	err := c.do(ctx, http.MethodGet, "/api/v1/image/"+url.PathEscape(id), nil, "", &img)
+	return img, err
+}
+
+// Upload stores the contents of r as a new image called name.
+func (c *Client) Upload(ctx context.Context, name, contentType string, r io.Reader) (api.Image, error) {
+	body, formType, err := form(name, contentType, r)
+	if err != nil {
+		return api.Image{}, err
+	}
+
+	var img api.Image
+	err = c.do(ctx, http.MethodPost, "/api/v1/image", body, formType, &img)
+	return img, err
+}
+
+// Replace swaps the contents of image id for those of r, keeping its id.
+func (c *Client) Replace(ctx context.Context, id, name, contentType string, r io.Reader) (api.Message, error) {
+	body, formType, err := form(name, contentType, r)
+	if err != nil {
+		return api.Message{}, err
+	}
+
+	var msg api.Message
+	err = c.do(ctx, http.MethodPut, "/api/v1/image/"+url.PathEscape(id), body, formType, &msg)
+	return msg, err
+}
+
+// Delete moves image id to the trash.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/image/"+url.PathEscape(id), nil, "", nil)
+}
+
+// form builds the multipart form the API takes uploads in.
+func form(name, contentType string, r io.Reader) (io.Reader, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="myFile"; filename=%q`, name))
+	h.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not create form: %s", err)
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return nil, "", fmt.Errorf("could not read file: %s", err)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", fmt.Errorf("could not create form: %s", err)
+	}
+
+	return &buf, mw.FormDataContentType(), nil
+}
+
+// do makes a request and decodes the response into out, unless it is nil.
+// Error statuses are returned as an *Error.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, contentType string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return fmt.Errorf("could not create request: %s", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read response: %s", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		e := newError(resp.StatusCode, data)
+		if id := resp.Header.Get("X-Request-Id"); id != "" {
+			e.RequestID = id
+		}
+		return e
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("could not decode response: %s", err)
+	}
+
+	return nil
+}
+
+// newError makes sense of an error response, which carries either an
+// ErrorMessage or, for conflicts and the like, a Message.
+func newError(status int, body []byte) *Error {
+	e := &Error{StatusCode: status, Message: http.StatusText(status)}
+
+	var fields struct {
+		api.ErrorMessage
+		api.Message
+		Allowed []string `json:"allowed"`
+	}
+	if json.Unmarshal(body, &fields) != nil {
+		return e
+	}
+
+	switch {
+	case fields.Error != "":
+		e.Message = fields.Error
+		e.Code = fields.Code
+		e.RequestID = fields.RequestID
+	case fields.Text != "":
+		e.Message = fields.Text
+		e.Details = fields.Details
+		e.Allowed = fields.Allowed
+	}
+
+	return e
+}
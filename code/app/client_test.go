@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/iterator"
+
+	"scalar-attempt/client"
+)
+
+// newTestClient runs the real handlers over images in memory and returns a
+// client for them.
+func newTestClient(t *testing.T, names ...string) *client.Client {
+	t.Helper()
+
+	ts := httptest.NewServer(NewServer(newTestMemoryStorage(t, names...)))
+	t.Cleanup(ts.Close)
+
+	return client.New(ts.URL, ts.Client())
+}
+
+func TestClientList(t *testing.T) {
+	c := newTestClient(t, "c.png", "a.png", "b.png", "d.png", "e.png")
+
+	var got []string
+	it := c.List(context.Background(), client.ListOptions{PageSize: 2})
+	for {
+		img, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		got = append(got, img.Name)
+	}
+
+	want := []string{"a", "b", "c", "d", "e"}
+	if len(got) != len(want) {
+		t.Fatalf("expected: %v, got: %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected: %v, got: %v", want, got)
+		}
+	}
+}
+
+func TestClientLifecycle(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	img, err := c.Upload(ctx, "a.png", "image/png", bytes.NewReader(testPNG(t)))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if img.Name != "a" || img.ContentType != "image/png" {
+		t.Fatalf("expected the new image, got: %+v", img)
+	}
+
+	if dup, err := c.Upload(ctx, "b.png", "image/png", bytes.NewReader(testPNG(t))); err != nil || !dup.Deduplicated || dup.Name != "a" {
+		t.Fatalf("expected the upload to be deduplicated, got: %+v, %v", dup, err)
+	}
+
+	if _, err := c.Replace(ctx, "a", "b.png", "image/png", bytes.NewReader(testPNG(t))); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if got, err := c.Get(ctx, "a"); err != nil || got.Name != "a" {
+		t.Fatalf("expected image a, got: %+v, %v", got, err)
+	}
+
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	_, err = c.Get(ctx, "a")
+	if statusOf(err) != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, err)
+	}
+}
+
+// statusOf is the status of the API error err, or 0 if it isn't one.
+func statusOf(err error) int {
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
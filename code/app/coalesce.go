@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalesceTimeout bounds a shared call started without a deadline.
+const coalesceTimeout = 30 * time.Second
+
+// CoalesceStorage wraps s so that concurrent identical reads and listings
+// share a single call to s, counting those that joined another's in m,
+// which can be nil.
+func CoalesceStorage(s Storage, m *Metrics) Storage {
+	return &coalescingStorage{Storage: s, metrics: m}
+}
+
+// coalescingStorage is a Storage that runs one of each read at a time.
+// Everyone waiting on a call gets the same files, so their metadata must
+// be treated as read-only, which it is everywhere.
+type coalescingStorage struct {
+	Storage
+	metrics *Metrics
+	calls   singleflight.Group
+}
+
+// detachedContext carries the values of a context, such as the trace it
+// is part of, but not its deadline or cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// do runs op once for every caller asking for key at the same time. The
+// call isn't tied to the caller that started it, so that one giving up
+// doesn't fail the others: each waits only as long as its own ctx allows.
+func (s *coalescingStorage) do(ctx context.Context, name, key string, op func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	led := false
+	// Calls for different tenants or users are never shared.
+	ch := s.calls.DoChan(scopeOf(ctx)+"\x00"+name+"\x00"+key, func() (interface{}, error) {
+		led = true
+
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(coalesceTimeout)
+		}
+		shared, cancel := context.WithDeadline(detachedContext{ctx}, deadline)
+		defer cancel()
+
+		return op(shared)
+	})
+
+	select {
+	case res := <-ch:
+		if !led {
+			s.metrics.coalesced(name)
+		}
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *coalescingStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	v, err := s.do(ctx, "Read", id, func(ctx context.Context) (interface{}, error) {
+		return s.Storage.Read(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Each caller gets a slice of its own to sort or append to.
+	return append(CSFiles(nil), v.(CSFiles)...), nil
+}
+
+// listing is what a shared List returns.
+type listing struct {
+	files CSFiles
+	next  string
+}
+
+func (s *coalescingStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	key := fmt.Sprintf("%s\x00%d\x00%s", prefix, pageSize, pageToken)
+	v, err := s.do(ctx, "List", key, func(ctx context.Context) (interface{}, error) {
+		fs, next, err := s.Storage.List(ctx, prefix, pageSize, pageToken)
+		return listing{fs, next}, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	l := v.(listing)
+	return append(CSFiles(nil), l.files...), l.next, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedStorage holds every Read until release is closed, counting them.
+type gatedStorage struct {
+	*MemoryStorage
+	reads   atomic.Int32
+	release chan struct{}
+}
+
+func (s *gatedStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	s.reads.Add(1)
+	<-s.release
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.MemoryStorage.Read(ctx, id)
+}
+
+func TestCoalesceReads(t *testing.T) {
+	gated := &gatedStorage{MemoryStorage: newTestMemoryStorage(t, "a.png"), release: make(chan struct{})}
+	metrics := NewMetrics()
+	store := CoalesceStorage(gated, metrics)
+
+	// The first caller gives up while the read is in flight, which mustn't
+	// fail the others.
+	first, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := store.Read(first, "a")
+		done <- err
+	}()
+	for gated.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 5)
+	errs := make([]error, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fs, err := store.Read(context.Background(), "a")
+			results[i], errs[i] = len(fs), err
+		}(i)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected the first caller to see it gave up, got: %v", err)
+	}
+	// Let the others join before the read finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(gated.release)
+	wg.Wait()
+
+	for i := range results {
+		if errs[i] != nil || results[i] == 0 {
+			t.Fatalf("expected every waiter to get the files, got: %d %v", results[i], errs[i])
+		}
+	}
+	if n := gated.reads.Load(); n != 1 {
+		t.Fatalf("expected one read of storage, got: %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `scaler_storage_coalesced_total{operation="Read"} 5`; !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("expected metrics to contain %q, got:\n%s", want, w.Body.String())
+	}
+}
+
+func TestCoalesceDistinctReads(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	store := CoalesceStorage(ms, nil)
+
+	for _, id := range []string{"a", "b"} {
+		fs, err := store.Read(context.Background(), id)
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if f, ok := originalFile(fs); !ok || !strings.Contains(f.Name, id) {
+			t.Fatalf("expected the files of %s, got: %v", id, fs)
+		}
+	}
+	if _, err := store.Read(context.Background(), "missing"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrNotFound, err)
+	}
+
+	fs, next, err := store.List(context.Background(), "", 100, "")
+	if err != nil || next != "" || len(fs) == 0 {
+		t.Fatalf("expected a listing, got: %v %q %v", fs, next, err)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Settings for compressing responses, set from COMPRESSION_LEVEL and
+// COMPRESSION_MIN_BYTES. Responses smaller than compressionMinBytes gain
+// too little from compression to be worth it.
+var (
+	compressionLevel    = gzip.DefaultCompression
+	compressionMinBytes = 1024
+)
+
+// EnableCompression gzips responses for clients that accept it, at level.
+// Only text is compressed: images and archives are compressed already, and
+// an event stream would be held up. Responses are compressed as they are
+// written, once the first minSize bytes show they are worth compressing.
+func (s *Server) EnableCompression(level, minSize int) {
+	pool := &sync.Pool{New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, level)
+		return gz
+	}}
+
+	s.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			// Ranges are of the bytes before compression, so a response
+			// to one is sent as it is.
+			if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, pool: pool, minSize: minSize}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		return q > 0
+	}
+
+	return false
+}
+
+// compressible reports whether responses of contentType are worth
+// compressing.
+func compressible(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case t == "text/event-stream":
+		return false
+	case strings.HasPrefix(t, "text/"), strings.HasSuffix(t, "+json"), strings.HasSuffix(t, "+xml"):
+		return true
+	}
+
+	switch t {
+	case "application/json", ndjsonType, "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// to compress it, and then passes it on through gzip or as it is.
+type compressWriter struct {
+	http.ResponseWriter
+	pool    *sync.Pool
+	minSize int
+
+	status  int
+	buf     []byte
+	started bool
+	gz      *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+
+	// Responses that can't have a body are sent straight on.
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.started {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.minSize {
+			return len(p), nil
+		}
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	if cw.gz != nil {
+		return cw.gz.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// start sends the headers, compressing what follows if worth is set and
+// the response is of a kind that compresses, and then what was held back.
+func (cw *compressWriter) start(worth bool) error {
+	cw.started = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if worth && cw.status >= http.StatusOK && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" && compressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		cw.gz = cw.pool.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
+}
+
+// Flush sends what has been written so far, compressed if the response
+// will be, which is decided now if it hasn't been already.
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		cw.start(true)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends a response too small to compress, or finishes the
+// compressed one.
+func (cw *compressWriter) Close() error {
+	if !cw.started {
+		return cw.start(false)
+	}
+	if cw.gz == nil {
+		return nil
+	}
+
+	err := cw.gz.Close()
+	cw.gz.Reset(io.Discard)
+	cw.pool.Put(cw.gz)
+	cw.gz = nil
+	return err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func compressedRequest(server *Server, target, acceptEncoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+func TestCompression(t *testing.T) {
+	names := []string{}
+	for i := 0; i < 50; i++ {
+		names = append(names, fmt.Sprintf("image%d.png", i))
+	}
+	server := NewServer(newTestMemoryStorage(t, names...))
+	server.EnableCompression(gzip.BestSpeed, 1024)
+
+	plain := compressedRequest(server, "/api/v1/image", "")
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected no compression without Accept-Encoding")
+	}
+
+	w := compressedRequest(server, "/api/v1/image", "br, gzip;q=0.8")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected Content-Encoding: gzip, got: %q", got)
+	}
+	if got := w.Header().Get("Vary"); !strings.Contains(got, "Accept-Encoding") {
+		t.Fatalf("expected Vary: Accept-Encoding, got: %q", got)
+	}
+	if w.Body.Len() >= plain.Body.Len() {
+		t.Fatalf("expected the list to shrink from %d bytes, got: %d", plain.Body.Len(), w.Body.Len())
+	}
+
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if string(body) != plain.Body.String() {
+		t.Fatalf("expected the list uncompressed to match, got: %s", body)
+	}
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	server.EnableCompression(gzip.BestSpeed, 0)
+
+	tests := map[string]struct {
+		target         string
+		acceptEncoding string
+		want           string
+	}{
+		"image":        {"/api/v1/image/a/content", "gzip", ""},
+		"refused":      {"/api/v1/image", "gzip;q=0", ""},
+		"other coding": {"/api/v1/image", "br", ""},
+		"any coding":   {"/api/v1/image", "*", "gzip"},
+		"static":       {"/main.js", "gzip", "gzip"},
+	}
+	for name, c := range tests {
+		w := compressedRequest(server, c.target, c.acceptEncoding)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s expected: %v, got: %v", name, http.StatusOK, w.Code)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != c.want {
+			t.Fatalf("%s expected Content-Encoding %q, got: %q", name, c.want, got)
+		}
+	}
+
+	server = NewServer(newTestMemoryStorage(t, "a.png"))
+	server.EnableCompression(gzip.BestSpeed, 1<<20)
+	if w := compressedRequest(server, "/api/v1/image/a", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected responses under the minimum size not to be compressed")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pools of requests that are limited separately.
+const (
+	poolRequests = "requests"
+	poolUploads  = "uploads"
+)
+
+// defaultConcurrencyWait is how long a request waits for a slot unless
+// CONCURRENCY_QUEUE_TIMEOUT says otherwise.
+const defaultConcurrencyWait = time.Second
+
+// ConcurrencyLimit is how many requests can be served at once, and how many
+// more can wait for one of them to finish. A zero InFlight leaves requests
+// unlimited.
+type ConcurrencyLimit struct {
+	InFlight int
+	Queue    int
+}
+
+// ConcurrencyLimiter bounds how many requests an instance serves at once,
+// so that a burst is turned away with a 429 rather than taking the
+// instance down before the autoscaler adds more. Uploads, which hold the
+// most memory, take a slot of their own as well, and have a lower limit.
+type ConcurrencyLimiter struct {
+	requests, uploads *concurrencyPool
+	wait              time.Duration
+}
+
+// concurrencyPool is a semaphore with a bounded queue.
+type concurrencyPool struct {
+	name    string
+	slots   chan struct{}
+	queue   int64
+	waiting atomic.Int64
+	metrics *Metrics
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter that lets requests
+// wait up to wait for a slot. Its pools are reported in m, which may be
+// nil.
+func NewConcurrencyLimiter(requests, uploads ConcurrencyLimit, wait time.Duration, m *Metrics) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		requests: newConcurrencyPool(poolRequests, requests, m),
+		uploads:  newConcurrencyPool(poolUploads, uploads, m),
+		wait:     wait,
+	}
+}
+
+func newConcurrencyPool(name string, l ConcurrencyLimit, m *Metrics) *concurrencyPool {
+	if l.InFlight <= 0 {
+		return nil
+	}
+
+	return &concurrencyPool{name: name, slots: make(chan struct{}, l.InFlight), queue: int64(l.Queue), metrics: m}
+}
+
+// acquire takes a slot, waiting up to wait for one if the queue has room.
+// It reports false if it couldn't get one. A nil pool always has room.
+func (p *concurrencyPool) acquire(ctx context.Context, wait time.Duration) bool {
+	if p == nil {
+		return true
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		p.metrics.requestStarted(p.name)
+		return true
+	default:
+	}
+
+	if p.waiting.Add(1) > p.queue {
+		p.waiting.Add(-1)
+		return false
+	}
+	defer p.waiting.Add(-1)
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+		p.metrics.requestStarted(p.name)
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *concurrencyPool) release() {
+	if p == nil {
+		return
+	}
+
+	<-p.slots
+	p.metrics.requestFinished(p.name)
+}
+
+// LimitConcurrency sheds requests over the limits of l.
+func (s *Server) LimitConcurrency(l *ConcurrencyLimiter) {
+	s.Use(l.middleware(s.router))
+}
+
+// middleware answers requests that can't get a slot in time with a 429,
+// telling them to try again once they might.
+func (l *ConcurrencyLimiter) middleware(router *mux.Router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pools := []*concurrencyPool{l.requests}
+			if l.uploads != nil && isUpload(router, r) {
+				// Uploads queue for their own slot before taking one from
+				// everything else.
+				pools = []*concurrencyPool{l.uploads, l.requests}
+			}
+
+			held := 0
+			for _, p := range pools {
+				if !p.acquire(r.Context(), l.wait) {
+					break
+				}
+				held++
+			}
+			defer func() {
+				for _, p := range pools[:held] {
+					p.release()
+				}
+			}()
+
+			if held < len(pools) {
+				p := pools[held]
+				p.metrics.requestShed(p.name)
+
+				secs := int(math.Max(1, math.Ceil(l.wait.Seconds())))
+				w.Header().Set("Retry-After", strconv.Itoa(secs))
+				msg := Message{Text: "too many requests", Details: "the server is busy, try again shortly"}
+				writeJSON(w, msg, http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// blockingLimiter wraps a handler that waits on release in the middleware of
+// l, and reports each request it starts on started.
+func blockingLimiter(l *ConcurrencyLimiter) (h http.Handler, started chan struct{}, release chan struct{}) {
+	started = make(chan struct{}, 10)
+	release = make(chan struct{})
+
+	router := mux.NewRouter()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	router.Handle("/api/v1/image", next)
+	router.Handle("/api/v1/image/{id}", next)
+
+	return l.middleware(router)(router), started, release
+}
+
+func serveAsync(h http.Handler, r *http.Request) chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		done <- w
+	}()
+	return done
+}
+
+func TestConcurrencyLimiterSheds(t *testing.T) {
+	metrics := NewMetrics()
+	l := NewConcurrencyLimiter(ConcurrencyLimit{InFlight: 1}, ConcurrencyLimit{}, 1500*time.Millisecond, metrics)
+	h, started, release := blockingLimiter(l)
+
+	first := serveAsync(h, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil))
+	<-started
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected: %v, got: %v", http.StatusTooManyRequests, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After: 2, got: %q", got)
+	}
+
+	close(release)
+	if w := <-first; w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`scaler_http_requests_shed_total{pool="requests"} 1`,
+		`scaler_http_requests_in_flight{pool="requests"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("expected metrics to contain %q, got:\n%s", want, w.Body.String())
+		}
+	}
+}
+
+func TestConcurrencyLimiterQueues(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyLimit{InFlight: 1, Queue: 1}, ConcurrencyLimit{}, 5*time.Second, nil)
+	h, started, release := blockingLimiter(l)
+
+	first := serveAsync(h, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil))
+	<-started
+	second := serveAsync(h, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil))
+
+	// The queue holds one, so a third is turned away straight off.
+	deadline := time.Now().Add(time.Second)
+	for l.requests.waiting.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected: %v, got: %v", http.StatusTooManyRequests, w.Code)
+	}
+
+	close(release)
+	for _, done := range []chan *httptest.ResponseRecorder{first, second} {
+		if w := <-done; w.Code != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+		}
+	}
+}
+
+func TestConcurrencyLimiterUploads(t *testing.T) {
+	l := NewConcurrencyLimiter(ConcurrencyLimit{InFlight: 10}, ConcurrencyLimit{InFlight: 1}, 10*time.Millisecond, nil)
+	h, started, release := blockingLimiter(l)
+	defer close(release)
+
+	serveAsync(h, httptest.NewRequest(http.MethodPost, "/api/v1/image", nil))
+	<-started
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/image", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a second upload to be shed, got: %v", w.Code)
+	}
+
+	get := serveAsync(h, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil))
+	select {
+	case <-started:
+	case w := <-get:
+		t.Fatalf("expected a read to be served alongside an upload, got: %v", w.Code)
+	}
+}
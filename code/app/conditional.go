@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notModified sets the validators for a response and, if the request's
+// conditions show the client already has it, writes a 304 and reports true.
+// If-None-Match wins over If-Modified-Since whenever both are sent. Either
+// validator can be left empty.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" || !etagMatches(inm, etag) {
+			return false
+		}
+	} else {
+		ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(ims) {
+			return false
+		}
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether any of the tags in an If-None-Match header
+// match etag, using the weak comparison that header calls for.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageETag is the ETag for the JSON describing an image, which is the
+// generation of its original unless labels, tags, metadata, an expiry or
+// the placeholders and perceptual hash worked out after it was stored have
+// been added to it since, which don't change the generation. Then
+// it is weak, but still starts with the generation, so that it can be sent
+// back in an If-Match.
+func imageETag(i Image) string {
+	if len(i.Labels) == 0 && len(i.Tags) == 0 && len(i.Metadata) == 0 && i.Expires == nil && !hasDerived(i) {
+		return fmt.Sprintf(`"%d"`, i.Generation)
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%v\x00%v\x00%v\x00%s\x00", i.ETag, i.Labels, i.Tags, i.Metadata, expiresTag(i.Expires))
+	fmt.Fprintf(h, "%s\x00%s\x00%s", i.DominantColor, i.BlurHash, i.PerceptualHash)
+	return fmt.Sprintf(`W/"%d-%x"`, i.Generation, h.Sum64())
+}
+
+// ifMatch returns the generation the If-Match header of r makes a write
+// conditional on, or 0 if it has none or is *, which any image meets. It
+// takes an ETag from imageETag or the bare generation of an image. One
+// that can't be a generation is never met, so it fails with
+// ErrPrecondition.
+func ifMatch(r *http.Request) (int64, error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return 0, nil
+	}
+	if strings.Contains(h, ",") {
+		return 0, invalidArgument(fmt.Errorf("invalid If-Match %q: only one ETag is supported", h))
+	}
+
+	tag := strings.Trim(strings.TrimPrefix(h, "W/"), `"`)
+	if i := strings.Index(tag, "-"); i > -1 {
+		tag = tag[:i]
+	}
+	generation, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || generation <= 0 {
+		return 0, ErrPrecondition
+	}
+
+	return generation, nil
+}
+
+// listETag is a weak ETag for a page of a listing, which changes whenever an
+// image or folder on it is added, removed or overwritten, or the page after
+// it does. Listings have no Last-Modified, since a deletion doesn't make
+// anything newer.
+func listETag(p ImagePage) string {
+	h := fnv.New64a()
+	for _, i := range p.Images {
+		// Labels, tags, metadata, expiries, placeholders and hashes change
+		// without the image changing. Maps are printed in key order.
+		fmt.Fprintf(h, "%s\x00%d\x00%v\x00%v\x00%v\x00%s\x00", i.Name, i.Generation, i.Labels, i.Tags, i.Metadata, expiresTag(i.Expires))
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", i.DominantColor, i.BlurHash, i.PerceptualHash)
+	}
+	for _, f := range p.Folders {
+		fmt.Fprintf(h, "%s/\x00", f)
+	}
+	fmt.Fprintf(h, "%s", p.NextPageToken)
+
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// hasDerived reports whether i has any of the values worked out from its
+// original after it is stored.
+func hasDerived(i Image) bool {
+	return i.DominantColor != "" || i.BlurHash != "" || i.PerceptualHash != ""
+}
+
+// expiresTag is when an image expires, as hashed into its ETag, or "" for
+// one that doesn't.
+func expiresTag(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
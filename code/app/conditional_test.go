@@ -0,0 +1,299 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionalGet(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+
+	for _, target := range []string{
+		"/api/v1/image",
+		"/api/v1/image?sort=size",
+		"/api/v1/image/a",
+		"/api/v1/image/a/content",
+	} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s expected: %v, got: %v", target, http.StatusOK, w.Code)
+		}
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s expected an ETag", target)
+		}
+
+		r = httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("If-None-Match", `"other", `+etag)
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotModified {
+			t.Fatalf("%s expected: %v, got: %v", target, http.StatusNotModified, w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Fatalf("%s expected no body, got: %q", target, w.Body.String())
+		}
+	}
+}
+
+func TestConditionalGetAfterChange(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	etag := w.Header().Get("ETag")
+
+	if err := ms.Delete(context.Background(), "b", 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	// The change was made behind the server's back, as another instance
+	// would, so the cached listing doesn't know of it.
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/image?fresh=true", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Fatalf("expected the ETag to change, got: %v", etag)
+	}
+}
+
+func TestConditionalGetAfterTTL(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+
+	etags := map[string]string{}
+	for _, target := range []string{"/api/v1/image", "/api/v1/image/a"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		etags[target] = w.Header().Get("ETag")
+	}
+
+	if w := patchTTL(server, "a", "1h"); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// The expiry doesn't change the generation, but it is news to a client
+	// holding the old JSON.
+	for target, etag := range etags {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"expires"`) {
+			t.Fatalf("%s expected: %v with an expiry, got: %v %s", target, http.StatusOK, w.Code, w.Body.String())
+		}
+		if w.Header().Get("ETag") == etag {
+			t.Fatalf("%s expected the ETag to change, got: %v", target, etag)
+		}
+	}
+}
+
+func TestConditionalGetAfterPlaceholders(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+
+	etags := map[string]string{}
+	for _, target := range []string{"/api/v1/image", "/api/v1/image/a"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		etags[target] = w.Header().Get("ETag")
+	}
+
+	// As they are backfilled, without the generation changing.
+	for _, m := range []map[string]string{
+		{dominantColorKey: "#102030", blurHashKey: "LEHV6nWB2yk8pyo0adR*.7kCMdnj"},
+		{perceptualHashKey: "8f373714acfcf4d0"},
+	} {
+		if err := ms.UpdateMetadata(context.Background(), "processed/a/original.png", m); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		server.lists.invalidate()
+
+		for target, etag := range etags {
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("If-None-Match", etag)
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+				t.Fatalf("%s expected: %v with a new ETag, got: %v %s", target, http.StatusOK, w.Code, w.Header().Get("ETag"))
+			}
+			etags[target] = w.Header().Get("ETag")
+		}
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+
+	tests := []struct {
+		since time.Time
+		want  int
+	}{
+		{since: time.Now().Add(time.Hour), want: http.StatusNotModified},
+		{since: time.Now().Add(-time.Hour), want: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image/a/content", nil)
+		r.Header.Set("If-Modified-Since", tc.since.UTC().Format(http.TimeFormat))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != tc.want {
+			t.Fatalf("expected: %v, got: %v", tc.want, w.Code)
+		}
+		if w.Header().Get("Last-Modified") == "" {
+			t.Fatalf("expected a Last-Modified header")
+		}
+	}
+}
+
+// currentETag returns the ETag image id is served with, checking it starts
+// with its generation. Once its placeholders are worked out it is weak.
+func currentETag(t *testing.T, server *Server, id string) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/"+id, nil))
+	image := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &image); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	etag := w.Header().Get("ETag")
+	strong, weak := fmt.Sprintf(`"%d"`, image.Generation), fmt.Sprintf(`W/"%d-`, image.Generation)
+	if image.Generation == 0 || etag != strong && !strings.HasPrefix(etag, weak) {
+		t.Fatalf("expected the generation as the ETag, got: %d %s", image.Generation, etag)
+	}
+	return etag
+}
+
+func TestIfMatch(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+	png := testPNG(t)
+
+	send := func(r *http.Request, ifMatch string) *httptest.ResponseRecorder {
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	stale := currentETag(t, server, "a")
+	if w := send(newRawPutRequest("/api/v1/image/a", "image/png", png), stale); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	etag := currentETag(t, server, "a")
+	if etag == stale {
+		t.Fatalf("expected the ETag to change, got: %s", etag)
+	}
+
+	// Whoever still has the old one is turned away, whatever they try.
+	for _, r := range []*http.Request{
+		newRawPutRequest("/api/v1/image/a", "image/png", png),
+		newUploadRequest(t, http.MethodPut, "/api/v1/image/a", "a.png", "image/png", png),
+		httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil),
+		httptest.NewRequest(http.MethodDelete, "/api/v1/image/a?hard=true", nil),
+	} {
+		if w := send(r, stale); w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("%s %s expected: %v, got: %v %s", r.Method, r.URL, http.StatusPreconditionFailed, w.Code, w.Body.String())
+		}
+	}
+	if got := currentETag(t, server, "a"); got != etag {
+		t.Fatalf("expected a to be left alone, got: %s", got)
+	}
+
+	if w := send(newUploadRequest(t, http.MethodPut, "/api/v1/image/a", "a.png", "image/png", png), etag); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := send(httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil), currentETag(t, server, "a")); w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	tests := map[string]struct {
+		ifMatch string
+		status  int
+	}{
+		"none":      {"", http.StatusOK},
+		"any":       {"*", http.StatusOK},
+		"bare":      {"", http.StatusOK},
+		"not ours":  {`"abc"`, http.StatusPreconditionFailed},
+		"several":   {`"1", "2"`, http.StatusBadRequest},
+		"not there": {`"1"`, http.StatusPreconditionFailed},
+	}
+	for name, tc := range tests {
+		id := "b"
+		if name == "not there" {
+			id = "missing"
+		}
+		// The other cases move b on, so its ETag is only known now.
+		if name == "bare" {
+			tc.ifMatch = strings.Trim(currentETag(t, server, "b"), `"`)
+		}
+		if w := send(newRawPutRequest("/api/v1/image/"+id, "image/png", png), tc.ifMatch); w.Code != tc.status {
+			t.Fatalf("%s expected: %v, got: %v %s", name, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestIfMatchTagged(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+
+	if err := ms.UpdateMetadata(context.Background(), "processed/a/original.png", map[string]string{"tags": "x"}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	// Tags make the ETag weak, but it still names the generation.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil))
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, "W/") {
+		t.Fatalf("expected a weak ETag, got: %s", etag)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil)
+	r.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,558 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is how the server is set up, read from the environment by
+// LoadConfig. Each field is tagged with the variable it comes from, which
+// is what /api/v1/admin/config shows it under; those tagged secret are
+// redacted there.
+type Config struct {
+	Port           string   `env:"PORT"`
+	GRPCPort       string   `env:"GRPC_PORT"`
+	TLSCertFile    string   `env:"TLS_CERT_FILE"`
+	TLSKeyFile     string   `env:"TLS_KEY_FILE"`
+	EnableH2C      bool     `env:"ENABLE_H2C"`
+	Bucket         string   `env:"BUCKET"`
+	Buckets        []string `env:"BUCKETS"`
+	StorageBackend string   `env:"STORAGE_BACKEND"`
+	StorageRoot    string   `env:"STORAGE_ROOT"`
+	StaticDir      string   `env:"STATIC_DIR"`
+	LogLevel       Severity `env:"LOG_LEVEL"`
+	IDStrategy     string   `env:"ID_STRATEGY"`
+
+	AllowedMimeTypes []string      `env:"ALLOWED_MIME_TYPES"`
+	MaxUploadBytes   int64         `env:"MAX_UPLOAD_BYTES"`
+	MaxAnimatedBytes int64         `env:"MAX_ANIMATED_BYTES"`
+	MinWidth         int           `env:"MIN_WIDTH"`
+	MinHeight        int           `env:"MIN_HEIGHT"`
+	MaxPixels        int64         `env:"MAX_PIXELS"`
+	MaxExportBytes   int64         `env:"MAX_EXPORT_BYTES"`
+	MaxImportBytes   int64         `env:"MAX_IMPORT_BYTES"`
+	MaxImportEntries int           `env:"MAX_IMPORT_ENTRIES"`
+	MaxBatchDelete   int           `env:"MAX_BATCH_DELETE"`
+	MaxSignedURLTTL  time.Duration `env:"MAX_SIGNED_URL_TTL"`
+	ThumbnailSize    int           `env:"THUMBNAIL_SIZE"`
+	StripExif        bool          `env:"STRIP_EXIF"`
+	TrashRetention   time.Duration `env:"TRASH_RETENTION"`
+	UploadExpiry     time.Duration `env:"UPLOAD_EXPIRY"`
+	JanitorInterval  time.Duration `env:"JANITOR_INTERVAL"`
+	JanitorRate      float64       `env:"JANITOR_RATE"`
+	JanitorDryRun    bool          `env:"JANITOR_DRY_RUN"`
+
+	RequestTimeout        time.Duration `env:"REQUEST_TIMEOUT"`
+	ShutdownTimeout       time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	StorageRetryAttempts  int           `env:"STORAGE_RETRY_ATTEMPTS"`
+	StorageRetryBaseDelay time.Duration `env:"STORAGE_RETRY_BASE_DELAY"`
+
+	StatsCacheTTL              time.Duration `env:"STATS_CACHE_TTL"`
+	ListCacheTTL               time.Duration `env:"LIST_CACHE_TTL"`
+	ListHiddenPrefixes         []string      `env:"LIST_HIDDEN_PREFIXES"`
+	ListImagesOnly             bool          `env:"LIST_IMAGES_ONLY"`
+	ContentCacheBytes          int64         `env:"CONTENT_CACHE_BYTES"`
+	ContentCacheMaxObjectBytes int64         `env:"CONTENT_CACHE_MAX_OBJECT_BYTES"`
+
+	EnableMetrics    bool          `env:"ENABLE_METRICS"`
+	StartupSelfTest  bool          `env:"STARTUP_SELF_TEST"`
+	SelfTestInterval time.Duration `env:"SELF_TEST_INTERVAL"`
+	ServedByHeader   bool          `env:"SERVED_BY_HEADER"`
+	EnableLoad       bool          `env:"ENABLE_LOAD_ENDPOINT"`
+	EnableChaos      bool          `env:"ENABLE_CHAOS"`
+	EnableGraphiQL   bool          `env:"ENABLE_GRAPHIQL"`
+	ReadOnly         bool          `env:"READ_ONLY"`
+
+	PubSubTopic   string   `env:"PUBSUB_TOPIC"`
+	WebhookURLs   []string `env:"WEBHOOK_URLS"`
+	WebhookSecret string   `env:"WEBHOOK_SECRET" secret:"true"`
+
+	GCSEvents         bool   `env:"GCS_EVENTS"`
+	GCSEventsAudience string `env:"GCS_EVENTS_AUDIENCE"`
+
+	Moderation          string `env:"MODERATION"`
+	ModerationThreshold string `env:"MODERATION_THRESHOLD"`
+	ModerationFailOpen  bool   `env:"MODERATION_FAIL_OPEN"`
+	Labels              string `env:"LABELS"`
+	MaxLabels           int    `env:"MAX_LABELS"`
+	LabelConcurrency    int    `env:"LABEL_CONCURRENCY"`
+
+	PlaceholderConcurrency int `env:"PLACEHOLDER_CONCURRENCY"`
+
+	Watermark         string  `env:"WATERMARK"`
+	WatermarkMode     string  `env:"WATERMARK_MODE"`
+	WatermarkPosition string  `env:"WATERMARK_POSITION"`
+	WatermarkOpacity  float64 `env:"WATERMARK_OPACITY"`
+	WatermarkScale    float64 `env:"WATERMARK_SCALE"`
+	WatermarkMinSize  int     `env:"WATERMARK_MIN_SIZE"`
+
+	HEIFConverter string `env:"HEIF_CONVERTER"`
+	WebPEncoder   string `env:"WEBP_ENCODER"`
+
+	RateLimitRPS        float64 `env:"RATE_LIMIT_RPS"`
+	RateLimitBurst      int     `env:"RATE_LIMIT_BURST"`
+	RateLimitWriteRPS   float64 `env:"RATE_LIMIT_WRITE_RPS"`
+	RateLimitWriteBurst int     `env:"RATE_LIMIT_WRITE_BURST"`
+	TrustedProxies      int     `env:"TRUSTED_PROXIES"`
+
+	MaxConcurrentRequests   int           `env:"MAX_CONCURRENT_REQUESTS"`
+	ConcurrencyQueue        int           `env:"CONCURRENCY_QUEUE"`
+	MaxConcurrentUploads    int           `env:"MAX_CONCURRENT_UPLOADS"`
+	UploadConcurrencyQueue  int           `env:"UPLOAD_CONCURRENCY_QUEUE"`
+	ConcurrencyQueueTimeout time.Duration `env:"CONCURRENCY_QUEUE_TIMEOUT"`
+
+	APIKeys            []string `env:"API_KEYS" secret:"true"`
+	RequireKeyForReads bool     `env:"REQUIRE_KEY_FOR_READS"`
+	FirebaseProjectID  string   `env:"FIREBASE_PROJECT_ID"`
+
+	CORSAllowedOrigins []string `env:"CORS_ALLOWED_ORIGINS"`
+	CORSAllowedHeaders []string `env:"CORS_ALLOWED_HEADERS"`
+	CORSAllowedMethods []string `env:"CORS_ALLOWED_METHODS"`
+
+	CompressionLevel    int `env:"COMPRESSION_LEVEL"`
+	CompressionMinBytes int `env:"COMPRESSION_MIN_BYTES"`
+}
+
+// ConfigError lists every problem found with the configuration, so that
+// they can all be fixed at once.
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// envParser reads variables, noting each that can't be parsed and going
+// on with its default.
+type envParser struct {
+	lookup func(string) (string, bool)
+	errs   ConfigError
+}
+
+// get returns the value of name, if it is set to something.
+func (p *envParser) get(name string) (string, bool) {
+	v, ok := p.lookup(name)
+	return v, ok && v != ""
+}
+
+func (p *envParser) fail(name, v, want string) {
+	p.errs = append(p.errs, fmt.Sprintf("invalid %s %q: %s", name, v, want))
+}
+
+func (p *envParser) string(name, def string) string {
+	if v, ok := p.get(name); ok {
+		return v
+	}
+	return def
+}
+
+func (p *envParser) list(name string, def []string) []string {
+	if v, ok := p.get(name); ok {
+		return parseList(v)
+	}
+	return def
+}
+
+func (p *envParser) bool(name string, def bool) bool {
+	v, ok := p.get(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		p.fail(name, v, "want true or false")
+		return def
+	}
+	return b
+}
+
+func (p *envParser) int(name string, def, min int, want string) int {
+	v, ok := p.get(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min {
+		p.fail(name, v, want)
+		return def
+	}
+	return n
+}
+
+func (p *envParser) int64(name string, def, min int64, want string) int64 {
+	v, ok := p.get(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < min {
+		p.fail(name, v, want)
+		return def
+	}
+	return n
+}
+
+func (p *envParser) float(name string, def, min float64, want string) float64 {
+	v, ok := p.get(name)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < min || math.IsNaN(f) || math.IsInf(f, 0) {
+		p.fail(name, v, want)
+		return def
+	}
+	return f
+}
+
+func (p *envParser) duration(name string, def, min time.Duration, want string) time.Duration {
+	v, ok := p.get(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < min {
+		p.fail(name, v, want)
+		return def
+	}
+	return d
+}
+
+// LoadConfig reads the configuration from lookup, which is os.LookupEnv
+// outside tests. Anything not set keeps its default. If anything is wrong
+// the error is a ConfigError listing all of it.
+func LoadConfig(lookup func(string) (string, bool)) (Config, error) {
+	p := &envParser{lookup: lookup}
+	c := Config{
+		Port:           p.string("PORT", "8080"),
+		GRPCPort:       p.string("GRPC_PORT", ""),
+		TLSCertFile:    p.string("TLS_CERT_FILE", ""),
+		TLSKeyFile:     p.string("TLS_KEY_FILE", ""),
+		EnableH2C:      p.bool("ENABLE_H2C", false),
+		Bucket:         p.string("BUCKET", ""),
+		Buckets:        p.list("BUCKETS", nil),
+		StorageBackend: p.string("STORAGE_BACKEND", ""),
+		StorageRoot:    p.string("STORAGE_ROOT", ""),
+		StaticDir:      p.string("STATIC_DIR", staticDir),
+		LogLevel:       logLevel,
+		IDStrategy:     p.string("ID_STRATEGY", idStrategy),
+
+		AllowedMimeTypes: defaultMimeTypes,
+		MaxUploadBytes:   p.int64("MAX_UPLOAD_BYTES", maxUploadBytes, 1, "want a positive number of bytes"),
+		MaxAnimatedBytes: p.int64("MAX_ANIMATED_BYTES", maxAnimatedBytes, 1, "want a positive number of bytes"),
+		MinWidth:         p.int("MIN_WIDTH", minWidth, 0, "want a number of pixels, or 0 for no minimum"),
+		MinHeight:        p.int("MIN_HEIGHT", minHeight, 0, "want a number of pixels, or 0 for no minimum"),
+		MaxPixels:        p.int64("MAX_PIXELS", maxPixels, 1, "want a positive number of pixels"),
+		MaxExportBytes:   p.int64("MAX_EXPORT_BYTES", maxExportBytes, 1, "want a positive number of bytes"),
+		MaxImportBytes:   p.int64("MAX_IMPORT_BYTES", maxImportBytes, 1, "want a positive number of bytes"),
+		MaxImportEntries: p.int("MAX_IMPORT_ENTRIES", maxImportEntries, 1, "want a positive number of files"),
+		MaxBatchDelete:   p.int("MAX_BATCH_DELETE", maxBatchDelete, 1, "want a positive number of ids"),
+		MaxSignedURLTTL:  p.duration("MAX_SIGNED_URL_TTL", maxSignedURLTTL, 1, "want a duration like 1h"),
+		ThumbnailSize:    p.int("THUMBNAIL_SIZE", thumbnailSize, 1, "want a positive number of pixels"),
+		StripExif:        p.bool("STRIP_EXIF", stripExif),
+		TrashRetention:   p.duration("TRASH_RETENTION", trashRetention, 0, "want a duration like 720h, or 0 to keep deleted images"),
+		UploadExpiry:     p.duration("UPLOAD_EXPIRY", uploadExpiry, 1, "want a duration like 24h"),
+		JanitorInterval:  p.duration("JANITOR_INTERVAL", janitorInterval, 0, "want a duration like 1h, or 0 to only clean up on demand"),
+		JanitorRate:      p.float("JANITOR_RATE", janitorRate, 0, "want storage calls per second, or 0 for no limit"),
+		JanitorDryRun:    p.bool("JANITOR_DRY_RUN", janitorDryRun),
+
+		RequestTimeout:        p.duration("REQUEST_TIMEOUT", requestTimeout, 0, "want a duration like 30s, or 0 for no limit"),
+		ShutdownTimeout:       p.duration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout, 0, "want a duration like 10s"),
+		StorageRetryAttempts:  p.int("STORAGE_RETRY_ATTEMPTS", retryAttempts, 1, "want a positive integer"),
+		StorageRetryBaseDelay: p.duration("STORAGE_RETRY_BASE_DELAY", retryBaseDelay, 0, "want a duration like 100ms"),
+
+		StatsCacheTTL:              p.duration("STATS_CACHE_TTL", statsTTL, 0, "want a duration like 30s, or 0 not to cache"),
+		ListCacheTTL:               p.duration("LIST_CACHE_TTL", listCacheTTL, 0, "want a duration like 5s, or 0 not to cache"),
+		ListHiddenPrefixes:         p.list("LIST_HIDDEN_PREFIXES", nil),
+		ListImagesOnly:             p.bool("LIST_IMAGES_ONLY", false),
+		ContentCacheBytes:          p.int64("CONTENT_CACHE_BYTES", contentCacheBytes, 0, "want a number of bytes, or 0 not to cache"),
+		ContentCacheMaxObjectBytes: p.int64("CONTENT_CACHE_MAX_OBJECT_BYTES", contentCacheMaxObject, 1, "want a positive number of bytes"),
+
+		EnableMetrics:    p.bool("ENABLE_METRICS", false),
+		StartupSelfTest:  p.bool("STARTUP_SELF_TEST", false),
+		SelfTestInterval: p.duration("SELF_TEST_INTERVAL", defaultSelfTestInterval, 0, "want a duration like 5m, or 0 not to test again"),
+		ServedByHeader:   p.bool("SERVED_BY_HEADER", false),
+		EnableLoad:       p.bool("ENABLE_LOAD_ENDPOINT", false),
+		EnableChaos:      p.bool("ENABLE_CHAOS", false),
+		EnableGraphiQL:   p.bool("ENABLE_GRAPHIQL", false),
+		ReadOnly:         p.bool("READ_ONLY", false),
+
+		PubSubTopic:   p.string("PUBSUB_TOPIC", ""),
+		WebhookURLs:   p.list("WEBHOOK_URLS", nil),
+		WebhookSecret: p.string("WEBHOOK_SECRET", ""),
+
+		GCSEvents:         p.bool("GCS_EVENTS", false),
+		GCSEventsAudience: p.string("GCS_EVENTS_AUDIENCE", ""),
+
+		Moderation:          p.string("MODERATION", ""),
+		ModerationThreshold: "LIKELY",
+		ModerationFailOpen:  p.bool("MODERATION_FAIL_OPEN", false),
+		Labels:              p.string("LABELS", ""),
+		MaxLabels:           p.int("MAX_LABELS", maxLabels, 1, "want a positive integer"),
+		LabelConcurrency:    p.int("LABEL_CONCURRENCY", defaultLabelConcurrency, 1, "want a positive integer"),
+
+		PlaceholderConcurrency: p.int("PLACEHOLDER_CONCURRENCY", defaultPlaceholderConcurrency, 0, "want a number of images, or 0 for no placeholders"),
+
+		Watermark:         p.string("WATERMARK", ""),
+		WatermarkMode:     p.string("WATERMARK_MODE", watermarkServe),
+		WatermarkPosition: p.string("WATERMARK_POSITION", positionBottomRight),
+		WatermarkOpacity:  p.float("WATERMARK_OPACITY", defaultWatermarkOpacity, 0, "want a fraction from 0 to 1"),
+		WatermarkScale:    p.float("WATERMARK_SCALE", defaultWatermarkScale, 0, "want a fraction of the image's width from 0 to 1"),
+		WatermarkMinSize:  p.int("WATERMARK_MIN_SIZE", defaultWatermarkMinSize, 0, "want a number of pixels"),
+
+		HEIFConverter: p.string("HEIF_CONVERTER", ""),
+		WebPEncoder:   p.string("WEBP_ENCODER", ""),
+
+		MaxConcurrentRequests:   p.int("MAX_CONCURRENT_REQUESTS", 0, 0, "want a number of requests, or 0 for no limit"),
+		MaxConcurrentUploads:    p.int("MAX_CONCURRENT_UPLOADS", 0, 0, "want a number of requests, or 0 for no limit"),
+		ConcurrencyQueueTimeout: p.duration("CONCURRENCY_QUEUE_TIMEOUT", defaultConcurrencyWait, 0, "want a duration like 1s"),
+
+		APIKeys:            p.list("API_KEYS", nil),
+		RequireKeyForReads: p.bool("REQUIRE_KEY_FOR_READS", false),
+		FirebaseProjectID:  p.string("FIREBASE_PROJECT_ID", ""),
+
+		CORSAllowedOrigins: corsOrigins,
+		CORSAllowedHeaders: p.list("CORS_ALLOWED_HEADERS", corsHeaders),
+		CORSAllowedMethods: p.list("CORS_ALLOWED_METHODS", corsMethods),
+
+		CompressionLevel:    p.int("COMPRESSION_LEVEL", compressionLevel, 0, "want 1 to 9, or 0 not to compress"),
+		CompressionMinBytes: p.int("COMPRESSION_MIN_BYTES", compressionMinBytes, 0, "want a number of bytes"),
+	}
+
+	// The queues default to as many requests as can be served at once.
+	c.ConcurrencyQueue = p.int("CONCURRENCY_QUEUE", c.MaxConcurrentRequests, 0, "want a number of requests")
+	c.UploadConcurrencyQueue = p.int("UPLOAD_CONCURRENCY_QUEUE", c.MaxConcurrentUploads, 0, "want a number of requests")
+
+	// Bursts default to a second's worth of requests, and writes to the
+	// limit on reads.
+	c.RateLimitRPS = p.float("RATE_LIMIT_RPS", 0, 0, "want requests per second, or 0 for no limit")
+	c.RateLimitBurst = p.int("RATE_LIMIT_BURST", int(math.Ceil(c.RateLimitRPS)), 1, "want a positive integer")
+	c.RateLimitWriteRPS, c.RateLimitWriteBurst = c.RateLimitRPS, c.RateLimitBurst
+	if _, ok := p.get("RATE_LIMIT_WRITE_RPS"); ok {
+		c.RateLimitWriteRPS = p.float("RATE_LIMIT_WRITE_RPS", c.RateLimitRPS, 0, "want requests per second, or 0 for no limit")
+		c.RateLimitWriteBurst = int(math.Ceil(c.RateLimitWriteRPS))
+	}
+	c.RateLimitWriteBurst = p.int("RATE_LIMIT_WRITE_BURST", c.RateLimitWriteBurst, 1, "want a positive integer")
+	c.TrustedProxies = p.int("TRUSTED_PROXIES", trustedProxies, 0, "want a number of proxies")
+
+	// CORS_ALLOWED_ORIGINS can be set empty, to allow no origins at all.
+	if v, ok := lookup("CORS_ALLOWED_ORIGINS"); ok {
+		c.CORSAllowedOrigins = parseList(v)
+	}
+
+	if v, ok := p.get("ALLOWED_MIME_TYPES"); ok {
+		types, err := parseMimeTypes(v)
+		if err != nil {
+			p.fail("ALLOWED_MIME_TYPES", v, err.Error())
+		} else {
+			c.AllowedMimeTypes = types
+		}
+	}
+
+	if v, ok := p.get("LOG_LEVEL"); ok {
+		sev, err := ParseSeverity(v)
+		if err != nil {
+			p.errs = append(p.errs, fmt.Sprintf("invalid LOG_LEVEL: %s", err))
+		} else {
+			c.LogLevel = sev
+		}
+	}
+
+	if v, ok := p.get("MODERATION_THRESHOLD"); ok {
+		threshold, err := parseLikelihood(v)
+		if err != nil {
+			p.errs = append(p.errs, fmt.Sprintf("invalid MODERATION_THRESHOLD: %s", err))
+		} else {
+			c.ModerationThreshold = threshold
+		}
+	}
+
+	p.errs = append(p.errs, c.validate()...)
+	if len(p.errs) > 0 {
+		return c, p.errs
+	}
+
+	return c, nil
+}
+
+// validate returns the problems with settings that can't be checked one
+// variable at a time.
+func (c Config) validate() []string {
+	var errs []string
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.GRPCPort != "" && c.GRPCPort == c.Port {
+		errs = append(errs, "GRPC_PORT has to differ from PORT")
+	}
+	if c.EnableH2C && c.TLSCertFile != "" {
+		errs = append(errs, "ENABLE_H2C is for serving without TLS, which already offers HTTP/2")
+	}
+	if _, err := parseBuckets(c.Buckets); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid BUCKETS: %s", err))
+	}
+	if c.Bucket != "" && len(c.Buckets) > 0 {
+		errs = append(errs, "BUCKET and BUCKETS can't both be set")
+	}
+	if c.StorageBackend == "filesystem" && c.StorageRoot == "" {
+		errs = append(errs, "STORAGE_ROOT is required for filesystem storage")
+	}
+	if c.StaticDir != "" {
+		if info, err := os.Stat(c.StaticDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Sprintf("invalid STATIC_DIR %q: want a directory", c.StaticDir))
+		}
+	}
+	if c.IDStrategy != idStrategyFilename && c.IDStrategy != idStrategyUUID {
+		errs = append(errs, fmt.Sprintf("invalid ID_STRATEGY %q: want %s or %s", c.IDStrategy, idStrategyFilename, idStrategyUUID))
+	}
+	if c.CompressionLevel > 9 {
+		errs = append(errs, fmt.Sprintf("invalid COMPRESSION_LEVEL \"%d\": want 1 to 9, or 0 not to compress", c.CompressionLevel))
+	}
+	if len(c.WebhookURLs) > 0 && c.WebhookSecret == "" {
+		errs = append(errs, "WEBHOOK_SECRET is required to sign webhooks")
+	}
+	if c.GCSEvents && (c.StorageBackend != "" || (c.Bucket == "" && len(c.Buckets) == 0)) {
+		errs = append(errs, "GCS_EVENTS is only for storage in Cloud Storage")
+	}
+	if c.Moderation != "" && c.Moderation != "vision" {
+		errs = append(errs, fmt.Sprintf("invalid MODERATION %q: want vision", c.Moderation))
+	}
+	if c.Labels != "" && c.Labels != "vision" {
+		errs = append(errs, fmt.Sprintf("invalid LABELS %q: want vision", c.Labels))
+	}
+	if c.WatermarkMode != watermarkServe && c.WatermarkMode != watermarkUpload {
+		errs = append(errs, fmt.Sprintf("invalid WATERMARK_MODE %q: want %s or %s", c.WatermarkMode, watermarkServe, watermarkUpload))
+	}
+	if !validPosition(c.WatermarkPosition) {
+		errs = append(errs, fmt.Sprintf("invalid WATERMARK_POSITION %q: want one of %s", c.WatermarkPosition, strings.Join(watermarkPositions, ", ")))
+	}
+	if c.WatermarkOpacity == 0 || c.WatermarkOpacity > 1 {
+		errs = append(errs, fmt.Sprintf("invalid WATERMARK_OPACITY \"%g\": want a fraction from 0 to 1", c.WatermarkOpacity))
+	}
+	if c.WatermarkScale == 0 || c.WatermarkScale > 1 {
+		errs = append(errs, fmt.Sprintf("invalid WATERMARK_SCALE \"%g\": want a fraction of the image's width from 0 to 1", c.WatermarkScale))
+	}
+
+	return errs
+}
+
+// apply sets the package-wide settings that the handlers read.
+func (c Config) apply() {
+	staticDir = c.StaticDir
+	logLevel = c.LogLevel
+	idStrategy = c.IDStrategy
+	allowedMimeTypes = NewMimeMap(c.AllowedMimeTypes)
+	maxUploadBytes = c.MaxUploadBytes
+	maxAnimatedBytes = c.MaxAnimatedBytes
+	minWidth = c.MinWidth
+	minHeight = c.MinHeight
+	maxPixels = c.MaxPixels
+	maxExportBytes = c.MaxExportBytes
+	maxImportBytes = c.MaxImportBytes
+	maxImportEntries = c.MaxImportEntries
+	maxBatchDelete = c.MaxBatchDelete
+	maxSignedURLTTL = c.MaxSignedURLTTL
+	thumbnailSize = c.ThumbnailSize
+	stripExif = c.StripExif
+	trustedProxies = c.TrustedProxies
+	trashRetention = c.TrashRetention
+	uploadExpiry = c.UploadExpiry
+	janitorInterval = c.JanitorInterval
+	janitorRate = c.JanitorRate
+	janitorDryRun = c.JanitorDryRun
+	requestTimeout = c.RequestTimeout
+	retryAttempts = c.StorageRetryAttempts
+	retryBaseDelay = c.StorageRetryBaseDelay
+	statsTTL = c.StatsCacheTTL
+	listCacheTTL = c.ListCacheTTL
+	listHiddenPrefixes = c.ListHiddenPrefixes
+	listImagesOnly = c.ListImagesOnly
+	contentCacheBytes = c.ContentCacheBytes
+	contentCacheMaxObject = c.ContentCacheMaxObjectBytes
+	maxLabels = c.MaxLabels
+	compressionLevel = c.CompressionLevel
+	compressionMinBytes = c.CompressionMinBytes
+}
+
+// redacted stands in for secrets that are set.
+const redacted = "REDACTED"
+
+// ConfigView is the effective configuration, by the variable each setting
+// is read from.
+type ConfigView map[string]string
+
+func (v ConfigView) JSON() (string, error) {
+	b, err := v.JSONBytes()
+	return string(b), err
+}
+
+func (v ConfigView) JSONBytes() ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// View returns c as it is shown at /api/v1/admin/config, with secrets
+// redacted. Lists are shown the way they are set, separated by commas.
+func (c Config) View() ConfigView {
+	view := ConfigView{}
+	cv := reflect.ValueOf(c)
+	for i := 0; i < cv.NumField(); i++ {
+		field := cv.Type().Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		var v string
+		switch f := cv.Field(i).Interface().(type) {
+		case []string:
+			v = strings.Join(f, ",")
+		default:
+			v = fmt.Sprint(f)
+		}
+		if field.Tag.Get("secret") == "true" && v != "" {
+			v = redacted
+		}
+		view[name] = v
+	}
+
+	return view
+}
+
+// ServeConfig shows c at /api/v1/admin/config to callers with an API key.
+func (s *Server) ServeConfig(c Config) {
+	s.config = &c
+}
+
+// configHandler serves the effective configuration. It always needs an
+// API key, even when reads don't, so it isn't served without API_KEYS.
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdminKey(w, r) {
+		return
+	}
+	if s.config == nil {
+		writeErrorMsg(w, http.StatusNotFound, fmt.Errorf("the configuration isn't served"))
+		return
+	}
+
+	writeJSON(w, s.config.View(), http.StatusOK)
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envMap looks variables up in a map, standing in for os.LookupEnv.
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := LoadConfig(envMap(nil))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if c.Port != "8080" || c.MaxUploadBytes != maxUploadBytes || c.ShutdownTimeout != defaultShutdownTimeout {
+		t.Fatalf("expected the defaults, got: %+v", c)
+	}
+	if !reflect.DeepEqual(c.AllowedMimeTypes, defaultMimeTypes) || !reflect.DeepEqual(c.CORSAllowedOrigins, corsOrigins) {
+		t.Fatalf("expected the default lists, got: %v %v", c.AllowedMimeTypes, c.CORSAllowedOrigins)
+	}
+	if c.RateLimitRPS != 0 || c.MaxConcurrentRequests != 0 || c.EnableMetrics {
+		t.Fatalf("expected limits and features off, got: %+v", c)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	c, err := LoadConfig(envMap(map[string]string{
+		"PORT":                    "9000",
+		"ALLOWED_MIME_TYPES":      "image/png, image/webp",
+		"MAX_UPLOAD_BYTES":        "1024",
+		"TRASH_RETENTION":         "0",
+		"ENABLE_METRICS":          "true",
+		"LOG_LEVEL":               "warning",
+		"MODERATION":              "vision",
+		"MODERATION_THRESHOLD":    "possible",
+		"RATE_LIMIT_RPS":          "2.5",
+		"MAX_CONCURRENT_REQUESTS": "8",
+		"CORS_ALLOWED_ORIGINS":    "",
+	}))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if c.Port != "9000" || c.MaxUploadBytes != 1024 || c.TrashRetention != 0 || !c.EnableMetrics {
+		t.Fatalf("expected the settings, got: %+v", c)
+	}
+	if want := []string{"image/png", "image/webp"}; !reflect.DeepEqual(c.AllowedMimeTypes, want) {
+		t.Fatalf("expected: %v, got: %v", want, c.AllowedMimeTypes)
+	}
+	if c.LogLevel != SeverityWarning || c.ModerationThreshold != "POSSIBLE" {
+		t.Fatalf("expected the log level and threshold, got: %v %v", c.LogLevel, c.ModerationThreshold)
+	}
+	// Bursts, writes and queues follow the limits they go with.
+	if c.RateLimitBurst != 3 || c.RateLimitWriteRPS != 2.5 || c.RateLimitWriteBurst != 3 || c.ConcurrencyQueue != 8 {
+		t.Fatalf("expected derived limits, got: %+v", c)
+	}
+	if len(c.CORSAllowedOrigins) != 0 {
+		t.Fatalf("expected no origins, got: %v", c.CORSAllowedOrigins)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, err := LoadConfig(envMap(map[string]string{
+		"MAX_UPLOAD_BYTES":  "-1",
+		"SHUTDOWN_TIMEOUT":  "soon",
+		"ENABLE_METRICS":    "yes please",
+		"COMPRESSION_LEVEL": "10",
+		"ID_STRATEGY":       "random",
+		"WEBHOOK_URLS":      "https://example.com/hook",
+		"LABELS":            "magic",
+	}))
+	ce, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("expected a ConfigError, got: %v", err)
+	}
+
+	// Every problem is reported, not just the first.
+	for _, want := range []string{
+		`invalid MAX_UPLOAD_BYTES "-1"`,
+		`invalid SHUTDOWN_TIMEOUT "soon"`,
+		`invalid ENABLE_METRICS "yes please"`,
+		`invalid COMPRESSION_LEVEL "10"`,
+		`invalid ID_STRATEGY "random"`,
+		"WEBHOOK_SECRET is required",
+		`invalid LABELS "magic"`,
+	} {
+		if !strings.Contains(ce.Error(), want) {
+			t.Fatalf("expected the error to contain %q, got:\n%s", want, ce.Error())
+		}
+	}
+	if len(ce) != 7 {
+		t.Fatalf("expected 7 problems, got: %d", len(ce))
+	}
+}
+
+func TestConfigView(t *testing.T) {
+	c, err := LoadConfig(envMap(map[string]string{
+		"API_KEYS":             "secret,other",
+		"WEBHOOK_URLS":         "https://a.example.com,https://b.example.com",
+		"WEBHOOK_SECRET":       "shh",
+		"UPLOAD_EXPIRY":        "90m",
+		"CORS_ALLOWED_METHODS": "GET,POST",
+	}))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	view := c.View()
+	want := map[string]string{
+		"API_KEYS":             redacted,
+		"WEBHOOK_SECRET":       redacted,
+		"PUBSUB_TOPIC":         "",
+		"WEBHOOK_URLS":         "https://a.example.com,https://b.example.com",
+		"UPLOAD_EXPIRY":        (90 * time.Minute).String(),
+		"CORS_ALLOWED_METHODS": "GET,POST",
+		"LOG_LEVEL":            "INFO",
+		"PORT":                 "8080",
+	}
+	for k, v := range want {
+		if got, ok := view[k]; !ok || got != v {
+			t.Fatalf("expected %s to be %q, got: %q", k, v, got)
+		}
+	}
+	if n := reflect.TypeOf(c).NumField(); len(view) != n {
+		t.Fatalf("expected every one of %d settings, got: %d", n, len(view))
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	c, err := LoadConfig(envMap(map[string]string{"API_KEYS": "secret"}))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	get := func(server *Server, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/admin/config", nil)
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	// Without API keys there is no way to authenticate.
+	server := NewServer(NewMemoryStorage())
+	server.ServeConfig(c)
+	if w := get(server, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+
+	// Reads don't need a key, but the configuration still does.
+	server.RequireAPIKey(c.APIKeys, false)
+	for _, key := range []string{"", "wrong"} {
+		if w := get(server, key); w.Code != http.StatusUnauthorized {
+			t.Fatalf("with key %q expected: %v, got: %v", key, http.StatusUnauthorized, w.Code)
+		}
+	}
+
+	w := get(server, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	view := ConfigView{}
+	if err := json.Unmarshal(w.Body.Bytes(), &view); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if view["API_KEYS"] != redacted || strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("expected the keys to be redacted, got: %s", w.Body.String())
+	}
+}
+
+func TestLoadConfigTLS(t *testing.T) {
+	tests := []map[string]string{
+		{"TLS_CERT_FILE": "cert.pem"},
+		{"TLS_KEY_FILE": "key.pem"},
+		{"TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem", "ENABLE_H2C": "true"},
+	}
+	for _, env := range tests {
+		if _, err := LoadConfig(envMap(env)); err == nil {
+			t.Fatalf("expected an error for %v", env)
+		}
+	}
+
+	c, err := LoadConfig(envMap(map[string]string{"TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem"}))
+	if err != nil || c.TLSCertFile != "cert.pem" || c.TLSKeyFile != "key.pem" {
+		t.Fatalf("expected the certificate files, got: %+v %v", c, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds on the content cache, set from CONTENT_CACHE_BYTES and
+// CONTENT_CACHE_MAX_OBJECT_BYTES. A zero contentCacheBytes turns it off.
+var (
+	contentCacheBytes     int64 = 64 << 20
+	contentCacheMaxObject int64 = 1 << 20
+)
+
+// ContentCache holds the contents of the originals served most recently,
+// up to a number of bytes, dropping those used least recently to make
+// room. Entries are kept under the name and generation of the object, so
+// an image that is replaced is never served from the cache again.
+type ContentCache struct {
+	max, maxObject int64
+	metrics        *Metrics
+	hits, misses   atomic.Int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// cachedContent is an object in the cache.
+type cachedContent struct {
+	key         string
+	data        []byte
+	filename    string
+	contentType string
+	etag        string
+	checksums   Checksums
+	updated     time.Time
+}
+
+// NewContentCache returns a ContentCache of up to max bytes, keeping no
+// object bigger than maxObject. Lookups are counted in m, which can be nil.
+func NewContentCache(max, maxObject int64, m *Metrics) *ContentCache {
+	c := &ContentCache{
+		max:       max,
+		maxObject: maxObject,
+		metrics:   m,
+		order:     list.New(),
+		entries:   map[string]*list.Element{},
+	}
+	m.watchContentCache(c)
+
+	return c
+}
+
+// CacheContent serves the originals of images from c where it can.
+func (s *Server) CacheContent(c *ContentCache) {
+	s.content = c
+}
+
+// contentKey is what the object f is kept under, for the scope it was read
+// in.
+func contentKey(scope string, f CSFile) string {
+	return scope + "/" + f.Name + "#" + strconv.FormatInt(f.Generation, 10)
+}
+
+// get returns the object kept under key, marking it used.
+func (c *ContentCache) get(key string) (*cachedContent, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+
+	c.metrics.contentCacheLookup(ok)
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return el.Value.(*cachedContent), true
+}
+
+// put keeps e, making room for it if need be. Objects too big to keep are
+// left out.
+func (c *ContentCache) put(e *cachedContent) {
+	n := int64(len(e.data))
+	if n > c.maxObject || n > c.max {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[e.key]; ok {
+		return
+	}
+	for c.size+n > c.max {
+		oldest := c.order.Back()
+		old := c.order.Remove(oldest).(*cachedContent)
+		delete(c.entries, old.key)
+		c.size -= int64(len(old.data))
+	}
+	c.entries[e.key] = c.order.PushFront(e)
+	c.size += n
+}
+
+// hitRatio returns the share of lookups that found what they were after.
+func (c *ContentCache) hitRatio() float64 {
+	hits, misses := c.hits.Load(), c.misses.Load()
+	if hits+misses == 0 {
+		return 0
+	}
+
+	return float64(hits) / float64(hits+misses)
+}
+
+// bytes returns how much the cache holds.
+func (c *ContentCache) bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// reader returns a CSReader over e, to be written as an object read from
+// storage would be.
+func (e *cachedContent) reader() *CSReader {
+	return &CSReader{
+		ReadCloser:  io.NopCloser(bytes.NewReader(e.data)),
+		Filename:    e.filename,
+		ContentType: e.contentType,
+		Size:        int64(len(e.data)),
+		ETag:        e.etag,
+		Checksums:   e.checksums,
+		Updated:     e.updated,
+	}
+}
+
+// cachedContentHandler serves the original of image id from the content
+// cache, or from storage if it isn't there, keeping it for next time if
+// it is small enough. Finding the generation to look for means reading the
+// image's files first.
+func (s *Server) cachedContentHandler(w http.ResponseWriter, r *http.Request, id string) {
+	fs, err := s.storage.Read(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to open image %s: %v", id, err))
+		return
+	}
+	original, ok := originalFile(fs)
+	if !ok {
+		writeNotFound(w, id)
+		return
+	}
+
+	key := contentKey(scopeOf(r.Context()), original)
+	if e, ok := s.content.get(key); ok {
+		writeObject(w, r, e.reader())
+		return
+	}
+
+	obj, err := s.storage.Open(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to open image %s: %v", id, err))
+		return
+	}
+	defer obj.Close()
+
+	// The object may have changed since its files were read, in which case
+	// it isn't the generation the key is for.
+	if obj.Size > s.content.maxObject || obj.ETag != original.ETag {
+		writeObject(w, r, obj)
+		return
+	}
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to read image %s: %v", id, err))
+		return
+	}
+	e := &cachedContent{
+		key:         key,
+		data:        data,
+		filename:    obj.Filename,
+		contentType: obj.ContentType,
+		etag:        obj.ETag,
+		checksums:   obj.Checksums,
+		updated:     obj.Updated,
+	}
+	s.content.put(e)
+
+	writeObject(w, r, e.reader())
+}
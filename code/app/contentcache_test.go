@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStorage counts the objects opened.
+type countingStorage struct {
+	*MemoryStorage
+	opens atomic.Int32
+}
+
+func (s *countingStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	s.opens.Add(1)
+	return s.MemoryStorage.Open(ctx, id)
+}
+
+func getContent(t *testing.T, server *Server, id string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/"+id+"/content", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	return w
+}
+
+func TestContentCache(t *testing.T) {
+	store := &countingStorage{MemoryStorage: newTestMemoryStorage(t, "a.png")}
+	metrics := NewMetrics()
+	server := NewServer(store)
+	server.CacheContent(NewContentCache(1<<20, 1<<20, metrics))
+
+	first := getContent(t, server, "a")
+	second := getContent(t, server, "a")
+	if n := store.opens.Load(); n != 1 {
+		t.Fatalf("expected one open of storage, got: %d", n)
+	}
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Fatalf("expected the same content from the cache")
+	}
+	for _, h := range []string{"ETag", "Content-Type", "Content-Length"} {
+		if first.Header().Get(h) == "" || first.Header().Get(h) != second.Header().Get(h) {
+			t.Fatalf("expected the same %s, got: %q and %q", h, first.Header().Get(h), second.Header().Get(h))
+		}
+	}
+
+	// A hit still answers conditional requests.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image/a/content", nil)
+	r.Header.Set("If-None-Match", second.Header().Get("ETag"))
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotModified, w.Code)
+	}
+
+	m := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(m, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`scaler_content_cache_lookups_total{result="hit"} 2`,
+		`scaler_content_cache_lookups_total{result="miss"} 1`,
+		"scaler_content_cache_hit_ratio 0.6666",
+		"scaler_content_cache_bytes " + first.Header().Get("Content-Length"),
+	} {
+		if !strings.Contains(m.Body.String(), want) {
+			t.Fatalf("expected metrics to contain %q, got:\n%s", want, m.Body.String())
+		}
+	}
+}
+
+func TestContentCacheReplaced(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+	server.CacheContent(NewContentCache(1<<20, 1<<20, nil))
+
+	before := getContent(t, server, "a")
+
+	// Replacing the image makes a new generation, which isn't in the cache.
+	content := append(testPNG(t), []byte("trailer")...)
+	if _, err := ms.Create(context.Background(), "a.png", newMemoryFile(content), CreateOptions{Overwrite: true}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	after := getContent(t, server, "a")
+	if !bytes.Equal(after.Body.Bytes(), content) {
+		t.Fatalf("expected the new content, got %d bytes", after.Body.Len())
+	}
+	if after.Header().Get("ETag") == before.Header().Get("ETag") {
+		t.Fatalf("expected a new ETag, got: %q", after.Header().Get("ETag"))
+	}
+}
+
+func TestContentCacheEviction(t *testing.T) {
+	c := NewContentCache(10, 6, nil)
+	put := func(key string, n int) {
+		c.put(&cachedContent{key: key, data: make([]byte, n)})
+	}
+
+	put("a", 4)
+	put("b", 4)
+	c.get("a")
+	// Making room for c drops b, which was used least recently.
+	put("c", 4)
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Fatalf("expected %s to be kept", key)
+		}
+	}
+	if n := c.bytes(); n != 8 {
+		t.Fatalf("expected 8 bytes held, got: %d", n)
+	}
+
+	// Objects bigger than the most kept are left out.
+	put("d", 7)
+	if _, ok := c.get("d"); ok {
+		t.Fatalf("expected d to be left out")
+	}
+	if n := c.bytes(); n != 8 {
+		t.Fatalf("expected 8 bytes held, got: %d", n)
+	}
+}
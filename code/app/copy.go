@@ -0,0 +1,140 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CopyRequest gives the filename a copy of an image should have.
+type CopyRequest struct {
+	Destination string `json:"destination"`
+}
+
+// copyHandler stores a copy of an image under a new name, without its
+// contents leaving storage. The copy keeps the metadata of the image, and
+// gets a thumbnail of its own if the image has one.
+func (s *Server) copyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	req := CopyRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNameBodyBytes)).Decode(&req); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return
+	}
+	name, err := sanitizeFilename(req.Destination)
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+
+	fs, err := s.storage.Read(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", id, err))
+		return
+	}
+	original, ok := originalFile(fs)
+	if !ok {
+		writeNotFound(w, id)
+		return
+	}
+	// The contents are copied as they are, so their type can't change.
+	if ext := filepath.Ext(original.Name); !strings.EqualFold(filepath.Ext(name), ext) {
+		writeError(w, invalidArgument(fmt.Errorf("invalid destination %q: want the extension %s", name, ext)))
+		return
+	}
+
+	newID := imageID(objectName(name))
+	if newID == id {
+		writeError(w, invalidArgument(errors.New("an image can't be copied over itself")))
+		return
+	}
+
+	err = s.copyImage(r.Context(), id, newID, r.URL.Query().Get("overwrite") == "true")
+	if err == ErrConflict {
+		writeErrorMsg(w, http.StatusConflict, fmt.Errorf("image id: %s already exists", newID))
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to copy %s: %w", id, err))
+		return
+	}
+
+	fs, err = s.storage.Read(r.Context(), newID)
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", newID, err))
+		return
+	}
+	copied, _ := originalFile(fs)
+	if idStrategy == idStrategyUUID {
+		if err := s.storage.UpdateMetadata(r.Context(), copied.Name, map[string]string{originalNameKey: name}); err != nil {
+			writeError(w, fmt.Errorf("failed to name copy of %s: %w", id, err))
+			return
+		}
+		copied.Metadata = copyMetadata(copied.Metadata)
+		copied.Metadata[originalNameKey] = name
+	}
+	img := NewImage(copied)
+
+	s.contents.of(r.Context()).add(newID, img.ETag)
+	s.notify(r.Context(), ImageEvent{Action: actionCreated, ID: newID, Size: img.SizeBytes, ContentType: img.ContentType, image: &img})
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(newID)))
+	writeJSON(w, img, http.StatusCreated)
+}
+
+// copyImage copies image id to newID, making the copy a thumbnail of its
+// own from the one made for id. Whatever was cached for an image newID
+// replaces is dropped.
+func (s *Server) copyImage(ctx context.Context, id, newID string, overwrite bool) error {
+	if err := s.storage.Copy(ctx, id, newID, overwrite); err != nil {
+		return err
+	}
+	s.contents.of(ctx).forget(newID)
+
+	s.dropVariants(ctx, newID)
+	if err := s.storage.DeleteObject(ctx, thumbnailName(newID)); err != nil && err != ErrNotFound {
+		weblog(fmt.Sprintf("error deleting thumbnail for %s: %s", newID, err))
+	}
+	if err := s.copyObject(ctx, thumbnailName(id), thumbnailName(newID)); err != nil && err != ErrNotFound {
+		weblog(fmt.Sprintf("error copying thumbnail for %s: %s", id, err))
+	}
+
+	return nil
+}
+
+// copyObject writes the contents of the object called from to to.
+func (s *Server) copyObject(ctx context.Context, from, to string) error {
+	obj, err := s.storage.OpenObject(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	return s.storage.PutObject(ctx, to, obj, obj.ContentType)
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func copyRequest(id, query, body string) *http.Request {
+	return httptest.NewRequest(http.MethodPost, "/api/v1/image/"+id+":copy"+query, strings.NewReader(body))
+}
+
+func TestCopy(t *testing.T) {
+	ms := newTestMemoryStorage(t, "x.png", "taken.png")
+	ctx := context.Background()
+	if err := ms.UpdateMetadata(ctx, "processed/x/original.png", map[string]string{"meta.owner": "sam"}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := ms.PutObject(ctx, thumbnailName("x"), strings.NewReader("thumb"), "image/png"); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	server := NewServer(ms)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, copyRequest("x", "", `{"destination": "copy-of-x.png"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Location"); got != "/api/v1/image/copy-of-x" {
+		t.Fatalf("expected: /api/v1/image/copy-of-x, got: %s", got)
+	}
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if img.ID != "copy-of-x" || img.Metadata["owner"] != "sam" {
+		t.Fatalf("expected copy-of-x with the metadata of x, got: %+v", img)
+	}
+
+	// Both have their own contents and thumbnail.
+	for _, id := range []string{"x", "copy-of-x"} {
+		if _, err := ms.Read(ctx, id); err != nil {
+			t.Fatalf("%s expected no error, got: %s", id, err)
+		}
+		obj, err := ms.OpenObject(ctx, thumbnailName(id))
+		if err != nil {
+			t.Fatalf("%s expected a thumbnail, got: %s", id, err)
+		}
+		b, _ := io.ReadAll(obj)
+		obj.Close()
+		if string(b) != "thumb" {
+			t.Fatalf("%s expected: thumb, got: %s", id, b)
+		}
+	}
+
+	type test struct {
+		id     string
+		query  string
+		body   string
+		status int
+	}
+
+	tests := []test{
+		{"missing", "", `{"destination": "found.png"}`, http.StatusNotFound},
+		{"x", "", `{"destination": "taken.png"}`, http.StatusConflict},
+		{"x", "", `{"destination": "x.png"}`, http.StatusBadRequest},
+		{"x", "", `{"destination": "x.gif"}`, http.StatusBadRequest},
+		{"x", "", `{"destination": "..."}`, http.StatusBadRequest},
+		{"x", "", `{"destination": `, http.StatusBadRequest},
+		{"x", "?overwrite=true", `{"destination": "taken.png"}`, http.StatusCreated},
+	}
+	for _, c := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, copyRequest(c.id, c.query, c.body))
+		if w.Code != c.status {
+			t.Fatalf("%s%s %s expected: %v, got: %v %s", c.id, c.query, c.body, c.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestCopyUUID(t *testing.T) {
+	idStrategy = idStrategyUUID
+	t.Cleanup(func() { idStrategy = idStrategyFilename })
+
+	ms := newTestMemoryStorage(t, "0b6f.png")
+	server := NewServer(ms)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, copyRequest("0b6f", "", `{"destination": "holiday.png"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if img.ID == "0b6f" || img.OriginalName != "holiday.png" {
+		t.Fatalf("expected a new id named holiday.png, got: %s %s", img.ID, img.OriginalName)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// CORS defaults, overridden by CORS_ALLOWED_ORIGINS, CORS_ALLOWED_HEADERS
+// and CORS_ALLOWED_METHODS.
+var (
+	corsOrigins = []string{"*"}
+	corsHeaders = []string{
+		"X-Requested-With", "Content-Type", "Authorization", apiKeyHeader, tenantHeader,
+		"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", ttlHeader,
+		"Last-Event-ID",
+	}
+	corsMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	}
+)
+
+// corsExposed are the response headers pages may read, which resumable
+// uploads can't do without, X-Served-By for pages showing which instance
+// answered, X-Skipped-Objects for those warning of a bucket with more in it
+// than images, X-Goog-Hash for those checking what they downloaded, and
+// ETag for those making changes conditional on it.
+var corsExposed = []string{
+	"ETag", "Location", "Content-Location", "Tus-Resumable", "Tus-Version", "Tus-Extension",
+	"Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Expires", "Upload-Metadata",
+	servedByHeader, skippedHeader, hashHeader,
+}
+
+// EnableCORS lets pages served from origins call the API with headers and
+// methods, and connect to its WebSocket. An origin may stand in for any
+// subdomain with a *, as in https://*.example.com, and a lone * allows every
+// origin.
+func (s *Server) EnableCORS(origins, headers, methods []string) {
+	opts := []handlers.CORSOption{
+		handlers.AllowedHeaders(headers),
+		handlers.AllowedMethods(methods),
+		handlers.ExposedHeaders(corsExposed),
+	}
+
+	all := false
+	for _, o := range origins {
+		all = all || o == "*"
+	}
+	if all {
+		opts = append(opts, handlers.AllowedOrigins([]string{"*"}))
+		s.socketOrigins = func(string) bool { return true }
+	} else {
+		s.socketOrigins = originMatcher(origins)
+		opts = append(opts, handlers.AllowedOriginValidator(s.socketOrigins))
+	}
+
+	cors := handlers.CORS(opts...)
+	s.Use(func(next http.Handler) http.Handler {
+		h := cors(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Only preflights are CORS's business. A plain OPTIONS would
+			// otherwise be turned away for not being one.
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// The allowed origin is echoed back, so caches must keep a
+			// copy of the response per origin.
+			if !all {
+				w.Header().Add("Vary", "Origin")
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+}
+
+// originMatcher reports whether an origin is one of origins, or a subdomain
+// of one with a wildcard.
+func originMatcher(origins []string) func(string) bool {
+	return func(origin string) bool {
+		origin = strings.ToLower(origin)
+		for _, o := range origins {
+			o = strings.ToLower(o)
+			i := strings.Index(o, "*")
+			if i < 0 {
+				if o == origin {
+					return true
+				}
+				continue
+			}
+
+			prefix, suffix := o[:i], o[i+1:]
+			if len(origin) <= len(prefix)+len(suffix) ||
+				!strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+				continue
+			}
+			// The wildcard only stands in for subdomains, not a port,
+			// path or credentials.
+			if sub := origin[len(prefix) : len(origin)-len(suffix)]; !strings.ContainsAny(sub, "/:@") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// allowOptions answers OPTIONS for every route registered so far, listing
+// the methods its path accepts. CORS preflights are answered before they
+// get here; this is for everyone else.
+func (s *Server) allowOptions() {
+	var paths []string
+	allowed := map[string][]string{}
+	s.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		if _, ok := allowed[path]; !ok {
+			paths = append(paths, path)
+		}
+		allowed[path] = append(allowed[path], methods...)
+		return nil
+	})
+
+	for _, path := range paths {
+		allow := strings.Join(append(allowed[path], http.MethodOptions), ", ")
+		s.router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+		}).Methods(http.MethodOptions)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginMatcher(t *testing.T) {
+	match := originMatcher([]string{"https://app.example.com", "https://*.example.org"})
+
+	tests := map[string]bool{
+		"https://app.example.com":          true,
+		"https://APP.example.com":          true,
+		"http://app.example.com":           false,
+		"https://example.com":              false,
+		"https://a.example.org":            true,
+		"https://a.b.example.org":          true,
+		"https://example.org":              false,
+		"https://.example.org":             false,
+		"https://evil.com/.example.org":    false,
+		"https://a.example.org.evil.com":   false,
+		"https://user@a.example.org":       false,
+		"https://a.example.org:8080":       false,
+		"https://evil.com:1@a.example.org": false,
+	}
+
+	for origin, want := range tests {
+		t.Run(origin, func(t *testing.T) {
+			if got := match(origin); got != want {
+				t.Fatalf("expected: %v, got: %v", want, got)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	server.EnableCORS([]string{"https://*.example.com"}, corsHeaders, corsMethods)
+
+	tests := map[string]struct {
+		method  string
+		target  string
+		headers map[string]string
+		status  int
+		origin  string
+		allow   string
+	}{
+		"preflight id": {
+			method: http.MethodOptions,
+			target: "/api/v1/image/a",
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  http.MethodDelete,
+				"Access-Control-Request-Headers": "Authorization, Content-Type",
+			},
+			status: http.StatusOK,
+			origin: "https://app.example.com",
+		},
+		"preflight unknown header": {
+			method: http.MethodOptions,
+			target: "/api/v1/image/a",
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  http.MethodDelete,
+				"Access-Control-Request-Headers": "X-Unknown",
+			},
+			status: http.StatusForbidden,
+		},
+		"other origin": {
+			method:  http.MethodGet,
+			target:  "/api/v1/image/a",
+			headers: map[string]string{"Origin": "https://example.net"},
+			status:  http.StatusOK,
+		},
+		"allowed origin": {
+			method:  http.MethodGet,
+			target:  "/api/v1/image/a",
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			status:  http.StatusOK,
+			origin:  "https://app.example.com",
+		},
+		"options id": {
+			method: http.MethodOptions,
+			target: "/api/v1/image/a",
+			status: http.StatusNoContent,
+			allow:  "GET, DELETE, POST, PUT, PATCH, OPTIONS",
+		},
+		"options list": {
+			method: http.MethodOptions,
+			target: "/api/v1/image",
+			status: http.StatusNoContent,
+			allow:  "GET, POST, OPTIONS",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			server.ServeHTTP(rr, req)
+
+			if rr.Code != tc.status {
+				t.Fatalf("expected: %v, got: %v", tc.status, rr.Code)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tc.origin {
+				t.Fatalf("expected origin: %q, got: %q", tc.origin, got)
+			}
+			if got := rr.Header().Get("Allow"); got != tc.allow {
+				t.Fatalf("expected allow: %q, got: %q", tc.allow, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+// ctlUsage explains scaler ctl, the maintenance commands built into the
+// server binary so that they share its storage code.
+const ctlUsage = `usage: scaler ctl <command> [flags] [args]
+
+commands:
+  list               list images, those starting with --prefix if given
+  upload <files...>  upload files as new images
+  delete <ids...>    delete images for good
+  purge --prefix P   delete every image whose id starts with P for good
+  stats              count images and the space they take
+
+flags:
+  --bucket   the bucket to work on, $BUCKET by default
+  --json     print JSON, for scripts
+  --dry-run  show what delete and purge would do without doing it
+  --force    upload files even if an image with the same content exists
+`
+
+// deleteStatusDryRun is the status of an image a dry run would delete.
+const deleteStatusDryRun = "would delete"
+
+// errFailed means a command finished, but not everything it was asked to
+// do succeeded. The details have already been printed.
+var errFailed = errors.New("some operations failed")
+
+// ctl runs maintenance commands against a Server's storage.
+type ctl struct {
+	server *Server
+	out    io.Writer
+	json   bool
+	dryRun bool
+	force  bool
+	prefix string
+}
+
+// runCtl runs scaler ctl with args, returning the status to exit with.
+func runCtl(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(stderr, ctlUsage)
+		return 2
+	}
+	cmd, args := args[0], args[1:]
+
+	c := &ctl{out: stdout}
+	fs := flag.NewFlagSet("scaler ctl "+cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, ctlUsage) }
+	bucket := fs.String("bucket", os.Getenv("BUCKET"), "the bucket to work on")
+	fs.BoolVar(&c.json, "json", false, "print JSON")
+	fs.BoolVar(&c.dryRun, "dry-run", false, "show what would be deleted")
+	fs.BoolVar(&c.force, "force", false, "upload files even if their content is already stored")
+	fs.StringVar(&c.prefix, "prefix", "", "only images whose id starts with this")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *bucket == "" && os.Getenv("STORAGE_BACKEND") != "filesystem" {
+		fmt.Fprintln(stderr, "scaler ctl: no bucket, set BUCKET or --bucket")
+		return 2
+	}
+
+	// Anything the shared code logs goes with the errors, not the output.
+	logOutput = stderr
+	store, err := openStorage(os.Getenv("STORAGE_BACKEND"), os.Getenv("STORAGE_ROOT"), *bucket, nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "scaler ctl: %s\n", err)
+		return 1
+	}
+	defer store.Close()
+	c.server = NewServer(store)
+
+	if err := c.run(context.Background(), cmd, fs.Args()); err != nil {
+		if err != errFailed {
+			fmt.Fprintf(stderr, "scaler ctl %s: %s\n", cmd, err)
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// run runs cmd with args.
+func (c *ctl) run(ctx context.Context, cmd string, args []string) error {
+	switch cmd {
+	case "list":
+		return c.list(ctx)
+	case "upload":
+		return c.upload(ctx, args)
+	case "delete":
+		if len(args) == 0 {
+			return errors.New("no ids to delete")
+		}
+		return c.delete(ctx, args)
+	case "purge":
+		if c.prefix == "" {
+			return errors.New("--prefix is required")
+		}
+		is, err := c.server.allImages(ctx, c.prefix)
+		if err != nil {
+			return fmt.Errorf("could not list images: %s", err)
+		}
+		ids := make([]string, len(is))
+		for i, img := range is {
+			ids[i] = img.Name
+		}
+		return c.delete(ctx, ids)
+	case "stats":
+		return c.stats(ctx)
+	default:
+		return fmt.Errorf("unknown command %q, see scaler ctl help", cmd)
+	}
+}
+
+func (c *ctl) list(ctx context.Context) error {
+	is, err := c.server.allImages(ctx, c.prefix)
+	if err != nil {
+		return fmt.Errorf("could not list images: %s", err)
+	}
+
+	if c.json {
+		return c.print(is)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSIZE\tTYPE\tUPDATED")
+	for _, img := range is {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", img.Name, img.SizeBytes, img.ContentType, img.Updated.Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
+
+func (c *ctl) upload(ctx context.Context, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("no files to upload")
+	}
+
+	results := UploadResults{}
+	for _, p := range paths {
+		res := UploadResult{Name: filepath.Base(p)}
+		img, status, err := c.uploadFile(ctx, p)
+		res.Status = status
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Image = &img
+		}
+		results = append(results, res)
+	}
+
+	if c.json {
+		if err := c.print(results); err != nil {
+			return err
+		}
+	} else {
+		for _, res := range results {
+			if res.Error != "" {
+				fmt.Fprintf(c.out, "%s: %s\n", res.Name, res.Error)
+				continue
+			}
+			if res.Image.Deduplicated {
+				fmt.Fprintf(c.out, "%s: already stored as %s\n", res.Name, res.Image.Name)
+				continue
+			}
+			fmt.Fprintf(c.out, "%s: uploaded as %s\n", res.Name, res.Image.Name)
+		}
+	}
+
+	for _, res := range results {
+		if res.Error != "" {
+			return errFailed
+		}
+	}
+	return nil
+}
+
+// uploadFile stores the file at path the same way an upload would be.
+func (c *ctl) uploadFile(ctx context.Context, path string) (Image, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Image{}, http.StatusBadRequest, err
+	}
+	defer f.Close()
+
+	return c.server.storeFile(ctx, filepath.Base(path), mime.TypeByExtension(filepath.Ext(path)), f, uploadOptions{Force: c.force})
+}
+
+// delete deletes images ids for good, or with --dry-run says which of them
+// it would.
+func (c *ctl) delete(ctx context.Context, ids []string) error {
+	resp := BatchDeleteResults{Results: []DeleteResult{}}
+	for _, id := range ids {
+		var res DeleteResult
+		if c.dryRun {
+			res = c.wouldDelete(ctx, id)
+		} else {
+			res = c.server.batchDeleteOne(ctx, id)
+		}
+
+		switch res.Status {
+		case deleteStatusDeleted, deleteStatusDryRun:
+			resp.Deleted++
+		case deleteStatusNotFound:
+			resp.NotFound++
+		default:
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, res)
+	}
+
+	if c.json {
+		if err := c.print(resp); err != nil {
+			return err
+		}
+	} else {
+		for _, res := range resp.Results {
+			if res.Error != "" {
+				fmt.Fprintf(c.out, "%s: %s: %s\n", res.ID, res.Status, res.Error)
+				continue
+			}
+			fmt.Fprintf(c.out, "%s: %s\n", res.ID, res.Status)
+		}
+	}
+
+	if resp.Failed > 0 {
+		return errFailed
+	}
+	return nil
+}
+
+// wouldDelete reports what deleting id would do, without doing it.
+func (c *ctl) wouldDelete(ctx context.Context, id string) DeleteResult {
+	for _, candidate := range []string{id, imageID(id)} {
+		_, err := c.server.storage.Read(ctx, candidate)
+		if err == nil {
+			return DeleteResult{ID: id, Status: deleteStatusDryRun}
+		}
+		if err != ErrNotFound {
+			return DeleteResult{ID: id, Status: deleteStatusError, Error: err.Error()}
+		}
+	}
+
+	return DeleteResult{ID: id, Status: deleteStatusNotFound}
+}
+
+// ctlStats sums up what is in storage.
+type ctlStats struct {
+	Images       int            `json:"images"`
+	Bytes        int64          `json:"bytes"`
+	ContentTypes map[string]int `json:"contentTypes"`
+	Trashed      int            `json:"trashed"`
+}
+
+func (c *ctl) stats(ctx context.Context) error {
+	is, err := c.server.allImages(ctx, c.prefix)
+	if err != nil {
+		return fmt.Errorf("could not list images: %s", err)
+	}
+	trashed, err := c.server.storage.ListTrash(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list trash: %s", err)
+	}
+
+	st := ctlStats{Images: len(is), ContentTypes: map[string]int{}, Trashed: len(NewTrashedImages(trashed))}
+	for _, img := range is {
+		st.Bytes += img.SizeBytes
+		st.ContentTypes[img.ContentType]++
+	}
+
+	if c.json {
+		return c.print(st)
+	}
+
+	fmt.Fprintf(c.out, "images:  %d\nbytes:   %d\ntrashed: %d\n", st.Images, st.Bytes, st.Trashed)
+	types := make([]string, 0, len(st.ContentTypes))
+	for t := range st.ContentTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(c.out, "  %s: %d\n", t, st.ContentTypes[t])
+	}
+	return nil
+}
+
+// print writes v to the output as indented JSON.
+func (c *ctl) print(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestCtl(t *testing.T, ms *MemoryStorage) (*ctl, *bytes.Buffer) {
+	t.Helper()
+
+	var out bytes.Buffer
+	return &ctl{server: NewServer(ms), out: &out}, &out
+}
+
+func TestCtlDelete(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png", "cat.png")
+	ctx := context.Background()
+
+	c, out := newTestCtl(t, ms)
+	c.dryRun = true
+	c.json = true
+	if err := c.run(ctx, "delete", []string{"a", "missing"}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	var resp BatchDeleteResults
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		t.Fatalf("expected JSON, got: %s", out.String())
+	}
+	if resp.Deleted != 1 || resp.NotFound != 1 || resp.Results[0].Status != deleteStatusDryRun {
+		t.Fatalf("expected a to be deleted in a dry run, got: %+v", resp)
+	}
+	if _, err := ms.Read(ctx, "a"); err != nil {
+		t.Fatalf("expected a dry run to leave a alone, got: %s", err)
+	}
+
+	c, _ = newTestCtl(t, ms)
+	c.prefix = "c"
+	if err := c.run(ctx, "purge", nil); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := ms.Read(ctx, "cat"); err != ErrNotFound {
+		t.Fatalf("expected cat to be purged, got: %v", err)
+	}
+	if _, err := ms.Read(ctx, "b"); err != nil {
+		t.Fatalf("expected b to be kept, got: %s", err)
+	}
+
+	c, _ = newTestCtl(t, ms)
+	if err := c.run(ctx, "purge", nil); err == nil {
+		t.Fatalf("expected purge without a prefix to be refused")
+	}
+}
+
+func TestCtlUploadAndStats(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "new.png")
+	if err := os.WriteFile(path, testPNG(t), 0o644); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	ms := newTestMemoryStorage(t, "a.png")
+	ctx := context.Background()
+
+	c, out := newTestCtl(t, ms)
+	c.force = true
+	if err := c.run(ctx, "upload", []string{path, filepath.Join(dir, "missing.png")}); err != errFailed {
+		t.Fatalf("expected: %v, got: %v", errFailed, err)
+	}
+	if !strings.Contains(out.String(), "new.png: uploaded as new") {
+		t.Fatalf("expected new.png to be uploaded, got: %s", out.String())
+	}
+
+	c, out = newTestCtl(t, ms)
+	c.json = true
+	if err := c.run(ctx, "stats", nil); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	var st ctlStats
+	if err := json.Unmarshal(out.Bytes(), &st); err != nil {
+		t.Fatalf("expected JSON, got: %s", out.String())
+	}
+	if st.Images != 2 || st.ContentTypes["image/png"] != 2 || st.Bytes == 0 {
+		t.Fatalf("expected two png images, got: %+v", st)
+	}
+}
+
+func TestRunCtlUsage(t *testing.T) {
+	var stderr bytes.Buffer
+	if code := runCtl(nil, &bytes.Buffer{}, &stderr); code != 2 {
+		t.Fatalf("expected: 2, got: %v", code)
+	}
+	if !strings.Contains(stderr.String(), "usage: scaler ctl") {
+		t.Fatalf("expected usage, got: %s", stderr.String())
+	}
+}
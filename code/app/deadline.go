@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// requestTimeout bounds how long a request can take before the storage
+// calls it is waiting on are abandoned. Zero leaves requests unbounded.
+var requestTimeout = 30 * time.Second
+
+// withDeadline gives every request requestTimeout to finish. The writer
+// handed on carries the request context, so that writeResponse can tell a
+// failure caused by the deadline or a departed client from a real one.
+func withDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if requestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+			defer cancel()
+		}
+
+		next.ServeHTTP(&contextWriter{w, ctx}, r.WithContext(ctx))
+	})
+}
+
+// contextWriter is a ResponseWriter that knows the context of the request
+// it is answering.
+type contextWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+// Flush lets streaming handlers flush through the writer.
+func (cw *contextWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (cw *contextWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// requestErr returns why the request w answers was cut short, if it was.
+func requestErr(w http.ResponseWriter) error {
+	cw, ok := w.(*contextWriter)
+	if !ok {
+		return nil
+	}
+
+	return cw.ctx.Err()
+}
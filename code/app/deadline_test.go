@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stuckStorage never finishes listing until the context it was given is
+// done.
+type stuckStorage struct {
+	*MemoryStorage
+}
+
+func (s stuckStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	<-ctx.Done()
+	return nil, "", fmt.Errorf("error iterating over bucket query: %s", ctx.Err())
+}
+
+func TestRequestTimeout(t *testing.T) {
+	old := requestTimeout
+	requestTimeout = 10 * time.Millisecond
+	t.Cleanup(func() { requestTimeout = old })
+
+	server := NewServer(stuckStorage{NewMemoryStorage()})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected: %v, got: %v", http.StatusGatewayTimeout, w.Code)
+	}
+}
+
+func TestCanceledRequest(t *testing.T) {
+	buf := captureLogs(t, SeverityDebug)
+
+	server := NewServer(stuckStorage{NewMemoryStorage()})
+	server.Use(accessLog)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image", nil).WithContext(ctx)
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	if strings.Contains(buf.String(), `"severity":"ERROR"`) {
+		t.Fatalf("expected no errors to be logged, got: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"severity":"DEBUG"`) {
+		t.Fatalf("expected the request to be logged at debug, got: %s", buf.String())
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"sync"
+)
+
+// contentIndex maps the checksums of stored originals to the images they
+// belong to, so uploads can be matched against them without listing the
+// bucket each time. It is filled from a listing the first time it is
+// needed and kept up to date as images change.
+//
+// It also keeps the perceptual hashes of the originals, for finding images
+// that look alike. Those of images changed since it was loaded are read
+// again when they are next needed.
+type contentIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	ids    map[string]map[string]bool // checksum to ids
+	sums   map[string]string          // id to checksum
+	hashes map[string]uint64          // id to perceptual hash
+	stale  map[string]bool            // ids whose hash has to be read again
+}
+
+// contentIndexes keeps a contentIndex for each tenant and user.
+type contentIndexes struct {
+	mu      sync.Mutex
+	byScope map[string]*contentIndex
+}
+
+// of returns the index of the tenant and user ctx is for.
+func (x *contentIndexes) of(ctx context.Context) *contentIndex {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	scope := scopeOf(ctx)
+	if x.byScope[scope] == nil {
+		if x.byScope == nil {
+			x.byScope = map[string]*contentIndex{}
+		}
+		x.byScope[scope] = &contentIndex{}
+	}
+	return x.byScope[scope]
+}
+
+// lookup returns the id of an image whose original has the checksum sum,
+// or "" if there isn't one. The index is loaded with load if it has to be.
+func (x *contentIndex) lookup(ctx context.Context, sum string, load func(context.Context) (Images, error)) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.load(ctx, load); err != nil {
+		return "", err
+	}
+
+	// Any of them will do, but always the same one.
+	match := ""
+	for id := range x.ids[sum] {
+		if match == "" || id < match {
+			match = id
+		}
+	}
+	return match, nil
+}
+
+// load fills the index with load, unless it already has been. The caller
+// must hold x.mu.
+func (x *contentIndex) load(ctx context.Context, load func(context.Context) (Images, error)) error {
+	if x.loaded {
+		return nil
+	}
+
+	is, err := load(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list images: %s", err)
+	}
+
+	x.ids, x.sums = map[string]map[string]bool{}, map[string]string{}
+	x.hashes, x.stale = map[string]uint64{}, map[string]bool{}
+	for _, img := range is {
+		x.set(img.Name, img.ETag)
+		delete(x.stale, img.Name)
+		if h, ok := parseHash(img.PerceptualHash); ok {
+			x.hashes[img.Name] = h
+		}
+	}
+	x.loaded = true
+
+	return nil
+}
+
+// add records that image id now has the checksum sum.
+func (x *contentIndex) add(id, sum string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.loaded {
+		x.set(id, sum)
+	}
+}
+
+// forget drops image id from the index.
+func (x *contentIndex) forget(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.loaded {
+		x.set(id, "")
+	}
+}
+
+// set records sum for id, replacing whatever it had. The caller must hold
+// x.mu.
+func (x *contentIndex) set(id, sum string) {
+	delete(x.hashes, id)
+	delete(x.stale, id)
+	if old, ok := x.sums[id]; ok {
+		delete(x.sums, id)
+		delete(x.ids[old], id)
+		if len(x.ids[old]) == 0 {
+			delete(x.ids, old)
+		}
+	}
+	if sum == "" {
+		return
+	}
+
+	x.sums[id] = sum
+	x.stale[id] = true
+	if x.ids[sum] == nil {
+		x.ids[sum] = map[string]bool{}
+	}
+	x.ids[sum][id] = true
+}
+
+// contentSum returns the checksum file would be stored with, in the form
+// of an Image's ETag, hashing it as it is read. file is rewound afterwards.
+func contentSum(file multipart.File) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return objectETag(h.Sum(nil), 0), nil
+}
+
+// findDuplicate returns the image already stored with the checksum sum, if
+// there is one.
+func (s *Server) findDuplicate(ctx context.Context, sum string) (Image, bool, error) {
+	id, err := s.contents.of(ctx).lookup(ctx, sum, func(ctx context.Context) (Images, error) {
+		return s.allImages(ctx, "")
+	})
+	if err != nil || id == "" {
+		return Image{}, false, err
+	}
+
+	fs, err := s.storage.Read(ctx, id)
+	if err == ErrNotFound {
+		// Deleted by someone else since the index was loaded.
+		s.contents.of(ctx).forget(id)
+		return Image{}, false, nil
+	}
+	if err != nil {
+		return Image{}, false, err
+	}
+
+	is, _ := NewImages(fs)
+	if len(is) == 0 || is[0].ETag != sum {
+		s.contents.of(ctx).forget(id)
+		return Image{}, false, nil
+	}
+
+	return is[0], true, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeduplicateUploads(t *testing.T) {
+	// a.png is already stored before the index is first loaded.
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	var other bytes.Buffer
+	if err := png.Encode(&other, image.NewRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatalf("could not encode image: %s", err)
+	}
+
+	upload := func(method, target, filename string, content []byte) (int, Image) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, newUploadRequest(t, method, target, filename, "image/png", content))
+
+		img := Image{}
+		json.Unmarshal(w.Body.Bytes(), &img)
+		return w.Code, img
+	}
+
+	status, img := upload(http.MethodPost, "/api/v1/image", "b.png", testPNG(t))
+	if status != http.StatusOK || !img.Deduplicated || img.Name != "a" {
+		t.Fatalf("expected b.png to be deduplicated to a, got: %v %+v", status, img)
+	}
+
+	status, img = upload(http.MethodPost, "/api/v1/image?force=true", "b.png", testPNG(t))
+	if status != http.StatusCreated || img.Deduplicated || img.Name != "b" {
+		t.Fatalf("expected force to store b, got: %v %+v", status, img)
+	}
+
+	// Once a is gone, copies go to b.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v", http.StatusNoContent, w.Code)
+	}
+
+	status, img = upload(http.MethodPost, "/api/v1/image", "c.png", testPNG(t))
+	if status != http.StatusOK || img.Name != "b" {
+		t.Fatalf("expected c.png to be deduplicated to b, got: %v %+v", status, img)
+	}
+
+	// Once b has other content, there is nothing to match.
+	if status, _ := upload(http.MethodPut, "/api/v1/image/b", "b.png", other.Bytes()); status != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, status)
+	}
+
+	status, img = upload(http.MethodPost, "/api/v1/image", "c.png", testPNG(t))
+	if status != http.StatusCreated || img.Name != "c" {
+		t.Fatalf("expected c to be stored, got: %v %+v", status, img)
+	}
+
+	status, img = upload(http.MethodPost, "/api/v1/image", "d.png", other.Bytes())
+	if status != http.StatusOK || img.Name != "b" {
+		t.Fatalf("expected d.png to be deduplicated to the new b, got: %v %+v", status, img)
+	}
+}
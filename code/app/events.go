@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Actions an ImageEvent reports.
+const (
+	actionCreated = "created"
+	actionUpdated = "updated"
+	actionDeleted = "deleted"
+)
+
+const (
+	// eventTypePrefix is followed by the action in the type of an event.
+	eventTypePrefix = "dev.deploystack.scaler.image."
+	// eventSource is where events say they come from.
+	eventSource = "/api/v1/image"
+	// publishTimeout bounds how long a publisher can take over one event.
+	publishTimeout = 30 * time.Second
+)
+
+// ImageEvent reports a change to an image. The image itself, when the
+// caller has it, goes to those following the stream of changes.
+type ImageEvent struct {
+	Action      string    `json:"action"`
+	ID          string    `json:"id"`
+	Size        int64     `json:"size,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+
+	image *Image
+}
+
+// CloudEvent is the CloudEvents 1.0 envelope an ImageEvent is sent in.
+type CloudEvent struct {
+	SpecVersion     string     `json:"specversion"`
+	Type            string     `json:"type"`
+	Source          string     `json:"source"`
+	ID              string     `json:"id"`
+	Time            time.Time  `json:"time"`
+	Subject         string     `json:"subject"`
+	DataContentType string     `json:"datacontenttype"`
+	Data            ImageEvent `json:"data"`
+}
+
+// NewCloudEvent wraps e in an envelope with an id of its own.
+func NewCloudEvent(e ImageEvent) CloudEvent {
+	return CloudEvent{
+		SpecVersion:     "1.0",
+		Type:            eventTypePrefix + e.Action,
+		Source:          eventSource,
+		ID:              uuid.NewString(),
+		Time:            e.Timestamp,
+		Subject:         e.ID,
+		DataContentType: "application/json",
+		Data:            e,
+	}
+}
+
+// Publisher sends events on to whoever is interested in them.
+type Publisher interface {
+	Publish(ctx context.Context, e CloudEvent) error
+}
+
+// namedPublisher is a Publisher along with the name its failures are
+// reported under.
+type namedPublisher struct {
+	name string
+	Publisher
+}
+
+// AddPublisher has every change to an image published to p. Failures are
+// logged and counted under name.
+func (s *Server) AddPublisher(name string, p Publisher) {
+	s.publishers = append(s.publishers, namedPublisher{name, p})
+}
+
+// notify publishes e to every publisher in the background, so that a slow
+// or failing publisher can neither hold up nor fail the request behind it,
+// and to the streams following changes in the scope of ctx. The cached
+// stats and listings are dropped as well, since e makes them stale.
+func (s *Server) notify(ctx context.Context, e ImageEvent) {
+	s.stats.invalidate()
+	s.lists.invalidate()
+	s.broadcast(ctx, e)
+	if len(s.publishers) == 0 {
+		return
+	}
+
+	e.Timestamp = time.Now().UTC()
+	ce := NewCloudEvent(e)
+
+	for _, p := range s.publishers {
+		s.publishing.Add(1)
+		go func(p namedPublisher) {
+			defer s.publishing.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+			defer cancel()
+
+			if err := p.Publish(ctx, ce); err != nil {
+				weblog(fmt.Sprintf("error publishing %s event for %s to %s: %s", e.Action, e.ID, p.name, err))
+				s.metrics.publishFailed(p.name)
+			}
+		}(p)
+	}
+}
+
+// WaitForEvents blocks until every event handed to a publisher has been
+// dealt with.
+func (s *Server) WaitForEvents() {
+	s.publishing.Wait()
+}
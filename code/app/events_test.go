@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// recordingPublisher keeps the events published to it, or fails them all
+// with err.
+type recordingPublisher struct {
+	mu     sync.Mutex
+	events []CloudEvent
+	err    error
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, e CloudEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	p.events = append(p.events, e)
+	return nil
+}
+
+func TestEvents(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	pub := &recordingPublisher{}
+	server.AddPublisher("test", pub)
+
+	requests := []*http.Request{
+		newUploadRequest(t, http.MethodPost, "/api/v1/image", "a.png", "image/png", testPNG(t)),
+		newUploadRequest(t, http.MethodPost, "/api/v1/image", "a.png", "image/png", testPNG(t)),
+		newUploadRequest(t, http.MethodPut, "/api/v1/image/a", "b.png", "image/png", testPNG(t)),
+		httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil),
+		httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil),
+		httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil),
+	}
+	for _, r := range requests {
+		server.ServeHTTP(httptest.NewRecorder(), r)
+		// Events are published in the background, in no set order.
+		server.WaitForEvents()
+	}
+
+	want := []string{actionCreated, actionUpdated, actionDeleted}
+	if len(pub.events) != len(want) {
+		t.Fatalf("expected: %v events, got: %v", len(want), pub.events)
+	}
+
+	for i, e := range pub.events {
+		if e.Data.Action != want[i] {
+			t.Fatalf("expected: %v, got: %v", want[i], e.Data.Action)
+		}
+		if e.Type != eventTypePrefix+want[i] || e.SpecVersion != "1.0" || e.ID == "" || e.Subject != "a" {
+			t.Fatalf("expected a CloudEvents envelope for a, got: %+v", e)
+		}
+		if e.Data.ID != "a" || e.Data.Timestamp.IsZero() {
+			t.Fatalf("expected an event for a, got: %+v", e.Data)
+		}
+	}
+
+	if created := pub.events[0].Data; created.Size == 0 || created.ContentType != "image/png" {
+		t.Fatalf("expected the size and type of the new image, got: %+v", created)
+	}
+}
+
+func TestEventsFailure(t *testing.T) {
+	m := NewMetrics()
+	server := NewServer(NewMemoryStorage())
+	server.EnableMetrics(m)
+	server.AddPublisher("test", &recordingPublisher{err: errors.New("topic is gone")})
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "a.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	server.WaitForEvents()
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+	if got := testutil.ToFloat64(m.published.WithLabelValues("test")); got != 1 {
+		t.Fatalf("expected: 1 failure, got: %v", got)
+	}
+}
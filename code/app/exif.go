@@ -0,0 +1,267 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	byteorder "encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+// stripExif, set from STRIP_EXIF, drops the EXIF and XMP metadata from JPEG
+// uploads, which can say where a photo was taken and with what, before
+// they are stored. Uploads with ?keepExif=true keep theirs.
+var stripExif = false
+
+// JPEG markers.
+const (
+	markerSOI  = 0xd8
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerSOS  = 0xda
+)
+
+// exifHeader starts an APP1 segment holding EXIF.
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifOrientation is the EXIF tag for which way up an image is.
+const exifOrientation = 0x0112
+
+// maxJPEGHeader bounds how much of a JPEG is read looking for where its
+// metadata ends and the image starts.
+const maxJPEGHeader = 1 << 20
+
+// withoutExif returns file, a JPEG, with its APP1 segments dropped, apart
+// from its orientation, which is kept in an EXIF segment of its own. A file
+// that has none, or that can't be made sense of, is returned as it is.
+func withoutExif(file multipart.File) (multipart.File, error) {
+	header, skip, stripped, err := stripJPEGHeader(file)
+	if err == nil && !stripped {
+		_, err = file.Seek(0, io.SeekStart)
+		return file, err
+	}
+	if err != nil {
+		if _, serr := file.Seek(0, io.SeekStart); serr != nil {
+			return nil, serr
+		}
+		return file, err
+	}
+
+	return &exifStrippedFile{src: file, header: header, skip: skip, r: io.MultiReader(bytes.NewReader(header), file)}, nil
+}
+
+// readSOI checks that r starts with the marker every JPEG starts with.
+func readSOI(r io.Reader) error {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0xff || buf[1] != markerSOI {
+		return errors.New("not a JPEG")
+	}
+
+	return nil
+}
+
+// readJPEGSegment reads the marker and length of the next segment of a
+// JPEG, at offset at, and unless it starts the image data, the rest of it.
+func readJPEGSegment(r io.Reader, at int64) (head, payload []byte, err error) {
+	head = make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	if head[0] != 0xff {
+		return nil, nil, fmt.Errorf("bad JPEG marker at %d", at)
+	}
+	n := int(byteorder.BigEndian.Uint16(head[2:4]))
+	if n < 2 {
+		return nil, nil, fmt.Errorf("bad JPEG segment length at %d", at)
+	}
+	if head[1] == markerSOS {
+		return head, nil, nil
+	}
+
+	payload = make([]byte, n-2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	return head, payload, nil
+}
+
+// stripJPEGHeader reads the segments of the JPEG in r up to the start of
+// the image data, returning them without APP1 and how much of r they took.
+// stripped is false when there was nothing to drop.
+func stripJPEGHeader(r io.Reader) (header []byte, skip int64, stripped bool, err error) {
+	if err := readSOI(r); err != nil {
+		return nil, 0, false, err
+	}
+	out := bytes.NewBuffer([]byte{0xff, markerSOI})
+	skip = 2
+
+	// The orientation goes where the EXIF would, after any JFIF segment.
+	orientation, insertAt := []byte(nil), 2
+	for skip < maxJPEGHeader {
+		head, payload, err := readJPEGSegment(r, skip)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		skip += int64(len(head) + len(payload))
+
+		switch marker := head[1]; {
+		case marker == markerSOS:
+			// The image data follows, and is left as it is.
+			out.Write(head)
+			header = out.Bytes()
+			if orientation != nil {
+				header = append(append(append([]byte{}, header[:insertAt]...), orientation...), header[insertAt:]...)
+			}
+			return header, skip, stripped, nil
+		case marker == markerAPP1:
+			stripped = true
+			if bytes.HasPrefix(payload, exifHeader) && orientation == nil {
+				if o, ok := readOrientation(payload[len(exifHeader):]); ok {
+					orientation = orientationSegment(o)
+				}
+			}
+		default:
+			jfif := marker == markerAPP0 && out.Len() == 2
+			out.Write(head)
+			out.Write(payload)
+			if jfif {
+				insertAt = out.Len()
+			}
+		}
+	}
+
+	return nil, 0, false, errors.New("JPEG header too long")
+}
+
+// readOrientation finds the orientation in the first IFD of a TIFF
+// structure, which is what EXIF is.
+func readOrientation(tiff []byte) (uint16, bool) {
+	if len(tiff) < 8 {
+		return 0, false
+	}
+	var order byteorder.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = byteorder.LittleEndian
+	case "MM":
+		order = byteorder.BigEndian
+	default:
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientation {
+			return order.Uint16(tiff[entry+8:]), true
+		}
+	}
+
+	return 0, false
+}
+
+// orientationSegment is an APP1 segment with an EXIF structure holding
+// nothing but orientation o.
+func orientationSegment(o uint16) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big endian, first IFD at 8
+		0, 1, // one entry
+		0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 0, // orientation, SHORT, one of them
+		0, 0, 0, 0, // no next IFD
+	}
+	byteorder.BigEndian.PutUint16(tiff[10:], exifOrientation)
+	byteorder.BigEndian.PutUint16(tiff[18:], o)
+
+	seg := []byte{0xff, markerAPP1, 0, 0}
+	seg = append(seg, exifHeader...)
+	seg = append(seg, tiff...)
+	byteorder.BigEndian.PutUint16(seg[2:], uint16(len(seg)-2))
+
+	return seg
+}
+
+// exifStrippedFile is a JPEG read with a new header in place of the one it
+// was uploaded with. Like the files it wraps, it is only ever read through
+// or rewound.
+type exifStrippedFile struct {
+	src    multipart.File
+	header []byte
+	// skip is how long the header it replaces is.
+	skip int64
+	r    io.Reader
+}
+
+func (f *exifStrippedFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *exifStrippedFile) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("stripped uploads can only be rewound")
+	}
+
+	if _, err := f.src.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(io.Discard, f.src, f.skip); err != nil {
+		return 0, err
+	}
+	f.r = io.MultiReader(bytes.NewReader(f.header), f.src)
+
+	return 0, nil
+}
+
+func (f *exifStrippedFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("stripped uploads can't be read at an offset")
+}
+
+func (f *exifStrippedFile) Close() error {
+	return f.src.Close()
+}
+
+// stripUploadExif drops the metadata from file if it is a JPEG and
+// stripExif is set, unless keep. A file it can't strip is turned away
+// rather than stored with its metadata. On failure it returns the status to
+// respond with.
+func stripUploadExif(file multipart.File, contentType string, keep bool) (multipart.File, int, error) {
+	if !stripExif || keep || contentType != "image/jpeg" {
+		return file, http.StatusOK, nil
+	}
+
+	stripped, err := withoutExif(file)
+	if stripped == nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+	if err != nil {
+		return nil, http.StatusUnprocessableEntity, fmt.Errorf("could not strip EXIF: %v", err)
+	}
+
+	return stripped, http.StatusOK, nil
+}
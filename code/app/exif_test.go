@@ -0,0 +1,186 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// app1 is an APP1 segment holding payload.
+func app1(payload []byte) []byte {
+	seg := []byte{0xff, markerAPP1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	return append(seg, payload...)
+}
+
+// testExifJPEG is a JPEG with EXIF that has an orientation of 6 and a
+// camera serial number, and XMP with a location.
+func testExifJPEG(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatalf("could not encode JPEG: %s", err)
+	}
+	plain := buf.Bytes()
+
+	tiff := []byte{
+		'I', 'I', 42, 0, 8, 0, 0, 0,
+		2, 0,
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0, // orientation 6
+		0x31, 0xa4, 2, 0, 4, 0, 0, 0, 'S', 'N', '1', 0, // body serial number
+		0, 0, 0, 0,
+	}
+	exif := app1(append([]byte("Exif\x00\x00"), tiff...))
+	xmp := app1([]byte("http://ns.adobe.com/xap/1.0/\x00<exif:GPSLatitude>51,30N</exif:GPSLatitude>"))
+
+	out := append([]byte{}, plain[:2]...)
+	out = append(out, exif...)
+	out = append(out, xmp...)
+	return append(out, plain[2:]...)
+}
+
+func TestStripExif(t *testing.T) {
+	old := stripExif
+	stripExif = true
+	defer func() { stripExif = old }()
+
+	photo := testExifJPEG(t)
+
+	type test struct {
+		target string
+		body   []byte
+		strip  bool
+	}
+
+	tests := map[string]test{
+		"stripped": {target: "/api/v1/image", body: photo, strip: true},
+		"kept":     {target: "/api/v1/image?keepExif=true", body: photo},
+	}
+
+	for name, c := range tests {
+		ms := newTestMemoryStorage(t)
+		server := NewServer(ms)
+
+		r := newUploadRequest(t, http.MethodPost, c.target, "photo.jpg", "image/jpeg", c.body)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s expected: %v, got: %v %s", name, http.StatusCreated, w.Code, w.Body.String())
+		}
+
+		obj, err := ms.Open(context.Background(), "photo")
+		if err != nil {
+			t.Fatalf("%s expected no error, got: %s", name, err)
+		}
+		stored, err := io.ReadAll(obj)
+		obj.Close()
+		if err != nil {
+			t.Fatalf("%s expected no error, got: %s", name, err)
+		}
+
+		if !c.strip {
+			if !bytes.Equal(stored, photo) {
+				t.Fatalf("%s expected the photo to be stored as it was", name)
+			}
+			continue
+		}
+
+		for _, leak := range []string{"SN1", "GPSLatitude"} {
+			if bytes.Contains(stored, []byte(leak)) {
+				t.Fatalf("%s expected %s to be stripped", name, leak)
+			}
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(stored)); err != nil {
+			t.Fatalf("%s expected a JPEG that still decodes, got: %s", name, err)
+		}
+		i := bytes.Index(stored, []byte("Exif\x00\x00"))
+		if i < 0 {
+			t.Fatalf("%s expected the orientation to be kept", name)
+		}
+		if o, ok := readOrientation(stored[i+6:]); !ok || o != 6 {
+			t.Fatalf("%s expected: 6, got: %v %v", name, o, ok)
+		}
+	}
+}
+
+func TestStripExifUnstrippable(t *testing.T) {
+	old := stripExif
+	stripExif = true
+	defer func() { stripExif = old }()
+
+	photo := testExifJPEG(t)
+
+	// The EXIF comes after more than maxJPEGHeader of other segments.
+	padded := append([]byte{}, photo[:2]...)
+	for i := 0; i < maxJPEGHeader/0xffff+1; i++ {
+		padded = append(padded, 0xff, 0xe2, 0xff, 0xff)
+		padded = append(padded, make([]byte, 0xffff-2)...)
+	}
+	padded = append(padded, photo[2:]...)
+
+	for name, body := range map[string][]byte{
+		"truncated": photo[:30],
+		"padded":    padded,
+	} {
+		ms := newTestMemoryStorage(t)
+		server := NewServer(ms)
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "photo.jpg", "image/jpeg", body))
+		if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "could not strip EXIF") {
+			t.Fatalf("%s expected: %v, got: %v %s", name, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+		}
+		if _, err := ms.Open(context.Background(), "photo"); err == nil {
+			t.Fatalf("%s expected nothing to be stored", name)
+		}
+	}
+}
+
+func TestStripExifRewinds(t *testing.T) {
+	photo := testExifJPEG(t)
+
+	file, err := withoutExif(newMemoryFile(photo))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	first, _ := io.ReadAll(file)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	second, _ := io.ReadAll(file)
+
+	if len(first) >= len(photo) || !bytes.Equal(first, second) {
+		t.Fatalf("expected the same stripped JPEG each time it is read, got %d and %d bytes", len(first), len(second))
+	}
+
+	// Files without metadata, or that aren't JPEGs, are left alone.
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil)
+	for _, b := range [][]byte{buf.Bytes(), testPNG(t)} {
+		file, _ := withoutExif(newMemoryFile(b))
+		got, _ := io.ReadAll(file)
+		if !bytes.Equal(got, b) {
+			t.Fatalf("expected the file to be untouched")
+		}
+	}
+}
@@ -0,0 +1,514 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	byteorder "encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// exifReadBytes is how much of an original is read looking for its EXIF,
+// which JPEGs keep at the start and TIFFs usually do.
+var exifReadBytes int64 = 128 << 10
+
+// The metadata the EXIF of an original is cached in, along with the ETag
+// of the contents it was read from.
+const (
+	exifKey     = "exif"
+	exifETagKey = "exifETag"
+)
+
+// maxCachedExif keeps cached EXIF well inside the 8 KiB Cloud Storage
+// allows for all of an object's metadata.
+const maxCachedExif = 4 << 10
+
+// ImageExif is what the EXIF of an image says about it. Fields the image
+// doesn't have are left out, so one without EXIF is an empty object.
+type ImageExif struct {
+	Make               string        `json:"make,omitempty"`
+	Model              string        `json:"model,omitempty"`
+	LensMake           string        `json:"lensMake,omitempty"`
+	LensModel          string        `json:"lensModel,omitempty"`
+	Software           string        `json:"software,omitempty"`
+	Artist             string        `json:"artist,omitempty"`
+	Copyright          string        `json:"copyright,omitempty"`
+	Orientation        int           `json:"orientation,omitempty"`
+	DateTime           string        `json:"dateTime,omitempty"`
+	DateTimeOriginal   string        `json:"dateTimeOriginal,omitempty"`
+	OffsetTimeOriginal string        `json:"offsetTimeOriginal,omitempty"`
+	ExposureTime       string        `json:"exposureTime,omitempty"`
+	FNumber            float64       `json:"fNumber,omitempty"`
+	ISO                int           `json:"iso,omitempty"`
+	FocalLength        float64       `json:"focalLength,omitempty"`
+	Flash              int           `json:"flash,omitempty"`
+	PixelXDimension    int           `json:"pixelXDimension,omitempty"`
+	PixelYDimension    int           `json:"pixelYDimension,omitempty"`
+	TakenAt            *time.Time    `json:"takenAt,omitempty"`
+	Location           *ExifLocation `json:"location,omitempty"`
+}
+
+// ExifLocation is where a photo was taken, in decimal degrees and meters
+// above sea level.
+type ExifLocation struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// JSON marshalls the content of ImageExif to json.
+func (e ImageExif) JSON() (string, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of ImageExif to json.
+func (e ImageExif) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// errNoExif is returned by parseExif for files that can't have EXIF, or
+// just don't.
+var errNoExif = errors.New("no EXIF")
+
+// parseExif reads the EXIF of the JPEG or TIFF starting with head. When
+// truncated, head is only the start of the file, and running out of it is
+// taken to mean the EXIF wasn't there rather than that the file is broken.
+func parseExif(head []byte, contentType string, truncated bool) (ImageExif, error) {
+	var tiff []byte
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, markerSOI}):
+		var err error
+		tiff, err = jpegExif(bytes.NewReader(head))
+		if truncated && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			return ImageExif{}, errNoExif
+		}
+		if err != nil {
+			return ImageExif{}, err
+		}
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		tiff = head
+	case contentType == "image/jpeg" || contentType == "image/tiff":
+		return ImageExif{}, fmt.Errorf("not a %s", strings.TrimPrefix(contentType, "image/"))
+	}
+	if tiff == nil {
+		return ImageExif{}, errNoExif
+	}
+
+	return readExif(tiff)
+}
+
+// jpegExif returns the TIFF structure in the EXIF segment of the JPEG in r,
+// or nil if it has none.
+func jpegExif(r io.Reader) ([]byte, error) {
+	if err := readSOI(r); err != nil {
+		return nil, err
+	}
+
+	for read := int64(2); read < maxJPEGHeader; {
+		head, payload, err := readJPEGSegment(r, read)
+		if err != nil {
+			return nil, err
+		}
+		if head[1] == markerSOS {
+			return nil, nil
+		}
+		if head[1] == markerAPP1 && bytes.HasPrefix(payload, exifHeader) {
+			return payload[len(exifHeader):], nil
+		}
+		read += int64(len(head) + len(payload))
+	}
+
+	return nil, errors.New("JPEG header too long")
+}
+
+// EXIF tags, by the IFD they are found in.
+const (
+	tagMake               = 0x010f
+	tagModel              = 0x0110
+	tagSoftware           = 0x0131
+	tagDateTime           = 0x0132
+	tagArtist             = 0x013b
+	tagCopyright          = 0x8298
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagExposureTime       = 0x829a
+	tagFNumber            = 0x829d
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFlash              = 0x9209
+	tagFocalLength        = 0x920a
+	tagPixelX             = 0xa002
+	tagPixelY             = 0xa003
+	tagLensMake           = 0xa433
+	tagLensModel          = 0xa434
+
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+// tiffTypeSizes is how many bytes each value of a TIFF field type takes.
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// tiffField is one entry of an IFD, with its values still encoded.
+type tiffField struct {
+	Type  uint16
+	Count int
+	Value []byte
+}
+
+// tiffFile is a TIFF structure, which is what EXIF is.
+type tiffFile struct {
+	data  []byte
+	order byteorder.ByteOrder
+}
+
+// ifd reads the fields of the IFD at offset. Fields whose values lie
+// outside the data, which may only be the start of a file, are left out.
+func (t tiffFile) ifd(offset int) (map[uint16]tiffField, error) {
+	if offset < 8 || offset+2 > len(t.data) {
+		return nil, fmt.Errorf("IFD offset %d out of range", offset)
+	}
+
+	fields := map[uint16]tiffField{}
+	count := int(t.order.Uint16(t.data[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + 12*i
+		if entry+12 > len(t.data) {
+			break
+		}
+		typ := t.order.Uint16(t.data[entry+2:])
+		size, ok := tiffTypeSizes[typ]
+		if !ok {
+			continue
+		}
+		n := int(t.order.Uint32(t.data[entry+4:]))
+		if n <= 0 || n > len(t.data)/size {
+			continue
+		}
+
+		at := entry + 8
+		if n*size > 4 {
+			at = int(t.order.Uint32(t.data[entry+8:]))
+		}
+		if at < 0 || at+n*size > len(t.data) {
+			continue
+		}
+		fields[t.order.Uint16(t.data[entry:])] = tiffField{Type: typ, Count: n, Value: t.data[at : at+n*size]}
+	}
+
+	return fields, nil
+}
+
+// str is an ASCII field as a string.
+func (t tiffFile) str(f tiffField) string {
+	if f.Type != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(f.Value), "\x00"))
+}
+
+// integer is the first value of an integer field.
+func (t tiffFile) integer(f tiffField) int {
+	switch f.Type {
+	case 1, 7:
+		return int(f.Value[0])
+	case 3:
+		return int(t.order.Uint16(f.Value))
+	case 4:
+		return int(t.order.Uint32(f.Value))
+	}
+	return 0
+}
+
+// rational is the ith value of a RATIONAL field as its numerator and
+// denominator.
+func (t tiffFile) rational(f tiffField, i int) (uint32, uint32, bool) {
+	if f.Type != 5 || i >= f.Count {
+		return 0, 0, false
+	}
+	return t.order.Uint32(f.Value[8*i:]), t.order.Uint32(f.Value[8*i+4:]), true
+}
+
+// ratio is the ith value of a RATIONAL field.
+func (t tiffFile) ratio(f tiffField, i int) (float64, bool) {
+	num, den, ok := t.rational(f, i)
+	if !ok || den == 0 {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+// readExif picks what ImageExif reports out of a TIFF structure.
+func readExif(data []byte) (ImageExif, error) {
+	e := ImageExif{}
+	if len(data) < 8 {
+		return e, errors.New("EXIF too short")
+	}
+
+	t := tiffFile{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = byteorder.LittleEndian
+	case "MM":
+		t.order = byteorder.BigEndian
+	default:
+		return e, errors.New("EXIF has no byte order")
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return e, errors.New("EXIF is not a TIFF structure")
+	}
+
+	ifd0, err := t.ifd(int(t.order.Uint32(data[4:])))
+	if err != nil {
+		return e, err
+	}
+	e.Make = t.str(ifd0[tagMake])
+	e.Model = t.str(ifd0[tagModel])
+	e.Software = t.str(ifd0[tagSoftware])
+	e.Artist = t.str(ifd0[tagArtist])
+	e.Copyright = t.str(ifd0[tagCopyright])
+	e.DateTime = t.str(ifd0[tagDateTime])
+	if f, ok := ifd0[exifOrientation]; ok {
+		e.Orientation = t.integer(f)
+	}
+
+	// The sub-IFDs are optional, and one that can't be read is skipped.
+	if f, ok := ifd0[tagExifIFD]; ok {
+		if sub, err := t.ifd(t.integer(f)); err == nil {
+			t.readExifIFD(sub, &e)
+		}
+	}
+	if f, ok := ifd0[tagGPSIFD]; ok {
+		if gps, err := t.ifd(t.integer(f)); err == nil {
+			e.Location = t.readLocation(gps)
+		}
+	}
+
+	e.TakenAt = takenAt(e)
+
+	return e, nil
+}
+
+// readExifIFD reads the camera settings from the Exif IFD.
+func (t tiffFile) readExifIFD(sub map[uint16]tiffField, e *ImageExif) {
+	e.LensMake = t.str(sub[tagLensMake])
+	e.LensModel = t.str(sub[tagLensModel])
+	e.DateTimeOriginal = t.str(sub[tagDateTimeOriginal])
+	e.OffsetTimeOriginal = t.str(sub[tagOffsetTimeOriginal])
+	if f, ok := sub[tagISO]; ok {
+		e.ISO = t.integer(f)
+	}
+	if f, ok := sub[tagFlash]; ok {
+		e.Flash = t.integer(f)
+	}
+	if f, ok := sub[tagPixelX]; ok {
+		e.PixelXDimension = t.integer(f)
+	}
+	if f, ok := sub[tagPixelY]; ok {
+		e.PixelYDimension = t.integer(f)
+	}
+	if v, ok := t.ratio(sub[tagFNumber], 0); ok {
+		e.FNumber = v
+	}
+	if v, ok := t.ratio(sub[tagFocalLength], 0); ok {
+		e.FocalLength = v
+	}
+	if num, den, ok := t.rational(sub[tagExposureTime], 0); ok && den != 0 {
+		// Exposures are given the way cameras show them, like 1/250.
+		if num < den {
+			e.ExposureTime = fmt.Sprintf("%d/%d", num, den)
+		} else {
+			e.ExposureTime = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+		}
+	}
+}
+
+// readLocation reads where a photo was taken from the GPS IFD, or nil if
+// it doesn't say.
+func (t tiffFile) readLocation(gps map[uint16]tiffField) *ExifLocation {
+	lat, ok := t.degrees(gps[tagGPSLatitude])
+	if !ok {
+		return nil
+	}
+	lon, ok := t.degrees(gps[tagGPSLongitude])
+	if !ok {
+		return nil
+	}
+	if t.str(gps[tagGPSLatitudeRef]) == "S" {
+		lat = -lat
+	}
+	if t.str(gps[tagGPSLongitudeRef]) == "W" {
+		lon = -lon
+	}
+
+	loc := &ExifLocation{Latitude: lat, Longitude: lon}
+	if alt, ok := t.ratio(gps[tagGPSAltitude], 0); ok {
+		if f, ok := gps[tagGPSAltitudeRef]; ok && t.integer(f) == 1 {
+			alt = -alt
+		}
+		loc.Altitude = &alt
+	}
+
+	return loc
+}
+
+// degrees reads a GPS coordinate given as degrees, minutes and seconds.
+func (t tiffFile) degrees(f tiffField) (float64, bool) {
+	total := 0.0
+	for i, unit := range []float64{1, 60, 3600} {
+		v, ok := t.ratio(f, i)
+		if !ok {
+			return 0, false
+		}
+		total += v / unit
+	}
+	if math.IsNaN(total) || total > 180 {
+		return 0, false
+	}
+
+	return total, true
+}
+
+// takenAt is when the photo was taken, from the time it was taken or
+// failing that last changed. EXIF times are local to the camera, so
+// without an offset they are taken to be UTC.
+func takenAt(e ImageExif) *time.Time {
+	v, offset := e.DateTimeOriginal, e.OffsetTimeOriginal
+	if v == "" {
+		v, offset = e.DateTime, ""
+	}
+	if v == "" {
+		return nil
+	}
+
+	layout := "2006:01:02 15:04:05"
+	if offset != "" {
+		layout, v = layout+"-07:00", v+offset
+	}
+	t, err := time.Parse(layout, v)
+	if err != nil {
+		return nil
+	}
+	t = t.UTC()
+
+	return &t
+}
+
+// cachedExif returns the EXIF cached in the metadata of an original, if it
+// was read from the contents it has now.
+func cachedExif(f CSFile) (ImageExif, bool) {
+	e := ImageExif{}
+	v, ok := f.Metadata[exifKey]
+	if !ok || f.ETag == "" || f.Metadata[exifETagKey] != f.ETag {
+		return e, false
+	}
+	if err := json.Unmarshal([]byte(v), &e); err != nil {
+		return e, false
+	}
+
+	return e, true
+}
+
+// exifHandler answers with the EXIF of an image's original. It is read
+// from the start of the file the first time it is asked for, and kept in
+// the original's metadata after that.
+func (s *Server) exifHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ctx := r.Context()
+
+	fs, err := s.storage.Read(ctx, id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to read image %s: %v", id, err))
+		return
+	}
+
+	original, ok := originalFile(fs)
+	if !ok {
+		writeNotFound(w, id)
+		return
+	}
+	if e, ok := cachedExif(original); ok {
+		writeJSON(w, e, http.StatusOK)
+		return
+	}
+
+	obj, err := s.storage.OpenObject(ctx, original.Name)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to open image %s: %v", id, err))
+		return
+	}
+	head, err := io.ReadAll(io.LimitReader(obj, exifReadBytes))
+	obj.Close()
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to read image %s: %v", id, err))
+		return
+	}
+
+	e, err := parseExif(head, obj.ContentType, int64(len(head)) < obj.Size)
+	if err != nil && err != errNoExif {
+		writeErrorMsg(w, http.StatusUnprocessableEntity, fmt.Errorf("could not read EXIF of %s: %v", id, err))
+		return
+	}
+
+	s.cacheExif(r, original.Name, obj.ETag, e)
+	writeJSON(w, e, http.StatusOK)
+}
+
+// cacheExif keeps e in the metadata of the original called name. Failing
+// to only costs reading the original again next time, so it is logged.
+func (s *Server) cacheExif(r *http.Request, name, etag string, e ImageExif) {
+	b, err := e.JSONBytes()
+	if err != nil || etag == "" || len(b) > maxCachedExif {
+		return
+	}
+
+	metadata := map[string]string{exifKey: string(b), exifETagKey: etag}
+	if err := s.storage.UpdateMetadata(r.Context(), name, metadata); err != nil {
+		weblog(fmt.Sprintf("could not cache EXIF of %s: %s", name, err))
+	}
+}
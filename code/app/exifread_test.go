@@ -0,0 +1,240 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	byteorder "encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testField is an IFD entry for testTIFF. An entry with a link points at
+// the IFD with that index instead of holding value.
+type testField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+	link  int
+}
+
+func ascii(s string) testField {
+	return testField{typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func short(v uint16) testField {
+	return testField{typ: 3, count: 1, value: []byte{byte(v), byte(v >> 8)}}
+}
+
+func rationals(vs ...uint32) testField {
+	f := testField{typ: 5, count: uint32(len(vs) / 2)}
+	for _, v := range vs {
+		f.value = byteorder.LittleEndian.AppendUint32(f.value, v)
+	}
+	return f
+}
+
+func withTag(tag uint16, f testField) testField {
+	f.tag = tag
+	return f
+}
+
+// testTIFF lays out ifds one after the other in a little endian TIFF
+// structure, each followed by the values too long for its entries.
+func testTIFF(ifds ...[]testField) []byte {
+	offsets := make([]int, len(ifds))
+	at := 8
+	for i, fields := range ifds {
+		offsets[i] = at
+		at += 2 + 12*len(fields) + 4
+		for _, f := range fields {
+			if len(f.value) > 4 {
+				at += len(f.value)
+			}
+		}
+	}
+
+	out := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	for _, fields := range ifds {
+		extra := len(out) + 2 + 12*len(fields) + 4
+		var data []byte
+		out = byteorder.LittleEndian.AppendUint16(out, uint16(len(fields)))
+		for _, f := range fields {
+			out = byteorder.LittleEndian.AppendUint16(out, f.tag)
+			if f.link > 0 {
+				out = byteorder.LittleEndian.AppendUint16(out, 4)
+				out = byteorder.LittleEndian.AppendUint32(out, 1)
+				out = byteorder.LittleEndian.AppendUint32(out, uint32(offsets[f.link]))
+				continue
+			}
+			out = byteorder.LittleEndian.AppendUint16(out, f.typ)
+			out = byteorder.LittleEndian.AppendUint32(out, f.count)
+			if len(f.value) > 4 {
+				out = byteorder.LittleEndian.AppendUint32(out, uint32(extra+len(data)))
+				data = append(data, f.value...)
+				continue
+			}
+			out = append(out, append(f.value, make([]byte, 4-len(f.value))...)...)
+		}
+		out = append(out, 0, 0, 0, 0)
+		out = append(out, data...)
+	}
+
+	return out
+}
+
+// testCameraJPEG is a JPEG with the EXIF a camera with GPS would give it.
+func testCameraJPEG(t *testing.T) []byte {
+	t.Helper()
+
+	tiff := testTIFF(
+		[]testField{
+			withTag(tagMake, ascii("Canon")),
+			withTag(tagModel, ascii("EOS R5")),
+			withTag(exifOrientation, short(6)),
+			{tag: tagExifIFD, link: 1},
+			{tag: tagGPSIFD, link: 2},
+		},
+		[]testField{
+			withTag(tagExposureTime, rationals(1, 250)),
+			withTag(tagFNumber, rationals(28, 10)),
+			withTag(tagISO, short(400)),
+			withTag(tagDateTimeOriginal, ascii("2021:06:01 14:30:00")),
+			withTag(tagOffsetTimeOriginal, ascii("+02:00")),
+		},
+		[]testField{
+			withTag(tagGPSLatitudeRef, ascii("N")),
+			withTag(tagGPSLatitude, rationals(51, 1, 30, 1, 0, 1)),
+			withTag(tagGPSLongitudeRef, ascii("W")),
+			withTag(tagGPSLongitude, rationals(0, 1, 7, 1, 30, 1)),
+		},
+	)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatalf("could not encode JPEG: %s", err)
+	}
+	plain := buf.Bytes()
+
+	out := append([]byte{}, plain[:2]...)
+	out = append(out, app1(append([]byte("Exif\x00\x00"), tiff...))...)
+	return append(out, plain[2:]...)
+}
+
+func TestParseExif(t *testing.T) {
+	e, err := parseExif(testCameraJPEG(t), "image/jpeg", false)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if e.Make != "Canon" || e.Model != "EOS R5" || e.Orientation != 6 {
+		t.Fatalf("expected the camera, got: %+v", e)
+	}
+	if e.ExposureTime != "1/250" || e.FNumber != 2.8 || e.ISO != 400 {
+		t.Fatalf("expected the camera settings, got: %+v", e)
+	}
+	want := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+	if e.TakenAt == nil || !e.TakenAt.Equal(want) {
+		t.Fatalf("expected: %v, got: %v", want, e.TakenAt)
+	}
+	if e.Location == nil || e.Location.Latitude != 51.5 || e.Location.Longitude != -0.125 {
+		t.Fatalf("expected: 51.5,-0.125, got: %+v", e.Location)
+	}
+
+	// A TIFF is its own EXIF.
+	e, err = parseExif(testTIFF([]testField{withTag(tagMake, ascii("Nikon"))}), "image/tiff", false)
+	if err != nil || e.Make != "Nikon" {
+		t.Fatalf("expected: Nikon, got: %+v %v", e, err)
+	}
+}
+
+// countingOpens is a Storage that counts the objects read through it.
+type countingOpens struct {
+	Storage
+	opens int
+}
+
+func (s *countingOpens) OpenObject(ctx context.Context, name string) (*CSReader, error) {
+	s.opens++
+	return s.Storage.OpenObject(ctx, name)
+}
+
+func TestExifHandler(t *testing.T) {
+	ms := newTestMemoryStorage(t, "plain.png")
+	for name, b := range map[string][]byte{
+		"camera.jpg": testCameraJPEG(t),
+		"broken.jpg": {0xff, markerSOI, 0xff, markerAPP1, 0, 1, 0},
+	} {
+		if _, err := ms.Create(context.Background(), name, newMemoryFile(b), CreateOptions{}); err != nil {
+			t.Fatalf("could not create %s: %s", name, err)
+		}
+	}
+	storage := &countingOpens{Storage: ms}
+	server := NewServer(storage)
+
+	get := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/"+id+"/exif", nil))
+		return w
+	}
+
+	type test struct {
+		id     string
+		status int
+		body   string
+	}
+
+	tests := []test{
+		{id: "plain", status: http.StatusOK, body: "{}"},
+		{id: "broken", status: http.StatusUnprocessableEntity},
+		{id: "missing", status: http.StatusNotFound},
+	}
+
+	for _, c := range tests {
+		w := get(c.id)
+		if w.Code != c.status {
+			t.Fatalf("%s expected: %v, got: %v %s", c.id, c.status, w.Code, w.Body.String())
+		}
+		if c.body != "" && w.Body.String() != c.body {
+			t.Fatalf("%s expected: %v, got: %v", c.id, c.body, w.Body.String())
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		w := get("camera")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		e := ImageExif{}
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if e.Model != "EOS R5" || e.Location == nil || e.TakenAt == nil {
+			t.Fatalf("expected the camera's EXIF, got: %s", w.Body.String())
+		}
+	}
+
+	// plain, broken and the first read of camera.
+	if storage.opens != 3 {
+		t.Fatalf("expected the EXIF to be cached, got: %v reads", storage.opens)
+	}
+}
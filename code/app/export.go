@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// maxExportBytes caps how much image data one export can hold, set from
+// MAX_EXPORT_BYTES.
+var maxExportBytes int64 = 1 << 30
+
+// manifestName is the entry of an export that describes the images in it.
+const manifestName = "manifest.json"
+
+// ExportedImage is an image in the manifest of an export, with the entry
+// its contents are in.
+type ExportedImage struct {
+	File string `json:"file"`
+	Image
+}
+
+// ExportManifest lists the images in an export.
+type ExportManifest struct {
+	Exported time.Time       `json:"exported"`
+	Images   []ExportedImage `json:"images"`
+}
+
+// exportHandler streams a zip of the originals of the images named by ids,
+// or of every image under prefix, along with a manifest of them. Entries
+// are read from storage and written one at a time, so only a buffer of each
+// is held. The size of the images is checked against maxExportBytes before
+// anything is written; once the archive has started a failure can only
+// cut it short, which leaves it without the directory a zip ends with.
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	is, err := s.exportImages(r.Context(), r.URL.Query().Get("prefix"), parseList(r.URL.Query().Get("ids")))
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to list files: %w", err))
+		return
+	}
+	if len(is) == 0 {
+		writeErrorMsg(w, http.StatusNotFound, errors.New("no images to export"))
+		return
+	}
+
+	var total int64
+	manifest := ExportManifest{Exported: time.Now().UTC(), Images: []ExportedImage{}}
+	for _, i := range is {
+		total += i.SizeBytes
+		manifest.Images = append(manifest.Images, ExportedImage{File: exportName(i), Image: i})
+	}
+	if total > maxExportBytes {
+		writeError(w, tooLarge(fmt.Errorf("export of %d bytes too large, limit is %d bytes", total, maxExportBytes)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.zip"`)
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	if err := writeManifest(zw, manifest); err != nil {
+		weblog(fmt.Sprintf("error exporting images: %s", err))
+		return
+	}
+	for _, e := range manifest.Images {
+		if err := s.exportImage(r.Context(), zw, e); err != nil {
+			weblog(fmt.Sprintf("error exporting %s: %s", e.ID, err))
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		weblog(fmt.Sprintf("error exporting images: %s", err))
+	}
+}
+
+// exportImages finds the images named by ids, skipping any there are none
+// of, or with no ids every image under prefix.
+func (s *Server) exportImages(ctx context.Context, prefix string, ids []string) (Images, error) {
+	if len(ids) == 0 {
+		return s.allImages(ctx, prefix)
+	}
+
+	is := Images{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		fs, err := s.storage.Read(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := originalFile(fs); ok {
+			is = append(is, NewImage(f))
+		}
+	}
+
+	return is, nil
+}
+
+// exportName is the entry the original of i is kept in, which goes by its
+// id so that no two clash.
+func exportName(i Image) string {
+	return i.ID + filepath.Ext(i.OriginalName)
+}
+
+func writeManifest(zw *zip.Writer, m ExportManifest) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: manifestName, Method: zip.Deflate, Modified: m.Exported})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// exportImage copies the original of e into zw. Images are compressed
+// already, so they are stored as they are.
+func (s *Server) exportImage(ctx context.Context, zw *zip.Writer, e ExportedImage) error {
+	obj, err := s.storage.Open(ctx, e.ID)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: e.File, Method: zip.Store, Modified: e.Updated})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, obj)
+	return err
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// readZip returns the contents of each entry in the zip in b.
+func readZip(t *testing.T, b []byte) map[string][]byte {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("expected a zip, got: %s", err)
+	}
+
+	entries := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("could not open %s: %s", f.Name, err)
+		}
+		entries[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+
+	return entries
+}
+
+func TestExport(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png", "b.gif", "trip/c.png"))
+	png := testPNG(t)
+
+	type test struct {
+		query string
+		want  []string
+	}
+
+	tests := []test{
+		{"", []string{"a.png", "b.gif", "trip/c.png"}},
+		{"?prefix=trip/", []string{"trip/c.png"}},
+		{"?ids=a,missing,a,trip/c", []string{"a.png", "trip/c.png"}},
+	}
+
+	for _, c := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/export.zip"+c.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s expected: %v, got: %v %s", c.query, http.StatusOK, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/zip" {
+			t.Fatalf("%s expected: application/zip, got: %s", c.query, got)
+		}
+
+		entries := readZip(t, w.Body.Bytes())
+		manifest := ExportManifest{}
+		if err := json.Unmarshal(entries[manifestName], &manifest); err != nil {
+			t.Fatalf("%s expected a manifest, got: %s", c.query, err)
+		}
+
+		files := []string{}
+		for _, i := range manifest.Images {
+			files = append(files, i.File)
+			if !bytes.Equal(entries[i.File], png) {
+				t.Fatalf("%s expected %s to hold the original", c.query, i.File)
+			}
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, c.want) {
+			t.Fatalf("%s expected: %v, got: %v", c.query, c.want, files)
+		}
+		if len(entries) != len(c.want)+1 {
+			t.Fatalf("%s expected %d entries, got: %d", c.query, len(c.want)+1, len(entries))
+		}
+	}
+}
+
+func TestExportLimits(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png", "b.png"))
+
+	for _, query := range []string{"?prefix=none", "?ids=missing"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/export.zip"+query, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s expected: %v, got: %v", query, http.StatusNotFound, w.Code)
+		}
+	}
+
+	old := maxExportBytes
+	maxExportBytes = int64(len(testPNG(t))) + 1
+	defer func() { maxExportBytes = old }()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/export.zip", nil))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/export.zip?ids=a", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
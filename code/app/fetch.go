@@ -0,0 +1,237 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// fetchTimeout caps how long fetching an image by URL can take, from
+// connecting to the last byte.
+var fetchTimeout = 30 * time.Second
+
+// maxFetchRedirects is how many redirects a fetch follows.
+const maxFetchRedirects = 5
+
+// errBlockedAddress means a fetch was headed somewhere other than the
+// public internet, such as the metadata server or a private network.
+var errBlockedAddress = errors.New("address is not public")
+
+// fetchClient fetches images by URL. It only connects to addresses that
+// publicIP allows, checked as each connection is made so that neither DNS
+// nor a redirect can sneak past.
+var fetchClient = newFetchClient(publicIP)
+
+// reservedNets are ranges that aren't on the public internet but that net.IP
+// has no method for.
+var reservedNets = parseCIDRs(
+	"0.0.0.0/8",      // this network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved
+	"64:ff9b:1::/48", // local-use NAT64
+)
+
+// FetchRequest asks for the image at URL to be stored. Name is what to call
+// it, by default the last part of the URL's path.
+type FetchRequest struct {
+	URL  string `json:"url"`
+	Name string `json:"name,omitempty"`
+}
+
+func newFetchClient(allowed func(net.IP) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowed(ip) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		// No proxy, which would connect on our behalf without the check.
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+}
+
+// publicIP reports whether ip is on the public internet.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+
+	return nets
+}
+
+// checkFetchURL checks that u is something a fetch may ask for.
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return invalidArgument(fmt.Errorf("invalid url %q: want http or https", u.Redacted()))
+	}
+	if u.Hostname() == "" {
+		return invalidArgument(fmt.Errorf("invalid url %q: no host", u.Redacted()))
+	}
+
+	return nil
+}
+
+// fetchImage downloads u, up to maxUploadBytes of it, into a staging
+// object, which the caller must drop, returning it and the type the server
+// said it was.
+func (s *Server) fetchImage(ctx context.Context, u *url.URL) (*stagedFile, string, error) {
+	ctx, span := startSpan(ctx, "fetchImage")
+	defer span.End()
+
+	// The staged file outlives the fetch, so only the fetch is timed out.
+	fetchCtx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", invalidArgument(fmt.Errorf("invalid url %q: %v", u.Redacted(), err))
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		var ae *apiError
+		switch {
+		case errors.Is(err, errBlockedAddress):
+			return nil, "", invalidArgument(fmt.Errorf("could not fetch %s: %v", u.Redacted(), errBlockedAddress))
+		case errors.As(err, &ae):
+			return nil, "", ae
+		default:
+			return nil, "", badGateway(fmt.Errorf("could not fetch %s: %v", u.Redacted(), err))
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", badGateway(fmt.Errorf("could not fetch %s: got %s", u.Redacted(), resp.Status))
+	}
+	if resp.ContentLength > maxUploadBytes {
+		return nil, "", tooLarge(fmt.Errorf("image too large, limit is %d bytes", maxUploadBytes))
+	}
+
+	// A missing or broken type is left to the usual check to turn down.
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	file, err := s.stageFile(ctx, resp.Body, contentType, maxUploadBytes)
+	if err != nil {
+		var ae *apiError
+		if !errors.As(err, &ae) {
+			err = badGateway(fmt.Errorf("could not fetch %s: %v", u.Redacted(), err))
+		}
+		return nil, "", err
+	}
+
+	return file, contentType, nil
+}
+
+// fetchHandler stores the image at a URL as if it had been uploaded, taking
+// the same ?overwrite= and ?force= as a create.
+func (s *Server) fetchHandler(w http.ResponseWriter, r *http.Request) {
+	req := FetchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, invalidArgument(fmt.Errorf("invalid request body: %s", err)))
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		writeError(w, invalidArgument(fmt.Errorf("invalid url: %s", err)))
+		return
+	}
+	if err := checkFetchURL(u); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = path.Base(u.Path)
+	}
+	if filepath.Ext(name) == "" {
+		writeError(w, invalidArgument(fmt.Errorf("can't tell what to call %s, give a name with an extension", u.Redacted())))
+		return
+	}
+
+	file, contentType, err := s.fetchImage(r.Context(), u)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer file.drop()
+
+	opts := uploadOptions{
+		Overwrite: r.URL.Query().Get("overwrite") == "true",
+		Force:     r.URL.Query().Get("force") == "true",
+		KeepExif:  r.URL.Query().Get("keepExif") == "true",
+	}
+	img, status, err := s.storeFile(r.Context(), name, contentType, file, opts)
+	if err != nil {
+		writeUploadError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(img.Name)))
+	writeJSON(w, img, status)
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"8.8.8.8":         true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+	}
+
+	for addr, want := range tests {
+		if got := publicIP(net.ParseIP(addr)); got != want {
+			t.Fatalf("%s expected: %v, got: %v", addr, want, got)
+		}
+	}
+}
+
+// newImageHost serves testPNG at /cat.png, and at /stream.png without
+// saying how long it is, text at /notes.txt and a redirect to somewhere it
+// may not go at /elsewhere.png.
+func newImageHost(t *testing.T) *httptest.Server {
+	png := testPNG(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cat.png", "/cat":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+		case "/stream.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.(http.Flusher).Flush()
+			w.Write(png)
+		case "/notes.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "not an image")
+		case "/elsewhere.png":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestFetchHandler(t *testing.T) {
+	host := newImageHost(t)
+
+	old := fetchClient
+	fetchClient = newFetchClient(func(net.IP) bool { return true })
+	defer func() { fetchClient = old }()
+
+	type test struct {
+		body   string
+		status int
+		name   string
+	}
+
+	tests := []test{
+		{body: fmt.Sprintf(`{"url": %q}`, host.URL+"/cat.png"), status: http.StatusCreated, name: "cat"},
+		{body: fmt.Sprintf(`{"url": %q, "name": "seed.png"}`, host.URL+"/cat"), status: http.StatusOK, name: "cat"},
+		{body: fmt.Sprintf(`{"url": %q, "name": "stream.png"}`, host.URL+"/stream.png"), status: http.StatusOK, name: "cat"},
+		{body: fmt.Sprintf(`{"url": %q}`, host.URL+"/cat"), status: http.StatusBadRequest},
+		{body: fmt.Sprintf(`{"url": %q}`, host.URL+"/notes.txt"), status: http.StatusUnsupportedMediaType},
+		{body: fmt.Sprintf(`{"url": %q}`, host.URL+"/missing.png"), status: http.StatusBadGateway},
+		{body: fmt.Sprintf(`{"url": %q}`, host.URL+"/elsewhere.png"), status: http.StatusBadRequest},
+		{body: `{"url": "file:///etc/passwd"}`, status: http.StatusBadRequest},
+		{body: `{"url": "gopher://example.com/a.png"}`, status: http.StatusBadRequest},
+		{body: `{"url": ":"}`, status: http.StatusBadRequest},
+		{body: `not json`, status: http.StatusBadRequest},
+	}
+
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+	for _, c := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/image:fetch", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Fatalf("%s expected: %v, got: %v %s", c.body, c.status, w.Code, w.Body.String())
+		}
+		if c.name == "" {
+			continue
+		}
+		img := Image{}
+		if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+			t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+		}
+		if img.Name != c.name {
+			t.Fatalf("%s expected: %v, got: %v", c.body, c.name, img.Name)
+		}
+	}
+	if staged, _ := ms.ListObjects(context.Background(), stagingPrefix); len(staged) != 0 {
+		t.Fatalf("expected nothing to be left staged, got: %v", staged)
+	}
+}
+
+func TestFetchHandlerLimits(t *testing.T) {
+	host := newImageHost(t)
+	server := NewServer(newTestMemoryStorage(t))
+	body := fmt.Sprintf(`{"url": %q}`, host.URL+"/cat.png")
+
+	// The test server is on loopback, which is as private as it gets.
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/image:fetch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), errBlockedAddress.Error()) {
+		t.Fatalf("expected the fetch to be blocked, got: %v %s", w.Code, w.Body.String())
+	}
+
+	old := fetchClient
+	fetchClient = newFetchClient(func(net.IP) bool { return true })
+	defer func() { fetchClient = old }()
+	oldMax := maxUploadBytes
+	maxUploadBytes = 100
+	defer func() { maxUploadBytes = oldMax }()
+
+	// Whether or not the response says how long it is.
+	for _, u := range []string{host.URL + "/cat.png", host.URL + "/stream.png"} {
+		r = httptest.NewRequest(http.MethodPost, "/api/v1/image:fetch", strings.NewReader(fmt.Sprintf(`{"url": %q}`, u)))
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%s: expected: %v, got: %v %s", u, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,865 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metaSuffix marks the sidecar file that holds an object's metadata.
+const metaSuffix = ".meta.json"
+
+// ErrInvalidName is returned when an object name would resolve to a path
+// outside of the storage root.
+var ErrInvalidName = errors.New("invalid object name")
+
+// FileStorage is a Storage that keeps objects as files under a root
+// directory, using the same processed layout as the Cloud Storage bucket.
+// Each object's metadata lives in a sidecar file next to it.
+type FileStorage struct {
+	Root string
+}
+
+type fileMeta struct {
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Created     time.Time         `json:"created"`
+	MD5         []byte            `json:"md5,omitempty"`
+	// CRC32C is missing from the sidecars of objects written before it
+	// was kept.
+	CRC32C *uint32 `json:"crc32c,omitempty"`
+}
+
+// checksums are those meta records.
+func (m fileMeta) checksums() Checksums {
+	if m.CRC32C == nil {
+		return newChecksums(m.MD5, 0, false)
+	}
+
+	return newChecksums(m.MD5, *m.CRC32C, true)
+}
+
+// NewFileStorage returns a FileStorage rooted at root, creating the
+// directory if needed.
+func NewFileStorage(root string) (*FileStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("no storage root given")
+	}
+
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %s", root, err)
+	}
+
+	if err := os.MkdirAll(abs, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create %s: %s", abs, err)
+	}
+
+	return &FileStorage{Root: abs}, nil
+}
+
+// Close is a no-op, there is nothing to release.
+func (s *FileStorage) Close() error {
+	return nil
+}
+
+// Ping checks that the root is still a directory.
+func (s *FileStorage) Ping(ctx context.Context) error {
+	info, err := os.Stat(s.Root)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", s.Root, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.Root)
+	}
+
+	return nil
+}
+
+// List returns a page of processed objects for images whose ids start with
+// prefix, sorted by name the same way Cloud Storage sorts them.
+func (s *FileStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	all, err := s.names("processed")
+	if err != nil {
+		return CSFiles{}, "", err
+	}
+
+	names := []string{}
+	for _, name := range all {
+		if strings.HasPrefix(name, "processed/"+prefix) {
+			names = append(names, name)
+		}
+	}
+
+	names, next, err := pageNames(names, pageSize, pageToken)
+	if err != nil {
+		return CSFiles{}, "", err
+	}
+
+	return s.files(names), next, nil
+}
+
+// Walk calls fn with each processed object of the images whose ids start
+// with prefix, reading each one's metadata only as it gets to it.
+func (s *FileStorage) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	all, err := s.names("processed")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range all {
+		if !strings.HasPrefix(name, "processed/"+prefix) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, f := range s.files([]string{name}) {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read returns all of the objects stored for image id.
+func (s *FileStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	names, err := s.imageNames(id)
+	if err != nil {
+		return CSFiles{}, err
+	}
+
+	return s.files(names), nil
+}
+
+// Open returns a reader over the original image stored for id.
+func (s *FileStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	names, err := s.imageNames(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if strings.Index(name, "original.") < 0 {
+			continue
+		}
+
+		cr, err := s.OpenObject(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		cr.Filename = uploadName(id, name, cr.Metadata)
+		return cr, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// Versions fails: a file overwritten on disk is gone.
+func (s *FileStorage) Versions(ctx context.Context, id string) (CSFiles, error) {
+	return nil, ErrVersioningDisabled
+}
+
+// OpenVersion fails, as there are no old versions to open.
+func (s *FileStorage) OpenVersion(ctx context.Context, id string, generation int64) (*CSReader, error) {
+	return nil, ErrVersioningDisabled
+}
+
+// SignedURL has nothing to sign, so it hands out the content endpoint
+// instead.
+func (s *FileStorage) SignedURL(ctx context.Context, id string, expires time.Time) (string, error) {
+	if _, err := s.imageNames(id); err != nil {
+		return "", err
+	}
+
+	return localSignedURL(id, expires), nil
+}
+
+// SignedUploadURL hands out the app's own upload endpoint, there being no
+// bucket to upload to.
+func (s *FileStorage) SignedUploadURL(ctx context.Context, name, contentType string, expires time.Time) (string, error) {
+	return localUploadURL(name, expires), nil
+}
+
+// Create stores file as a new image named after its base name.
+func (s *FileStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	ext := filepath.Ext(name)
+	id := imageID(name)
+
+	existing, err := s.imageNames(id)
+	if err != nil && err != ErrNotFound {
+		return CSFile{}, err
+	}
+	if len(existing) > 0 && !opts.Overwrite {
+		return CSFile{}, ErrConflict
+	}
+	if err := checkGeneration(s.files(existing), opts.IfGeneration); err != nil {
+		return CSFile{}, err
+	}
+
+	if err := s.store(id, ext, file, opts.Metadata); err != nil {
+		return CSFile{}, err
+	}
+
+	for _, name := range existing {
+		if filepath.Ext(name) == ext {
+			continue
+		}
+		if err := s.remove(name); err != nil {
+			return CSFile{}, err
+		}
+	}
+
+	return s.files([]string{originalName(name)})[0], nil
+}
+
+// Replace swaps the contents of image id for file.
+func (s *FileStorage) Replace(ctx context.Context, id, filename string, file multipart.File, metadata map[string]string, generation int64) error {
+	names, err := s.imageNames(id)
+	if err != nil {
+		return err
+	}
+	if err := checkGeneration(s.files(names), generation); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(filename)
+	if err := s.store(id, ext, file, metadata); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if filepath.Ext(name) == ext {
+			continue
+		}
+		if err := s.remove(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes all of the objects stored for image id.
+func (s *FileStorage) Delete(ctx context.Context, id string, generation int64) error {
+	names, err := s.imageNames(id)
+	if err != nil {
+		return err
+	}
+	if err := checkGeneration(s.files(names), generation); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.remove(name); err != nil {
+			return err
+		}
+	}
+
+	p, err := s.path(path.Join("processed", id))
+	if err != nil {
+		return err
+	}
+	os.Remove(p)
+
+	return nil
+}
+
+// Rename moves the objects of image id to newID.
+func (s *FileStorage) Rename(ctx context.Context, id, newID string, overwrite bool) error {
+	if err := s.clearTarget(ctx, id, newID, overwrite); err != nil {
+		return err
+	}
+
+	return s.move(path.Join("processed", id), path.Join("processed", newID), func(map[string]string) {})
+}
+
+// Copy copies the objects of image id to newID.
+func (s *FileStorage) Copy(ctx context.Context, id, newID string, overwrite bool) error {
+	if err := s.clearTarget(ctx, id, newID, overwrite); err != nil {
+		return err
+	}
+
+	names, err := s.imageNames(id)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.copy(name, imageDir(newID)+strings.TrimPrefix(name, imageDir(id))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clearTarget makes way for image id to be renamed or copied to newID,
+// checking that there is an image id, and that there isn't one called
+// newID unless overwrite allows it to be deleted.
+func (s *FileStorage) clearTarget(ctx context.Context, id, newID string, overwrite bool) error {
+	if _, err := s.imageNames(id); err != nil {
+		return err
+	}
+	if !validFileID(newID) {
+		return invalidArgument(fmt.Errorf("invalid image id %q", newID))
+	}
+
+	_, err := s.imageNames(newID)
+	switch {
+	case err == nil && !overwrite:
+		return ErrConflict
+	case err == nil:
+		return s.Delete(ctx, newID, 0)
+	case err != ErrNotFound:
+		return err
+	}
+
+	return nil
+}
+
+// Trash moves the objects of image id under the trash prefix, stamped with
+// the deletion time.
+func (s *FileStorage) Trash(ctx context.Context, id string, deleted time.Time, generation int64) error {
+	names, err := s.imageNames(id)
+	if err != nil {
+		return err
+	}
+	if err := checkGeneration(s.files(names), generation); err != nil {
+		return err
+	}
+
+	return s.move(path.Join("processed", id), trashDir(id), func(m map[string]string) {
+		m[deletedKey] = deleted.UTC().Format(time.RFC3339)
+	})
+}
+
+// Restore moves the objects of trashed image id back to where they were.
+func (s *FileStorage) Restore(ctx context.Context, id string) error {
+	if !validFileID(id) {
+		return ErrNotFound
+	}
+	if _, err := s.imageNames(id); err != ErrNotFound {
+		if err == nil {
+			return ErrConflict
+		}
+		return err
+	}
+
+	return s.move(trashDir(id), path.Join("processed", id), func(m map[string]string) {
+		delete(m, deletedKey)
+	})
+}
+
+// ListTrash returns every object in the trash.
+func (s *FileStorage) ListTrash(ctx context.Context) (CSFiles, error) {
+	names, err := s.names(trashPrefix)
+	if err != nil {
+		return CSFiles{}, err
+	}
+
+	return s.files(names), nil
+}
+
+// Purge removes the objects of trashed image id.
+func (s *FileStorage) Purge(ctx context.Context, id string) error {
+	if !validFileID(id) {
+		return ErrNotFound
+	}
+
+	names, err := s.names(trashDir(id))
+	if err != nil {
+		return err
+	}
+	names = ownObjects(trashDir(id)+"/", names)
+	if len(names) == 0 {
+		return ErrNotFound
+	}
+
+	for _, name := range names {
+		if err := s.remove(name); err != nil {
+			return err
+		}
+	}
+	// Only goes if nothing is nested under it.
+	if p, err := s.path(trashDir(id)); err == nil {
+		os.Remove(p)
+	}
+
+	return nil
+}
+
+// PutObject writes r to the object called name.
+func (s *FileStorage) PutObject(ctx context.Context, name string, r io.Reader, contentType string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	meta, err := s.write(p, r)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		meta.ContentType = contentType
+	}
+
+	return s.writeMeta(p, meta)
+}
+
+// OpenObject returns a reader over the object called name.
+func (s *FileStorage) OpenObject(ctx context.Context, name string) (*CSReader, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %s", name, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+
+	meta, err := s.readMeta(p)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	cr := &CSReader{
+		ReadCloser:  f,
+		Filename:    filepath.Base(name),
+		ContentType: meta.ContentType,
+		Size:        info.Size(),
+		Updated:     info.ModTime(),
+		Metadata:    meta.Metadata,
+	}
+	if len(meta.MD5) > 0 {
+		cr.ETag = objectETag(meta.MD5, 0)
+		cr.Checksums = meta.checksums()
+	}
+	return cr, nil
+}
+
+// UpdateMetadata merges metadata into the sidecar of the object called
+// name.
+func (s *FileStorage) UpdateMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return ErrNotFound
+	}
+	if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+
+	meta, err := s.readMeta(p)
+	if err != nil {
+		return err
+	}
+	meta.Metadata = copyMetadata(meta.Metadata)
+	for k, v := range metadata {
+		meta.Metadata[k] = v
+		if v == "" {
+			delete(meta.Metadata, k)
+		}
+	}
+
+	return s.writeMeta(p, meta)
+}
+
+// DeleteObject removes the object called name.
+func (s *FileStorage) DeleteObject(ctx context.Context, name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+
+	return s.remove(name)
+}
+
+// ListObjects returns every object under dir.
+func (s *FileStorage) ListObjects(ctx context.Context, dir string) (CSFiles, error) {
+	names, err := s.names(dir)
+	if err != nil {
+		return CSFiles{}, err
+	}
+
+	return s.files(names), nil
+}
+
+// DeleteObjects removes every object under dir.
+func (s *FileStorage) DeleteObjects(ctx context.Context, dir string) error {
+	names, err := s.names(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.remove(name); err != nil {
+			return err
+		}
+	}
+
+	p, err := s.path(dir)
+	if err != nil {
+		return err
+	}
+	os.Remove(p)
+
+	return nil
+}
+
+// move renames every object directly in the directory from to the same
+// name under to, letting edit change its metadata on the way.
+func (s *FileStorage) move(from, to string, edit func(map[string]string)) error {
+	names, err := s.names(from)
+	if err != nil {
+		return err
+	}
+	names = ownObjects(from+"/", names)
+	if len(names) == 0 {
+		return ErrNotFound
+	}
+
+	for _, name := range names {
+		src, err := s.path(name)
+		if err != nil {
+			return err
+		}
+		dst, err := s.path(to + strings.TrimPrefix(name, from))
+		if err != nil {
+			return err
+		}
+
+		meta, err := s.readMeta(src)
+		if err != nil {
+			return err
+		}
+		meta.Metadata = copyMetadata(meta.Metadata)
+		edit(meta.Metadata)
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return fmt.Errorf("could not create directory for %s: %s", dst, err)
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return fmt.Errorf("could not move %s: %s", name, err)
+		}
+		if err := s.writeMeta(dst, meta); err != nil {
+			return err
+		}
+		os.Remove(src + metaSuffix)
+	}
+
+	if p, err := s.path(from); err == nil {
+		os.Remove(p)
+	}
+
+	return nil
+}
+
+// store writes file as both the original and thumbnail of image id, after
+// the same fashion as MemoryStorage.
+// copy writes the object called from, and its metadata, to the name to.
+func (s *FileStorage) copy(from, to string) error {
+	src, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := s.path(to)
+	if err != nil {
+		return err
+	}
+
+	meta, err := s.readMeta(src)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", from, err)
+	}
+	defer f.Close()
+
+	if _, err := s.write(dst, f); err != nil {
+		return err
+	}
+	meta.Created = time.Now()
+
+	return s.writeMeta(dst, meta)
+}
+
+func (s *FileStorage) store(id, ext string, file multipart.File, metadata map[string]string) error {
+	original := fmt.Sprintf("processed/%s/original%s", id, ext)
+	thumbnail := fmt.Sprintf("processed/%s/thumbnail%s", id, ext)
+
+	op, err := s.path(original)
+	if err != nil {
+		return err
+	}
+	tp, err := s.path(thumbnail)
+	if err != nil {
+		return err
+	}
+
+	meta, err := s.write(op, file)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("could not rewind file: %s", err)
+	}
+
+	if _, err := s.write(tp, file); err != nil {
+		return err
+	}
+
+	meta.Metadata, meta.Created = metadata, time.Now()
+	if err := s.writeMeta(op, meta); err != nil {
+		return err
+	}
+
+	return s.writeMeta(tp, meta)
+}
+
+// write copies r to p by way of a temporary file, so a failed write never
+// leaves a partial object behind. It returns the metadata it can tell from
+// what was written: the sniffed content type and the checksums.
+func (s *FileStorage) write(p string, r io.Reader) (fileMeta, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fileMeta{}, fmt.Errorf("could not create directory for %s: %s", p, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return fileMeta{}, fmt.Errorf("could not create file for %s: %s", p, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		tmp.Close()
+		return fileMeta{}, fmt.Errorf("could not read file: %s", err)
+	}
+	head = head[:n]
+
+	h, c := md5.New(), crc32.New(castagnoli)
+	w := io.MultiWriter(tmp, h, c)
+	if _, err := w.Write(head); err != nil {
+		tmp.Close()
+		return fileMeta{}, fmt.Errorf("could not write file %s: %s", p, err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		tmp.Close()
+		return fileMeta{}, fmt.Errorf("could not write file %s: %s", p, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fileMeta{}, fmt.Errorf("could not write file %s: %s", p, err)
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fileMeta{}, fmt.Errorf("could not write file %s: %s", p, err)
+	}
+
+	crc := c.Sum32()
+	return fileMeta{ContentType: http.DetectContentType(head), MD5: h.Sum(nil), CRC32C: &crc}, nil
+}
+
+func (s *FileStorage) readMeta(p string) (fileMeta, error) {
+	meta := fileMeta{}
+
+	b, err := os.ReadFile(p + metaSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, fmt.Errorf("could not read metadata for %s: %s", p, err)
+	}
+
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return meta, fmt.Errorf("could not read metadata for %s: %s", p, err)
+	}
+
+	return meta, nil
+}
+
+func (s *FileStorage) writeMeta(p string, meta fileMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("could not marshal metadata for %s: %s", p, err)
+	}
+
+	if err := os.WriteFile(p+metaSuffix, b, 0o644); err != nil {
+		return fmt.Errorf("could not write metadata for %s: %s", p, err)
+	}
+
+	return nil
+}
+
+// remove deletes an object and its sidecar.
+func (s *FileStorage) remove(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error deleting  %s: %s", name, err)
+	}
+	if err := os.Remove(p + metaSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error deleting  %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// path resolves an object name to a file under the root, refusing names
+// that would escape it.
+func (s *FileStorage) path(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean != "/"+name || strings.Contains(name, "\\") {
+		return "", ErrInvalidName
+	}
+
+	return filepath.Join(s.Root, filepath.FromSlash(clean)), nil
+}
+
+// imageNames returns the names of the objects stored for image id.
+func (s *FileStorage) imageNames(id string) ([]string, error) {
+	if !validFileID(id) {
+		return nil, ErrNotFound
+	}
+
+	names, err := s.names(path.Join("processed", id))
+	if err != nil {
+		return nil, err
+	}
+	names = ownObjects(imageDir(id), names)
+	if len(names) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return names, nil
+}
+
+// validFileID reports whether id names a directory under processed or the
+// trash. Nested ids are fine, as long as no part of them climbs out.
+func validFileID(id string) bool {
+	if id == "" || strings.Contains(id, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(id, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// names returns the sorted names of every object under dir.
+func (s *FileStorage) names(dir string) ([]string, error) {
+	p, err := s.path(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	err = filepath.WalkDir(p, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, metaSuffix) || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %s", dir, err)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// files converts object names to CSFiles, filling in what it can from the
+// filesystem and sidecars.
+func (s *FileStorage) files(names []string) CSFiles {
+	files := CSFiles{}
+	for _, name := range names {
+		f := CSFile{Name: name, URL: &url.URL{Path: name}}
+		if p, err := s.path(name); err == nil {
+			if info, err := os.Stat(p); err == nil {
+				f.Size = info.Size()
+				f.Created = info.ModTime()
+				f.Updated = info.ModTime()
+				f.Generation = info.ModTime().UnixNano()
+			}
+			if meta, err := s.readMeta(p); err == nil {
+				f.ContentType = meta.ContentType
+				f.Metadata = meta.Metadata
+				if len(meta.MD5) > 0 {
+					f.ETag = objectETag(meta.MD5, 0)
+					f.Checksums = meta.checksums()
+				}
+				if !meta.Created.IsZero() {
+					f.Created = meta.Created
+				}
+			}
+		}
+		files = append(files, f)
+	}
+
+	return files
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestFileStorage(t *testing.T, names ...string) *FileStorage {
+	fs, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("could not create file storage: %s", err)
+	}
+
+	for _, name := range names {
+		if _, err := fs.Create(context.Background(), name, newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+			t.Fatalf("could not create %s: %s", name, err)
+		}
+	}
+
+	return fs
+}
+
+func TestFileStorageListMatchesMemoryStorage(t *testing.T) {
+	names := []string{"a-b.png", "a.png", "c.gif", "B.png"}
+	fs := newTestFileStorage(t, names...)
+	ms := newTestMemoryStorage(t, names...)
+
+	for _, pageSize := range []int{1, 3, 100} {
+		want, wantNext, err := ms.List(context.Background(), "", pageSize, "")
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		got, gotNext, err := fs.List(context.Background(), "", pageSize, "")
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+
+		// The two were written moments apart, so only check that the
+		// timestamps and generations are there.
+		for _, fs := range []CSFiles{want, got} {
+			for i := range fs {
+				if fs[i].Created.IsZero() || fs[i].Updated.IsZero() || fs[i].Generation == 0 {
+					t.Fatalf("expected timestamps for %s, got: %v", fs[i].Name, fs[i])
+				}
+				fs[i].Created, fs[i].Updated, fs[i].Generation = time.Time{}, time.Time{}, 0
+			}
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("expected: %v, got: %v", want, got)
+		}
+		if wantNext != gotNext {
+			t.Fatalf("expected: %v, got: %v", wantNext, gotNext)
+		}
+	}
+}
+
+func TestFileStorageOpen(t *testing.T) {
+	fs := newTestFileStorage(t, "RetoColt.png")
+
+	r, err := fs.Open(context.Background(), "RetoColt")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if !bytes.Equal(testPNG(t), got) {
+		t.Fatalf("expected content to round trip")
+	}
+	if r.ContentType != "image/png" {
+		t.Fatalf("expected: %v, got: %v", "image/png", r.ContentType)
+	}
+	if r.Size != int64(len(got)) {
+		t.Fatalf("expected: %v, got: %v", len(got), r.Size)
+	}
+}
+
+func TestFileStoragePathTraversal(t *testing.T) {
+	fs := newTestFileStorage(t, "RetoColt.png")
+
+	outside := filepath.Join(filepath.Dir(fs.Root), "escaped.png")
+	defer os.Remove(outside)
+
+	ids := []string{"..", "../RetoColt", "processed/../../x", "a/b", `..\x`}
+	for _, id := range ids {
+		if _, err := fs.Read(context.Background(), id); err != ErrNotFound {
+			t.Fatalf("Read(%q) expected: %v, got: %v", id, ErrNotFound, err)
+		}
+		if err := fs.Delete(context.Background(), id, 0); err != ErrNotFound {
+			t.Fatalf("Delete(%q) expected: %v, got: %v", id, ErrNotFound, err)
+		}
+	}
+
+	if _, err := fs.Create(context.Background(), "../../escaped.png", newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Fatalf("expected create to stay inside %s", fs.Root)
+	}
+	if _, err := fs.Read(context.Background(), "escaped"); err != nil {
+		t.Fatalf("expected the upload to be stored under its base name, got: %s", err)
+	}
+
+	if _, err := fs.path("processed/../../x"); err != ErrInvalidName {
+		t.Fatalf("expected: %v, got: %v", ErrInvalidName, err)
+	}
+}
+
+func TestFileStorageDelete(t *testing.T) {
+	fs := newTestFileStorage(t, "RetoColt.png", "ColtReto.png")
+
+	if err := fs.Delete(context.Background(), "RetoColt", 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := fs.Read(context.Background(), "RetoColt"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrNotFound, err)
+	}
+	if _, err := fs.Read(context.Background(), "ColtReto"); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// firebaseCertsURL serves the certificates Firebase signs ID tokens with.
+const firebaseCertsURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+
+const (
+	// firebaseCertsTTL is how long the certificates are kept when the
+	// response doesn't say.
+	firebaseCertsTTL = time.Hour
+	// firebaseSkew allows for clocks that are a little out.
+	firebaseSkew = time.Minute
+)
+
+// certsRefetchInterval is how long after the certificates were last fetched
+// a key that isn't among them, or a fetch that failed, has them fetched
+// again, so that tokens naming made-up keys can't have Google's endpoint
+// called for each of them.
+var certsRefetchInterval = time.Minute
+
+// ErrUnauthenticated is returned to callers without a valid ID token.
+var ErrUnauthenticated = errors.New("a valid Firebase ID token is required")
+
+// certSet holds the keys of the certificates Google publishes at certsURL
+// for the tokens called name, fetched again once they expire.
+type certSet struct {
+	name     string
+	certsURL string
+	client   *http.Client
+
+	// fetches runs one fetch at a time for everyone waiting on it, without
+	// holding mu.
+	fetches singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	expires time.Time
+	// fetched is when a fetch was last started, and err how the last one
+	// failed, if it did.
+	fetched time.Time
+	err     error
+}
+
+// FirebaseVerifier checks Firebase ID tokens issued for a project, as the
+// Admin SDK does.
+type FirebaseVerifier struct {
+	projectID string
+	certSet
+}
+
+// NewFirebaseVerifier returns a FirebaseVerifier for tokens of projectID.
+func NewFirebaseVerifier(projectID string) *FirebaseVerifier {
+	v := &FirebaseVerifier{projectID: projectID}
+	v.name, v.certsURL, v.client = "Firebase", firebaseCertsURL, &http.Client{Timeout: 10 * time.Second}
+	return v
+}
+
+// firebaseClaims are the claims of an ID token that are checked.
+type firebaseClaims struct {
+	Audience string `json:"aud"`
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	AuthTime int64  `json:"auth_time"`
+}
+
+// Verify checks that token is an unexpired ID token for the project, signed
+// by Firebase, and returns the uid of the user it is for.
+func (v *FirebaseVerifier) Verify(ctx context.Context, token string) (string, error) {
+	claims := firebaseClaims{}
+	if err := v.verify(ctx, token, &claims); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	switch {
+	case claims.Audience != v.projectID:
+		return "", fmt.Errorf("token is for project %q", claims.Audience)
+	case claims.Issuer != "https://securetoken.google.com/"+v.projectID:
+		return "", fmt.Errorf("token was issued by %q", claims.Issuer)
+	case time.Unix(claims.Expires, 0).Before(now.Add(-firebaseSkew)):
+		return "", fmt.Errorf("token has expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(firebaseSkew)), time.Unix(claims.AuthTime, 0).After(now.Add(firebaseSkew)):
+		return "", fmt.Errorf("token is from the future")
+	case !validUID(claims.Subject):
+		return "", fmt.Errorf("token has an invalid subject")
+	}
+
+	return claims.Subject, nil
+}
+
+// validUID reports whether uid can name a directory of images: Firebase
+// allows up to 128 characters, any of which could be a slash in uids
+// made with custom tokens.
+func validUID(uid string) bool {
+	return uid != "" && len(uid) <= 128 && uid != "." && uid != ".." && !strings.Contains(uid, "/")
+}
+
+// decodeSegment decodes a base64 JSON segment of a token into v.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verify checks that token is signed with one of the keys of c, and
+// decodes its claims into claims. Checking them is left to the caller.
+func (c *certSet) verify(ctx context.Context, token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("malformed token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unexpected signing algorithm %q", header.Alg)
+	}
+
+	key, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token signature: %v", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return fmt.Errorf("invalid token signature")
+	}
+
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return fmt.Errorf("malformed token claims: %v", err)
+	}
+	return nil
+}
+
+// key returns the public key kid, fetching the certificates again once
+// those held have expired. A kid that isn't among them, or a fetch that
+// failed, only has them fetched again once certsRefetchInterval has passed
+// since the last fetch, and is turned away until then.
+func (v *certSet) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	if k, ok, err := v.held(kid); ok {
+		return k, err
+	}
+
+	// The fetch isn't tied to the caller that started it, so that one
+	// giving up doesn't fail the others.
+	ch := v.fetches.DoChan("", func() (interface{}, error) {
+		shared, cancel := context.WithTimeout(detachedContext{ctx}, coalesceTimeout)
+		defer cancel()
+		keys, expires, err := v.fetch(shared)
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		if err == nil {
+			v.keys, v.expires = keys, expires
+		}
+		v.err = err
+		return nil, err
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("token signed with unknown key %q", kid)
+}
+
+// held answers for kid from the certificates held, with ok set, unless they
+// are due to be fetched again, in which case it marks the fetch as started.
+func (v *certSet) held(kid string) (k *rsa.PublicKey, ok bool, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	k, known := v.keys[kid]
+	fresh := now.Before(v.expires)
+	switch {
+	case known && fresh:
+		return k, true, nil
+	case now.Sub(v.fetched) >= certsRefetchInterval, !fresh && v.err == nil:
+		v.fetched = now
+		return nil, false, nil
+	case v.err != nil:
+		return nil, true, v.err
+	default:
+		return nil, true, fmt.Errorf("token signed with unknown key %q", kid)
+	}
+}
+
+// fetch loads the certificates, and returns their keys with when they stop
+// being cached, as the response says.
+func (v *certSet) fetch(ctx context.Context) (map[string]*rsa.PublicKey, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.certsURL, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("could not fetch %s certificates: %v", v.name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("could not fetch %s certificates: %s", v.name, resp.Status)
+	}
+
+	certs := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return nil, time.Time{}, fmt.Errorf("could not read %s certificates: %v", v.name, err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for kid, c := range certs {
+		block, _ := pem.Decode([]byte(c))
+		if block == nil {
+			return nil, time.Time{}, fmt.Errorf("could not decode %s certificate %s", v.name, kid)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("could not parse %s certificate %s: %v", v.name, kid, err)
+		}
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, time.Time{}, fmt.Errorf("%s certificate %s is not for an RSA key", v.name, kid)
+		}
+		keys[kid] = key
+	}
+
+	ttl := firebaseCertsTTL
+	if age, ok := maxAge(resp.Header.Get("Cache-Control")); ok {
+		ttl = age
+	}
+
+	return keys, time.Now().Add(ttl), nil
+}
+
+// maxAge reads the max-age of a Cache-Control header.
+func maxAge(cc string) (time.Duration, bool) {
+	for _, d := range strings.Split(cc, ",") {
+		d = strings.TrimSpace(d)
+		if !strings.HasPrefix(d, "max-age=") {
+			continue
+		}
+		if secs, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
+
+// RequireFirebaseAuth turns away API requests without a Firebase ID token
+// that v accepts in the Authorization header, with a 401. Requests that
+// have one are for the user it names, and only see that user's images if
+// storage is a UserStorage. The static files, health endpoints and those
+// that aren't about images are always open.
+func (s *Server) RequireFirebaseAuth(v *FirebaseVerifier) {
+	s.firebase = v
+	s.router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isStatic(r) || r.Method == http.MethodOptions || isUnscoped(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			auth := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if token == auth || token == "" {
+				writeErrorMsg(w, http.StatusUnauthorized, ErrUnauthenticated)
+				return
+			}
+			uid, err := v.Verify(r.Context(), token)
+			if err != nil {
+				logJSON(SeverityInfo, LogEntry{Message: fmt.Sprintf("rejected ID token: %v", err)})
+				writeErrorMsg(w, http.StatusUnauthorized, ErrUnauthenticated)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(withUser(r.Context(), uid)))
+		})
+	})
+}
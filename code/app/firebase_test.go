@@ -0,0 +1,378 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testProject = "test-project"
+
+// testFirebase stands in for Firebase: it signs ID tokens and serves the
+// certificate they can be checked with.
+type testFirebase struct {
+	key     *rsa.PrivateKey
+	fetches int
+}
+
+// newTestVerifier returns a FirebaseVerifier for testProject that fetches
+// its certificates from a fake of Google's endpoint.
+func newTestVerifier(t *testing.T) (*FirebaseVerifier, *testFirebase) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "securetoken.system.gserviceaccount.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	fb := &testFirebase{key: key}
+	certs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fb.fetches++
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		json.NewEncoder(w).Encode(map[string]string{
+			"kid1": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		})
+	}))
+	t.Cleanup(certs.Close)
+
+	v := NewFirebaseVerifier(testProject)
+	v.certsURL = certs.URL
+	return v, fb
+}
+
+// token returns an ID token for uid, with claims changing any of the
+// usual ones.
+func (fb *testFirebase) token(t *testing.T, uid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	now := time.Now().Unix()
+	c := map[string]interface{}{
+		"aud":       testProject,
+		"iss":       "https://securetoken.google.com/" + testProject,
+		"sub":       uid,
+		"iat":       now,
+		"auth_time": now,
+		"exp":       now + 3600,
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": "kid1", "typ": "JWT"}) + "." + segment(c)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, fb.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestFirebaseVerify(t *testing.T) {
+	v, fb := newTestVerifier(t)
+	ctx := context.Background()
+
+	uid, err := v.Verify(ctx, fb.token(t, "alice", nil))
+	if err != nil || uid != "alice" {
+		t.Fatalf("expected alice, got: %q %v", uid, err)
+	}
+
+	tests := map[string]string{
+		"expired":       fb.token(t, "alice", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"other project": fb.token(t, "alice", map[string]interface{}{"aud": "other"}),
+		"other issuer":  fb.token(t, "alice", map[string]interface{}{"iss": "https://example.com"}),
+		"future":        fb.token(t, "alice", map[string]interface{}{"iat": time.Now().Add(time.Hour).Unix()}),
+		"no subject":    fb.token(t, "", nil),
+		"slash":         fb.token(t, "../bob", nil),
+		"malformed":     "not.a-token",
+		"tampered":      fb.token(t, "alice", nil) + "x",
+	}
+	for name, token := range tests {
+		if _, err := v.Verify(ctx, token); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+
+	// The certificate is kept as long as it may be cached.
+	if fb.fetches != 1 {
+		t.Fatalf("expected the certificates to be fetched once, got: %d", fb.fetches)
+	}
+}
+
+func TestFirebaseUnknownKey(t *testing.T) {
+	v, fb := newTestVerifier(t)
+	ctx := context.Background()
+
+	// However many tokens name a key that isn't held, the certificates are
+	// fetched for them once an interval, and they are turned away between.
+	for i := 0; i < 3; i++ {
+		if _, err := v.key(ctx, "kid2"); err == nil || !strings.Contains(err.Error(), `unknown key "kid2"`) {
+			t.Fatalf("expected an unknown key, got: %v", err)
+		}
+	}
+	if fb.fetches != 1 {
+		t.Fatalf("expected the certificates to be fetched once, got: %d", fb.fetches)
+	}
+	if uid, err := v.Verify(ctx, fb.token(t, "alice", nil)); err != nil || uid != "alice" {
+		t.Fatalf("expected alice, got: %q %v", uid, err)
+	}
+
+	v.fetched = v.fetched.Add(-certsRefetchInterval)
+	if _, err := v.key(ctx, "kid2"); err == nil || fb.fetches != 2 {
+		t.Fatalf("expected the certificates to be fetched again, got: %d fetches, %v", fb.fetches, err)
+	}
+}
+
+func TestFirebaseConcurrentFetch(t *testing.T) {
+	v, fb := newTestVerifier(t)
+	token := fb.token(t, "alice", nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.Verify(context.Background(), token); err != nil {
+				t.Errorf("expected no error, got: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fb.fetches != 1 {
+		t.Fatalf("expected the certificates to be fetched once, got: %d", fb.fetches)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"public, max-age=19800, must-revalidate, no-transform": 19800 * time.Second,
+		"max-age=0": 0,
+	}
+	for cc, want := range tests {
+		if got, ok := maxAge(cc); !ok || got != want {
+			t.Fatalf("%q expected: %v, got: %v", cc, want, got)
+		}
+	}
+	if _, ok := maxAge("no-store"); ok {
+		t.Fatalf("expected no max-age")
+	}
+}
+
+// newUserServer returns a server with memory storage that keeps signed in
+// users apart.
+func newUserServer(t *testing.T) (*Server, *MemoryStorage, *testFirebase) {
+	t.Helper()
+
+	v, fb := newTestVerifier(t)
+	ms := NewMemoryStorage()
+	server := NewServer(CoalesceStorage(UserStorage(ms), nil))
+	server.CacheContent(NewContentCache(1<<20, 1<<20, nil))
+	server.RequireFirebaseAuth(v)
+
+	return server, ms, fb
+}
+
+// userRequest sends r to server with token, if there is one.
+func userRequest(server *Server, r *http.Request, token string) *httptest.ResponseRecorder {
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+func userIDs(t *testing.T, server *Server, token string) []string {
+	t.Helper()
+
+	w := userRequest(server, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil), token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	page := ImagePage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	ids := []string{}
+	for _, i := range page.Images {
+		ids = append(ids, i.ID)
+	}
+	return ids
+}
+
+func TestFirebaseAuthRequired(t *testing.T) {
+	server, _, fb := newUserServer(t)
+
+	expired := fb.token(t, "alice", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})
+	for _, token := range []string{"", "garbage", expired} {
+		w := userRequest(server, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil), token)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q expected: %v, got: %v", token, http.StatusUnauthorized, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Fatalf("expected a JSON error, got: %s", ct)
+		}
+	}
+
+	// Endpoints that aren't about images don't need one.
+	for _, target := range []string{"/api/v1/openapi.json", "/healthz", "/readyz"} {
+		if w := userRequest(server, httptest.NewRequest(http.MethodGet, target, nil), ""); w.Code != http.StatusOK {
+			t.Fatalf("GET %s expected: %v, got: %v", target, http.StatusOK, w.Code)
+		}
+	}
+}
+
+func TestUserIsolation(t *testing.T) {
+	server, ms, fb := newUserServer(t)
+	alice, bob := fb.token(t, "alice", nil), fb.token(t, "bob", nil)
+
+	// Listing for bob first caches an empty page, which alice mustn't get.
+	if ids := userIDs(t, server, bob); len(ids) != 0 {
+		t.Fatalf("expected no images for bob, got: %v", ids)
+	}
+
+	w := userRequest(server, newUploadRequest(t, http.MethodPost, "/api/v1/image", "x.png", "image/png", testPNG(t)), alice)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	image := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &image); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if image.ID != "x" {
+		t.Fatalf("expected alice to get back the id x, got: %s", image.ID)
+	}
+	if _, err := ms.Read(context.Background(), "users/alice/x"); err != nil {
+		t.Fatalf("expected the upload under alice's directory, got: %v", err)
+	}
+
+	if ids := userIDs(t, server, alice); !reflect.DeepEqual(ids, []string{"x"}) {
+		t.Fatalf("expected alice to list x, got: %v", ids)
+	}
+	if ids := userIDs(t, server, bob); len(ids) != 0 {
+		t.Fatalf("expected bob to list nothing, got: %v", ids)
+	}
+
+	// alice's image is there for alice, and served from the cache next time,
+	// but is never found for bob, whatever the request.
+	for i := 0; i < 2; i++ {
+		if w := userRequest(server, httptest.NewRequest(http.MethodGet, "/api/v1/image/x/content", nil), alice); w.Code != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+		}
+	}
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/v1/image/x", nil),
+		httptest.NewRequest(http.MethodGet, "/api/v1/image/x/content", nil),
+		httptest.NewRequest(http.MethodDelete, "/api/v1/image/x", nil),
+		newUploadRequest(t, http.MethodPut, "/api/v1/image/x", "x.png", "image/png", testPNG(t)),
+	} {
+		if w := userRequest(server, r, bob); w.Code != http.StatusNotFound {
+			t.Fatalf("%s %s for bob expected: %v, got: %v", r.Method, r.URL.Path, http.StatusNotFound, w.Code)
+		}
+	}
+	if ids := userIDs(t, server, alice); !reflect.DeepEqual(ids, []string{"x"}) {
+		t.Fatalf("expected alice to still list x, got: %v", ids)
+	}
+
+	if w := userRequest(server, httptest.NewRequest(http.MethodDelete, "/api/v1/image/x", nil), alice); w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+}
+
+func TestUserStorageAnonymous(t *testing.T) {
+	ms := newTestMemoryStorage(t, "x.png")
+	us := UserStorage(ms)
+
+	// Without anybody signed in, everything is as it was.
+	fs, err := us.Read(context.Background(), "x")
+	if err != nil || len(fs) == 0 || fs[0].Name != "processed/x/original.png" {
+		t.Fatalf("expected processed/x/original.png, got: %v %v", fs, err)
+	}
+	if _, err := us.Read(withUser(context.Background(), "alice"), "x"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrNotFound, err)
+	}
+}
+
+// createdStorage records the names images are created under.
+type createdStorage struct {
+	*MemoryStorage
+	names []string
+}
+
+func (cs *createdStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	cs.names = append(cs.names, name)
+	return cs.MemoryStorage.Create(ctx, name, file, opts)
+}
+
+func TestUserStorageObjectNames(t *testing.T) {
+	cs := &createdStorage{MemoryStorage: NewMemoryStorage()}
+	us := UserStorage(cs)
+
+	for _, uid := range []string{"alice", "bob"} {
+		if _, err := us.Create(withUser(context.Background(), uid), "x.png", newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+	}
+
+	// In Cloud Storage, each user's upload goes to the Cloud Function under
+	// their own directory, and is processed to where they read it from.
+	for i, want := range []struct{ upload, original string }{
+		{"uploads/users/alice/x.png", "processed/users/alice/x/original.png"},
+		{"uploads/users/bob/x.png", "processed/users/bob/x/original.png"},
+	} {
+		if got := uploadObject(cs.names[i]); got != want.upload {
+			t.Errorf("expected the upload %s, got: %s", want.upload, got)
+		}
+		if got := originalName(cs.names[i]); got != want.original {
+			t.Errorf("expected the original %s, got: %s", want.original, got)
+		}
+	}
+}
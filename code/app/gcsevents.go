@@ -0,0 +1,317 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// gcsEventsPath is where Cloud Storage notifications are pushed to.
+const gcsEventsPath = "/api/v1/internal/gcs-events"
+
+// googleCertsURL serves the certificates Google signs ID tokens with.
+const googleCertsURL = "https://www.googleapis.com/oauth2/v1/certs"
+
+// maxGCSEventBytes bounds the body of a notification.
+const maxGCSEventBytes = 64 << 10
+
+// What a notification can say happened to an object.
+const (
+	objectFinalized       = "finalized"
+	objectDeleted         = "deleted"
+	objectArchived        = "archived"
+	objectMetadataUpdated = "metadataUpdated"
+)
+
+// objectChanges maps the event types of both Pub/Sub notifications and
+// CloudEvents to what happened. Any other type is acked and ignored.
+var objectChanges = map[string]string{
+	"OBJECT_FINALIZE":                                objectFinalized,
+	"OBJECT_DELETE":                                  objectDeleted,
+	"OBJECT_ARCHIVE":                                 objectArchived,
+	"OBJECT_METADATA_UPDATE":                         objectMetadataUpdated,
+	"google.cloud.storage.object.v1.finalized":       objectFinalized,
+	"google.cloud.storage.object.v1.deleted":         objectDeleted,
+	"google.cloud.storage.object.v1.archived":        objectArchived,
+	"google.cloud.storage.object.v1.metadataUpdated": objectMetadataUpdated,
+}
+
+// OIDCVerifier checks the Google-signed ID tokens Pub/Sub and Eventarc
+// push with.
+type OIDCVerifier struct {
+	audience string
+	certSet
+}
+
+// NewOIDCVerifier returns an OIDCVerifier for tokens minted for audience.
+func NewOIDCVerifier(audience string) *OIDCVerifier {
+	v := &OIDCVerifier{audience: audience}
+	v.name, v.certsURL, v.client = "Google", googleCertsURL, &http.Client{Timeout: 10 * time.Second}
+	return v
+}
+
+// oidcClaims are the claims of a Google ID token that are checked.
+type oidcClaims struct {
+	Audience string `json:"aud"`
+	Issuer   string `json:"iss"`
+	Email    string `json:"email"`
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+}
+
+// Verify checks that token is an unexpired ID token for the audience,
+// signed by Google, and returns the email of the account it is for.
+func (v *OIDCVerifier) Verify(ctx context.Context, token string) (string, error) {
+	claims := oidcClaims{}
+	if err := v.verify(ctx, token, &claims); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	switch {
+	case claims.Audience != v.audience:
+		return "", fmt.Errorf("token is for %q", claims.Audience)
+	case claims.Issuer != "https://accounts.google.com" && claims.Issuer != "accounts.google.com":
+		return "", fmt.Errorf("token was issued by %q", claims.Issuer)
+	case time.Unix(claims.Expires, 0).Before(now.Add(-firebaseSkew)):
+		return "", fmt.Errorf("token has expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(firebaseSkew)):
+		return "", fmt.Errorf("token is from the future")
+	}
+
+	return claims.Email, nil
+}
+
+// gcsEvents is how notifications are taken in: whose bucket is whose, and
+// whether images are kept apart by user.
+type gcsEvents struct {
+	verifier *OIDCVerifier
+	tenants  map[string]string
+	perUser  bool
+}
+
+// ReceiveGCSEvents takes in the notifications Cloud Storage sends when
+// objects change, so that an instance finds out about changes made through
+// the others. tenants names the tenant of each bucket notifications may be
+// about, "" if there is only the one, and perUser says whether images are
+// kept apart by user as UserStorage does. If v is set, only pushes with an
+// ID token it accepts are taken.
+func (s *Server) ReceiveGCSEvents(tenants map[string]string, perUser bool, v *OIDCVerifier) {
+	s.gcsEvents = &gcsEvents{verifier: v, tenants: tenants, perUser: perUser}
+}
+
+// objectChange is a notification that an object changed, however it came.
+type objectChange struct {
+	change string
+	bucket string
+	name   string
+	// overwrote is set when a new generation replaced a live one, which
+	// only Pub/Sub notifications say.
+	overwrote bool
+}
+
+// objectData is the part of an object's resource a notification carries
+// that is needed here.
+type objectData struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+}
+
+// pubSubPush is the body of a Pub/Sub push.
+type pubSubPush struct {
+	Message *struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       string            `json:"data"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// structuredEvent is a CloudEvent in the structured content mode.
+type structuredEvent struct {
+	SpecVersion string          `json:"specversion"`
+	Type        string          `json:"type"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// readObjectChange reads the notification r carries, whether a Pub/Sub
+// push or a CloudEvent in the binary or structured content mode. An event
+// of a type that isn't about objects changing comes back with no change.
+func readObjectChange(r *http.Request) (objectChange, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxGCSEventBytes))
+	if err != nil {
+		return objectChange{}, fmt.Errorf("could not read notification: %w", err)
+	}
+
+	var eventType string
+	data := body
+	ch := objectChange{}
+	switch {
+	case r.Header.Get("Ce-Type") != "":
+		eventType = r.Header.Get("Ce-Type")
+	case strings.HasPrefix(r.Header.Get("Content-Type"), "application/cloudevents+json"):
+		ce := structuredEvent{}
+		if err := json.Unmarshal(body, &ce); err != nil {
+			return objectChange{}, fmt.Errorf("invalid CloudEvent: %w", err)
+		}
+		eventType, data = ce.Type, ce.Data
+	default:
+		push := pubSubPush{}
+		if err := json.Unmarshal(body, &push); err != nil || push.Message == nil {
+			return objectChange{}, errors.New("expected a Pub/Sub push or a CloudEvent")
+		}
+		attrs := push.Message.Attributes
+		eventType = attrs["eventType"]
+		ch.overwrote = attrs["overwroteGeneration"] != ""
+		if data, err = base64.StdEncoding.DecodeString(push.Message.Data); err != nil {
+			return objectChange{}, fmt.Errorf("invalid message data: %w", err)
+		}
+		// Notifications can be set up without the object in the data,
+		// in which case the attributes have to do.
+		if len(data) == 0 {
+			data, _ = json.Marshal(objectData{Bucket: attrs["bucketId"], Name: attrs["objectId"]})
+		}
+	}
+
+	if ch.change = objectChanges[eventType]; ch.change == "" {
+		return ch, nil
+	}
+	obj := objectData{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return objectChange{}, fmt.Errorf("invalid object data: %w", err)
+	}
+	if obj.Bucket == "" || obj.Name == "" {
+		return objectChange{}, errors.New("notification names no object")
+	}
+	ch.bucket, ch.name = obj.Bucket, obj.Name
+
+	return ch, nil
+}
+
+// image returns the id of the image the object name is the original of,
+// and the user it belongs to, if it is one.
+func (g *gcsEvents) image(name string) (id, uid string, ok bool) {
+	dir, rest, _ := strings.Cut(name, "/")
+	if dir != "processed" || !strings.HasPrefix(path.Base(rest), "original.") {
+		return "", "", false
+	}
+	id = path.Dir(rest)
+	if g.perUser && strings.HasPrefix(id, "users/") {
+		uid, id, _ = strings.Cut(strings.TrimPrefix(id, "users/"), "/")
+	}
+
+	return id, uid, id != "." && id != ""
+}
+
+// gcsEventsHandler takes in a notification that an object changed. If it
+// is the original of an image, the caches are dropped and the change is
+// handed to the local streams, unless it was made here and so has been
+// already. What the image now is, or whether it is gone, is read from
+// storage rather than taken from the notification. Every notification is
+// acked with a 204 unless storage can't be read, so that Pub/Sub tries it
+// again.
+//
+// Each notification is pushed to a single instance, so for all of them to
+// hear of every change each needs a subscription of its own.
+func (s *Server) gcsEventsHandler(w http.ResponseWriter, r *http.Request) {
+	g := s.gcsEvents
+	if g == nil {
+		writeErrorMsg(w, http.StatusNotFound, errors.New("notifications are only taken in with GCS_EVENTS set"))
+		return
+	}
+	if g.verifier != nil {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || token == "" {
+			writeErrorMsg(w, http.StatusUnauthorized, ErrUnauthenticated)
+			return
+		}
+		if _, err := g.verifier.Verify(r.Context(), token); err != nil {
+			logJSON(SeverityInfo, LogEntry{Message: fmt.Sprintf("rejected notification token: %v", err)})
+			writeErrorMsg(w, http.StatusUnauthorized, ErrUnauthenticated)
+			return
+		}
+	}
+
+	ch, err := readObjectChange(r)
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	tenant, known := g.tenants[ch.bucket]
+	id, uid, isImage := g.image(ch.name)
+	if ch.change == "" || !known || !isImage {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ctx := withUser(withTenant(r.Context(), tenant), uid)
+	if err := s.objectChanged(ctx, id, ch); err != nil {
+		writeError(w, fmt.Errorf("error reading %s after it changed: %w", id, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// objectChanged brings what is held about image id in line with storage
+// once ch says its original changed.
+func (s *Server) objectChanged(ctx context.Context, id string, ch objectChange) error {
+	s.stats.invalidate()
+	s.lists.invalidate()
+
+	scope := scopeOf(ctx)
+	last, seen := s.events.latest(scope, id)
+	fs, err := s.storage.Read(ctx, id)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	is, _ := NewImages(fs)
+
+	if len(is) == 0 {
+		// An image deleted on a versioned bucket is archived rather
+		// than deleted, and one overwritten is archived or deleted, so
+		// only an image that is gone counts as deleted.
+		s.contents.of(ctx).forget(id)
+		if !seen || last.action != actionDeleted {
+			s.events.publish(scope, actionDeleted, Image{ID: id, Name: id})
+		}
+		return nil
+	}
+
+	img := is[0]
+	s.contents.of(ctx).add(id, img.ETag)
+	// What replaced it has a notification of its own.
+	if ch.change == objectDeleted || ch.change == objectArchived {
+		return nil
+	}
+	if seen && last.action != actionDeleted && last.image.Generation == img.Generation && last.image.Updated.Equal(img.Updated) {
+		return nil
+	}
+	action := actionCreated
+	if (seen && last.action != actionDeleted) || ch.overwrote || ch.change == objectMetadataUpdated {
+		action = actionUpdated
+	}
+	s.events.publish(scope, action, img)
+
+	return nil
+}
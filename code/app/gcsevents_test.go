@@ -0,0 +1,189 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pubSubNotification returns a Pub/Sub push of a notification that the
+// object name in bucket had eventType happen to it.
+func pubSubNotification(eventType, bucket, name string) *http.Request {
+	data := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{"bucket": %q, "name": %q, "generation": "1"}`, bucket, name)))
+	body := fmt.Sprintf(`{"message": {"attributes": {"eventType": %q, "bucketId": %q, "objectId": %q}, "data": %q, "messageId": "1"}, "subscription": "projects/p/subscriptions/s"}`, eventType, bucket, name, data)
+	return httptest.NewRequest(http.MethodPost, gcsEventsPath, strings.NewReader(body))
+}
+
+// nextEvent returns the next change handed to sub, if there is one.
+func nextEvent(sub *subscriber) (busEvent, bool) {
+	select {
+	case e := <-sub.events:
+		return e, true
+	default:
+		return busEvent{}, false
+	}
+}
+
+func TestGCSEvents(t *testing.T) {
+	ms := NewMemoryStorage()
+	server := NewServer(ms)
+	server.ReceiveGCSEvents(map[string]string{"bucket": ""}, false, nil)
+	sub, _, _ := server.events.subscribe("/", "")
+
+	notify := func(r *http.Request) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected: %v, got: %v %s", http.StatusNoContent, w.Code, w.Body)
+		}
+	}
+
+	// An image added through another instance is handed on once.
+	if _, err := ms.Create(context.Background(), "a.png", newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	notify(pubSubNotification("OBJECT_FINALIZE", "bucket", "processed/a/original.png"))
+	if e, ok := nextEvent(sub); !ok || e.action != actionCreated || e.image.ID != "a" {
+		t.Fatalf("expected a to be created, got: %+v", e)
+	}
+	notify(pubSubNotification("OBJECT_FINALIZE", "bucket", "processed/a/original.png"))
+	if e, ok := nextEvent(sub); ok {
+		t.Fatalf("expected a redelivery to be passed over, got: %+v", e)
+	}
+
+	// One made here has been handed on already.
+	server.ServeHTTP(httptest.NewRecorder(), newUploadRequest(t, http.MethodPost, "/api/v1/image?force=true", "b.png", "image/png", testPNG(t)))
+	if e, ok := nextEvent(sub); !ok || e.action != actionCreated || e.image.ID != "b" {
+		t.Fatalf("expected b to be created, got: %+v", e)
+	}
+	notify(pubSubNotification("OBJECT_FINALIZE", "bucket", "processed/b/original.png"))
+	if e, ok := nextEvent(sub); ok {
+		t.Fatalf("expected the notification of b to be passed over, got: %+v", e)
+	}
+
+	if err := ms.Delete(context.Background(), "a", 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		notify(pubSubNotification("OBJECT_DELETE", "bucket", "processed/a/original.png"))
+	}
+	if e, ok := nextEvent(sub); !ok || e.action != actionDeleted || e.image.ID != "a" {
+		t.Fatalf("expected a to be deleted, got: %+v", e)
+	}
+	if e, ok := nextEvent(sub); ok {
+		t.Fatalf("expected a single delete, got: %+v", e)
+	}
+
+	// Other buckets, objects and kinds of events are acked and ignored.
+	notify(pubSubNotification("OBJECT_FINALIZE", "elsewhere", "processed/b/original.png"))
+	notify(pubSubNotification("OBJECT_FINALIZE", "bucket", "processed/b/thumbnail.png"))
+	notify(pubSubNotification("OBJECT_FINALIZE", "bucket", "staging/upload"))
+	notify(pubSubNotification("OBJECT_RESTORE", "bucket", "processed/b/original.png"))
+	if e, ok := nextEvent(sub); ok {
+		t.Fatalf("expected nothing to be handed on, got: %+v", e)
+	}
+
+	for _, body := range []string{"nonsense", `{"subscription": "s"}`, `{"message": {"attributes": {"eventType": "OBJECT_FINALIZE"}, "data": ""}}`} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, gcsEventsPath, strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestGCSCloudEvents(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(UserStorage(ms))
+	server.ReceiveGCSEvents(map[string]string{"bucket": "acme"}, true, nil)
+	sub, _, _ := server.events.subscribe("acme/alice", "")
+
+	binary := httptest.NewRequest(http.MethodPost, gcsEventsPath, strings.NewReader(`{"bucket": "bucket", "name": "processed/users/alice/a/original.png"}`))
+	binary.Header.Set("Ce-Type", "google.cloud.storage.object.v1.deleted")
+	binary.Header.Set("Content-Type", "application/json")
+	structured := httptest.NewRequest(http.MethodPost, gcsEventsPath, strings.NewReader(`{"specversion": "1.0", "type": "google.cloud.storage.object.v1.finalized", "data": {"bucket": "bucket", "name": "processed/users/alice/b/original.png"}}`))
+	structured.Header.Set("Content-Type", "application/cloudevents+json")
+
+	for _, r := range []*http.Request{binary, structured} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected: %v, got: %v %s", http.StatusNoContent, w.Code, w.Body)
+		}
+	}
+
+	// Neither is in alice's images, so both are gone.
+	for _, id := range []string{"a", "b"} {
+		if e, ok := nextEvent(sub); !ok || e.action != actionDeleted || e.image.ID != id {
+			t.Fatalf("expected %s to be deleted for alice, got: %+v", id, e)
+		}
+	}
+}
+
+func TestGCSEventsDisabled(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, pubSubNotification("OBJECT_FINALIZE", "bucket", "processed/a/original.png"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestGCSEventsToken(t *testing.T) {
+	// The fake serves Google's certificates as well as Firebase's.
+	firebase, fb := newTestVerifier(t)
+	v := NewOIDCVerifier("https://gallery.example.com/push")
+	v.certsURL = firebase.certsURL
+
+	server := NewServer(NewMemoryStorage())
+	server.RequireAPIKey([]string{"key"}, true)
+	server.ReceiveGCSEvents(map[string]string{"bucket": ""}, false, v)
+
+	_, other := newTestVerifier(t)
+	claims := map[string]interface{}{"aud": v.audience, "iss": "https://accounts.google.com", "email": "push@example.iam.gserviceaccount.com"}
+	tests := map[string]struct {
+		token string
+		code  int
+	}{
+		"none":         {"", http.StatusUnauthorized},
+		"good":         {fb.token(t, "push", claims), http.StatusNoContent},
+		"wrong key":    {other.token(t, "push", claims), http.StatusUnauthorized},
+		"firebase":     {fb.token(t, "push", nil), http.StatusUnauthorized},
+		"wrong issuer": {fb.token(t, "push", map[string]interface{}{"aud": v.audience}), http.StatusUnauthorized},
+		"expired": {fb.token(t, "push", map[string]interface{}{
+			"aud": v.audience, "iss": "accounts.google.com", "exp": time.Now().Add(-time.Hour).Unix(),
+		}), http.StatusUnauthorized},
+	}
+	for name, test := range tests {
+		r := pubSubNotification("OBJECT_FINALIZE", "bucket", "processed/a/original.png")
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected: %v, got: %v %s", name, test.code, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+)
+
+// maxAnimatedBytes is the largest animated GIF that can be uploaded, set
+// from MAX_ANIMATED_BYTES. Every frame of one is a whole image once it is
+// decoded, so it gets a lower limit than other uploads.
+var maxAnimatedBytes int64 = 4 << 20
+
+// The metadata an upload's frame count is kept in, and whether it is
+// animated, for GIFs.
+const (
+	frameCountKey = "frameCount"
+	animatedKey   = "animated"
+)
+
+// errNotGIF is what gifFrames makes of anything but a GIF.
+var errNotGIF = errors.New("not a GIF")
+
+// errAnimated is what resizing or converting an animated GIF fails with,
+// since only its first frame would be left.
+var errAnimated = errors.New("animated images can't be resized or converted")
+
+// gifFrames counts the frames of the GIF in r by walking its blocks, without
+// decoding any of them, so that a large animation costs no memory to check.
+// A GIF that ends without a trailer counts the frames it got to.
+func gifFrames(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+
+	// The header, then the logical screen descriptor.
+	var header [13]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, errNotGIF
+	}
+	if v := string(header[:6]); v != "GIF87a" && v != "GIF89a" {
+		return 0, errNotGIF
+	}
+	if err := skipColorTable(br, header[10]); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+
+		switch b {
+		case 0x21: // An extension: its label, then its data.
+			if _, err := br.ReadByte(); err != nil {
+				return frames, unexpectedEOF(err)
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return frames, err
+			}
+		case 0x2c: // An image descriptor, its color table and its pixels.
+			var desc [9]byte
+			if _, err := io.ReadFull(br, desc[:]); err != nil {
+				return frames, unexpectedEOF(err)
+			}
+			if err := skipColorTable(br, desc[8]); err != nil {
+				return frames, err
+			}
+			// The minimum LZW code size.
+			if _, err := br.ReadByte(); err != nil {
+				return frames, unexpectedEOF(err)
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return frames, err
+			}
+			frames++
+		case 0x3b: // The trailer.
+			return frames, nil
+		default:
+			return frames, fmt.Errorf("gif: unknown block type %#x", b)
+		}
+	}
+}
+
+// skipColorTable skips the color table that flags, the packed field of a
+// screen or image descriptor, says follows, if any.
+func skipColorTable(br *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := br.Discard(3 << (flags&0x07 + 1))
+	return unexpectedEOF(err)
+}
+
+// skipSubBlocks skips a run of data sub-blocks, up to the empty one that
+// ends it.
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		n, err := br.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(n)); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+}
+
+// unexpectedEOF makes running out in the middle of a block the error it is.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// animated reports whether data is a GIF of more than one frame.
+func animated(data []byte) bool {
+	frames, err := gifFrames(bytes.NewReader(data))
+	return err == nil && frames > 1
+}
+
+// frameMetadata is the metadata recorded for a GIF upload: how many frames
+// it has, and whether that makes it animated. It leaves the file rewound.
+func frameMetadata(file multipart.File) (map[string]string, error) {
+	frames, err := gifFrames(file)
+	if _, serr := file.Seek(0, io.SeekStart); serr != nil {
+		return nil, serr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]string{frameCountKey: strconv.Itoa(frames)}
+	if frames > 1 {
+		m[animatedKey] = "true"
+	}
+	return m, nil
+}
+
+// checkAnimated turns away animated GIFs larger than maxAnimatedBytes. On
+// failure it returns the status to respond with. file is rewound so it can
+// be read again from the start.
+func checkAnimated(file multipart.File) (int, error) {
+	// Uploads can only be rewound, so the size is counted rather than
+	// sought.
+	cr := &countingReader{r: file}
+	frames, err := gifFrames(cr)
+	if err == nil && frames > 1 {
+		io.Copy(io.Discard, cr)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil || cr.err != nil {
+		if err == nil {
+			err = cr.err
+		}
+		return http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+
+	if err == nil && frames > 1 && cr.n > maxAnimatedBytes {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("animated image too large, limit is %d bytes", maxAnimatedBytes)
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testGIF encodes a 32 by 32 GIF of frames frames, each a different
+// shade of grey.
+func testGIF(t *testing.T, frames int) []byte {
+	palette := color.Palette{}
+	for i := 0; i < frames; i++ {
+		palette = append(palette, color.Gray{Y: uint8(i * 255 / frames)})
+	}
+
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 32, 32), palette)
+		for p := range img.Pix {
+			img.Pix[p] = uint8(i)
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("could not encode test GIF: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrames(t *testing.T) {
+	for _, frames := range []int{1, 3} {
+		got, err := gifFrames(bytes.NewReader(testGIF(t, frames)))
+		if err != nil || got != frames {
+			t.Errorf("expected %d frames, got: %d %v", frames, got, err)
+		}
+	}
+
+	animation := testGIF(t, 3)
+	if _, err := gifFrames(bytes.NewReader(animation[:len(animation)/2])); err == nil {
+		t.Errorf("expected an error for a truncated GIF")
+	}
+	if _, err := gifFrames(bytes.NewReader(testPNG(t))); err != errNotGIF {
+		t.Errorf("expected: %v, got: %v", errNotGIF, err)
+	}
+}
+
+func TestAnimatedGIF(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	server.SetWebPEncoder(fakeWebPEncoder{webp: testWebP})
+	animation := testGIF(t, 3)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "spin.gif", "image/gif", animation))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var img Image
+	json.Unmarshal(w.Body.Bytes(), &img)
+	if img.FrameCount != 3 || !img.Animated {
+		t.Fatalf("expected 3 frames, animated, got: %d %v", img.FrameCount, img.Animated)
+	}
+
+	// The thumbnail is of the first frame.
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/spin/thumbnail", nil))
+	thumb, _, err := image.Decode(w.Body)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("expected a thumbnail, got: %v %v", w.Code, err)
+	}
+	if r, _, _, _ := thumb.At(0, 0).RGBA(); r != 0 {
+		t.Fatalf("expected the first frame, got: %v", thumb.At(0, 0))
+	}
+
+	// Resizing or converting would lose all but the first frame.
+	for _, target := range []string{"/api/v1/image/spin/content?w=16", "/api/v1/image/spin/content?format=png"} {
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("%s: expected: %v, got: %v", target, http.StatusNotImplemented, w.Code)
+		}
+	}
+
+	// A browser that takes WebP gets the animation as it is.
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image/spin/content", nil)
+	r.Header.Set("Accept", "image/webp,*/*")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), animation) {
+		t.Fatalf("expected the original, got: %v %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestAnimatedGIFTooLarge(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	animation, still := testGIF(t, 3), testGIF(t, 1)
+
+	old := maxAnimatedBytes
+	maxAnimatedBytes = int64(len(still))
+	defer func() { maxAnimatedBytes = old }()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "spin.gif", "image/gif", animation))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "still.gif", "image/gif", still))
+	var img Image
+	json.Unmarshal(w.Body.Bytes(), &img)
+	if w.Code != http.StatusCreated || img.FrameCount != 1 || img.Animated {
+		t.Fatalf("expected a still image, got: %v %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,594 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/99designs/gqlgen/complexity"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/executor"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+
+	"scalar-attempt/api"
+	"scalar-attempt/graph"
+)
+
+// graphqlPath serves GraphQL queries over the same storage as the REST
+// API. Uploads stay on REST.
+const graphqlPath = "/api/v1/graphql"
+
+// maxGraphQLBodyBytes bounds the body of a GraphQL request, which also
+// bounds how many fields a query can select.
+const maxGraphQLBodyBytes = 64 << 10
+
+// Limits on what a single GraphQL operation can ask for. Depth counts
+// nested selections, and complexity what resolving them costs, so that a
+// query can't list a page of images under a thousand aliases, or read the
+// whole bucket over and over. Introspection counts toward neither, being
+// bounded by the schema.
+var (
+	gqlMaxDepth      = 8
+	gqlMaxComplexity = 20000
+)
+
+// What fields cost toward gqlMaxComplexity beyond what they select, every
+// other field costing 1. Listing images in any order but by name, or
+// counting them, reads the whole bucket, so a query can only do either
+// twice. Mutations are priced so that a request can't make more changes
+// than a batch delete could.
+var (
+	gqlFullListingCost = 8000
+	gqlMutationCost    = 200
+)
+
+// GraphQLRequest is the body of a POST to /api/v1/graphql.
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// GraphQLResponse answers a GraphQL request. Data is left out if the
+// request couldn't be executed at all, in which case Errors say why.
+type GraphQLResponse struct {
+	Data   json.RawMessage `json:"data,omitempty"`
+	Errors []GraphQLError  `json:"errors,omitempty"`
+}
+
+// JSON marshalls the content of GraphQLResponse to json.
+func (gr GraphQLResponse) JSON() (string, error) {
+	bytes, err := json.Marshal(gr)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of GraphQLResponse to json.
+func (gr GraphQLResponse) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(gr)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// GraphQLError is an error answered in the errors of a GraphQL response.
+// Path leads to the field that failed, if one did, and the code is that
+// the REST API would give the same error.
+type GraphQLError struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions GraphQLErrorExtensions `json:"extensions"`
+}
+
+type GraphQLErrorExtensions struct {
+	Code string `json:"code"`
+}
+
+// EnableGraphiQL serves GraphiQL on GET /api/v1/graphql, for trying out
+// queries in a browser.
+func (s *Server) EnableGraphiQL() {
+	s.graphiql = true
+}
+
+// graphqlHandler executes a GraphQL request. Queries only read, so they
+// are let through as any other read is; mutations need a key if reads
+// don't, and can't be made while the server is read-only.
+func (s *Server) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		if !s.graphiql {
+			writeErrorMsg(w, http.StatusNotFound, errors.New("GraphiQL not enabled, set ENABLE_GRAPHIQL=true"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, graphiqlPage)
+		return
+	}
+
+	ctx := graphql.StartOperationTrace(r.Context())
+	start := graphql.Now()
+	req := GraphQLRequest{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGraphQLBodyBytes))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		writeGraphQLError(w, gqlerror.List{gqlerror.Errorf("invalid request body: %s", err)})
+		return
+	}
+	rc, errs := s.graphql.CreateOperationContext(ctx, &graphql.RawParams{
+		Query:         req.Query,
+		OperationName: req.OperationName,
+		Variables:     req.Variables,
+		ReadTime:      graphql.TraceTiming{Start: start, End: graphql.Now()},
+	})
+	if errs != nil {
+		writeGraphQLError(w, errs)
+		return
+	}
+
+	if rc.Operation.Operation == ast.Mutation {
+		if s.validKey != nil {
+			if key := r.Header.Get(apiKeyHeader); key == "" || !s.validKey(key) {
+				writeErrorMsg(w, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+		}
+		if s.Mode() == ModeReadOnly {
+			w.Header().Set("Retry-After", strconv.Itoa(int(modeRetryAfter.Seconds())))
+			writeErrorMsg(w, http.StatusServiceUnavailable, ErrReadOnly)
+			return
+		}
+	}
+
+	h, ctx := s.graphql.DispatchOperation(ctx, rc)
+	resp := h(ctx)
+	ges := gqlErrors(resp.Errors)
+	for _, ge := range ges {
+		if ge.Extensions.Code == codeInternal {
+			logJSON(SeverityError, LogEntry{
+				Message: fmt.Sprintf("Webserver : graphql %v: %s", ge.Path, ge.Message),
+				Labels:  requestLabels(w.Header().Get(requestIDHeader)),
+			})
+		}
+	}
+
+	writeJSON(w, GraphQLResponse{Data: resp.Data, Errors: ges}, http.StatusOK)
+}
+
+// writeGraphQLError answers a request that couldn't be executed with a 400.
+func writeGraphQLError(w http.ResponseWriter, errs gqlerror.List) {
+	ges := gqlErrors(errs)
+	for i := range ges {
+		ges[i].Extensions.Code = codeInvalidArgument
+	}
+	writeJSON(w, GraphQLResponse{Errors: ges}, http.StatusBadRequest)
+}
+
+// gqlErrors are errs as answered, with the code presentGraphQLError gave
+// them.
+func gqlErrors(errs gqlerror.List) []GraphQLError {
+	var ges []GraphQLError
+	for _, err := range errs {
+		ge := GraphQLError{Message: err.Message, Extensions: GraphQLErrorExtensions{Code: codeInternal}}
+		if c, ok := err.Extensions["code"].(string); ok {
+			ge.Extensions.Code = c
+		}
+		for _, p := range err.Path {
+			switch p := p.(type) {
+			case ast.PathName:
+				ge.Path = append(ge.Path, string(p))
+			case ast.PathIndex:
+				ge.Path = append(ge.Path, int(p))
+			}
+		}
+		ges = append(ges, ge)
+	}
+	return ges
+}
+
+// presentGraphQLError is what a field that failed with err answers, with
+// the message and code the REST API would give.
+func presentGraphQLError(ctx context.Context, err error) *gqlerror.Error {
+	var ae *apiError
+	errors.As(classify(err), &ae)
+	ge := gqlerror.WrapPath(graphql.GetPath(ctx), ae)
+	ge.Extensions = map[string]interface{}{"code": ae.Code}
+	return ge
+}
+
+// graphQLSchema is what /api/v1/graphql serves, resolved against s.
+func (s *Server) graphQLSchema() *executor.Executor {
+	c := graph.ComplexityRoot{}
+	c.Query.Images = func(child int, first *int, _, _ *string, sort *graph.ImageSort) int {
+		base := 1
+		if !gqlSort(sort).native() {
+			base = gqlFullListingCost
+		}
+		return base + gqlFirst(first)*child
+	}
+	c.Query.Stats = func(child int) int { return gqlFullListingCost + child }
+	c.Mutation.DeleteImage = func(child int, _ string) int { return gqlMutationCost + child }
+	c.Mutation.UpdateMetadata = func(child int, _ string, _ []string, _ *string) int { return gqlMutationCost + child }
+
+	es := graph.NewExecutableSchema(graph.Config{Resolvers: gqlResolver{s}, Complexity: c})
+	e := executor.New(es)
+	e.Use(extension.Introspection{})
+	e.Use(gqlLimits{es})
+	e.SetErrorPresenter(presentGraphQLError)
+
+	return e
+}
+
+// gqlLimits turns away operations over gqlMaxDepth or gqlMaxComplexity
+// before they are executed.
+type gqlLimits struct {
+	es graphql.ExecutableSchema
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationContextMutator
+} = gqlLimits{}
+
+func (gqlLimits) ExtensionName() string {
+	return "Limits"
+}
+
+func (gqlLimits) Validate(graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (l gqlLimits) MutateOperationContext(ctx context.Context, rc *graphql.OperationContext) *gqlerror.Error {
+	if gqlDepth(rc.Operation.SelectionSet) > gqlMaxDepth {
+		return gqlerror.Errorf("the query is nested more than %d deep", gqlMaxDepth)
+	}
+	if cost := complexity.Calculate(l.es, rc.Operation, rc.Variables); cost > gqlMaxComplexity {
+		return gqlerror.Errorf("the %s costs %d, more than the limit of %d: ask for fewer images at once", rc.Operation.Operation, cost, gqlMaxComplexity)
+	}
+	return nil
+}
+
+// gqlDepth is how many selection sets deep sels go, leaving out those
+// below an introspection field. Validation has already turned away
+// fragments that spread themselves.
+func gqlDepth(sels ast.SelectionSet) int {
+	deepest := 0
+	for _, sel := range sels {
+		d := 0
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if sel.Name == "__schema" || sel.Name == "__type" {
+				continue
+			}
+			if len(sel.SelectionSet) > 0 {
+				d = gqlDepth(sel.SelectionSet)
+			}
+		case *ast.FragmentSpread:
+			d = gqlDepth(sel.Definition.SelectionSet) - 1
+		case *ast.InlineFragment:
+			d = gqlDepth(sel.SelectionSet) - 1
+		}
+		if d > deepest {
+			deepest = d
+		}
+	}
+	return 1 + deepest
+}
+
+// gqlSorts are the orders images can be listed in, by the ImageSort values
+// naming them.
+var gqlSorts = map[graph.ImageSort]sortOrder{
+	graph.ImageSortNameAsc:     {Key: sortName},
+	graph.ImageSortNameDesc:    {Key: sortName, Desc: true},
+	graph.ImageSortSizeAsc:     {Key: sortSize},
+	graph.ImageSortSizeDesc:    {Key: sortSize, Desc: true},
+	graph.ImageSortUpdatedAsc:  {Key: sortUpdated},
+	graph.ImageSortUpdatedDesc: {Key: sortUpdated, Desc: true},
+}
+
+func gqlSort(name *graph.ImageSort) sortOrder {
+	if name != nil {
+		if order, ok := gqlSorts[*name]; ok {
+			return order
+		}
+	}
+	return sortOrder{Key: sortName}
+}
+
+// gqlFirst is the page size first asks for, capped as a listing's is.
+func gqlFirst(first *int) int {
+	n := defaultPageSize
+	if first != nil {
+		n = *first
+	}
+	if n > maxPageSize {
+		n = maxPageSize
+	}
+	return n
+}
+
+// gqlOptString is v, empty if it was left out or null.
+func gqlOptString(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+// gqlStr is v as answered over GraphQL, null if it is empty.
+func gqlStr(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return &v
+}
+
+// gqlTime is t as answered over GraphQL, null if it is zero.
+func gqlTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	return gqlStr(t.Format(time.RFC3339Nano))
+}
+
+// gqlStrings is ss as a GraphQL list, which is never null.
+func gqlStrings(ss []string) []string {
+	if ss == nil {
+		return []string{}
+	}
+	return ss
+}
+
+// gqlGiven reports whether the field being resolved was given the argument
+// name, if only as null, rather than leaving it out.
+func gqlGiven(ctx context.Context, name string) bool {
+	arg := graphql.GetFieldContext(ctx).Field.Arguments.ForName(name)
+	if arg == nil {
+		return false
+	}
+	if arg.Value.Kind == ast.Variable {
+		_, ok := graphql.GetOperationContext(ctx).Variables[arg.Value.Raw]
+		return ok
+	}
+	return true
+}
+
+// gqlResolver resolves the schema in graph against s.
+type gqlResolver struct {
+	s *Server
+}
+
+func (r gqlResolver) Query() graph.QueryResolver       { return gqlQuery(r) }
+func (r gqlResolver) Mutation() graph.MutationResolver { return gqlMutation(r) }
+func (r gqlResolver) Image() graph.ImageResolver       { return gqlImage{} }
+
+type gqlQuery gqlResolver
+
+// Images lists a page of images, sharing the list cache with
+// /api/v1/image.
+func (r gqlQuery) Images(ctx context.Context, first *int, after, prefix *string, sort *graph.ImageSort) (*graph.ImageConnection, error) {
+	if first != nil && *first < 1 {
+		return nil, invalidArgument(fmt.Errorf("invalid first, want a positive integer got: %d", *first))
+	}
+	s := r.s
+	limit := gqlFirst(first)
+	order := gqlSort(sort)
+
+	q := url.Values{"limit": {strconv.Itoa(limit)}, "pageToken": {gqlOptString(after)}, "prefix": {gqlOptString(prefix)}, "sort": {order.Key}}
+	if order.Desc {
+		q.Set("order", "desc")
+	}
+	key := scopeOf(ctx) + "?" + listKey(q)
+	page, _, ok := s.lists.get(key)
+	if !ok {
+		gen := s.lists.generation()
+		var err error
+		if order.native() {
+			page, err = s.storageList(ctx, gqlOptString(prefix), limit, gqlOptString(after))
+		} else {
+			page, err = s.sortedList(ctx, order, listFilter{prefix: gqlOptString(prefix)}, limit, gqlOptString(after))
+		}
+		if err == ErrInvalidPageToken {
+			return nil, invalidArgument(fmt.Errorf("invalid after: %s", gqlOptString(after)))
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.lists.put(key, gen, page)
+	}
+
+	return &graph.ImageConnection{
+		Nodes:    []api.Image(page.Images),
+		PageInfo: &graph.PageInfo{HasNextPage: page.NextPageToken != "", EndCursor: gqlStr(page.NextPageToken)},
+	}, nil
+}
+
+// Image reads an image, which is null if there is no such image or it has
+// expired.
+func (r gqlQuery) Image(ctx context.Context, id string) (*api.Image, error) {
+	fs, err := r.s.storage.Read(ctx, id)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read files %s: %w", id, err)
+	}
+	is, _ := NewImages(fs)
+	if len(is) == 0 || expired(is[0], time.Now()) {
+		return nil, nil
+	}
+
+	return &is[0], nil
+}
+
+func (r gqlQuery) Stats(ctx context.Context) (*graph.Stats, error) {
+	st, err := r.s.imageStats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute stats: %w", err)
+	}
+
+	gs := &graph.Stats{Images: st.Images, Bytes: float64(st.Bytes), ContentTypes: []graph.ContentTypeStats{}, Computed: st.Computed.Format(time.RFC3339Nano)}
+	if l := st.Largest; l != nil {
+		gs.Largest = &graph.LargestImage{ID: l.ID, SizeBytes: int(l.SizeBytes)}
+	}
+	names := []string{}
+	for ct := range st.ContentTypes {
+		names = append(names, ct)
+	}
+	sort.Strings(names)
+	for _, ct := range names {
+		cts := st.ContentTypes[ct]
+		gs.ContentTypes = append(gs.ContentTypes, graph.ContentTypeStats{ContentType: ct, Images: cts.Images, Bytes: float64(cts.Bytes)})
+	}
+
+	return gs, nil
+}
+
+type gqlMutation gqlResolver
+
+func (r gqlMutation) DeleteImage(ctx context.Context, id string) (bool, error) {
+	if err := r.s.trashImage(ctx, id, 0); err != nil {
+		return false, fmt.Errorf("image id: %s: %w", id, err)
+	}
+	r.s.notify(ctx, ImageEvent{Action: actionDeleted, ID: id})
+	return true, nil
+}
+
+// UpdateMetadata replaces the tags of an image if they are given, and sets
+// its caption if that is, removing it if it is given as null.
+func (r gqlMutation) UpdateMetadata(ctx context.Context, id string, tags []string, caption *string) (*api.Image, error) {
+	patch := MetadataPatch{}
+	if gqlGiven(ctx, "tags") {
+		tags = gqlStrings(tags)
+		patch.Tags = &tags
+	}
+	if gqlGiven(ctx, "caption") {
+		c := gqlOptString(caption)
+		patch.Metadata = map[string]*string{captionKey: &c}
+	}
+	img, err := r.s.patchImage(ctx, id, patch)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// captionKey is the metadata key GraphQL keeps an image's caption under.
+const captionKey = "caption"
+
+// gqlImage resolves the fields of an Image that aren't answered as they
+// are kept.
+type gqlImage struct{}
+
+func (gqlImage) OriginalName(_ context.Context, i *api.Image) (*string, error) {
+	return gqlStr(i.OriginalName), nil
+}
+
+func (gqlImage) ContentType(_ context.Context, i *api.Image) (*string, error) {
+	return gqlStr(i.ContentType), nil
+}
+
+func (gqlImage) Created(_ context.Context, i *api.Image) (*string, error) {
+	return gqlTime(i.Created), nil
+}
+
+func (gqlImage) Updated(_ context.Context, i *api.Image) (*string, error) {
+	return gqlTime(i.Updated), nil
+}
+
+func (gqlImage) ThumbnailURL(_ context.Context, i *api.Image) (*string, error) {
+	return gqlStr(i.ThumbnailURL), nil
+}
+
+func (gqlImage) Labels(_ context.Context, i *api.Image) ([]string, error) {
+	return gqlStrings(i.Labels), nil
+}
+
+func (gqlImage) DominantColor(_ context.Context, i *api.Image) (*string, error) {
+	return gqlStr(i.DominantColor), nil
+}
+
+func (gqlImage) BlurHash(_ context.Context, i *api.Image) (*string, error) {
+	return gqlStr(i.BlurHash), nil
+}
+
+func (gqlImage) Tags(_ context.Context, i *api.Image) ([]string, error) {
+	return gqlStrings(i.Tags), nil
+}
+
+func (gqlImage) Caption(_ context.Context, i *api.Image) (*string, error) {
+	return gqlStr(i.Metadata[captionKey]), nil
+}
+
+func (gqlImage) Metadata(_ context.Context, i *api.Image) ([]graph.MetadataEntry, error) {
+	keys := []string{}
+	for k := range i.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := make([]graph.MetadataEntry, len(keys))
+	for n, k := range keys {
+		entries[n] = graph.MetadataEntry{Key: k, Value: i.Metadata[k]}
+	}
+	return entries, nil
+}
+
+func (gqlImage) Expires(_ context.Context, i *api.Image) (*string, error) {
+	if i.Expires == nil {
+		return nil, nil
+	}
+	return gqlTime(*i.Expires), nil
+}
+
+func (gqlImage) Generation(_ context.Context, i *api.Image) (*string, error) {
+	if i.Generation == 0 {
+		return nil, nil
+	}
+	return gqlStr(strconv.FormatInt(i.Generation, 10)), nil
+}
+
+// graphiqlPage is GraphiQL, loaded from a CDN, pointed at /api/v1/graphql.
+const graphiqlPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Scaler GraphQL</title>
+  <link rel="stylesheet" href="https://unpkg.com/graphiql@3/graphiql.min.css">
+</head>
+<body style="margin: 0">
+  <div id="graphiql" style="height: 100vh"></div>
+  <script crossorigin src="https://unpkg.com/react@18/umd/react.production.min.js"></script>
+  <script crossorigin src="https://unpkg.com/react-dom@18/umd/react-dom.production.min.js"></script>
+  <script crossorigin src="https://unpkg.com/graphiql@3/graphiql.min.js"></script>
+  <script>
+    const fetcher = GraphiQL.createFetcher({url: "/api/v1/graphql"});
+    ReactDOM.createRoot(document.getElementById("graphiql")).render(React.createElement(GraphiQL, {fetcher: fetcher}));
+  </script>
+</body>
+</html>
+`
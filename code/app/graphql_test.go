@@ -0,0 +1,317 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gqlResult is a GraphQL response decoded generically.
+type gqlResult struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []GraphQLError         `json:"errors"`
+}
+
+// postGraphQL posts query with vars to server, with key if it is set.
+func postGraphQL(t *testing.T, server *Server, key, query string, vars map[string]interface{}) (*httptest.ResponseRecorder, gqlResult) {
+	t.Helper()
+
+	body, _ := json.Marshal(GraphQLRequest{Query: query, Variables: vars})
+	r := httptest.NewRequest(http.MethodPost, graphqlPath, strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		r.Header.Set(apiKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	res := gqlResult{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w, res
+}
+
+func TestGraphQLImages(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png", "b.png", "c.png"))
+
+	query := `query Page($after: String) {
+		images(first: 2, after: $after) { nodes { id contentType } pageInfo { hasNextPage endCursor } }
+	}`
+	w, res := postGraphQL(t, server, "", query, nil)
+	if w.Code != http.StatusOK || res.Errors != nil {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body)
+	}
+	// Fields come in the order they were selected.
+	if want := `{"data":{"images":{"nodes":[{"id":"a","contentType":"image/png"},{"id":"b","contentType":"image/png"}],"pageInfo":{"hasNextPage":true,"endCursor":`; !strings.HasPrefix(w.Body.String(), want) {
+		t.Fatalf("expected a and b, got: %s", w.Body)
+	}
+
+	cursor := res.Data["images"].(map[string]interface{})["pageInfo"].(map[string]interface{})["endCursor"]
+	_, res = postGraphQL(t, server, "", query, map[string]interface{}{"after": cursor})
+	images := res.Data["images"].(map[string]interface{})
+	if nodes := images["nodes"].([]interface{}); len(nodes) != 1 || nodes[0].(map[string]interface{})["id"] != "c" {
+		t.Fatalf("expected c, got: %v", nodes)
+	}
+	if info := images["pageInfo"].(map[string]interface{}); info["hasNextPage"] != false || info["endCursor"] != nil {
+		t.Fatalf("expected the last page, got: %v", info)
+	}
+
+	w, _ = postGraphQL(t, server, "", `{ images(sort: NAME_DESC, prefix: "") { nodes { id } } }`, nil)
+	if want := `{"data":{"images":{"nodes":[{"id":"c"},{"id":"b"},{"id":"a"}]}}}`; w.Body.String() != want {
+		t.Fatalf("expected: %s, got: %s", want, w.Body)
+	}
+}
+
+func TestGraphQLImage(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	w, _ := postGraphQL(t, server, "", `{
+		a: image(id: "a") { __typename id contentType tags caption ...sizes }
+		missing: image(id: "nope") { id }
+		stats { images bytes contentTypes { contentType images } }
+	}
+	fragment sizes on Image { sizeBytes @include(if: true) height @skip(if: true) }`, nil)
+	var res struct {
+		Data struct {
+			A struct {
+				Typename  string   `json:"__typename"`
+				ID        string   `json:"id"`
+				Type      string   `json:"contentType"`
+				Tags      []string `json:"tags"`
+				Caption   *string  `json:"caption"`
+				SizeBytes int64    `json:"sizeBytes"`
+				Height    *int     `json:"height"`
+			}
+			Missing *struct{}
+			Stats   struct {
+				Images       int
+				ContentTypes []map[string]interface{}
+			}
+		}
+		Errors []GraphQLError
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	a := res.Data.A
+	if a.Typename != "Image" || a.ID != "a" || a.Type != "image/png" || a.Tags == nil || a.Caption != nil || a.SizeBytes == 0 || a.Height != nil {
+		t.Fatalf("expected a, got: %+v", a)
+	}
+	if res.Data.Missing != nil || res.Errors != nil {
+		t.Fatalf("expected a missing image to be null, got: %s", w.Body)
+	}
+	if st := res.Data.Stats; st.Images != 1 || len(st.ContentTypes) != 1 || st.ContentTypes[0]["contentType"] != "image/png" {
+		t.Fatalf("expected one png, got: %+v", st)
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png", "b.png"))
+	server.RequireAPIKey([]string{"secret"}, false)
+
+	update := `mutation($caption: String) { updateMetadata(id: "a", tags: ["Cat", "cat"], caption: $caption) { tags caption } }`
+	if w, _ := postGraphQL(t, server, "", update, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %v, got: %v", http.StatusUnauthorized, w.Code)
+	}
+	if w, res := postGraphQL(t, server, "", `{ image(id: "a") { id } }`, nil); w.Code != http.StatusOK || res.Data["image"] == nil {
+		t.Fatalf("expected queries to need no key, got: %v %s", w.Code, w.Body)
+	}
+
+	w, _ := postGraphQL(t, server, "secret", update, map[string]interface{}{"caption": "On the mat"})
+	if want := `{"data":{"updateMetadata":{"tags":["cat"],"caption":"On the mat"}}}`; w.Body.String() != want {
+		t.Fatalf("expected: %s, got: %s", want, w.Body)
+	}
+	// A null caption removes it.
+	w, _ = postGraphQL(t, server, "secret", update, map[string]interface{}{"caption": nil})
+	if want := `{"data":{"updateMetadata":{"tags":["cat"],"caption":null}}}`; w.Body.String() != want {
+		t.Fatalf("expected: %s, got: %s", want, w.Body)
+	}
+
+	w, _ = postGraphQL(t, server, "secret", `mutation { deleteImage(id: "a") }`, nil)
+	if want := `{"data":{"deleteImage":true}}`; w.Body.String() != want {
+		t.Fatalf("expected: %s, got: %s", want, w.Body)
+	}
+	_, res := postGraphQL(t, server, "", `{ image(id: "a") { id } }`, nil)
+	if res.Data["image"] != nil {
+		t.Fatalf("expected a to be gone, got: %v", res.Data)
+	}
+
+	_, res = postGraphQL(t, server, "secret", `mutation { deleteImage(id: "a") }`, nil)
+	if res.Data != nil || len(res.Errors) != 1 || res.Errors[0].Extensions.Code != codeNotFound || !reflect.DeepEqual(res.Errors[0].Path, []interface{}{"deleteImage"}) {
+		t.Fatalf("expected a not to be found, got: %+v", res)
+	}
+
+	server.SetMode(ModeReadOnly)
+	if w, _ := postGraphQL(t, server, "secret", `mutation { deleteImage(id: "b") }`, nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+	if w, _ := postGraphQL(t, server, "", `{ image(id: "b") { id } }`, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected queries to go on, got: %v", w.Code)
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	tests := map[string]struct {
+		query string
+		ok    bool
+	}{
+		"a page":            {`{ a: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } b: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } c: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } }`, true},
+		"too many pages":    {`{ a: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } b: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } c: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } d: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } }`, false},
+		"a sorted page":     {`{ images(sort: SIZE_DESC) { nodes { id } } stats { images } }`, true},
+		"too many listings": {`{ a: images(sort: SIZE_DESC) { nodes { id } } b: images(sort: UPDATED_ASC) { nodes { id } } stats { images } }`, false},
+		"fragments":         {`{ ...a ...b } fragment a on Query { w: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } x: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } } fragment b on Query { y: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } z: images(first: 1000) { nodes { metadata { key } } pageInfo { hasNextPage } } }`, false},
+		"introspection":     {`{ __schema { types { fields { type { ofType { ofType { ofType { ofType { ofType { ofType { ofType { name } } } } } } } } } } } }`, true},
+		"mutations":         {`mutation { ` + strings.Repeat(`deleteImage(id: "a") `, 101) + `}`, false},
+	}
+	for name, test := range tests {
+		w, res := postGraphQL(t, server, "", test.query, nil)
+		if ok := w.Code == http.StatusOK; ok != test.ok {
+			t.Errorf("%s: expected ok to be %v, got: %v %s", name, test.ok, w.Code, w.Body)
+		}
+		if !test.ok && (res.Data != nil || len(res.Errors) != 1 || res.Errors[0].Extensions.Code != codeInvalidArgument || !strings.Contains(res.Errors[0].Message, "costs")) {
+			t.Errorf("%s: expected the query to cost too much, got: %s", name, w.Body)
+		}
+	}
+
+	depth := gqlMaxDepth
+	defer func() { gqlMaxDepth = depth }()
+	gqlMaxDepth = 3
+	if w, _ := postGraphQL(t, server, "", `{ images { nodes { metadata { key } } } }`, nil); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "nested more than 3 deep") {
+		t.Fatalf("expected the query to be too deep, got: %v %s", w.Code, w.Body)
+	}
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	tests := map[string]struct {
+		query string
+		vars  map[string]interface{}
+		want  string
+	}{
+		"syntax":            {`{ images { nodes { id } }`, nil, "Expected Name, found <EOF>"},
+		"unknown field":     {`{ images { nodes { name } } }`, nil, `Cannot query field "name" on type "Image".`},
+		"no selections":     {`{ images }`, nil, `Field "images" of type "ImageConnection!" must have a selection of subfields.`},
+		"leaf selections":   {`{ image(id: "a") { id { x } } }`, nil, `Field "id" must not have a selection since type "ID" has no subfields.`},
+		"required argument": {`{ image { id } }`, nil, `Field "image" argument "id" of type "ID!" is required, but it was not provided.`},
+		"unknown argument":  {`{ image(id: "a", size: 1) { id } }`, nil, `Unknown argument "size" on field "Query.image".`},
+		"wrong type":        {`{ images(first: "ten") { nodes { id } } }`, nil, `Int cannot represent non-integer value: "ten"`},
+		"bad enum":          {`{ images(sort: SIDEWAYS) { nodes { id } } }`, nil, `Value "SIDEWAYS" does not exist in "ImageSort" enum.`},
+		"missing variable":  {`query($id: ID!) { image(id: $id) { id } }`, nil, `must be defined`},
+		"wrong variable":    {`query($n: Int) { images(first: $n) { nodes { id } } }`, map[string]interface{}{"n": 1.5}, `as Int`},
+		"undeclared":        {`{ image(id: $id) { id } }`, nil, `Variable "$id" is not defined.`},
+		"fragment cycle":    {`{ ...a } fragment a on Query { ...a }`, nil, `Cannot spread fragment "a" within itself.`},
+		"wrong fragment":    {`{ ...a } fragment a on Image { id }`, nil, `Fragment "a" cannot be spread here as objects of type "Query" can never be of type "Image".`},
+		"subscription":      {`subscription { images { nodes { id } } }`, nil, `Schema does not support operation type "subscription"`},
+		"two operations":    {`query a { stats { images } } query b { stats { bytes } }`, nil, `operation  not found`},
+	}
+	for name, test := range tests {
+		w, res := postGraphQL(t, server, "", test.query, test.vars)
+		found := false
+		for _, ge := range res.Errors {
+			found = found || ge.Extensions.Code == codeInvalidArgument && strings.Contains(ge.Message, test.want)
+		}
+		if w.Code != http.StatusBadRequest || !found {
+			t.Errorf("%s: expected %q, got: %v %s", name, test.want, w.Code, w.Body)
+		}
+	}
+
+	// A field that fails is null, and so is what it is in if it can't be.
+	w, res := postGraphQL(t, server, "", `{ image(id: "a") { id } images(after: "???") { nodes { id } } }`, nil)
+	if w.Code != http.StatusOK || res.Data != nil || len(res.Errors) != 1 || res.Errors[0].Extensions.Code != codeInvalidArgument {
+		t.Fatalf("expected the listing to fail, got: %v %s", w.Code, w.Body)
+	}
+	if w.Body.String() != `{"data":null,"errors":[{"message":"invalid after: ???","path":["images"],"extensions":{"code":"invalid_argument"}}]}` {
+		t.Fatalf("expected data to be null, got: %s", w.Body)
+	}
+}
+
+func TestGraphQLIntrospection(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	// What GraphiQL asks for, cut down.
+	_, res := postGraphQL(t, server, "", `query IntrospectionQuery {
+		__schema {
+			queryType { name }
+			mutationType { name }
+			subscriptionType { name }
+			types { ...FullType }
+			directives { name locations args { ...InputValue } }
+		}
+		sort: __type(name: "ImageSort") { kind enumValues(includeDeprecated: true) { name } }
+	}
+	fragment FullType on __Type {
+		kind name description
+		fields(includeDeprecated: true) { name args { ...InputValue } type { ...TypeRef } isDeprecated deprecationReason }
+		inputFields { ...InputValue }
+		interfaces { ...TypeRef }
+		enumValues(includeDeprecated: true) { name isDeprecated }
+		possibleTypes { ...TypeRef }
+	}
+	fragment InputValue on __InputValue { name description type { ...TypeRef } defaultValue }
+	fragment TypeRef on __Type { kind name ofType { kind name ofType { kind name ofType { kind name } } } }`, nil)
+	if res.Errors != nil {
+		t.Fatalf("expected no errors, got: %+v", res.Errors)
+	}
+
+	schema := res.Data["__schema"].(map[string]interface{})
+	if schema["queryType"].(map[string]interface{})["name"] != "Query" || schema["mutationType"].(map[string]interface{})["name"] != "Mutation" || schema["subscriptionType"] != nil {
+		t.Fatalf("expected the roots, got: %v", schema)
+	}
+	types := map[string]map[string]interface{}{}
+	for _, typ := range schema["types"].([]interface{}) {
+		types[typ.(map[string]interface{})["name"].(string)] = typ.(map[string]interface{})
+	}
+	for _, name := range []string{"Query", "Mutation", "Image", "ImageConnection", "Stats", "String", "Int"} {
+		if types[name] == nil {
+			t.Errorf("expected %s in the types", name)
+		}
+	}
+	var images map[string]interface{}
+	for _, f := range types["Query"]["fields"].([]interface{}) {
+		if f.(map[string]interface{})["name"] == "images" {
+			images = f.(map[string]interface{})
+		}
+	}
+	if args := images["args"].([]interface{}); len(args) != 4 || args[0].(map[string]interface{})["defaultValue"] != "100" {
+		t.Fatalf("expected the arguments of images, got: %v", args)
+	}
+	if sort := res.Data["sort"].(map[string]interface{}); sort["kind"] != "ENUM" || len(sort["enumValues"].([]interface{})) != len(gqlSorts) {
+		t.Fatalf("expected ImageSort, got: %v", sort)
+	}
+}
+
+func TestGraphiQL(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, graphqlPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+
+	server.EnableGraphiQL()
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, graphqlPath, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "GraphiQL") {
+		t.Fatalf("expected GraphiQL, got: %v %s", w.Code, w.Body)
+	}
+}
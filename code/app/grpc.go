@@ -0,0 +1,494 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"scalar-attempt/imagepb"
+)
+
+// downloadChunkSize is how many bytes of an image each message of a
+// download carries.
+const downloadChunkSize = 64 << 10
+
+// imageService serves ImageService from the same storage, and through the
+// same code, as the REST handlers.
+type imageService struct {
+	imagepb.UnimplementedImageServiceServer
+	s *Server
+}
+
+// NewGRPCServer returns a gRPC server with ImageService registered. Calls
+// are authenticated, scoped to a tenant and user, held to the mode, traced
+// and counted as requests to the REST API are, going by the settings the
+// Server has when each call is made.
+func (s *Server) NewGRPCServer() *grpc.Server {
+	gs := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.unaryInterceptor),
+		grpc.ChainStreamInterceptor(s.streamInterceptor),
+	)
+	imagepb.RegisterImageServiceServer(gs, &imageService{s: s})
+	return gs
+}
+
+// stopGRPC stops gs once the calls in flight have finished, or cuts them
+// off if they haven't within drain.
+func stopGRPC(gs *grpc.Server, drain time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		gs.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(drain):
+		log.Printf("gRPC calls still running after %s, stopping them", drain)
+		gs.Stop()
+	}
+}
+
+func (s *Server) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var resp interface{}
+	err := s.grpcCall(ctx, info.FullMethod, func(ctx context.Context) error {
+		var err error
+		resp, err = handler(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *Server) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return s.grpcCall(ss.Context(), info.FullMethod, func(ctx context.Context) error {
+		return handler(srv, scopedStream{ss, ctx})
+	})
+}
+
+// scopedStream is a stream whose context has been given what the call is
+// scoped to.
+type scopedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss scopedStream) Context() context.Context {
+	return ss.ctx
+}
+
+// grpcWrites are the methods that change images, which need an API key
+// whether or not reads do, and are turned away while the gallery is
+// read-only.
+var grpcWrites = map[string]bool{
+	"/scaler.v1.ImageService/Delete": true,
+	"/scaler.v1.ImageService/Upload": true,
+}
+
+// grpcCall runs call as the REST middleware would a request: with an id,
+// in a span, within a panic handler, checked against the mode, the API key
+// and the ID token, and scoped to a tenant. Its error is turned into the
+// status with the code matching the HTTP status it would have had, and the
+// call is logged and counted.
+func (s *Server) grpcCall(ctx context.Context, method string, call func(context.Context) error) (err error) {
+	start := time.Now()
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := mdValue(md, strings.ToLower(requestIDHeader))
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+
+	var span trace.Span
+	if s.tracing != nil {
+		ctx = tracePropagator.Extract(ctx, metadataCarrier(md))
+		service, name, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+		ctx, span = s.tracing.Tracer(tracerName).Start(ctx, strings.TrimPrefix(method, "/"),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("rpc.service", service), attribute.String("rpc.method", name)))
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			logJSON(SeverityError, LogEntry{
+				Message: fmt.Sprintf("gRPC : panic serving %s: %v\n%s", method, p, debug.Stack()),
+				Labels:  requestLabels(id),
+			})
+			s.metrics.panicked(method)
+			err = status.Error(codes.Internal, errInternal.Error())
+		}
+
+		code := status.Code(err)
+		if span != nil {
+			span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+			if grpcServerFault(code) {
+				span.SetStatus(otelcodes.Error, status.Convert(err).Message())
+			}
+			span.End()
+		}
+		s.metrics.grpcHandled(method, code, time.Since(start))
+
+		sev := SeverityInfo
+		switch {
+		case code == codes.Canceled:
+			sev = SeverityDebug
+		case grpcServerFault(code):
+			sev = SeverityError
+		case code != codes.OK:
+			sev = SeverityWarning
+		}
+		logJSON(sev, LogEntry{Message: fmt.Sprintf("gRPC %s %s", method, code), Labels: requestLabels(id)})
+	}()
+
+	scoped, err := s.grpcScope(ctx, md, method)
+	if err != nil {
+		return err
+	}
+	return grpcError(call(scoped))
+}
+
+// grpcScope checks a call to method against the mode and whatever the REST
+// API requires of requests, going by the same settings, and returns ctx
+// scoped to the tenant and user it names.
+func (s *Server) grpcScope(ctx context.Context, md metadata.MD, method string) (context.Context, error) {
+	switch s.Mode() {
+	case ModeMaintenance:
+		return nil, status.Error(codes.Unavailable, ErrMaintenance.Error())
+	case ModeReadOnly:
+		if grpcWrites[method] {
+			return nil, status.Error(codes.Unavailable, ErrReadOnly.Error())
+		}
+	}
+
+	if s.validKey != nil && (s.keyForReads || grpcWrites[method]) {
+		if key := mdValue(md, strings.ToLower(apiKeyHeader)); key == "" || !s.validKey(key) {
+			return nil, status.Error(codes.Unauthenticated, ErrUnauthorized.Error())
+		}
+	}
+
+	if s.firebase != nil {
+		auth := mdValue(md, "authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || token == "" {
+			return nil, status.Error(codes.Unauthenticated, ErrUnauthenticated.Error())
+		}
+		uid, err := s.firebase.Verify(ctx, token)
+		if err != nil {
+			logJSON(SeverityInfo, LogEntry{Message: fmt.Sprintf("rejected ID token: %v", err)})
+			return nil, status.Error(codes.Unauthenticated, ErrUnauthenticated.Error())
+		}
+		ctx = withUser(ctx, uid)
+	}
+
+	if len(s.tenants) > 0 {
+		tenant := mdValue(md, strings.ToLower(tenantHeader))
+		known := false
+		for _, t := range s.tenants {
+			known = known || t == tenant
+		}
+		if !known {
+			return nil, status.Errorf(codes.NotFound, "%s %q: name one in the %s metadata", ErrUnknownTenant, tenant, strings.ToLower(tenantHeader))
+		}
+		ctx = withTenant(ctx, tenant)
+	}
+
+	return ctx, nil
+}
+
+// mdValue is the first value of key in md, if it has one.
+func mdValue(md metadata.MD, key string) string {
+	if vs := md.Get(key); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// metadataCarrier lets trace context be read from gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	return mdValue(metadata.MD(c), key)
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// grpcError is err as a gRPC status, its code the one matching the HTTP
+// status the REST API answers it with. Errors that already are a status
+// are left as they are.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus().Err()
+	}
+
+	var ae *apiError
+	errors.As(classify(err), &ae)
+	return status.Error(grpcCode(ae.Code), ae.Error())
+}
+
+// grpcCode is the canonical gRPC code for an error body's code.
+func grpcCode(code string) codes.Code {
+	switch code {
+	case codeInvalidArgument, codeUnsupportedType, codeUnprocessable:
+		return codes.InvalidArgument
+	case codeNotFound, codeGone:
+		return codes.NotFound
+	case codeConflict:
+		return codes.AlreadyExists
+	case codePrecondition:
+		return codes.FailedPrecondition
+	case codeTooLarge:
+		return codes.ResourceExhausted
+	case codeInternal:
+		return codes.Internal
+	case codeUnimplemented:
+		return codes.Unimplemented
+	case codeUpstream, codeUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Unknown
+	}
+}
+
+// grpcServerFault reports whether a call that ended with code failed on the
+// server's account rather than the caller's.
+func grpcServerFault(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// uploadFailed is the error for an upload storeFile turned down with
+// status.
+func uploadFailed(status int, err error) error {
+	return &apiError{Status: status, Code: errorCode(status), Err: err}
+}
+
+func (g *imageService) List(ctx context.Context, req *imagepb.ListRequest) (*imagepb.ListResponse, error) {
+	limit := int(req.PageSize)
+	switch {
+	case limit < 0:
+		return nil, invalidArgument(fmt.Errorf("invalid page_size, want a positive integer got: %d", limit))
+	case limit == 0:
+		limit = defaultPageSize
+	case limit > maxPageSize:
+		limit = maxPageSize
+	}
+
+	page, err := g.s.storageList(ctx, req.Prefix, limit, req.PageToken)
+	if err == ErrInvalidPageToken {
+		return nil, invalidArgument(fmt.Errorf("invalid page_token: %s", req.PageToken))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &imagepb.ListResponse{NextPageToken: page.NextPageToken}
+	for _, img := range page.Images {
+		resp.Images = append(resp.Images, protoImage(img))
+	}
+	return resp, nil
+}
+
+func (g *imageService) Get(ctx context.Context, req *imagepb.GetRequest) (*imagepb.Image, error) {
+	fs, err := g.s.storage.Read(ctx, req.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read files %s: %w", req.Id, err)
+	}
+	is, _ := NewImages(fs)
+	if len(is) < 1 {
+		return nil, fmt.Errorf("image id: %s: %w", req.Id, ErrNotFound)
+	}
+	if expired(is[0], time.Now()) {
+		return nil, fmt.Errorf("image id: %s expired at %s: %w", req.Id, is[0].Expires.Format(time.RFC3339), ErrExpired)
+	}
+
+	return protoImage(is[0]), nil
+}
+
+func (g *imageService) Delete(ctx context.Context, req *imagepb.DeleteRequest) (*imagepb.DeleteResponse, error) {
+	remove := g.s.trashImage
+	if req.Hard {
+		remove = g.s.deleteImage
+	}
+	if err := remove(ctx, req.Id, req.Generation); err != nil {
+		return nil, fmt.Errorf("image id: %s: %w", req.Id, err)
+	}
+	g.s.notify(ctx, ImageEvent{Action: actionDeleted, ID: req.Id})
+
+	return &imagepb.DeleteResponse{}, nil
+}
+
+func (g *imageService) Upload(stream imagepb.ImageService_UploadServer) error {
+	ctx := stream.Context()
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return invalidArgument(errors.New("an upload starts with its UploadInfo"))
+	}
+	if err != nil {
+		return err
+	}
+	info := req.GetInfo()
+	if info == nil {
+		return invalidArgument(errors.New("an upload starts with its UploadInfo"))
+	}
+
+	um := userMetadata{Meta: map[string]string{}}
+	if err := um.setTTL(info.Ttl); err != nil {
+		return invalidArgument(err)
+	}
+	if um.Tags, err = normalizeTags(info.Tags); err != nil {
+		return invalidArgument(err)
+	}
+	keys := make([]string, 0, len(info.Metadata))
+	for k := range info.Metadata {
+		keys = append(keys, k)
+	}
+	// Sorted, so that going over the limit is reported the same way each
+	// time.
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := um.setMeta(k, info.Metadata[k]); err != nil {
+			return invalidArgument(err)
+		}
+	}
+
+	f, err := g.s.stageFile(ctx, &uploadChunks{stream: stream}, info.ContentType, maxUploadBytes)
+	if err != nil {
+		return err
+	}
+	defer f.drop()
+
+	img, status, err := g.s.storeFile(ctx, info.Filename, info.ContentType, f, uploadOptions{Overwrite: info.Overwrite, Force: info.Force, Metadata: um})
+	if err != nil {
+		return uploadFailed(status, err)
+	}
+	return stream.SendAndClose(protoImage(img))
+}
+
+// uploadChunks reads the bytes of an upload from the messages after its
+// UploadInfo.
+type uploadChunks struct {
+	stream imagepb.ImageService_UploadServer
+	buf    []byte
+}
+
+func (u *uploadChunks) Read(p []byte) (int, error) {
+	for len(u.buf) == 0 {
+		req, err := u.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if req.GetInfo() != nil {
+			return 0, invalidArgument(errors.New("an upload has only the one UploadInfo"))
+		}
+		u.buf = req.GetChunk()
+	}
+
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	return n, nil
+}
+
+func (g *imageService) Download(req *imagepb.DownloadRequest, stream imagepb.ImageService_DownloadServer) error {
+	obj, err := g.s.storage.Open(stream.Context(), req.Id)
+	if err != nil {
+		return fmt.Errorf("failed to open image %s: %w", req.Id, err)
+	}
+	defer obj.Close()
+
+	// The first message goes even if the image is empty, as it says what
+	// the image is.
+	resp := &imagepb.DownloadResponse{ContentType: obj.ContentType, SizeBytes: obj.Size}
+	for sent := false; ; sent = true {
+		buf := make([]byte, downloadChunkSize)
+		n, err := io.ReadFull(obj, buf)
+		if n > 0 || !sent {
+			resp.Chunk = buf[:n]
+			if serr := stream.Send(resp); serr != nil {
+				return serr
+			}
+			resp = &imagepb.DownloadResponse{}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error streaming %s: %w", req.Id, err)
+		}
+	}
+}
+
+// protoImage is img as ImageService sends it.
+func protoImage(img Image) *imagepb.Image {
+	p := &imagepb.Image{
+		Id:           img.ID,
+		OriginalName: img.OriginalName,
+		ContentType:  img.ContentType,
+		SizeBytes:    img.SizeBytes,
+		Width:        int32(img.Width),
+		Height:       int32(img.Height),
+		Labels:       img.Labels,
+		Tags:         img.Tags,
+		Metadata:     img.Metadata,
+		Md5:          img.MD5,
+		Crc32C:       img.CRC32C,
+		Generation:   img.Generation,
+		Etag:         img.ETag,
+	}
+	if !img.Created.IsZero() {
+		p.Created = timestamppb.New(img.Created)
+	}
+	if !img.Updated.IsZero() {
+		p.Updated = timestamppb.New(img.Updated)
+	}
+	if img.Expires != nil {
+		p.Expires = timestamppb.New(*img.Expires)
+	}
+
+	return p
+}
@@ -0,0 +1,264 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"scalar-attempt/imagepb"
+)
+
+// dialGRPC serves server over gRPC in memory and returns a client of it.
+func dialGRPC(t *testing.T, server *Server) imagepb.ImageServiceClient {
+	t.Helper()
+
+	ln := bufconn.Listen(1 << 20)
+	gs := server.NewGRPCServer()
+	go gs.Serve(ln)
+	t.Cleanup(func() { stopGRPC(gs, time.Second) })
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return imagepb.NewImageServiceClient(conn)
+}
+
+// upload sends content over client as info says, in small chunks. A send
+// fails with io.EOF once the server has given up on the upload, whose
+// status then comes with the response.
+func upload(ctx context.Context, client imagepb.ImageServiceClient, info *imagepb.UploadInfo, content []byte) (*imagepb.Image, error) {
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&imagepb.UploadRequest{Data: &imagepb.UploadRequest_Info{Info: info}})
+	for err == nil && len(content) > 0 {
+		n := 100
+		if n > len(content) {
+			n = len(content)
+		}
+		err = stream.Send(&imagepb.UploadRequest{Data: &imagepb.UploadRequest_Chunk{Chunk: content[:n]}})
+		content = content[n:]
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestGRPCImageService(t *testing.T) {
+	client := dialGRPC(t, NewServer(NewMemoryStorage()))
+	ctx := context.Background()
+	png := testPNG(t)
+
+	img, err := upload(ctx, client, &imagepb.UploadInfo{
+		Filename: "a.png", ContentType: "image/png", Tags: []string{"Cat"}, Metadata: map[string]string{"camera": "x100"},
+	}, png)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if img.Id != "a" || img.ContentType != "image/png" || len(img.Tags) != 1 || img.Tags[0] != "cat" || img.Metadata["camera"] != "x100" {
+		t.Fatalf("expected a to be stored, got: %+v", img)
+	}
+
+	got, err := client.Get(ctx, &imagepb.GetRequest{Id: "a"})
+	if err != nil || got.Id != "a" || got.Width == 0 || got.Created == nil {
+		t.Fatalf("expected a, got: %+v %v", got, err)
+	}
+
+	page, err := client.List(ctx, &imagepb.ListRequest{PageSize: 10})
+	if err != nil || len(page.Images) != 1 || page.Images[0].Id != "a" {
+		t.Fatalf("expected a to be listed, got: %+v %v", page, err)
+	}
+
+	stream, err := client.Download(ctx, &imagepb.DownloadRequest{Id: "a"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	var content []byte
+	for i := 0; ; i++ {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if i == 0 && (resp.ContentType != "image/png" || resp.SizeBytes != int64(len(png))) {
+			t.Fatalf("expected the first response to say what the image is, got: %+v", resp)
+		}
+		content = append(content, resp.Chunk...)
+	}
+	if !bytes.Equal(content, png) {
+		t.Fatalf("expected the original, got %d bytes", len(content))
+	}
+
+	if _, err := client.Delete(ctx, &imagepb.DeleteRequest{Id: "a", Hard: true}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := client.Get(ctx, &imagepb.GetRequest{Id: "a"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected: %v, got: %v", codes.NotFound, err)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	client := dialGRPC(t, NewServer(newTestMemoryStorage(t, "a.png")))
+	ctx := context.Background()
+
+	tests := map[string]struct {
+		call func() error
+		code codes.Code
+	}{
+		"missing": {func() error {
+			_, err := client.Get(ctx, &imagepb.GetRequest{Id: "nope"})
+			return err
+		}, codes.NotFound},
+		"bad page token": {func() error {
+			_, err := client.List(ctx, &imagepb.ListRequest{PageToken: "???"})
+			return err
+		}, codes.InvalidArgument},
+		"no info": {func() error {
+			stream, _ := client.Upload(ctx)
+			stream.Send(&imagepb.UploadRequest{Data: &imagepb.UploadRequest_Chunk{Chunk: []byte("x")}})
+			_, err := stream.CloseAndRecv()
+			return err
+		}, codes.InvalidArgument},
+		"not an image": {func() error {
+			_, err := upload(ctx, client, &imagepb.UploadInfo{Filename: "b.png", ContentType: "image/png"}, []byte("hello"))
+			return err
+		}, codes.InvalidArgument},
+		"bad ttl": {func() error {
+			_, err := upload(ctx, client, &imagepb.UploadInfo{Filename: "b.png", Ttl: "soon"}, testPNG(t))
+			return err
+		}, codes.InvalidArgument},
+		"exists": {func() error {
+			_, err := upload(ctx, client, &imagepb.UploadInfo{Filename: "a.png", ContentType: "image/png", Force: true}, testPNG(t))
+			return err
+		}, codes.AlreadyExists},
+		"changed since": {func() error {
+			_, err := client.Delete(ctx, &imagepb.DeleteRequest{Id: "a", Generation: 12345})
+			return err
+		}, codes.FailedPrecondition},
+	}
+	for name, test := range tests {
+		if err := test.call(); status.Code(err) != test.code {
+			t.Errorf("%s: expected: %v, got: %v", name, test.code, err)
+		}
+	}
+}
+
+func TestGRPCCode(t *testing.T) {
+	// Every code an error body can have matches the HTTP status it comes
+	// with.
+	for status, want := range map[int]codes.Code{
+		http.StatusBadRequest:            codes.InvalidArgument,
+		http.StatusNotFound:              codes.NotFound,
+		http.StatusGone:                  codes.NotFound,
+		http.StatusConflict:              codes.AlreadyExists,
+		http.StatusPreconditionFailed:    codes.FailedPrecondition,
+		http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+		http.StatusUnsupportedMediaType:  codes.InvalidArgument,
+		http.StatusUnprocessableEntity:   codes.InvalidArgument,
+		http.StatusInternalServerError:   codes.Internal,
+		http.StatusNotImplemented:        codes.Unimplemented,
+		http.StatusBadGateway:            codes.Unavailable,
+		http.StatusServiceUnavailable:    codes.Unavailable,
+	} {
+		if got := grpcCode(errorCode(status)); got != want {
+			t.Errorf("%d: expected: %v, got: %v", status, want, got)
+		}
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png", "b.png"))
+	server.RequireAPIKey([]string{"secret"}, false)
+	client := dialGRPC(t, server)
+	ctx := context.Background()
+
+	if _, err := client.Get(ctx, &imagepb.GetRequest{Id: "a"}); err != nil {
+		t.Fatalf("expected reads to need no key, got: %v", err)
+	}
+	if _, err := client.Delete(ctx, &imagepb.DeleteRequest{Id: "a"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected: %v, got: %v", codes.Unauthenticated, err)
+	}
+	keyed := metadata.AppendToOutgoingContext(ctx, "x-api-key", "secret")
+	if _, err := client.Delete(keyed, &imagepb.DeleteRequest{Id: "a"}); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	server.SetMode(ModeReadOnly)
+	if _, err := client.Delete(keyed, &imagepb.DeleteRequest{Id: "b"}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected: %v, got: %v", codes.Unavailable, err)
+	}
+	if _, err := client.Get(ctx, &imagepb.GetRequest{Id: "b"}); err != nil {
+		t.Fatalf("expected reads to go on, got: %v", err)
+	}
+}
+
+func TestGRPCTenants(t *testing.T) {
+	server := NewServer(NewTenantStorage(map[string]Storage{"acme": newTestMemoryStorage(t, "a.png"), "globex": NewMemoryStorage()}, nil))
+	server.ServeTenants([]string{"acme", "globex"})
+	client := dialGRPC(t, server)
+
+	for tenant, want := range map[string]codes.Code{"acme": codes.OK, "globex": codes.NotFound, "initech": codes.NotFound} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", tenant)
+		if _, err := client.Get(ctx, &imagepb.GetRequest{Id: "a"}); status.Code(err) != want {
+			t.Errorf("%s: expected: %v, got: %v", tenant, want, err)
+		}
+	}
+}
+
+func TestGRPCMetrics(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	server.EnableMetrics(NewMetrics())
+	client := dialGRPC(t, server)
+
+	client.Get(context.Background(), &imagepb.GetRequest{Id: "a"})
+	client.Get(context.Background(), &imagepb.GetRequest{Id: "nope"})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`scaler_grpc_requests_total{code="OK",method="/scaler.v1.ImageService/Get"} 1`,
+		`scaler_grpc_requests_total{code="NotFound",method="/scaler.v1.ImageService/Get"} 1`,
+		`scaler_grpc_request_duration_seconds_count{method="/scaler.v1.ImageService/Get"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expected %s in the metrics", want)
+		}
+	}
+}
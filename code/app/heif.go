@@ -0,0 +1,196 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heifTimeout bounds how long a converter can take over one upload.
+const heifTimeout = 60 * time.Second
+
+// originalFormatKey is the metadata the type an upload was converted from
+// is kept in.
+const originalFormatKey = "originalFormat"
+
+// The types of HEIF image that are converted to JPEG as they are uploaded.
+const (
+	mimeHEIC = "image/heic"
+	mimeHEIF = "image/heif"
+)
+
+// errHEIFDisabled turns away HEIC and HEIF uploads when there is nothing
+// to convert them with.
+var errHEIFDisabled = errors.New("HEIC and HEIF uploads aren't supported: HEIF conversion isn't enabled on this server")
+
+// heifBrands maps the major brands of the HEIF files that hold a still
+// image to their type. Sequences, and formats built on HEIF such as AVIF,
+// aren't among them.
+var heifBrands = map[string]string{
+	"heic": mimeHEIC,
+	"heix": mimeHEIC,
+	"heim": mimeHEIC,
+	"heis": mimeHEIC,
+	"mif1": mimeHEIF,
+}
+
+// sniffHEIF returns the type of HEIF image head, the start of a file, is,
+// or "" if it isn't one: its file type box names the brand.
+func sniffHEIF(head []byte) string {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return ""
+	}
+	return heifBrands[string(head[8:12])]
+}
+
+// isHEIF reports whether contentType is one converted from.
+func isHEIF(contentType string) bool {
+	return contentType == mimeHEIC || contentType == mimeHEIF
+}
+
+// HEIFConverter transcodes HEIC and HEIF images, which browsers can't show,
+// to JPEG.
+type HEIFConverter interface {
+	ConvertHEIF(ctx context.Context, r io.Reader) ([]byte, error)
+}
+
+// SetHEIFConverter has HEIC and HEIF uploads converted to JPEG with c and
+// stored as that. Without one they are turned away.
+func (s *Server) SetHEIFConverter(c HEIFConverter) {
+	s.heif = c
+}
+
+// CommandConverter converts with a program run as `Path -q Quality in out`,
+// such as libheif's heif-convert.
+type CommandConverter struct {
+	Path    string
+	Quality int
+}
+
+// NewCommandConverter returns a CommandConverter for the program at path,
+// or by that name on the PATH.
+func NewCommandConverter(path string) (*CommandConverter, error) {
+	p, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not find %s: %w", path, err)
+	}
+
+	return &CommandConverter{Path: p, Quality: defaultQuality}, nil
+}
+
+// ConvertHEIF writes r to a file for the program to convert, and returns the
+// JPEG it writes.
+func (c *CommandConverter) ConvertHEIF(ctx context.Context, r io.Reader) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "heif")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in.heic"), filepath.Join(dir, "out.jpg")
+	f, err := os.Create(in)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Path, "-q", strconv.Itoa(c.Quality), in, out)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	return os.ReadFile(out)
+}
+
+// checkDeclaredType checks an upload's declared type before its content is
+// seen: it must be allowed, or HEIC or HEIF with a converter to take it.
+func (s *Server) checkDeclaredType(contentType string) error {
+	switch {
+	case allowedMimeTypes.Valid(contentType):
+		return nil
+	case isHEIF(contentType) && s.heif == nil:
+		return errHEIFDisabled
+	case isHEIF(contentType):
+		return nil
+	default:
+		return fmt.Errorf("%q is not an allowed type", contentType)
+	}
+}
+
+// jpegName is name with the extension of the JPEG it is converted to.
+func jpegName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg"
+}
+
+// convertHEIF converts file to a JPEG if it is a HEIC or HEIF image, and
+// returns it with the type it was, or as it is with "" for anything else.
+// On failure it returns the status to respond with. file is rewound so it
+// can be read again from the start.
+func (s *Server) convertHEIF(ctx context.Context, file multipart.File, declared string) (multipart.File, string, int, error) {
+	head := make([]byte, 12)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, "", http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, "", http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+
+	detected := sniffHEIF(head[:n])
+	if detected == "" {
+		return file, "", http.StatusOK, nil
+	}
+	if s.heif == nil {
+		return nil, "", http.StatusUnsupportedMediaType, errHEIFDisabled
+	}
+	if !isHEIF(declared) {
+		return nil, "", http.StatusUnsupportedMediaType, fmt.Errorf("declared type %s does not match detected type %s", declared, detected)
+	}
+
+	ctx, span := startSpan(ctx, "convertHEIF")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, heifTimeout)
+	defer cancel()
+
+	data, err := s.heif.ConvertHEIF(ctx, file)
+	if err != nil {
+		return nil, "", http.StatusUnprocessableEntity, fmt.Errorf("could not convert %s image: %v", detected, err)
+	}
+
+	return newMemoryFile(data), detected, http.StatusOK, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testHEIC is enough of a HEIC file to be sniffed as one.
+var testHEIC = append([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), make([]byte, 64)...)
+
+// fakeConverter converts anything to jpeg, or fails with err.
+type fakeConverter struct {
+	jpeg []byte
+	err  error
+}
+
+func (c fakeConverter) ConvertHEIF(ctx context.Context, r io.Reader) ([]byte, error) {
+	if _, err := io.ReadAll(r); err != nil {
+		return nil, err
+	}
+	return c.jpeg, c.err
+}
+
+func TestSniffHEIF(t *testing.T) {
+	for name, c := range map[string]struct {
+		head []byte
+		want string
+	}{
+		"heic":  {testHEIC, mimeHEIC},
+		"heif":  {[]byte("\x00\x00\x00\x18ftypmif1"), mimeHEIF},
+		"avif":  {[]byte("\x00\x00\x00\x18ftypavif"), ""},
+		"png":   {testPNG(t), ""},
+		"short": {[]byte("ftyp"), ""},
+	} {
+		if got := sniffHEIF(c.head); got != c.want {
+			t.Errorf("%s: expected: %q, got: %q", name, c.want, got)
+		}
+	}
+}
+
+func TestHEIFUpload(t *testing.T) {
+	ms := NewMemoryStorage()
+	server := NewServer(ms)
+	jpeg, _ := reexported(t, 80)
+
+	// Without a converter, HEIC is turned away saying so.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "IMG_0001.heic", mimeHEIC, testHEIC))
+	if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), "HEIF conversion isn't enabled") {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+	}
+
+	server.SetHEIFConverter(fakeConverter{jpeg: jpeg})
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "IMG_0001.heic", mimeHEIC, testHEIC))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var img Image
+	json.Unmarshal(w.Body.Bytes(), &img)
+	if img.ID != "IMG_0001" || img.ContentType != "image/jpeg" || img.OriginalName != "IMG_0001.heic" || img.OriginalFormat != mimeHEIC {
+		t.Fatalf("expected a JPEG converted from IMG_0001.heic, got: %+v", img)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/IMG_0001/content", nil))
+	if !bytes.Equal(w.Body.Bytes(), jpeg) {
+		t.Fatalf("expected the converted JPEG, got: %v %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// Declared as something else, it is as much a mismatch as ever.
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "other.png", "image/png", testHEIC))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+	}
+
+	server.SetHEIFConverter(fakeConverter{err: errors.New("bad file")})
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "broken.heic", mimeHEIC, testHEIC))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+}
+
+func TestHEIFUpdate(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	jpeg, _ := reexported(t, 80)
+	server.SetHEIFConverter(fakeConverter{jpeg: jpeg})
+
+	// An update goes through the same steps as an upload, and keeps the id.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPut, "/api/v1/image/a", "IMG_0002.heic", mimeHEIC, testHEIC))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil))
+	var img Image
+	json.Unmarshal(w.Body.Bytes(), &img)
+	if img.ContentType != "image/jpeg" || img.OriginalName != "IMG_0002.heic" || img.OriginalFormat != mimeHEIC {
+		t.Fatalf("expected a JPEG converted from IMG_0002.heic, got: %+v", img)
+	}
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a/content", nil))
+	if !bytes.Equal(w.Body.Bytes(), jpeg) {
+		t.Fatalf("expected the converted JPEG, got: %v %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestHEIFRawUpload(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newRawPutRequest("/api/v1/image/photo", mimeHEIC, testHEIC))
+	if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), "HEIF conversion isn't enabled") {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+	}
+
+	jpeg, _ := reexported(t, 80)
+	server.SetHEIFConverter(fakeConverter{jpeg: jpeg})
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newRawPutRequest("/api/v1/image/photo", mimeHEIC, testHEIC))
+	var img Image
+	json.Unmarshal(w.Body.Bytes(), &img)
+	if w.Code != http.StatusCreated || img.ContentType != "image/jpeg" || img.OriginalFormat != mimeHEIC {
+		t.Fatalf("expected a converted JPEG, got: %v %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCommandConverter(t *testing.T) {
+	jpeg, _ := reexported(t, 80)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "converted.jpg")
+	if err := os.WriteFile(src, jpeg, 0o644); err != nil {
+		t.Fatalf("could not write test image: %s", err)
+	}
+	// Stands in for heif-convert: -q 85 in out.
+	script := filepath.Join(dir, "heif-convert")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n[ \"$1\" = -q ] && [ -s \"$3\" ] && cp "+src+" \"$4\"\n"), 0o755); err != nil {
+		t.Fatalf("could not write test script: %s", err)
+	}
+
+	c, err := NewCommandConverter(script)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	got, err := c.ConvertHEIF(context.Background(), bytes.NewReader(testHEIC))
+	if err != nil || !bytes.Equal(got, jpeg) {
+		t.Fatalf("expected the JPEG, got: %d bytes, %v", len(got), err)
+	}
+	if _, err := c.ConvertHEIF(context.Background(), bytes.NewReader(nil)); err == nil {
+		t.Fatalf("expected an error for a failed conversion")
+	}
+
+	if _, err := NewCommandConverter(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("expected an error for a missing program")
+	}
+}
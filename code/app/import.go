@@ -0,0 +1,226 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Limits on what one import can hold, set from MAX_IMPORT_ENTRIES and
+// MAX_IMPORT_BYTES. The byte limit applies to the archive as uploaded and
+// to what it holds uncompressed, so a zip bomb is turned down before any of
+// it is extracted.
+var (
+	maxImportEntries       = 1000
+	maxImportBytes   int64 = 256 << 20
+)
+
+// importHandler stores every image in an uploaded zip, answering with the
+// outcome for each entry, as for an upload of several files. Entries are
+// checked by their content, not their extension. They are stored under
+// their base name, or with preservePaths under their whole path, which
+// keeps the folders they were in.
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > maxImportBytes {
+		writeError(w, tooLarge(fmt.Errorf("upload too large, limit is %d bytes", maxImportBytes)))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	archive, err := s.stageArchive(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer archive.drop()
+
+	zr, err := zip.NewReader(archive, archive.size)
+	if err != nil {
+		writeError(w, invalidArgument(fmt.Errorf("invalid zip archive: %s", err)))
+		return
+	}
+
+	entries, err := importEntries(zr)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	opts := uploadOptions{
+		Overwrite: r.URL.Query().Get("overwrite") == "true",
+		Force:     r.URL.Query().Get("force") == "true",
+		KeepExif:  r.URL.Query().Get("keepExif") == "true",
+	}
+	preservePaths := r.URL.Query().Get("preservePaths") == "true"
+
+	results := UploadResults{}
+	status := http.StatusCreated
+	for _, f := range entries {
+		img, code, err := s.importEntry(r.Context(), f, preservePaths, opts)
+		res := UploadResult{Name: f.Name, Status: code}
+		if err != nil {
+			res.Error = err.Error()
+			status = http.StatusOK
+		} else {
+			res.Image = &img
+		}
+		results = append(results, res)
+	}
+
+	writeJSON(w, results, status)
+}
+
+// stageArchive copies the first file in the form of r to a staging object,
+// which the caller must drop.
+func (s *Server) stageArchive(r *http.Request) (*stagedFile, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, uploadReadError(err)
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, invalidArgument(errors.New("error retrieving file: no file in the form"))
+		}
+		if err != nil {
+			return nil, uploadReadError(err)
+		}
+		if part.FileName() == "" {
+			continue
+		}
+
+		f, err := s.stageFile(r.Context(), part, "application/zip", maxImportBytes)
+		if err != nil {
+			var ae *apiError
+			if !errors.As(err, &ae) {
+				err = uploadReadError(err)
+			}
+			return nil, err
+		}
+		return f, nil
+	}
+}
+
+// importEntries returns the files in zr, leaving out folders and the
+// resource forks macOS adds, once it has checked that there aren't too
+// many of them and that they don't add up to too much.
+func importEntries(zr *zip.Reader) ([]*zip.File, error) {
+	entries := []*zip.File{}
+	var total uint64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		entries = append(entries, f)
+		total += f.UncompressedSize64
+	}
+
+	if len(entries) == 0 {
+		return nil, invalidArgument(errors.New("archive has no files in it"))
+	}
+	if len(entries) > maxImportEntries {
+		return nil, tooLarge(fmt.Errorf("archive has %d files, limit is %d", len(entries), maxImportEntries))
+	}
+	if total > uint64(maxImportBytes) {
+		return nil, tooLarge(fmt.Errorf("archive holds %d bytes, limit is %d bytes", total, maxImportBytes))
+	}
+
+	return entries, nil
+}
+
+// importEntry stores the file f holds. On failure it returns the status to
+// respond with.
+func (s *Server) importEntry(ctx context.Context, f *zip.File, preservePaths bool, opts uploadOptions) (Image, int, error) {
+	name, err := importName(f.Name, preservePaths)
+	if err != nil {
+		return Image{}, http.StatusBadRequest, err
+	}
+	if f.UncompressedSize64 > uint64(maxUploadBytes) {
+		return Image{}, http.StatusRequestEntityTooLarge, fmt.Errorf("upload too large, limit is %d bytes", maxUploadBytes)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return Image{}, http.StatusBadRequest, fmt.Errorf("could not read %s: %s", f.Name, err)
+	}
+	defer rc.Close()
+
+	// The reader fails if the entry holds more than it says it does.
+	data, err := io.ReadAll(io.LimitReader(rc, int64(f.UncompressedSize64)+1))
+	if err != nil {
+		return Image{}, http.StatusBadRequest, fmt.Errorf("could not read %s: %s", f.Name, err)
+	}
+	file := newMemoryFile(data)
+
+	// The archive says nothing of the type of an entry, so it goes by what
+	// the entry holds.
+	declared, err := sniffMimeType(file)
+	if err != nil {
+		return Image{}, http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+
+	return s.storeObject(ctx, objectName(name), name, declared, file, opts)
+}
+
+// importName is the name an entry called entry is stored under: its base
+// name, or with preservePaths its whole path, with each part of it
+// sanitized as a filename would be. Paths that are absolute or climb out of
+// the archive are turned down.
+func importName(entry string, preservePaths bool) (string, error) {
+	p := strings.ReplaceAll(entry, "\\", "/")
+	if strings.HasPrefix(p, "/") || (len(p) > 1 && p[1] == ':') {
+		return "", fmt.Errorf("invalid entry %q: paths can't be absolute", entry)
+	}
+
+	parts := []string{}
+	for _, part := range strings.Split(p, "/") {
+		switch part {
+		case "..":
+			return "", fmt.Errorf("invalid entry %q: paths can't leave the archive", entry)
+		case "", ".":
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("invalid entry %q: want a name", entry)
+	}
+
+	base, err := sanitizeFilename(parts[len(parts)-1])
+	if err != nil {
+		return "", err
+	}
+	if !preservePaths {
+		return base, nil
+	}
+
+	// Folders are cleaned up the same way, but don't need an extension.
+	dirs := parts[:len(parts)-1]
+	for i, dir := range dirs {
+		dirs[i] = cleanName(dir)
+		if strings.Trim(dirs[i], ".") == "" || len(dirs[i]) > maxFilenameLength {
+			return "", fmt.Errorf("invalid entry %q: invalid folder %q", entry, dir)
+		}
+	}
+
+	return strings.Join(append(dirs, base), "/"), nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testZip is a zip with an entry for each name in order, holding the
+// content in entries.
+func testZip(t *testing.T, names []string, entries map[string][]byte) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("could not create %s: %s", name, err)
+		}
+		f.Write(entries[name])
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("could not close zip: %s", err)
+	}
+
+	return b.Bytes()
+}
+
+func importRequest(t *testing.T, query string, archive []byte) *http.Request {
+	return newMultipartRequest(t, http.MethodPost, "/api/v1/import"+query, testPart{"archive", "images.zip", "application/zip", archive})
+}
+
+func TestImport(t *testing.T) {
+	png := testPNG(t)
+	names := []string{"trip/", "trip/beach.png", "trip/day2/sunset.png", "../evil.png", "/etc/abs.png", "notes.txt", "__MACOSX/trip/._beach.png"}
+	entries := map[string][]byte{
+		"trip/beach.png":            png,
+		"trip/day2/sunset.png":      append(append([]byte{}, png...), 0),
+		"../evil.png":               png,
+		"/etc/abs.png":              png,
+		"notes.txt":                 []byte("not an image"),
+		"__MACOSX/trip/._beach.png": []byte("fork"),
+	}
+	archive := testZip(t, names, entries)
+
+	type test struct {
+		query string
+		want  map[string]int
+		ids   []string
+	}
+
+	tests := []test{
+		{
+			query: "",
+			want: map[string]int{
+				"trip/beach.png": http.StatusCreated, "trip/day2/sunset.png": http.StatusCreated,
+				"../evil.png": http.StatusBadRequest, "/etc/abs.png": http.StatusBadRequest,
+				"notes.txt": http.StatusUnsupportedMediaType,
+			},
+			ids: []string{"beach", "sunset"},
+		},
+		{
+			query: "?preservePaths=true",
+			want: map[string]int{
+				"trip/beach.png": http.StatusCreated, "trip/day2/sunset.png": http.StatusCreated,
+				"../evil.png": http.StatusBadRequest, "/etc/abs.png": http.StatusBadRequest,
+				"notes.txt": http.StatusUnsupportedMediaType,
+			},
+			ids: []string{"trip/beach", "trip/day2/sunset"},
+		},
+	}
+
+	for _, c := range tests {
+		ms := newTestMemoryStorage(t)
+		server := NewServer(ms)
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, importRequest(t, c.query, archive))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s expected: %v, got: %v %s", c.query, http.StatusOK, w.Code, w.Body.String())
+		}
+
+		results := UploadResults{}
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s expected no error, got: %s", c.query, err)
+		}
+		if len(results) != len(c.want) {
+			t.Fatalf("%s expected %d results, got: %s", c.query, len(c.want), w.Body.String())
+		}
+		for _, res := range results {
+			if res.Status != c.want[res.Name] {
+				t.Fatalf("%s %s expected: %v, got: %v %s", c.query, res.Name, c.want[res.Name], res.Status, res.Error)
+			}
+		}
+		for _, id := range c.ids {
+			if _, err := ms.Read(context.Background(), id); err != nil {
+				t.Fatalf("%s expected %s to be stored, got: %s", c.query, id, err)
+			}
+		}
+		if staged, _ := ms.ListObjects(context.Background(), stagingPrefix); len(staged) != 0 {
+			t.Fatalf("%s expected nothing to be left staged, got: %v", c.query, staged)
+		}
+	}
+}
+
+func TestImportLimits(t *testing.T) {
+	png := testPNG(t)
+	three := testZip(t, []string{"a.png", "b.png", "c.png"}, map[string][]byte{"a.png": png, "b.png": png, "c.png": png})
+
+	type test struct {
+		entries int
+		bytes   int64
+		archive []byte
+		status  int
+	}
+
+	tests := map[string]test{
+		"fits":           {entries: 3, bytes: int64(3*len(png)) + 64<<10, archive: three, status: http.StatusCreated},
+		"too many files": {entries: 2, bytes: int64(3*len(png)) + 64<<10, archive: three, status: http.StatusRequestEntityTooLarge},
+		"too many bytes": {entries: 3, bytes: int64(3*len(png)) - 1, archive: three, status: http.StatusRequestEntityTooLarge},
+		// Zeros compress to next to nothing, so only what they add up to
+		// gives them away.
+		"bomb":      {entries: 3, bytes: 1 << 20, archive: testZip(t, []string{"z.png"}, map[string][]byte{"z.png": make([]byte, 2<<20)}), status: http.StatusRequestEntityTooLarge},
+		"not a zip": {entries: 3, bytes: 1 << 20, archive: []byte("not a zip"), status: http.StatusBadRequest},
+		"empty":     {entries: 3, bytes: 1 << 20, archive: testZip(t, []string{"dir/"}, nil), status: http.StatusBadRequest},
+	}
+
+	oldEntries, oldBytes := maxImportEntries, maxImportBytes
+	defer func() { maxImportEntries, maxImportBytes = oldEntries, oldBytes }()
+
+	for name, c := range tests {
+		maxImportEntries, maxImportBytes = c.entries, c.bytes
+		server := NewServer(newTestMemoryStorage(t))
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, importRequest(t, "?force=true", c.archive))
+		if w.Code != c.status {
+			t.Fatalf("%s expected: %v, got: %v %s", name, c.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestImportName(t *testing.T) {
+	type test struct {
+		entry, flat, preserved string
+	}
+
+	tests := []test{
+		{"a.png", "a.png", "a.png"},
+		{"./x/y/a.png", "a.png", "x/y/a.png"},
+		{"x\\a.png", "a.png", "x/a.png"},
+		{"x//a#1.png", "a%231.png", "x/a%231.png"},
+		{"x/../a.png", "", ""},
+		{"C:\\a.png", "", ""},
+	}
+
+	for _, c := range tests {
+		for preserve, want := range map[bool]string{false: c.flat, true: c.preserved} {
+			got, err := importName(c.entry, preserve)
+			if want == "" {
+				if err == nil {
+					t.Fatalf("%s expected an error, got: %s", c.entry, got)
+				}
+				continue
+			}
+			if err != nil || got != want {
+				t.Fatalf("%s expected: %s, got: %s %v", c.entry, want, got, err)
+			}
+			if strings.Contains(got, "..") {
+				t.Fatalf("%s expected no way out, got: %s", c.entry, got)
+			}
+		}
+	}
+}
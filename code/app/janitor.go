@@ -0,0 +1,324 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// cleanupPath is where a cleanup is run on demand.
+const cleanupPath = "/api/v1/admin/cleanup"
+
+// janitorInterval is how often the janitor sweeps storage. Zero leaves it
+// to be run on demand.
+var janitorInterval = time.Hour
+
+// janitorRate is how many storage calls a second a sweep makes at most, so
+// that it doesn't take the bucket's capacity from requests. Zero doesn't
+// limit them.
+var janitorRate = 10.0
+
+// janitorDryRun makes the scheduled sweeps only report what they would
+// remove.
+var janitorDryRun = false
+
+// maxCleanupNames bounds how many objects a dry run lists by name.
+const maxCleanupNames = 1000
+
+// CleanupReport is what a sweep of storage removed, or in a dry run would
+// have, by kind. Errors holds what went wrong, each step going on after
+// the one before failed.
+type CleanupReport struct {
+	DryRun     bool      `json:"dryRun"`
+	Started    time.Time `json:"started"`
+	Duration   string    `json:"duration"`
+	Thumbnails int       `json:"thumbnails"`
+	Variants   int       `json:"variants"`
+	Trash      int       `json:"trash"`
+	Uploads    int       `json:"uploads"`
+	Staged     int       `json:"staged"`
+	Expired    int       `json:"expired"`
+	Names      []string  `json:"names,omitempty"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// JSON marshalls the content of CleanupReport to json.
+func (c CleanupReport) JSON() (string, error) {
+	bytes, err := c.JSONBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of CleanupReport to json.
+func (c CleanupReport) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// total is how many things were removed, of every kind.
+func (c CleanupReport) total() int {
+	return c.Thumbnails + c.Variants + c.Trash + c.Uploads + c.Staged + c.Expired
+}
+
+// String sums c up in a line for the log.
+func (c CleanupReport) String() string {
+	verb := "removed"
+	if c.DryRun {
+		verb = "would remove"
+	}
+
+	return fmt.Sprintf("cleanup %s %d expired images, %d thumbnails, %d variants, %d trashed images, %d uploads and %d staged uploads in %s with %d errors",
+		verb, c.Expired, c.Thumbnails, c.Variants, c.Trash, c.Uploads, c.Staged, c.Duration, len(c.Errors))
+}
+
+// sweep is a single run of the janitor. It paces the storage calls made
+// for it and counts what is removed. The zero sweep removes everything it
+// is asked to as fast as it can.
+type sweep struct {
+	dryRun  bool
+	limiter *rate.Limiter
+	report  CleanupReport
+}
+
+// newSweep returns a sweep making up to rps storage calls a second, or
+// any number with rps zero.
+func newSweep(dryRun bool, rps float64) *sweep {
+	sw := &sweep{dryRun: dryRun, report: CleanupReport{DryRun: dryRun, Started: time.Now()}}
+	if rps > 0 {
+		sw.limiter = rate.NewLimiter(rate.Limit(rps), 1)
+	}
+
+	return sw
+}
+
+// wait holds off until the next storage call can be made, or ctx is done.
+func (sw *sweep) wait(ctx context.Context) error {
+	if sw.limiter == nil {
+		return ctx.Err()
+	}
+
+	return sw.limiter.Wait(ctx)
+}
+
+// remove deletes name with del, adding it to count. A dry run only counts
+// it and notes its name. Something already gone counts as removed, and
+// something changed since it was found is left alone.
+func (sw *sweep) remove(ctx context.Context, count *int, name string, del func() error) error {
+	if sw.dryRun {
+		if len(sw.report.Names) < maxCleanupNames {
+			sw.report.Names = append(sw.report.Names, name)
+		}
+		*count++
+		return ctx.Err()
+	}
+
+	if err := sw.wait(ctx); err != nil {
+		return err
+	}
+	switch err := del(); err {
+	case nil, ErrNotFound:
+	case ErrPrecondition:
+		return nil
+	default:
+		return err
+	}
+	*count++
+
+	return nil
+}
+
+// purgeOrphans removes, as part of sw, the thumbnails and cached variants
+// of images that are gone. The thumbnail of an image in the trash is kept,
+// as it comes back when the image is restored.
+func (s *Server) purgeOrphans(ctx context.Context, sw *sweep) error {
+	if err := sw.wait(ctx); err != nil {
+		return err
+	}
+	fs, err := s.storage.ListTrash(ctx)
+	if err != nil {
+		return err
+	}
+	trashed := map[string]bool{}
+	for _, t := range NewTrashedImages(fs) {
+		trashed[t.Name] = true
+	}
+
+	live := map[string]bool{}
+	gone := func(id string) (bool, error) {
+		if l, ok := live[id]; ok {
+			return !l, nil
+		}
+		if err := sw.wait(ctx); err != nil {
+			return false, err
+		}
+		_, err := s.storage.Read(ctx, id)
+		if err != nil && err != ErrNotFound {
+			return false, err
+		}
+		live[id] = err == nil
+		return !live[id], nil
+	}
+
+	kinds := []struct {
+		prefix string
+		count  *int
+		id     func(name string) string
+	}{
+		{thumbnailPrefix, &sw.report.Thumbnails, func(name string) string {
+			return strings.TrimPrefix(name, thumbnailPrefix+"/")
+		}},
+		{variantPrefix, &sw.report.Variants, func(name string) string {
+			return path.Dir(strings.TrimPrefix(name, variantPrefix+"/"))
+		}},
+	}
+	for _, k := range kinds {
+		if err := sw.wait(ctx); err != nil {
+			return err
+		}
+		fs, err := s.storage.ListObjects(ctx, k.prefix)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range fs {
+			id := k.id(f.Name)
+			if trashed[id] {
+				continue
+			}
+			g, err := gone(id)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", id, err)
+			}
+			if !g {
+				continue
+			}
+			name := f.Name
+			if err := sw.remove(ctx, k.count, name, func() error { return s.storage.DeleteObject(ctx, name) }); err != nil {
+				return fmt.Errorf("error deleting %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// cleanup sweeps storage once, deleting images that have expired, then
+// removing thumbnails and variants whose image is gone, images that have
+// been in the trash longer than trashRetention, and uploads abandoned for
+// longer than uploadExpiry. Each step goes on if the one before fails,
+// unless ctx is done. The outcome is logged and counted in the metrics as
+// well as returned.
+func (s *Server) cleanup(ctx context.Context, dryRun bool) CleanupReport {
+	sw := newSweep(dryRun, janitorRate)
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"expired", func() error { return s.purgeExpired(ctx, sw, time.Now()) }},
+		{"orphans", func() error { return s.purgeOrphans(ctx, sw) }},
+		{"trash", func() error {
+			if trashRetention <= 0 {
+				return nil
+			}
+			return s.purgeTrash(ctx, sw, time.Now().Add(-trashRetention))
+		}},
+		{"uploads", func() error { return s.purgeUploads(ctx, sw, time.Now()) }},
+		{"staging", func() error { return s.purgeStaging(ctx, sw, time.Now().Add(-uploadExpiry)) }},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			sw.report.Errors = append(sw.report.Errors, fmt.Sprintf("%s: %s", step.name, err))
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	sw.report.Duration = time.Since(sw.report.Started).Round(time.Millisecond).String()
+
+	s.metrics.cleanedUp(sw.report)
+	switch {
+	case len(sw.report.Errors) > 0:
+		logJSON(SeverityWarning, LogEntry{Message: fmt.Sprintf("%s: %s", sw.report, strings.Join(sw.report.Errors, "; "))})
+	case sw.report.total() > 0:
+		logJSON(SeverityInfo, LogEntry{Message: sw.report.String()})
+	default:
+		logJSON(SeverityDebug, LogEntry{Message: sw.report.String()})
+	}
+
+	return sw.report
+}
+
+// runJanitor sweeps storage every interval until ctx is done, starting
+// straight away. Sweeps are skipped outside the normal mode, as nothing is
+// to change then.
+func (s *Server) runJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if s.Mode() == ModeNormal {
+			s.cleanup(ctx, janitorDryRun)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanupHandler runs a sweep for callers with an API key, answering with
+// its report. With ?dryRun=true nothing is removed, which is also the
+// only way to run one outside the normal mode.
+func (s *Server) cleanupHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdminKey(w, r) {
+		return
+	}
+
+	dryRun := janitorDryRun
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, invalidArgument(fmt.Errorf("invalid dryRun %q: want true or false", v)))
+			return
+		}
+		dryRun = b
+	}
+	if !dryRun && s.Mode() != ModeNormal {
+		w.Header().Set("Retry-After", strconv.Itoa(int(modeRetryAfter.Seconds())))
+		writeErrorMsg(w, http.StatusServiceUnavailable, fmt.Errorf("nothing can be removed in %s mode, ask for a dry run instead", s.Mode()))
+		return
+	}
+
+	writeJSON(w, s.cleanup(r.Context(), dryRun), http.StatusOK)
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestJanitorStorage holds image a, old in the trash for longer than it
+// is kept and recent for less, thumbnails and variants both of images and
+// of ones that are gone, and a staged upload that was abandoned.
+func newTestJanitorStorage(t *testing.T) *MemoryStorage {
+	t.Helper()
+
+	ctx := context.Background()
+	ms := newTestMemoryStorage(t, "a.png", "old.png", "recent.png")
+	if err := ms.Trash(ctx, "old", time.Now().Add(-trashRetention-time.Hour), 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := ms.Trash(ctx, "recent", time.Now(), 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	for _, name := range []string{
+		thumbnailName("a"),
+		thumbnailName("recent"),
+		thumbnailName("gone"),
+		variantName("a", resizeOptions{Width: 10, Fit: fitInside}),
+		variantName("gone", resizeOptions{Width: 10, Fit: fitInside}),
+		variantName("b/gone", resizeOptions{Width: 10, Fit: fitInside}),
+	} {
+		if err := ms.PutObject(ctx, name, strings.NewReader("x"), "image/png"); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+	}
+	if err := ms.PutObject(ctx, stagingPrefix+"/left", strings.NewReader("x"), ""); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	obj := ms.objects[stagingPrefix+"/left"]
+	obj.created = time.Now().Add(-uploadExpiry - time.Hour)
+	ms.objects[stagingPrefix+"/left"] = obj
+
+	return ms
+}
+
+func TestCleanup(t *testing.T) {
+	ms := newTestJanitorStorage(t)
+	server := NewServer(ms)
+	before := len(ms.objects)
+
+	// Thumbnails, variants, trash, uploads and staged uploads.
+	want := [5]int{1, 2, 1, 0, 1}
+	counts := func(c CleanupReport) [5]int {
+		return [5]int{c.Thumbnails, c.Variants, c.Trash, c.Uploads, c.Staged}
+	}
+
+	dry := server.cleanup(context.Background(), true)
+	if counts(dry) != want || len(dry.Errors) > 0 || !dry.DryRun {
+		t.Fatalf("expected: %+v, got: %+v", want, dry)
+	}
+	sort.Strings(dry.Names)
+	names := []string{
+		"cache/b/gone/w10h0", "cache/gone/w10h0", "staging/left", "thumbs/gone", "trash/old",
+	}
+	if strings.Join(dry.Names, ",") != strings.Join(names, ",") {
+		t.Fatalf("expected: %v, got: %v", names, dry.Names)
+	}
+	if len(ms.objects) != before {
+		t.Fatalf("expected a dry run to leave everything, got %d objects of %d", len(ms.objects), before)
+	}
+
+	report := server.cleanup(context.Background(), false)
+	if counts(report) != want || len(report.Errors) > 0 || len(report.Names) > 0 {
+		t.Fatalf("expected: %+v, got: %+v", want, report)
+	}
+	for _, name := range []string{thumbnailName("a"), thumbnailName("recent"), variantName("a", resizeOptions{Width: 10, Fit: fitInside})} {
+		if _, ok := ms.objects[name]; !ok {
+			t.Fatalf("expected %s to be kept", name)
+		}
+	}
+	if _, err := ms.Read(context.Background(), "a"); err != nil {
+		t.Fatalf("expected a to be kept, got: %s", err)
+	}
+
+	if again := server.cleanup(context.Background(), false); again.total() != 0 {
+		t.Fatalf("expected nothing left to remove, got: %+v", again)
+	}
+}
+
+func TestCleanupCanceled(t *testing.T) {
+	ms := newTestJanitorStorage(t)
+	server := NewServer(ms)
+	before := len(ms.objects)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report := server.cleanup(ctx, false)
+	if len(report.Errors) != 1 || report.total() != 0 || len(ms.objects) != before {
+		t.Fatalf("expected the sweep to stop at once, got: %+v", report)
+	}
+}
+
+func TestSweepRate(t *testing.T) {
+	sw := newSweep(false, 100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := sw.wait(context.Background()); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("expected the calls to be paced, took: %s", d)
+	}
+}
+
+func TestCleanupHandler(t *testing.T) {
+	server := NewServer(newTestJanitorStorage(t))
+
+	post := func(target, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post(cleanupPath, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+	server.RequireAPIKey([]string{"secret"}, false)
+	if w := post(cleanupPath, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %v, got: %v", http.StatusUnauthorized, w.Code)
+	}
+	if w := post(cleanupPath+"?dryRun=maybe", "secret"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+	}
+
+	server.SetMode(ModeReadOnly)
+	if w := post(cleanupPath, "secret"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+	w := post(cleanupPath+"?dryRun=true", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	report := CleanupReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || !report.DryRun || report.Thumbnails != 1 {
+		t.Fatalf("expected a dry run report, got: %s", w.Body.String())
+	}
+
+	server.SetMode(ModeNormal)
+	w = post(cleanupPath, "secret")
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || report.DryRun || report.total() != 5 {
+		t.Fatalf("expected 5 objects removed, got: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// jsonUploadOverhead is how much room a JSON upload gets on top of its
+// encoded data, for the name, type and punctuation.
+const jsonUploadOverhead = 4 << 10
+
+// JSONUpload is an upload for clients that can only send JSON. Data is the
+// file, base64 encoded. ContentType defaults to the one for Name's
+// extension.
+type JSONUpload struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType,omitempty"`
+	Data        string `json:"data"`
+}
+
+// isJSON reports whether r has a JSON body.
+func isJSON(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+// jsonUploadHandler is the createHandler for JSON bodies. It takes the same
+// ?overwrite= and ?force= and answers the same way as an upload of one file.
+func (s *Server) jsonUploadHandler(w http.ResponseWriter, r *http.Request) {
+	limit := int64(base64.StdEncoding.EncodedLen(int(maxUploadBytes))) + jsonUploadOverhead
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	req := JSONUpload{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			writeError(w, tooLarge(fmt.Errorf("upload too large, limit is %d bytes", maxUploadBytes)))
+			return
+		}
+		writeError(w, invalidArgument(fmt.Errorf("invalid request body: %s", err)))
+		return
+	}
+	if req.Name == "" || req.Data == "" {
+		writeError(w, invalidArgument(errors.New("name and data are required")))
+		return
+	}
+	if req.ContentType == "" {
+		req.ContentType, _, _ = mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(req.Name)))
+	}
+
+	file, err := decodeUpload(req.Data)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	// The encoded copy is no longer needed while the file is stored.
+	req.Data = ""
+
+	opts := uploadOptions{
+		Overwrite: r.URL.Query().Get("overwrite") == "true",
+		Force:     r.URL.Query().Get("force") == "true",
+		KeepExif:  r.URL.Query().Get("keepExif") == "true",
+	}
+	if err := opts.Metadata.setTTL(r.Header.Get(ttlHeader)); err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	img, status, err := s.storeFile(r.Context(), req.Name, req.ContentType, file, opts)
+	if err != nil {
+		writeUploadError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(img.Name)))
+	writeJSON(w, img, status)
+}
+
+// decodeUpload streams base64 data into a temporary file, which the caller
+// must close and remove, so that the upload is never held in memory twice.
+// Data that isn't base64, or decodes to more than maxUploadBytes, is turned
+// down.
+func decodeUpload(data string) (*os.File, error) {
+	f, err := spool(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) {
+		return nil, invalidArgument(fmt.Errorf("data is not valid base64: %v", corrupt))
+	}
+
+	return f, err
+}
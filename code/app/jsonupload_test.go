@@ -0,0 +1,128 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newJSONUploadRequest(t *testing.T, target string, upload JSONUpload) *http.Request {
+	t.Helper()
+
+	body, err := json.Marshal(upload)
+	if err != nil {
+		t.Fatalf("could not marshal upload: %s", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return r
+}
+
+func TestJSONUpload(t *testing.T) {
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+	data := base64.StdEncoding.EncodeToString(testPNG(t))
+
+	r := newJSONUploadRequest(t, "/api/v1/image", JSONUpload{Name: "sensor.png", Data: data})
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Location"); got != "/api/v1/image/sensor" {
+		t.Fatalf("expected: %v, got: %v", "/api/v1/image/sensor", got)
+	}
+
+	obj, err := ms.Open(context.Background(), "sensor")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	defer obj.Close()
+	got, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if !bytes.Equal(got, testPNG(t)) {
+		t.Fatalf("expected the decoded image to be stored")
+	}
+}
+
+func TestJSONUploadRejected(t *testing.T) {
+	old := maxUploadBytes
+	maxUploadBytes = int64(2 * len(testPNG(t)))
+	defer func() { maxUploadBytes = old }()
+
+	png := base64.StdEncoding.EncodeToString(testPNG(t))
+
+	type test struct {
+		upload JSONUpload
+		status int
+		want   string
+	}
+
+	tests := map[string]test{
+		"bad base64":   {upload: JSONUpload{Name: "a.png", Data: "not*base64"}, status: http.StatusBadRequest, want: "not valid base64"},
+		"no name":      {upload: JSONUpload{Data: png}, status: http.StatusBadRequest, want: "required"},
+		"no data":      {upload: JSONUpload{Name: "a.png"}, status: http.StatusBadRequest, want: "required"},
+		"wrong type":   {upload: JSONUpload{Name: "a.png", ContentType: "image/gif", Data: png}, status: http.StatusUnsupportedMediaType},
+		"not an image": {upload: JSONUpload{Name: "a.png", Data: base64.StdEncoding.EncodeToString([]byte("MZ"))}, status: http.StatusUnsupportedMediaType},
+		"too large": {
+			upload: JSONUpload{Name: "a.png", Data: base64.StdEncoding.EncodeToString(make([]byte, maxUploadBytes+1000))},
+			status: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	server := NewServer(newTestMemoryStorage(t))
+	for name, c := range tests {
+		r := newJSONUploadRequest(t, "/api/v1/image", c.upload)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Fatalf("%s expected: %v, got: %v %s", name, c.status, w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), c.want) {
+			t.Fatalf("%s expected %q in: %s", name, c.want, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/image", strings.NewReader(`{"name": `))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+	}
+
+	// A body too big to be an allowed upload is cut off before it is read.
+	body := fmt.Sprintf(`{"name": "a.png", "data": %q}`, strings.Repeat("A", int(4*maxUploadBytes)))
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/image", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected: %v, got: %v", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// labelsKey is the metadata the labels of an original are kept in,
+// separated by commas.
+const labelsKey = "labels"
+
+// labelTimeout bounds how long labelling one upload can take, including
+// waiting for a slot and for the Cloud Function to process it.
+const labelTimeout = 2 * time.Minute
+
+// maxLabels is how many labels are kept for each image, set from
+// MAX_LABELS.
+var maxLabels = 5
+
+// defaultLabelConcurrency is how many images are labelled at once unless
+// LABEL_CONCURRENCY says otherwise.
+const defaultLabelConcurrency = 4
+
+// labelPollInterval is how often labelling checks whether the original of
+// a new upload has appeared yet.
+var labelPollInterval = 2 * time.Second
+
+// Labeler names what is in an image, most confident first.
+type Labeler interface {
+	Label(ctx context.Context, r io.Reader, contentType string) ([]string, error)
+}
+
+// SetLabeler has every new image labelled by l in the background, with at
+// most concurrency of them at once.
+func (s *Server) SetLabeler(l Labeler, concurrency int) {
+	s.labeler = l
+	s.labelSlots = make(chan struct{}, concurrency)
+}
+
+// WaitForLabels blocks until every image handed to the labeler has been
+// dealt with.
+func (s *Server) WaitForLabels() {
+	s.labelling.Wait()
+}
+
+// label has the image id labelled in the background, once its original
+// has the content with etag. Failures are logged and never reach the
+// upload, whose ctx is only kept for the tenant and user it was for.
+func (s *Server) label(ctx context.Context, id, etag string) {
+	if s.labeler == nil {
+		return
+	}
+
+	s.labelling.Add(1)
+	go func() {
+		defer s.labelling.Done()
+
+		ctx, cancel := context.WithTimeout(detachedScope(ctx), labelTimeout)
+		defer cancel()
+
+		select {
+		case s.labelSlots <- struct{}{}:
+			defer func() { <-s.labelSlots }()
+		case <-ctx.Done():
+			weblog(fmt.Sprintf("gave up labelling %s: too many waiting", id))
+			return
+		}
+
+		if err := s.labelImage(ctx, id, etag); err != nil {
+			weblog(fmt.Sprintf("error labelling %s: %s", id, err))
+		}
+	}()
+}
+
+// labelImage labels the original of image id and keeps the labels in its
+// metadata.
+func (s *Server) labelImage(ctx context.Context, id, etag string) error {
+	original, err := s.awaitOriginal(ctx, id, etag)
+	if err != nil {
+		return err
+	}
+
+	obj, err := s.storage.OpenObject(ctx, original.Name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	labels, err := s.labeler.Label(ctx, obj, obj.ContentType)
+	if err != nil {
+		return err
+	}
+	if len(labels) > maxLabels {
+		labels = labels[:maxLabels]
+	}
+	for i, l := range labels {
+		// Commas separate the labels in the metadata.
+		labels[i] = strings.ReplaceAll(strings.ToLower(l), ",", " ")
+	}
+
+	if err := s.storage.UpdateMetadata(ctx, original.Name, map[string]string{labelsKey: strings.Join(labels, ",")}); err != nil {
+		return err
+	}
+	s.lists.invalidate()
+
+	return nil
+}
+
+// awaitOriginal waits for the original of image id to have the content
+// with etag, which for Cloud Storage is once the Cloud Function has
+// processed the upload.
+func (s *Server) awaitOriginal(ctx context.Context, id, etag string) (CSFile, error) {
+	for {
+		fs, err := s.storage.Read(ctx, id)
+		if err != nil && err != ErrNotFound {
+			return CSFile{}, err
+		}
+		if f, ok := originalFile(fs); ok && (etag == "" || f.ETag == etag) {
+			return f, nil
+		}
+
+		select {
+		case <-time.After(labelPollInterval):
+		case <-ctx.Done():
+			return CSFile{}, errors.New("timed out waiting for the upload to be processed")
+		}
+	}
+}
+
+// imageLabels reads the labels kept in the metadata of an original.
+func imageLabels(metadata map[string]string) []string {
+	v := metadata[labelsKey]
+	if v == "" {
+		return nil
+	}
+
+	return strings.Split(v, ",")
+}
+
+// labelled returns the images in is with the label l, ignoring case.
+func labelled(is Images, l string) Images {
+	l = strings.ToLower(l)
+
+	matched := Images{}
+	for _, i := range is {
+		for _, have := range i.Labels {
+			if have == l {
+				matched = append(matched, i)
+				break
+			}
+		}
+	}
+
+	return matched
+}
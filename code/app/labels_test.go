@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLabeler gives every image the same labels, or fails with err,
+// keeping track of how many it labels at once.
+type fakeLabeler struct {
+	labels []string
+	err    error
+
+	mu      sync.Mutex
+	running int
+	most    int
+}
+
+func (l *fakeLabeler) Label(ctx context.Context, r io.Reader, contentType string) ([]string, error) {
+	l.mu.Lock()
+	l.running++
+	if l.running > l.most {
+		l.most = l.running
+	}
+	l.mu.Unlock()
+
+	io.ReadAll(r)
+	time.Sleep(10 * time.Millisecond)
+
+	l.mu.Lock()
+	l.running--
+	l.mu.Unlock()
+
+	return append([]string{}, l.labels...), l.err
+}
+
+func TestLabels(t *testing.T) {
+	old := maxLabels
+	maxLabels = 3
+	defer func() { maxLabels = old }()
+
+	ms := newTestMemoryStorage(t, "unlabelled.png")
+	server := NewServer(ms)
+	labeler := &fakeLabeler{labels: []string{"Dog", "Beach", "Sunset", "Sky"}}
+	server.SetLabeler(labeler, 1)
+
+	for i := 0; i < 3; i++ {
+		r := newUploadRequest(t, http.MethodPost, "/api/v1/image?force=true", fmt.Sprintf("dog%d.png", i), "image/png", testPNG(t))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+	server.WaitForLabels()
+
+	if labeler.most != 1 {
+		t.Fatalf("expected one image to be labelled at a time, got: %v", labeler.most)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/dog0", nil))
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if want := []string{"dog", "beach", "sunset"}; !reflect.DeepEqual(img.Labels, want) {
+		t.Fatalf("expected: %v, got: %v", want, img.Labels)
+	}
+
+	type test struct {
+		label string
+		want  int
+	}
+
+	tests := []test{{"dog", 3}, {"Beach", 3}, {"sky", 0}, {"cat", 0}}
+	for _, c := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image?label="+c.label, nil))
+		page := ImagePage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s expected no error, got: %s", c.label, err)
+		}
+		if len(page.Images) != c.want {
+			t.Fatalf("%s expected: %v, got: %v", c.label, c.want, len(page.Images))
+		}
+	}
+}
+
+func TestLabelsBestEffort(t *testing.T) {
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+	server.SetLabeler(&fakeLabeler{err: errors.New("vision is down")}, 2)
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "photo.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	logs := captureLogs(t, SeverityDebug)
+	server.ServeHTTP(w, r)
+	server.WaitForLabels()
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	fs, err := ms.Read(context.Background(), "photo")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if f, _ := originalFile(fs); f.Metadata[labelsKey] != "" {
+		t.Fatalf("expected no labels, got: %v", f.Metadata[labelsKey])
+	}
+	if !strings.Contains(logs.String(), "error labelling photo") {
+		t.Fatalf("expected the failure to be logged")
+	}
+}
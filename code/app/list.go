@@ -0,0 +1,279 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sortName    = "name"
+	sortSize    = "size"
+	sortUpdated = "updated"
+)
+
+// sortOrder is how a listing is sorted. Ties are broken by name, so every
+// image has exactly one place in the order.
+type sortOrder struct {
+	Key  string
+	Desc bool
+}
+
+// parseSort reads ?sort= and ?order= from a query, defaulting to ascending
+// by name.
+func parseSort(q url.Values) (sortOrder, error) {
+	o := sortOrder{Key: sortName}
+
+	switch key := q.Get("sort"); key {
+	case "":
+	case sortName, sortSize, sortUpdated:
+		o.Key = key
+	default:
+		return o, fmt.Errorf("invalid sort %q: want %s, %s or %s", key, sortName, sortSize, sortUpdated)
+	}
+
+	switch order := q.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		o.Desc = true
+	default:
+		return o, fmt.Errorf("invalid order %q: want asc or desc", order)
+	}
+
+	return o, nil
+}
+
+// native reports whether storage already lists in this order, so it can
+// page through the listing itself.
+func (o sortOrder) native() bool {
+	return o.Key == sortName && !o.Desc
+}
+
+// less reports whether a comes before b.
+func (o sortOrder) less(a, b Image) bool {
+	if o.Desc {
+		a, b = b, a
+	}
+
+	switch o.Key {
+	case sortSize:
+		if a.SizeBytes != b.SizeBytes {
+			return a.SizeBytes < b.SizeBytes
+		}
+	case sortUpdated:
+		if !a.Updated.Equal(b.Updated) {
+			return a.Updated.Before(b.Updated)
+		}
+	}
+
+	return a.Name < b.Name
+}
+
+// sortCursor is what a page token holds for a sorted listing: enough of the
+// last image on a page to find where the next one starts, even if images
+// have come or gone in between.
+type sortCursor struct {
+	Name      string    `json:"n"`
+	SizeBytes int64     `json:"s"`
+	Updated   time.Time `json:"u"`
+}
+
+// page sorts is and returns the page of up to limit images after the one
+// pageToken points at, along with the token for the page after that.
+func (o sortOrder) page(is Images, limit int, pageToken string) (Images, string, error) {
+	sort.Slice(is, func(i, j int) bool { return o.less(is[i], is[j]) })
+
+	start := 0
+	if pageToken != "" {
+		after, err := decodeCursor(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		start = sort.Search(len(is), func(i int) bool { return o.less(after, is[i]) })
+	}
+
+	end := len(is)
+	next := ""
+	if start+limit < end {
+		end = start + limit
+		next = encodeCursor(is[end-1])
+	}
+
+	return is[start:end], next, nil
+}
+
+func encodeCursor(i Image) string {
+	b, _ := json.Marshal(sortCursor{i.Name, i.SizeBytes, i.Updated})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string) (Image, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Image{}, ErrInvalidPageToken
+	}
+
+	c := sortCursor{}
+	if err := json.Unmarshal(b, &c); err != nil || c.Name == "" {
+		return Image{}, ErrInvalidPageToken
+	}
+
+	return Image{Name: c.Name, SizeBytes: c.SizeBytes, Updated: c.Updated}, nil
+}
+
+// matching returns the images in is whose names contain q, ignoring case.
+func matching(is Images, q string) Images {
+	q = strings.ToLower(q)
+
+	matched := Images{}
+	for _, i := range is {
+		if strings.Contains(strings.ToLower(i.Name), q) {
+			matched = append(matched, i)
+		}
+	}
+
+	return matched
+}
+
+// listFilter narrows a listing to the images whose ids start with prefix
+// and contain q, and that have label and tag. With a delimiter, images
+// nested deeper than prefix are rolled up into folders instead.
+type listFilter struct {
+	prefix    string
+	q         string
+	label     string
+	tag       string
+	delimiter string
+}
+
+// splitFolders keeps the images in is whose ids have no delimiter after
+// prefix, and returns the sorted, distinct folders the others are in. A
+// folder is the id up to and including the delimiter, the same way Cloud
+// Storage reports prefixes.
+func splitFolders(is Images, prefix, delimiter string) (Images, []string) {
+	images := Images{}
+	seen := map[string]bool{}
+	folders := []string{}
+	for _, i := range is {
+		rest := strings.TrimPrefix(i.Name, prefix)
+		n := strings.Index(rest, delimiter)
+		if n < 0 {
+			images = append(images, i)
+			continue
+		}
+
+		folder := prefix + rest[:n+len(delimiter)]
+		if !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	sort.Strings(folders)
+
+	return images, folders
+}
+
+// allFiles lists every object of the images in storage whose ids start
+// with prefix, for listings storage can't page through itself.
+func (s *Server) allFiles(ctx context.Context, prefix string) (CSFiles, error) {
+	all := CSFiles{}
+	token := ""
+	for {
+		fs, next, err := s.storage.List(ctx, prefix, maxPageSize*filesPerImage, token)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, fs...)
+
+		if next == "" {
+			return all, nil
+		}
+		token = next
+	}
+}
+
+// allImages lists every image in storage whose id starts with prefix.
+func (s *Server) allImages(ctx context.Context, prefix string) (Images, error) {
+	fs, err := s.allFiles(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	is, _ := NewImages(fs)
+	return is, nil
+}
+
+// Settings for what listings leave out, set from LIST_HIDDEN_PREFIXES and
+// LIST_IMAGES_ONLY.
+var (
+	// listHiddenPrefixes are where images kept out of listings have their
+	// ids, such as scratch/.
+	listHiddenPrefixes []string
+	// listImagesOnly keeps objects that aren't of an allowed type out of
+	// listings as well.
+	listImagesOnly bool
+)
+
+// skippedHeader tells clients how many objects were skipped making a
+// listing because they couldn't be listed as images.
+const skippedHeader = "X-Skipped-Objects"
+
+// listedPage is a page of a listing and how many objects were skipped
+// making it.
+type listedPage struct {
+	ImagePage
+	skipped int
+}
+
+// listImages returns the images among fs that a listing shows, and how
+// many objects it skipped for not being images: those NewImages can't
+// read and, with listImagesOnly, those not of an allowed type. Hidden
+// images are left out without being counted, since nobody is meant to
+// see them, and so are expired ones the janitor has yet to delete.
+func listImages(fs CSFiles) (Images, int) {
+	all, skipped := NewImages(fs)
+
+	now := time.Now()
+	is := Images{}
+	for _, i := range all {
+		switch {
+		case hidden(i.ID):
+		case expired(i, now):
+		case listImagesOnly && !allowedMimeTypes.Valid(i.ContentType):
+			skipped++
+		default:
+			is = append(is, i)
+		}
+	}
+
+	return is, skipped
+}
+
+// hidden reports whether image id is kept out of listings.
+func hidden(id string) bool {
+	for _, p := range listHiddenPrefixes {
+		if strings.HasPrefix(id, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSortServer returns a server holding images whose sizes run the other
+// way to their names.
+func newSortServer(t *testing.T) *Server {
+	ms := NewMemoryStorage()
+	for i, name := range []string{"a.png", "b.png", "c.png", "d.png", "e.png"} {
+		data := append(testPNG(t), make([]byte, 10*(5-i))...)
+		if _, err := ms.Create(context.Background(), name, newMemoryFile(data), CreateOptions{}); err != nil {
+			t.Fatalf("could not create %s: %s", name, err)
+		}
+	}
+
+	return NewServer(ms)
+}
+
+// listAll follows page tokens from query until the listing runs out and
+// returns the names it saw.
+func listAll(t *testing.T, server *Server, query string) []string {
+	names := []string{}
+	token := ""
+	for {
+		q, _ := url.ParseQuery(query)
+		q.Set("pageToken", token)
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image?"+q.Encode(), nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %v, got: %v", query, http.StatusOK, w.Code)
+		}
+
+		page := ImagePage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+		}
+		for _, i := range page.Images {
+			names = append(names, i.Name)
+		}
+
+		if page.NextPageToken == "" {
+			return names
+		}
+		token = page.NextPageToken
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	type test struct {
+		query   string
+		want    sortOrder
+		wantErr bool
+	}
+
+	tests := []test{
+		{query: "", want: sortOrder{Key: sortName}},
+		{query: "sort=size", want: sortOrder{Key: sortSize}},
+		{query: "sort=updated&order=desc", want: sortOrder{Key: sortUpdated, Desc: true}},
+		{query: "order=asc", want: sortOrder{Key: sortName}},
+		{query: "sort=colour", wantErr: true},
+		{query: "sort=name&order=up", wantErr: true},
+	}
+
+	for _, c := range tests {
+		q, _ := url.ParseQuery(c.query)
+		got, err := parseSort(q)
+		if (err != nil) != c.wantErr {
+			t.Fatalf("%s: expected error: %v, got: %v", c.query, c.wantErr, err)
+		}
+		if err == nil && got != c.want {
+			t.Fatalf("%s: expected: %v, got: %v", c.query, c.want, got)
+		}
+	}
+}
+
+func TestSortOrderLess(t *testing.T) {
+	now := time.Now()
+	older := Image{Name: "b", SizeBytes: 1, Updated: now.Add(-time.Hour)}
+	newer := Image{Name: "a", SizeBytes: 1, Updated: now}
+
+	type test struct {
+		order sortOrder
+		want  bool
+	}
+
+	tests := []test{
+		{order: sortOrder{Key: sortUpdated}, want: true},
+		{order: sortOrder{Key: sortUpdated, Desc: true}, want: false},
+		{order: sortOrder{Key: sortSize}, want: false},
+		{order: sortOrder{Key: sortName, Desc: true}, want: true},
+	}
+
+	for _, c := range tests {
+		if got := c.order.less(older, newer); got != c.want {
+			t.Fatalf("%v: expected: %v, got: %v", c.order, c.want, got)
+		}
+	}
+}
+
+func TestListSorted(t *testing.T) {
+	server := newSortServer(t)
+
+	type test struct {
+		query string
+		want  []string
+	}
+
+	tests := []test{
+		{query: "limit=2", want: []string{"a", "b", "c", "d", "e"}},
+		{query: "limit=2&sort=name&order=desc", want: []string{"e", "d", "c", "b", "a"}},
+		{query: "limit=2&sort=size", want: []string{"e", "d", "c", "b", "a"}},
+		{query: "limit=3&sort=size&order=desc", want: []string{"a", "b", "c", "d", "e"}},
+		{query: "limit=1&sort=updated", want: []string{"a", "b", "c", "d", "e"}},
+		{query: "sort=updated&order=desc", want: []string{"e", "d", "c", "b", "a"}},
+	}
+
+	for _, c := range tests {
+		if got := listAll(t, server, c.query); !reflect.DeepEqual(c.want, got) {
+			t.Fatalf("%s: expected: %v, got: %v", c.query, c.want, got)
+		}
+	}
+}
+
+func TestListSortedBadRequest(t *testing.T) {
+	server := newSortServer(t)
+
+	for _, query := range []string{"sort=colour", "order=sideways", "sort=size&pageToken=" + strings.Repeat("!", 4)} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image?"+query, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected: %v, got: %v", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestListFiltered(t *testing.T) {
+	ms := newTestMemoryStorage(t, "2024-06-01-shot.png", "2024-06-02-Shot.png", "2024-07-01-shot.png", "notes.png")
+	server := NewServer(ms)
+
+	type test struct {
+		query string
+		want  []string
+	}
+
+	tests := []test{
+		{query: "prefix=2024-06", want: []string{"2024-06-01-shot", "2024-06-02-Shot"}},
+		{query: "prefix=2024-06&limit=1", want: []string{"2024-06-01-shot", "2024-06-02-Shot"}},
+		{query: "q=SHOT&limit=1", want: []string{"2024-06-01-shot", "2024-06-02-Shot", "2024-07-01-shot"}},
+		{query: "prefix=2024&q=01&sort=name&order=desc", want: []string{"2024-07-01-shot", "2024-06-01-shot"}},
+		{query: "prefix=2025", want: []string{}},
+		{query: "q=nothing", want: []string{}},
+	}
+
+	for _, c := range tests {
+		if got := listAll(t, server, c.query); !reflect.DeepEqual(c.want, got) {
+			t.Fatalf("%s: expected: %v, got: %v", c.query, c.want, got)
+		}
+	}
+
+	for _, query := range []string{"prefix=2025", "q=nothing"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image?"+query, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if !strings.Contains(w.Body.String(), `"images":[]`) {
+			t.Fatalf("%s: expected an empty list, got: %s", query, w.Body.String())
+		}
+	}
+}
+
+func TestListFolders(t *testing.T) {
+	ms := newTestMemoryStorage(t, "events/2024/party.png", "events/2024/dinner.png", "events/banner.png", "events/cover.png", "events/zoo/cat.png", "home.png")
+	server := NewServer(ms)
+
+	type test struct {
+		query       string
+		wantImages  []string
+		wantFolders []string
+	}
+
+	tests := []test{
+		{query: "delimiter=/", wantImages: []string{"home"}, wantFolders: []string{"events/"}},
+		{query: "delimiter=/&prefix=events/", wantImages: []string{"events/banner", "events/cover"}, wantFolders: []string{"events/2024/", "events/zoo/"}},
+		{query: "delimiter=/&prefix=events/2024/", wantImages: []string{"events/2024/dinner", "events/2024/party"}},
+		{query: "prefix=events/", wantImages: []string{"events/2024/dinner", "events/2024/party", "events/banner", "events/cover", "events/zoo/cat"}},
+	}
+
+	for _, c := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image?"+c.query, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %v, got: %v", c.query, http.StatusOK, w.Code)
+		}
+		page := ImagePage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+		}
+
+		images := []string{}
+		for _, i := range page.Images {
+			images = append(images, i.Name)
+		}
+		if !reflect.DeepEqual(c.wantImages, images) {
+			t.Fatalf("%s: expected: %v, got: %v", c.query, c.wantImages, images)
+		}
+		if !reflect.DeepEqual(c.wantFolders, page.Folders) {
+			t.Fatalf("%s: expected folders: %v, got: %v", c.query, c.wantFolders, page.Folders)
+		}
+	}
+
+	// Folders come with the first page only.
+	first := ImagePage{}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image?delimiter=/&prefix=events/&limit=1", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if err := json.Unmarshal(w.Body.Bytes(), &first); err != nil || len(first.Folders) != 2 || first.NextPageToken == "" {
+		t.Fatalf("expected folders and a next page, got: %s", w.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/image?delimiter=/&prefix=events/&limit=1&pageToken="+url.QueryEscape(first.NextPageToken), nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "folders") {
+		t.Fatalf("expected the second page without folders, got: %v %s", w.Code, w.Body.String())
+	}
+}
+
+// newStrayServer returns a server whose storage holds a and b, along with
+// objects that aren't images put there by hand, and an image under
+// scratch/.
+func newStrayServer(t *testing.T) *Server {
+	t.Helper()
+
+	ms := newTestMemoryStorage(t, "a.png", "b.png", "scratch/c.png")
+	for name, contentType := range map[string]string{
+		"processed/readme.txt":         "text/plain",
+		"processed/notes/original.txt": "text/plain",
+	} {
+		if err := ms.PutObject(context.Background(), name, strings.NewReader("not an image"), contentType); err != nil {
+			t.Fatalf("could not put %s: %s", name, err)
+		}
+	}
+
+	return NewServer(ms)
+}
+
+func TestListSkipsStrayObjects(t *testing.T) {
+	oldHidden, oldOnly := listHiddenPrefixes, listImagesOnly
+	defer func() { listHiddenPrefixes, listImagesOnly = oldHidden, oldOnly }()
+
+	tests := []struct {
+		hidden  []string
+		only    bool
+		want    []string
+		skipped string
+	}{
+		{nil, false, []string{"a", "b", "notes", "scratch/c"}, "1"},
+		{[]string{"scratch/"}, false, []string{"a", "b", "notes"}, "1"},
+		{[]string{"scratch/"}, true, []string{"a", "b"}, "2"},
+	}
+	for _, tc := range tests {
+		listHiddenPrefixes, listImagesOnly = tc.hidden, tc.only
+		server := newStrayServer(t)
+
+		for _, target := range []string{"/api/v1/image", "/api/v1/image?sort=size"} {
+			ids, w := listIDs(t, server, target)
+			sort.Strings(ids)
+			if !reflect.DeepEqual(ids, tc.want) {
+				t.Fatalf("%s hiding %v, images only %v, expected: %v, got: %v", target, tc.hidden, tc.only, tc.want, ids)
+			}
+			if got := w.Header().Get(skippedHeader); got != tc.skipped {
+				t.Fatalf("%s hiding %v, images only %v, expected %s skipped, got: %s", target, tc.hidden, tc.only, tc.skipped, got)
+			}
+		}
+	}
+
+	// A stream only knows how many it skipped at the end.
+	w, lines := ndjsonLines(t, newStrayServer(t), httptest.NewRequest(http.MethodGet, "/api/v1/image?format=ndjson", nil))
+	if got := w.Result().Trailer.Get(skippedHeader); got != "2" || len(lines) != 2 {
+		t.Fatalf("expected a and b with 2 skipped, got: %v with %q skipped", lines, got)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// listCacheTTL is how long a listing is served from memory, set from
+// LIST_CACHE_TTL. Changes made through this instance drop it straight away,
+// but those made through another aren't seen until it expires, so it is
+// kept short.
+var listCacheTTL = 5 * time.Second
+
+// maxListCacheEntries bounds how many listings are kept. Once it is
+// reached they are all dropped, rather than tracking which is oldest.
+const maxListCacheEntries = 1000
+
+// listParams are the query parameters that change what a listing holds.
+var listParams = []string{"limit", "pageToken", "sort", "order", "prefix", "q", "label", "tag", "delimiter"}
+
+// listCache holds pages of listings until they expire or an image changes.
+type listCache struct {
+	mu    sync.Mutex
+	pages map[string]cachedPage
+	// gen counts invalidations, so that pages listed while an image
+	// changed aren't kept.
+	gen int
+}
+
+type cachedPage struct {
+	page   listedPage
+	stored time.Time
+}
+
+// listKey is what a listing asked for with q is kept under.
+func listKey(q url.Values) string {
+	key := url.Values{}
+	for _, p := range listParams {
+		if v := q.Get(p); v != "" {
+			key.Set(p, v)
+		}
+	}
+
+	return key.Encode()
+}
+
+// get returns the page kept under key and when it was listed, if it hasn't
+// expired.
+func (c *listCache) get(key string) (listedPage, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp, ok := c.pages[key]
+	if !ok {
+		return listedPage{}, time.Time{}, false
+	}
+	if time.Since(cp.stored) >= listCacheTTL {
+		delete(c.pages, key)
+		return listedPage{}, time.Time{}, false
+	}
+
+	return cp.page, cp.stored, true
+}
+
+// generation returns a token for put, to be taken before listing.
+func (c *listCache) generation() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// put keeps page under key, unless an image changed since gen was taken.
+func (c *listCache) put(key string, gen int, page listedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen != gen || listCacheTTL <= 0 {
+		return
+	}
+	if c.pages == nil || len(c.pages) >= maxListCacheEntries {
+		c.pages = map[string]cachedPage{}
+	}
+	c.pages[key] = cachedPage{page: page, stored: time.Now()}
+}
+
+// invalidate drops every listing.
+func (c *listCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pages = nil
+	c.gen++
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func listIDs(t *testing.T, server *Server, target string) ([]string, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	page := ImagePage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	ids := []string{}
+	for _, i := range page.Images {
+		ids = append(ids, i.ID)
+	}
+	return ids, w
+}
+
+func TestListCache(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+
+	ids, w := listIDs(t, server, "/api/v1/image")
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 images, got: %v", ids)
+	}
+	if w.Header().Get("Cache-Control") != "no-cache" || w.Header().Get("Age") != "0" {
+		t.Fatalf("expected Cache-Control and Age, got: %v", w.Header())
+	}
+
+	// Changes made elsewhere aren't seen until the listing expires, unless
+	// it is bypassed.
+	if err := ms.Delete(context.Background(), "b", 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if ids, _ := listIDs(t, server, "/api/v1/image"); len(ids) != 2 {
+		t.Fatalf("expected the cached listing, got: %v", ids)
+	}
+	if ids, _ := listIDs(t, server, "/api/v1/image?sort=size"); len(ids) != 1 {
+		t.Fatalf("expected another sort to be listed afresh, got: %v", ids)
+	}
+	if ids, _ := listIDs(t, server, "/api/v1/image?fresh=true"); len(ids) != 1 {
+		t.Fatalf("expected fresh=true to bypass the cache, got: %v", ids)
+	}
+
+	// Changes made through the server drop the cache.
+	server.ServeHTTP(httptest.NewRecorder(), newUploadRequest(t, http.MethodPost, "/api/v1/image?force=true", "c.png", "image/png", testPNG(t)))
+	if ids, _ := listIDs(t, server, "/api/v1/image?sort=size"); len(ids) != 2 {
+		t.Fatalf("expected the upload to be listed, got: %v", ids)
+	}
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/image/c", nil))
+	if ids, _ := listIDs(t, server, "/api/v1/image?sort=size"); len(ids) != 1 {
+		t.Fatalf("expected the delete to be listed, got: %v", ids)
+	}
+}
+
+func TestListCacheExpires(t *testing.T) {
+	listCacheTTL = 20 * time.Millisecond
+	t.Cleanup(func() { listCacheTTL = 5 * time.Second })
+
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+
+	listIDs(t, server, "/api/v1/image")
+	if err := ms.Delete(context.Background(), "b", 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if ids, _ := listIDs(t, server, "/api/v1/image"); len(ids) != 1 {
+		t.Fatalf("expected the listing to expire, got: %v", ids)
+	}
+}
+
+func TestListKey(t *testing.T) {
+	a, _ := url.ParseQuery("prefix=x&sort=size&fresh=true&limit=10")
+	b, _ := url.ParseQuery("limit=10&sort=size&prefix=x&unknown=1")
+	if listKey(a) != listKey(b) {
+		t.Fatalf("expected the same key, got: %q and %q", listKey(a), listKey(b))
+	}
+
+	c, _ := url.ParseQuery("prefix=x&sort=name")
+	if listKey(a) == listKey(c) {
+		t.Fatalf("expected different keys, got: %q", listKey(a))
+	}
+}
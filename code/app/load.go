@@ -0,0 +1,210 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bounds on what one load request can ask for. Durations and workers over
+// them are capped rather than turned down.
+const (
+	defaultLoadDuration = 5 * time.Second
+	maxLoadDuration     = time.Minute
+	maxLoadWorkers      = 16
+)
+
+// loadSlice is how often a worker checks whether to rest or stop.
+const loadSlice = 10 * time.Millisecond
+
+// LoadResult is what a load request did.
+type LoadResult struct {
+	Instance  Instance `json:"instance"`
+	Workers   int      `json:"workers"`
+	CPUMillis int      `json:"cpuMillis"`
+	Duration  string   `json:"duration"`
+	// ElapsedMillis is how long the load ran, which is less than Duration
+	// if the request was cancelled.
+	ElapsedMillis int64 `json:"elapsedMillis"`
+	// BusyMillis is the time spent spinning, added up over the workers.
+	BusyMillis int64  `json:"busyMillis"`
+	Iterations uint64 `json:"iterations"`
+	Cancelled  bool   `json:"cancelled"`
+}
+
+// JSON marshalls the content of LoadResult to json.
+func (l LoadResult) JSON() (string, error) {
+	bytes, err := l.JSONBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of LoadResult to json.
+func (l LoadResult) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(l)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// EnableLoad serves /api/v1/load. Without it the endpoint answers 404, as
+// anyone can use it to keep an instance busy.
+func (s *Server) EnableLoad() {
+	s.loadEnabled = true
+}
+
+// loadHandler keeps the CPU busy for a while so that the autoscaler has
+// something to scale on. Each of workers goroutines spins for cpuMillis of
+// every second until duration is up or the request goes away, after which
+// the handler answers with what they did.
+func (s *Server) loadHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.loadEnabled {
+		writeErrorMsg(w, http.StatusNotFound, errors.New("load endpoint not enabled, set ENABLE_LOAD_ENDPOINT=true"))
+		return
+	}
+
+	q := r.URL.Query()
+	cpuMillis, err := parseLoadInt("cpuMillis", q.Get("cpuMillis"), 1000, 1000)
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	workers, err := parseLoadInt("workers", q.Get("workers"), 1, maxLoadWorkers)
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	duration, err := parseLoadDuration(q.Get("duration"))
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+
+	res := burnCPU(r.Context(), workers, time.Duration(cpuMillis)*time.Millisecond, duration)
+	res.Instance = s.instance
+	res.CPUMillis = cpuMillis
+	res.Duration = duration.String()
+
+	writeJSON(w, res, http.StatusOK)
+}
+
+// parseLoadInt reads a whole number from 1 to max, defaulting to def.
+// Numbers over max are capped.
+func parseLoadInt(name, v string, def, max int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q: want a whole number from 1 to %d", name, v, max)
+	}
+	if n > max {
+		n = max
+	}
+
+	return n, nil
+}
+
+// parseLoadDuration reads a duration like 5s, capping it at
+// maxLoadDuration.
+func parseLoadDuration(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultLoadDuration, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q: want a duration like 5s", v)
+	}
+	if d > maxLoadDuration {
+		d = maxLoadDuration
+	}
+
+	return d, nil
+}
+
+// burnCPU runs workers goroutines that each spin for busy of every second
+// and sleep for the rest, until duration is up or ctx is done.
+func burnCPU(parent context.Context, workers int, busy, duration time.Duration) LoadResult {
+	ctx, cancel := context.WithTimeout(parent, duration)
+	defer cancel()
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		res = LoadResult{Workers: workers}
+	)
+	start := time.Now()
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spun, iterations := spin(ctx, busy)
+
+			mu.Lock()
+			res.BusyMillis += spun.Milliseconds()
+			res.Iterations += iterations
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	res.ElapsedMillis = time.Since(start).Milliseconds()
+	res.Cancelled = parent.Err() != nil
+	return res
+}
+
+// spin keeps one CPU busy for busy of every second until ctx is done,
+// reporting how long it spun and how many loops that took.
+func spin(ctx context.Context, busy time.Duration) (time.Duration, uint64) {
+	var (
+		spun       time.Duration
+		iterations uint64
+	)
+	for {
+		second := time.Now()
+		for time.Since(second) < busy {
+			sliceEnd := time.Now().Add(loadSlice)
+			for time.Now().Before(sliceEnd) {
+				iterations++
+			}
+			if ctx.Err() != nil {
+				return spun + time.Since(second), iterations
+			}
+		}
+		spun += time.Since(second)
+
+		rest := time.NewTimer(time.Second - time.Since(second))
+		select {
+		case <-rest.C:
+		case <-ctx.Done():
+			rest.Stop()
+			return spun, iterations
+		}
+	}
+}
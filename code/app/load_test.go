@@ -0,0 +1,87 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/load", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected the endpoint to be off by default, got: %v", w.Code)
+	}
+
+	server.instance.Revision = "scaler-00001"
+	server.EnableLoad()
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/load?cpuMillis=50&duration=100ms&workers=100", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	res := LoadResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if res.Instance.ProcessID != server.instance.ProcessID || res.Instance.Revision != "scaler-00001" {
+		t.Fatalf("expected the instance, got: %+v", res.Instance)
+	}
+	if res.Workers != maxLoadWorkers || res.CPUMillis != 50 || res.Duration != "100ms" {
+		t.Fatalf("expected %d workers at 50ms for 100ms, got: %+v", maxLoadWorkers, res)
+	}
+	if res.BusyMillis == 0 || res.Iterations == 0 || res.Cancelled {
+		t.Fatalf("expected the workers to spin, got: %+v", res)
+	}
+
+	for _, query := range []string{"cpuMillis=0", "cpuMillis=lots", "workers=-1", "duration=5", "duration=-1s"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/load?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s expected: %v, got: %v", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestLoadDurationCapped(t *testing.T) {
+	d, err := parseLoadDuration("1h")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if d != maxLoadDuration {
+		t.Fatalf("expected: %s, got: %s", maxLoadDuration, d)
+	}
+}
+
+func TestBurnCPUCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	res := burnCPU(ctx, 2, time.Second, time.Minute)
+	if !res.Cancelled {
+		t.Fatalf("expected the load to be cancelled, got: %+v", res)
+	}
+	if res.ElapsedMillis > 1000 {
+		t.Fatalf("expected the load to stop when cancelled, took: %dms", res.ElapsedMillis)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity is a log level, named the way Cloud Logging expects to find it
+// in the severity field of a structured entry.
+type Severity int
+
+const (
+	SeverityDebug Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityError
+)
+
+var severityNames = map[Severity]string{
+	SeverityDebug:   "DEBUG",
+	SeverityInfo:    "INFO",
+	SeverityWarning: "WARNING",
+	SeverityError:   "ERROR",
+}
+
+func (s Severity) String() string {
+	return severityNames[s]
+}
+
+// ParseSeverity converts a LOG_LEVEL value like "info" or "WARNING".
+func ParseSeverity(s string) (Severity, error) {
+	for sev, name := range severityNames {
+		if strings.EqualFold(s, name) {
+			return sev, nil
+		}
+	}
+
+	return SeverityInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+var (
+	logLevel            = SeverityInfo
+	logOutput io.Writer = os.Stdout
+	logMu     sync.Mutex
+)
+
+// HTTPRequest is the subset of Cloud Logging's httpRequest field that the
+// access log fills in.
+type HTTPRequest struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	Status        int    `json:"status"`
+	ResponseSize  string `json:"responseSize"`
+	Latency       string `json:"latency"`
+	RemoteIP      string `json:"remoteIp"`
+	UserAgent     string `json:"userAgent"`
+}
+
+// LogEntry is a single structured log line.
+type LogEntry struct {
+	Severity    string       `json:"severity"`
+	Message     string       `json:"message"`
+	HTTPRequest *HTTPRequest `json:"httpRequest,omitempty"`
+	// Labels are indexed by Cloud Logging, so can be filtered on.
+	Labels map[string]string `json:"logging.googleapis.com/labels,omitempty"`
+}
+
+// logJSON writes one structured entry to logOutput if sev is at or above
+// the configured log level.
+func logJSON(sev Severity, entry LogEntry) {
+	if sev < logLevel {
+		return
+	}
+	entry.Severity = sev.String()
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("could not marshal log entry: %s", err)
+		return
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(append(b, '\n'))
+}
+
+// statusRecorder remembers the status and size of a response on its way
+// out.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// accessLog is middleware that writes one structured entry per request.
+// Server errors are logged as ERROR and client errors as WARNING, unless the
+// client went away first, which is only DEBUG.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(sr, r)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		sev := SeverityInfo
+		switch {
+		case r.Context().Err() == context.Canceled:
+			sev = SeverityDebug
+		case sr.status >= 500:
+			sev = SeverityError
+		case sr.status >= 400:
+			sev = SeverityWarning
+		}
+
+		req := &HTTPRequest{
+			RequestMethod: r.Method,
+			RequestURL:    r.URL.RequestURI(),
+			Status:        sr.status,
+			ResponseSize:  fmt.Sprintf("%d", sr.bytes),
+			Latency:       fmt.Sprintf("%.9fs", time.Since(start).Seconds()),
+			RemoteIP:      remoteIP(r),
+			UserAgent:     r.UserAgent(),
+		}
+		msg := fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, sr.status)
+		logJSON(sev, LogEntry{Message: msg, HTTPRequest: req, Labels: requestLabels(requestIDFrom(r.Context()))})
+	})
+}
+
+// remoteIP is the client address, preferring the first hop recorded by a
+// proxy in X-Forwarded-For.
+func remoteIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
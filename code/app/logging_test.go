@@ -0,0 +1,153 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs redirects structured logs into a buffer for the rest of the
+// test.
+func captureLogs(t *testing.T, level Severity) *bytes.Buffer {
+	var buf bytes.Buffer
+	oldOutput, oldLevel := logOutput, logLevel
+	logOutput, logLevel = &buf, level
+	t.Cleanup(func() { logOutput, logLevel = oldOutput, oldLevel })
+
+	return &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	type test struct {
+		status   int
+		severity string
+	}
+
+	tests := []test{
+		{status: http.StatusOK, severity: "INFO"},
+		{status: http.StatusCreated, severity: "INFO"},
+		{status: http.StatusNotFound, severity: "WARNING"},
+		{status: http.StatusInternalServerError, severity: "ERROR"},
+	}
+
+	for _, c := range tests {
+		buf := captureLogs(t, SeverityDebug)
+
+		handler := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+			w.Write([]byte("hello"))
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image?limit=1", nil)
+		r.Header.Set("User-Agent", "scaler-test")
+		r.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		entry := LogEntry{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("could not unmarshal log line %q: %s", buf.String(), err)
+		}
+
+		if entry.Severity != c.severity {
+			t.Fatalf("expected: %v, got: %v", c.severity, entry.Severity)
+		}
+
+		req := entry.HTTPRequest
+		if req == nil {
+			t.Fatalf("expected an httpRequest field, got: %s", buf.String())
+		}
+		if req.Status != c.status || req.RequestMethod != http.MethodGet || req.RequestURL != "/api/v1/image?limit=1" {
+			t.Fatalf("unexpected request fields: %+v", req)
+		}
+		if req.ResponseSize != "5" || req.RemoteIP != "203.0.113.9" || req.UserAgent != "scaler-test" {
+			t.Fatalf("unexpected request fields: %+v", req)
+		}
+		if !strings.HasSuffix(req.Latency, "s") {
+			t.Fatalf("expected latency as a duration in seconds, got: %s", req.Latency)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	buf := captureLogs(t, SeverityWarning)
+
+	logJSON(SeverityInfo, LogEntry{Message: "quiet"})
+	if buf.Len() != 0 {
+		t.Fatalf("expected info to be dropped at warning level, got: %s", buf.String())
+	}
+
+	logJSON(SeverityError, LogEntry{Message: "loud"})
+	if buf.Len() == 0 {
+		t.Fatalf("expected error to be logged at warning level")
+	}
+}
+
+func TestWriteResponseOnlyLogsErrors(t *testing.T) {
+	type test struct {
+		status int
+		logged bool
+	}
+
+	tests := []test{
+		{status: http.StatusOK, logged: false},
+		{status: http.StatusCreated, logged: false},
+		{status: http.StatusNoContent, logged: false},
+		{status: http.StatusNotFound, logged: true},
+		{status: http.StatusInternalServerError, logged: true},
+	}
+
+	for _, c := range tests {
+		buf := captureLogs(t, SeverityDebug)
+
+		writeResponse(httptest.NewRecorder(), c.status, `{"text":"body"}`)
+
+		if got := buf.Len() > 0; got != c.logged {
+			t.Fatalf("status %d expected logged: %v, got: %v", c.status, c.logged, got)
+		}
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	type test struct {
+		input string
+		want  Severity
+	}
+
+	tests := []test{
+		{input: "debug", want: SeverityDebug},
+		{input: "INFO", want: SeverityInfo},
+		{input: "Warning", want: SeverityWarning},
+		{input: "error", want: SeverityError},
+	}
+
+	for _, c := range tests {
+		got, err := ParseSeverity(c.input)
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if !(c.want == got) {
+			t.Fatalf("expected: %v, got: %v", c.want, got)
+		}
+	}
+
+	if _, err := ParseSeverity("loud"); err == nil {
+		t.Fatalf("expected error for unknown level")
+	}
+}
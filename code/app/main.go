@@ -15,103 +15,680 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-)
 
-var cs CloudStorage
+	"scalar-attempt/api"
+)
 
 func main() {
-	port := os.Getenv("PORT")
-	bucket := os.Getenv("BUCKET")
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:], os.Stdout, os.Stderr))
+	}
 
-	if port == "" {
-		port = "8080"
+	cfg, err := LoadConfig(os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.apply()
+	if cfg.StaticDir != "" {
+		log.Printf("serving the frontend from %s", cfg.StaticDir)
 	}
 
-	fmt.Printf("Port: %s\n", port)
+	fmt.Printf("Port: %s\n", cfg.Port)
 
-	var err error
-	cs, err = NewCloudStorage(bucket)
+	var metrics *Metrics
+	if cfg.EnableMetrics {
+		metrics = NewMetrics()
+	}
+
+	var store Storage
+	var tenants []string
+	if len(cfg.Buckets) > 0 {
+		buckets, _ := parseBuckets(cfg.Buckets)
+		ts, err := openTenantStorage(cfg.StorageBackend, cfg.StorageRoot, buckets, metrics)
+		if err != nil {
+			log.Fatalf("failed to create storage: %v", err)
+		}
+		store, tenants = ts, ts.Tenants()
+		log.Printf("serving %d tenants, named in the %s header", len(tenants), tenantHeader)
+	} else if store, err = openStorage(cfg.StorageBackend, cfg.StorageRoot, cfg.Bucket, metrics); err != nil {
+		log.Fatalf("failed to create storage: %v", err)
+	}
+	if cfg.FirebaseProjectID != "" {
+		store = UserStorage(store)
+	}
+
+	tp, err := NewTracerProvider(context.Background())
 	if err != nil {
-		log.Printf("failed to create client: %v", err)
-		return
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+	if tp != nil {
+		store = TraceStorage(store)
+	}
+
+	if metrics != nil {
+		store = metrics.Storage(store)
+	}
+	// Reads share calls above the metrics, so that those only count the
+	// calls storage actually gets.
+	store = CoalesceStorage(store, metrics)
+
+	server := NewServer(store)
+	server.LookupInstance()
+	server.ServeConfig(cfg)
+	if cfg.ContentCacheBytes > 0 {
+		server.CacheContent(NewContentCache(cfg.ContentCacheBytes, cfg.ContentCacheMaxObjectBytes, metrics))
+	}
+
+	var recheck time.Duration
+	if cfg.StartupSelfTest {
+		recheck = cfg.SelfTestInterval
+		server.EnableSelfTest()
+		if err := server.SelfTest(context.Background()); err != nil {
+			store.Close()
+			log.Fatal(err)
+		}
+		log.Printf("storage self-test passed")
+	}
+
+	var pub *PubSubPublisher
+	if cfg.PubSubTopic != "" {
+		pub, err = NewPubSubPublisher(context.Background(), cfg.PubSubTopic)
+		if err != nil {
+			log.Fatalf("failed to set up pubsub: %v", err)
+		}
+		server.AddPublisher("pubsub", pub)
+		log.Printf("publishing image events to %s", cfg.PubSubTopic)
+	}
+
+	if cfg.GCSEvents {
+		tenants := map[string]string{cfg.Bucket: ""}
+		if len(cfg.Buckets) > 0 {
+			buckets, _ := parseBuckets(cfg.Buckets)
+			tenants = map[string]string{}
+			for tenant, bucket := range buckets {
+				tenants[bucket] = tenant
+			}
+		}
+		var v *OIDCVerifier
+		if cfg.GCSEventsAudience != "" {
+			v = NewOIDCVerifier(cfg.GCSEventsAudience)
+		}
+		server.ReceiveGCSEvents(tenants, cfg.FirebaseProjectID != "", v)
+		log.Printf("taking in notifications for %d bucket(s) at %s", len(tenants), gcsEventsPath)
+	}
+
+	var hooks *WebhookPublisher
+	if len(cfg.WebhookURLs) > 0 {
+		hooks = NewWebhookPublisher(cfg.WebhookURLs, cfg.WebhookSecret, metrics)
+		server.AddPublisher("webhook", hooks)
+		log.Printf("sending image events to %d webhook(s)", len(cfg.WebhookURLs))
+	}
+
+	if cfg.Moderation == "vision" {
+		m, err := NewVisionModerator(context.Background(), cfg.ModerationThreshold)
+		if err != nil {
+			log.Fatalf("failed to set up moderation: %v", err)
+		}
+		server.SetModerator(m, cfg.ModerationFailOpen)
+		log.Printf("moderating uploads with vision, rejecting at %s", cfg.ModerationThreshold)
+	}
+
+	if cfg.Labels == "vision" {
+		l, err := NewVisionLabeler(context.Background(), cfg.MaxLabels)
+		if err != nil {
+			log.Fatalf("failed to set up labelling: %v", err)
+		}
+		server.SetLabeler(l, cfg.LabelConcurrency)
+		log.Printf("labelling uploads with vision, %d at a time", cfg.LabelConcurrency)
+	}
+
+	if cfg.PlaceholderConcurrency > 0 {
+		server.EnablePlaceholders(cfg.PlaceholderConcurrency)
+	}
+
+	if cfg.Watermark != "" {
+		img, err := LoadWatermark(context.Background(), cfg.Watermark, store)
+		if err != nil {
+			log.Fatalf("failed to set up watermarking: %v", err)
+		}
+		server.SetWatermark(Watermark{
+			Image:    img,
+			Mode:     cfg.WatermarkMode,
+			Position: cfg.WatermarkPosition,
+			Opacity:  cfg.WatermarkOpacity,
+			Scale:    cfg.WatermarkScale,
+			MinSize:  cfg.WatermarkMinSize,
+		})
+		log.Printf("watermarking images on %s with %s", cfg.WatermarkMode, cfg.Watermark)
+	}
+
+	if cfg.HEIFConverter != "" {
+		c, err := NewCommandConverter(cfg.HEIFConverter)
+		if err != nil {
+			log.Fatalf("failed to set up HEIF conversion: %v", err)
+		}
+		server.SetHEIFConverter(c)
+		log.Printf("converting HEIC and HEIF uploads to JPEG with %s", c.Path)
+	}
+
+	if cfg.WebPEncoder != "" {
+		e, err := NewCommandWebPEncoder(cfg.WebPEncoder)
+		if err != nil {
+			log.Fatalf("failed to set up WebP encoding: %v", err)
+		}
+		server.SetWebPEncoder(e)
+		log.Printf("encoding WebP with %s", e.Path)
+	}
+
+	if cfg.ServedByHeader {
+		server.EnableServedBy()
+	}
+
+	if cfg.EnableLoad {
+		server.EnableLoad()
+		log.Printf("serving /api/v1/load, anyone who can reach it can keep the CPU busy")
+	}
+
+	if cfg.EnableChaos {
+		server.EnableChaos()
+		log.Printf("serving %s, requests can be made to fail on purpose", chaosPath)
+	}
+
+	if cfg.EnableGraphiQL {
+		server.EnableGraphiQL()
+		log.Printf("serving GraphiQL at %s", graphqlPath)
+	}
+
+	if cfg.ReadOnly {
+		server.SetMode(ModeReadOnly)
+		log.Printf("starting read-only, POST %s to allow writes again", modePath)
+	}
+
+	var limiter *RateLimiter
+	if cfg.RateLimitRPS > 0 || cfg.RateLimitWriteRPS > 0 {
+		reads := RateLimit{Rate: cfg.RateLimitRPS, Burst: cfg.RateLimitBurst}
+		writes := RateLimit{Rate: cfg.RateLimitWriteRPS, Burst: cfg.RateLimitWriteBurst}
+		limiter = NewRateLimiter(reads, writes)
+		server.Use(limiter.Middleware)
+	}
+
+	if cfg.MaxConcurrentRequests > 0 || cfg.MaxConcurrentUploads > 0 {
+		requests := ConcurrencyLimit{InFlight: cfg.MaxConcurrentRequests, Queue: cfg.ConcurrencyQueue}
+		uploads := ConcurrencyLimit{InFlight: cfg.MaxConcurrentUploads, Queue: cfg.UploadConcurrencyQueue}
+		server.LimitConcurrency(NewConcurrencyLimiter(requests, uploads, cfg.ConcurrencyQueueTimeout, metrics))
+		log.Printf("serving up to %d requests and %d uploads at once, 0 for no limit", requests.InFlight, uploads.InFlight)
+	}
+
+	if len(cfg.APIKeys) > 0 {
+		server.RequireAPIKey(cfg.APIKeys, cfg.RequireKeyForReads)
+		log.Printf("requiring an API key, %d configured", len(cfg.APIKeys))
+	}
+	if cfg.FirebaseProjectID != "" {
+		server.RequireFirebaseAuth(NewFirebaseVerifier(cfg.FirebaseProjectID))
+		log.Printf("requiring Firebase ID tokens for project %s, each user seeing only their own images", cfg.FirebaseProjectID)
+	}
+	// Tenants are only told apart once the caller is known, so that
+	// unknown tenants look the same as known ones to those without a key.
+	if len(tenants) > 0 {
+		server.ServeTenants(tenants)
+	}
+
+	if cfg.CompressionLevel != 0 {
+		server.EnableCompression(cfg.CompressionLevel, cfg.CompressionMinBytes)
+	}
+
+	server.EnableCORS(cfg.CORSAllowedOrigins, cfg.CORSAllowedHeaders, cfg.CORSAllowedMethods)
+	server.Use(accessLog, requestID)
+	if metrics != nil {
+		server.EnableMetrics(metrics)
+	}
+	if tp != nil {
+		server.EnableTracing(tp)
+	}
+
+	srv := &http.Server{
+		Handler:      server,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+	}
+	srv.RegisterOnShutdown(server.CloseEvents)
+
+	var certs *certReloader
+	switch {
+	case cfg.TLSCertFile != "":
+		if certs, err = newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			store.Close()
+			log.Fatal(err)
+		}
+		useTLS(srv, certs)
+		log.Printf("serving HTTPS with %s, send SIGHUP to reload it", cfg.TLSCertFile)
+	case cfg.EnableH2C:
+		useH2C(srv)
+		log.Printf("serving HTTP/2 without TLS")
+	}
+
+	ln, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		store.Close()
+		log.Fatalf("could not listen on port %s: %s", cfg.Port, err)
 	}
-	defer cs.Close()
 
-	router := mux.NewRouter().StrictSlash(true)
+	// gRPC is served on a port of its own and stopped along with srv,
+	// draining at the same time.
+	grpcDone := make(chan struct{})
+	gs := server.NewGRPCServer()
+	if cfg.GRPCPort != "" {
+		gln, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			store.Close()
+			log.Fatalf("could not listen on port %s: %s", cfg.GRPCPort, err)
+		}
+		go func() {
+			if err := gs.Serve(gln); err != nil {
+				log.Printf("gRPC server failed: %v", err)
+			}
+			close(grpcDone)
+		}()
+		srv.RegisterOnShutdown(func() { stopGRPC(gs, cfg.ShutdownTimeout) })
+		log.Printf("serving gRPC on port %s", cfg.GRPCPort)
+	} else {
+		close(grpcDone)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if certs != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go certs.watch(ctx, hup)
+	}
+	if janitorInterval > 0 {
+		for _, ctx := range server.tenantContexts(ctx) {
+			go server.runJanitor(ctx, janitorInterval)
+		}
+	}
+	if recheck > 0 {
+		go server.recheckStorage(ctx, recheck)
+	}
+	for _, ctx := range server.tenantContexts(ctx) {
+		go func(ctx context.Context) {
+			if err := server.IndexContents(ctx); err != nil {
+				log.Printf("could not index images: %v", err)
+			}
+		}(ctx)
+	}
+	if limiter != nil {
+		go limiter.Sweep(ctx, rateLimitSweepInterval)
+	}
+
+	err = serve(srv, ln, stop, cfg.ShutdownTimeout)
+	cancel()
+	// It is stopped on shutdown, but not if serving failed.
+	stopGRPC(gs, cfg.ShutdownTimeout)
+	<-grpcDone
+	server.WaitForEvents()
+	// Streams are closed on shutdown, but not if serving failed.
+	server.CloseEvents()
+	server.WaitForSockets()
+	server.WaitForLabels()
+	server.WaitForPlaceholders()
+	if hooks != nil {
+		hooks.Close()
+	}
+	if pub != nil {
+		if perr := pub.Close(); perr != nil {
+			log.Printf("failed to close pubsub: %v", perr)
+		}
+	}
+	if tp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		if terr := tp.Shutdown(ctx); terr != nil {
+			log.Printf("failed to flush traces: %v", terr)
+		}
+		cancel()
+	}
+	if cerr := store.Close(); cerr != nil {
+		log.Printf("failed to close storage: %v", cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseList splits a comma separated list, dropping blanks.
+func parseList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// openStorage returns the backend asked for, filesystem storage under root
+// or memory, or without one bucket, falling back to memory if that isn't set
+// either. Cloud Storage retries transient failures, counting them in
+// metrics.
+func openStorage(backend, root, bucket string, metrics *Metrics) (Storage, error) {
+	switch {
+	case backend == "filesystem":
+		fs, err := NewFileStorage(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create filesystem storage: %v", err)
+		}
+		log.Printf("using filesystem storage at %s", fs.Root)
+		return fs, nil
+	case backend == "memory" || bucket == "":
+		log.Printf("using in-memory storage, images will not persist")
+		return NewMemoryStorage(), nil
+	default:
+		cs, err := NewCloudStorage(bucket)
+		if err != nil {
+			return nil, err
+		}
+		return RetryStorage(&cs, metrics), nil
+	}
+}
+
+// openTenantStorage returns a TenantStorage with the backend asked for
+// for each tenant: a directory of its own under root, memory, or otherwise
+// its bucket in Cloud Storage.
+func openTenantStorage(backend, root string, buckets map[string]string, metrics *Metrics) (*TenantStorage, error) {
+	if backend != "filesystem" && backend != "memory" {
+		return NewCloudTenantStorage(buckets, metrics)
+	}
+
+	tenants := map[string]Storage{}
+	for tenant := range buckets {
+		if backend == "memory" {
+			tenants[tenant] = NewMemoryStorage()
+			continue
+		}
+		fs, err := NewFileStorage(filepath.Join(root, tenant))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create filesystem storage: %v", err)
+		}
+		tenants[tenant] = fs
+	}
+	if backend == "memory" {
+		log.Printf("using in-memory storage, images will not persist")
+	}
+
+	return NewTenantStorage(tenants, nil), nil
+}
+
+const (
+	readTimeout            = time.Minute
+	writeTimeout           = time.Minute
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// serve runs srv on ln until a signal arrives on stop, then stops accepting
+// connections and gives in-flight requests up to drain to finish. It serves
+// HTTPS if srv has a TLS config.
+func serve(srv *http.Server, ln net.Listener, stop <-chan os.Signal, drain time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errs <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errs <- srv.Serve(ln)
+	}()
 
-	router.HandleFunc("/api/v1/image", listHandler).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc("/api/v1/image", createHandler).Methods(http.MethodPost)
-	router.HandleFunc("/api/v1/image/{id}", readHandler).Methods(http.MethodGet)
-	router.HandleFunc("/api/v1/image/{id}", deleteHandler).Methods(http.MethodDelete)
-	router.HandleFunc("/api/v1/image/{id}", updateHandler).Methods(http.MethodPost, http.MethodPut)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Printf("received %s, shutting down", sig)
+	}
 
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
 
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With"})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"})
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("could not shut down cleanly: %s", err)
+	}
 
-	log.Fatal(http.ListenAndServe(":"+port, handlers.CORS(originsOk, headersOk, methodsOk)(router)))
+	return nil
 }
 
-func listHandler(w http.ResponseWriter, r *http.Request) {
-	fs, err := cs.List()
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+	// filesPerImage is the number of objects the Cloud Function writes for
+	// every upload: the original and its thumbnail.
+	filesPerImage = 2
+)
+
+func (s *Server) listHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultPageSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			writeError(w, invalidArgument(fmt.Errorf("invalid limit, want a positive integer got: %s", l)))
+			return
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	token := r.URL.Query().Get("pageToken")
+
+	order, err := parseSort(r.URL.Query())
 	if err != nil {
-		writeErrorMsg(w, fmt.Errorf("failed to list files: %v", err))
+		writeError(w, invalidArgument(err))
+		return
+	}
 
+	filter := listFilter{
+		prefix:    r.URL.Query().Get("prefix"),
+		q:         r.URL.Query().Get("q"),
+		label:     r.URL.Query().Get("label"),
+		tag:       r.URL.Query().Get("tag"),
+		delimiter: r.URL.Query().Get("delimiter"),
+	}
+
+	stream, err := streamed(r)
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	if stream {
+		if !order.native() || filter.delimiter != "" {
+			writeError(w, invalidArgument(errors.New("an ndjson listing is always in id order, without folders")))
+			return
+		}
+		s.streamList(w, r, filter)
 		return
 	}
 
-	is, err := NewImages(fs)
+	key := scopeOf(r.Context()) + "?" + listKey(r.URL.Query())
+	if r.URL.Query().Get("fresh") != "true" {
+		if page, listed, ok := s.lists.get(key); ok {
+			s.placeholdMissing(r.Context(), page.Images)
+			writePage(w, r, page, listed)
+			return
+		}
+	}
+
+	gen := s.lists.generation()
+	var page listedPage
+	if filter != (listFilter{prefix: filter.prefix}) || !order.native() {
+		page, err = s.sortedList(r.Context(), order, filter, limit, token)
+	} else {
+		page, err = s.storageList(r.Context(), filter.prefix, limit, token)
+	}
+	if err == ErrInvalidPageToken {
+		writeError(w, invalidArgument(fmt.Errorf("invalid pageToken: %s", token)))
+		return
+	}
 	if err != nil {
-		writeErrorMsg(w, fmt.Errorf("failed to convert files to images images: %v", err))
+		writeError(w, err)
 		return
 	}
+	s.lists.put(key, gen, page)
 
-	writeJSON(w, is, http.StatusOK)
-	return
+	s.placeholdMissing(r.Context(), page.Images)
+	writePage(w, r, page, time.Now())
 }
 
-func createHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(10 << 20)
-	// FormFile returns the first file for the given key `myFile`
-	// it also returns the FileHeader so we can get the Filename,
-	// the Header and the size of the file
-	file, handler, err := r.FormFile("myFile")
-	if err != nil {
-		writeErrorMsg(w, fmt.Errorf("error retrieving file: %v", err))
+// writePage answers with page, listed at listed. Clients are told how old
+// it is, and to check back rather than keep it, since it may be served
+// from the list cache, and how many objects were skipped making it.
+func writePage(w http.ResponseWriter, r *http.Request, page listedPage, listed time.Time) {
+	if listCacheTTL > 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(listed).Seconds())))
+	}
+	w.Header().Set(skippedHeader, strconv.Itoa(page.skipped))
+	if notModified(w, r, listETag(page.ImagePage), time.Time{}) {
 		return
 	}
-	defer file.Close()
 
-	mimemap := NewMimeMap([]string{"image/png", "image/jpeg", "image/gif"})
+	writeJSON(w, page.ImagePage, http.StatusOK)
+}
+
+// storageList lists a page of images in the order storage keeps them,
+// letting storage page through them.
+func (s *Server) storageList(ctx context.Context, prefix string, limit int, token string) (listedPage, error) {
+	fs, next, err := s.storage.List(ctx, prefix, limit*filesPerImage, token)
+	if err == ErrInvalidPageToken {
+		return listedPage{}, err
+	}
+	if err != nil {
+		return listedPage{}, fmt.Errorf("failed to list files: %w", err)
+	}
 
-	mimetype := handler.Header.Get("Content-Type")
+	is, skipped := listImages(fs)
+	return listedPage{ImagePage{Images: is, NextPageToken: next}, skipped}, nil
+}
 
-	if !mimemap.Valid(mimetype) {
-		mimelist := mimemap.List()
-		writeErrorMsg(w, fmt.Errorf("invalid image type, want one of %s got : %s", mimelist, mimetype))
+// sortedList lists images in an order storage can't give them in, or
+// filtered in a way it can't filter them, which means reading the whole
+// listing and paging through it here.
+func (s *Server) sortedList(ctx context.Context, order sortOrder, filter listFilter, limit int, token string) (listedPage, error) {
+	fs, err := s.allFiles(ctx, filter.prefix)
+	if err != nil {
+		return listedPage{}, fmt.Errorf("failed to list files: %w", err)
+	}
+	all, skipped := listImages(fs)
+	if filter.q != "" {
+		all = matching(all, filter.q)
+	}
+	if filter.label != "" {
+		all = labelled(all, filter.label)
+	}
+	if filter.tag != "" {
+		all = tagged(all, filter.tag)
+	}
+	var folders []string
+	if filter.delimiter != "" {
+		all, folders = splitFolders(all, filter.prefix, filter.delimiter)
+	}
+
+	is, next, err := order.page(all, limit, token)
+	if err != nil {
+		return listedPage{}, err
+	}
+
+	page := listedPage{ImagePage{Images: is, NextPageToken: next}, skipped}
+	if token == "" {
+		// Folders come once, with the first page.
+		page.Folders = folders
+	}
+
+	return page, nil
+}
+
+func (s *Server) createHandler(w http.ResponseWriter, r *http.Request) {
+	if isJSON(r) {
+		s.jsonUploadHandler(w, r)
 		return
 	}
 
-	if err := cs.Create(handler.Filename, file); err != nil {
-		writeErrorMsg(w, fmt.Errorf("image couldn't be created: %v", err))
+	staged, values, ok := s.stageUploads(w, r, "")
+	if !ok {
+		return
+	}
+	defer s.dropStaged(r.Context(), staged)
+	if len(staged) == 0 {
+		writeError(w, invalidArgument(errors.New("error retrieving file: no file in the form")))
 		return
 	}
 
-	writeResponse(w, http.StatusCreated, "")
+	opts := uploadOptions{
+		Overwrite: r.URL.Query().Get("overwrite") == "true",
+		Force:     r.URL.Query().Get("force") == "true",
+		KeepExif:  r.URL.Query().Get("keepExif") == "true",
+		Metadata:  readUserMetadata(nil),
+	}
+	// A ttl field wins over the header.
+	if err := opts.Metadata.setTTL(r.Header.Get(ttlHeader)); err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	if err := opts.Metadata.applyForm(values); err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+
+	if len(staged) == 1 {
+		img, status, err := s.storeStaged(r.Context(), staged[0], opts)
+		if err != nil {
+			writeUploadError(w, status, err)
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(img.Name)))
+		writeJSON(w, img, status)
+		return
+	}
+
+	results := UploadResults{}
+	status := http.StatusCreated
+	for _, u := range staged {
+		img, code, err := s.storeStaged(r.Context(), u, opts)
+		res := UploadResult{Name: u.Filename, Status: code}
+		if err != nil {
+			res.Error = err.Error()
+			status = http.StatusOK
+		} else {
+			res.Image = &img
+		}
+		results = append(results, res)
+	}
+
+	writeJSON(w, results, status)
 	return
 }
 
+// MimeMap is a set of MIME types. A type like image/* stands for every
+// subtype of image.
 type MimeMap map[string]bool
 
 func NewMimeMap(s []string) MimeMap {
@@ -122,81 +699,278 @@ func NewMimeMap(s []string) MimeMap {
 	return m
 }
 
+// Valid reports whether mimetype is in m, or matched by a wildcard in it.
 func (m MimeMap) Valid(mimetype string) bool {
-	_, ok := m[mimetype]
-	return ok
+	if m[mimetype] {
+		return true
+	}
+
+	major, _, ok := strings.Cut(mimetype, "/")
+	return ok && major != "" && m[major+"/*"]
 }
 
-func (m MimeMap) List() string {
-	var sb strings.Builder
-	for i := range m {
-		sb.WriteString(i)
-		sb.WriteString(", ")
+// Slice returns the types in m, sorted.
+func (m MimeMap) Slice() []string {
+	types := make([]string, 0, len(m))
+	for t := range m {
+		types = append(types, t)
 	}
+	sort.Strings(types)
+
+	return types
+}
 
-	return strings.TrimRight(sb.String(), ", ")
+// List returns the types in m, sorted and separated by commas, for people
+// to read.
+func (m MimeMap) List() string {
+	return strings.Join(m.Slice(), ", ")
 }
 
-func updateHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) updateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && !isMultipart(r) {
+		s.rawPutHandler(w, r)
+		return
+	}
+
 	id := mux.Vars(r)["id"]
-	r.ParseMultipartForm(10 << 20)
-	// FormFile returns the first file for the given key `myFile`
-	// it also returns the FileHeader so we can get the Filename,
-	// the Header and the size of the file
-	file, handler, err := r.FormFile("myFile")
+	generation, err := ifMatch(r)
 	if err != nil {
-		writeErrorMsg(w, fmt.Errorf("error retrieving file: %v", err))
+		writeError(w, err)
 		return
 	}
+	staged, values, ok := s.stageUploads(w, r, "myFile")
+	if !ok {
+		return
+	}
+	defer s.dropStaged(r.Context(), staged)
+	if len(staged) == 0 {
+		writeError(w, invalidArgument(errors.New("error retrieving file: no myFile in the form")))
+		return
+	}
+	upload := staged[0]
+	if upload.err != nil {
+		writeUploadError(w, upload.status, upload.err)
+		return
+	}
+	// The image keeps its tags and metadata, less any the form changes.
+	fs, err := s.storage.Read(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", id, err))
+		return
+	}
+	// Checking now saves the work of processing an upload that can't be
+	// stored. Storage checks again when it is.
+	if err := checkGeneration(fs, generation); err != nil {
+		writeError(w, err)
+		return
+	}
+	previous, _ := originalFile(fs)
+	um := readUserMetadata(previous.Metadata)
+	if err := um.applyForm(values); err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+
+	name, err := sanitizeFilename(upload.Filename)
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+
+	// The image keeps its id whatever the uploaded file was called.
+	file := newStagedFile(r.Context(), s.storage, upload.name)
 	defer file.Close()
+	_, status, err := s.storeObject(r.Context(), id+filepath.Ext(name), name, upload.ContentType, file, uploadOptions{
+		Overwrite:    true,
+		Force:        true,
+		Replace:      true,
+		KeepExif:     r.URL.Query().Get("keepExif") == "true",
+		Metadata:     um,
+		MD5:          upload.MD5,
+		IfGeneration: generation,
+	})
+	if status == http.StatusNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeUploadError(w, status, err)
+		return
+	}
 
-	if err := cs.Delete(id); err != nil {
-		writeErrorMsg(w, fmt.Errorf("error replacing file: %s", err))
+	msg := Message{Text: "image updated", Details: fmt.Sprintf("image id: %s", id)}
+	writeJSON(w, msg, http.StatusOK)
+}
+
+func (s *Server) readHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	fs, err := s.storage.Read(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", id, err))
 		return
 	}
 
-	if err := cs.Create(handler.Filename, file); err != nil {
-		writeErrorMsg(w, fmt.Errorf("image couldn't be created: %v", err))
+	is, _ := NewImages(fs)
+	if len(is) < 1 {
+		writeResponse(w, http.StatusNoContent, "")
+		return
+	}
+	// It only lasts until the janitor next comes round.
+	if expired(is[0], time.Now()) {
+		writeError(w, fmt.Errorf("image id: %s expired at %s: %w", id, is[0].Expires.Format(time.RFC3339), ErrExpired))
 		return
 	}
+	s.placeholdMissing(r.Context(), is[:1])
 
-	writeResponse(w, http.StatusOK, "")
-	return
+	if notModified(w, r, imageETag(is[0]), is[0].Updated) {
+		return
+	}
+
+	writeJSON(w, is[0], http.StatusOK)
 }
 
-func readHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) contentHandler(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	fs, err := cs.Read(id)
+	opts, err := parseResize(r.URL.Query())
 	if err != nil {
-		writeErrorMsg(w, fmt.Errorf("failed to read files %s: %v", id, err))
+		writeErrorMsg(w, http.StatusBadRequest, err)
+		return
+	}
+	if s.webp == nil && opts != nil && opts.Format == formatWebP {
+		writeError(w, notImplemented(errWebPDisabled))
+		return
+	}
+	if s.webp != nil {
+		// Browsers that take WebP get it unless a format is asked for, so
+		// what is served depends on Accept.
+		w.Header().Add("Vary", "Accept")
+		if (opts == nil || opts.Format == "") && acceptsType(r.Header.Get("Accept"), "image/webp") {
+			if opts == nil {
+				opts = &resizeOptions{Fit: fitInside}
+			}
+			opts.Format, opts.Quality, opts.Negotiated = formatWebP, defaultQuality, true
+		}
+	}
+	if s.servesWatermarked() {
+		// Only admins get images without the watermark, and they aren't
+		// for shared caches.
+		if r.URL.Query().Get("watermark") == "false" {
+			if key := r.Header.Get(apiKeyHeader); s.validKey == nil || key == "" || !s.validKey(key) {
+				writeErrorMsg(w, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			if opts == nil {
+				opts = &resizeOptions{Fit: fitInside}
+			}
+			opts.Watermark = s.watermark
+		}
+	}
+	if opts != nil {
+		s.resizedContent(w, r, id, *opts)
+		return
+	}
 
+	if s.content != nil {
+		s.cachedContentHandler(w, r, id)
 		return
 	}
 
-	is, err := NewImages(fs)
+	obj, err := s.storage.Open(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
 	if err != nil {
-		writeErrorMsg(w, fmt.Errorf("failed to convert files to images images: %v", err))
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to open image %s: %v", id, err))
 		return
 	}
-	if len(is) < 1 {
-		writeResponse(w, http.StatusNoContent, "")
+	defer obj.Close()
+
+	writeObject(w, r, obj)
+}
+
+// writeObject streams obj to w, with its checksums in hashHeader when they
+// are known. With ?download=true it is sent as an attachment named after
+// the original file. Clients that already have it get a 304 instead.
+func writeObject(w http.ResponseWriter, r *http.Request, obj *CSReader) {
+	if notModified(w, r, obj.ETag, obj.Updated) {
 		return
 	}
 
-	writeJSON(w, is[0], http.StatusOK)
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	if h := obj.Checksums.hashHeader(); h != "" {
+		w.Header().Set(hashHeader, h)
+	}
+	if r.URL.Query().Get("download") == "true" {
+		cd := mime.FormatMediaType("attachment", map[string]string{"filename": obj.Filename})
+		w.Header().Set("Content-Disposition", cd)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, obj); err != nil {
+		if r.Context().Err() == context.Canceled {
+			logJSON(SeverityDebug, LogEntry{Message: fmt.Sprintf("stopped streaming %s: request canceled", obj.Filename)})
+			return
+		}
+		weblog(fmt.Sprintf("error streaming %s: %s", obj.Filename, err))
+	}
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
+// deleteHandler moves an image to the trash, or with ?hard=true deletes it
+// for good.
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
+	generation, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	remove := s.trashImage
+	if r.URL.Query().Get("hard") == "true" {
+		remove = s.deleteImage
+	}
 
-	if err := cs.Delete(id); err != nil {
-		writeErrorMsg(w, err)
+	if err := remove(r.Context(), id, generation); err != nil {
+		if err == ErrNotFound {
+			writeNotFound(w, id)
+			return
+		}
+		writeError(w, err)
 		return
 	}
-	msg := Message{"image deleted", fmt.Sprintf("image id: %s", id)}
+	s.notify(r.Context(), ImageEvent{Action: actionDeleted, ID: id})
 
-	writeJSON(w, msg, http.StatusNoContent)
+	writeResponse(w, http.StatusNoContent, "")
+}
+
+// deleteImage deletes image id along with its thumbnail and cached variants,
+// on condition its original is at generation unless that is 0.
+func (s *Server) deleteImage(ctx context.Context, id string, generation int64) error {
+	if err := s.storage.Delete(ctx, id, generation); err != nil {
+		return err
+	}
+	s.contents.of(ctx).forget(id)
+
+	if err := s.storage.DeleteObject(ctx, thumbnailName(id)); err != nil && err != ErrNotFound {
+		weblog(fmt.Sprintf("error deleting thumbnail for %s: %s", id, err))
+	}
+	s.dropVariants(ctx, id)
+
+	return nil
 }
 
 // JSONProducer is an interface that spits out a JSON string version of itself
@@ -208,58 +982,95 @@ type JSONProducer interface {
 func writeJSON(w http.ResponseWriter, j JSONProducer, status int) {
 	json, err := j.JSON()
 	if err != nil {
-		writeErrorMsg(w, err)
+		writeResponse(w, http.StatusInternalServerError, `{"error":"could not marshal json for response"}`)
 		return
 	}
 	writeResponse(w, status, json)
 	return
 }
 
-func writeErrorMsg(w http.ResponseWriter, err error) {
-	s := fmt.Sprintf("{\"error\":\"%s\"}", err)
-	writeResponse(w, http.StatusInternalServerError, s)
-	return
+func writeNotFound(w http.ResponseWriter, id string) {
+	if wantsProblem(w) {
+		writeProblem(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("image id: %s", id))
+		return
+	}
+	msg := Message{Text: "not found", Details: fmt.Sprintf("image id: %s", id)}
+	writeJSON(w, msg, http.StatusNotFound)
 }
 
-func writeResponse(w http.ResponseWriter, status int, msg string) {
-	if status != http.StatusOK {
-		weblog(fmt.Sprintf(msg))
+// writeErrorMsg writes err with status, unless err is an apiError, which
+// says what status it should have.
+func writeErrorMsg(w http.ResponseWriter, status int, err error) {
+	code := errorCode(status)
+	var ae *apiError
+	if errors.As(err, &ae) {
+		status, code = ae.Status, ae.Code
+	}
+	if wantsProblem(w) {
+		writeProblem(w, status, code, err.Error())
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,access-control-allow-origin, access-control-allow-headers")
-	w.WriteHeader(status)
-	w.Write([]byte(msg))
-
+	// The id requestID set on the way in ties the error to its logs.
+	writeJSON(w, ErrorMessage{Error: err.Error(), Code: code, RequestID: w.Header().Get(requestIDHeader)}, status)
 	return
 }
 
-func weblog(msg string) {
-	log.Printf("Webserver : %s", msg)
+// writeError writes err with the status classify gives it.
+func writeError(w http.ResponseWriter, err error) {
+	writeErrorMsg(w, http.StatusInternalServerError, classify(err))
 }
 
-// Message is a structure for communicating additional data to API consumer.
-type Message struct {
-	Text    string `json:"text"`
-	Details string `json:"details"`
+// writeResponse writes msg with status. Server errors caused by the request
+// running out of time become 504s, and those caused by the client going
+// away are only worth a debug line. Only errors are logged. A 204 goes
+// without msg, since it can't have a body.
+func writeResponse(w http.ResponseWriter, status int, msg string) {
+	writeResponseType(w, status, "application/json; charset=utf-8", msg)
 }
 
-// JSON marshalls the content of a todo to json.
-func (m Message) JSON() (string, error) {
-	bytes, err := json.Marshal(m)
-	if err != nil {
-		return "", fmt.Errorf("could not marshal json for response: %s", err)
+// writeResponseType is writeResponse for a body of contentType.
+func writeResponseType(w http.ResponseWriter, status int, contentType, msg string) {
+	canceled := false
+	if status >= http.StatusInternalServerError {
+		switch requestErr(w) {
+		case context.DeadlineExceeded:
+			status = http.StatusGatewayTimeout
+		case context.Canceled:
+			canceled = true
+		}
 	}
 
-	return string(bytes), nil
-}
+	labels := requestLabels(w.Header().Get(requestIDHeader))
+	switch {
+	case canceled:
+		logJSON(SeverityDebug, LogEntry{Message: fmt.Sprintf("Webserver : request canceled: %s", msg), Labels: labels})
+	case status >= http.StatusInternalServerError:
+		logJSON(SeverityError, LogEntry{Message: fmt.Sprintf("Webserver : %s", msg), Labels: labels})
+	case status >= http.StatusBadRequest:
+		logJSON(SeverityWarning, LogEntry{Message: fmt.Sprintf("Webserver : %s", msg), Labels: labels})
+	}
 
-// JSONBytes marshalls the content of a todo to json as a byte array.
-func (m Message) JSONBytes() ([]byte, error) {
-	bytes, err := json.Marshal(m)
-	if err != nil {
-		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,access-control-allow-origin, access-control-allow-headers")
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
 	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write([]byte(msg))
+
+	return
+}
 
-	return bytes, nil
+func weblog(msg string) {
+	logJSON(SeverityError, LogEntry{Message: fmt.Sprintf("Webserver : %s", msg)})
 }
+
+// ErrorMessage, Message and Problem are shared with clients of the API.
+type (
+	ErrorMessage = api.ErrorMessage
+	Message      = api.Message
+	InvalidType  = api.InvalidType
+	Problem      = api.Problem
+)
@@ -0,0 +1,471 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Keep expected error responses from cluttering the test output.
+	logOutput = io.Discard
+	os.Exit(m.Run())
+}
+
+// testPart is one file in a multipart request built by newMultipartRequest.
+type testPart struct {
+	field    string
+	filename string
+	mimetype string
+	content  []byte
+}
+
+// newUploadRequest builds a multipart request carrying a single myFile part
+// with the given Content-Type. An empty mimetype omits the header entirely.
+func newUploadRequest(t *testing.T, method, target, filename, mimetype string, content []byte) *http.Request {
+	return newMultipartRequest(t, method, target, testPart{"myFile", filename, mimetype, content})
+}
+
+func newMultipartRequest(t *testing.T, method, target string, parts ...testPart) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for _, p := range parts {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, p.field, p.filename))
+		if p.mimetype != "" {
+			h.Set("Content-Type", p.mimetype)
+		}
+
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatalf("could not create multipart part: %s", err)
+		}
+		if _, err := part.Write(p.content); err != nil {
+			t.Fatalf("could not write multipart part: %s", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("could not close multipart writer: %s", err)
+	}
+
+	r := httptest.NewRequest(method, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUpdateHandlerMimeType(t *testing.T) {
+	type test struct {
+		mimetype string
+		content  []byte
+		want     int
+	}
+
+	tests := []test{
+		{mimetype: "application/octet-stream", content: []byte("MZ"), want: http.StatusUnsupportedMediaType},
+		{mimetype: "application/x-msdownload", content: []byte("MZ"), want: http.StatusUnsupportedMediaType},
+		{mimetype: "", content: []byte("MZ"), want: http.StatusUnsupportedMediaType},
+		{mimetype: "image/png", content: []byte("MZ"), want: http.StatusUnsupportedMediaType},
+		{mimetype: "image/png", content: []byte("GIF89a"), want: http.StatusUnsupportedMediaType},
+		{mimetype: "", content: []byte("GIF89a"), want: http.StatusUnsupportedMediaType},
+	}
+
+	for _, c := range tests {
+		r := newUploadRequest(t, http.MethodPut, "/api/v1/image/RetoColt", "RetoColt.exe", c.mimetype, c.content)
+		w := httptest.NewRecorder()
+
+		NewServer(nil).ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("expected: %v, got: %v", c.want, w.Code)
+		}
+
+		msg := InvalidType{}
+		if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+			t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+		}
+		if msg.Details == "" {
+			t.Fatalf("expected details, got none")
+		}
+		if want := []string{"image/gif", "image/jpeg", "image/png"}; !reflect.DeepEqual(msg.Allowed, want) {
+			t.Fatalf("expected: %v, got: %v", want, msg.Allowed)
+		}
+	}
+}
+
+func TestMimeMap(t *testing.T) {
+	m := NewMimeMap([]string{"image/png", "application/pdf", "image/*", "video/mp4"})
+
+	if got, want := m.Slice(), []string{"application/pdf", "image/*", "image/png", "video/mp4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected: %v, got: %v", want, got)
+	}
+	if got, want := m.List(), "application/pdf, image/*, image/png, video/mp4"; got != want {
+		t.Fatalf("expected: %q, got: %q", want, got)
+	}
+
+	tests := map[string]bool{
+		"image/png":       true,
+		"image/webp":      true,
+		"application/pdf": true,
+		"video/mp4":       true,
+		"video/webm":      false,
+		"text/plain":      false,
+		"image":           false,
+		"":                false,
+	}
+	for mimetype, want := range tests {
+		if got := m.Valid(mimetype); got != want {
+			t.Fatalf("%q: expected: %v, got: %v", mimetype, want, got)
+		}
+	}
+}
+
+func TestParseMimeTypes(t *testing.T) {
+	type test struct {
+		input   string
+		want    []string
+		wantErr bool
+	}
+
+	tests := []test{
+		{input: "image/png", want: []string{"image/png"}},
+		{input: "image/png, image/webp,image/avif", want: []string{"image/png", "image/webp", "image/avif"}},
+		{input: "image/PNG", want: []string{"image/png"}},
+		{input: "image/*, image/svg+xml", want: []string{"image/*", "image/svg+xml"}},
+		{input: "png", wantErr: true},
+		{input: " , ", wantErr: true},
+	}
+
+	for _, c := range tests {
+		got, err := parseMimeTypes(c.input)
+		if c.wantErr {
+			if err == nil {
+				t.Fatalf("expected error for %q, got: %v", c.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected no error for %q, got: %s", c.input, err)
+		}
+		if !reflect.DeepEqual(c.want, got) {
+			t.Fatalf("expected: %v, got: %v", c.want, got)
+		}
+	}
+}
+
+func TestUpdateHandlerTooLarge(t *testing.T) {
+	old := maxUploadBytes
+	maxUploadBytes = 1024
+	defer func() { maxUploadBytes = old }()
+
+	content := append([]byte("GIF89a"), make([]byte, 4096)...)
+	r := newUploadRequest(t, http.MethodPut, "/api/v1/image/RetoColt", "RetoColt.gif", "image/gif", content)
+	w := httptest.NewRecorder()
+
+	NewServer(nil).ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected: %v, got: %v", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestHandlersWithMemoryStorage(t *testing.T) {
+	type test struct {
+		method string
+		target string
+		want   int
+	}
+
+	tests := []test{
+		{method: http.MethodGet, target: "/api/v1/image", want: http.StatusOK},
+		{method: http.MethodGet, target: "/api/v1/image?limit=0", want: http.StatusBadRequest},
+		{method: http.MethodGet, target: "/api/v1/image?pageToken=%25%25", want: http.StatusBadRequest},
+		{method: http.MethodGet, target: "/api/v1/image/RetoColt", want: http.StatusOK},
+		{method: http.MethodGet, target: "/api/v1/image/ColtReto", want: http.StatusNotFound},
+		{method: http.MethodGet, target: "/api/v1/image/RetoColt/content", want: http.StatusOK},
+		{method: http.MethodGet, target: "/api/v1/image/ColtReto/content", want: http.StatusNotFound},
+		{method: http.MethodDelete, target: "/api/v1/image/ColtReto", want: http.StatusNotFound},
+		{method: http.MethodDelete, target: "/api/v1/image/RetoColt", want: http.StatusNoContent},
+	}
+
+	server := NewServer(newTestMemoryStorage(t, "RetoColt.png"))
+
+	for _, c := range tests {
+		r := httptest.NewRequest(c.method, c.target, nil)
+		w := httptest.NewRecorder()
+
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("%s %s expected: %v, got: %v", c.method, c.target, c.want, w.Code)
+		}
+	}
+}
+
+func TestDeleteHandlerNoContent(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png", "b.png"))
+
+	for _, target := range []string{"/api/v1/image/a", "/api/v1/image/b?hard=true"} {
+		buf := captureLogs(t, SeverityDebug)
+		r := httptest.NewRequest(http.MethodDelete, target, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("%s expected: %v, got: %v", target, http.StatusNoContent, w.Code)
+		}
+		if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+			t.Fatalf("%s expected no body, got: %q with type %q", target, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+		if strings.Contains(buf.String(), "Webserver") {
+			t.Fatalf("%s expected a success not to be logged, got: %s", target, buf.String())
+		}
+	}
+}
+
+func TestCreateAndListWithMemoryStorage(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "RetoColt.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	if got := w.Header().Get("Location"); got != "/api/v1/image/RetoColt" {
+		t.Fatalf("expected: %v, got: %v", "/api/v1/image/RetoColt", got)
+	}
+
+	created := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+
+	want := Image{
+		ID:           "RetoColt",
+		Name:         "RetoColt",
+		OriginalName: "RetoColt.png",
+		Original:     "/api/v1/image/RetoColt/content",
+		Thumbnail:    "/api/v1/image/RetoColt/content",
+		ThumbnailURL: "/api/v1/image/RetoColt/thumbnail",
+		Content:      "/api/v1/image/RetoColt/content",
+		SizeBytes:    int64(len(testPNG(t))),
+		ContentType:  "image/png",
+		Width:        906,
+		Height:       1080,
+		MD5:          testPNGSums.MD5,
+		CRC32C:       testPNGSums.CRC32C,
+	}
+	if created.Created.IsZero() || created.Updated.IsZero() || created.Generation == 0 {
+		t.Fatalf("expected timestamps and a generation, got: %+v", created)
+	}
+	created.Created, created.Updated, created.Generation = time.Time{}, time.Time{}, 0
+	if !reflect.DeepEqual(want, created) {
+		t.Fatalf("expected: %+v, got: %+v", want, created)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	page := ImagePage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+
+	if len(page.Images) != 1 || page.Images[0].Name != "RetoColt" {
+		t.Fatalf("expected: %v, got: %v", "[RetoColt]", page.Images)
+	}
+}
+
+func TestImageDimensions(t *testing.T) {
+	type test struct {
+		metadata map[string]string
+		want     string
+	}
+
+	tests := []test{
+		{metadata: map[string]string{"width": "640", "height": "480"}, want: `"width":640,"height":480`},
+		{metadata: nil, want: ""},
+		{metadata: map[string]string{"width": "wide"}, want: ""},
+	}
+
+	for _, c := range tests {
+		img := NewImage(CSFile{Name: "processed/a/original.png", Metadata: c.metadata})
+
+		got, err := img.JSON()
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if c.want == "" && strings.Contains(got, "width") {
+			t.Fatalf("expected no dimensions, got: %s", got)
+		}
+		if !strings.Contains(got, c.want) {
+			t.Fatalf("expected: %s, got: %s", c.want, got)
+		}
+	}
+}
+
+func TestServeDrainsOnSignal(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(&http.Server{Handler: handler}, ln, stop, 5*time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		results <- result{string(b), err}
+	}()
+
+	<-started
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("could not send signal: %s", err)
+	}
+
+	if err := <-served; err != nil {
+		t.Fatalf("expected clean shutdown, got: %s", err)
+	}
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			t.Fatalf("expected slow request to complete, got: %s", res.err)
+		}
+		if res.body != "done" {
+			t.Fatalf("expected: %v, got: %v", "done", res.body)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected slow request to complete before serve returned")
+	}
+}
+
+func TestCreateConflictWithMemoryStorage(t *testing.T) {
+	type test struct {
+		target string
+		want   int
+	}
+
+	tests := []test{
+		{target: "/api/v1/image", want: http.StatusCreated},
+		{target: "/api/v1/image", want: http.StatusOK},
+		{target: "/api/v1/image?force=true", want: http.StatusConflict},
+		{target: "/api/v1/image?overwrite=true", want: http.StatusCreated},
+	}
+
+	server := NewServer(NewMemoryStorage())
+
+	for _, c := range tests {
+		r := newUploadRequest(t, http.MethodPost, c.target, "RetoColt.png", "image/png", testPNG(t))
+		w := httptest.NewRecorder()
+
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("%s expected: %v, got: %v", c.target, c.want, w.Code)
+		}
+	}
+}
+
+func TestWriteErrorMsgEncoding(t *testing.T) {
+	type test struct {
+		err    error
+		status int
+	}
+
+	tests := []test{
+		{err: fmt.Errorf(`googleapi: Error 403: "svc@x" does not have storage.objects.list`), status: http.StatusForbidden},
+		{err: fmt.Errorf("line one\nline two\ttabbed"), status: http.StatusInternalServerError},
+		{err: fmt.Errorf(`C:\path\to\file "quoted" </script>`), status: http.StatusBadRequest},
+	}
+
+	for _, c := range tests {
+		buf := captureLogs(t, SeverityDebug)
+		w := httptest.NewRecorder()
+
+		writeErrorMsg(w, c.status, c.err)
+
+		if w.Code != c.status {
+			t.Fatalf("expected: %v, got: %v", c.status, w.Code)
+		}
+
+		got := ErrorMessage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+		}
+		if got.Error != c.err.Error() {
+			t.Fatalf("expected: %v, got: %v", c.err.Error(), got.Error)
+		}
+
+		if !json.Valid(bytes.TrimSpace(buf.Bytes())) {
+			t.Fatalf("expected a valid structured log line, got: %s", buf.String())
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	got := parseList(" one, two,,three ,")
+	want := []string{"one", "two", "three"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected: %v, got: %v", want, got)
+	}
+
+	if got := parseList(""); len(got) != 0 {
+		t.Fatalf("expected no keys, got: %v", got)
+	}
+}
@@ -0,0 +1,650 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a Storage that keeps everything in process memory. It is
+// meant for tests and local development without GCP credentials. There is no
+// Cloud Function watching it, so uploads are stored directly in the
+// processed layout that the function would otherwise produce, with the
+// original standing in for its own thumbnail.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	// versions holds the objects that have been overwritten or removed,
+	// by name, once versioning is enabled.
+	versions map[string][]memoryObject
+}
+
+type memoryObject struct {
+	data        []byte
+	contentType string
+	metadata    map[string]string
+	created     time.Time
+	md5         []byte
+	crc32c      uint32
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string]memoryObject)}
+}
+
+// EnableVersioning keeps the objects that are overwritten or removed from
+// now on, as a bucket with object versioning does.
+func (ms *MemoryStorage) EnableVersioning() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.versions == nil {
+		ms.versions = make(map[string][]memoryObject)
+	}
+}
+
+// Close is a no-op, there is nothing to release.
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
+
+// Ping always succeeds, memory is always within reach.
+func (ms *MemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+// List returns a page of processed objects for images whose ids start with
+// prefix, in lexical order, the same order Cloud Storage returns them in.
+func (ms *MemoryStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	names, next, err := pageNames(ms.names("processed/"+prefix), pageSize, pageToken)
+	if err != nil {
+		return CSFiles{}, "", err
+	}
+
+	return ms.files(names), next, nil
+}
+
+// Walk calls fn with each processed object of the images whose ids start
+// with prefix, as they were when it was called.
+func (ms *MemoryStorage) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	ms.mu.RLock()
+	fs := ms.files(ms.names("processed/" + prefix))
+	ms.mu.RUnlock()
+
+	for _, f := range fs {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read returns all of the objects stored for image id.
+func (ms *MemoryStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	names := ms.imageNames(id)
+	if len(names) == 0 {
+		return CSFiles{}, ErrNotFound
+	}
+
+	return ms.files(names), nil
+}
+
+// Open returns a reader over the original image stored for id.
+func (ms *MemoryStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	ms.mu.RLock()
+	names := ms.imageNames(id)
+	ms.mu.RUnlock()
+
+	for _, name := range names {
+		if strings.Index(name, "original.") < 0 {
+			continue
+		}
+
+		cr, err := ms.OpenObject(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		cr.Filename = uploadName(id, name, cr.Metadata)
+		return cr, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// Versions lists the generations of the original of image id that are
+// kept, live or not.
+func (ms *MemoryStorage) Versions(ctx context.Context, id string) (CSFiles, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.versions == nil {
+		return nil, ErrVersioningDisabled
+	}
+
+	fs := CSFiles{}
+	for _, name := range ms.imageNames(id) {
+		if strings.HasPrefix(path.Base(name), "original.") {
+			fs = append(fs, objectFile(name, ms.objects[name]))
+		}
+	}
+	for name, objs := range ms.versions {
+		if path.Dir(name)+"/" != imageDir(id) || !strings.HasPrefix(path.Base(name), "original.") {
+			continue
+		}
+		for _, obj := range objs {
+			fs = append(fs, objectFile(name, obj))
+		}
+	}
+	if len(fs) == 0 {
+		return nil, ErrNotFound
+	}
+	sortGenerations(fs)
+
+	return fs, nil
+}
+
+// OpenVersion returns a reader over generation of the original of image
+// id, live or not.
+func (ms *MemoryStorage) OpenVersion(ctx context.Context, id string, generation int64) (*CSReader, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.versions == nil {
+		return nil, ErrVersioningDisabled
+	}
+
+	objs := map[string][]memoryObject{}
+	for _, name := range ms.imageNames(id) {
+		objs[name] = []memoryObject{ms.objects[name]}
+	}
+	for name, old := range ms.versions {
+		if path.Dir(name)+"/" == imageDir(id) {
+			objs[name] = append(objs[name], old...)
+		}
+	}
+	for name, versions := range objs {
+		if !strings.HasPrefix(path.Base(name), "original.") {
+			continue
+		}
+		for _, obj := range versions {
+			if obj.created.UnixNano() != generation {
+				continue
+			}
+			cr := &CSReader{
+				ReadCloser:  io.NopCloser(bytes.NewReader(obj.data)),
+				Filename:    uploadName(id, name, obj.metadata),
+				ContentType: obj.contentType,
+				Size:        int64(len(obj.data)),
+				ETag:        objectETag(obj.md5, 0),
+				Checksums:   newChecksums(obj.md5, obj.crc32c, true),
+				Updated:     obj.created,
+				Metadata:    copyMetadata(obj.metadata),
+			}
+			return cr, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// SignedURL has nothing to sign, so it hands out the content endpoint
+// instead.
+func (ms *MemoryStorage) SignedURL(ctx context.Context, id string, expires time.Time) (string, error) {
+	if _, err := ms.Read(ctx, id); err != nil {
+		return "", err
+	}
+
+	return localSignedURL(id, expires), nil
+}
+
+// SignedUploadURL hands out the app's own upload endpoint, there being no
+// bucket to upload to.
+func (ms *MemoryStorage) SignedUploadURL(ctx context.Context, name, contentType string, expires time.Time) (string, error) {
+	return localUploadURL(name, expires), nil
+}
+
+// Create stores file as a new image named after its base name.
+func (ms *MemoryStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	ext := filepath.Ext(name)
+	id := imageID(name)
+
+	obj, err := newMemoryObject(file, opts.Metadata)
+	if err != nil {
+		return CSFile{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	existing := ms.imageNames(id)
+	if len(existing) > 0 && !opts.Overwrite {
+		return CSFile{}, ErrConflict
+	}
+	if err := checkGeneration(ms.files(existing), opts.IfGeneration); err != nil {
+		return CSFile{}, err
+	}
+	for _, name := range existing {
+		ms.remove(name)
+	}
+
+	ms.store(id, ext, obj)
+
+	return ms.files([]string{originalName(name)})[0], nil
+}
+
+// Replace swaps the contents of image id for file.
+func (ms *MemoryStorage) Replace(ctx context.Context, id, filename string, file multipart.File, metadata map[string]string, generation int64) error {
+	ext := filepath.Ext(filename)
+
+	obj, err := newMemoryObject(file, metadata)
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	names := ms.imageNames(id)
+	if len(names) == 0 {
+		return ErrNotFound
+	}
+	if err := checkGeneration(ms.files(names), generation); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		ms.remove(name)
+	}
+	ms.store(id, ext, obj)
+
+	return nil
+}
+
+// Delete removes all of the objects stored for image id.
+func (ms *MemoryStorage) Delete(ctx context.Context, id string, generation int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	names := ms.imageNames(id)
+	if len(names) == 0 {
+		return ErrNotFound
+	}
+	if err := checkGeneration(ms.files(names), generation); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		ms.remove(name)
+	}
+
+	return nil
+}
+
+// Rename moves the objects of image id to newID.
+func (ms *MemoryStorage) Rename(ctx context.Context, id, newID string, overwrite bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if err := ms.clearTarget(id, newID, overwrite); err != nil {
+		return err
+	}
+
+	return ms.move(imageDir(id), imageDir(newID), func(map[string]string) {})
+}
+
+// Copy copies the objects of image id to newID.
+func (ms *MemoryStorage) Copy(ctx context.Context, id, newID string, overwrite bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if err := ms.clearTarget(id, newID, overwrite); err != nil {
+		return err
+	}
+
+	from, to := imageDir(id), imageDir(newID)
+	now := time.Now()
+	for _, name := range ms.imageNames(id) {
+		obj := ms.objects[name]
+		obj.metadata = copyMetadata(obj.metadata)
+		obj.created = now
+		ms.objects[to+strings.TrimPrefix(name, from)] = obj
+	}
+
+	return nil
+}
+
+// clearTarget makes way for image id to be renamed or copied to newID,
+// checking that there is an image id, and that there isn't one called
+// newID unless overwrite allows it to be deleted. The caller must hold
+// ms.mu.
+func (ms *MemoryStorage) clearTarget(id, newID string, overwrite bool) error {
+	if len(ms.imageNames(id)) == 0 {
+		return ErrNotFound
+	}
+	if existing := ms.imageNames(newID); len(existing) > 0 {
+		if !overwrite {
+			return ErrConflict
+		}
+		for _, name := range existing {
+			ms.remove(name)
+		}
+	}
+
+	return nil
+}
+
+// Trash moves the objects of image id under the trash prefix, stamped with
+// the deletion time.
+func (ms *MemoryStorage) Trash(ctx context.Context, id string, deleted time.Time, generation int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if names := ms.imageNames(id); len(names) > 0 {
+		if err := checkGeneration(ms.files(names), generation); err != nil {
+			return err
+		}
+	}
+
+	return ms.move(imageDir(id), trashDir(id)+"/", func(m map[string]string) {
+		m[deletedKey] = deleted.UTC().Format(time.RFC3339)
+	})
+}
+
+// Restore moves the objects of trashed image id back to where they were.
+func (ms *MemoryStorage) Restore(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if len(ms.imageNames(id)) > 0 {
+		return ErrConflict
+	}
+
+	return ms.move(trashDir(id)+"/", imageDir(id), func(m map[string]string) {
+		delete(m, deletedKey)
+	})
+}
+
+// ListTrash returns every object in the trash.
+func (ms *MemoryStorage) ListTrash(ctx context.Context) (CSFiles, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.files(ms.names(trashPrefix + "/")), nil
+}
+
+// Purge removes the objects of trashed image id.
+func (ms *MemoryStorage) Purge(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	names := ownObjects(trashDir(id)+"/", ms.names(trashDir(id)+"/"))
+	if len(names) == 0 {
+		return ErrNotFound
+	}
+
+	for _, name := range names {
+		ms.remove(name)
+	}
+
+	return nil
+}
+
+// PutObject writes r to the object called name.
+func (ms *MemoryStorage) PutObject(ctx context.Context, name string, r io.Reader, contentType string) error {
+	obj, err := newMemoryObject(r, nil)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		obj.contentType = contentType
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.objects[name] = obj
+
+	return nil
+}
+
+// OpenObject returns a reader over the object called name.
+func (ms *MemoryStorage) OpenObject(ctx context.Context, name string) (*CSReader, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	obj, ok := ms.objects[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	cr := &CSReader{
+		ReadCloser:  io.NopCloser(bytes.NewReader(obj.data)),
+		Filename:    filepath.Base(name),
+		ContentType: obj.contentType,
+		Size:        int64(len(obj.data)),
+		ETag:        objectETag(obj.md5, 0),
+		Checksums:   newChecksums(obj.md5, obj.crc32c, true),
+		Updated:     obj.created,
+		Metadata:    copyMetadata(obj.metadata),
+	}
+	return cr, nil
+}
+
+// UpdateMetadata merges metadata into that of the object called name.
+func (ms *MemoryStorage) UpdateMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	obj, ok := ms.objects[name]
+	if !ok {
+		return ErrNotFound
+	}
+	// The map may be shared with the thumbnail stored from the same upload.
+	obj.metadata = copyMetadata(obj.metadata)
+	for k, v := range metadata {
+		obj.metadata[k] = v
+		if v == "" {
+			delete(obj.metadata, k)
+		}
+	}
+	ms.objects[name] = obj
+
+	return nil
+}
+
+// DeleteObject removes the object called name.
+func (ms *MemoryStorage) DeleteObject(ctx context.Context, name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.objects[name]; !ok {
+		return ErrNotFound
+	}
+	ms.remove(name)
+
+	return nil
+}
+
+// ListObjects returns every object under dir.
+func (ms *MemoryStorage) ListObjects(ctx context.Context, dir string) (CSFiles, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.files(ms.names(dir + "/")), nil
+}
+
+// DeleteObjects removes every object under dir.
+func (ms *MemoryStorage) DeleteObjects(ctx context.Context, dir string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, name := range ms.names(dir + "/") {
+		ms.remove(name)
+	}
+
+	return nil
+}
+
+// remove deletes the object called name, keeping it as an old version if
+// versioning is enabled. The caller must hold ms.mu.
+func (ms *MemoryStorage) remove(name string) {
+	if obj, ok := ms.objects[name]; ok && ms.versions != nil {
+		ms.versions[name] = append(ms.versions[name], obj)
+	}
+	delete(ms.objects, name)
+}
+
+// store writes obj as both the original and thumbnail of image id. The
+// caller must hold ms.mu.
+func (ms *MemoryStorage) store(id, ext string, obj memoryObject) {
+	ms.objects[fmt.Sprintf("processed/%s/original%s", id, ext)] = obj
+	ms.objects[fmt.Sprintf("processed/%s/thumbnail%s", id, ext)] = obj
+}
+
+// move renames every object directly under from to the same name under
+// to, letting edit change its metadata on the way. The caller must hold
+// ms.mu.
+func (ms *MemoryStorage) move(from, to string, edit func(map[string]string)) error {
+	names := ownObjects(from, ms.names(from))
+	if len(names) == 0 {
+		return ErrNotFound
+	}
+
+	for _, name := range names {
+		obj := ms.objects[name]
+		obj.metadata = copyMetadata(obj.metadata)
+		edit(obj.metadata)
+		ms.objects[to+strings.TrimPrefix(name, from)] = obj
+		ms.remove(name)
+	}
+
+	return nil
+}
+
+// imageNames returns the sorted names of the objects of image id, leaving
+// out any images nested under it. The caller must hold ms.mu.
+func (ms *MemoryStorage) imageNames(id string) []string {
+	return ownObjects(imageDir(id), ms.names(imageDir(id)))
+}
+
+// names returns the sorted names of every object starting with prefix. The
+// caller must hold ms.mu.
+func (ms *MemoryStorage) names(prefix string) []string {
+	names := []string{}
+	for name := range ms.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// files converts object names to CSFiles. The caller must hold ms.mu.
+func (ms *MemoryStorage) files(names []string) CSFiles {
+	fs := CSFiles{}
+	for _, name := range names {
+		fs = append(fs, objectFile(name, ms.objects[name]))
+	}
+
+	return fs
+}
+
+// objectFile converts obj, called name, to a CSFile.
+func objectFile(name string, obj memoryObject) CSFile {
+	f := CSFile{
+		Name:        name,
+		URL:         &url.URL{Path: name},
+		Size:        int64(len(obj.data)),
+		ContentType: obj.contentType,
+		Created:     obj.created,
+		Updated:     obj.created,
+		ETag:        objectETag(obj.md5, 0),
+		Generation:  obj.created.UnixNano(),
+		Checksums:   newChecksums(obj.md5, obj.crc32c, true),
+	}
+	if len(obj.metadata) > 0 {
+		f.Metadata = copyMetadata(obj.metadata)
+	}
+
+	return f
+}
+
+func newMemoryObject(r io.Reader, metadata map[string]string) (memoryObject, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return memoryObject{}, fmt.Errorf("could not read file: %s", err)
+	}
+
+	sum := md5.Sum(data)
+	obj := memoryObject{
+		data:        data,
+		contentType: http.DetectContentType(data),
+		metadata:    copyMetadata(metadata),
+		created:     time.Now(),
+		md5:         sum[:],
+		crc32c:      crc32.Checksum(data, castagnoli),
+	}
+
+	return obj, nil
+}
+
+// pageNames picks a page out of a sorted list of object names for backends
+// that don't have their own paging. The token is the name the page starts
+// at, encoded so that clients treat it as opaque.
+func pageNames(names []string, pageSize int, pageToken string) ([]string, string, error) {
+	start := ""
+	if pageToken != "" {
+		b, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, "", ErrInvalidPageToken
+		}
+		start = string(b)
+	}
+
+	i := sort.SearchStrings(names, start)
+
+	next := ""
+	end := len(names)
+	if pageSize > 0 && i+pageSize < end {
+		end = i + pageSize
+		next = base64.RawURLEncoding.EncodeToString([]byte(names[end]))
+	}
+
+	return names[i:end], next, nil
+}
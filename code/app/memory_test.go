@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newTestMemoryStorage(t *testing.T, names ...string) *MemoryStorage {
+	ms := NewMemoryStorage()
+	for _, name := range names {
+		if _, err := ms.Create(context.Background(), name, newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+			t.Fatalf("could not create %s: %s", name, err)
+		}
+	}
+
+	return ms
+}
+
+func TestMemoryStorageList(t *testing.T) {
+	ms := newTestMemoryStorage(t, "c.png", "a.png", "b.gif")
+
+	type test struct {
+		pageSize int
+		want     [][]string
+	}
+
+	tests := []test{
+		{pageSize: 10, want: [][]string{{
+			"processed/a/original.png", "processed/a/thumbnail.png",
+			"processed/b/original.gif", "processed/b/thumbnail.gif",
+			"processed/c/original.png", "processed/c/thumbnail.png",
+		}}},
+		{pageSize: 4, want: [][]string{
+			{"processed/a/original.png", "processed/a/thumbnail.png", "processed/b/original.gif", "processed/b/thumbnail.gif"},
+			{"processed/c/original.png", "processed/c/thumbnail.png"},
+		}},
+		{pageSize: 2, want: [][]string{
+			{"processed/a/original.png", "processed/a/thumbnail.png"},
+			{"processed/b/original.gif", "processed/b/thumbnail.gif"},
+			{"processed/c/original.png", "processed/c/thumbnail.png"},
+		}},
+	}
+
+	for _, c := range tests {
+		got := [][]string{}
+		token := ""
+		for {
+			fs, next, err := ms.List(context.Background(), "", c.pageSize, token)
+			if err != nil {
+				t.Fatalf("expected no error, got: %s", err)
+			}
+
+			names := []string{}
+			for _, f := range fs {
+				names = append(names, f.Name)
+			}
+			got = append(got, names)
+
+			if next == "" {
+				break
+			}
+			token = next
+		}
+
+		if !reflect.DeepEqual(c.want, got) {
+			t.Fatalf("expected: %v, got: %v", c.want, got)
+		}
+	}
+}
+
+func TestMemoryStorageListInvalidToken(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+
+	if _, _, err := ms.List(context.Background(), "", 10, "%%%"); err != ErrInvalidPageToken {
+		t.Fatalf("expected: %v, got: %v", ErrInvalidPageToken, err)
+	}
+}
+
+func TestMemoryStorageNotFound(t *testing.T) {
+	ms := newTestMemoryStorage(t, "RetoColt.png")
+
+	if _, err := ms.Read(context.Background(), "ColtReto"); err != ErrNotFound {
+		t.Fatalf("Read expected: %v, got: %v", ErrNotFound, err)
+	}
+	if _, err := ms.Open(context.Background(), "ColtReto"); err != ErrNotFound {
+		t.Fatalf("Open expected: %v, got: %v", ErrNotFound, err)
+	}
+	if err := ms.Delete(context.Background(), "ColtReto", 0); err != ErrNotFound {
+		t.Fatalf("Delete expected: %v, got: %v", ErrNotFound, err)
+	}
+	if err := ms.Replace(context.Background(), "ColtReto", "ColtReto.png", newMemoryFile(testPNG(t)), nil, 0); err != ErrNotFound {
+		t.Fatalf("Replace expected: %v, got: %v", ErrNotFound, err)
+	}
+
+	// Ids are matched on whole path segments, not prefixes.
+	if _, err := ms.Read(context.Background(), "Reto"); err != ErrNotFound {
+		t.Fatalf("Read expected: %v, got: %v", ErrNotFound, err)
+	}
+}
+
+func TestMemoryStorageOpen(t *testing.T) {
+	ms := newTestMemoryStorage(t, "RetoColt.png")
+
+	r, err := ms.Open(context.Background(), "RetoColt")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if !bytes.Equal(testPNG(t), got) {
+		t.Fatalf("expected content to round trip")
+	}
+	if r.ContentType != "image/png" {
+		t.Fatalf("expected: %v, got: %v", "image/png", r.ContentType)
+	}
+	if r.Filename != "RetoColt.png" {
+		t.Fatalf("expected: %v, got: %v", "RetoColt.png", r.Filename)
+	}
+}
+
+// testPNG returns the bytes of a real image from the function's test data.
+func testPNG(t *testing.T) []byte {
+	b, err := os.ReadFile("../function/RetoColt.png")
+	if err != nil {
+		t.Fatalf("could not read test image: %s", err)
+	}
+
+	return b
+}
@@ -0,0 +1,288 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tags are kept in the metadata of an original separated by commas, and
+// the metadata clients set under their own keys with a prefix, so that
+// neither can clash with the keys the app keeps there itself.
+const (
+	tagsKey        = "tags"
+	userMetaPrefix = "meta."
+)
+
+// Limits on what clients can keep with an image, which Cloud Storage
+// allows only 8 KiB of metadata for in all.
+var (
+	maxTags            = 20
+	maxTagLength       = 64
+	maxMetaKeys        = 20
+	maxMetaKeyLength   = 64
+	maxMetaValueLength = 256
+)
+
+// metaKeyPattern is what metadata keys can be made of once lowercased.
+var metaKeyPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// userMetadata is the tags and metadata a client keeps with an image, and
+// when it expires, if it does.
+type userMetadata struct {
+	Tags    []string
+	Meta    map[string]string
+	Expires time.Time
+}
+
+// readUserMetadata finds the tags and client metadata in the metadata of
+// an original. Keys that were removed may be left empty, so empty values
+// don't count.
+func readUserMetadata(metadata map[string]string) userMetadata {
+	um := userMetadata{Meta: map[string]string{}}
+	if v := metadata[tagsKey]; v != "" {
+		um.Tags = strings.Split(v, ",")
+	}
+	for k, v := range metadata {
+		if strings.HasPrefix(k, userMetaPrefix) && v != "" {
+			um.Meta[strings.TrimPrefix(k, userMetaPrefix)] = v
+		}
+	}
+	um.Expires, _ = time.Parse(time.RFC3339, metadata[expiresKey])
+
+	return um
+}
+
+// normalizeTags lowercases and trims tags, dropping empty and repeated
+// ones.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is too long, limit is %d characters", t, maxTagLength)
+		}
+		if strings.Contains(t, ",") {
+			return nil, fmt.Errorf("tag %q can't contain a comma", t)
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("too many tags, limit is %d", maxTags)
+	}
+
+	return out, nil
+}
+
+// setMeta sets key to value, or with an empty value removes it, checking
+// both against the limits.
+func (um *userMetadata) setMeta(key, value string) error {
+	key = strings.ToLower(key)
+	if len(key) > maxMetaKeyLength || !metaKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid metadata key %q: want up to %d letters, digits, - or _", key, maxMetaKeyLength)
+	}
+	if len(value) > maxMetaValueLength {
+		return fmt.Errorf("metadata %s is too long, limit is %d bytes", key, maxMetaValueLength)
+	}
+
+	if value == "" {
+		delete(um.Meta, key)
+		return nil
+	}
+	um.Meta[key] = value
+	if len(um.Meta) > maxMetaKeys {
+		return fmt.Errorf("too many metadata keys, limit is %d", maxMetaKeys)
+	}
+
+	return nil
+}
+
+// applyForm sets the tags and metadata given in form fields: tags, a comma
+// separated list, meta.KEY for each key, and ttl.
+func (um *userMetadata) applyForm(values url.Values) error {
+	if err := um.setTTL(values.Get("ttl")); err != nil {
+		return err
+	}
+	if v, ok := values["tags"]; ok {
+		tags, err := normalizeTags(strings.Split(strings.Join(v, ","), ","))
+		if err != nil {
+			return err
+		}
+		um.Tags = tags
+	}
+
+	keys := []string{}
+	for k := range values {
+		if strings.HasPrefix(k, userMetaPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	// Sorted, so that going over the limit is reported the same way each
+	// time.
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := um.setMeta(strings.TrimPrefix(k, userMetaPrefix), values.Get(k)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// objectMetadata is um as the metadata of an original. Keys in previous
+// that um no longer has are set empty, which removes them.
+func (um userMetadata) objectMetadata(previous map[string]string) map[string]string {
+	m := map[string]string{tagsKey: strings.Join(um.Tags, ","), expiresKey: ""}
+	if !um.Expires.IsZero() {
+		m[expiresKey] = um.Expires.Format(time.RFC3339)
+	}
+	for k := range previous {
+		if strings.HasPrefix(k, userMetaPrefix) {
+			m[k] = ""
+		}
+	}
+	for k, v := range um.Meta {
+		m[userMetaPrefix+k] = v
+	}
+
+	return m
+}
+
+// MetadataPatch is the body of a PATCH to an image. Tags, when given,
+// replace the image's tags. Metadata is merged into the image's, with a
+// null or empty value removing a key. TTL makes the image expire that long
+// from now, or with never keeps it for good.
+type MetadataPatch struct {
+	Tags     *[]string          `json:"tags,omitempty"`
+	Metadata map[string]*string `json:"metadata,omitempty"`
+	TTL      string             `json:"ttl,omitempty"`
+}
+
+// maxMetadataPatchBytes bounds the body of a PATCH.
+const maxMetadataPatchBytes = 64 << 10
+
+// patchHandler updates the tags and metadata of an image in place, without
+// touching its contents.
+func (s *Server) patchHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	patch := MetadataPatch{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataPatchBytes)).Decode(&patch); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return
+	}
+
+	img, err := s.patchImage(r.Context(), id, patch)
+	if errors.Is(err, ErrNotFound) {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, img, http.StatusOK)
+}
+
+// patchImage applies patch to image id and returns the image as it then
+// is.
+func (s *Server) patchImage(ctx context.Context, id string, patch MetadataPatch) (Image, error) {
+	fs, err := s.storage.Read(ctx, id)
+	if err == ErrNotFound {
+		return Image{}, fmt.Errorf("image id: %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to read files %s: %w", id, err)
+	}
+	original, ok := originalFile(fs)
+	if !ok {
+		return Image{}, fmt.Errorf("image id: %s: %w", id, ErrNotFound)
+	}
+
+	um := readUserMetadata(original.Metadata)
+	if patch.Tags != nil {
+		if um.Tags, err = normalizeTags(*patch.Tags); err != nil {
+			return Image{}, invalidArgument(err)
+		}
+	}
+	if err := um.setTTL(patch.TTL); err != nil {
+		return Image{}, invalidArgument(err)
+	}
+	keys := []string{}
+	for k := range patch.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := ""
+		if patch.Metadata[k] != nil {
+			v = *patch.Metadata[k]
+		}
+		if err := um.setMeta(k, v); err != nil {
+			return Image{}, invalidArgument(err)
+		}
+	}
+
+	metadata := um.objectMetadata(original.Metadata)
+	if err := s.storage.UpdateMetadata(ctx, original.Name, metadata); err != nil {
+		return Image{}, fmt.Errorf("failed to update metadata of %s: %w", id, err)
+	}
+	s.notify(ctx, ImageEvent{Action: actionUpdated, ID: id, Size: original.Size, ContentType: original.ContentType})
+
+	fs, err = s.storage.Read(ctx, id)
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to read files %s: %w", id, err)
+	}
+	is, _ := NewImages(fs)
+	if len(is) == 0 {
+		return Image{}, fmt.Errorf("image id: %s: %w", id, ErrNotFound)
+	}
+
+	return is[0], nil
+}
+
+// tagged returns the images in is with the tag t, ignoring case.
+func tagged(is Images, t string) Images {
+	t = strings.ToLower(t)
+
+	matched := Images{}
+	for _, i := range is {
+		for _, have := range i.Tags {
+			if have == t {
+				matched = append(matched, i)
+				break
+			}
+		}
+	}
+
+	return matched
+}
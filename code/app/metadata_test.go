@@ -0,0 +1,189 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// uploadWithFields is an upload of a PNG called name along with the form
+// fields in fields.
+func uploadWithFields(t *testing.T, method, target, name string, fields map[string]string) *http.Request {
+	parts := []testPart{{"myFile", name, "image/png", testPNG(t)}}
+	for k, v := range fields {
+		parts = append(parts, testPart{field: k, content: []byte(v)})
+	}
+
+	return newMultipartRequest(t, method, target, parts...)
+}
+
+func readImage(t *testing.T, server *Server, id string) Image {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/"+id, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	return img
+}
+
+func TestUploadMetadata(t *testing.T) {
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+
+	fields := map[string]string{"tags": "Holiday, beach,holiday", "meta.Camera": "X100", "meta.place": "Lisbon", "other": "ignored"}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, uploadWithFields(t, http.MethodPost, "/api/v1/image", "trip.png", fields))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	img := readImage(t, server, "trip")
+	if want := []string{"holiday", "beach"}; !reflect.DeepEqual(img.Tags, want) {
+		t.Fatalf("expected: %v, got: %v", want, img.Tags)
+	}
+	if want := map[string]string{"camera": "X100", "place": "Lisbon"}; !reflect.DeepEqual(img.Metadata, want) {
+		t.Fatalf("expected: %v, got: %v", want, img.Metadata)
+	}
+
+	// Replacing the image keeps what the form doesn't change.
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, uploadWithFields(t, http.MethodPost, "/api/v1/image/trip", "trip.png", map[string]string{"meta.place": "", "tags": "city"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	img = readImage(t, server, "trip")
+	if want := []string{"city"}; !reflect.DeepEqual(img.Tags, want) {
+		t.Fatalf("expected: %v, got: %v", want, img.Tags)
+	}
+	if want := map[string]string{"camera": "X100"}; !reflect.DeepEqual(img.Metadata, want) {
+		t.Fatalf("expected: %v, got: %v", want, img.Metadata)
+	}
+}
+
+func TestUploadMetadataLimits(t *testing.T) {
+	tags := []string{}
+	for i := 0; i <= maxTags; i++ {
+		tags = append(tags, fmt.Sprintf("tag%d", i))
+	}
+	manyTags := strings.Join(tags, ",")
+
+	tests := map[string]map[string]string{
+		"long tag":   {"tags": strings.Repeat("a", maxTagLength+1)},
+		"many tags":  {"tags": manyTags},
+		"bad key":    {"meta.no spaces": "x"},
+		"long value": {"meta.note": strings.Repeat("a", maxMetaValueLength+1)},
+		"long field": {"meta.note": strings.Repeat("a", maxMetadataFieldBytes+1)},
+		"empty tags": {"tags": ","},
+	}
+
+	for name, fields := range tests {
+		server := NewServer(newTestMemoryStorage(t))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, uploadWithFields(t, http.MethodPost, "/api/v1/image", "limits.png", fields))
+
+		want := http.StatusBadRequest
+		if name == "empty tags" {
+			want = http.StatusCreated
+		}
+		if w.Code != want {
+			t.Fatalf("%s expected: %v, got: %v %s", name, want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPatchMetadata(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+
+	patch := func(id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/api/v1/image/"+id, strings.NewReader(body)))
+		return w
+	}
+
+	w := patch("a", `{"tags": ["Cat", "indoor"], "metadata": {"owner": "sam", "room": "kitchen"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if want := []string{"cat", "indoor"}; !reflect.DeepEqual(img.Tags, want) {
+		t.Fatalf("expected: %v, got: %v", want, img.Tags)
+	}
+
+	// Only the keys given change, and null removes one.
+	if w := patch("a", `{"metadata": {"room": null, "floor": "2"}}`); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	img = readImage(t, server, "a")
+	if want := map[string]string{"owner": "sam", "floor": "2"}; !reflect.DeepEqual(img.Metadata, want) {
+		t.Fatalf("expected: %v, got: %v", want, img.Metadata)
+	}
+	if want := []string{"cat", "indoor"}; !reflect.DeepEqual(img.Tags, want) {
+		t.Fatalf("expected the tags to be kept, got: %v", img.Tags)
+	}
+
+	// The contents are left alone.
+	obj, err := ms.Open(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	obj.Close()
+
+	type test struct {
+		id     string
+		body   string
+		status int
+	}
+
+	tests := []test{
+		{"missing", `{"tags": ["x"]}`, http.StatusNotFound},
+		{"b", `{"tags": `, http.StatusBadRequest},
+		{"b", `{"metadata": {"Not Valid": "x"}}`, http.StatusBadRequest},
+		{"b", `{"tags": ["` + strings.Repeat("a", maxTagLength+1) + `"]}`, http.StatusBadRequest},
+	}
+	for _, c := range tests {
+		if w := patch(c.id, c.body); w.Code != c.status {
+			t.Fatalf("%s expected: %v, got: %v %s", c.body, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	for tag, want := range map[string]int{"cat": 1, "CAT": 1, "dog": 0} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image?tag="+tag, nil))
+		page := ImagePage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s expected no error, got: %s", tag, err)
+		}
+		if len(page.Images) != want {
+			t.Fatalf("%s expected: %v, got: %v", tag, want, len(page.Images))
+		}
+	}
+}
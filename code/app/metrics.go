@@ -0,0 +1,494 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+)
+
+const metricsNamespace = "scaler"
+
+// Metrics holds the Prometheus collectors for the app, in a registry of its
+// own so that every Server can have a fresh set.
+type Metrics struct {
+	registry   *prometheus.Registry
+	requests   *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	uploadSize prometheus.Histogram
+	storage    *prometheus.HistogramVec
+	retries    *prometheus.CounterVec
+	coalescing *prometheus.CounterVec
+	lookups    *prometheus.CounterVec
+	published  *prometheus.CounterVec
+	webhooks   prometheus.Counter
+	panics     *prometheus.CounterVec
+	inFlight   *prometheus.GaugeVec
+	shed       *prometheus.CounterVec
+	cleanups   *prometheus.CounterVec
+	cleaned    *prometheus.CounterVec
+	followers  *prometheus.GaugeVec
+	evictions  *prometheus.CounterVec
+	calls      *prometheus.CounterVec
+	callTime   *prometheus.HistogramVec
+}
+
+// NewMetrics returns a Metrics with every collector registered, along with
+// the standard process and Go runtime ones.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served, by handler, method and status code.",
+		}, []string{"handler", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by handler and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"handler", "method"}),
+		uploadSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_size_bytes",
+			Help:      "Size of request bodies carrying uploads.",
+			Buckets:   prometheus.ExponentialBuckets(1<<10, 4, 10),
+		}),
+		storage: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Time taken by storage operations, by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_retries_total",
+			Help:      "Storage operations retried after a transient failure, by operation.",
+		}, []string{"operation"}),
+		coalescing: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "storage_coalesced_total",
+			Help:      "Storage reads that shared a call already in flight rather than making their own, by operation.",
+		}, []string{"operation"}),
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "content_cache_lookups_total",
+			Help:      "Lookups in the content cache, by whether they were a hit or a miss.",
+		}, []string{"result"}),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_publish_failures_total",
+			Help:      "Image events that could not be published, by publisher.",
+		}, []string{"publisher"}),
+		webhooks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "webhook_delivery_failures_total",
+			Help:      "Webhook deliveries given up on after every attempt failed.",
+		}),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_panics_total",
+			Help:      "Panics recovered from while serving HTTP requests, by handler.",
+		}, []string{"handler"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_in_flight",
+			Help:      "Requests being served under a concurrency limit, by pool.",
+		}, []string{"pool"}),
+		shed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_shed_total",
+			Help:      "Requests turned away with a 429 for want of a slot, by pool.",
+		}, []string{"pool"}),
+		cleanups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "janitor_runs_total",
+			Help:      "Sweeps of storage by the janitor, by whether they were dry runs and whether they failed.",
+		}, []string{"dry_run", "result"}),
+		cleaned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "janitor_removed_total",
+			Help:      "Objects the janitor removed, by kind. Dry runs aren't counted.",
+		}, []string{"kind"}),
+		followers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_subscribers",
+			Help:      "Clients following the stream of changes to images, by transport.",
+		}, []string{"transport"}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_subscribers_evicted_total",
+			Help:      "Clients dropped from the stream of changes for falling behind, by transport.",
+		}, []string{"transport"}),
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_requests_total",
+			Help:      "gRPC calls served, by method and status code.",
+		}, []string{"method", "code"}),
+		callTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_request_duration_seconds",
+			Help:      "Time taken to serve gRPC calls, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.uploadSize,
+		m.storage,
+		m.retries,
+		m.coalescing,
+		m.lookups,
+		m.published,
+		m.webhooks,
+		m.panics,
+		m.inFlight,
+		m.shed,
+		m.cleanups,
+		m.cleaned,
+		m.followers,
+		m.evictions,
+		m.calls,
+		m.callTime,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Storage wraps s so that the latency of its operations is recorded.
+func (m *Metrics) Storage(s Storage) Storage {
+	return instrumentedStorage{s, m.storage}
+}
+
+// retried counts a retry of a storage operation. It does nothing on a nil
+// Metrics.
+func (m *Metrics) retried(op string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(op).Inc()
+}
+
+// coalesced counts a storage read that shared another's call. It does
+// nothing on a nil Metrics.
+func (m *Metrics) coalesced(op string) {
+	if m == nil {
+		return
+	}
+	m.coalescing.WithLabelValues(op).Inc()
+}
+
+// contentCacheLookup counts a lookup in the content cache. It does nothing
+// on a nil Metrics.
+func (m *Metrics) contentCacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.lookups.WithLabelValues(result).Inc()
+}
+
+// watchContentCache reports how full c is and how often it is hit. It does
+// nothing on a nil Metrics.
+func (m *Metrics) watchContentCache(c *ContentCache) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "content_cache_bytes",
+			Help:      "Bytes of image content held in the content cache.",
+		}, func() float64 { return float64(c.bytes()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "content_cache_hit_ratio",
+			Help:      "Share of content cache lookups that were hits, since the process started.",
+		}, c.hitRatio),
+	)
+}
+
+// publishFailed counts an event that publisher could not publish. It does
+// nothing on a nil Metrics.
+func (m *Metrics) publishFailed(publisher string) {
+	if m == nil {
+		return
+	}
+	m.published.WithLabelValues(publisher).Inc()
+}
+
+// webhookFailed counts a webhook delivery that was given up on. It does
+// nothing on a nil Metrics.
+func (m *Metrics) webhookFailed() {
+	if m == nil {
+		return
+	}
+	m.webhooks.Inc()
+}
+
+// panicked counts a panic recovered from in handler. It does nothing on a
+// nil Metrics.
+func (m *Metrics) panicked(handler string) {
+	if m == nil {
+		return
+	}
+	m.panics.WithLabelValues(handler).Inc()
+}
+
+// requestStarted and requestFinished track a request holding a slot in
+// pool. They do nothing on a nil Metrics.
+func (m *Metrics) requestStarted(pool string) {
+	if m == nil {
+		return
+	}
+	m.inFlight.WithLabelValues(pool).Inc()
+}
+
+func (m *Metrics) requestFinished(pool string) {
+	if m == nil {
+		return
+	}
+	m.inFlight.WithLabelValues(pool).Dec()
+}
+
+// requestShed counts a request turned away for want of a slot in pool. It
+// does nothing on a nil Metrics.
+func (m *Metrics) requestShed(pool string) {
+	if m == nil {
+		return
+	}
+	m.shed.WithLabelValues(pool).Inc()
+}
+
+// cleanedUp counts a sweep of storage and, unless it was a dry run, what
+// it removed. It does nothing on a nil Metrics.
+func (m *Metrics) cleanedUp(c CleanupReport) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if len(c.Errors) > 0 {
+		result = "failed"
+	}
+	m.cleanups.WithLabelValues(strconv.FormatBool(c.DryRun), result).Inc()
+	if c.DryRun {
+		return
+	}
+	for kind, n := range map[string]int{
+		"thumbnail": c.Thumbnails,
+		"variant":   c.Variants,
+		"trash":     c.Trash,
+		"upload":    c.Uploads,
+		"staged":    c.Staged,
+		"expired":   c.Expired,
+	} {
+		m.cleaned.WithLabelValues(kind).Add(float64(n))
+	}
+}
+
+// subscribed and unsubscribed track a client following changes over
+// transport. They do nothing on a nil Metrics.
+func (m *Metrics) subscribed(transport string) {
+	if m == nil {
+		return
+	}
+	m.followers.WithLabelValues(transport).Inc()
+}
+
+func (m *Metrics) unsubscribed(transport string) {
+	if m == nil {
+		return
+	}
+	m.followers.WithLabelValues(transport).Dec()
+}
+
+// evicted counts a client dropped for falling behind. It does nothing on a
+// nil Metrics.
+func (m *Metrics) evicted(transport string) {
+	if m == nil {
+		return
+	}
+	m.evictions.WithLabelValues(transport).Inc()
+}
+
+// grpcHandled records a gRPC call to method that ended with code after
+// taking d. It does nothing on a nil Metrics.
+func (m *Metrics) grpcHandled(method string, code codes.Code, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.calls.WithLabelValues(method, code.String()).Inc()
+	m.callTime.WithLabelValues(method).Observe(d.Seconds())
+}
+
+// EnableMetrics serves m at /metrics, alongside the health endpoints so it
+// is neither instrumented itself nor caught by the static files, and
+// records every other request in it.
+func (s *Server) EnableMetrics(m *Metrics) {
+	s.metrics = m
+	s.probes.Handle("/metrics", m.Handler()).Methods(http.MethodGet)
+	s.Use(m.middleware(s.router))
+}
+
+// uploadRoutes are the routes whose request bodies count as uploads.
+var uploadRoutes = map[string]bool{
+	"/api/v1/image":              true,
+	"/api/v1/image/{id}":         true,
+	"/api/v1/uploads/{filename}": true,
+	"/api/v1/import":             true,
+}
+
+// isUpload reports whether r sends an upload to one of the routes in
+// router.
+func isUpload(router *mux.Router, r *http.Request) bool {
+	return (r.Method == http.MethodPost || r.Method == http.MethodPut) && uploadRoutes[routeLabel(router, r)]
+}
+
+// middleware records every request against the template of the route in
+// router that it matches, so that image ids don't blow up the number of
+// series.
+func (m *Metrics) middleware(router *mux.Router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler := routeLabel(router, r)
+			if uploadRoutes[handler] && r.ContentLength > 0 && (r.Method == http.MethodPost || r.Method == http.MethodPut) {
+				m.uploadSize.Observe(float64(r.ContentLength))
+			}
+
+			start := time.Now()
+			sr := &statusRecorder{ResponseWriter: w}
+
+			next.ServeHTTP(sr, r)
+
+			if sr.status == 0 {
+				sr.status = http.StatusOK
+			}
+			m.requests.WithLabelValues(handler, r.Method, strconv.Itoa(sr.status)).Inc()
+			m.duration.WithLabelValues(handler, r.Method).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// routeLabel names the route r matches by its path template. Everything
+// served by the static file catch-all is lumped together.
+func routeLabel(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.Route == nil {
+		return "unmatched"
+	}
+
+	tpl, err := routeTemplate(match.Route)
+	if err != nil {
+		return "unmatched"
+	}
+	if tpl == "/" {
+		return "static"
+	}
+
+	return tpl
+}
+
+// varPattern matches the pattern of a variable in a route template.
+var varPattern = regexp.MustCompile(`{(\w+):[^}]*}`)
+
+// routeTemplate is the path template of route without the patterns of its
+// variables, so /api/v1/image/{id:.+} reads /api/v1/image/{id}.
+func routeTemplate(route *mux.Route) (string, error) {
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "", err
+	}
+
+	return varPattern.ReplaceAllString(tpl, "{$1}"), nil
+}
+
+// instrumentedStorage is a Storage that times the operations the handlers
+// lean on most.
+type instrumentedStorage struct {
+	Storage
+	latency *prometheus.HistogramVec
+}
+
+func (s instrumentedStorage) observe(op string, start time.Time) {
+	s.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (s instrumentedStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	defer s.observe("List", time.Now())
+	return s.Storage.List(ctx, prefix, pageSize, pageToken)
+}
+
+func (s instrumentedStorage) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	defer s.observe("Walk", time.Now())
+	return s.Storage.Walk(ctx, prefix, fn)
+}
+
+func (s instrumentedStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	defer s.observe("Read", time.Now())
+	return s.Storage.Read(ctx, id)
+}
+
+func (s instrumentedStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	defer s.observe("Open", time.Now())
+	return s.Storage.Open(ctx, id)
+}
+
+func (s instrumentedStorage) Versions(ctx context.Context, id string) (CSFiles, error) {
+	defer s.observe("Versions", time.Now())
+	return s.Storage.Versions(ctx, id)
+}
+
+func (s instrumentedStorage) OpenVersion(ctx context.Context, id string, generation int64) (*CSReader, error) {
+	defer s.observe("OpenVersion", time.Now())
+	return s.Storage.OpenVersion(ctx, id, generation)
+}
+
+func (s instrumentedStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	defer s.observe("Create", time.Now())
+	return s.Storage.Create(ctx, name, file, opts)
+}
+
+func (s instrumentedStorage) Replace(ctx context.Context, id, filename string, file multipart.File, metadata map[string]string, generation int64) error {
+	defer s.observe("Replace", time.Now())
+	return s.Storage.Replace(ctx, id, filename, file, metadata, generation)
+}
+
+func (s instrumentedStorage) Delete(ctx context.Context, id string, generation int64) error {
+	defer s.observe("Delete", time.Now())
+	return s.Storage.Delete(ctx, id, generation)
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	metrics := NewMetrics()
+	server := NewServer(metrics.Storage(newTestMemoryStorage(t, "a.png")))
+	server.EnableMetrics(metrics)
+
+	for _, target := range []string{"/api/v1/image", "/api/v1/image?fresh=true", "/api/v1/image/a", "/api/v1/image/missing"} {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	server.ServeHTTP(httptest.NewRecorder(), newUploadRequest(t, http.MethodPost, "/api/v1/image?force=true", "b.png", "image/png", testPNG(t)))
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`scaler_http_requests_total{code="200",handler="/api/v1/image",method="GET"} 2`,
+		`scaler_http_requests_total{code="200",handler="/api/v1/image/{id}",method="GET"} 1`,
+		`scaler_http_requests_total{code="404",handler="/api/v1/image/{id}",method="GET"} 1`,
+		`scaler_http_requests_total{code="201",handler="/api/v1/image",method="POST"} 1`,
+		`scaler_http_request_duration_seconds_count{handler="/api/v1/image",method="GET"} 2`,
+		`scaler_upload_size_bytes_count 1`,
+		`scaler_storage_operation_duration_seconds_count{operation="List"} 2`,
+		`scaler_storage_operation_duration_seconds_count{operation="Read"} 2`,
+		`scaler_storage_operation_duration_seconds_count{operation="Create"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+
+	if strings.Contains(body, `handler="/metrics"`) {
+		t.Fatalf("expected scrapes not to be counted, got:\n%s", body)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if strings.Contains(w.Body.String(), "scaler_http_requests_total") {
+		t.Fatalf("expected no metrics without EnableMetrics, got: %s", w.Body.String())
+	}
+}
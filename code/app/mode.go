@@ -0,0 +1,149 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// modePath is where the mode is shown and changed.
+const modePath = "/api/v1/admin/mode"
+
+// adminPrefix starts the paths of the admin endpoints, which are served in
+// any mode so that it can always be changed back.
+const adminPrefix = "/api/v1/admin/"
+
+// modeRetryAfter is how long callers turned away by the mode are told to
+// wait before trying again.
+const modeRetryAfter = 5 * time.Minute
+
+// maxModeBodyBytes bounds the body of a mode change.
+const maxModeBodyBytes = 1 << 10
+
+// Mode is what the server is open for.
+type Mode string
+
+const (
+	// ModeNormal serves everything.
+	ModeNormal Mode = "normal"
+	// ModeReadOnly serves reads, but turns away anything that would
+	// change the images, as during a bucket migration.
+	ModeReadOnly Mode = "read-only"
+	// ModeMaintenance turns away every API request. The health endpoints
+	// still answer, so the instance isn't restarted.
+	ModeMaintenance Mode = "maintenance"
+)
+
+var (
+	// ErrReadOnly is returned for writes in read-only mode.
+	ErrReadOnly = errors.New("the gallery is read-only for now, try again later")
+	// ErrMaintenance is returned for API requests in maintenance mode.
+	ErrMaintenance = errors.New("the gallery is down for maintenance, try again later")
+)
+
+// ServerMode is the mode the server is in.
+type ServerMode struct {
+	Mode Mode `json:"mode"`
+}
+
+// JSON marshalls the content of ServerMode to json.
+func (m ServerMode) JSON() (string, error) {
+	bytes, err := m.JSONBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of ServerMode to json.
+func (m ServerMode) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// Mode returns the mode the server is in.
+func (s *Server) Mode() Mode {
+	if m := s.mode.Load(); m != nil {
+		return *m
+	}
+	return ModeNormal
+}
+
+// SetMode puts the server in mode m. The mode is this instance's alone;
+// others behind the same load balancer must be changed too.
+func (s *Server) SetMode(m Mode) {
+	s.mode.Store(&m)
+}
+
+// guardMode turns away, with a 503, the API requests the mode doesn't
+// allow.
+func (s *Server) guardMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, adminPrefix) {
+			switch s.Mode() {
+			case ModeMaintenance:
+				err = ErrMaintenance
+			case ModeReadOnly:
+				if !isRead(r) && r.Method != http.MethodOptions {
+					err = ErrReadOnly
+				}
+			}
+		}
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(modeRetryAfter.Seconds())))
+			writeErrorMsg(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// modeHandler shows the mode or, to callers with an API key, changes it.
+func (s *Server) modeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !s.requireAdminKey(w, r) {
+			return
+		}
+
+		m := ServerMode{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxModeBodyBytes)).Decode(&m); err != nil {
+			writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+			return
+		}
+		switch m.Mode {
+		case ModeNormal, ModeReadOnly, ModeMaintenance:
+		default:
+			writeError(w, invalidArgument(fmt.Errorf("invalid mode %q: want %s, %s or %s", m.Mode, ModeNormal, ModeReadOnly, ModeMaintenance)))
+			return
+		}
+		s.SetMode(m.Mode)
+		logJSON(SeverityWarning, LogEntry{Message: fmt.Sprintf("mode set to %s", m.Mode)})
+	}
+
+	writeJSON(w, ServerMode{Mode: s.Mode()}, http.StatusOK)
+}
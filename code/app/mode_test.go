@@ -0,0 +1,130 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func modeRequest(server *Server, body, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, modePath, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set(apiKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+func modeServe(server *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	server.SetMode(ModeReadOnly)
+
+	for _, target := range []string{"/api/v1/image", "/api/v1/image/a", "/api/v1/image/a/content", "/healthz"} {
+		if w := modeServe(server, httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusOK {
+			t.Fatalf("GET %s expected: %v, got: %v", target, http.StatusOK, w.Code)
+		}
+	}
+
+	for _, r := range []*http.Request{
+		newUploadRequest(t, http.MethodPost, "/api/v1/image", "b.png", "image/png", testPNG(t)),
+		newUploadRequest(t, http.MethodPut, "/api/v1/image/a", "a.png", "image/png", testPNG(t)),
+		httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil),
+	} {
+		w := modeServe(server, r)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s %s expected: %v, got: %v", r.Method, r.URL.Path, http.StatusServiceUnavailable, w.Code)
+		}
+		if w.Header().Get("Retry-After") != "300" {
+			t.Fatalf("expected Retry-After: 300, got: %q", w.Header().Get("Retry-After"))
+		}
+		msg := ErrorMessage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+			t.Fatalf("expected a JSON error, got: %s", w.Body.String())
+		}
+	}
+
+	if w := modeServe(server, httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil)); w.Code != http.StatusOK {
+		t.Fatalf("expected the image to still be there, got: %v", w.Code)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	server.SetMode(ModeMaintenance)
+
+	for _, target := range []string{"/api/v1/image", "/api/v1/image/a", "/api/v1/stats"} {
+		if w := modeServe(server, httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("GET %s expected: %v, got: %v", target, http.StatusServiceUnavailable, w.Code)
+		}
+	}
+
+	// The platform mustn't think the instance is broken, and the mode must
+	// be there to change back.
+	for _, target := range []string{"/healthz", modePath} {
+		if w := modeServe(server, httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusOK {
+			t.Fatalf("GET %s expected: %v, got: %v", target, http.StatusOK, w.Code)
+		}
+	}
+}
+
+func TestModeHandler(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	// Without API keys nobody can change it.
+	if w := modeRequest(server, `{"mode": "read-only"}`, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+
+	server.RequireAPIKey([]string{"secret"}, false)
+	if w := modeRequest(server, `{"mode": "read-only"}`, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %v, got: %v", http.StatusUnauthorized, w.Code)
+	}
+	if w := modeRequest(server, `{"mode": "closed"}`, "secret"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+	}
+	if server.Mode() != ModeNormal {
+		t.Fatalf("expected: %v, got: %v", ModeNormal, server.Mode())
+	}
+
+	w := modeRequest(server, `{"mode": "maintenance"}`, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	m := ServerMode{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil || m.Mode != ModeMaintenance {
+		t.Fatalf("expected %s, got: %+v %v", ModeMaintenance, m, err)
+	}
+	if w := modeServe(server, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+
+	if w := modeRequest(server, `{"mode": "normal"}`, "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+	if w := modeServe(server, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+}
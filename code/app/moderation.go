@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// moderationTimeout bounds how long a moderator can take over one upload.
+const moderationTimeout = 30 * time.Second
+
+// Verdict is what a Moderator made of an upload.
+type Verdict struct {
+	Allowed bool
+	// Scores are how likely the upload is to fall in each category the
+	// moderator checks, in whatever terms it uses.
+	Scores map[string]string
+}
+
+// Moderator decides whether an upload is fit to be stored.
+type Moderator interface {
+	Moderate(ctx context.Context, r io.Reader, contentType string) (Verdict, error)
+}
+
+// SetModerator has every upload that passes the MIME check run past m
+// before it is stored. With failOpen, uploads are let through when m
+// can't be reached rather than turned away.
+func (s *Server) SetModerator(m Moderator, failOpen bool) {
+	s.moderator = m
+	s.moderationFailOpen = failOpen
+}
+
+// moderationError is the error for an upload the moderator turned down.
+type moderationError struct {
+	Scores map[string]string
+}
+
+func (e *moderationError) Error() string {
+	return "upload rejected by moderation"
+}
+
+// Rejected is the response to an upload the moderator turned down.
+type Rejected struct {
+	Text   string            `json:"message"`
+	Scores map[string]string `json:"scores"`
+}
+
+// JSON marshalls the content of Rejected to json.
+func (m Rejected) JSON() (string, error) {
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of Rejected to json.
+func (m Rejected) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// moderate runs file past the moderator, if there is one, and rewinds it.
+// On failure it returns the status to respond with.
+func (s *Server) moderate(ctx context.Context, file multipart.File, contentType string) (int, error) {
+	if s.moderator == nil {
+		return http.StatusOK, nil
+	}
+
+	ctx, span := startSpan(ctx, "moderate")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, moderationTimeout)
+	defer cancel()
+
+	v, err := s.moderator.Moderate(ctx, file, contentType)
+	if _, serr := file.Seek(0, io.SeekStart); serr != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error reading file: %v", serr)
+	}
+	if err != nil {
+		if s.moderationFailOpen {
+			weblog(fmt.Sprintf("could not moderate upload, letting it through: %s", err))
+			return http.StatusOK, nil
+		}
+		return http.StatusServiceUnavailable, fmt.Errorf("could not moderate upload: %v", err)
+	}
+	if !v.Allowed {
+		return http.StatusUnprocessableEntity, &moderationError{Scores: v.Scores}
+	}
+
+	return http.StatusOK, nil
+}
+
+// writeModerationError writes the response for an upload the moderator
+// turned down, reporting false if err isn't one.
+func writeModerationError(w http.ResponseWriter, status int, err error) bool {
+	var me *moderationError
+	if !errors.As(err, &me) {
+		return false
+	}
+
+	writeJSON(w, Rejected{Text: me.Error(), Scores: me.Scores}, status)
+	return true
+}
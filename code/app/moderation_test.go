@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	vision "google.golang.org/api/vision/v1"
+)
+
+// fakeModerator gives every upload the same verdict, or fails with err.
+type fakeModerator struct {
+	verdict Verdict
+	err     error
+	seen    int
+}
+
+func (m *fakeModerator) Moderate(ctx context.Context, r io.Reader, contentType string) (Verdict, error) {
+	b, _ := io.ReadAll(r)
+	m.seen = len(b)
+	return m.verdict, m.err
+}
+
+func TestModeration(t *testing.T) {
+	scores := map[string]string{"adult": "VERY_LIKELY", "violence": "UNLIKELY"}
+	outage := errors.New("vision is down")
+
+	type test struct {
+		moderator *fakeModerator
+		failOpen  bool
+		status    int
+	}
+
+	tests := map[string]test{
+		"allowed":     {moderator: &fakeModerator{verdict: Verdict{Allowed: true}}, status: http.StatusCreated},
+		"rejected":    {moderator: &fakeModerator{verdict: Verdict{Scores: scores}}, status: http.StatusUnprocessableEntity},
+		"fail closed": {moderator: &fakeModerator{err: outage}, status: http.StatusServiceUnavailable},
+		"fail open":   {moderator: &fakeModerator{err: outage}, failOpen: true, status: http.StatusCreated},
+	}
+
+	png := testPNG(t)
+	for name, c := range tests {
+		ms := newTestMemoryStorage(t)
+		server := NewServer(ms)
+		server.SetModerator(c.moderator, c.failOpen)
+
+		r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "upload.png", "image/png", png)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Fatalf("%s expected: %v, got: %v %s", name, c.status, w.Code, w.Body.String())
+		}
+		if c.moderator.seen != len(png) {
+			t.Fatalf("%s expected the moderator to see the whole upload, got: %v bytes", name, c.moderator.seen)
+		}
+
+		_, err := ms.Open(context.Background(), "upload")
+		if stored := err == nil; stored != (c.status == http.StatusCreated) {
+			t.Fatalf("%s expected stored to be %v", name, !stored)
+		}
+		if c.status == http.StatusCreated {
+			obj, _ := ms.Open(context.Background(), "upload")
+			got, _ := io.ReadAll(obj)
+			if !bytes.Equal(got, png) {
+				t.Fatalf("%s expected the upload to be stored whole after moderation", name)
+			}
+		}
+
+		if c.status == http.StatusUnprocessableEntity {
+			body := Rejected{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("%s expected no error, got: %s", name, err)
+			}
+			if body.Scores["adult"] != "VERY_LIKELY" {
+				t.Fatalf("%s expected the scores, got: %s", name, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestModerationOnReplace(t *testing.T) {
+	ms := newTestMemoryStorage(t, "kept.png")
+	server := NewServer(ms)
+	server.SetModerator(&fakeModerator{verdict: Verdict{Scores: map[string]string{"violence": "LIKELY"}}}, false)
+
+	r := newUploadRequest(t, http.MethodPut, "/api/v1/image/kept", "other.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+}
+
+func TestSafeSearchVerdict(t *testing.T) {
+	type test struct {
+		annotation vision.SafeSearchAnnotation
+		threshold  string
+		allowed    bool
+	}
+
+	tests := map[string]test{
+		"clean":        {annotation: vision.SafeSearchAnnotation{Adult: "VERY_UNLIKELY", Violence: "UNLIKELY"}, threshold: "LIKELY", allowed: true},
+		"adult":        {annotation: vision.SafeSearchAnnotation{Adult: "LIKELY", Violence: "UNLIKELY"}, threshold: "LIKELY"},
+		"violent":      {annotation: vision.SafeSearchAnnotation{Adult: "UNLIKELY", Violence: "VERY_LIKELY"}, threshold: "LIKELY"},
+		"strict":       {annotation: vision.SafeSearchAnnotation{Adult: "POSSIBLE", Violence: "UNLIKELY"}, threshold: "POSSIBLE"},
+		"racy is fine": {annotation: vision.SafeSearchAnnotation{Racy: "VERY_LIKELY"}, threshold: "LIKELY", allowed: true},
+	}
+
+	for name, c := range tests {
+		v := safeSearchVerdict(&c.annotation, c.threshold)
+		if v.Allowed != c.allowed {
+			t.Fatalf("%s expected: %v, got: %v", name, c.allowed, v.Allowed)
+		}
+		if v.Scores["racy"] != c.annotation.Racy {
+			t.Fatalf("%s expected every category to be scored, got: %v", name, v.Scores)
+		}
+	}
+
+	if _, err := parseLikelihood("unknown"); err == nil {
+		t.Fatalf("expected an error for a threshold that would reject everything")
+	}
+	if v, err := parseLikelihood("possible"); err != nil || v != "POSSIBLE" {
+		t.Fatalf("expected: POSSIBLE, got: %v %v", v, err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ndjsonType is the content type of a listing streamed a line at a time.
+const ndjsonType = "application/x-ndjson"
+
+// ndjsonFlushEvery is how many images a streamed listing writes between
+// flushes.
+const ndjsonFlushEvery = 100
+
+// streamed reports whether r asks for its listing as NDJSON, with
+// ?format=ndjson or, without a format, an Accept header naming it.
+func streamed(r *http.Request) (bool, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+		return strings.Contains(r.Header.Get("Accept"), ndjsonType), nil
+	case "json":
+		return false, nil
+	case "ndjson":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid format %q: want json or ndjson", f)
+	}
+}
+
+// admits reports whether f lets i into a listing. The prefix is left to
+// storage, and the delimiter, which rolls images up rather than leaving
+// them out, to splitFolders.
+func (f listFilter) admits(i Image) bool {
+	one := Images{i}
+	return (f.q == "" || len(matching(one, f.q)) == 1) &&
+		(f.label == "" || len(labelled(one, f.label)) == 1) &&
+		(f.tag == "" || len(tagged(one, f.tag)) == 1)
+}
+
+// streamList writes every image filter admits as a line of JSON, in id
+// order, as storage yields them, so that neither the listing nor the
+// response is ever held whole. The first line is flushed straight away and
+// then every ndjsonFlushEvery. Once the first line has gone so has the
+// status, so a failure after that ends the stream with an ErrorMessage in
+// place of an image, which clients can tell apart by its error field.
+// How many objects were skipped is only known at the end, so it comes in
+// a trailer.
+func (s *Server) streamList(w http.ResponseWriter, r *http.Request, filter listFilter) {
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	n, skipped := 0, 0
+	err := s.storage.Walk(r.Context(), filter.prefix, func(f CSFile) error {
+		is, sk := listImages(CSFiles{f})
+		skipped += sk
+		if len(is) == 0 || !filter.admits(is[0]) {
+			return nil
+		}
+
+		if n == 0 {
+			w.Header().Set("Content-Type", ndjsonType)
+			w.Header().Set("Trailer", skippedHeader)
+			w.WriteHeader(http.StatusOK)
+		}
+		n++
+		if err := enc.Encode(is[0]); err != nil {
+			return err
+		}
+		if flusher != nil && (n == 1 || n%ndjsonFlushEvery == 0) {
+			flusher.Flush()
+		}
+		return nil
+	})
+	w.Header().Set(skippedHeader, strconv.Itoa(skipped))
+
+	switch {
+	case err != nil && n == 0:
+		writeError(w, fmt.Errorf("failed to list files: %w", err))
+	case err != nil:
+		if errors.Is(requestErr(w), context.Canceled) {
+			return
+		}
+		err = fmt.Errorf("failed to list files after %d images: %w", n, err)
+		id := w.Header().Get(requestIDHeader)
+		logJSON(SeverityError, LogEntry{Message: fmt.Sprintf("Webserver : %s", err), Labels: requestLabels(id)})
+		enc.Encode(ErrorMessage{Error: err.Error(), Code: codeInternal, RequestID: id})
+	case n == 0:
+		w.Header().Set("Content-Type", ndjsonType)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// brokenWalk fails its walks with err once it has yielded after objects,
+// counting the walks made.
+type brokenWalk struct {
+	*MemoryStorage
+	after int
+	err   error
+	walks int
+}
+
+func (s *brokenWalk) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	s.walks++
+	n := 0
+	return s.MemoryStorage.Walk(ctx, prefix, func(f CSFile) error {
+		if n == s.after {
+			return s.err
+		}
+		n++
+		return fn(f)
+	})
+}
+
+// ndjsonLines sends r to server, returning the response and each line of
+// it.
+func ndjsonLines(t *testing.T, server *Server, r *http.Request) (*httptest.ResponseRecorder, []string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	lines := []string{}
+	sc := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return w, lines
+}
+
+func streamedIDs(t *testing.T, lines []string) []string {
+	t.Helper()
+
+	ids := []string{}
+	for _, l := range lines {
+		i := Image{}
+		if err := json.Unmarshal([]byte(l), &i); err != nil {
+			t.Fatalf("expected an image, got: %s", l)
+		}
+		ids = append(ids, i.ID)
+	}
+	return ids
+}
+
+func TestListNDJSON(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "c.png", "a.png", "b/x.png", "b/y.png"))
+
+	tests := map[string]struct {
+		target string
+		accept string
+		want   []string
+	}{
+		"format":    {"/api/v1/image?format=ndjson", "", []string{"a", "b/x", "b/y", "c"}},
+		"accept":    {"/api/v1/image", ndjsonType, []string{"a", "b/x", "b/y", "c"}},
+		"prefix":    {"/api/v1/image?format=ndjson&prefix=b/", "", []string{"b/x", "b/y"}},
+		"q":         {"/api/v1/image?format=ndjson&q=Y", "", []string{"b/y"}},
+		"no limits": {"/api/v1/image?format=ndjson&limit=1", "", []string{"a", "b/x", "b/y", "c"}},
+		"nothing":   {"/api/v1/image?format=ndjson&prefix=z", "", []string{}},
+	}
+	for name, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w, lines := ndjsonLines(t, server, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %v, got: %v %s", name, http.StatusOK, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ndjsonType {
+			t.Fatalf("%s: expected: %s, got: %s", name, ndjsonType, ct)
+		}
+		if ids := streamedIDs(t, lines); !reflect.DeepEqual(ids, tc.want) {
+			t.Fatalf("%s: expected: %v, got: %v", name, tc.want, ids)
+		}
+	}
+
+	// Clients that don't ask still get pages.
+	w, _ := ndjsonLines(t, server, httptest.NewRequest(http.MethodGet, "/api/v1/image?format=json", nil))
+	page := ImagePage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Images) != 4 {
+		t.Fatalf("expected a page of 4 images, got: %s", w.Body.String())
+	}
+
+	for _, target := range []string{
+		"/api/v1/image?format=xml",
+		"/api/v1/image?format=ndjson&sort=size",
+		"/api/v1/image?format=ndjson&delimiter=/",
+	} {
+		if w, _ := ndjsonLines(t, server, httptest.NewRequest(http.MethodGet, target, nil)); w.Code != http.StatusBadRequest {
+			t.Fatalf("GET %s expected: %v, got: %v", target, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestListNDJSONFailure(t *testing.T) {
+	bw := &brokenWalk{MemoryStorage: newTestMemoryStorage(t, "a.png", "b.png"), err: context.DeadlineExceeded}
+	server := NewServer(bw)
+
+	// Before anything is written, the failure is the status.
+	w, _ := ndjsonLines(t, server, httptest.NewRequest(http.MethodGet, "/api/v1/image?format=ndjson", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected: %v, got: %v", http.StatusInternalServerError, w.Code)
+	}
+
+	// After that, it ends the stream.
+	bw.after = 2
+	w, lines := ndjsonLines(t, server, httptest.NewRequest(http.MethodGet, "/api/v1/image?format=ndjson", nil))
+	if w.Code != http.StatusOK || len(lines) != 2 {
+		t.Fatalf("expected an image and an error, got: %v %v", w.Code, lines)
+	}
+	if ids := streamedIDs(t, lines[:1]); !reflect.DeepEqual(ids, []string{"a"}) {
+		t.Fatalf("expected a, got: %v", ids)
+	}
+	msg := ErrorMessage{}
+	if err := json.Unmarshal([]byte(lines[1]), &msg); err != nil || msg.Error == "" || msg.Code != codeInternal {
+		t.Fatalf("expected an error to end the stream, got: %s", lines[1])
+	}
+}
+
+func TestRetryWalk(t *testing.T) {
+	bw := &brokenWalk{MemoryStorage: newTestMemoryStorage(t, "a.png"), err: &googleapi.Error{Code: http.StatusServiceUnavailable}}
+	rs := RetryStorage(bw, nil)
+
+	// Nothing has been walked, so it can start again.
+	if err := rs.Walk(context.Background(), "", func(CSFile) error { return nil }); err == nil || bw.walks != retryAttempts {
+		t.Fatalf("expected %d walks, got: %d %v", retryAttempts, bw.walks, err)
+	}
+
+	// Something has, so it can't.
+	bw.after, bw.walks = 1, 0
+	if err := rs.Walk(context.Background(), "", func(CSFile) error { return nil }); err == nil || bw.walks != 1 {
+		t.Fatalf("expected 1 walk, got: %d %v", bw.walks, err)
+	}
+}
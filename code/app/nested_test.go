@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestImageID(t *testing.T) {
+	tests := map[string]string{
+		"a.png":             "a",
+		"events/2024/a.png": "events/2024/a",
+		"../../escaped.png": "escaped",
+		"a/../../b.png":     "b",
+		"no extension":      "no extension",
+		"dots.in.name.jpeg": "dots.in.name",
+		"folder.v2/cat.png": "folder.v2/cat",
+	}
+
+	for name, want := range tests {
+		if got := imageID(name); got != want {
+			t.Fatalf("%s: expected: %v, got: %v", name, want, got)
+		}
+	}
+}
+
+func TestNestedImageIDs(t *testing.T) {
+	ids := []string{"events/2024/party", "events", "with space", "café/ünïcode"}
+	ms := newTestMemoryStorage(t, "events/2024/party.png", "events.png", "with space.png", "café/ünïcode.png")
+	server := NewServer(ms)
+
+	for _, id := range ids {
+		for _, target := range []string{
+			"/api/v1/image/" + url.PathEscape(id),
+			"/api/v1/image/" + (&url.URL{Path: id}).EscapedPath(),
+		} {
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected: %v, got: %v", target, http.StatusOK, w.Code)
+			}
+			img := Image{}
+			if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+				t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+			}
+			if img.ID != id {
+				t.Fatalf("%s: expected: %v, got: %v", target, id, img.ID)
+			}
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image/"+url.PathEscape(id)+"/content", nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("%s content: expected a png, got: %v %s", id, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+
+	// Deleting a folder's image leaves the images nested under it alone.
+	r := httptest.NewRequest(http.MethodDelete, "/api/v1/image/events", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if _, err := ms.Read(context.Background(), "events"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrNotFound, err)
+	}
+	if _, err := ms.Read(context.Background(), "events/2024/party"); err != nil {
+		t.Fatalf("expected the nested image to be kept, got: %s", err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/trash/events:restore", nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	for _, id := range ids {
+		r := httptest.NewRequest(http.MethodDelete, "/api/v1/image/"+url.PathEscape(id), nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("delete %s: expected: %v, got: %v %s", id, http.StatusNoContent, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestFileStorageNestedIDs(t *testing.T) {
+	fs := newTestFileStorage(t, "events/2024/party.png", "events.png")
+	ctx := context.Background()
+
+	files, err := fs.Read(ctx, "events")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected the original and thumbnail of events only, got: %v", files)
+	}
+
+	if err := fs.Delete(ctx, "events/2024/party", 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := fs.Read(ctx, "events"); err != nil {
+		t.Fatalf("expected events to be kept, got: %s", err)
+	}
+}
@@ -0,0 +1,691 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// apiParam is a query parameter an operation takes.
+type apiParam struct {
+	name        string
+	typ         string
+	description string
+}
+
+// binary stands in for a response body that is the bytes of a file.
+type binary string
+
+// apiOperation documents a route. Request and response bodies are given as
+// values of the Go types that are marshalled for them, so the schemas in
+// the document follow the code. A nil response has no body.
+type apiOperation struct {
+	method  string
+	path    string
+	summary string
+	query   []apiParam
+	// upload is set for routes taking a multipart form, body to the JSON
+	// a route takes instead or as well, and raw to the content type of
+	// routes taking the bytes of a file.
+	upload    bool
+	raw       string
+	body      interface{}
+	responses map[int]interface{}
+}
+
+var (
+	pageParams = []apiParam{
+		{"limit", "integer", fmt.Sprintf("Images per page, at most %d.", maxPageSize)},
+		{"pageToken", "string", "The nextPageToken of the page before."},
+		{"prefix", "string", "Only list images whose id starts with this."},
+		{"q", "string", "Only list images whose id contains this."},
+		{"label", "string", "Only list images labelled with this, such as dog."},
+		{"tag", "string", "Only list images tagged with this."},
+		{"sort", "string", "Order by name, size or updated."},
+		{"order", "string", "asc or desc."},
+		{"delimiter", "string", "Roll images nested below the prefix up into folders, such as /."},
+		{"fresh", "boolean", "List from storage rather than from the cache."},
+		{"format", "string", "json for pages, or ndjson to stream every image, one per line, in id order."},
+	}
+	keepExifParam = apiParam{"keepExif", "boolean", "Keep a JPEG's EXIF and XMP metadata when STRIP_EXIF is set."}
+	contentParams = []apiParam{
+		{"w", "integer", "Width to scale to."},
+		{"h", "integer", "Height to scale to."},
+		{"fit", "string", "inside or cover."},
+		{"format", "string", "jpeg, png or webp, if the server encodes WebP. Then, without it, clients that accept image/webp get WebP."},
+		{"quality", "integer", "Quality of a conversion, from 1 to 100. Defaults to 85."},
+		{"watermark", "boolean", "With false and an API key, serve the image without the watermark WATERMARK_MODE=serve stamps on it."},
+		{"download", "boolean", "Send as an attachment."},
+	}
+)
+
+// apiOperations documents every route of the API. A test checks it against
+// the router, so that neither can change without the other.
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, path: "/api/v1/image", summary: "List images",
+		query:     pageParams,
+		responses: map[int]interface{}{http.StatusOK: ImagePage{}, http.StatusNotModified: nil, http.StatusBadRequest: ErrorMessage{}},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image", summary: "Upload one or more images",
+		query: []apiParam{
+			{"overwrite", "boolean", "Replace an image with the same id."},
+			{"force", "boolean", "Store the upload even if an image with the same content exists."},
+			keepExifParam,
+		},
+		upload: true,
+		body:   JSONUpload{},
+		responses: map[int]interface{}{
+			http.StatusCreated:              Image{},
+			http.StatusOK:                   UploadResults{},
+			http.StatusConflict:             Message{},
+			http.StatusUnsupportedMediaType: InvalidType{},
+			http.StatusUnprocessableEntity:  Rejected{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image:batchDelete", summary: "Delete many images for good",
+		body:      BatchDeleteRequest{},
+		responses: map[int]interface{}{http.StatusOK: BatchDeleteResults{}, http.StatusBadRequest: ErrorMessage{}},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image:fetch", summary: "Upload an image from a URL",
+		query: []apiParam{
+			{"overwrite", "boolean", "Replace an image with the same id."},
+			{"force", "boolean", "Store the image even if one with the same content exists."},
+			keepExifParam,
+		},
+		body: FetchRequest{},
+		responses: map[int]interface{}{
+			http.StatusCreated:               Image{},
+			http.StatusOK:                    Image{},
+			http.StatusBadRequest:            ErrorMessage{},
+			http.StatusConflict:              Message{},
+			http.StatusRequestEntityTooLarge: ErrorMessage{},
+			http.StatusUnsupportedMediaType:  InvalidType{},
+			http.StatusBadGateway:            ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image/upload-url", summary: "Get a URL to upload a file to directly",
+		body:      UploadURLRequest{},
+		responses: map[int]interface{}{http.StatusOK: UploadURL{}, http.StatusBadRequest: ErrorMessage{}},
+	},
+	{
+		method: http.MethodPut, path: "/api/v1/uploads/{filename}", summary: "Upload a file to a URL from upload-url",
+		query: []apiParam{{"expires", "integer", "When the URL expires, in seconds since the epoch."}},
+		raw:   "image/*",
+		responses: map[int]interface{}{
+			http.StatusCreated:               Image{},
+			http.StatusForbidden:             ErrorMessage{},
+			http.StatusRequestEntityTooLarge: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/upload/", summary: "Start a resumable tus upload of Upload-Length bytes",
+		responses: map[int]interface{}{
+			http.StatusCreated:               nil,
+			http.StatusBadRequest:            ErrorMessage{},
+			http.StatusPreconditionFailed:    ErrorMessage{},
+			http.StatusRequestEntityTooLarge: ErrorMessage{},
+			http.StatusUnsupportedMediaType:  InvalidType{},
+		},
+	},
+	{
+		method: http.MethodHead, path: "/api/v1/upload/{id}", summary: "Get the Upload-Offset of a tus upload",
+		responses: map[int]interface{}{http.StatusOK: nil, http.StatusNotFound: nil},
+	},
+	{
+		method: http.MethodPatch, path: "/api/v1/upload/{id}", summary: "Add to a tus upload at Upload-Offset",
+		raw: tusContentType,
+		responses: map[int]interface{}{
+			http.StatusNoContent:             nil,
+			http.StatusNotFound:              ErrorMessage{},
+			http.StatusConflict:              ErrorMessage{},
+			http.StatusRequestEntityTooLarge: ErrorMessage{},
+			http.StatusUnsupportedMediaType:  InvalidType{},
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/api/v1/upload/{id}", summary: "Abandon a tus upload",
+		responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusNotFound: ErrorMessage{}},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/image/{id}", summary: "Get an image",
+		responses: map[int]interface{}{http.StatusOK: Image{}, http.StatusNotModified: nil, http.StatusNotFound: ErrorMessage{}, http.StatusGone: ErrorMessage{}},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image/{id}", summary: "Replace an image",
+		query:     []apiParam{keepExifParam},
+		upload:    true,
+		responses: map[int]interface{}{http.StatusOK: Message{}, http.StatusNotFound: ErrorMessage{}, http.StatusPreconditionFailed: ErrorMessage{}},
+	},
+	{
+		method: http.MethodPut, path: "/api/v1/image/{id}", summary: "Replace an image, or store the raw bytes of one under id",
+		query:  []apiParam{keepExifParam},
+		upload: true,
+		raw:    "image/*",
+		responses: map[int]interface{}{
+			http.StatusOK:                    Message{},
+			http.StatusCreated:               Image{},
+			http.StatusNotFound:              ErrorMessage{},
+			http.StatusPreconditionFailed:    ErrorMessage{},
+			http.StatusRequestEntityTooLarge: ErrorMessage{},
+			http.StatusUnsupportedMediaType:  InvalidType{},
+		},
+	},
+	{
+		method: http.MethodPatch, path: "/api/v1/image/{id}", summary: "Change the tags, metadata and time to live of an image",
+		body:      MetadataPatch{},
+		responses: map[int]interface{}{http.StatusOK: Image{}, http.StatusBadRequest: ErrorMessage{}, http.StatusNotFound: ErrorMessage{}},
+	},
+	{
+		method: http.MethodDelete, path: "/api/v1/image/{id}", summary: "Move an image to the trash",
+		query: []apiParam{{"hard", "boolean", "Delete for good instead."}},
+		responses: map[int]interface{}{
+			http.StatusNoContent: nil, http.StatusNotFound: ErrorMessage{}, http.StatusPreconditionFailed: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/image/{id}/content", summary: "Get the bytes of an image, optionally resized",
+		query: contentParams,
+		responses: map[int]interface{}{
+			http.StatusOK: binary("image/*"), http.StatusNotModified: nil, http.StatusUnauthorized: ErrorMessage{}, http.StatusNotFound: ErrorMessage{},
+			http.StatusNotImplemented: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/image/{id}/thumbnail", summary: "Get the thumbnail of an image",
+		query:     []apiParam{{"download", "boolean", "Send as an attachment."}},
+		responses: map[int]interface{}{http.StatusOK: binary("image/*"), http.StatusNotModified: nil, http.StatusNotFound: ErrorMessage{}},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/image/{id}/signed-url", summary: "Get a time limited URL for an image",
+		query:     []apiParam{{"ttl", "string", "How long the URL lasts, like 15m."}},
+		responses: map[int]interface{}{http.StatusOK: SignedURL{}, http.StatusNotFound: ErrorMessage{}},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/image/{id}/exif", summary: "Read the EXIF of an image",
+		responses: map[int]interface{}{
+			http.StatusOK: ImageExif{}, http.StatusNotFound: ErrorMessage{}, http.StatusUnprocessableEntity: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/image/{id}/similar", summary: "Find the images that look like an image",
+		query: []apiParam{{"threshold", "integer", "How many bits of the perceptual hashes can differ, from 0 to 64. Defaults to 10."}},
+		responses: map[int]interface{}{
+			http.StatusOK: SimilarImages{}, http.StatusBadRequest: ErrorMessage{}, http.StatusNotFound: ErrorMessage{}, http.StatusUnprocessableEntity: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image/{id}:rename", summary: "Give an image a new name, keeping its contents and metadata",
+		query: []apiParam{{"overwrite", "boolean", "Replace an image that already has the new name."}},
+		body:  RenameRequest{},
+		responses: map[int]interface{}{
+			http.StatusOK:         Image{},
+			http.StatusBadRequest: ErrorMessage{},
+			http.StatusNotFound:   ErrorMessage{},
+			http.StatusConflict:   ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image/{id}:copy", summary: "Store a copy of an image under a new name",
+		query: []apiParam{{"overwrite", "boolean", "Replace an image that already has the new name."}},
+		body:  CopyRequest{},
+		responses: map[int]interface{}{
+			http.StatusCreated:    Image{},
+			http.StatusBadRequest: ErrorMessage{},
+			http.StatusNotFound:   ErrorMessage{},
+			http.StatusConflict:   ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image/{id}:transform", summary: "Rotate and crop an image, in place or into a new one",
+		query: []apiParam{{"overwrite", "boolean", "Replace an image that already has the destination's name."}},
+		body:  TransformRequest{},
+		responses: map[int]interface{}{
+			http.StatusOK:                  Image{},
+			http.StatusCreated:             Image{},
+			http.StatusBadRequest:          ErrorMessage{},
+			http.StatusNotFound:            ErrorMessage{},
+			http.StatusConflict:            Message{},
+			http.StatusPreconditionFailed:  ErrorMessage{},
+			http.StatusUnprocessableEntity: ErrorMessage{},
+			http.StatusNotImplemented:      ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image/{id}:verify", summary: "Check an image's contents against the checksums stored with them",
+		responses: map[int]interface{}{http.StatusOK: Verification{}, http.StatusNotFound: ErrorMessage{}},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/image/{id}/versions", summary: "List the kept generations of an image, if the bucket has object versioning",
+		responses: map[int]interface{}{
+			http.StatusOK: ImageVersions{}, http.StatusNotFound: ErrorMessage{}, http.StatusNotImplemented: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/image/{id}/versions/{generation}/content", summary: "Get the bytes of one generation of an image",
+		query: []apiParam{{"download", "boolean", "Send as an attachment."}},
+		responses: map[int]interface{}{
+			http.StatusOK:             binary("image/*"),
+			http.StatusNotModified:    nil,
+			http.StatusBadRequest:     ErrorMessage{},
+			http.StatusNotFound:       ErrorMessage{},
+			http.StatusNotImplemented: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/image/{id}/versions/{generation}:restore", summary: "Make an old generation of an image current again",
+		responses: map[int]interface{}{
+			http.StatusOK:                 Image{},
+			http.StatusBadRequest:         ErrorMessage{},
+			http.StatusNotFound:           ErrorMessage{},
+			http.StatusPreconditionFailed: ErrorMessage{},
+			http.StatusNotImplemented:     ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/stats", summary: "Count images and the space they take",
+		responses: map[int]interface{}{http.StatusOK: Stats{}},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/events", summary: "Follow changes to images as server-sent events",
+		responses: map[int]interface{}{http.StatusOK: binary(eventStreamType), http.StatusServiceUnavailable: ErrorMessage{}},
+	},
+	{
+		method: http.MethodGet, path: socketPath, summary: "Follow changes to images over a WebSocket",
+		responses: map[int]interface{}{
+			http.StatusSwitchingProtocols: nil,
+			http.StatusBadRequest:         ErrorMessage{},
+			http.StatusUpgradeRequired:    ErrorMessage{},
+			http.StatusServiceUnavailable: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/whoami", summary: "Describe the instance that answered",
+		responses: map[int]interface{}{http.StatusOK: WhoAmI{}},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/admin/chaos", summary: "Get how requests are made to misbehave, if ENABLE_CHAOS is set",
+		responses: map[int]interface{}{http.StatusOK: ChaosConfig{}, http.StatusNotFound: ErrorMessage{}},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/admin/chaos", summary: "Delay requests and fail them with a 503 on purpose",
+		body: ChaosConfig{},
+		responses: map[int]interface{}{
+			http.StatusOK:         ChaosConfig{},
+			http.StatusBadRequest: ErrorMessage{},
+			http.StatusNotFound:   ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/api/v1/admin/chaos", summary: "Stop requests misbehaving",
+		responses: map[int]interface{}{http.StatusOK: ChaosConfig{}, http.StatusNotFound: ErrorMessage{}},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/admin/config", summary: "Show the effective configuration, with secrets redacted, to callers with an API key",
+		responses: map[int]interface{}{
+			http.StatusOK:           ConfigView{},
+			http.StatusUnauthorized: ErrorMessage{},
+			http.StatusNotFound:     ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/admin/mode", summary: "Get whether the gallery is open, read-only or down for maintenance",
+		responses: map[int]interface{}{http.StatusOK: ServerMode{}},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/admin/mode", summary: "Make the gallery read-only, down for maintenance, or open again, with an API key",
+		body: ServerMode{},
+		responses: map[int]interface{}{
+			http.StatusOK:           ServerMode{},
+			http.StatusBadRequest:   ErrorMessage{},
+			http.StatusUnauthorized: ErrorMessage{},
+			http.StatusNotFound:     ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/admin/cleanup", summary: "Delete expired images, and remove orphaned thumbnails and variants, old trash and abandoned uploads, with an API key",
+		query: []apiParam{{"dryRun", "boolean", "Only report what would be removed. Defaults to JANITOR_DRY_RUN."}},
+		responses: map[int]interface{}{
+			http.StatusOK:                 CleanupReport{},
+			http.StatusBadRequest:         ErrorMessage{},
+			http.StatusUnauthorized:       ErrorMessage{},
+			http.StatusNotFound:           ErrorMessage{},
+			http.StatusServiceUnavailable: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: gcsEventsPath, summary: "Take in a Cloud Storage notification, pushed by Pub/Sub or Eventarc, if GCS_EVENTS is set",
+		responses: map[int]interface{}{
+			http.StatusNoContent:           nil,
+			http.StatusBadRequest:          ErrorMessage{},
+			http.StatusUnauthorized:        ErrorMessage{},
+			http.StatusNotFound:            ErrorMessage{},
+			http.StatusInternalServerError: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/load", summary: "Keep the CPU busy for a while, if ENABLE_LOAD_ENDPOINT is set",
+		query: []apiParam{
+			{"cpuMillis", "integer", "Milliseconds of every second each worker spins for, at most 1000."},
+			{"duration", "string", fmt.Sprintf("How long to keep it up, such as 5s, at most %s.", maxLoadDuration)},
+			{"workers", "integer", fmt.Sprintf("Goroutines to spin in, at most %d.", maxLoadWorkers)},
+		},
+		responses: map[int]interface{}{
+			http.StatusOK:         LoadResult{},
+			http.StatusBadRequest: ErrorMessage{},
+			http.StatusNotFound:   ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/export.zip", summary: "Download images as a zip, with a manifest.json describing them",
+		query: []apiParam{
+			{"prefix", "string", "Only export images whose ids start with this."},
+			{"ids", "string", "Export these images instead, separated by commas."},
+		},
+		responses: map[int]interface{}{
+			http.StatusOK:                    binary("application/zip"),
+			http.StatusNotFound:              ErrorMessage{},
+			http.StatusRequestEntityTooLarge: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/import", summary: "Store every image in an uploaded zip",
+		query: []apiParam{
+			{"preservePaths", "boolean", "Keep the folders entries are in, rather than only their names."},
+			{"overwrite", "boolean", "Replace images with the same ids."},
+			{"force", "boolean", "Store entries even if images with the same content exist."},
+			keepExifParam,
+		},
+		upload: true,
+		responses: map[int]interface{}{
+			http.StatusCreated:               UploadResults{},
+			http.StatusOK:                    UploadResults{},
+			http.StatusBadRequest:            ErrorMessage{},
+			http.StatusRequestEntityTooLarge: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/trash", summary: "List images in the trash",
+		responses: map[int]interface{}{http.StatusOK: TrashedImages{}},
+	},
+	{
+		method: http.MethodPost, path: "/api/v1/trash/{id}:restore", summary: "Restore an image from the trash",
+		responses: map[int]interface{}{http.StatusOK: Image{}, http.StatusNotFound: ErrorMessage{}, http.StatusConflict: Message{}},
+	},
+	{
+		method: http.MethodPost, path: graphqlPath, summary: "Query images and change their metadata with GraphQL",
+		body: GraphQLRequest{},
+		responses: map[int]interface{}{
+			http.StatusOK:                 GraphQLResponse{},
+			http.StatusBadRequest:         GraphQLResponse{},
+			http.StatusUnauthorized:       ErrorMessage{},
+			http.StatusServiceUnavailable: ErrorMessage{},
+		},
+	},
+	{
+		method: http.MethodGet, path: graphqlPath, summary: "Try out GraphQL queries with GraphiQL, if ENABLE_GRAPHIQL is set",
+		responses: map[int]interface{}{http.StatusOK: binary("text/html"), http.StatusNotFound: ErrorMessage{}},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/openapi.json", summary: "Get this document",
+		responses: map[int]interface{}{http.StatusOK: binary("application/json")},
+	},
+	{
+		method: http.MethodGet, path: "/api/v1/docs", summary: "Browse this document",
+		responses: map[int]interface{}{http.StatusOK: binary("text/html")},
+	},
+}
+
+// OpenAPIDocument is an OpenAPI 3 description of the API.
+type OpenAPIDocument map[string]interface{}
+
+// JSON marshalls the content of OpenAPIDocument to json.
+func (d OpenAPIDocument) JSON() (string, error) {
+	bytes, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of OpenAPIDocument to json as a byte
+// array.
+func (d OpenAPIDocument) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(d)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// pathParam matches the variables in a route template.
+var pathParam = regexp.MustCompile(`{([^}]+)}`)
+
+// NewOpenAPIDocument describes ops, with schemas for every type they use.
+func NewOpenAPIDocument(ops []apiOperation) OpenAPIDocument {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+
+	for _, op := range ops {
+		var params []interface{}
+		for _, m := range pathParam.FindAllStringSubmatch(op.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+		for _, p := range op.query {
+			params = append(params, map[string]interface{}{
+				"name": p.name, "in": "query", "description": p.description, "schema": map[string]string{"type": p.typ},
+			})
+		}
+
+		responses := map[string]interface{}{
+			"default": response("Something went wrong", ErrorMessage{}, schemas),
+		}
+		for status, body := range op.responses {
+			responses[fmt.Sprint(status)] = response(http.StatusText(status), body, schemas)
+		}
+
+		operation := map[string]interface{}{
+			"summary":   op.summary,
+			"responses": responses,
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		content := map[string]interface{}{}
+		if op.upload {
+			content["multipart/form-data"] = map[string]interface{}{
+				"schema": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"myFile"},
+					"properties": map[string]interface{}{
+						"myFile": map[string]string{"type": "string", "format": "binary"},
+					},
+				},
+			}
+		}
+		if op.body != nil {
+			content["application/json"] = map[string]interface{}{"schema": schemaFor(reflect.TypeOf(op.body), schemas)}
+		}
+		if op.raw != "" {
+			content[op.raw] = map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}}
+		}
+		if len(content) > 0 {
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+
+		if op.method != http.MethodGet {
+			operation["security"] = []interface{}{map[string]interface{}{}, map[string]interface{}{"apiKey": []string{}}}
+		}
+
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]interface{}{}
+		}
+		paths[op.path][strings.ToLower(op.method)] = operation
+	}
+
+	return OpenAPIDocument{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "Scaler",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+			},
+		},
+	}
+}
+
+// response describes a response carrying body.
+func response(description string, body interface{}, schemas map[string]interface{}) map[string]interface{} {
+	r := map[string]interface{}{"description": description}
+
+	switch b := body.(type) {
+	case nil:
+	case binary:
+		r["content"] = map[string]interface{}{
+			string(b): map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}},
+		}
+	case ErrorMessage:
+		// Clients that accept problem documents get one instead.
+		r["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaFor(reflect.TypeOf(body), schemas)},
+			problemType:        map[string]interface{}{"schema": schemaFor(reflect.TypeOf(Problem{}), schemas)},
+		}
+	default:
+		r["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaFor(reflect.TypeOf(body), schemas)},
+		}
+	}
+
+	return r
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	// rawType is JSON passed through as it is, which can be anything.
+	rawType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor returns the schema of the JSON t marshals to. Named structs are
+// added to schemas and referred to.
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType:
+		return map[string]interface{}{}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return map[string]interface{}{}
+	}
+
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	if _, ok := schemas[t.Name()]; ok {
+		return ref
+	}
+	// Claim the name first, in case the type refers to itself.
+	schemas[t.Name()] = nil
+
+	properties := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		properties[name] = schemaFor(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	schemas[t.Name()] = schema
+
+	return ref
+}
+
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, NewOpenAPIDocument(apiOperations), http.StatusOK)
+}
+
+// docsPage is Swagger UI, loaded from a CDN, pointed at the document.
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Scaler API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "/api/v1/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+func (s *Server) docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, docsPage)
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestOpenAPIRoutes fails when a route is added without documenting it, or
+// documented without being routed.
+func TestOpenAPIRoutes(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		documented[op.method+" "+op.path] = true
+	}
+
+	routed := map[string]bool{}
+	err := server.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := routeTemplate(route)
+		if err != nil || tpl == "/" {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		for _, m := range methods {
+			if m == http.MethodOptions {
+				continue
+			}
+			routed[m+" "+tpl] = true
+			if !documented[m+" "+tpl] {
+				t.Errorf("%s %s is missing from the OpenAPI document", m, tpl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not walk routes: %s", err)
+	}
+
+	for op := range documented {
+		if !routed[op] {
+			t.Errorf("%s is documented but not routed", op)
+		}
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("expected a JSON document, got: %s", err)
+	}
+
+	if doc.OpenAPI != "3.0.3" {
+		t.Fatalf("expected: 3.0.3, got: %v", doc.OpenAPI)
+	}
+	if _, ok := doc.Paths["/api/v1/image/{id}"]["delete"]; !ok {
+		t.Fatalf("expected the delete route to be documented, got: %v", doc.Paths)
+	}
+
+	image := doc.Components.Schemas["Image"].Properties
+	for _, field := range []string{"name", "sizeBytes", "created"} {
+		if _, ok := image[field]; !ok {
+			t.Fatalf("expected Image to have %s, got: %v", field, image)
+		}
+	}
+	if _, ok := image["ETag"]; ok {
+		t.Fatalf("expected fields left out of the JSON to be left out of the schema")
+	}
+	for _, name := range []string{"Message", "ErrorMessage", "ImagePage"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Fatalf("expected a %s schema, got: %v", name, doc.Components.Schemas)
+		}
+	}
+}
+
+func TestDocsHandler(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/docs", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "/api/v1/openapi.json") {
+		t.Fatalf("expected the page to load the document, got: %s", w.Body.String())
+	}
+}
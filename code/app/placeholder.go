@@ -0,0 +1,317 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"time"
+)
+
+// The metadata an original's placeholders are kept in: its dominant color
+// as #rrggbb, and a BlurHash of it.
+const (
+	dominantColorKey = "dominantColor"
+	blurHashKey      = "blurHash"
+)
+
+// placeholderTimeout bounds how long working out the placeholders of one
+// image can take, including waiting for a slot.
+const placeholderTimeout = time.Minute
+
+// defaultPlaceholderConcurrency is how many images have their placeholders
+// worked out at once unless PLACEHOLDER_CONCURRENCY says otherwise.
+const defaultPlaceholderConcurrency = 2
+
+// placeholderSize is the longest edge images are scaled down to before
+// their placeholders are worked out, which is plenty for a blur.
+const placeholderSize = 64
+
+// blurHashX and blurHashY are how many components a BlurHash has across
+// and down.
+const (
+	blurHashX = 4
+	blurHashY = 3
+)
+
+// EnablePlaceholders has the dominant color and BlurHash of new images
+// worked out in the background, with at most concurrency at once. Images
+// listed or read without them, such as those uploaded before, get them
+// when there is a slot free.
+func (s *Server) EnablePlaceholders(concurrency int) {
+	s.placeholderSlots = make(chan struct{}, concurrency)
+}
+
+// WaitForPlaceholders blocks until every image handed over for
+// placeholders has been dealt with.
+func (s *Server) WaitForPlaceholders() {
+	s.placeholding.Wait()
+}
+
+// placehold has the placeholders of image id worked out in the
+// background, once its original has the content with etag. Failures are
+// logged and never reach the upload, whose ctx is only kept for the tenant
+// and user it was for.
+func (s *Server) placehold(ctx context.Context, id, etag string) {
+	if s.placeholderSlots == nil {
+		return
+	}
+	// A new upload always gets them, even over an image that had them.
+	s.placeholders.Store(scopeOf(ctx)+"/"+id, true)
+
+	s.placeholding.Add(1)
+	go func() {
+		defer s.placeholding.Done()
+
+		ctx, cancel := context.WithTimeout(detachedScope(ctx), placeholderTimeout)
+		defer cancel()
+
+		select {
+		case s.placeholderSlots <- struct{}{}:
+			defer func() { <-s.placeholderSlots }()
+		case <-ctx.Done():
+			weblog(fmt.Sprintf("gave up on placeholders for %s: too many waiting", id))
+			s.placeholders.Delete(scopeOf(ctx) + "/" + id)
+			return
+		}
+
+		if err := s.placeholdImage(ctx, id, etag); err != nil {
+			weblog(fmt.Sprintf("error working out placeholders for %s: %s", id, err))
+		}
+	}()
+}
+
+// placeholdMissing has the placeholders of the images in is that don't
+// have them yet worked out, as far as there are slots free right now. The
+// rest are left for a later request, rather than piling up behind reads.
+func (s *Server) placeholdMissing(ctx context.Context, is Images) {
+	if s.placeholderSlots == nil {
+		return
+	}
+
+	for _, img := range is {
+		if img.BlurHash != "" || !s.claimPlaceholder(ctx, img.Name) {
+			continue
+		}
+
+		select {
+		case s.placeholderSlots <- struct{}{}:
+		default:
+			s.placeholders.Delete(scopeOf(ctx) + "/" + img.Name)
+			return
+		}
+
+		s.placeholding.Add(1)
+		go func(id string) {
+			defer s.placeholding.Done()
+			defer func() { <-s.placeholderSlots }()
+
+			ctx, cancel := context.WithTimeout(detachedScope(ctx), placeholderTimeout)
+			defer cancel()
+
+			if err := s.placeholdImage(ctx, id, ""); err != nil {
+				weblog(fmt.Sprintf("error working out placeholders for %s: %s", id, err))
+			}
+		}(img.Name)
+	}
+}
+
+// claimPlaceholder reports whether image id is to have its placeholders
+// worked out, which it is only once per instance: an image that can't be
+// decoded would otherwise be tried on every read.
+func (s *Server) claimPlaceholder(ctx context.Context, id string) bool {
+	_, claimed := s.placeholders.LoadOrStore(scopeOf(ctx)+"/"+id, true)
+	return !claimed
+}
+
+// placeholdImage works out the placeholders of the original of image id
+// and keeps them in its metadata. An original that can't be decoded is
+// left without them.
+func (s *Server) placeholdImage(ctx context.Context, id, etag string) error {
+	original, err := s.awaitOriginal(ctx, id, etag)
+	if err != nil {
+		return err
+	}
+
+	obj, err := s.storage.OpenObject(ctx, original.Name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	color, hash, ok := placeholders(obj)
+	if !ok {
+		return nil
+	}
+
+	if err := s.storage.UpdateMetadata(ctx, original.Name, map[string]string{dominantColorKey: color, blurHashKey: hash}); err != nil {
+		return err
+	}
+	s.lists.invalidate()
+
+	return nil
+}
+
+// placeholders decodes the image in r and returns its dominant color and
+// BlurHash, or false if it can't be decoded.
+func placeholders(r io.Reader) (string, string, bool) {
+	src, _, err := decodeImage(r)
+	if err != nil || src.Bounds().Empty() {
+		return "", "", false
+	}
+
+	small := scaleToFit(src, placeholderSize, placeholderSize)
+	return dominantColor(small), blurHash(small, blurHashX, blurHashY), true
+}
+
+// dominantColor returns the most common color of img as #rrggbb. Colors
+// are counted in buckets of 16 levels a channel, so that near enough the
+// same color counts as one, and the bucket's colors averaged.
+func dominantColor(img image.Image) string {
+	type bucket struct {
+		n, r, g, b int
+	}
+	var buckets [4096]bucket
+
+	best := 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cr, cg, cb, ca := img.At(x, y).RGBA()
+			if ca == 0 {
+				continue
+			}
+			r, g, bl := int(cr>>8), int(cg>>8), int(cb>>8)
+			i := r>>4<<8 | g>>4<<4 | bl>>4
+			buckets[i].n++
+			buckets[i].r += r
+			buckets[i].g += g
+			buckets[i].b += bl
+			if buckets[i].n > buckets[best].n {
+				best = i
+			}
+		}
+	}
+
+	d := buckets[best]
+	if d.n == 0 {
+		return "#000000"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", d.r/d.n, d.g/d.n, d.b/d.n)
+}
+
+// blurHashChars are the digits of the base 83 BlurHash is written in.
+const blurHashChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHash encodes img as a BlurHash with nx by ny components, as
+// described at https://github.com/woltapp/blurhash.
+func blurHash(img image.Image, nx, ny int) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// The pixels in linear RGB, so they are only converted once.
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			linear[y*w+x] = [3]float64{sRGBToLinear(r >> 8), sRGBToLinear(g >> 8), sRGBToLinear(bl >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, nx*ny)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := linear[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	hash := encode83((nx-1)+(ny-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash += encode83(quantisedMax, 1)
+	} else {
+		hash += encode83(0, 1)
+	}
+
+	hash += encode83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash += encode83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+
+	return hash
+}
+
+// encode83 writes n as length base 83 digits.
+func encode83(n, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = blurHashChars[n%83]
+		n /= 83
+	}
+
+	return string(out)
+}
+
+// sRGBToLinear converts an 8 bit sRGB channel to linear light.
+func sRGBToLinear(v uint32) float64 {
+	x := float64(v) / 255
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts linear light back to an 8 bit sRGB channel.
+func linearToSRGB(v float64) int {
+	x := math.Max(0, math.Min(1, v))
+	if x <= 0.0031308 {
+		return int(x*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(x, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow is |v| to the power of exp, with the sign of v.
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// solid returns a w by h image of c.
+func solid(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func TestBlurHash(t *testing.T) {
+	// A 4x3 size flag, the largest component, the average color, white,
+	// and eleven more components.
+	want := "LfTSUA~qfQ~q~qt7fQt7fQfQfQfQ"
+	if got := blurHash(solid(8, 8, color.White), 4, 3); got != want {
+		t.Fatalf("expected: %s, got: %s", want, got)
+	}
+
+	half := solid(8, 8, color.White)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 4; x++ {
+			half.Set(x, y, color.Black)
+		}
+	}
+	got := blurHash(half, 4, 3)
+	if len(got) != 28 || got == want || got[0] != 'L' || strings.HasPrefix(got[2:], "TSUA") {
+		t.Fatalf("expected a 4x3 hash with detail, got: %s", got)
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	img := solid(10, 10, color.RGBA{R: 255, A: 255})
+	for x := 0; x < 10; x++ {
+		img.Set(x, 0, color.RGBA{B: 255, A: 255})
+		img.Set(x, 1, color.RGBA{B: 250, A: 255})
+	}
+	if got := dominantColor(img); got != "#ff0000" {
+		t.Fatalf("expected: %s, got: %s", "#ff0000", got)
+	}
+}
+
+func TestPlaceholdersOnUpload(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	server.EnablePlaceholders(1)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "a.png", "image/png", testPNG(t)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	server.WaitForPlaceholders()
+
+	img := readImage(t, server, "a")
+	if !regexp.MustCompile(`^#[0-9a-f]{6}$`).MatchString(img.DominantColor) || len(img.BlurHash) != 28 {
+		t.Fatalf("expected placeholders, got: %q %q", img.DominantColor, img.BlurHash)
+	}
+	if _, ok := img.Metadata[blurHashKey]; ok {
+		t.Fatalf("expected placeholders not to show as user metadata, got: %v", img.Metadata)
+	}
+}
+
+func TestPlaceholdersLazily(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	if _, err := ms.Create(context.Background(), "broken.png", newMemoryFile([]byte("not an image")), CreateOptions{}); err != nil {
+		t.Fatalf("could not create broken.png: %s", err)
+	}
+	server := NewServer(ms)
+
+	// Without placeholders enabled, nothing is worked out.
+	if img := readImage(t, server, "a"); img.BlurHash != "" {
+		t.Fatalf("expected no placeholders, got: %q", img.BlurHash)
+	}
+
+	server.EnablePlaceholders(2)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+	server.WaitForPlaceholders()
+
+	if img := readImage(t, server, "a"); img.DominantColor == "" || img.BlurHash == "" {
+		t.Fatalf("expected placeholders after listing, got: %q %q", img.DominantColor, img.BlurHash)
+	}
+
+	// An image that can't be decoded goes without, and isn't tried again.
+	if img := readImage(t, server, "broken"); img.DominantColor != "" || img.BlurHash != "" {
+		t.Fatalf("expected no placeholders, got: %q %q", img.DominantColor, img.BlurHash)
+	}
+	if server.claimPlaceholder(context.Background(), "broken") {
+		t.Fatalf("expected broken to have been tried")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// problemType is the content type of an RFC 7807 error response.
+const problemType = "application/problem+json"
+
+// problemTypeBase starts the type of every problem the API knows. The
+// types are relative, so they name this API's problems wherever it is
+// served.
+const problemTypeBase = "/problems/"
+
+// problemKind is the type and title of a problem.
+type problemKind struct {
+	Type  string
+	Title string
+}
+
+// problemKinds are the problems the error codes stand for. An error
+// without one is about:blank, titled after its status, as RFC 7807 has it.
+var problemKinds = map[string]problemKind{
+	codeInvalidArgument:  {problemTypeBase + "invalid-argument", "Invalid argument"},
+	codeNotFound:         {problemTypeBase + "not-found", "Not found"},
+	codeGone:             {problemTypeBase + "gone", "Gone"},
+	codeConflict:         {problemTypeBase + "conflict", "Already exists"},
+	codePrecondition:     {problemTypeBase + "failed-precondition", "Precondition failed"},
+	codeTooLarge:         {problemTypeBase + "too-large", "Too large"},
+	codeUnsupportedType:  {problemTypeBase + "unsupported-type", "Unsupported type"},
+	codeUnprocessable:    {problemTypeBase + "unprocessable", "Unprocessable"},
+	codeInternal:         {problemTypeBase + "internal", "Internal error"},
+	codeUnimplemented:    {problemTypeBase + "unimplemented", "Not implemented"},
+	codeUpstream:         {problemTypeBase + "upstream", "Upstream failure"},
+	codeUnavailable:      {problemTypeBase + "unavailable", "Unavailable"},
+	codeUnauthenticated:  {problemTypeBase + "unauthenticated", "Unauthenticated"},
+	codePermissionDenied: {problemTypeBase + "permission-denied", "Permission denied"},
+	codeMethodNotAllowed: {problemTypeBase + "method-not-allowed", "Method not allowed"},
+	codeRateLimited:      {problemTypeBase + "rate-limited", "Rate limited"},
+}
+
+// newProblem is the problem for an error with code, answered with status.
+func newProblem(status int, code, detail, requestID string) Problem {
+	if code == "" {
+		code = envelopeCode(status)
+	}
+	kind, ok := problemKinds[code]
+	if !ok {
+		kind = problemKind{Type: "about:blank", Title: http.StatusText(status)}
+	}
+
+	return Problem{Type: kind.Type, Title: kind.Title, Status: status, Detail: detail, Instance: requestID, Code: code}
+}
+
+// writeProblem writes an error as a problem document.
+func writeProblem(w http.ResponseWriter, status int, code, detail string) {
+	// The status in the document has to be the one it is sent with.
+	if status >= http.StatusInternalServerError && requestErr(w) == context.DeadlineExceeded {
+		status = http.StatusGatewayTimeout
+	}
+
+	msg, err := newProblem(status, code, detail, w.Header().Get(requestIDHeader)).JSON()
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, `{"error":"could not marshal json for response"}`)
+		return
+	}
+	writeResponseType(w, status, problemType, msg)
+}
+
+// problems is middleware that marks the responses of requests accepting
+// application/problem+json, so that their errors are written as problem
+// documents. Other clients keep getting ErrorMessage.
+func problems(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsProblem(r.Header.Get("Accept")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(&problemWriter{w}, r)
+	})
+}
+
+// problemWriter is a ResponseWriter whose errors are problem documents.
+type problemWriter struct {
+	http.ResponseWriter
+}
+
+// Flush lets streaming handlers flush through the writer.
+func (pw *problemWriter) Flush() {
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (pw *problemWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// wantsProblem reports whether w, or a writer it wraps, is a
+// problemWriter.
+func wantsProblem(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(*problemWriter); ok {
+			return true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
+
+// acceptsProblem reports whether an Accept header names
+// application/problem+json. Wildcards don't count: a client that takes
+// anything gets the errors it always has.
+func acceptsProblem(header string) bool {
+	return acceptsType(header, problemType)
+}
+
+// acceptsType reports whether an Accept header names mediaType, and
+// doesn't give it a quality of zero.
+func acceptsType(header, mediaType string) bool {
+	for _, part := range strings.Split(header, ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || t != mediaType {
+			continue
+		}
+
+		if q, ok := params["q"]; ok {
+			f, err := strconv.ParseFloat(q, 64)
+			return err == nil && f > 0
+		}
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProblemErrors(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+	server.RequireAPIKey([]string{"secret"}, false)
+	handler := requestID(server)
+
+	tests := map[string]struct {
+		method, target string
+		want           Problem
+	}{
+		"missing": {http.MethodGet, "/api/v1/image/nope", Problem{
+			Type: "/problems/not-found", Title: "Not found", Status: http.StatusNotFound, Detail: "image id: nope", Code: codeNotFound,
+		}},
+		"bad page token": {http.MethodGet, "/api/v1/image?pageToken=???", Problem{
+			Type: "/problems/invalid-argument", Title: "Invalid argument", Status: http.StatusBadRequest, Code: codeInvalidArgument,
+		}},
+		"no key": {http.MethodDelete, "/api/v1/image/a", Problem{
+			Type: "/problems/unauthenticated", Title: "Unauthenticated", Status: http.StatusUnauthorized, Code: codeUnauthenticated,
+		}},
+	}
+	for name, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		r.Header.Set("Accept", "application/problem+json, application/json;q=0.9")
+		r.Header.Set(requestIDHeader, "req-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if ct := w.Header().Get("Content-Type"); ct != problemType {
+			t.Errorf("%s: expected: %s, got: %s", name, problemType, ct)
+		}
+		var got Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: expected a problem, got: %q", name, w.Body.String())
+		}
+		if got.Type != test.want.Type || got.Title != test.want.Title || got.Status != test.want.Status || got.Code != test.want.Code || got.Instance != "req-1" || got.Detail == "" {
+			t.Errorf("%s: expected: %+v, got: %+v", name, test.want, got)
+		}
+		if test.want.Detail != "" && got.Detail != test.want.Detail {
+			t.Errorf("%s: expected: %s, got: %s", name, test.want.Detail, got.Detail)
+		}
+		if w.Code != got.Status {
+			t.Errorf("%s: expected the status sent, %v, got: %v", name, w.Code, got.Status)
+		}
+	}
+}
+
+func TestProblemNotAccepted(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	for _, accept := range []string{"", "application/json", "*/*", "application/problem+json;q=0"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image?pageToken=???", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		var got ErrorMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Code != codeInvalidArgument || got.Error == "" {
+			t.Errorf("%q: expected the usual error, got: %q", accept, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("%q: expected json, got: %s", accept, ct)
+		}
+	}
+
+	// Successes are the same either way.
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil)
+	r.Header.Set("Accept", problemType)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Fatalf("expected a, got: %v %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestNewProblem(t *testing.T) {
+	// A status without a code of its own is about:blank.
+	got := newProblem(http.StatusTeapot, "", "short and stout", "")
+	if got.Type != "about:blank" || got.Title != http.StatusText(http.StatusTeapot) || got.Code != codeUnknown {
+		t.Fatalf("expected about:blank, got: %+v", got)
+	}
+
+	// Every code has a problem type.
+	for status := 400; status < 600; status++ {
+		if code := errorCode(status); code != "" {
+			if _, ok := problemKinds[code]; !ok {
+				t.Errorf("expected a problem type for %s", code)
+			}
+		}
+	}
+}
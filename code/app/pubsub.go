@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/pubsub"
+)
+
+// PubSubPublisher publishes events to a Pub/Sub topic in the structured
+// CloudEvents format, which Eventarc understands.
+type PubSubPublisher struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+}
+
+// NewPubSubPublisher returns a publisher for topic, given either in full as
+// projects/PROJECT/topics/TOPIC or by its id alone. The project of a bare id
+// is taken from GOOGLE_CLOUD_PROJECT, or failing that the metadata server.
+func NewPubSubPublisher(ctx context.Context, topic string) (*PubSubPublisher, error) {
+	project, id, err := topicProject(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("could not create pubsub client: %s", err)
+	}
+
+	return &PubSubPublisher{client: client, topic: client.Topic(id)}, nil
+}
+
+// topicProject splits topic into the project it belongs to and its id.
+func topicProject(topic string) (string, string, error) {
+	if parts := strings.Split(topic, "/"); len(parts) == 4 && parts[0] == "projects" && parts[2] == "topics" {
+		return parts[1], parts[3], nil
+	}
+	if strings.Contains(topic, "/") {
+		return "", "", fmt.Errorf("invalid topic %q: want projects/PROJECT/topics/TOPIC or a topic id", topic)
+	}
+
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return project, topic, nil
+	}
+	if metadata.OnGCE() {
+		project, err := metadata.ProjectID()
+		if err != nil {
+			return "", "", fmt.Errorf("could not look up project: %s", err)
+		}
+		return project, topic, nil
+	}
+
+	return "", "", fmt.Errorf("no project for topic %q: set GOOGLE_CLOUD_PROJECT or give the full topic name", topic)
+}
+
+// Publish sends e and waits for Pub/Sub to accept it.
+func (p *PubSubPublisher) Publish(ctx context.Context, e CloudEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %s", err)
+	}
+
+	res := p.topic.Publish(ctx, &pubsub.Message{
+		Data:       data,
+		Attributes: map[string]string{"content-type": "application/cloudevents+json; charset=UTF-8"},
+	})
+	if _, err := res.Get(ctx); err != nil {
+		return fmt.Errorf("could not publish event: %w", err)
+	}
+
+	return nil
+}
+
+// Close sends any events still waiting to go and releases the client.
+func (p *PubSubPublisher) Close() error {
+	p.topic.Stop()
+	return p.client.Close()
+}
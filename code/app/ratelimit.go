@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// trustedProxies, set from TRUSTED_PROXIES, is how many proxies in front of
+// the server add to X-Forwarded-For, such as 1 on Cloud Run. With 0 clients
+// are told apart by the address they connect from.
+var trustedProxies = 0
+
+// rateLimitSweepInterval is how often clients that have gone quiet are
+// forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is how many requests a second a client can make, and how many
+// it can make at once after a lull. A zero Rate leaves requests unlimited.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter holds a token bucket per client IP, one for reads and another
+// for requests that change images.
+type RateLimiter struct {
+	reads, writes RateLimit
+
+	mu      sync.Mutex
+	clients map[string]*clientLimits
+}
+
+// clientLimits are the buckets of a single client.
+type clientLimits struct {
+	reads, writes *rate.Limiter
+}
+
+// NewRateLimiter returns a RateLimiter that allows each client reads and
+// writes.
+func NewRateLimiter(reads, writes RateLimit) *RateLimiter {
+	return &RateLimiter{
+		reads:   reads,
+		writes:  writes,
+		clients: map[string]*clientLimits{},
+	}
+}
+
+func (l RateLimit) limiter() *rate.Limiter {
+	if l.Rate <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+
+	burst := l.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	return rate.NewLimiter(rate.Limit(l.Rate), burst)
+}
+
+// limiter returns the bucket r is taken from.
+func (rl *RateLimiter) limiter(r *http.Request) *rate.Limiter {
+	ip := clientIP(r)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	c, ok := rl.clients[ip]
+	if !ok {
+		c = &clientLimits{reads: rl.reads.limiter(), writes: rl.writes.limiter()}
+		rl.clients[ip] = c
+	}
+
+	if isRead(r) || r.Method == http.MethodOptions {
+		return c.reads
+	}
+	return c.writes
+}
+
+// Middleware answers clients that have run out of requests with a 429,
+// telling them when to try again.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := rl.limiter(r).Reserve()
+		if delay := res.Delay(); delay > 0 {
+			res.Cancel()
+
+			secs := int(math.Ceil(delay.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			msg := Message{Text: "too many requests", Details: fmt.Sprintf("try again in %d seconds", secs)}
+			writeJSON(w, msg, http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sweep forgets clients whose buckets have filled back up, as they would be
+// no different from new ones.
+func (rl *RateLimiter) sweep(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for ip, c := range rl.clients {
+		if full(c.reads, now) && full(c.writes, now) {
+			delete(rl.clients, ip)
+		}
+	}
+}
+
+func full(l *rate.Limiter, now time.Time) bool {
+	return l.Limit() == rate.Inf || l.TokensAt(now) >= float64(l.Burst())
+}
+
+// Sweep forgets quiet clients every interval until ctx is done.
+func (rl *RateLimiter) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rl.sweep(now)
+		}
+	}
+}
+
+// clientIP is the address r came from. Behind trustedProxies proxies that is
+// the address the first of them added to X-Forwarded-For, counting from the
+// end; any before it were supplied by the client and can't be trusted. With
+// no proxies X-Forwarded-For is the client's own, and is ignored.
+func clientIP(r *http.Request) string {
+	if trustedProxies > 0 {
+		var addrs []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			addrs = append(addrs, strings.Split(v, ",")...)
+		}
+		if i := len(addrs) - trustedProxies; i >= 0 {
+			if ip := strings.TrimSpace(addrs[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
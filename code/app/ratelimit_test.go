@@ -0,0 +1,142 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	limiter := NewRateLimiter(RateLimit{Rate: 1, Burst: 2}, RateLimit{Rate: 0.1, Burst: 1})
+	server.Use(limiter.Middleware)
+
+	do := func(method, target, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	type test struct {
+		method string
+		target string
+		ip     string
+		want   int
+	}
+
+	tests := []test{
+		{method: http.MethodGet, target: "/api/v1/image", ip: "10.0.0.1", want: http.StatusOK},
+		{method: http.MethodGet, target: "/api/v1/image", ip: "10.0.0.1", want: http.StatusOK},
+		{method: http.MethodGet, target: "/api/v1/image", ip: "10.0.0.1", want: http.StatusTooManyRequests},
+		{method: http.MethodGet, target: "/api/v1/image", ip: "10.0.0.2", want: http.StatusOK},
+		{method: http.MethodDelete, target: "/api/v1/image/a", ip: "10.0.0.1", want: http.StatusNotFound},
+		{method: http.MethodDelete, target: "/api/v1/image/a", ip: "10.0.0.1", want: http.StatusTooManyRequests},
+	}
+
+	for i, c := range tests {
+		w := do(c.method, c.target, c.ip)
+		if w.Code != c.want {
+			t.Fatalf("request %d expected: %v, got: %v", i, c.want, w.Code)
+		}
+		if w.Code != http.StatusTooManyRequests {
+			continue
+		}
+
+		if w.Header().Get("Retry-After") == "" {
+			t.Fatalf("request %d expected a Retry-After header", i)
+		}
+		var msg Message
+		if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+			t.Fatalf("request %d expected a JSON message, got: %s", i, w.Body.String())
+		}
+	}
+
+	if w := do(http.MethodGet, "/healthz", "10.0.0.1"); w.Code != http.StatusOK {
+		t.Fatalf("expected health checks not to be limited, got: %v", w.Code)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Rate: 1, Burst: 1}, RateLimit{})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)
+	limiter.limiter(r).Allow()
+
+	limiter.sweep(time.Now())
+	if len(limiter.clients) != 1 {
+		t.Fatalf("expected a client that just made a request to be kept")
+	}
+
+	limiter.sweep(time.Now().Add(time.Minute))
+	if len(limiter.clients) != 0 {
+		t.Fatalf("expected a quiet client to be forgotten, got: %v", limiter.clients)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	type test struct {
+		proxies   int
+		forwarded []string
+		want      string
+	}
+
+	tests := []test{
+		{want: "192.0.2.1"},
+		{forwarded: []string{"203.0.113.7"}, want: "192.0.2.1"},
+		{proxies: 1, want: "192.0.2.1"},
+		{proxies: 1, forwarded: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{proxies: 1, forwarded: []string{"198.51.100.1, 203.0.113.7"}, want: "203.0.113.7"},
+		{proxies: 1, forwarded: []string{"198.51.100.1", "203.0.113.7"}, want: "203.0.113.7"},
+		{proxies: 2, forwarded: []string{"198.51.100.1, 203.0.113.7, 10.0.0.1"}, want: "203.0.113.7"},
+		{proxies: 2, forwarded: []string{"10.0.0.1"}, want: "192.0.2.1"},
+	}
+
+	defer func(old int) { trustedProxies = old }(trustedProxies)
+	for _, c := range tests {
+		trustedProxies = c.proxies
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, f := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+
+		if got := clientIP(r); got != c.want {
+			t.Fatalf("%d %v expected: %v, got: %v", c.proxies, c.forwarded, c.want, got)
+		}
+	}
+}
+
+func TestRateLimiterSpoofedForwardedFor(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	server.Use(NewRateLimiter(RateLimit{Rate: 1, Burst: 1}, RateLimit{}).Middleware)
+
+	// With no proxy in front, a client can't get a fresh bucket by making up
+	// a new address each time.
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)
+		r.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Fatalf("request %d expected: %v, got: %v", i, want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// preferredExtensions are the extensions raw uploads of the common image
+// types are stored with, where the system knows several.
+var preferredExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	mimeHEIC:     ".heic",
+	mimeHEIF:     ".heif",
+}
+
+// isMultipart reports whether r has a multipart form body.
+func isMultipart(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "multipart/form-data"
+}
+
+// extensionFor is the extension to store a file of contentType with.
+func extensionFor(contentType string) string {
+	if ext, ok := preferredExtensions[contentType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(contentType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+
+	return ""
+}
+
+// checkImageID rejects ids an image can't be stored under.
+func checkImageID(id string) error {
+	if len(id) > maxFilenameLength || !validFileID(id) || strings.IndexFunc(id, unicode.IsControl) > -1 {
+		return fmt.Errorf("invalid image id %q", id)
+	}
+
+	return nil
+}
+
+// rawPutHandler stores the body of a PUT as image id, creating or replacing
+// it, for clients that know what they want to call an image and don't want
+// to build a form. If-None-Match: * only creates, failing with a 412 if the
+// image exists, and If-Match only replaces the generation it names. A
+// Content-MD5 the body doesn't have fails it with a 400.
+func (s *Server) rawPutHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := checkImageID(id); err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	sum, err := contentMD5(r.Header.Get("Content-MD5"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	generation, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	um := readUserMetadata(nil)
+	if err := um.setTTL(r.Header.Get(ttlHeader)); err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil {
+		err = s.checkDeclaredType(contentType)
+	}
+	if err != nil {
+		msg := InvalidType{
+			Text:    "invalid image type",
+			Details: fmt.Sprintf("%q is not an allowed type", r.Header.Get("Content-Type")),
+			Allowed: allowedMimeTypes.Slice(),
+		}
+		if err == errHEIFDisabled {
+			msg.Details = err.Error()
+		}
+		writeJSON(w, msg, http.StatusUnsupportedMediaType)
+		return
+	}
+	ext := extensionFor(contentType)
+	if ext == "" {
+		writeError(w, invalidArgument(fmt.Errorf("no extension is known for %s", contentType)))
+		return
+	}
+
+	createOnly := strings.TrimSpace(r.Header.Get("If-None-Match")) == "*"
+	fs, err := s.storage.Read(r.Context(), id)
+	exists := err == nil
+	if err != nil && err != ErrNotFound {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", id, err))
+		return
+	}
+	if exists && createOnly {
+		writeErrorMsg(w, http.StatusPreconditionFailed, fmt.Errorf("image id: %s already exists", id))
+		return
+	}
+	if err := checkGeneration(fs, generation); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	file, err := spool(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// The client named the image, so it is stored under that name even
+	// if its content is already stored as another.
+	name := id + ext
+	opts := uploadOptions{
+		Overwrite:    !createOnly,
+		Force:        true,
+		KeepExif:     r.URL.Query().Get("keepExif") == "true",
+		MD5:          sum,
+		IfGeneration: generation,
+		Metadata:     um,
+	}
+	img, status, err := s.storeObject(r.Context(), name, name, contentType, file, opts)
+	if status == http.StatusConflict {
+		// Someone else created it since it was checked.
+		writeErrorMsg(w, http.StatusPreconditionFailed, fmt.Errorf("image id: %s already exists", id))
+		return
+	}
+	if err != nil {
+		writeUploadError(w, status, err)
+		return
+	}
+
+	w.Header().Set("ETag", imageETag(img))
+	if exists {
+		writeJSON(w, img, http.StatusOK)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(img.Name)))
+	writeJSON(w, img, http.StatusCreated)
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newRawPutRequest(target, contentType string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPut, target, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+func TestRawPut(t *testing.T) {
+	ms := newTestMemoryStorage(t, "taken.png")
+	server := NewServer(ms)
+	png := testPNG(t)
+
+	type test struct {
+		name   string
+		req    *http.Request
+		status int
+	}
+
+	createOnly := newRawPutRequest("/api/v1/image/fresh", "image/png", png)
+	createOnly.Header.Set("If-None-Match", "*")
+	taken := newRawPutRequest("/api/v1/image/taken", "image/png", png)
+	taken.Header.Set("If-None-Match", "*")
+
+	tests := []test{
+		{name: "create", req: newRawPutRequest("/api/v1/image/new", "image/png", png), status: http.StatusCreated},
+		{name: "nested", req: newRawPutRequest("/api/v1/image/cams/front", "image/png", png), status: http.StatusCreated},
+		{name: "replace", req: newRawPutRequest("/api/v1/image/taken", "image/png", png), status: http.StatusOK},
+		{name: "create only", req: createOnly, status: http.StatusCreated},
+		{name: "create only, taken", req: taken, status: http.StatusPreconditionFailed},
+		{name: "not allowed", req: newRawPutRequest("/api/v1/image/notes", "text/plain", []byte("hi")), status: http.StatusUnsupportedMediaType},
+		{name: "not what it says", req: newRawPutRequest("/api/v1/image/fake", "image/png", []byte("MZ")), status: http.StatusUnsupportedMediaType},
+		{name: "no type", req: newRawPutRequest("/api/v1/image/none", "", png), status: http.StatusUnsupportedMediaType},
+		{name: "bad id", req: newRawPutRequest("/api/v1/image/a%5Cb", "image/png", png), status: http.StatusBadRequest},
+	}
+
+	for _, c := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, c.req)
+
+		if w.Code != c.status {
+			t.Fatalf("%s expected: %v, got: %v %s", c.name, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	for _, id := range []string{"new", "cams/front", "taken", "fresh"} {
+		if _, err := ms.Read(context.Background(), id); err != nil {
+			t.Fatalf("expected %s to be stored, got: %s", id, err)
+		}
+	}
+}
+
+func TestRawPutTooLarge(t *testing.T) {
+	old := maxUploadBytes
+	maxUploadBytes = 100
+	defer func() { maxUploadBytes = old }()
+
+	server := NewServer(newTestMemoryStorage(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newRawPutRequest("/api/v1/image/big", "image/png", testPNG(t)))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected: %v, got: %v", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestMultipartPutStillReplaces(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	r := newUploadRequest(t, http.MethodPut, "/api/v1/image/a", "b.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("image updated")) {
+		t.Fatalf("expected the multipart update, got: %v %s", w.Code, w.Body.String())
+	}
+}
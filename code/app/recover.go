@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// errInternal is all a client is told about a handler that panicked.
+var errInternal = errors.New("internal server error")
+
+// recoverPanics is middleware that turns a panic in a handler into a 500
+// with the usual error body, rather than a dropped connection. The stack is
+// logged with the request's id and the panic counted.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// net/http uses this panic to abort a response on purpose.
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			handler := routeLabel(s.router, r)
+			logJSON(SeverityError, LogEntry{
+				Message: fmt.Sprintf("Webserver : panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack()),
+				Labels:  requestLabels(requestIDFrom(r.Context())),
+			})
+			s.metrics.panicked(handler)
+
+			// Whatever was already sent can't be taken back.
+			if sr.status == 0 {
+				writeErrorMsg(sr, http.StatusInternalServerError, errInternal)
+			}
+		}()
+
+		next.ServeHTTP(sr, r)
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// nilStorage panics with a nil pointer dereference on every call, as a
+// handler with a bug would.
+type nilStorage struct {
+	Storage
+}
+
+func TestRecoverPanics(t *testing.T) {
+	logs := captureLogs(t, SeverityDebug)
+
+	metrics := NewMetrics()
+	server := NewServer(nilStorage{})
+	server.EnableMetrics(metrics)
+	server.Use(accessLog, requestID)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil)
+	r.Header.Set(requestIDHeader, "req-1")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected: %v, got: %v", http.StatusInternalServerError, w.Code)
+	}
+
+	msg := ErrorMessage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if msg.Error != errInternal.Error() || msg.RequestID != "req-1" {
+		t.Fatalf("expected an internal error for req-1, got: %+v", msg)
+	}
+
+	if !strings.Contains(logs.String(), "nil pointer dereference") || !strings.Contains(logs.String(), "readHandler") {
+		t.Fatalf("expected the panic and its stack to be logged, got: %s", logs.String())
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := `scaler_http_panics_total{handler="/api/v1/image/{id}"} 1`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("expected metrics to contain %q, got:\n%s", want, w.Body.String())
+	}
+	want = `scaler_http_requests_total{code="500",handler="/api/v1/image/{id}",method="GET"} 1`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("expected metrics to contain %q, got:\n%s", want, w.Body.String())
+	}
+}
+
+func TestRecoverPanicsAbort(t *testing.T) {
+	server := NewServer(nil)
+	handler := server.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("expected: %v, got: %v", http.ErrAbortHandler, p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// RenameRequest gives the filename an image should have instead.
+type RenameRequest struct {
+	NewName string `json:"newName"`
+}
+
+// maxNameBodyBytes bounds the body of a rename or copy.
+const maxNameBodyBytes = 4 << 10
+
+// renameHandler gives an image a new name without its contents leaving
+// storage. With ids taken from filenames the image moves to the id of the
+// new name, and its thumbnail with it. With UUIDs the id stays and only the
+// filename kept with it changes.
+func (s *Server) renameHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	req := RenameRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNameBodyBytes)).Decode(&req); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return
+	}
+	name, err := sanitizeFilename(req.NewName)
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+
+	fs, err := s.storage.Read(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", id, err))
+		return
+	}
+	original, ok := originalFile(fs)
+	if !ok {
+		writeNotFound(w, id)
+		return
+	}
+	// The contents are left as they are, so their type can't change.
+	if ext := filepath.Ext(original.Name); !strings.EqualFold(filepath.Ext(name), ext) {
+		writeError(w, invalidArgument(fmt.Errorf("invalid name %q: want the extension %s", name, ext)))
+		return
+	}
+
+	newID := id
+	if idStrategy == idStrategyUUID {
+		err = s.storage.UpdateMetadata(r.Context(), original.Name, map[string]string{originalNameKey: name})
+	} else if newID = imageID(name); newID != id {
+		err = s.renameImage(r.Context(), id, newID, r.URL.Query().Get("overwrite") == "true")
+	}
+	if err == ErrConflict {
+		writeErrorMsg(w, http.StatusConflict, fmt.Errorf("image id: %s already exists", newID))
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to rename %s: %w", id, err))
+		return
+	}
+
+	fs, err = s.storage.Read(r.Context(), newID)
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", newID, err))
+		return
+	}
+	is, _ := NewImages(fs)
+	if len(is) == 0 {
+		writeNotFound(w, newID)
+		return
+	}
+
+	if newID != id {
+		s.contents.of(r.Context()).add(newID, is[0].ETag)
+		s.notify(r.Context(), ImageEvent{Action: actionDeleted, ID: id})
+		s.notify(r.Context(), ImageEvent{Action: actionCreated, ID: newID, Size: is[0].SizeBytes, ContentType: is[0].ContentType, image: &is[0]})
+	} else {
+		s.lists.invalidate()
+	}
+
+	writeJSON(w, is[0], http.StatusOK)
+}
+
+// renameImage moves image id to newID along with the thumbnail made for
+// it. Cached variants are dropped rather than moved, and made again for
+// newID when they are asked for.
+func (s *Server) renameImage(ctx context.Context, id, newID string, overwrite bool) error {
+	if err := s.storage.Rename(ctx, id, newID, overwrite); err != nil {
+		return err
+	}
+	s.contents.of(ctx).forget(id)
+	s.contents.of(ctx).forget(newID)
+
+	s.dropVariants(ctx, newID)
+	s.dropVariants(ctx, id)
+	if err := s.storage.DeleteObject(ctx, thumbnailName(newID)); err != nil && err != ErrNotFound {
+		weblog(fmt.Sprintf("error deleting thumbnail for %s: %s", newID, err))
+	}
+	if err := s.moveObject(ctx, thumbnailName(id), thumbnailName(newID)); err != nil && err != ErrNotFound {
+		weblog(fmt.Sprintf("error moving thumbnail for %s: %s", id, err))
+	}
+
+	return nil
+}
+
+// moveObject copies the object called from to to, and then deletes it.
+func (s *Server) moveObject(ctx context.Context, from, to string) error {
+	if err := s.copyObject(ctx, from, to); err != nil {
+		return err
+	}
+
+	return s.storage.DeleteObject(ctx, from)
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func renameRequest(id, query, body string) *http.Request {
+	return httptest.NewRequest(http.MethodPost, "/api/v1/image/"+id+":rename"+query, strings.NewReader(body))
+}
+
+func TestRename(t *testing.T) {
+	ms := newTestMemoryStorage(t, "tpyo.png", "taken.png")
+	ctx := context.Background()
+	if err := ms.UpdateMetadata(ctx, "processed/tpyo/original.png", map[string]string{"meta.owner": "sam"}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := ms.PutObject(ctx, thumbnailName("tpyo"), strings.NewReader("thumb"), "image/png"); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	server := NewServer(ms)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, renameRequest("tpyo", "", `{"newName": "typo.png"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if img.ID != "typo" || img.Metadata["owner"] != "sam" {
+		t.Fatalf("expected typo with its metadata, got: %+v", img)
+	}
+
+	if _, err := ms.Read(ctx, "tpyo"); err != ErrNotFound {
+		t.Fatalf("expected the old id to be gone, got: %v", err)
+	}
+	obj, err := ms.OpenObject(ctx, thumbnailName("typo"))
+	if err != nil {
+		t.Fatalf("expected the thumbnail to move, got: %s", err)
+	}
+	var thumb bytes.Buffer
+	thumb.ReadFrom(obj)
+	obj.Close()
+	if thumb.String() != "thumb" {
+		t.Fatalf("expected: thumb, got: %s", thumb.String())
+	}
+
+	type test struct {
+		id     string
+		query  string
+		body   string
+		status int
+	}
+
+	tests := []test{
+		{"missing", "", `{"newName": "found.png"}`, http.StatusNotFound},
+		{"typo", "", `{"newName": "taken.png"}`, http.StatusConflict},
+		{"typo", "", `{"newName": "typo.jpg"}`, http.StatusBadRequest},
+		{"typo", "", `{"newName": ""}`, http.StatusBadRequest},
+		{"typo", "", `{"newName": `, http.StatusBadRequest},
+		{"typo", "?overwrite=true", `{"newName": "taken.png"}`, http.StatusOK},
+	}
+	for _, c := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, renameRequest(c.id, c.query, c.body))
+		if w.Code != c.status {
+			t.Fatalf("%s%s %s expected: %v, got: %v %s", c.id, c.query, c.body, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	fs, err := ms.Read(ctx, "taken")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if f, _ := originalFile(fs); f.Metadata["meta.owner"] != "sam" {
+		t.Fatalf("expected taken to be overwritten, got: %v", f.Metadata)
+	}
+}
+
+func TestRenameUUID(t *testing.T) {
+	idStrategy = idStrategyUUID
+	t.Cleanup(func() { idStrategy = idStrategyFilename })
+
+	ms := newTestMemoryStorage(t, "0b6f.png")
+	server := NewServer(ms)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, renameRequest("0b6f", "", `{"newName": "holiday.png"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if img.ID != "0b6f" || img.OriginalName != "holiday.png" {
+		t.Fatalf("expected the id to stay and the name to change, got: %s %s", img.ID, img.OriginalName)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// requestIDHeader carries the id of a request, both ways.
+	requestIDHeader = "X-Request-Id"
+	// cloudTraceHeader is set by Google's load balancers and Cloud Run as
+	// TRACE_ID/SPAN_ID;o=OPTIONS.
+	cloudTraceHeader = "X-Cloud-Trace-Context"
+	// maxRequestIDLength bounds the ids taken from clients.
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the id of the request ctx belongs to, if it has one.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID is middleware that gives every request an id, puts it in the
+// request's context and sends it back in the X-Request-Id header. An id
+// the client or a proxy already gave the request is kept, so the request
+// can be followed from one end to the other.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = strings.SplitN(r.Header.Get(cloudTraceHeader), "/", 2)[0]
+		}
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether id is safe to log and echo back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestLabels are the log labels that tie an entry to request id.
+func requestLabels(id string) map[string]string {
+	if id == "" {
+		return nil
+	}
+
+	return map[string]string{"requestId": id}
+}
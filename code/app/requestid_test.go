@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestID(t *testing.T) {
+	type test struct {
+		headers map[string]string
+		want    string
+	}
+
+	tests := []test{
+		{headers: map[string]string{requestIDHeader: "abc-123"}, want: "abc-123"},
+		{headers: map[string]string{cloudTraceHeader: "105445aa7843bc8bf206b12000100000/1;o=1"}, want: "105445aa7843bc8bf206b12000100000"},
+		{headers: map[string]string{requestIDHeader: "abc-123", cloudTraceHeader: "1054/1;o=1"}, want: "abc-123"},
+		{headers: map[string]string{requestIDHeader: "bad id\n"}},
+		{headers: map[string]string{requestIDHeader: strings.Repeat("a", maxRequestIDLength+1)}},
+		{},
+	}
+
+	for _, c := range tests {
+		var got string
+		handler := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = requestIDFrom(r.Context())
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if c.want == "" {
+			if _, err := uuid.Parse(got); err != nil {
+				t.Fatalf("%v: expected a generated id, got: %q", c.headers, got)
+			}
+		} else if got != c.want {
+			t.Fatalf("%v: expected: %q, got: %q", c.headers, c.want, got)
+		}
+		if h := w.Header().Get(requestIDHeader); h != got {
+			t.Fatalf("%v: expected the id to be echoed, got: %q", c.headers, h)
+		}
+	}
+}
+
+func TestRequestIDInErrors(t *testing.T) {
+	logs := captureLogs(t, SeverityDebug)
+
+	server := NewServer(NewMemoryStorage())
+	server.Use(accessLog, requestID)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image?sort=bogus", nil)
+	r.Header.Set(requestIDHeader, "req-1")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+	}
+
+	msg := ErrorMessage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if msg.RequestID != "req-1" {
+		t.Fatalf("expected: %q, got: %q", "req-1", msg.RequestID)
+	}
+
+	// Both the error and the access log line can be found by the id.
+	found := 0
+	sc := bufio.NewScanner(logs)
+	for sc.Scan() {
+		entry := LogEntry{}
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("could not unmarshal log line %q: %s", sc.Text(), err)
+		}
+		if entry.Labels["requestId"] == "req-1" {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("expected 2 log entries for the request, got: %d\n%s", found, logs.String())
+	}
+}
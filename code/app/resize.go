@@ -0,0 +1,301 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/image/draw"
+	// So that WebP originals can be resized and converted too.
+	_ "golang.org/x/image/webp"
+)
+
+// maxResizeDimension caps the width and height that can be asked for on the
+// content endpoint.
+const maxResizeDimension = 4096
+
+const (
+	// fitInside scales the image down to fit within the requested box,
+	// keeping its aspect ratio.
+	fitInside = "inside"
+	// fitCover scales the image to fill the requested box, cropping
+	// whatever falls outside it.
+	fitCover = "cover"
+)
+
+// The formats images can be converted to on the content endpoint.
+const (
+	formatJPEG = "jpeg"
+	formatPNG  = "png"
+	formatWebP = "webp"
+)
+
+// defaultQuality is the ?quality= of conversions that don't give one.
+const defaultQuality = 85
+
+// resizeOptions are the ?w=, ?h=, ?fit=, ?format= and ?quality= parameters
+// of the content endpoint. A zero width or height leaves that edge
+// unconstrained, and no format keeps that of the original. Negotiated is
+// set when the format comes from the Accept header instead, in which case
+// the original is served if converting it doesn't make it smaller.
+// Watermark, when set, is stamped on the result.
+type resizeOptions struct {
+	Width      int
+	Height     int
+	Fit        string
+	Format     string
+	Quality    int
+	Negotiated bool
+	Watermark  *Watermark
+}
+
+// parseResize reads resize and conversion options from a query. It
+// returns nil if neither was asked for.
+func parseResize(q url.Values) (*resizeOptions, error) {
+	if q.Get("w") == "" && q.Get("h") == "" && q.Get("format") == "" {
+		if q.Get("quality") != "" {
+			return nil, fmt.Errorf("invalid quality: only applies with a format")
+		}
+		return nil, nil
+	}
+
+	opts := resizeOptions{Fit: fitInside}
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"w", &opts.Width}, {"h", &opts.Height}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxResizeDimension {
+			return nil, fmt.Errorf("invalid %s %q: want a number from 1 to %d", p.name, v, maxResizeDimension)
+		}
+		*p.dst = n
+	}
+
+	switch fit := q.Get("fit"); fit {
+	case "", fitInside:
+	case fitCover:
+		opts.Fit = fitCover
+	default:
+		return nil, fmt.Errorf("invalid fit %q: want %s or %s", fit, fitInside, fitCover)
+	}
+
+	switch format := q.Get("format"); format {
+	case "":
+		if q.Get("quality") != "" {
+			return nil, fmt.Errorf("invalid quality: only applies with a format")
+		}
+		return &opts, nil
+	case formatJPEG, formatPNG, formatWebP:
+		opts.Format = format
+	default:
+		return nil, fmt.Errorf("invalid format %q: want %s, %s or %s", format, formatJPEG, formatPNG, formatWebP)
+	}
+
+	opts.Quality = defaultQuality
+	if v := q.Get("quality"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("invalid quality %q: want a number from 1 to 100", v)
+		}
+		opts.Quality = n
+	}
+
+	return &opts, nil
+}
+
+// variantName is where the variant of image id made with opts is cached.
+func variantName(id string, opts resizeOptions) string {
+	name := fmt.Sprintf("%s/w%dh%d", variantDir(id), opts.Width, opts.Height)
+	if opts.Fit != fitInside {
+		name += "-" + opts.Fit
+	}
+	if opts.Format != "" {
+		name += fmt.Sprintf(".%s-q%d", opts.Format, opts.Quality)
+	}
+	if opts.Negotiated {
+		name += "-negotiated"
+	}
+	if opts.Watermark != nil {
+		name += "-wm" + opts.Watermark.key
+	}
+
+	return name
+}
+
+// variantPrefix is where resized and converted variants are cached.
+const variantPrefix = "cache"
+
+// variantDir holds every cached variant of image id.
+func variantDir(id string) string {
+	return fmt.Sprintf("%s/%s", variantPrefix, id)
+}
+
+// resize scales src according to opts.
+func resize(src image.Image, opts resizeOptions) image.Image {
+	w, h := opts.Width, opts.Height
+	if opts.Fit == fitCover && w > 0 && h > 0 {
+		return scaleToCover(src, w, h)
+	}
+
+	if w == 0 {
+		w = math.MaxInt32
+	}
+	if h == 0 {
+		h = math.MaxInt32
+	}
+
+	return scaleToFit(src, w, h)
+}
+
+// scaleToCover returns src scaled and centre-cropped to exactly w by h.
+func scaleToCover(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+
+	cw, ch := b.Dx(), b.Dx()*h/w
+	if ch > b.Dy() {
+		cw, ch = b.Dy()*w/h, b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-cw)/2
+	y0 := b.Min.Y + (b.Dy()-ch)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, image.Rect(x0, y0, x0+cw, y0+ch), draw.Over, nil)
+
+	return dst
+}
+
+// resizedContent serves image id resized, converted and watermarked
+// according to opts, from the cache if it has been made before. Images that
+// can't be are served unmodified, apart from animated GIFs that were asked
+// to be resized or converted, which are refused rather than losing all but
+// their first frame.
+func (s *Server) resizedContent(w http.ResponseWriter, r *http.Request, id string, opts resizeOptions) {
+	name := variantName(id, opts)
+
+	cached, err := s.storage.OpenObject(r.Context(), name)
+	if err == nil {
+		defer cached.Close()
+		writeObject(w, r, cached)
+		return
+	}
+	if err != ErrNotFound {
+		weblog(fmt.Sprintf("error opening cached variant %s: %s", name, err))
+	}
+
+	obj, err := s.storage.Open(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to open image %s: %v", id, err))
+		return
+	}
+	defer obj.Close()
+
+	// Only a conversion is wanted, and the original needs none.
+	convertOnly := opts.Width == 0 && opts.Height == 0 && opts.Watermark == nil
+	if opts.Negotiated && obj.ContentType == "image/"+opts.Format && convertOnly {
+		writeObject(w, r, obj)
+		return
+	}
+
+	original, err := io.ReadAll(obj)
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to read image %s: %v", id, err))
+		return
+	}
+
+	data, contentType, err := s.resizeImage(r.Context(), original, opts)
+	switch {
+	case err == errAnimated && (opts.Width > 0 || opts.Height > 0 || opts.Format != "" && !opts.Negotiated):
+		writeError(w, notImplemented(err))
+		return
+	case err != nil:
+		logJSON(SeverityWarning, LogEntry{Message: fmt.Sprintf("serving %s unmodified: %s", id, err)})
+		data, contentType = original, obj.ContentType
+	case opts.Negotiated && convertOnly && len(data) >= len(original):
+		// Not worth it, which is kept so that it isn't worked out again.
+		data, contentType = original, obj.ContentType
+		fallthrough
+	default:
+		if err := s.storage.PutObject(r.Context(), name, bytes.NewReader(data), contentType); err != nil {
+			weblog(fmt.Sprintf("error caching variant %s: %s", name, err))
+		}
+	}
+
+	writeObject(w, r, &CSReader{
+		ReadCloser:  io.NopCloser(bytes.NewReader(data)),
+		Filename:    obj.Filename,
+		ContentType: contentType,
+		Metadata:    obj.Metadata,
+		Size:        int64(len(data)),
+	})
+}
+
+// resizeImage decodes data, resizes it according to opts and encodes it
+// again, in opts.Format if it has one. Animated GIFs fail with errAnimated.
+func (s *Server) resizeImage(ctx context.Context, data []byte, opts resizeOptions) ([]byte, string, error) {
+	if animated(data) {
+		return nil, "", errAnimated
+	}
+	src, format, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decode image: %s", err)
+	}
+	if opts.Width > 0 || opts.Height > 0 {
+		src = resize(src, opts)
+	}
+	if opts.Watermark != nil {
+		src, _ = opts.Watermark.apply(src)
+	}
+
+	switch opts.Format {
+	case "":
+		return encodeImage(src, format)
+	case formatJPEG:
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, src, &jpeg.Options{Quality: opts.Quality}); err != nil {
+			return nil, "", fmt.Errorf("could not encode image: %s", err)
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	case formatWebP:
+		data, err := s.encodeWebP(ctx, src, opts.Quality)
+		return data, "image/webp", err
+	default:
+		return encodeImage(src, opts.Format)
+	}
+}
+
+// dropVariants removes the cached variants of image id once they no longer
+// match it.
+func (s *Server) dropVariants(ctx context.Context, id string) {
+	if err := s.storage.DeleteObjects(ctx, variantDir(id)); err != nil {
+		weblog(fmt.Sprintf("error deleting cached variants for %s: %s", id, err))
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// newResizeServer returns a server holding a 400x200 PNG called wide.
+func newResizeServer(t *testing.T) (*Server, *MemoryStorage) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatalf("could not encode test image: %s", err)
+	}
+
+	ms := NewMemoryStorage()
+	if _, err := ms.Create(context.Background(), "wide.png", newMemoryFile(buf.Bytes()), CreateOptions{}); err != nil {
+		t.Fatalf("could not create test image: %s", err)
+	}
+
+	return NewServer(ms), ms
+}
+
+func TestParseResize(t *testing.T) {
+	type test struct {
+		query   string
+		want    *resizeOptions
+		wantErr bool
+	}
+
+	tests := []test{
+		{query: "", want: nil},
+		{query: "download=true", want: nil},
+		{query: "w=800", want: &resizeOptions{Width: 800, Fit: fitInside}},
+		{query: "w=800&h=600&fit=inside", want: &resizeOptions{Width: 800, Height: 600, Fit: fitInside}},
+		{query: "h=600&fit=cover", want: &resizeOptions{Height: 600, Fit: fitCover}},
+		{query: "w=0", wantErr: true},
+		{query: "w=abc", wantErr: true},
+		{query: "w=4097", wantErr: true},
+		{query: "w=100&fit=stretch", wantErr: true},
+		{query: "format=png", want: &resizeOptions{Fit: fitInside, Format: formatPNG, Quality: defaultQuality}},
+		{query: "format=webp", want: &resizeOptions{Fit: fitInside, Format: formatWebP, Quality: defaultQuality}},
+		{query: "w=10&format=jpeg&quality=40", want: &resizeOptions{Width: 10, Fit: fitInside, Format: formatJPEG, Quality: 40}},
+		{query: "format=gif", wantErr: true},
+		{query: "format=jpeg&quality=0", wantErr: true},
+		{query: "quality=50", wantErr: true},
+	}
+
+	for _, c := range tests {
+		q, _ := url.ParseQuery(c.query)
+		got, err := parseResize(q)
+		if (err != nil) != c.wantErr {
+			t.Fatalf("%s: expected error: %v, got: %v", c.query, c.wantErr, err)
+		}
+		if !reflect.DeepEqual(c.want, got) {
+			t.Fatalf("%s: expected: %v, got: %v", c.query, c.want, got)
+		}
+	}
+}
+
+func TestResizedContentDimensions(t *testing.T) {
+	server, _ := newResizeServer(t)
+
+	type test struct {
+		query string
+		wantW int
+		wantH int
+	}
+
+	tests := []test{
+		{query: "w=100", wantW: 100, wantH: 50},
+		{query: "h=100", wantW: 200, wantH: 100},
+		{query: "w=100&h=100&fit=inside", wantW: 100, wantH: 50},
+		{query: "w=100&h=100&fit=cover", wantW: 100, wantH: 100},
+		{query: "w=800&h=600", wantW: 400, wantH: 200},
+	}
+
+	for _, c := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content?"+c.query, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected: %v, got: %v", c.query, http.StatusOK, w.Code)
+		}
+		cfg, _, err := image.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatalf("%s: could not decode response: %s", c.query, err)
+		}
+		if cfg.Width != c.wantW || cfg.Height != c.wantH {
+			t.Fatalf("%s: expected: %dx%d, got: %dx%d", c.query, c.wantW, c.wantH, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestResizedContentCached(t *testing.T) {
+	server, ms := newResizeServer(t)
+	opts := resizeOptions{Width: 100, Height: 100, Fit: fitInside}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content?w=100&h=100", nil)
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	if _, err := ms.OpenObject(context.Background(), variantName("wide", opts)); err != nil {
+		t.Fatalf("expected variant to be cached, got: %s", err)
+	}
+
+	// Swap the cached bytes out so we can tell where the next response
+	// comes from.
+	if err := ms.PutObject(context.Background(), variantName("wide", opts), bytes.NewReader([]byte("cached")), "image/png"); err != nil {
+		t.Fatalf("could not replace cached variant: %s", err)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content?w=100&h=100", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Body.String() != "cached" {
+		t.Fatalf("expected: %v, got: %v", "cached", w.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/v1/image/wide", nil)
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	if _, err := ms.OpenObject(context.Background(), variantName("wide", opts)); err != ErrNotFound {
+		t.Fatalf("expected variant to be deleted, got: %v", err)
+	}
+}
+
+func TestConvertedContent(t *testing.T) {
+	server, ms := newResizeServer(t)
+
+	for _, c := range []struct {
+		query, want string
+	}{
+		{"format=jpeg&quality=50", "image/jpeg"},
+		{"format=png&w=10", "image/png"},
+		{"", "image/png"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content?"+c.query, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != c.want {
+			t.Fatalf("%s: expected: %s, got: %v %s", c.query, c.want, w.Code, w.Header().Get("Content-Type"))
+		}
+		if _, format, err := image.Decode(w.Body); err != nil || "image/"+format != c.want {
+			t.Errorf("%s: expected a %s, got: %s %v", c.query, c.want, format, err)
+		}
+	}
+
+	opts := resizeOptions{Fit: fitInside, Format: formatJPEG, Quality: 50}
+	if _, err := ms.OpenObject(context.Background(), variantName("wide", opts)); err != nil {
+		t.Errorf("expected %s to be cached, got: %s", variantName("wide", opts), err)
+	}
+}
+
+func TestResizedContentUnsupported(t *testing.T) {
+	ms := NewMemoryStorage()
+	server := NewServer(ms)
+	gif := []byte("GIF89a")
+	if _, err := ms.Create(context.Background(), "anim.gif", newMemoryFile(gif), CreateOptions{}); err != nil {
+		t.Fatalf("could not create test image: %s", err)
+	}
+
+	type test struct {
+		path string
+		want int
+		body []byte
+	}
+
+	tests := []test{
+		{path: "/api/v1/image/anim/content?w=100", want: http.StatusOK, body: gif},
+		{path: "/api/v1/image/missing/content?w=100", want: http.StatusNotFound},
+		{path: "/api/v1/image/anim/content?w=100000", want: http.StatusBadRequest},
+	}
+
+	for _, c := range tests {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("%s: expected: %v, got: %v", c.path, c.want, w.Code)
+		}
+		if c.body != nil && !bytes.Equal(w.Body.Bytes(), c.body) {
+			t.Fatalf("%s: expected: %q, got: %q", c.path, c.body, w.Body.Bytes())
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// retryAttempts is how many times an operation is tried in all.
+	retryAttempts = 3
+	// retryBaseDelay is the wait before the first retry, doubling for
+	// every one after.
+	retryBaseDelay = 100 * time.Millisecond
+)
+
+// uncommittedError marks a failed write that left nothing behind, which
+// makes it safe to try again.
+type uncommittedError struct {
+	err error
+}
+
+func (e uncommittedError) Error() string { return e.err.Error() }
+func (e uncommittedError) Unwrap() error { return e.err }
+
+// transient reports whether err is the kind of failure that trying again
+// might get past: throttling, a server error or a dropped connection.
+func transient(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code >= http.StatusInternalServerError
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RetryStorage wraps s so that idempotent operations are retried with
+// jittered exponential backoff when they fail transiently. Retries are
+// counted in m, which can be nil.
+func RetryStorage(s Storage, m *Metrics) Storage {
+	return retryingStorage{s, m}
+}
+
+// retryingStorage is a Storage that retries transient failures.
+type retryingStorage struct {
+	Storage
+	metrics *Metrics
+}
+
+// retry runs op up to retryAttempts times for as long as it fails in a way
+// that retryable accepts and ctx has time left for the wait.
+func (s retryingStorage) retry(ctx context.Context, name string, retryable func(error) bool, op func(attempt int) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = op(attempt)
+		if err == nil || attempt >= retryAttempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := backoff(retryBaseDelay, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+
+		s.metrics.retried(name)
+		logJSON(SeverityWarning, LogEntry{
+			Message: fmt.Sprintf("retrying storage %s after: %s", name, err),
+			Labels:  map[string]string{"operation": name, "attempt": strconv.Itoa(attempt + 1)},
+		})
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// backoff is how long to wait after attempt fails: base doubled for every
+// attempt before it, less a random amount of up to half so that instances
+// don't retry in lockstep.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << (attempt - 1)
+	if d <= 0 {
+		return 0
+	}
+
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+func (s retryingStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	var fs CSFiles
+	var next string
+	err := s.retry(ctx, "List", transient, func(int) error {
+		var err error
+		fs, next, err = s.Storage.List(ctx, prefix, pageSize, pageToken)
+		return err
+	})
+	return fs, next, err
+}
+
+// Walk is only retried until fn has been given something, since starting
+// again would give it the same objects twice.
+func (s retryingStorage) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	walked := false
+	return s.retry(ctx, "Walk", func(err error) bool { return !walked && transient(err) }, func(int) error {
+		return s.Storage.Walk(ctx, prefix, func(f CSFile) error {
+			walked = true
+			return fn(f)
+		})
+	})
+}
+
+func (s retryingStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	var fs CSFiles
+	err := s.retry(ctx, "Read", transient, func(int) error {
+		var err error
+		fs, err = s.Storage.Read(ctx, id)
+		return err
+	})
+	return fs, err
+}
+
+func (s retryingStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	var cr *CSReader
+	err := s.retry(ctx, "Open", transient, func(int) error {
+		var err error
+		cr, err = s.Storage.Open(ctx, id)
+		return err
+	})
+	return cr, err
+}
+
+// Delete retries a failed delete of image id. If a retry finds nothing left
+// to delete, the attempt before must have got it all.
+func (s retryingStorage) Delete(ctx context.Context, id string, generation int64) error {
+	return s.retry(ctx, "Delete", transient, func(attempt int) error {
+		err := s.Storage.Delete(ctx, id, generation)
+		if err == ErrNotFound && attempt > 1 {
+			return nil
+		}
+		return err
+	})
+}
+
+// Create is only retried when the failed attempt is known not to have
+// stored anything, and the file can be read again from the start.
+func (s retryingStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	retryable := func(err error) bool {
+		var uerr uncommittedError
+		return errors.As(err, &uerr) && transient(uerr.err)
+	}
+
+	var f CSFile
+	err := s.retry(ctx, "Create", retryable, func(attempt int) error {
+		if attempt > 1 {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("could not rewind file: %s", err)
+			}
+		}
+
+		var err error
+		f, err = s.Storage.Create(ctx, name, file, opts)
+		return err
+	})
+	return f, err
+}
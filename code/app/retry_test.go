@@ -0,0 +1,172 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
+)
+
+// flakyStorage fails the first failures calls to List and Create with err,
+// and counts the calls made. Failed creates read the file first, as a
+// partial upload would.
+type flakyStorage struct {
+	*MemoryStorage
+	err      error
+	failures int
+	calls    int
+}
+
+func (s *flakyStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, "", fmt.Errorf("error iterating over bucket query: %w", s.err)
+	}
+	return s.MemoryStorage.List(ctx, prefix, pageSize, pageToken)
+}
+
+func (s *flakyStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		io.Copy(io.Discard, file)
+		return CSFile{}, s.err
+	}
+	return s.MemoryStorage.Create(ctx, name, file, opts)
+}
+
+func setRetries(t *testing.T, attempts int, delay time.Duration) {
+	t.Helper()
+	oldAttempts, oldDelay := retryAttempts, retryBaseDelay
+	retryAttempts, retryBaseDelay = attempts, delay
+	t.Cleanup(func() { retryAttempts, retryBaseDelay = oldAttempts, oldDelay })
+}
+
+func TestRetryStorage(t *testing.T) {
+	setRetries(t, 3, time.Millisecond)
+
+	tests := map[string]struct {
+		err      error
+		failures int
+		calls    int
+		ok       bool
+	}{
+		"server error":  {&googleapi.Error{Code: http.StatusServiceUnavailable}, 2, 3, true},
+		"rate limited":  {&googleapi.Error{Code: http.StatusTooManyRequests}, 1, 2, true},
+		"too many":      {&googleapi.Error{Code: http.StatusInternalServerError}, 3, 3, false},
+		"client error":  {&googleapi.Error{Code: http.StatusForbidden}, 1, 1, false},
+		"other failure": {fmt.Errorf("bucket does not exist"), 1, 1, false},
+		"no failures":   {nil, 0, 1, true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			flaky := &flakyStorage{MemoryStorage: newTestMemoryStorage(t, "a.png"), err: tc.err, failures: tc.failures}
+			m := NewMetrics()
+			store := RetryStorage(flaky, m)
+
+			fs, _, err := store.List(context.Background(), "", 0, "")
+			if (err == nil) != tc.ok {
+				t.Fatalf("expected success: %v, got: %v", tc.ok, err)
+			}
+			if flaky.calls != tc.calls {
+				t.Fatalf("expected: %v calls, got: %v", tc.calls, flaky.calls)
+			}
+			if tc.ok && len(fs) == 0 {
+				t.Fatalf("expected the listing, got no files")
+			}
+
+			retries := testutil.ToFloat64(m.retries.WithLabelValues("List"))
+			if int(retries) != tc.calls-1 {
+				t.Fatalf("expected: %v retries, got: %v", tc.calls-1, retries)
+			}
+		})
+	}
+}
+
+func TestRetryStorageLogs(t *testing.T) {
+	setRetries(t, 2, time.Millisecond)
+	buf := captureLogs(t, SeverityWarning)
+
+	flaky := &flakyStorage{MemoryStorage: NewMemoryStorage(), err: &googleapi.Error{Code: http.StatusBadGateway}, failures: 1}
+	if _, _, err := RetryStorage(flaky, nil).List(context.Background(), "", 0, ""); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	for _, want := range []string{`"severity":"WARNING"`, `"operation":"List"`, `"attempt":"2"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %s in the logs, got: %s", want, buf.String())
+		}
+	}
+}
+
+func TestRetryStorageDeadline(t *testing.T) {
+	setRetries(t, 3, time.Hour)
+
+	flaky := &flakyStorage{MemoryStorage: NewMemoryStorage(), err: &googleapi.Error{Code: http.StatusServiceUnavailable}, failures: 3}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if _, _, err := RetryStorage(flaky, nil).List(ctx, "", 0, ""); err == nil {
+		t.Fatalf("expected an error, got none")
+	}
+	if flaky.calls != 1 {
+		t.Fatalf("expected: 1 call, got: %v", flaky.calls)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected to give up without waiting past the deadline")
+	}
+}
+
+func TestRetryStorageCreate(t *testing.T) {
+	setRetries(t, 3, time.Millisecond)
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	tests := map[string]struct {
+		err   error
+		calls int
+		ok    bool
+	}{
+		"uncommitted":  {uncommittedError{fmt.Errorf("could not write file: %w", unavailable)}, 2, true},
+		"maybe stored": {fmt.Errorf("could not write file: %w", unavailable), 1, false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			flaky := &flakyStorage{MemoryStorage: NewMemoryStorage(), err: tc.err, failures: 1}
+			store := RetryStorage(flaky, nil)
+
+			f, err := store.Create(context.Background(), "a.png", newMemoryFile(testPNG(t)), CreateOptions{})
+			if (err == nil) != tc.ok {
+				t.Fatalf("expected success: %v, got: %v", tc.ok, err)
+			}
+			if flaky.calls != tc.calls {
+				t.Fatalf("expected: %v calls, got: %v", tc.calls, flaky.calls)
+			}
+			if tc.ok && f.Size != int64(len(testPNG(t))) {
+				t.Fatalf("expected the whole file to be stored, got: %v bytes", f.Size)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	"google.golang.org/api/googleapi"
+)
+
+// selfTestPrefix is where self-test probe objects are written.
+const selfTestPrefix = "selftest/"
+
+// Defaults for how long a self-test can take and how often it is run again
+// after the first, unless SELF_TEST_INTERVAL says otherwise.
+const (
+	selfTestTimeout         = 10 * time.Second
+	defaultSelfTestInterval = 5 * time.Minute
+)
+
+// errSelfTestPending is what /readyz reports until the first self-test
+// passes.
+var errSelfTestPending = errors.New("storage self-test has not passed yet")
+
+// selfTestState is the outcome of the last self-test.
+type selfTestState struct {
+	mu  sync.RWMutex
+	err error
+}
+
+func (st *selfTestState) set(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.err = err
+}
+
+func (st *selfTestState) get() error {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.err
+}
+
+// EnableSelfTest keeps /readyz failing until SelfTest has passed, and for
+// as long as the last one run failed.
+func (s *Server) EnableSelfTest() {
+	s.selfTest = &selfTestState{err: errSelfTestPending}
+}
+
+// SelfTest writes a probe object, reads it back and deletes it, which
+// checks that storage is there and that it can be written to, unlike the
+// ping /readyz does. With tenants, each of their storage is tested. The
+// outcome is kept for /readyz if EnableSelfTest has been called.
+func (s *Server) SelfTest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	var err error
+	for _, ctx := range s.tenantContexts(ctx) {
+		if err = selfTest(ctx, s.storage); err != nil {
+			if tenant := tenantFrom(ctx); tenant != "" {
+				err = fmt.Errorf("tenant %s: %w", tenant, err)
+			}
+			break
+		}
+	}
+	if s.selfTest != nil {
+		s.selfTest.set(err)
+	}
+	return err
+}
+
+func selfTest(ctx context.Context, store Storage) error {
+	name := selfTestPrefix + uuid.NewString()
+	probe := []byte("self-test " + name)
+
+	if err := store.PutObject(ctx, name, bytes.NewReader(probe), "text/plain"); err != nil {
+		return selfTestError("write", err)
+	}
+
+	obj, err := store.OpenObject(ctx, name)
+	if err != nil {
+		return selfTestError("read", err)
+	}
+	got, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return selfTestError("read", err)
+	}
+	if !bytes.Equal(got, probe) {
+		return fmt.Errorf("self-test read back %d bytes that don't match the %d written", len(got), len(probe))
+	}
+
+	if err := store.DeleteObject(ctx, name); err != nil {
+		return selfTestError("delete", err)
+	}
+
+	return nil
+}
+
+// selfTestError says which step of the self-test failed, and what the
+// failure most likely means.
+func selfTestError(step string, err error) error {
+	var (
+		gerr *googleapi.Error
+		nerr net.Error
+	)
+	switch {
+	case errors.Is(err, storage.ErrBucketNotExist), errors.Is(err, os.ErrNotExist),
+		errors.As(err, &gerr) && gerr.Code == http.StatusNotFound:
+		return fmt.Errorf("self-test could not %s a probe object, the bucket doesn't exist: check BUCKET: %w", step, err)
+	case errors.Is(err, os.ErrPermission),
+		errors.As(err, &gerr) && (gerr.Code == http.StatusForbidden || gerr.Code == http.StatusUnauthorized):
+		return fmt.Errorf("self-test could not %s a probe object, permission denied: grant the service account roles/storage.objectAdmin on the bucket: %w", step, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr):
+		return fmt.Errorf("self-test could not %s a probe object, storage could not be reached: check the network: %w", step, err)
+	}
+
+	return fmt.Errorf("self-test could not %s a probe object: %w", step, err)
+}
+
+// recheckStorage runs the self-test every interval until ctx is done, so
+// that /readyz notices permissions being revoked.
+func (s *Server) recheckStorage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		before := s.selfTest.get()
+		err := s.SelfTest(ctx)
+		if err != nil && ctx.Err() == nil {
+			weblog(err.Error())
+		} else if err == nil && before != nil {
+			logJSON(SeverityInfo, LogEntry{Message: "storage self-test passed again"})
+		}
+	}
+}
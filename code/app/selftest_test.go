@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// unwritableStorage fails every write with err.
+type unwritableStorage struct {
+	*MemoryStorage
+	err error
+}
+
+func (s *unwritableStorage) PutObject(ctx context.Context, name string, r io.Reader, contentType string) error {
+	if s.err != nil {
+		return fmt.Errorf("could not write %s to CloudStorage: %w", name, s.err)
+	}
+	return s.MemoryStorage.PutObject(ctx, name, r, contentType)
+}
+
+func TestSelfTest(t *testing.T) {
+	ms := NewMemoryStorage()
+	if err := selfTest(context.Background(), ms); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if names, err := ms.ListObjects(context.Background(), selfTestPrefix); err != nil || len(names) != 0 {
+		t.Fatalf("expected the probe to be deleted, got: %v %v", names, err)
+	}
+
+	tests := map[string]struct {
+		err  error
+		want string
+	}{
+		"no bucket":  {storage.ErrBucketNotExist, "the bucket doesn't exist"},
+		"not found":  {&googleapi.Error{Code: http.StatusNotFound}, "the bucket doesn't exist"},
+		"forbidden":  {&googleapi.Error{Code: http.StatusForbidden}, "permission denied"},
+		"no network": {&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, "storage could not be reached"},
+		"other":      {fmt.Errorf("bad things"), "could not write a probe object: "},
+	}
+	for name, c := range tests {
+		err := selfTest(context.Background(), &unwritableStorage{MemoryStorage: NewMemoryStorage(), err: c.err})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s expected an error containing %q, got: %v", name, c.want, err)
+		}
+	}
+}
+
+func TestSelfTestReady(t *testing.T) {
+	store := &unwritableStorage{MemoryStorage: NewMemoryStorage()}
+	server := NewServer(store)
+	server.EnableSelfTest()
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Fatalf("expected not to be ready before the self-test, got: %v", got)
+	}
+	if err := server.SelfTest(context.Background()); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if got := ready(); got != http.StatusOK {
+		t.Fatalf("expected to be ready after the self-test, got: %v", got)
+	}
+
+	store.err = &googleapi.Error{Code: http.StatusForbidden}
+	if err := server.SelfTest(context.Background()); err == nil {
+		t.Fatalf("expected the self-test to fail")
+	}
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Fatalf("expected not to be ready once permission is revoked, got: %v", got)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql/executor"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Server routes API requests to handlers backed by a Storage.
+type Server struct {
+	storage Storage
+	router  *mux.Router
+	handler http.Handler
+
+	// probes holds the health endpoints, which are matched ahead of the
+	// router and bypass any middleware added with Use.
+	probes *mux.Router
+
+	// contents finds images already stored with the same content as an
+	// upload.
+	contents contentIndexes
+	// stats caches what /api/v1/stats last answered, and lists the pages
+	// /api/v1/image has.
+	stats statsCache
+	lists listCache
+	// content holds the contents of hot images, if it is set.
+	content *ContentCache
+
+	metrics    *Metrics
+	publishers []namedPublisher
+	publishing sync.WaitGroup
+	// events hands changes on to the clients following them, sockets
+	// being those following over a WebSocket.
+	events  eventBus
+	sockets sync.WaitGroup
+	// socketOrigins checks the origin of pages connecting to the WebSocket,
+	// when CORS is enabled.
+	socketOrigins func(origin string) bool
+	// gcsEvents says how Cloud Storage notifications are taken in, if
+	// they are.
+	gcsEvents *gcsEvents
+
+	moderator          Moderator
+	moderationFailOpen bool
+
+	labeler    Labeler
+	labelSlots chan struct{}
+	labelling  sync.WaitGroup
+
+	// placeholderSlots bounds how many images have their placeholders
+	// worked out at once, and placeholders holds the ids of those that
+	// have been handed over.
+	placeholderSlots chan struct{}
+	placeholding     sync.WaitGroup
+	placeholders     sync.Map
+
+	// watermark is stamped onto images, if set by SetWatermark.
+	watermark *Watermark
+	// heif converts HEIC and HEIF uploads to JPEG, if they are taken.
+	heif HEIFConverter
+	// webp encodes images as WebP, if it is offered.
+	webp WebPEncoder
+
+	// instance is who answers /api/v1/whoami, and requests counts what
+	// it has served.
+	instance    Instance
+	requests    atomic.Uint64
+	loadEnabled bool
+	chaos       *chaos
+	// mode is what the server is open for, normal if it is unset.
+	mode atomic.Pointer[Mode]
+
+	// config is served at /api/v1/admin/config to callers whose key
+	// validKey accepts, validKey being set by RequireAPIKey.
+	config   *Config
+	validKey func(string) bool
+	// keyForReads says whether reads need a key too, and firebase checks
+	// the ID tokens of callers, if they need one. The REST API goes by
+	// the middleware RequireAPIKey and RequireFirebaseAuth add, gRPC calls
+	// by these.
+	keyForReads bool
+	firebase    *FirebaseVerifier
+	// tracing is what gRPC calls are traced with, if they are.
+	tracing trace.TracerProvider
+
+	// selfTest is set if /readyz should wait on a storage self-test.
+	selfTest *selfTestState
+
+	// tenants are those requests can name, if each has storage of its own.
+	tenants []string
+
+	// graphql executes the schema /api/v1/graphql serves, and graphiql whether
+	// GraphiQL is served alongside it.
+	graphql  *executor.Executor
+	graphiql bool
+}
+
+// NewServer returns a Server with all of its routes registered.
+func NewServer(storage Storage) *Server {
+	s := &Server{
+		storage:  storage,
+		router:   mux.NewRouter().StrictSlash(true),
+		probes:   mux.NewRouter(),
+		instance: newInstance(),
+	}
+	s.handler = problems(s.apiV2(s.guardMode(s.recoverPanics(withDeadline(s.router)))))
+	s.graphql = s.graphQLSchema()
+	s.routes()
+
+	return s
+}
+
+// Use wraps every route apart from the health endpoints in mw. Middleware
+// added later runs first.
+func (s *Server) Use(mw ...func(http.Handler) http.Handler) {
+	for _, m := range mw {
+		s.handler = m(s.handler)
+	}
+}
+
+func (s *Server) routes() {
+	s.probes.HandleFunc("/healthz", s.healthHandler).Methods(http.MethodGet)
+	s.probes.HandleFunc("/readyz", s.readyHandler).Methods(http.MethodGet)
+
+	s.router.HandleFunc("/api/v1/image", s.listHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image", s.createHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/image:batchDelete", s.batchDeleteHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/image:fetch", s.fetchHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/image/upload-url", s.uploadURLHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/uploads/{filename}", s.directUploadHandler).Methods(http.MethodPut)
+	s.router.Handle("/api/v1/upload/", tus(s.tusCreateHandler)).Methods(http.MethodPost)
+	s.router.Handle("/api/v1/upload/", tus(s.tusOptionsHandler)).Methods(http.MethodOptions)
+	s.router.Handle("/api/v1/upload/{id}", tus(s.tusHeadHandler)).Methods(http.MethodHead)
+	s.router.Handle("/api/v1/upload/{id}", tus(s.tusPatchHandler)).Methods(http.MethodPatch)
+	s.router.Handle("/api/v1/upload/{id}", tus(s.tusDeleteHandler)).Methods(http.MethodDelete)
+	s.router.Handle("/api/v1/upload/{id}", tus(s.tusOptionsHandler)).Methods(http.MethodOptions)
+	// Ids can hold slashes, so the routes under an image go first or the
+	// id would swallow them.
+	s.router.HandleFunc("/api/v1/image/{id:.+}/versions/{generation:[0-9]+}/content", s.versionContentHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image/{id:.+}/versions/{generation:[0-9]+}:restore", s.restoreVersionHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/image/{id:.+}/versions", s.versionsHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image/{id:.+}/content", s.contentHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image/{id:.+}/thumbnail", s.thumbnailHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image/{id:.+}/signed-url", s.signedURLHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image/{id:.+}/exif", s.exifHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image/{id:.+}/similar", s.similarHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image/{id:.+}:rename", s.renameHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/image/{id:.+}:copy", s.copyHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/image/{id:.+}:transform", s.transformHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/image/{id:.+}:verify", s.verifyHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/image/{id:.+}", s.readHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/image/{id:.+}", s.deleteHandler).Methods(http.MethodDelete)
+	s.router.HandleFunc("/api/v1/image/{id:.+}", s.updateHandler).Methods(http.MethodPost, http.MethodPut)
+	s.router.HandleFunc("/api/v1/image/{id:.+}", s.patchHandler).Methods(http.MethodPatch)
+	s.router.HandleFunc("/api/v1/stats", s.statsHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/events", s.eventsHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(socketPath, s.socketHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/whoami", s.whoamiHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/load", s.loadHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/export.zip", s.exportHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/import", s.importHandler).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/trash", s.trashListHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/trash/{id:.+}:restore", s.restoreHandler).Methods(http.MethodPost)
+	s.router.HandleFunc(chaosPath, s.chaosHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+	s.router.HandleFunc("/api/v1/admin/config", s.configHandler).Methods(http.MethodGet)
+	s.router.HandleFunc(modePath, s.modeHandler).Methods(http.MethodGet, http.MethodPost)
+	s.router.HandleFunc(cleanupPath, s.cleanupHandler).Methods(http.MethodPost)
+	s.router.HandleFunc(gcsEventsPath, s.gcsEventsHandler).Methods(http.MethodPost)
+	s.router.HandleFunc(graphqlPath, s.graphqlHandler).Methods(http.MethodGet, http.MethodPost)
+	s.router.HandleFunc("/api/v1/openapi.json", s.openAPIHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/docs", s.docsHandler).Methods(http.MethodGet)
+	s.allowOptions()
+
+	s.router.PathPrefix("/").Handler(staticHandler(staticFiles()))
+}
+
+// ServeHTTP dispatches the request to the matching handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+
+	var match mux.RouteMatch
+	if s.probes.Match(r, &match) {
+		s.probes.ServeHTTP(w, r)
+		return
+	}
+
+	s.handler.ServeHTTP(w, r)
+}
+
+// readyTimeout bounds how long /readyz waits on storage.
+const readyTimeout = 2 * time.Second
+
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, Message{Text: "ok", Details: ""}, http.StatusOK)
+}
+
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	if err := s.storage.Ping(ctx); err != nil {
+		writeErrorMsg(w, http.StatusServiceUnavailable, fmt.Errorf("storage is not reachable: %s", err))
+		return
+	}
+	if s.selfTest != nil {
+		if err := s.selfTest.get(); err != nil {
+			writeErrorMsg(w, http.StatusServiceUnavailable, err)
+			return
+		}
+	}
+
+	writeJSON(w, Message{Text: "ready", Details: ""}, http.StatusOK)
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestProbes(t *testing.T) {
+	missing, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("could not create file storage: %s", err)
+	}
+	missing.Root = filepath.Join(missing.Root, "gone")
+
+	type test struct {
+		storage Storage
+		target  string
+		want    int
+	}
+
+	tests := []test{
+		{storage: NewMemoryStorage(), target: "/healthz", want: http.StatusOK},
+		{storage: NewMemoryStorage(), target: "/readyz", want: http.StatusOK},
+		{storage: missing, target: "/healthz", want: http.StatusOK},
+		{storage: missing, target: "/readyz", want: http.StatusServiceUnavailable},
+	}
+
+	for _, c := range tests {
+		server := NewServer(c.storage)
+
+		middlewareRan := false
+		server.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				middlewareRan = true
+				next.ServeHTTP(w, r)
+			})
+		})
+
+		r := httptest.NewRequest(http.MethodGet, c.target, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("%s expected: %v, got: %v", c.target, c.want, w.Code)
+		}
+		if middlewareRan {
+			t.Fatalf("%s expected to bypass middleware", c.target)
+		}
+	}
+}
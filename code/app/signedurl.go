@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultSignedURLTTL is how long a signed URL lasts when ?ttl= isn't given.
+const defaultSignedURLTTL = 15 * time.Minute
+
+// maxSignedURLTTL caps the ttl that can be asked for.
+var maxSignedURLTTL = time.Hour
+
+// SignedURL is a time limited URL for an object in a private bucket.
+type SignedURL struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// JSON marshalls the content of SignedURL to json.
+func (s SignedURL) JSON() (string, error) {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of SignedURL to json.
+func (s SignedURL) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// localSignedURL stands in for a signed URL for backends that serve images
+// through the content endpoint.
+func localSignedURL(id string, expires time.Time) string {
+	return fmt.Sprintf("/api/v1/image/%s/content?expires=%s", url.PathEscape(id), strconv.FormatInt(expires.Unix(), 10))
+}
+
+// parseTTL reads a ttl like 15m, capping it at maxSignedURLTTL.
+func parseTTL(v string) (time.Duration, error) {
+	if v == "" {
+		v = defaultSignedURLTTL.String()
+	}
+
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q: want a duration like 15m", v)
+	}
+	if ttl > maxSignedURLTTL {
+		ttl = maxSignedURLTTL
+	}
+
+	return ttl, nil
+}
+
+func (s *Server) signedURLHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	ttl, err := parseTTL(r.URL.Query().Get("ttl"))
+	if err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, err)
+		return
+	}
+
+	expires := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	u, err := s.storage.SignedURL(r.Context(), id, expires)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to sign url for %s: %v", id, err))
+		return
+	}
+
+	writeJSON(w, SignedURL{u, expires}, http.StatusOK)
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTTL(t *testing.T) {
+	type test struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}
+
+	tests := []test{
+		{input: "", want: defaultSignedURLTTL},
+		{input: "5m", want: 5 * time.Minute},
+		{input: "1h", want: time.Hour},
+		{input: "48h", want: maxSignedURLTTL},
+		{input: "0s", wantErr: true},
+		{input: "-5m", wantErr: true},
+		{input: "soon", wantErr: true},
+	}
+
+	for _, c := range tests {
+		got, err := parseTTL(c.input)
+		if (err != nil) != c.wantErr {
+			t.Fatalf("%q: expected error: %v, got: %v", c.input, c.wantErr, err)
+		}
+		if got != c.want {
+			t.Fatalf("%q: expected: %v, got: %v", c.input, c.want, got)
+		}
+	}
+}
+
+func TestSignedURLHandler(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	type test struct {
+		target string
+		want   int
+	}
+
+	tests := []test{
+		{target: "/api/v1/image/a/signed-url?ttl=15m", want: http.StatusOK},
+		{target: "/api/v1/image/a/signed-url", want: http.StatusOK},
+		{target: "/api/v1/image/missing/signed-url", want: http.StatusNotFound},
+		{target: "/api/v1/image/a/signed-url?ttl=never", want: http.StatusBadRequest},
+	}
+
+	for _, c := range tests {
+		r := httptest.NewRequest(http.MethodGet, c.target, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("%s: expected: %v, got: %v", c.target, c.want, w.Code)
+		}
+	}
+
+	before := time.Now()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image/a/signed-url?ttl=48h", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	got := SignedURL{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if !strings.HasPrefix(got.URL, "/api/v1/image/a/content?expires=") {
+		t.Fatalf("expected a content url, got: %s", got.URL)
+	}
+	if got.Expires.After(before.Add(maxSignedURLTTL)) {
+		t.Fatalf("expected expiry capped at %v, got: %v", maxSignedURLTTL, got.Expires.Sub(before))
+	}
+}
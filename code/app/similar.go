@@ -0,0 +1,342 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+)
+
+// perceptualHashKey is the metadata the perceptual hash of an original is
+// kept in, as 16 hex digits.
+const perceptualHashKey = "dhash"
+
+// defaultSimilarThreshold is how many bits two perceptual hashes can differ
+// by for their images to count as alike, unless ?threshold= says
+// otherwise. It is also what uploads are checked against.
+const defaultSimilarThreshold = 10
+
+// SimilarImage is an image that looks like another, Distance bits of
+// their perceptual hashes apart.
+type SimilarImage struct {
+	Image
+	Distance int `json:"distance"`
+}
+
+// SimilarImages are the images that look like image ID, closest first.
+type SimilarImages struct {
+	ID        string         `json:"id"`
+	Threshold int            `json:"threshold"`
+	Images    []SimilarImage `json:"images"`
+}
+
+// JSON marshalls the content of SimilarImages to json.
+func (s SimilarImages) JSON() (string, error) {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of SimilarImages to json.
+func (s SimilarImages) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// dHash is the difference hash of img: it is shrunk to 9 by 8 grey pixels,
+// and each bit says whether a pixel is brighter than the one to its right.
+// Re-encoding, resizing or a little editing changes few of the bits.
+func dHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				h |= 1
+			}
+		}
+	}
+
+	return h
+}
+
+// perceptualHash decodes the image in r and returns its dHash.
+func perceptualHash(r io.Reader) (uint64, error) {
+	img, _, err := decodeImage(r)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode image: %s", err)
+	}
+
+	return dHash(img), nil
+}
+
+// uploadHash returns the perceptual hash of an upload, from its thumbnail
+// when it has one, which is quicker to decode and hashes the same. It
+// leaves the file rewound, and reports false for one it can't decode.
+func uploadHash(file multipart.File, thumb *thumbnail) (uint64, bool) {
+	var r io.Reader = file
+	if thumb != nil {
+		r = bytes.NewReader(thumb.data)
+	}
+
+	h, err := perceptualHash(r)
+	if _, serr := file.Seek(0, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	return h, err == nil
+}
+
+// formatHash writes a perceptual hash the way it is kept in metadata.
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// parseHash reads a perceptual hash kept in metadata.
+func parseHash(s string) (uint64, bool) {
+	if len(s) != 16 {
+		return 0, false
+	}
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil
+}
+
+// hashed records that image id has the perceptual hash h.
+func (x *contentIndex) hashed(id string, h uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.loaded && x.sums[id] != "" {
+		x.hashes[id] = h
+		delete(x.stale, id)
+	}
+}
+
+// similar returns the images other than id whose perceptual hashes are at
+// most max bits from h, with how far they are. The index is loaded with
+// load if it has to be, and the hashes of images changed since are read
+// with read.
+func (x *contentIndex) similar(ctx context.Context, id string, h uint64, max int, load func(context.Context) (Images, error), read func(context.Context, string) (uint64, bool, error)) (map[string]int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.load(ctx, load); err != nil {
+		return nil, err
+	}
+	for stale := range x.stale {
+		sh, ok, err := read(ctx, stale)
+		if err != nil {
+			// Left to be read the next time.
+			weblog(fmt.Sprintf("could not read the perceptual hash of %s: %s", stale, err))
+			continue
+		}
+		if ok {
+			x.hashes[stale] = sh
+		}
+		delete(x.stale, stale)
+	}
+
+	matches := map[string]int{}
+	for other, oh := range x.hashes {
+		if d := bits.OnesCount64(h ^ oh); other != id && d <= max {
+			matches[other] = d
+		}
+	}
+	return matches, nil
+}
+
+// findSimilar returns the images other than id that look like one with
+// the perceptual hash h, at most max bits apart, with how far they are.
+func (s *Server) findSimilar(ctx context.Context, id string, h uint64, max int) (map[string]int, error) {
+	return s.contents.of(ctx).similar(ctx, id, h, max, func(ctx context.Context) (Images, error) {
+		return s.allImages(ctx, "")
+	}, s.storedHash)
+}
+
+// storedHash reads the perceptual hash kept with image id, reporting false
+// if it has none, or is gone.
+func (s *Server) storedHash(ctx context.Context, id string) (uint64, bool, error) {
+	fs, err := s.storage.Read(ctx, id)
+	if err == ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	is, _ := NewImages(fs)
+	if len(is) == 0 {
+		return 0, false, nil
+	}
+	h, ok := parseHash(is[0].PerceptualHash)
+	return h, ok, nil
+}
+
+// similarTo returns the ids of the images that look like an upload with
+// the perceptual hash h, to warn whoever uploads it. Failing to find them
+// doesn't fail the upload.
+func (s *Server) similarTo(ctx context.Context, id string, h uint64) []string {
+	matches, err := s.findSimilar(ctx, id, h, defaultSimilarThreshold)
+	if err != nil {
+		weblog(fmt.Sprintf("could not check %s for similar images: %s", id, err))
+		return nil
+	}
+
+	ids := make([]string, 0, len(matches))
+	for other := range matches {
+		ids = append(ids, other)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if matches[ids[i]] != matches[ids[j]] {
+			return matches[ids[i]] < matches[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// similarHandler lists the images that look like image id, within
+// ?threshold= bits of its perceptual hash.
+func (s *Server) similarHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ctx := r.Context()
+
+	threshold := defaultSimilarThreshold
+	if t := r.URL.Query().Get("threshold"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || n < 0 || n > 64 {
+			writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid threshold %q: want a number of bits from 0 to 64", t))
+			return
+		}
+		threshold = n
+	}
+
+	fs, err := s.storage.Read(ctx, id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read image %s: %w", id, err))
+		return
+	}
+	original, ok := originalFile(fs)
+	if !ok {
+		writeNotFound(w, id)
+		return
+	}
+
+	h, ok := parseHash(original.Metadata[perceptualHashKey])
+	if !ok {
+		// Uploaded before hashes were kept, so it is hashed now and kept
+		// for next time.
+		h, err = s.hashOriginal(ctx, id, original)
+		if err == ErrNotFound {
+			writeNotFound(w, id)
+			return
+		}
+		if err != nil {
+			writeErrorMsg(w, http.StatusUnprocessableEntity, fmt.Errorf("could not hash %s: %v", id, err))
+			return
+		}
+	}
+
+	matches, err := s.findSimilar(ctx, id, h, threshold)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	res := SimilarImages{ID: id, Threshold: threshold, Images: []SimilarImage{}}
+	for other, d := range matches {
+		fs, err := s.storage.Read(ctx, other)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			writeError(w, fmt.Errorf("failed to read image %s: %w", other, err))
+			return
+		}
+		if is, _ := NewImages(fs); len(is) > 0 {
+			res.Images = append(res.Images, SimilarImage{Image: is[0], Distance: d})
+		}
+	}
+	sort.Slice(res.Images, func(i, j int) bool {
+		a, b := res.Images[i], res.Images[j]
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		return a.Name < b.Name
+	})
+
+	writeJSON(w, res, http.StatusOK)
+}
+
+// hashOriginal works out the perceptual hash of original, that of image
+// id, and keeps it in its metadata. Failing to keep it only costs working
+// it out again.
+func (s *Server) hashOriginal(ctx context.Context, id string, original CSFile) (uint64, error) {
+	obj, err := s.storage.OpenObject(ctx, original.Name)
+	if err != nil {
+		return 0, err
+	}
+	h, err := perceptualHash(obj)
+	obj.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.storage.UpdateMetadata(ctx, original.Name, map[string]string{perceptualHashKey: formatHash(h)}); err != nil {
+		weblog(fmt.Sprintf("could not keep the perceptual hash of %s: %s", original.Name, err))
+	}
+	s.contents.of(ctx).hashed(id, h)
+
+	return h, nil
+}
+
+// IndexContents loads the index of the images' checksums and perceptual
+// hashes for the tenant and user of ctx, which would otherwise be loaded
+// by the first upload or similarity query to need it.
+func (s *Server) IndexContents(ctx context.Context) error {
+	x := s.contents.of(ctx)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.load(ctx, func(ctx context.Context) (Images, error) {
+		return s.allImages(ctx, "")
+	})
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math/bits"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// reexported returns the test image as a JPEG of quality, and mirrored, as
+// a PNG: one that looks the same, and one that doesn't.
+func reexported(t *testing.T, quality int) ([]byte, []byte) {
+	src, err := png.Decode(bytes.NewReader(testPNG(t)))
+	if err != nil {
+		t.Fatalf("could not decode test image: %s", err)
+	}
+
+	var lossy bytes.Buffer
+	if err := jpeg.Encode(&lossy, src, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatalf("could not encode: %s", err)
+	}
+
+	b := src.Bounds()
+	mirror := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			mirror.Set(b.Max.X-1-(x-b.Min.X), y, src.At(x, y))
+		}
+	}
+	var mirrored bytes.Buffer
+	if err := png.Encode(&mirrored, mirror); err != nil {
+		t.Fatalf("could not encode: %s", err)
+	}
+
+	return lossy.Bytes(), mirrored.Bytes()
+}
+
+func TestPerceptualHash(t *testing.T) {
+	lossy, mirrored := reexported(t, 30)
+
+	original, err := perceptualHash(bytes.NewReader(testPNG(t)))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	for name, test := range map[string]struct {
+		content []byte
+		alike   bool
+	}{
+		"jpeg":     {lossy, true},
+		"mirrored": {mirrored, false},
+	} {
+		h, err := perceptualHash(bytes.NewReader(test.content))
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %s", name, err)
+		}
+		if d := bits.OnesCount64(original ^ h); (d <= defaultSimilarThreshold) != test.alike {
+			t.Errorf("%s: expected alike to be %v, got a distance of %d", name, test.alike, d)
+		}
+	}
+
+	if _, err := perceptualHash(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if h, ok := parseHash(formatHash(original)); !ok || h != original {
+		t.Fatalf("expected %x back, got: %x", original, h)
+	}
+}
+
+// getSimilar gets target, a listing of similar images, from server.
+func getSimilar(t *testing.T, server *Server, target string) (int, SimilarImages) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	var res SimilarImages
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+	}
+
+	return w.Code, res
+}
+
+func TestSimilarImages(t *testing.T) {
+	// a was uploaded before hashes were kept.
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+	lossy, mirrored := reexported(t, 30)
+
+	for _, upload := range []struct {
+		filename, mimetype string
+		content            []byte
+	}{
+		{"b.jpg", "image/jpeg", lossy},
+		{"c.png", "image/png", mirrored},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", upload.filename, upload.mimetype, upload.content))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: expected: %v, got: %v %s", upload.filename, http.StatusCreated, w.Code, w.Body.String())
+		}
+		var img Image
+		json.Unmarshal(w.Body.Bytes(), &img)
+		if len(img.SimilarTo) != 0 {
+			t.Fatalf("%s: expected no warning before a has a hash, got: %v", upload.filename, img.SimilarTo)
+		}
+	}
+
+	code, res := getSimilar(t, server, "/api/v1/image/a/similar")
+	if code != http.StatusOK || len(res.Images) != 1 || res.Images[0].Name != "b" || res.Threshold != defaultSimilarThreshold {
+		t.Fatalf("expected b, got: %v %+v", code, res)
+	}
+	fs, _ := ms.Read(context.Background(), "a")
+	if original, _ := originalFile(fs); original.Metadata[perceptualHashKey] == "" {
+		t.Fatalf("expected a's hash to be kept, got: %v", original.Metadata)
+	}
+
+	// Now that a has a hash, uploads that look like it are pointed at it.
+	other, _ := reexported(t, 60)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", "d.jpg", "image/jpeg", other))
+	var img Image
+	json.Unmarshal(w.Body.Bytes(), &img)
+	if w.Code != http.StatusCreated || !reflect.DeepEqual(img.SimilarTo, []string{"b", "a"}) && !reflect.DeepEqual(img.SimilarTo, []string{"a", "b"}) {
+		t.Fatalf("expected a warning about a and b, got: %v %s", w.Code, w.Body.String())
+	}
+
+	// Deleting takes images out of the index.
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/api/v1/image/b?hard=true", nil))
+	code, res = getSimilar(t, server, "/api/v1/image/a/similar?threshold=64")
+	names := []string{}
+	for _, i := range res.Images {
+		names = append(names, i.Name)
+	}
+	if code != http.StatusOK || !reflect.DeepEqual(names, []string{"d", "c"}) || res.Images[0].Distance > res.Images[1].Distance {
+		t.Fatalf("expected d then c, got: %v %v", code, names)
+	}
+}
+
+func TestSimilarErrors(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	if _, err := ms.Create(context.Background(), "broken.png", newMemoryFile([]byte("not an image")), CreateOptions{}); err != nil {
+		t.Fatalf("could not create broken.png: %s", err)
+	}
+	server := NewServer(ms)
+
+	for target, want := range map[string]int{
+		"/api/v1/image/a/similar?threshold=65":   http.StatusBadRequest,
+		"/api/v1/image/a/similar?threshold=near": http.StatusBadRequest,
+		"/api/v1/image/nope/similar":             http.StatusNotFound,
+		"/api/v1/image/broken/similar":           http.StatusUnprocessableEntity,
+	} {
+		if code, _ := getSimilar(t, server, target); code != want {
+			t.Errorf("%s: expected: %v, got: %v", target, want, code)
+		}
+	}
+}
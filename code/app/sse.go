@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// eventStreamType is the content type of a stream of server-sent events.
+const eventStreamType = "text/event-stream"
+
+// eventRetry is how long browsers wait before reconnecting once a stream
+// ends, as it does at the request deadline or when a client falls behind.
+const eventRetry = 2 * time.Second
+
+// eventKeepAlive is how often a quiet stream is sent a comment, so that
+// proxies don't close it for being idle.
+var eventKeepAlive = 15 * time.Second
+
+// writeSSE writes e as a server-sent event named for its action, with the
+// image as its data. A reset has no image, so goes with an empty object.
+func (b *eventBus) writeSSE(w io.Writer, e busEvent) error {
+	data := []byte("{}")
+	if e.action != actionReset {
+		var err error
+		if data, err = json.Marshal(e.image); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", b.id(e.seq), e.action, data)
+	return err
+}
+
+// eventsHandler streams every change to an image made through this process
+// in the scope of the request, as server-sent events, until the client
+// goes or the request deadline passes. A client that reconnects with
+// Last-Event-ID is sent what it missed first, or a reset if that is no
+// longer known. One that falls too far behind is dropped, to come back the
+// same way.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorMsg(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	sub, missed, err := s.events.subscribe(scopeOf(r.Context()), r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(eventRetry.Seconds())))
+		writeErrorMsg(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer s.events.unsubscribe(sub)
+	s.metrics.subscribed("sse")
+	defer s.metrics.unsubscribed("sse")
+
+	w.Header().Set("Content-Type", eventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx and the like from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	for _, e := range missed {
+		if err := s.events.writeSSE(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				if sub.evicted {
+					s.metrics.evicted("sse")
+				}
+				return
+			}
+			if err := s.events.writeSSE(w, e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
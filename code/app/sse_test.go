@@ -0,0 +1,166 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one server-sent event as a client reads it.
+type sseEvent struct {
+	id, event, data string
+}
+
+// followEvents opens a stream of events from ts, picking up after lastID
+// if it is set.
+func followEvents(t *testing.T, ts *httptest.Server, lastID string) (*bufio.Reader, func()) {
+	t.Helper()
+
+	r, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/events", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if lastID != "" {
+		r.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != eventStreamType {
+		resp.Body.Close()
+		t.Fatalf("expected an event stream, got: %v %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+}
+
+// readEvent reads the next event from br, passing over comments and the
+// retry interval.
+func readEvent(t *testing.T, br *bufio.Reader) sseEvent {
+	t.Helper()
+
+	e := sseEvent{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected an event, got: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			e.id = value
+		case "event":
+			e.event = value
+		case "data":
+			e.data = value
+		case "":
+			if e.event != "" {
+				return e
+			}
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	br, done := followEvents(t, ts, "")
+	defer done()
+
+	server.ServeHTTP(httptest.NewRecorder(), newUploadRequest(t, http.MethodPost, "/api/v1/image", "a.png", "image/png", testPNG(t)))
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPatch, "/api/v1/image/a", strings.NewReader(`{"tags": ["x"]}`)))
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil))
+
+	var first string
+	for i, want := range []string{actionCreated, actionUpdated, actionDeleted} {
+		e := readEvent(t, br)
+		img := Image{}
+		if err := json.Unmarshal([]byte(e.data), &img); err != nil || e.event != want || img.ID != "a" || e.id == "" {
+			t.Fatalf("expected a to be %s, got: %+v", want, e)
+		}
+		if want == actionUpdated && (len(img.Tags) != 1 || img.Tags[0] != "x") {
+			t.Fatalf("expected the updated image, got: %+v", img)
+		}
+		if i == 0 {
+			first = e.id
+		}
+	}
+
+	// Coming back picks up after the last event seen.
+	again, done := followEvents(t, ts, first)
+	defer done()
+	if e := readEvent(t, again); e.event != actionUpdated {
+		t.Fatalf("expected the update to be replayed, got: %+v", e)
+	}
+	if e := readEvent(t, again); e.event != actionDeleted {
+		t.Fatalf("expected the delete to be replayed, got: %+v", e)
+	}
+
+	gone, done := followEvents(t, ts, "elsewhere-1")
+	defer done()
+	if e := readEvent(t, gone); e.event != actionReset || e.data != "{}" {
+		t.Fatalf("expected a reset, got: %+v", e)
+	}
+}
+
+func TestEventStreamKeepAlive(t *testing.T) {
+	defer func(d time.Duration) { eventKeepAlive = d }(eventKeepAlive)
+	eventKeepAlive = 10 * time.Millisecond
+
+	ts := httptest.NewServer(NewServer(NewMemoryStorage()))
+	defer ts.Close()
+	br, done := followEvents(t, ts, "")
+	defer done()
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected a keep-alive, got: %s", err)
+		}
+		if line == ": keep-alive\n" {
+			return
+		}
+	}
+}
+
+func TestEventStreamClosed(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	br, done := followEvents(t, ts, "")
+	defer done()
+	server.CloseEvents()
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatalf("expected the stream to end, got: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/events", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected: %v, got: %v", http.StatusServiceUnavailable, w.Code)
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// stagingPrefix is where the files in a multipart upload are streamed to
+// while the rest of the form arrives. Cloud Run's disk is memory, so
+// buffering them there would cost as much as holding them.
+const stagingPrefix = "staging"
+
+// stagedUpload is a file from a multipart upload.
+type stagedUpload struct {
+	Filename    string
+	ContentType string
+	Size        int64
+	// MD5 is the one the part's Content-MD5 gave, if it had one.
+	MD5 []byte
+
+	// name is the object the file was staged as. It is empty for files
+	// turned down on sight, with status and err.
+	name   string
+	status int
+	err    error
+}
+
+// stageUploads streams the files in the multipart form of r to staging
+// objects one part at a time, so that only a buffer of each is ever held.
+// With field set, only the files sent as it are staged. A file whose first
+// bytes show it isn't an allowed image is turned down without being staged.
+// The fields that give an image tags and metadata are returned with them.
+// Each file can have a Content-MD5 of its own, which a part that isn't
+// staged doesn't need to be checked against.
+//
+// It reports false when the upload is too large or not a form, in which
+// case a 413 or 400 has already been written to w and nothing is left
+// staged. Otherwise the caller must drop the staged files when it is done.
+func (s *Server) stageUploads(w http.ResponseWriter, r *http.Request, field string) ([]*stagedUpload, url.Values, bool) {
+	// Forms that say up front that they are too large aren't read at all.
+	if r.ContentLength > maxUploadBytes {
+		writeError(w, tooLarge(fmt.Errorf("upload too large, limit is %d bytes", maxUploadBytes)))
+		return nil, nil, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	ctx := r.Context()
+
+	_, span := startSpan(ctx, "stageUploads")
+	defer span.End()
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, uploadReadError(err))
+		return nil, nil, false
+	}
+
+	staged := []*stagedUpload{}
+	values := url.Values{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return staged, values, true
+		}
+
+		switch {
+		case err != nil:
+		case part.FileName() == "":
+			err = readMetadataField(values, part)
+		case field != "" && part.FormName() != field:
+		default:
+			var sum []byte
+			if sum, err = contentMD5(part.Header.Get("Content-MD5")); err != nil {
+				break
+			}
+			var u *stagedUpload
+			u, err = s.stage(ctx, part.FileName(), part.Header.Get("Content-Type"), part)
+			if u != nil {
+				u.MD5 = sum
+				staged = append(staged, u)
+			}
+		}
+
+		if err != nil {
+			s.dropStaged(ctx, staged)
+			var ae *apiError
+			if !errors.As(err, &ae) {
+				err = uploadReadError(err)
+			}
+			writeError(w, err)
+			return nil, nil, false
+		}
+	}
+}
+
+// maxMetadataFields bounds how many tag and metadata fields a form can
+// have, and maxMetadataFieldBytes how long each can be.
+const (
+	maxMetadataFields     = 64
+	maxMetadataFieldBytes = 4 << 10
+)
+
+// readMetadataField adds the value of part to values if it is one of the
+// fields that give an image tags, metadata or a time to live. Other fields
+// are skipped.
+func readMetadataField(values url.Values, part *multipart.Part) error {
+	name := part.FormName()
+	if name != "tags" && name != "ttl" && !strings.HasPrefix(name, userMetaPrefix) {
+		return nil
+	}
+	if len(values) >= maxMetadataFields {
+		return invalidArgument(fmt.Errorf("too many tag and metadata fields, limit is %d", maxMetadataFields))
+	}
+
+	v, err := io.ReadAll(io.LimitReader(part, maxMetadataFieldBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(v) > maxMetadataFieldBytes {
+		return invalidArgument(fmt.Errorf("form field %s is too long, limit is %d bytes", name, maxMetadataFieldBytes))
+	}
+	values.Add(name, string(v))
+
+	return nil
+}
+
+// stage streams the file in part to a staging object.
+func (s *Server) stage(ctx context.Context, filename, declared string, part io.Reader) (*stagedUpload, error) {
+	u := &stagedUpload{Filename: filename, ContentType: declared}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	if n == 0 {
+		u.status, u.err = http.StatusBadRequest, errors.New("empty file: got 0 bytes")
+		return u, nil
+	}
+	// HEIF is converted once it is stored, and checked then, so long as
+	// it can be.
+	if heif := sniffHEIF(head); heif != "" {
+		if err := s.checkDeclaredType(heif); err != nil {
+			u.status, u.err = http.StatusUnsupportedMediaType, err
+			return u, nil
+		}
+	} else if status, err := checkMimeType(ctx, newMemoryFile(head), declared); err != nil {
+		// The rest of the part is skipped by the next one.
+		u.status, u.err = status, err
+		return u, nil
+	}
+
+	body := &countingReader{r: io.MultiReader(bytes.NewReader(head), part)}
+	name := fmt.Sprintf("%s/%s", stagingPrefix, uuid.NewString())
+	if err := s.storage.PutObject(ctx, name, body, declared); err != nil {
+		if derr := s.storage.DeleteObject(ctx, name); derr != nil && derr != ErrNotFound {
+			weblog(fmt.Sprintf("error deleting staged upload %s: %s", name, derr))
+		}
+		// Blame the client for a body that couldn't be read.
+		if body.err != nil {
+			return nil, body.err
+		}
+		return nil, fmt.Errorf("could not stage %s: %w", filename, err)
+	}
+	u.name, u.Size = name, body.n
+
+	return u, nil
+}
+
+// dropStaged deletes the staging objects of staged.
+func (s *Server) dropStaged(ctx context.Context, staged []*stagedUpload) {
+	for _, u := range staged {
+		if u.name == "" {
+			continue
+		}
+		if err := s.storage.DeleteObject(ctx, u.name); err != nil && err != ErrNotFound {
+			weblog(fmt.Sprintf("error deleting staged upload %s: %s", u.name, err))
+		}
+	}
+}
+
+// stageFile streams src, up to limit bytes, to a staging object like the
+// files of a multipart upload, and returns it to be stored from. Anything
+// larger is turned down with a 413. The caller must drop the file when it
+// is done.
+func (s *Server) stageFile(ctx context.Context, src io.Reader, contentType string, limit int64) (*stagedFile, error) {
+	_, span := startSpan(ctx, "stageFile")
+	defer span.End()
+
+	body := &countingReader{r: io.LimitReader(src, limit+1)}
+	name := fmt.Sprintf("%s/%s", stagingPrefix, uuid.NewString())
+	err := s.storage.PutObject(ctx, name, body, contentType)
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(body.err, &maxBytes), err == nil && body.n > limit:
+		err = tooLarge(fmt.Errorf("upload too large, limit is %d bytes", limit))
+	case body.err != nil:
+		err = fmt.Errorf("could not stage upload: %w", body.err)
+	case err != nil:
+		err = fmt.Errorf("could not stage upload: %w", err)
+	}
+
+	f := newStagedFile(ctx, s.storage, name)
+	f.size = body.n
+	if err != nil {
+		f.drop()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// storeStaged validates and stores a staged file, after the same fashion
+// as storeFile.
+func (s *Server) storeStaged(ctx context.Context, u *stagedUpload, opts uploadOptions) (Image, int, error) {
+	if u.err != nil {
+		return Image{}, u.status, u.err
+	}
+
+	file := newStagedFile(ctx, s.storage, u.name)
+	defer file.Close()
+
+	opts.MD5 = u.MD5
+	return s.storeFile(ctx, u.Filename, u.ContentType, file, opts)
+}
+
+// countingReader counts what is read through it, and keeps the first error
+// other than io.EOF.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// stagedFile reads a staged upload back from storage as a multipart.File.
+// Uploads are only ever read through or rewound, which opens the object
+// again, so that is all it supports. ReadAt keeps a reader of its own, and
+// only opens the object again to go back, which suits archive/zip: once
+// it has read the directory at the end, it reads the entries in order.
+type stagedFile struct {
+	ctx     context.Context
+	storage Storage
+	name    string
+	r       io.ReadCloser
+
+	// size is how big the file is, when stageFile staged it.
+	size int64
+	// at is the reader of ReadAt, which is at offset.
+	at     io.ReadCloser
+	offset int64
+}
+
+func newStagedFile(ctx context.Context, storage Storage, name string) *stagedFile {
+	return &stagedFile{ctx: ctx, storage: storage, name: name}
+}
+
+func (f *stagedFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		r, err := f.storage.OpenObject(f.ctx, f.name)
+		if err != nil {
+			return 0, fmt.Errorf("could not read staged upload: %w", err)
+		}
+		f.r = r
+	}
+
+	return f.r.Read(p)
+}
+
+func (f *stagedFile) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("staged uploads can only be rewound")
+	}
+
+	return 0, f.Close()
+}
+
+func (f *stagedFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.at != nil && off < f.offset {
+		f.at.Close()
+		f.at = nil
+	}
+	if f.at == nil {
+		r, err := f.storage.OpenObject(f.ctx, f.name)
+		if err != nil {
+			return 0, fmt.Errorf("could not read staged upload: %w", err)
+		}
+		f.at, f.offset = r, 0
+	}
+
+	if off > f.offset {
+		n, err := io.CopyN(io.Discard, f.at, off-f.offset)
+		f.offset += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(f.at, p)
+	f.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *stagedFile) Close() error {
+	if f.at != nil {
+		f.at.Close()
+		f.at = nil
+	}
+	if f.r == nil {
+		return nil
+	}
+	err := f.r.Close()
+	f.r = nil
+	return err
+}
+
+// drop closes f and deletes the staging object it reads.
+func (f *stagedFile) drop() {
+	f.Close()
+	if err := f.storage.DeleteObject(f.ctx, f.name); err != nil && err != ErrNotFound {
+		weblog(fmt.Sprintf("error deleting staged upload %s: %s", f.name, err))
+	}
+}
+
+// purgeStaging removes, as part of sw, staged uploads older than before,
+// which the instance that staged them didn't live to drop.
+func (s *Server) purgeStaging(ctx context.Context, sw *sweep, before time.Time) error {
+	if err := sw.wait(ctx); err != nil {
+		return err
+	}
+	fs, err := s.storage.ListObjects(ctx, stagingPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fs {
+		if !f.Updated.Before(before) {
+			continue
+		}
+		err := sw.remove(ctx, &sw.report.Staged, f.Name, func() error {
+			return s.storage.DeleteObject(ctx, f.Name)
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting staged upload %s: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
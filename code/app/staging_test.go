@@ -0,0 +1,185 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// newStreamingUploadRequest uploads a PNG header followed by size zeros as
+// myFile, generating the body as it is read.
+func newStreamingUploadRequest(t *testing.T, target, filename string, size int64) *http.Request {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="myFile"; filename="%s"`, filename))
+		h.Set("Content-Type", "image/png")
+		part, err := mw.CreatePart(h)
+		if err == nil {
+			_, err = io.WriteString(part, "\x89PNG\r\n\x1a\n")
+		}
+		if err == nil {
+			_, err = io.Copy(part, io.LimitReader(zeros{}, size))
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	r := httptest.NewRequest(http.MethodPost, target, pr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestStreamingUploadMemory(t *testing.T) {
+	const size = 64 << 20
+
+	old := maxUploadBytes
+	maxUploadBytes = 2 * size
+	defer func() { maxUploadBytes = old }()
+
+	fs, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	server := NewServer(fs)
+
+	r := newStreamingUploadRequest(t, "/api/v1/image", "big.png", size)
+	w := httptest.NewRecorder()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	server.ServeHTTP(w, r)
+	runtime.ReadMemStats(&after)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if got := after.TotalAlloc - before.TotalAlloc; got > size/8 {
+		t.Fatalf("expected the upload to be streamed, but %d bytes were allocated for a %d byte file", got, size)
+	}
+
+	obj, err := fs.Open(context.Background(), "big")
+	if err != nil {
+		t.Fatalf("expected the upload to be stored, got: %s", err)
+	}
+	defer obj.Close()
+	if obj.Size != size+8 {
+		t.Fatalf("expected: %v, got: %v", size+8, obj.Size)
+	}
+	if staged, _ := fs.ListObjects(context.Background(), stagingPrefix); len(staged) != 0 {
+		t.Fatalf("expected nothing to be left staged, got: %v", staged)
+	}
+}
+
+func TestStreamingUploadTooLarge(t *testing.T) {
+	old := maxUploadBytes
+	maxUploadBytes = 1024
+	defer func() { maxUploadBytes = old }()
+
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+
+	// The body is streamed, so its length isn't known until it is read.
+	r := newStreamingUploadRequest(t, "/api/v1/image", "big.png", 4096)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+	}
+	if staged, _ := ms.ListObjects(context.Background(), stagingPrefix); len(staged) != 0 {
+		t.Fatalf("expected nothing to be left staged, got: %v", staged)
+	}
+}
+
+func TestPurgeStaging(t *testing.T) {
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+
+	if err := ms.PutObject(context.Background(), stagingPrefix+"/left", strings.NewReader("x"), ""); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	sw := &sweep{}
+	if err := server.purgeStaging(context.Background(), sw, time.Now().Add(-time.Hour)); err != nil || sw.report.Staged != 0 {
+		t.Fatalf("expected a fresh upload to be kept, got: %v %v", sw.report.Staged, err)
+	}
+	if err := server.purgeStaging(context.Background(), sw, time.Now().Add(time.Second)); err != nil || sw.report.Staged != 1 {
+		t.Fatalf("expected: 1, got: %v %v", sw.report.Staged, err)
+	}
+}
+
+func TestStageFile(t *testing.T) {
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+
+	f, err := server.stageFile(context.Background(), strings.NewReader("0123456789"), "text/plain", 10)
+	if err != nil || f.size != 10 {
+		t.Fatalf("expected 10 bytes staged, got: %v %v", f, err)
+	}
+	// Reading at offsets goes forward and back, and leaves Read alone.
+	for _, c := range []struct {
+		off  int64
+		want string
+	}{{6, "678"}, {7, "789"}, {1, "123"}} {
+		p := make([]byte, 3)
+		if n, err := f.ReadAt(p, c.off); err != nil || string(p[:n]) != c.want {
+			t.Fatalf("at %d expected: %q, got: %q %v", c.off, c.want, p[:n], err)
+		}
+	}
+	if n, err := f.ReadAt(make([]byte, 3), 8); n != 2 || err != io.EOF {
+		t.Fatalf("expected 2 bytes and EOF, got: %d %v", n, err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "0123456789" {
+		t.Fatalf("expected the whole file, got: %q %v", b, err)
+	}
+	f.drop()
+	if staged, _ := ms.ListObjects(context.Background(), stagingPrefix); len(staged) != 0 {
+		t.Fatalf("expected nothing to be left staged, got: %v", staged)
+	}
+
+	_, err = server.stageFile(context.Background(), strings.NewReader("0123456789"), "text/plain", 9)
+	if ae, ok := err.(*apiError); !ok || ae.Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected: %v, got: %v", http.StatusRequestEntityTooLarge, err)
+	}
+	if staged, _ := ms.ListObjects(context.Background(), stagingPrefix); len(staged) != 0 {
+		t.Fatalf("expected nothing to be left staged, got: %v", staged)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// embeddedStatic is the frontend, built into the binary so it is found
+// whatever directory the server is started from.
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// staticDir, set from STATIC_DIR, serves the frontend from disk instead, so
+// it can be worked on without rebuilding.
+var staticDir = ""
+
+// errNoEndpoint is returned for API paths that match no route, rather than
+// handing them the frontend.
+var errNoEndpoint = errors.New("no such endpoint")
+
+// hashedAsset matches file names with a content hash in them, such as
+// main.3f2a9c1d.js, which never change once built.
+var hashedAsset = regexp.MustCompile(`[.-][0-9a-f]{8,}\.[0-9a-z]+$`)
+
+// staticFiles returns the frontend's files.
+func staticFiles() fs.FS {
+	if staticDir != "" {
+		return os.DirFS(staticDir)
+	}
+
+	files, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		// The directory is embedded above, so this can't happen.
+		panic(err)
+	}
+	return files
+}
+
+// staticHandler serves files. Paths that aren't a file get index.html so
+// that the frontend can route them itself.
+func staticHandler(files fs.FS) http.Handler {
+	fileServer := http.FileServer(http.FS(files))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeErrorMsg(w, http.StatusNotFound, errNoEndpoint)
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if info, err := fs.Stat(files, name); name == "" || err != nil || info.IsDir() {
+			// The file server serves index.html for the root, and
+			// redirects requests for it by name there.
+			r = r.Clone(r.Context())
+			r.URL.Path = "/"
+			name = "index.html"
+		}
+
+		if hashedAsset.MatchString(name) {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else if name == "index.html" {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
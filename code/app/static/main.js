@@ -87,7 +87,7 @@ function listImages() {
 }
 
 function renderGallery(resp){
-    let images = JSON.parse(resp);
+    let images = JSON.parse(resp).images;
     let content = document.querySelector(".gallery");
     
 
@@ -115,7 +115,7 @@ function renderGallery(resp){
         a.href = img.original;
 
         let i = document.createElement("img");
-        i.src = img.thumbnail;
+        i.src = img.thumbnailUrl;
         a.appendChild(i)
         a.appendChild(p)
         div.appendChild(a);
@@ -161,16 +161,18 @@ function deleteImage(e){
 function uploadImage(e){
     e.preventDefault();
     var xmlhttp = new XMLHttpRequest();
-    let photo = document.getElementById("myFile").files[0];  // file from input
+    let photos = document.getElementById("myFile").files;  // files from input
     let form  = new FormData();
 
 
-    if (typeof photo == 'undefined'){
+    if (photos.length == 0){
         alert('No image indicated');
         return;
     }
     
-    form.append("myFile", photo);                                
+    for (let photo of photos) {
+        form.append("myFile", photo);
+    }
 
     xmlhttp.onreadystatechange = function() {
         if (xmlhttp.readyState == XMLHttpRequest.DONE) {   // XMLHttpRequest.DONE == 4
@@ -179,6 +181,17 @@ function uploadImage(e){
                sendAlert("Processing image!");  
                setTimeout(listImages, 2000);
            }
+           else if (xmlhttp.status == 200) {
+               // Some of a multiple file upload failed.
+               let results = JSON.parse(xmlhttp.response);
+               let failed = results.filter(res => res.error).map(res => res.name + ": " + res.error);
+               sendError(failed.join("<br>"));
+               setTimeout(listImages, 2000);
+           }
+           else if (xmlhttp.status == 409 || xmlhttp.status == 415) {
+            let msg = JSON.parse(xmlhttp.response);
+            sendError(msg.text + ": " + msg.details);
+           }
            else if (xmlhttp.status == 500) {
             let msg = JSON.parse(xmlhttp.response);
             if (msg.error.includes("invalid image type")) {
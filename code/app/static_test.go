@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStaticHandler(t *testing.T) {
+	files := fstest.MapFS{
+		"index.html":               {Data: []byte("<html>app</html>")},
+		"main.css":                 {Data: []byte("body {}")},
+		"assets/main.3f2a9c1d.js":  {Data: []byte("console.log(1)")},
+		"assets/logo-0123abcd.svg": {Data: []byte("<svg/>")},
+	}
+	handler := staticHandler(files)
+
+	tests := map[string]struct {
+		target string
+		status int
+		body   string
+		cache  string
+	}{
+		"root":        {target: "/", status: http.StatusOK, body: "<html>app</html>", cache: "no-cache"},
+		"file":        {target: "/main.css", status: http.StatusOK, body: "body {}"},
+		"hashed":      {target: "/assets/main.3f2a9c1d.js", status: http.StatusOK, body: "console.log(1)", cache: "public, max-age=31536000, immutable"},
+		"hashed dash": {target: "/assets/logo-0123abcd.svg", status: http.StatusOK, body: "<svg/>", cache: "public, max-age=31536000, immutable"},
+		"deep link":   {target: "/images/a/edit", status: http.StatusOK, body: "<html>app</html>", cache: "no-cache"},
+		"directory":   {target: "/assets/", status: http.StatusOK, body: "<html>app</html>", cache: "no-cache"},
+		"api":         {target: "/api/v2/image", status: http.StatusNotFound, body: errNoEndpoint.Error()},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			if rr.Code != tc.status {
+				t.Fatalf("expected: %v, got: %v", tc.status, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), tc.body) {
+				t.Fatalf("expected body: %q, got: %q", tc.body, rr.Body.String())
+			}
+			if got := rr.Header().Get("Cache-Control"); got != tc.cache {
+				t.Fatalf("expected cache: %q, got: %q", tc.cache, got)
+			}
+		})
+	}
+}
+
+func TestStaticFilesEmbedded(t *testing.T) {
+	if _, err := fs.Stat(staticFiles(), "index.html"); err != nil {
+		t.Fatalf("expected index.html to be embedded, got: %s", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statsTTL is how long stats are served from memory before storage is
+// listed again, set from STATS_CACHE_TTL. Zero computes them every time.
+var statsTTL = 30 * time.Second
+
+// Stats sums up the images in storage.
+type Stats struct {
+	Images       int                     `json:"images"`
+	Bytes        int64                   `json:"bytes"`
+	Largest      *LargestImage           `json:"largest,omitempty"`
+	ContentTypes map[string]ContentTypes `json:"contentTypes"`
+	Computed     time.Time               `json:"computed"`
+}
+
+// LargestImage is the biggest image in storage.
+type LargestImage struct {
+	ID        string `json:"id"`
+	SizeBytes int64  `json:"sizeBytes"`
+}
+
+// ContentTypes counts the images of one content type.
+type ContentTypes struct {
+	Images int   `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// JSON marshalls the content of Stats to json.
+func (st Stats) JSON() (string, error) {
+	bytes, err := json.Marshal(st)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of Stats to json.
+func (st Stats) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(st)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// NewStats sums up is.
+func NewStats(is Images) Stats {
+	st := Stats{ContentTypes: map[string]ContentTypes{}, Computed: time.Now().UTC()}
+	for _, img := range is {
+		st.Images++
+		st.Bytes += img.SizeBytes
+
+		ct := st.ContentTypes[img.ContentType]
+		ct.Images++
+		ct.Bytes += img.SizeBytes
+		st.ContentTypes[img.ContentType] = ct
+
+		if st.Largest == nil || img.SizeBytes > st.Largest.SizeBytes {
+			st.Largest = &LargestImage{ID: img.Name, SizeBytes: img.SizeBytes}
+		}
+	}
+
+	return st
+}
+
+// statsCache holds the last stats computed until they expire or an image
+// changes.
+type statsCache struct {
+	mu sync.Mutex
+	// stats are kept for each tenant and user.
+	stats map[string]cachedStats
+	// gen counts invalidations, so that stats computed while an image
+	// changed aren't kept.
+	gen int
+}
+
+type cachedStats struct {
+	stats   Stats
+	expires time.Time
+}
+
+// invalidate drops the cached stats.
+func (c *statsCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats = nil
+	c.gen++
+}
+
+// imageStats returns the stats for every image, from the cache if they are
+// fresh enough.
+func (s *Server) imageStats(ctx context.Context) (Stats, error) {
+	c := &s.stats
+	scope := scopeOf(ctx)
+	c.mu.Lock()
+	if cs, ok := c.stats[scope]; ok && time.Now().Before(cs.expires) {
+		c.mu.Unlock()
+		return cs.stats, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	is, err := s.allImages(ctx, "")
+	if err != nil {
+		return Stats{}, err
+	}
+	st := NewStats(is)
+
+	c.mu.Lock()
+	if c.gen == gen && statsTTL > 0 {
+		if c.stats == nil {
+			c.stats = map[string]cachedStats{}
+		}
+		c.stats[scope] = cachedStats{stats: st, expires: time.Now().Add(statsTTL)}
+	}
+	c.mu.Unlock()
+
+	return st, nil
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	st, err := s.imageStats(r.Context())
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to compute stats: %v", err))
+		return
+	}
+
+	writeJSON(w, st, http.StatusOK)
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewStats(t *testing.T) {
+	st := NewStats(Images{
+		{Name: "a", SizeBytes: 10, ContentType: "image/png"},
+		{Name: "b", SizeBytes: 30, ContentType: "image/jpeg"},
+		{Name: "c", SizeBytes: 20, ContentType: "image/png"},
+	})
+
+	if st.Images != 3 || st.Bytes != 60 {
+		t.Fatalf("expected 3 images of 60 bytes, got: %+v", st)
+	}
+	if st.Largest == nil || st.Largest.ID != "b" {
+		t.Fatalf("expected b to be the largest, got: %+v", st.Largest)
+	}
+	if got := st.ContentTypes["image/png"]; got != (ContentTypes{Images: 2, Bytes: 30}) {
+		t.Fatalf("expected: %+v, got: %+v", ContentTypes{Images: 2, Bytes: 30}, got)
+	}
+
+	if empty := NewStats(nil); empty.Largest != nil || empty.ContentTypes == nil {
+		t.Fatalf("expected no largest image and no content types, got: %+v", empty)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+
+	stats := func() Stats {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+		}
+
+		st := Stats{}
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+			t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+		}
+		return st
+	}
+
+	if st := stats(); st.Images != 1 || st.ContentTypes["image/png"].Images != 1 {
+		t.Fatalf("expected one png, got: %+v", st)
+	}
+
+	// Changes made behind the server's back wait for the cache to expire.
+	if _, err := ms.Create(context.Background(), "b.png", newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+		t.Fatalf("could not create b.png: %s", err)
+	}
+	if st := stats(); st.Images != 1 {
+		t.Fatalf("expected cached stats, got: %+v", st)
+	}
+
+	// Those made through it are seen straight away.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/image/a", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v", http.StatusNoContent, w.Code)
+	}
+	if st := stats(); st.Images != 1 || st.Largest == nil || st.Largest.ID != "b" {
+		t.Fatalf("expected only b, got: %+v", st)
+	}
+}
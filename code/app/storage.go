@@ -16,22 +16,111 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+
+	"scalar-attempt/api"
 )
 
+// Storage is the set of operations the handlers need from wherever images
+// are kept.
+type Storage interface {
+	List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error)
+	// Walk calls fn with each of the objects List would return for prefix,
+	// in the same order, as storage yields them, so that the listing is
+	// never held all at once. It stops at the first error fn returns and
+	// returns that.
+	Walk(ctx context.Context, prefix string, fn func(CSFile) error) error
+	Read(ctx context.Context, id string) (CSFiles, error)
+	Open(ctx context.Context, id string) (*CSReader, error)
+	Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error)
+	// Replace, Delete and Trash can be made conditional on the original of
+	// image id being at generation, failing with ErrPrecondition if it has
+	// been overwritten since. A generation of 0 makes them unconditional.
+	Replace(ctx context.Context, id, filename string, file multipart.File, metadata map[string]string, generation int64) error
+	Delete(ctx context.Context, id string, generation int64) error
+	// Rename moves the objects of image id to newID, keeping their
+	// contents, content types and metadata. It fails with ErrNotFound if
+	// there is no image id, and with ErrConflict if there is already one
+	// called newID, unless overwrite is set, in which case that one is
+	// deleted first.
+	Rename(ctx context.Context, id, newID string, overwrite bool) error
+	// Copy is Rename without removing image id.
+	Copy(ctx context.Context, id, newID string, overwrite bool) error
+
+	// Trash moves the objects stored for image id under the trash prefix,
+	// recording when it was deleted. Restore moves them back, failing with
+	// ErrConflict if another image has taken the id since. ListTrash
+	// returns every trashed object, and Purge removes a trashed image for
+	// good.
+	Trash(ctx context.Context, id string, deleted time.Time, generation int64) error
+	Restore(ctx context.Context, id string) error
+	ListTrash(ctx context.Context) (CSFiles, error)
+	Purge(ctx context.Context, id string) error
+
+	// Versions returns the generations of the original of image id that
+	// storage keeps, the live one included, oldest first. OpenVersion
+	// returns a reader over one of them. Both fail with
+	// ErrVersioningDisabled where old generations aren't kept.
+	Versions(ctx context.Context, id string) (CSFiles, error)
+	OpenVersion(ctx context.Context, id string, generation int64) (*CSReader, error)
+
+	// SignedURL returns a URL anyone can GET the original of image id from
+	// until expires, or ErrNotFound if there is no such image.
+	SignedURL(ctx context.Context, id string, expires time.Time) (string, error)
+	// SignedUploadURL returns a URL that an upload called name, of type
+	// contentType, can be PUT to directly until expires.
+	SignedUploadURL(ctx context.Context, name, contentType string, expires time.Time) (string, error)
+
+	// PutObject, OpenObject and DeleteObject work on single objects by
+	// name, for the things the app keeps next to the images themselves.
+	// ListObjects returns everything under a directory of those, and
+	// DeleteObjects removes it. Neither minds if there is nothing there.
+	// UpdateMetadata sets keys in the metadata of an object, leaving the
+	// rest of it and the object's contents as they are. Keys set empty are
+	// removed, or with Cloud Storage, which can't remove a single key in
+	// place, left empty.
+	PutObject(ctx context.Context, name string, r io.Reader, contentType string) error
+	OpenObject(ctx context.Context, name string) (*CSReader, error)
+	UpdateMetadata(ctx context.Context, name string, metadata map[string]string) error
+	DeleteObject(ctx context.Context, name string) error
+	ListObjects(ctx context.Context, dir string) (CSFiles, error)
+	DeleteObjects(ctx context.Context, dir string) error
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// CreateOptions control how Create stores an upload.
+type CreateOptions struct {
+	// Overwrite replaces an existing image instead of failing with
+	// ErrConflict.
+	Overwrite bool
+	// Metadata is stored with the original.
+	Metadata map[string]string
+	// IfGeneration, when set, only overwrites an image whose original is
+	// at that generation, failing with ErrPrecondition otherwise.
+	IfGeneration int64
+}
+
+// CloudStorage is a Storage backed by a Cloud Storage bucket.
 type CloudStorage struct {
 	Client storage.Client
 	Bucket string
-	ctx    context.Context
 }
 
 func NewCloudStorage(bucket string) (CloudStorage, error) {
@@ -44,7 +133,6 @@ func NewCloudStorage(bucket string) (CloudStorage, error) {
 	}
 	cs.Client = *client
 	cs.Bucket = bucket
-	cs.ctx = ctx
 
 	return cs, nil
 }
@@ -53,186 +141,1019 @@ func (cs *CloudStorage) Close() error {
 	return cs.Client.Close()
 }
 
-func (cs CloudStorage) List() (CSFiles, error) {
+// Ping checks that the bucket exists and can be reached by reading its
+// attributes.
+func (cs CloudStorage) Ping(ctx context.Context) error {
+	if _, err := cs.Client.Bucket(cs.Bucket).Attrs(ctx); err != nil {
+		return fmt.Errorf("could not read bucket %s: %w", cs.Bucket, err)
+	}
+
+	return nil
+}
+
+// ErrNotFound is returned when there are no objects stored for an image id.
+var ErrNotFound = errors.New("image not found")
+
+// ErrConflict is returned by Create when an image with the same id already
+// exists and overwriting wasn't asked for.
+var ErrConflict = errors.New("image already exists")
+
+// ErrPrecondition is returned when a write was conditional on the
+// generation of an image's original and it is at another.
+var ErrPrecondition = errors.New("image has been changed since")
+
+// ErrVersioningDisabled is returned for the old versions of an image when
+// storage doesn't keep them.
+var ErrVersioningDisabled = errors.New("object versioning isn't enabled on the bucket, so old versions of images aren't kept")
+
+// ErrInvalidPageToken is returned by List when Cloud Storage rejects the
+// page token it was handed.
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// List returns a single page of at most pageSize processed objects for images
+// whose ids start with prefix, starting at pageToken, along with the token
+// for the following page. An empty next token means there are no more pages.
+func (cs CloudStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
 	i := CSFiles{}
 	bucket := cs.Client.Bucket(cs.Bucket)
 
-	query := &storage.Query{}
-	it := bucket.Objects(cs.ctx, query)
+	query := &storage.Query{Prefix: "processed/" + prefix}
+	it := bucket.Objects(ctx, query)
+
+	var objs []*storage.ObjectAttrs
+	next, err := iterator.NewPager(it, pageSize, pageToken).NextPage(&objs)
+	if err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusBadRequest {
+			return i, "", ErrInvalidPageToken
+		}
+		return i, "", fmt.Errorf("error iterating over bucket query: %w", err)
+	}
+
+	for _, obj := range objs {
+		img, err := cs.file(obj)
+		if err != nil {
+			return i, "", err
+		}
+		i = append(i, img)
+	}
+
+	return i, next, nil
+}
+
+func (cs CloudStorage) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	bucket := cs.Client.Bucket(cs.Bucket)
+
+	it := bucket.Objects(ctx, &storage.Query{Prefix: "processed/" + prefix})
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+
+		f, err := cs.file(obj)
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+}
+
+func (cs CloudStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	i := CSFiles{}
+	bucket := cs.Client.Bucket(cs.Bucket)
+
+	query := &storage.Query{Prefix: imageDir(id), Delimiter: "/"}
+	it := bucket.Objects(ctx, query)
 	for {
 		obj, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return i, fmt.Errorf("error iterating over bucket query: %s", err)
+			return i, fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+		if obj.Prefix != "" {
+			// A nested image, not one of this one's objects.
+			continue
 		}
 
-		u, err := url.Parse(obj.MediaLink)
+		img, err := cs.file(obj)
 		if err != nil {
-			return i, fmt.Errorf("cannot create url from %s: %s", obj.MediaLink, err)
+			return i, err
 		}
-		img := CSFile{obj.Name, cs.Bucket, u}
 		i = append(i, img)
 
 	}
 
+	if len(i) == 0 {
+		return i, ErrNotFound
+	}
+
 	return i, nil
 }
 
-func (cs CloudStorage) Read(id string) (CSFiles, error) {
-	i := CSFiles{}
-	bucket := cs.Client.Bucket(cs.Bucket)
+// versioned fails with ErrVersioningDisabled unless the bucket keeps the
+// objects that are overwritten or deleted.
+func (cs CloudStorage) versioned(ctx context.Context) error {
+	attrs, err := cs.Client.Bucket(cs.Bucket).Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading bucket %s: %w", cs.Bucket, err)
+	}
+	if !attrs.VersioningEnabled {
+		return ErrVersioningDisabled
+	}
+
+	return nil
+}
 
-	query := &storage.Query{Prefix: fmt.Sprintf("processed/%s", id)}
-	it := bucket.Objects(cs.ctx, query)
+// Versions lists every generation of the original of image id the bucket
+// has, live or not.
+func (cs CloudStorage) Versions(ctx context.Context, id string) (CSFiles, error) {
+	if err := cs.versioned(ctx); err != nil {
+		return nil, err
+	}
+
+	query := &storage.Query{Prefix: imageDir(id), Delimiter: "/", Versions: true}
+	it := cs.Client.Bucket(cs.Bucket).Objects(ctx, query)
+	fs := CSFiles{}
 	for {
 		obj, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return i, fmt.Errorf("error iterating over bucket query: %s", err)
+			return nil, fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+		if obj.Prefix != "" || !strings.HasPrefix(path.Base(obj.Name), "original.") {
+			continue
 		}
 
-		u, err := url.Parse(obj.MediaLink)
+		f, err := cs.file(obj)
 		if err != nil {
-			return i, fmt.Errorf("cannot create url from %s: %s", obj.MediaLink, err)
+			return nil, err
 		}
-		img := CSFile{obj.Name, cs.Bucket, u}
-		i = append(i, img)
+		fs = append(fs, f)
+	}
+	if len(fs) == 0 {
+		return nil, ErrNotFound
+	}
+	sortGenerations(fs)
 
+	return fs, nil
+}
+
+// OpenVersion returns a reader over generation of the original of image
+// id, live or not.
+func (cs CloudStorage) OpenVersion(ctx context.Context, id string, generation int64) (*CSReader, error) {
+	fs, err := cs.Versions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := versionOf(fs, generation)
+	if !ok {
+		return nil, ErrNotFound
 	}
 
-	return i, nil
+	r, err := cs.Client.Bucket(cs.Bucket).Object(f.Name).Generation(generation).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s#%d: %w", f.Name, generation, err)
+	}
+
+	cr := &CSReader{
+		ReadCloser:  r,
+		Filename:    uploadName(id, f.Name, f.Metadata),
+		ContentType: f.ContentType,
+		Size:        f.Size,
+		ETag:        f.ETag,
+		Checksums:   f.Checksums,
+		Updated:     f.Updated,
+		Metadata:    f.Metadata,
+	}
+	return cr, nil
 }
 
-func (cs CloudStorage) Create(name string, file multipart.File) error {
-	csPath := fmt.Sprintf("uploads/%s", name)
-	obj := cs.Client.Bucket(cs.Bucket).Object(csPath).NewWriter(cs.ctx)
+// Open finds the original image stored for id and returns a reader over its
+// contents. The caller is responsible for closing it.
+func (cs CloudStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	fs, err := cs.Read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range fs {
+		if strings.Index(f.Name, "original.") < 0 {
+			continue
+		}
+
+		cr, err := cs.OpenObject(ctx, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		cr.Filename = uploadName(id, f.Name, cr.Metadata)
+		return cr, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// SignedURL signs a V4 GET URL for the original of image id with the
+// client's service account credentials.
+func (cs CloudStorage) SignedURL(ctx context.Context, id string, expires time.Time) (string, error) {
+	fs, err := cs.Read(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	for _, f := range fs {
+		if strings.Index(f.Name, "original.") < 0 {
+			continue
+		}
+
+		opts := &storage.SignedURLOptions{
+			Scheme:  storage.SigningSchemeV4,
+			Method:  http.MethodGet,
+			Expires: expires,
+		}
+		u, err := cs.Client.Bucket(cs.Bucket).SignedURL(f.Name, opts)
+		if err != nil {
+			return "", fmt.Errorf("could not sign url for %s: %w", f.Name, err)
+		}
+		return u, nil
+	}
+
+	return "", ErrNotFound
+}
+
+// SignedUploadURL signs a V4 PUT URL for name in the uploads folder, so
+// that the file goes straight to the bucket and on to the Cloud Function.
+func (cs CloudStorage) SignedUploadURL(ctx context.Context, name, contentType string, expires time.Time) (string, error) {
+	object := uploadObject(name)
+	opts := &storage.SignedURLOptions{
+		Scheme:      storage.SigningSchemeV4,
+		Method:      http.MethodPut,
+		ContentType: contentType,
+		Expires:     expires,
+	}
+
+	u, err := cs.Client.Bucket(cs.Bucket).SignedURL(object, opts)
+	if err != nil {
+		return "", fmt.Errorf("could not sign url for %s: %w", object, err)
+	}
+
+	return u, nil
+}
+
+// Create uploads file for the Cloud Function to process. The returned CSFile
+// describes the original as it will be stored once processing is done.
+// Unless overwrite is set, ErrConflict is returned if the image already
+// exists or another upload of the same name is still waiting to be
+// processed.
+func (cs CloudStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	overwrite := opts.Overwrite
+	if !overwrite {
+		if _, err := cs.Read(ctx, imageID(name)); err != ErrNotFound {
+			if err == nil {
+				return CSFile{}, ErrConflict
+			}
+			return CSFile{}, err
+		}
+	}
+	if opts.IfGeneration != 0 {
+		fs, err := cs.Read(ctx, imageID(name))
+		if err != nil && err != ErrNotFound {
+			return CSFile{}, err
+		}
+		if err := checkGeneration(fs, opts.IfGeneration); err != nil {
+			return CSFile{}, err
+		}
+	}
+
+	csPath := uploadObject(name)
+	handle := cs.Client.Bucket(cs.Bucket).Object(csPath)
+	if !overwrite {
+		handle = handle.If(storage.Conditions{DoesNotExist: true})
+	}
+
+	obj := handle.NewWriter(ctx)
+	obj.Metadata = copyMetadata(opts.Metadata)
+	if overwrite {
+		obj.Metadata["replace"] = "true"
+	}
+
+	// Objects only appear once the writer is closed successfully, so a
+	// failure up to then leaves nothing behind.
+	if _, err := io.Copy(obj, file); err != nil {
+		obj.Close()
+		return CSFile{}, uncommittedError{fmt.Errorf("could not write file to CloudStorage: %w", err)}
+	}
+
+	if err := obj.Close(); err != nil {
+		if preconditionFailed(err) {
+			return CSFile{}, ErrConflict
+		}
+		err = fmt.Errorf("could not write file to CloudStorage: %w", err)
+		if obj.Attrs() == nil {
+			err = uncommittedError{err}
+		}
+		return CSFile{}, err
+	}
+
+	f, err := cs.file(obj.Attrs())
+	if err != nil {
+		return CSFile{}, err
+	}
+	f.Name = originalName(name)
+
+	return f, nil
+}
+
+// Replace swaps the contents of image id for file. The new upload is flagged
+// so the Cloud Function processes it over the existing image rather than
+// under a new suffix, and nothing is removed here: processed files that the
+// new version won't overwrite, because their extension differs, are left
+// for the Cloud Function to delete once the new original is in place, so
+// the image is never without one. The processed original is written by the
+// Cloud Function, not here, so its generation can only be checked before
+// the upload is written.
+func (cs CloudStorage) Replace(ctx context.Context, id, filename string, file multipart.File, metadata map[string]string, generation int64) error {
+	fs, err := cs.Read(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkGeneration(fs, generation); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(filename)
+	csPath := uploadObject(id + ext)
+	obj := cs.Client.Bucket(cs.Bucket).Object(csPath).NewWriter(ctx)
+	obj.Metadata = copyMetadata(metadata)
+	obj.Metadata["replace"] = "true"
 
 	if _, err := io.Copy(obj, file); err != nil {
-		return fmt.Errorf("could not write file to CloudStorage")
+		obj.Close()
+		return fmt.Errorf("could not write file to CloudStorage: %w", err)
+	}
+
+	if err := obj.Close(); err != nil {
+		return fmt.Errorf("could not write file to CloudStorage: %w", err)
 	}
-	defer obj.Close()
 
 	return nil
 }
 
-func (cs CloudStorage) Delete(id string) error {
+// Delete removes the objects stored for image id. One conditional on a
+// generation deletes the original first, on condition it is still at it,
+// so that nothing is removed if it isn't.
+func (cs CloudStorage) Delete(ctx context.Context, id string, generation int64) error {
 	bucket := cs.Client.Bucket(cs.Bucket)
-	query := &storage.Query{Prefix: fmt.Sprintf("processed/%s/", id)}
-	it := bucket.Objects(cs.ctx, query)
+	deleted := 0
+	if generation != 0 {
+		fs, err := cs.Read(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkGeneration(fs, generation); err != nil {
+			return err
+		}
+		original, _ := originalFile(fs)
+		err = bucket.Object(original.Name).If(storage.Conditions{GenerationMatch: generation}).Delete(ctx)
+		if preconditionFailed(err) || err == storage.ErrObjectNotExist {
+			return ErrPrecondition
+		}
+		if err != nil {
+			return fmt.Errorf("error deleting  %s: %w", original.Name, err)
+		}
+		deleted++
+	}
+
+	query := &storage.Query{Prefix: imageDir(id), Delimiter: "/"}
+	it := bucket.Objects(ctx, query)
 	for {
 		i, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error iterating over bucket query: %s", err)
+			return fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+		if i.Prefix != "" {
+			continue
 		}
 
 		obj := cs.Client.Bucket(cs.Bucket).Object(i.Name)
 
-		if err := obj.Delete(cs.ctx); err != nil {
-			return fmt.Errorf("error deleting  %s: %s", i.Name, err)
+		if err := obj.Delete(ctx); err != nil {
+			if err == storage.ErrObjectNotExist {
+				continue
+			}
+			return fmt.Errorf("error deleting  %s: %w", i.Name, err)
 		}
+		deleted++
+
+	}
 
+	if deleted == 0 {
+		return ErrNotFound
 	}
 
 	return nil
 }
 
-type CSFile struct {
-	Name   string
-	Bucket string
-	URL    *url.URL
+// Rename copies the objects of image id to newID within the bucket, so
+// nothing is downloaded, and then removes the originals.
+func (cs CloudStorage) Rename(ctx context.Context, id, newID string, overwrite bool) error {
+	if err := cs.clearTarget(ctx, id, newID, overwrite); err != nil {
+		return err
+	}
+
+	return cs.move(ctx, imageDir(id), imageDir(newID), func(map[string]string) {})
 }
 
-type CSFiles []CSFile
+// Copy copies the objects of image id to newID within the bucket.
+func (cs CloudStorage) Copy(ctx context.Context, id, newID string, overwrite bool) error {
+	if err := cs.clearTarget(ctx, id, newID, overwrite); err != nil {
+		return err
+	}
 
-type Image struct {
-	Name      string `json:"name"`
-	Original  string `json:"original"`
-	Thumbnail string `json:"thumbnail"`
+	_, err := cs.copyAll(ctx, imageDir(id), imageDir(newID), func(map[string]string) {})
+	return err
 }
 
-// Load converts a Cloud Storage Object to the format we need for this app.
-func (i *Image) Load(f CSFile) error {
-	if strings.Index(f.Name, "original.") > -1 {
-		dir := filepath.Dir(f.Name)
-		base := filepath.Base(f.Name)
-		name := strings.Replace(dir, "processed/", "", 1)
-		o := fmt.Sprintf("https://storage.googleapis.com/%s/%s/%s", f.Bucket, dir, base)
-		t := fmt.Sprintf("https://storage.googleapis.com/%s/%s/%s", f.Bucket, dir, strings.Replace(base, "original.", "thumbnail.", 1))
-		img := Image{name, o, t}
-		*i = img
+// clearTarget makes way for image id to be renamed or copied to newID,
+// checking that there is an image id, and that there isn't one called
+// newID unless overwrite allows it to be deleted.
+func (cs CloudStorage) clearTarget(ctx context.Context, id, newID string, overwrite bool) error {
+	if _, err := cs.Read(ctx, id); err != nil {
+		return err
+	}
+
+	_, err := cs.Read(ctx, newID)
+	switch {
+	case err == nil && !overwrite:
+		return ErrConflict
+	case err == nil:
+		if err := cs.Delete(ctx, newID, 0); err != nil && err != ErrNotFound {
+			return err
+		}
+	case err != ErrNotFound:
+		return err
 	}
 
 	return nil
 }
 
-// JSON marshalls the content of Image to json.
-func (i Image) JSON() (string, error) {
-	bytes, err := json.Marshal(i)
+// file converts the attributes of a Cloud Storage object to a CSFile.
+func (cs CloudStorage) file(obj *storage.ObjectAttrs) (CSFile, error) {
+	u, err := url.Parse(obj.MediaLink)
 	if err != nil {
-		return "", fmt.Errorf("could not marshal json for response: %s", err)
+		return CSFile{}, fmt.Errorf("cannot create url from %s: %w", obj.MediaLink, err)
+	}
+
+	f := CSFile{
+		Name:        obj.Name,
+		Bucket:      cs.Bucket,
+		URL:         u,
+		Size:        obj.Size,
+		ContentType: obj.ContentType,
+		Metadata:    obj.Metadata,
+		Created:     obj.Created,
+		Updated:     obj.Updated,
+		ETag:        objectETag(obj.MD5, obj.CRC32C),
+		Generation:  obj.Generation,
+		Checksums:   newChecksums(obj.MD5, obj.CRC32C, true),
 	}
 
-	return string(bytes), nil
+	return f, nil
 }
 
-// JSONBytes marshalls the content of Image to json.
-func (i Image) JSONBytes() ([]byte, error) {
-	bytes, err := json.Marshal(i)
-	if err != nil {
-		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+// Trash copies the objects of image id under the trash prefix, stamped
+// with the deletion time, and then removes the originals. Its generation
+// is checked before anything is copied.
+func (cs CloudStorage) Trash(ctx context.Context, id string, deleted time.Time, generation int64) error {
+	if generation != 0 {
+		fs, err := cs.Read(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkGeneration(fs, generation); err != nil {
+			return err
+		}
 	}
 
-	return bytes, nil
+	return cs.move(ctx, imageDir(id), trashDir(id)+"/", func(m map[string]string) {
+		m[deletedKey] = deleted.UTC().Format(time.RFC3339)
+	})
 }
 
-type Images []Image
+// Restore moves the objects of trashed image id back to where they were.
+func (cs CloudStorage) Restore(ctx context.Context, id string) error {
+	if _, err := cs.Read(ctx, id); err != ErrNotFound {
+		if err == nil {
+			return ErrConflict
+		}
+		return err
+	}
 
-// NewImages returns a list of images in the format we need for this app.
-func NewImages(fs CSFiles) (Images, error) {
-	is := Images{}
-	err := is.Load(fs)
-	return is, err
+	return cs.move(ctx, trashDir(id)+"/", imageDir(id), func(m map[string]string) {
+		delete(m, deletedKey)
+	})
 }
 
-// Load converts a slice of Cloud Storage Objects to the format we need for this app.
-func (is *Images) Load(fs CSFiles) error {
-	for _, v := range fs {
-		if strings.Index(v.Name, "original.") > -1 {
-			i := Image{}
-			if err := i.Load(v); err != nil {
-				return err
+// ListTrash returns every object in the trash.
+func (cs CloudStorage) ListTrash(ctx context.Context) (CSFiles, error) {
+	i := CSFiles{}
+	it := cs.Client.Bucket(cs.Bucket).Objects(ctx, &storage.Query{Prefix: trashPrefix + "/"})
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return i, fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+
+		img, err := cs.file(obj)
+		if err != nil {
+			return i, err
+		}
+		i = append(i, img)
+	}
+
+	return i, nil
+}
+
+// Purge removes the objects of trashed image id.
+func (cs CloudStorage) Purge(ctx context.Context, id string) error {
+	bucket := cs.Client.Bucket(cs.Bucket)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: trashDir(id) + "/", Delimiter: "/"})
+	deleted := 0
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+		if obj.Prefix != "" {
+			continue
+		}
+
+		if err := bucket.Object(obj.Name).Delete(ctx); err != nil {
+			if err == storage.ErrObjectNotExist {
+				continue
 			}
+			return fmt.Errorf("error deleting  %s: %w", obj.Name, err)
+		}
+		deleted++
+	}
 
-			*is = append(*is, i)
+	if deleted == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// move copies every object directly under from to the same name under to,
+// letting edit change its metadata on the way, and then deletes the source.
+// Nested images are left where they are. It returns ErrNotFound if there is
+// nothing under from.
+func (cs CloudStorage) move(ctx context.Context, from, to string, edit func(map[string]string)) error {
+	names, err := cs.copyAll(ctx, from, to, edit)
+	if err != nil {
+		return err
+	}
+
+	bucket := cs.Client.Bucket(cs.Bucket)
+	for _, name := range names {
+		if err := bucket.Object(name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return fmt.Errorf("error deleting  %s: %w", name, err)
 		}
 	}
 
 	return nil
 }
 
-// JSON marshalls the content of Images to json.
-func (is Images) JSON() (string, error) {
-	bytes, err := json.Marshal(is)
+// copyAll is move without deleting the source, returning the names of the
+// objects it copied.
+func (cs CloudStorage) copyAll(ctx context.Context, from, to string, edit func(map[string]string)) ([]string, error) {
+	bucket := cs.Client.Bucket(cs.Bucket)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: from, Delimiter: "/"})
+	copied := []string{}
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+		if obj.Prefix != "" {
+			continue
+		}
+
+		dst := to + strings.TrimPrefix(obj.Name, from)
+		c := bucket.Object(dst).CopierFrom(bucket.Object(obj.Name))
+		c.ContentType = obj.ContentType
+		c.Metadata = copyMetadata(obj.Metadata)
+		edit(c.Metadata)
+		if _, err := c.Run(ctx); err != nil {
+			return nil, fmt.Errorf("error copying %s to %s: %w", obj.Name, dst, err)
+		}
+		copied = append(copied, obj.Name)
+	}
+
+	if len(copied) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return copied, nil
+}
+
+// PutObject writes r to the object called name.
+func (cs CloudStorage) PutObject(ctx context.Context, name string, r io.Reader, contentType string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	obj := cs.Client.Bucket(cs.Bucket).Object(name).NewWriter(ctx)
+	obj.ContentType = contentType
+
+	if _, err := io.Copy(obj, r); err != nil {
+		// Canceling first abandons the write rather than committing what
+		// was read of r.
+		cancel()
+		obj.Close()
+		return fmt.Errorf("could not write %s to CloudStorage: %w", name, err)
+	}
+
+	if err := obj.Close(); err != nil {
+		return fmt.Errorf("could not write %s to CloudStorage: %w", name, err)
+	}
+
+	return nil
+}
+
+// OpenObject returns a reader over the object called name. Readers don't
+// carry checksums, so the attributes are read first and the reader pinned
+// to the generation they describe.
+func (cs CloudStorage) OpenObject(ctx context.Context, name string) (*CSReader, error) {
+	handle := cs.Client.Bucket(cs.Bucket).Object(name)
+	attrs, err := handle.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", name, err)
+	}
+
+	r, err := handle.Generation(attrs.Generation).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", name, err)
+	}
+
+	cr := &CSReader{
+		ReadCloser:  r,
+		Filename:    filepath.Base(name),
+		ContentType: r.Attrs.ContentType,
+		Size:        r.Attrs.Size,
+		ETag:        objectETag(attrs.MD5, attrs.CRC32C),
+		Checksums:   newChecksums(attrs.MD5, attrs.CRC32C, true),
+		Updated:     attrs.Updated,
+		Metadata:    attrs.Metadata,
+	}
+	return cr, nil
+}
+
+// UpdateMetadata merges metadata into that of the object called name. The
+// update is conditional on the metageneration it was merged with, so that
+// a concurrent update fails rather than being lost.
+func (cs CloudStorage) UpdateMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	handle := cs.Client.Bucket(cs.Bucket).Object(name)
+	attrs, err := handle.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return ErrNotFound
+	}
 	if err != nil {
-		return "", fmt.Errorf("could not marshal json for response: %s", err)
+		return fmt.Errorf("error reading %s: %w", name, err)
 	}
 
-	return string(bytes), nil
+	merged := copyMetadata(attrs.Metadata)
+	for k, v := range metadata {
+		merged[k] = v
+	}
+
+	cond := storage.Conditions{MetagenerationMatch: attrs.Metageneration}
+	if _, err := handle.If(cond).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: merged}); err != nil {
+		return fmt.Errorf("error updating metadata of %s: %w", name, err)
+	}
+
+	return nil
 }
 
-// JSONBytes marshalls the content of Images to json.
-func (is Images) JSONBytes() ([]byte, error) {
-	bytes, err := json.Marshal(is)
+// DeleteObject removes the object called name.
+func (cs CloudStorage) DeleteObject(ctx context.Context, name string) error {
+	err := cs.Client.Bucket(cs.Bucket).Object(name).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return ErrNotFound
+	}
 	if err != nil {
-		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+		return fmt.Errorf("error deleting  %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// ListObjects returns every object under dir.
+func (cs CloudStorage) ListObjects(ctx context.Context, dir string) (CSFiles, error) {
+	i := CSFiles{}
+	it := cs.Client.Bucket(cs.Bucket).Objects(ctx, &storage.Query{Prefix: dir + "/"})
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return i, fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+
+		f, err := cs.file(obj)
+		if err != nil {
+			return i, err
+		}
+		i = append(i, f)
+	}
+
+	return i, nil
+}
+
+// DeleteObjects removes every object under dir.
+func (cs CloudStorage) DeleteObjects(ctx context.Context, dir string) error {
+	bucket := cs.Client.Bucket(cs.Bucket)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: dir + "/"})
+	for {
+		i, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error iterating over bucket query: %w", err)
+		}
+
+		if err := bucket.Object(i.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return fmt.Errorf("error deleting  %s: %w", i.Name, err)
+		}
+	}
+
+	return nil
+}
+
+type CSFile struct {
+	Name        string
+	Bucket      string
+	URL         *url.URL
+	Size        int64
+	ContentType string
+	Metadata    map[string]string
+	Created     time.Time
+	Updated     time.Time
+	// ETag identifies the contents of the object, and Generation the
+	// version of it, changing whenever it is overwritten.
+	ETag       string
+	Generation int64
+	// Checksums are those of the contents, as far as they are known.
+	Checksums Checksums
+}
+
+// objectETag is the strong ETag for an object with the given checksums,
+// preferring MD5, which composite objects don't have, over CRC32C.
+func objectETag(md5 []byte, crc32c uint32) string {
+	if len(md5) > 0 {
+		return fmt.Sprintf(`"%x"`, md5)
+	}
+
+	return fmt.Sprintf(`"%08x"`, crc32c)
+}
+
+// copyMetadata returns a copy of m that is safe to add to.
+func copyMetadata(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
+
+// imageID is the id an upload called name is stored under. Directories in
+// name are kept, so images can be grouped into folders, but not any that
+// would climb out of them.
+func imageID(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// imageDir is the prefix every object of image id is stored under.
+func imageDir(id string) string {
+	return fmt.Sprintf("processed/%s/", id)
+}
+
+// ownObjects keeps the names directly under dir, dropping those that
+// belong to images nested further down, such as dir/2024/original.png.
+func ownObjects(dir string, names []string) []string {
+	own := []string{}
+	for _, name := range names {
+		if !strings.Contains(strings.TrimPrefix(name, dir), "/") {
+			own = append(own, name)
+		}
+	}
+
+	return own
+}
+
+// originalName is where the original of an upload called name is stored.
+func originalName(name string) string {
+	return fmt.Sprintf("processed/%s/original%s", imageID(name), filepath.Ext(name))
+}
+
+// uploadObject is the object a file called name is uploaded to for the
+// Cloud Function, which keeps the folders it is in, so that it becomes
+// originalName(name).
+func uploadObject(name string) string {
+	return "uploads/" + name
+}
+
+// originalFile finds the original among the objects of an image.
+func originalFile(fs CSFiles) (CSFile, bool) {
+	for _, f := range fs {
+		if strings.Index(f.Name, "original.") > -1 {
+			return f, true
+		}
+	}
+
+	return CSFile{}, false
+}
+
+type CSFiles []CSFile
+
+// checkGeneration fails with ErrPrecondition unless the original among fs
+// is at generation. A generation of 0 is always met.
+func checkGeneration(fs CSFiles, generation int64) error {
+	if generation == 0 {
+		return nil
+	}
+	if f, ok := originalFile(fs); !ok || f.Generation != generation {
+		return ErrPrecondition
+	}
+
+	return nil
+}
+
+// sortGenerations puts fs in the order they were written.
+func sortGenerations(fs CSFiles) {
+	sort.SliceStable(fs, func(i, j int) bool { return fs[i].Generation < fs[j].Generation })
+}
+
+// versionOf returns the file among fs at generation.
+func versionOf(fs CSFiles, generation int64) (CSFile, bool) {
+	for _, f := range fs {
+		if f.Generation == generation {
+			return f, true
+		}
+	}
+
+	return CSFile{}, false
+}
+
+// preconditionFailed reports whether err is Cloud Storage turning down a
+// conditional request.
+func preconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// CSReader streams the contents of a stored object.
+type CSReader struct {
+	io.ReadCloser
+	Filename    string
+	ContentType string
+	Size        int64
+	ETag        string
+	Checksums   Checksums
+	Updated     time.Time
+	Metadata    map[string]string
+}
+
+// originalNameKey is the metadata an upload's filename is kept in when it
+// is stored under some other id.
+const originalNameKey = "originalName"
+
+// uploadName is what the original of image id, stored as the object called
+// name, was called when it was uploaded.
+func uploadName(id, name string, metadata map[string]string) string {
+	if n := metadata[originalNameKey]; n != "" {
+		return n
+	}
+
+	return id + filepath.Ext(name)
+}
+
+// The types the API answers with are shared with its clients.
+type (
+	Image     = api.Image
+	Images    = api.Images
+	ImagePage = api.ImagePage
+)
+
+// NewImage converts a Cloud Storage Object to the format we need for this
+// app. Width and Height come from the metadata recorded on upload. Objects
+// that don't live in a bucket are served through the content endpoint
+// instead. Anything but an original converts to the zero Image.
+func NewImage(f CSFile) Image {
+	if strings.Index(f.Name, "original.") < 0 {
+		return Image{}
+	}
+
+	dir := filepath.Dir(f.Name)
+	base := filepath.Base(f.Name)
+	name := strings.Replace(dir, "processed/", "", 1)
+	o := fmt.Sprintf("https://storage.googleapis.com/%s/%s/%s", f.Bucket, dir, base)
+	t := fmt.Sprintf("https://storage.googleapis.com/%s/%s/%s", f.Bucket, dir, strings.Replace(base, "original.", "thumbnail.", 1))
+	c := fmt.Sprintf("/api/v1/image/%s/content", url.PathEscape(name))
+	if f.Bucket == "" {
+		o = c
+		t = c
+	}
+	tu := o
+	if f.Metadata["thumbnail"] != "" {
+		tu = fmt.Sprintf("/api/v1/image/%s/thumbnail", url.PathEscape(name))
+	}
+	img := Image{
+		ID:             name,
+		Name:           name,
+		OriginalName:   uploadName(name, f.Name, f.Metadata),
+		OriginalFormat: f.Metadata[originalFormatKey],
+		Original:       o,
+		Thumbnail:      t,
+		ThumbnailURL:   tu,
+		Content:        c,
+		SizeBytes:      f.Size,
+		ContentType:    f.ContentType,
+		Created:        f.Created,
+		Updated:        f.Updated,
+		ETag:           f.ETag,
+		Generation:     f.Generation,
+		MD5:            f.Checksums.MD5,
+		CRC32C:         f.Checksums.CRC32C,
+	}
+	// Objects uploaded before dimensions were recorded just go without
+	// them.
+	img.Width, _ = strconv.Atoi(f.Metadata["width"])
+	img.Height, _ = strconv.Atoi(f.Metadata["height"])
+	img.FrameCount, _ = strconv.Atoi(f.Metadata[frameCountKey])
+	img.Animated = f.Metadata[animatedKey] == "true"
+	img.Labels = imageLabels(f.Metadata)
+	img.DominantColor, img.BlurHash = f.Metadata[dominantColorKey], f.Metadata[blurHashKey]
+	img.PerceptualHash = f.Metadata[perceptualHashKey]
+	um := readUserMetadata(f.Metadata)
+	img.Tags, img.Metadata = um.Tags, um.Meta
+	if !um.Expires.IsZero() {
+		img.Expires = &um.Expires
+	}
+
+	return img
+}
+
+// NewImages returns a list of images in the format we need for this app.
+// The other objects kept for an image, such as its thumbnail, are passed
+// over. Anything else, like a file copied into the bucket by hand, can't
+// be read as an image, so it is skipped and counted rather than failing
+// the lot.
+func NewImages(fs CSFiles) (Images, int) {
+	is := Images{}
+	skipped := 0
+	for _, v := range fs {
+		dir, base := path.Split(v.Name)
+		switch {
+		case !strings.HasPrefix(dir, "processed/") || dir == "processed/":
+			skipped++
+		case strings.HasPrefix(base, "original."):
+			is = append(is, NewImage(v))
+		}
 	}
 
-	return bytes, nil
+	return is, skipped
 }
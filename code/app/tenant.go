@@ -0,0 +1,410 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// tenantHeader names the tenant a request is for, when BUCKETS gives each
+// tenant a bucket of its own.
+const tenantHeader = "X-Tenant"
+
+// ErrUnknownTenant is returned for requests naming no tenant, or one that
+// isn't configured.
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// tenantName is what a tenant can be called.
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// unscopedRoutes are those that have nothing to do with any one tenant's
+// or user's images, so are served without naming either.
+var unscopedRoutes = map[string]bool{
+	"/api/v1/openapi.json": true,
+	"/api/v1/docs":         true,
+	"/api/v1/whoami":       true,
+	"/api/v1/load":         true,
+	"/api/v1/admin/config": true,
+	modePath:               true,
+	chaosPath:              true,
+	gcsEventsPath:          true,
+}
+
+type tenantKey struct{}
+
+// withTenant returns a copy of ctx for tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant ctx is for, or "" if there isn't one.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// parseBuckets reads BUCKETS, a comma separated list of tenant:bucket
+// pairs.
+func parseBuckets(list []string) (map[string]string, error) {
+	buckets := map[string]string{}
+	for _, pair := range list {
+		tenant, bucket, ok := strings.Cut(pair, ":")
+		if !ok || bucket == "" || !tenantName.MatchString(tenant) {
+			return nil, fmt.Errorf("%q is not a tenant:bucket pair", pair)
+		}
+		if _, ok := buckets[tenant]; ok {
+			return nil, fmt.Errorf("tenant %s is given twice", tenant)
+		}
+		buckets[tenant] = bucket
+	}
+
+	return buckets, nil
+}
+
+// TenantStorage is a Storage that hands each call to the storage of the
+// tenant its context is for, failing with ErrUnknownTenant if there isn't
+// one. Calls for one tenant never see another's images.
+type TenantStorage struct {
+	tenants map[string]Storage
+	// close releases the tenants' storage, when they share something that
+	// mustn't be closed more than once.
+	close func() error
+}
+
+// NewTenantStorage returns a TenantStorage over tenants. Closing it calls
+// close, or if that is nil, closes each of them.
+func NewTenantStorage(tenants map[string]Storage, close func() error) *TenantStorage {
+	return &TenantStorage{tenants: tenants, close: close}
+}
+
+// NewCloudTenantStorage returns a TenantStorage with a Cloud Storage bucket
+// for each tenant, all going through a single client. Each retries
+// transient failures, counting them in m.
+func NewCloudTenantStorage(buckets map[string]string, m *Metrics) (*TenantStorage, error) {
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+
+	tenants := map[string]Storage{}
+	for tenant, bucket := range buckets {
+		tenants[tenant] = RetryStorage(&CloudStorage{Client: *client, Bucket: bucket}, m)
+	}
+
+	return NewTenantStorage(tenants, client.Close), nil
+}
+
+// Tenants returns the names of the tenants, in order.
+func (ts *TenantStorage) Tenants() []string {
+	names := make([]string, 0, len(ts.tenants))
+	for name := range ts.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// of returns the storage of the tenant ctx is for.
+func (ts *TenantStorage) of(ctx context.Context) (Storage, error) {
+	if s, ok := ts.tenants[tenantFrom(ctx)]; ok {
+		return s, nil
+	}
+
+	return nil, ErrUnknownTenant
+}
+
+func (ts *TenantStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.List(ctx, prefix, pageSize, pageToken)
+}
+
+func (ts *TenantStorage) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Walk(ctx, prefix, fn)
+}
+
+func (ts *TenantStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Read(ctx, id)
+}
+
+func (ts *TenantStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(ctx, id)
+}
+
+func (ts *TenantStorage) Versions(ctx context.Context, id string) (CSFiles, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Versions(ctx, id)
+}
+
+func (ts *TenantStorage) OpenVersion(ctx context.Context, id string, generation int64) (*CSReader, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.OpenVersion(ctx, id, generation)
+}
+
+func (ts *TenantStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return CSFile{}, err
+	}
+	return s.Create(ctx, name, file, opts)
+}
+
+func (ts *TenantStorage) Replace(ctx context.Context, id, filename string, file multipart.File, metadata map[string]string, generation int64) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Replace(ctx, id, filename, file, metadata, generation)
+}
+
+func (ts *TenantStorage) Delete(ctx context.Context, id string, generation int64) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Delete(ctx, id, generation)
+}
+
+func (ts *TenantStorage) Rename(ctx context.Context, id, newID string, overwrite bool) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Rename(ctx, id, newID, overwrite)
+}
+
+func (ts *TenantStorage) Copy(ctx context.Context, id, newID string, overwrite bool) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Copy(ctx, id, newID, overwrite)
+}
+
+func (ts *TenantStorage) Trash(ctx context.Context, id string, deleted time.Time, generation int64) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Trash(ctx, id, deleted, generation)
+}
+
+func (ts *TenantStorage) Restore(ctx context.Context, id string) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Restore(ctx, id)
+}
+
+func (ts *TenantStorage) ListTrash(ctx context.Context) (CSFiles, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ListTrash(ctx)
+}
+
+func (ts *TenantStorage) Purge(ctx context.Context, id string) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Purge(ctx, id)
+}
+
+func (ts *TenantStorage) SignedURL(ctx context.Context, id string, expires time.Time) (string, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return "", err
+	}
+	return s.SignedURL(ctx, id, expires)
+}
+
+func (ts *TenantStorage) SignedUploadURL(ctx context.Context, name, contentType string, expires time.Time) (string, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return "", err
+	}
+	return s.SignedUploadURL(ctx, name, contentType, expires)
+}
+
+func (ts *TenantStorage) PutObject(ctx context.Context, name string, r io.Reader, contentType string) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.PutObject(ctx, name, r, contentType)
+}
+
+func (ts *TenantStorage) OpenObject(ctx context.Context, name string) (*CSReader, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.OpenObject(ctx, name)
+}
+
+func (ts *TenantStorage) UpdateMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.UpdateMetadata(ctx, name, metadata)
+}
+
+func (ts *TenantStorage) DeleteObject(ctx context.Context, name string) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.DeleteObject(ctx, name)
+}
+
+func (ts *TenantStorage) ListObjects(ctx context.Context, dir string) (CSFiles, error) {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ListObjects(ctx, dir)
+}
+
+func (ts *TenantStorage) DeleteObjects(ctx context.Context, dir string) error {
+	s, err := ts.of(ctx)
+	if err != nil {
+		return err
+	}
+	return s.DeleteObjects(ctx, dir)
+}
+
+// Ping checks the storage of the tenant ctx is for, or without one, that
+// of every tenant.
+func (ts *TenantStorage) Ping(ctx context.Context) error {
+	if tenantFrom(ctx) != "" {
+		s, err := ts.of(ctx)
+		if err != nil {
+			return err
+		}
+		return s.Ping(ctx)
+	}
+
+	for _, name := range ts.Tenants() {
+		if err := ts.tenants[name].Ping(ctx); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (ts *TenantStorage) Close() error {
+	if ts.close != nil {
+		return ts.close()
+	}
+
+	var first error
+	for _, s := range ts.tenants {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ServeTenants has requests name one of tenants in the X-Tenant header,
+// turning away those that don't with a 404. The static files and the
+// endpoints that aren't about images are served regardless.
+func (s *Server) ServeTenants(tenants []string) {
+	s.tenants = tenants
+	known := map[string]bool{}
+	for _, t := range tenants {
+		known[t] = true
+	}
+
+	s.router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isStatic(r) || r.Method == http.MethodOptions || isUnscoped(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			tenant := r.Header.Get(tenantHeader)
+			if !known[tenant] {
+				writeErrorMsg(w, http.StatusNotFound, fmt.Errorf("%w %q: name one in the %s header", ErrUnknownTenant, tenant, tenantHeader))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+		})
+	})
+}
+
+// isUnscoped reports whether r was routed to an endpoint that isn't about
+// any tenant's or user's images.
+func isUnscoped(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+
+	tpl, err := route.GetPathTemplate()
+	return err == nil && unscopedRoutes[tpl]
+}
+
+// tenantContexts returns a copy of ctx for each tenant, or just ctx if
+// there are none, for work done outside of a request.
+func (s *Server) tenantContexts(ctx context.Context) []context.Context {
+	if len(s.tenants) == 0 {
+		return []context.Context{ctx}
+	}
+
+	ctxs := make([]context.Context, len(s.tenants))
+	for i, t := range s.tenants {
+		ctxs[i] = withTenant(ctx, t)
+	}
+	return ctxs
+}
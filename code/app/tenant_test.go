@@ -0,0 +1,187 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// newTenantServer returns a server for tenants a and b, each with memory
+// storage of its own, with the caches that could mix them up turned on.
+func newTenantServer(t *testing.T) (*Server, map[string]*MemoryStorage) {
+	t.Helper()
+
+	stores := map[string]*MemoryStorage{"a": NewMemoryStorage(), "b": NewMemoryStorage()}
+	tenants := map[string]Storage{}
+	for name, ms := range stores {
+		tenants[name] = ms
+	}
+	ts := NewTenantStorage(tenants, nil)
+
+	server := NewServer(CoalesceStorage(ts, nil))
+	server.CacheContent(NewContentCache(1<<20, 1<<20, nil))
+	server.ServeTenants(ts.Tenants())
+
+	return server, stores
+}
+
+// tenantRequest sends a request for tenant to server.
+func tenantRequest(server *Server, r *http.Request, tenant string) *httptest.ResponseRecorder {
+	if tenant != "" {
+		r.Header.Set(tenantHeader, tenant)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+func tenantIDs(t *testing.T, server *Server, tenant string) []string {
+	t.Helper()
+
+	w := tenantRequest(server, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil), tenant)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	page := ImagePage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	ids := []string{}
+	for _, i := range page.Images {
+		ids = append(ids, i.ID)
+	}
+	return ids
+}
+
+func TestTenantIsolation(t *testing.T) {
+	server, stores := newTenantServer(t)
+
+	// Listing b first caches an empty page, which a mustn't be given.
+	if ids := tenantIDs(t, server, "b"); len(ids) != 0 {
+		t.Fatalf("expected no images for b, got: %v", ids)
+	}
+
+	w := tenantRequest(server, newUploadRequest(t, http.MethodPost, "/api/v1/image", "x.png", "image/png", testPNG(t)), "a")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if _, err := stores["a"].Read(context.Background(), "x"); err != nil {
+		t.Fatalf("expected the upload in a's storage, got: %v", err)
+	}
+	if _, err := stores["b"].Read(context.Background(), "x"); err != ErrNotFound {
+		t.Fatalf("expected nothing in b's storage, got: %v", err)
+	}
+
+	if ids := tenantIDs(t, server, "a"); !reflect.DeepEqual(ids, []string{"x"}) {
+		t.Fatalf("expected a to list x, got: %v", ids)
+	}
+	if ids := tenantIDs(t, server, "b"); len(ids) != 0 {
+		t.Fatalf("expected b to list nothing, got: %v", ids)
+	}
+
+	// a's image is there for a, and served from the cache next time, but
+	// never for b.
+	for i := 0; i < 2; i++ {
+		if w := tenantRequest(server, httptest.NewRequest(http.MethodGet, "/api/v1/image/x/content", nil), "a"); w.Code != http.StatusOK {
+			t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+		}
+	}
+	for _, target := range []string{"/api/v1/image/x", "/api/v1/image/x/content"} {
+		if w := tenantRequest(server, httptest.NewRequest(http.MethodGet, target, nil), "b"); w.Code != http.StatusNotFound {
+			t.Fatalf("GET %s for b expected: %v, got: %v", target, http.StatusNotFound, w.Code)
+		}
+	}
+
+	// The same content in b isn't a duplicate of a's.
+	w = tenantRequest(server, newUploadRequest(t, http.MethodPost, "/api/v1/image", "y.png", "image/png", testPNG(t)), "b")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	// Deleting in b leaves a's image of the same name alone.
+	if w := tenantRequest(server, httptest.NewRequest(http.MethodDelete, "/api/v1/image/x", nil), "b"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+	if w := tenantRequest(server, httptest.NewRequest(http.MethodDelete, "/api/v1/image/y", nil), "a"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+	if ids := tenantIDs(t, server, "a"); !reflect.DeepEqual(ids, []string{"x"}) {
+		t.Fatalf("expected a to still list x, got: %v", ids)
+	}
+
+	for tenant, want := range map[string]int{"a": 1, "b": 1} {
+		w := tenantRequest(server, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil), tenant)
+		st := Stats{}
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if st.Images != want {
+			t.Fatalf("expected %d images for %s, got: %d", want, tenant, st.Images)
+		}
+	}
+}
+
+func TestUnknownTenant(t *testing.T) {
+	server, _ := newTenantServer(t)
+
+	for _, tenant := range []string{"", "c"} {
+		w := tenantRequest(server, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil), tenant)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("tenant %q expected: %v, got: %v", tenant, http.StatusNotFound, w.Code)
+		}
+	}
+
+	// Endpoints that aren't about images don't need one.
+	for _, target := range []string{"/api/v1/whoami", "/api/v1/openapi.json", "/healthz", "/readyz"} {
+		if w := tenantRequest(server, httptest.NewRequest(http.MethodGet, target, nil), ""); w.Code != http.StatusOK {
+			t.Fatalf("GET %s expected: %v, got: %v", target, http.StatusOK, w.Code)
+		}
+	}
+}
+
+func TestTenantStorageNeedsTenant(t *testing.T) {
+	ts := NewTenantStorage(map[string]Storage{"a": newTestMemoryStorage(t, "x.png")}, nil)
+
+	if _, err := ts.Read(context.Background(), "x"); err != ErrUnknownTenant {
+		t.Fatalf("expected: %v, got: %v", ErrUnknownTenant, err)
+	}
+	if _, err := ts.Read(withTenant(context.Background(), "a"), "x"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := ts.Ping(context.Background()); err != nil {
+		t.Fatalf("expected every tenant to answer, got: %v", err)
+	}
+}
+
+func TestParseBuckets(t *testing.T) {
+	buckets, err := parseBuckets([]string{"teamA:bucket-a", "teamB:bucket-b"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if want := map[string]string{"teamA": "bucket-a", "teamB": "bucket-b"}; !reflect.DeepEqual(buckets, want) {
+		t.Fatalf("expected: %v, got: %v", want, buckets)
+	}
+
+	for _, list := range [][]string{{"teamA"}, {"teamA:"}, {":bucket"}, {"team/a:bucket"}, {"a:x", "a:y"}} {
+		if _, err := parseBuckets(list); err == nil {
+			t.Fatalf("expected an error for %v", list)
+		}
+	}
+}
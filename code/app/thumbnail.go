@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+)
+
+// thumbnailSize is the longest edge, in pixels, of generated thumbnails.
+var thumbnailSize = 256
+
+// thumbnailPrefix is where generated thumbnails are stored.
+const thumbnailPrefix = "thumbs"
+
+// thumbnailName is where the thumbnail for image id is stored.
+func thumbnailName(id string) string {
+	return fmt.Sprintf("%s/%s", thumbnailPrefix, id)
+}
+
+// makeThumbnail decodes an image from r and scales it down to fit within a
+// max by max square, keeping its aspect ratio. JPEGs stay JPEGs, everything
+// else becomes a PNG. Images that already fit are re-encoded unscaled. Only
+// the first frame of an animated GIF is decoded, and that is its thumbnail.
+func makeThumbnail(r io.Reader, max int) ([]byte, string, error) {
+	src, format, err := decodeImage(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decode image: %s", err)
+	}
+
+	return encodeImage(scaleToFit(src, max, max), format)
+}
+
+// encodeImage encodes img as a JPEG if it was decoded from one, or as a PNG
+// otherwise.
+func encodeImage(img image.Image, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var err error
+	contentType := "image/png"
+	if format == "jpeg" {
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("could not encode image: %s", err)
+	}
+
+	return buf.Bytes(), contentType, nil
+}
+
+// scaleToFit returns src scaled down to fit within w by h, keeping its
+// aspect ratio. Images that already fit are returned as they are.
+func scaleToFit(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= w && b.Dy() <= h {
+		return src
+	}
+
+	dw, dh := w, b.Dy()*w/b.Dx()
+	if dh > h {
+		dw, dh = b.Dx()*h/b.Dy(), h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+
+	return dst
+}
+
+// thumbnail is a generated thumbnail waiting to be stored.
+type thumbnail struct {
+	data        []byte
+	contentType string
+}
+
+// metadata marks the original as having a thumbnail, if there is one.
+func (t *thumbnail) metadata() map[string]string {
+	if t == nil {
+		return nil
+	}
+
+	return map[string]string{"thumbnail": "true"}
+}
+
+// thumbnail makes a thumbnail of an upload and rewinds it. Files that can't
+// be decoded just don't get one; their listings fall back to the original.
+func (s *Server) thumbnail(ctx context.Context, file multipart.File) *thumbnail {
+	_, span := startSpan(ctx, "thumbnail")
+	defer span.End()
+
+	data, contentType, err := makeThumbnail(file, thumbnailSize)
+	if _, serr := file.Seek(0, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	if err != nil {
+		logJSON(SeverityWarning, LogEntry{Message: fmt.Sprintf("no thumbnail generated: %s", err)})
+		return nil
+	}
+
+	return &thumbnail{data, contentType}
+}
+
+// storeThumbnail writes the thumbnail for image id. A failure here doesn't
+// undo the upload it belongs to.
+func (s *Server) storeThumbnail(ctx context.Context, id string, t *thumbnail) {
+	if t == nil {
+		return
+	}
+
+	if err := s.storage.PutObject(ctx, thumbnailName(id), bytes.NewReader(t.data), t.contentType); err != nil {
+		weblog(fmt.Sprintf("error storing thumbnail for %s: %s", id, err))
+	}
+}
+
+// thumbnailHandler serves the generated thumbnail for an image.
+func (s *Server) thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	obj, err := s.storage.OpenObject(r.Context(), thumbnailName(id))
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to open thumbnail %s: %v", id, err))
+		return
+	}
+	defer obj.Close()
+
+	writeObject(w, r, obj)
+}
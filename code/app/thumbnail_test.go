@@ -0,0 +1,148 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScaleToFit(t *testing.T) {
+	type test struct {
+		w, h  int
+		max   int
+		wantW int
+		wantH int
+	}
+
+	tests := []test{
+		{w: 1000, h: 500, max: 256, wantW: 256, wantH: 128},
+		{w: 500, h: 1000, max: 256, wantW: 128, wantH: 256},
+		{w: 100, h: 50, max: 256, wantW: 100, wantH: 50},
+		{w: 5000, h: 2, max: 256, wantW: 256, wantH: 1},
+	}
+
+	for _, c := range tests {
+		got := scaleToFit(image.NewRGBA(image.Rect(0, 0, c.w, c.h)), c.max, c.max).Bounds()
+		if got.Dx() != c.wantW || got.Dy() != c.wantH {
+			t.Fatalf("expected: %dx%d, got: %dx%d", c.wantW, c.wantH, got.Dx(), got.Dy())
+		}
+	}
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	var src bytes.Buffer
+	if err := jpeg.Encode(&src, image.NewRGBA(image.Rect(0, 0, 800, 600)), nil); err != nil {
+		t.Fatalf("could not encode test image: %s", err)
+	}
+
+	type test struct {
+		input    []byte
+		wantType string
+		wantMax  int
+	}
+
+	tests := []test{
+		{input: testPNG(t), wantType: "image/png", wantMax: 256},
+		{input: src.Bytes(), wantType: "image/jpeg", wantMax: 256},
+	}
+
+	for _, c := range tests {
+		data, contentType, err := makeThumbnail(bytes.NewReader(c.input), 256)
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		if contentType != c.wantType {
+			t.Fatalf("expected: %v, got: %v", c.wantType, contentType)
+		}
+
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("could not decode thumbnail: %s", err)
+		}
+		if cfg.Width != c.wantMax && cfg.Height != c.wantMax {
+			t.Fatalf("expected longest edge of %d, got: %dx%d", c.wantMax, cfg.Width, cfg.Height)
+		}
+	}
+
+	if _, _, err := makeThumbnail(bytes.NewReader([]byte("GIF89a")), 256); err == nil {
+		t.Fatalf("expected error for an undecodable image")
+	}
+}
+
+func TestThumbnailLifecycle(t *testing.T) {
+	ms := NewMemoryStorage()
+	server := NewServer(ms)
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "RetoColt.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if img.ThumbnailURL != "/api/v1/image/RetoColt/thumbnail" {
+		t.Fatalf("expected: %v, got: %v", "/api/v1/image/RetoColt/thumbnail", img.ThumbnailURL)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, img.ThumbnailURL, nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+	cfg, _, err := image.DecodeConfig(w.Body)
+	if err != nil {
+		t.Fatalf("could not decode thumbnail: %s", err)
+	}
+	if cfg.Width > thumbnailSize || cfg.Height > thumbnailSize {
+		t.Fatalf("expected thumbnail within %d, got: %dx%d", thumbnailSize, cfg.Width, cfg.Height)
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/v1/image/RetoColt?hard=true", nil)
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	if _, err := ms.OpenObject(context.Background(), thumbnailName("RetoColt")); err != ErrNotFound {
+		t.Fatalf("expected thumbnail to be deleted, got: %v", err)
+	}
+}
+
+func TestThumbnailFallback(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "broken.gif", "image/gif", []byte("GIF89a"))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if img.ThumbnailURL != img.Original {
+		t.Fatalf("expected: %v, got: %v", img.Original, img.ThumbnailURL)
+	}
+}
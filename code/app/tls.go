@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// certReloader serves the certificate in certFile and keyFile, loading them
+// again when asked to so that they can be rotated without a restart.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// newCertReloader returns a certReloader with the certificate loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// reload loads the certificate again. If that fails the one loaded before
+// is kept.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate %s: %v", c.certFile, err)
+	}
+	c.cert.Store(&cert)
+
+	return nil
+}
+
+// GetCertificate is for tls.Config.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// watch reloads the certificate on every signal from hup until ctx is done.
+func (c *certReloader) watch(ctx context.Context, hup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := c.reload(); err != nil {
+				weblog(fmt.Sprintf("failed to reload certificate, keeping the old one: %v", err))
+				continue
+			}
+			logJSON(SeverityInfo, LogEntry{Message: fmt.Sprintf("reloaded certificate %s", c.certFile)})
+		}
+	}
+}
+
+// useTLS has srv serve HTTPS with the certificate from c. HTTP/2 is
+// offered alongside HTTP/1.1.
+func useTLS(srv *http.Server, c *certReloader) {
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// useH2C has srv take HTTP/2 without TLS, for load balancers that end
+// TLS but still speak HTTP/2 to the backend.
+func useH2C(srv *http.Server) {
+	srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{})
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with the
+// given serial number to dir, returning the paths of it and its key.
+func writeTestCert(t *testing.T, dir string, serial int64) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "scaler test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %s", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("could not write certificate: %s", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("could not write key: %s", err)
+	}
+
+	return certFile, keyFile
+}
+
+// startServer serves handler on a local port with serve, stopping it when
+// the test ends.
+func startServer(t *testing.T, srv *http.Server) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, ln, stop, time.Second)
+	}()
+	t.Cleanup(func() {
+		stop <- syscall.SIGTERM
+		<-served
+	})
+
+	return ln.Addr().String()
+}
+
+func protoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), 1)
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	srv := &http.Server{Handler: protoHandler()}
+	useTLS(srv, certs)
+	addr := startServer(t, srv)
+
+	serial := func() int64 {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get("https://" + addr)
+		if err != nil {
+			t.Fatalf("expected no error, got: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("expected HTTP/2, got: %s", resp.Proto)
+		}
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if n := serial(); n != 1 {
+		t.Fatalf("expected the first certificate, got serial: %d", n)
+	}
+
+	// A signal picks up a rotated certificate, and a broken one is ignored.
+	hup := make(chan os.Signal)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go certs.watch(ctx, hup)
+
+	writeTestCert(t, filepath.Dir(certFile), 2)
+	hup <- syscall.SIGHUP
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("could not write key: %s", err)
+	}
+	hup <- syscall.SIGHUP
+	// The watcher has finished the first reload once it takes the second
+	// signal; one more makes sure it has finished the second.
+	hup <- syscall.SIGHUP
+
+	if n := serial(); n != 2 {
+		t.Fatalf("expected the rotated certificate, got serial: %d", n)
+	}
+}
+
+func TestNewCertReloaderMissing(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Fatalf("expected an error for missing files")
+	}
+}
+
+func TestServeH2C(t *testing.T) {
+	srv := &http.Server{Handler: protoHandler()}
+	useH2C(srv)
+	addr := startServer(t, srv)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got: %s", resp.Proto)
+	}
+
+	// HTTP/1.1 clients are still served.
+	resp, err = http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Fatalf("expected HTTP/1.1, got: %s", resp.Proto)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name spans are created under.
+const tracerName = "scaler"
+
+// defaultServiceName is reported when OTEL_SERVICE_NAME isn't set.
+const defaultServiceName = "scaler"
+
+// tracePropagator reads the trace context callers propagate, for both HTTP
+// requests and gRPC calls.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// NewTracerProvider returns a provider that exports spans over OTLP, set up
+// by the standard OTEL_EXPORTER_OTLP_* variables, or nil if no endpoint is
+// configured and tracing should stay off.
+func NewTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP exporter: %s", err)
+	}
+
+	name := os.Getenv("OTEL_SERVICE_NAME")
+	if name == "" {
+		name = defaultServiceName
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(name))),
+	)
+
+	return tp, nil
+}
+
+// EnableTracing starts a span for every request apart from the health
+// endpoints, and every gRPC call, named after the route or method and
+// continuing any trace the caller propagated. Storage passed to the Server
+// should be wrapped with TraceStorage for its calls to show up as children.
+func (s *Server) EnableTracing(tp trace.TracerProvider) {
+	s.tracing = tp
+	s.Use(func(next http.Handler) http.Handler {
+		return otelhttp.NewHandler(next, "http.server",
+			otelhttp.WithTracerProvider(tp),
+			otelhttp.WithPropagators(tracePropagator),
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return r.Method + " " + routeLabel(s.router, r)
+			}),
+		)
+	})
+}
+
+// startSpan starts a child of the span in ctx, if there is one. Without one
+// the span does nothing.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if err is one worth knowing about.
+// Missing images and conflicts are answers, not failures.
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != ErrNotFound && err != ErrConflict {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceStorage wraps s so that each of its operations is a span.
+func TraceStorage(s Storage) Storage {
+	return tracedStorage{s}
+}
+
+// tracedStorage is a Storage whose operations are spans under the request
+// that made them.
+type tracedStorage struct {
+	Storage
+}
+
+func (s tracedStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	ctx, span := startSpan(ctx, "Storage.List", attribute.String("prefix", prefix), attribute.Int("pageSize", pageSize))
+	fs, next, err := s.Storage.List(ctx, prefix, pageSize, pageToken)
+	endSpan(span, err)
+	return fs, next, err
+}
+
+func (s tracedStorage) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	ctx, span := startSpan(ctx, "Storage.Walk", attribute.String("prefix", prefix))
+	err := s.Storage.Walk(ctx, prefix, fn)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	ctx, span := startSpan(ctx, "Storage.Read", attribute.String("id", id))
+	fs, err := s.Storage.Read(ctx, id)
+	endSpan(span, err)
+	return fs, err
+}
+
+func (s tracedStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	ctx, span := startSpan(ctx, "Storage.Open", attribute.String("id", id))
+	cr, err := s.Storage.Open(ctx, id)
+	endSpan(span, err)
+	return cr, err
+}
+
+func (s tracedStorage) Versions(ctx context.Context, id string) (CSFiles, error) {
+	ctx, span := startSpan(ctx, "Storage.Versions", attribute.String("id", id))
+	fs, err := s.Storage.Versions(ctx, id)
+	endSpan(span, err)
+	return fs, err
+}
+
+func (s tracedStorage) OpenVersion(ctx context.Context, id string, generation int64) (*CSReader, error) {
+	ctx, span := startSpan(ctx, "Storage.OpenVersion", attribute.String("id", id), attribute.Int64("generation", generation))
+	cr, err := s.Storage.OpenVersion(ctx, id, generation)
+	endSpan(span, err)
+	return cr, err
+}
+
+func (s tracedStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	ctx, span := startSpan(ctx, "Storage.Create", attribute.String("name", name))
+	f, err := s.Storage.Create(ctx, name, file, opts)
+	endSpan(span, err)
+	return f, err
+}
+
+func (s tracedStorage) Replace(ctx context.Context, id, filename string, file multipart.File, metadata map[string]string, generation int64) error {
+	ctx, span := startSpan(ctx, "Storage.Replace", attribute.String("id", id))
+	err := s.Storage.Replace(ctx, id, filename, file, metadata, generation)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) Delete(ctx context.Context, id string, generation int64) error {
+	ctx, span := startSpan(ctx, "Storage.Delete", attribute.String("id", id))
+	err := s.Storage.Delete(ctx, id, generation)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) Rename(ctx context.Context, id, newID string, overwrite bool) error {
+	ctx, span := startSpan(ctx, "Storage.Rename", attribute.String("id", id), attribute.String("newID", newID))
+	err := s.Storage.Rename(ctx, id, newID, overwrite)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) Copy(ctx context.Context, id, newID string, overwrite bool) error {
+	ctx, span := startSpan(ctx, "Storage.Copy", attribute.String("id", id), attribute.String("newID", newID))
+	err := s.Storage.Copy(ctx, id, newID, overwrite)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) Trash(ctx context.Context, id string, deleted time.Time, generation int64) error {
+	ctx, span := startSpan(ctx, "Storage.Trash", attribute.String("id", id))
+	err := s.Storage.Trash(ctx, id, deleted, generation)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) Restore(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, "Storage.Restore", attribute.String("id", id))
+	err := s.Storage.Restore(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) ListTrash(ctx context.Context) (CSFiles, error) {
+	ctx, span := startSpan(ctx, "Storage.ListTrash")
+	fs, err := s.Storage.ListTrash(ctx)
+	endSpan(span, err)
+	return fs, err
+}
+
+func (s tracedStorage) Purge(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, "Storage.Purge", attribute.String("id", id))
+	err := s.Storage.Purge(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) SignedURL(ctx context.Context, id string, expires time.Time) (string, error) {
+	ctx, span := startSpan(ctx, "Storage.SignedURL", attribute.String("id", id))
+	u, err := s.Storage.SignedURL(ctx, id, expires)
+	endSpan(span, err)
+	return u, err
+}
+
+func (s tracedStorage) SignedUploadURL(ctx context.Context, name, contentType string, expires time.Time) (string, error) {
+	ctx, span := startSpan(ctx, "Storage.SignedUploadURL", attribute.String("name", name))
+	u, err := s.Storage.SignedUploadURL(ctx, name, contentType, expires)
+	endSpan(span, err)
+	return u, err
+}
+
+func (s tracedStorage) PutObject(ctx context.Context, name string, r io.Reader, contentType string) error {
+	ctx, span := startSpan(ctx, "Storage.PutObject", attribute.String("name", name))
+	err := s.Storage.PutObject(ctx, name, r, contentType)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) OpenObject(ctx context.Context, name string) (*CSReader, error) {
+	ctx, span := startSpan(ctx, "Storage.OpenObject", attribute.String("name", name))
+	cr, err := s.Storage.OpenObject(ctx, name)
+	endSpan(span, err)
+	return cr, err
+}
+
+func (s tracedStorage) UpdateMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	ctx, span := startSpan(ctx, "Storage.UpdateMetadata", attribute.String("name", name))
+	err := s.Storage.UpdateMetadata(ctx, name, metadata)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) DeleteObject(ctx context.Context, name string) error {
+	ctx, span := startSpan(ctx, "Storage.DeleteObject", attribute.String("name", name))
+	err := s.Storage.DeleteObject(ctx, name)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) ListObjects(ctx context.Context, dir string) (CSFiles, error) {
+	ctx, span := startSpan(ctx, "Storage.ListObjects", attribute.String("dir", dir))
+	fs, err := s.Storage.ListObjects(ctx, dir)
+	endSpan(span, err)
+	return fs, err
+}
+
+func (s tracedStorage) DeleteObjects(ctx context.Context, dir string) error {
+	ctx, span := startSpan(ctx, "Storage.DeleteObjects", attribute.String("dir", dir))
+	err := s.Storage.DeleteObjects(ctx, dir)
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	server := NewServer(TraceStorage(NewMemoryStorage()))
+	server.EnableTracing(tp)
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "a.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = s
+	}
+
+	root, ok := spans["POST /api/v1/image"]
+	if !ok {
+		t.Fatalf("expected a span for the request, got: %v", spans)
+	}
+
+	for _, name := range []string{"stageUploads", "checkMimeType", "thumbnail", "Storage.Create", "Storage.PutObject"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Fatalf("expected a %s span, got: %v", name, spans)
+		}
+		if s.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Fatalf("expected %s to be a child of the request span", name)
+		}
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+	tp, err := NewTracerProvider(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if tp != nil {
+		t.Fatalf("expected no provider without an endpoint, got: %v", tp)
+	}
+}
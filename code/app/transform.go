@@ -0,0 +1,352 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+)
+
+// CropRect is the part of an image a crop keeps, in pixels from its top
+// left corner.
+type CropRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// TransformRequest edits an image: it is rotated clockwise by Rotate
+// degrees, a multiple of 90, and cropped to Crop, in the order they are
+// given in. The result replaces the image, or with Destination is stored
+// as a new one under that filename.
+type TransformRequest struct {
+	Rotate      int       `json:"rotate,omitempty"`
+	Crop        *CropRect `json:"crop,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+}
+
+// transformOp is one of the operations of a transform: a rotation, or a
+// crop when crop is set.
+type transformOp struct {
+	rotate int
+	crop   *CropRect
+}
+
+// parseTransform reads a TransformRequest from r, along with its operations
+// in the order the body gives them, which a struct alone would lose.
+func parseTransform(r io.Reader) (TransformRequest, []transformOp, error) {
+	req := TransformRequest{}
+	ops := []transformOp{}
+
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return req, nil, errors.New("want a JSON object")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return req, nil, err
+		}
+		switch key := t.(string); key {
+		case "rotate":
+			if err := dec.Decode(&req.Rotate); err != nil {
+				return req, nil, fmt.Errorf("invalid rotate: %s", err)
+			}
+			if req.Rotate%90 != 0 {
+				return req, nil, fmt.Errorf("invalid rotate %d: want a multiple of 90", req.Rotate)
+			}
+			ops = append(ops, transformOp{rotate: (req.Rotate%360 + 360) % 360})
+		case "crop":
+			c := CropRect{}
+			if err := dec.Decode(&c); err != nil {
+				return req, nil, fmt.Errorf("invalid crop: %s", err)
+			}
+			if c.X < 0 || c.Y < 0 || c.W < 1 || c.H < 1 {
+				return req, nil, fmt.Errorf("invalid crop %+v: want a non-negative x and y, and a positive w and h", c)
+			}
+			req.Crop = &c
+			ops = append(ops, transformOp{crop: &c})
+		case "destination":
+			if err := dec.Decode(&req.Destination); err != nil {
+				return req, nil, fmt.Errorf("invalid destination: %s", err)
+			}
+		default:
+			return req, nil, fmt.Errorf("unknown field %q", key)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return req, nil, err
+	}
+
+	if len(ops) == 0 {
+		return req, nil, errors.New("nothing to do: want rotate or crop")
+	}
+	return req, ops, nil
+}
+
+// apply applies op to img. A crop that doesn't lie inside img is an
+// invalid argument.
+func (op transformOp) apply(img image.Image) (image.Image, error) {
+	if op.crop != nil {
+		b := img.Bounds()
+		c := *op.crop
+		if c.X+c.W > b.Dx() || c.Y+c.H > b.Dy() {
+			return nil, invalidArgument(fmt.Errorf("invalid crop %+v: outside the %dx%d image", c, b.Dx(), b.Dy()))
+		}
+		r := image.Rect(c.X, c.Y, c.X+c.W, c.Y+c.H).Add(b.Min)
+		return img.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(r), nil
+	}
+
+	return rotate(img, op.rotate), nil
+}
+
+// rotate turns img clockwise by degrees, a multiple of 90 from 0 to 270.
+func rotate(img image.Image, degrees int) image.Image {
+	if degrees == 0 {
+		return img
+	}
+
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := sh, sw
+	if degrees == 180 {
+		w, h = sw, sh
+	}
+	dst := newLike(img, w, h)
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			c := img.At(b.Min.X+x, b.Min.Y+y)
+			switch degrees {
+			case 90:
+				dst.Set(sh-1-y, x, c)
+			case 180:
+				dst.Set(sw-1-x, sh-1-y, c)
+			case 270:
+				dst.Set(y, sw-1-x, c)
+			}
+		}
+	}
+
+	return dst
+}
+
+// newLike returns a blank w by h image that holds the same colors as img
+// without loss: a paletted image gets the same palette, so that a GIF
+// isn't dithered when it is encoded again.
+func newLike(img image.Image, w, h int) draw.Image {
+	r := image.Rect(0, 0, w, h)
+	switch img := img.(type) {
+	case *image.Paletted:
+		return image.NewPaletted(r, img.Palette)
+	case *image.Gray:
+		return image.NewGray(r)
+	case *image.Gray16:
+		return image.NewGray16(r)
+	case *image.RGBA64, *image.NRGBA64:
+		return image.NewNRGBA64(r)
+	default:
+		return image.NewNRGBA(r)
+	}
+}
+
+// transformImage decodes data, applies ops to it in turn and encodes it
+// again in the same format, which it returns the content type of. Data
+// that can't be decoded is an unprocessable entity, and animated GIFs
+// aren't supported.
+func (s *Server) transformImage(ctx context.Context, data []byte, ops []transformOp) ([]byte, string, error) {
+	if animated(data) {
+		return nil, "", notImplemented(errors.New("animated images can't be transformed"))
+	}
+	img, format, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", unprocessable(fmt.Errorf("could not decode image: %s", err))
+	}
+
+	for _, op := range ops {
+		if img, err = op.apply(img); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return s.encodeAs(ctx, img, format)
+}
+
+// encodeAs encodes img in format, as image.Decode names it, and returns
+// its content type. Anything but a GIF or WebP is a JPEG or a PNG, and so
+// is a WebP when the server has no encoder for it.
+func (s *Server) encodeAs(ctx context.Context, img image.Image, format string) ([]byte, string, error) {
+	switch {
+	case format == "gif":
+		var buf bytes.Buffer
+		if err := gif.Encode(&buf, img, nil); err != nil {
+			return nil, "", fmt.Errorf("could not encode image: %s", err)
+		}
+		return buf.Bytes(), "image/gif", nil
+	case format == "webp" && s.webp != nil:
+		data, err := s.encodeWebP(ctx, img, 100)
+		return data, "image/webp", err
+	default:
+		return encodeImage(img, format)
+	}
+}
+
+// transformHandler rotates and crops an image, replacing it with the
+// result or storing that as a new image under the request's destination,
+// and responds with the image it is in. Either way it keeps the format and
+// the tags and metadata of the image.
+func (s *Server) transformHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	generation, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	req, ops, err := parseTransform(http.MaxBytesReader(w, r.Body, maxNameBodyBytes))
+	if err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return
+	}
+
+	fs, err := s.storage.Read(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", id, err))
+		return
+	}
+	if err := checkGeneration(fs, generation); err != nil {
+		writeError(w, err)
+		return
+	}
+	original, ok := originalFile(fs)
+	if !ok {
+		writeNotFound(w, id)
+		return
+	}
+
+	name, newID := "", id
+	if req.Destination != "" {
+		if name, err = sanitizeFilename(req.Destination); err != nil {
+			writeError(w, invalidArgument(err))
+			return
+		}
+		// The format is kept, so the extension has to be.
+		if ext := filepath.Ext(original.Name); !strings.EqualFold(filepath.Ext(name), ext) {
+			writeError(w, invalidArgument(fmt.Errorf("invalid destination %q: want the extension %s", name, ext)))
+			return
+		}
+		newID = imageID(objectName(name))
+	}
+
+	obj, err := s.storage.OpenObject(r.Context(), original.Name)
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to open image %s: %w", id, err))
+		return
+	}
+	data, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read image %s: %w", id, err))
+		return
+	}
+
+	data, contentType, err := s.transformImage(r.Context(), data, ops)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	um := readUserMetadata(original.Metadata)
+	if newID != id {
+		img, status, err := s.storeObject(r.Context(), objectName(name), name, contentType, newMemoryFile(data), uploadOptions{
+			Overwrite:   r.URL.Query().Get("overwrite") == "true",
+			Force:       true,
+			KeepExif:    true,
+			Watermarked: true,
+			Metadata:    um,
+		})
+		if err != nil {
+			writeUploadError(w, status, err)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(img.Name)))
+		writeJSON(w, img, http.StatusCreated)
+		return
+	}
+
+	img, err := s.replaceContent(r.Context(), id, original, newMemoryFile(data), contentType, um, generation)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, img, http.StatusOK)
+}
+
+// replaceContent replaces the contents of image id, whose original is
+// original, with file, keeping its name and the metadata um, and returns
+// it as it is now.
+func (s *Server) replaceContent(ctx context.Context, id string, original CSFile, file multipart.File, contentType string, um userMetadata, generation int64) (Image, error) {
+	sum, err := contentSum(file)
+	if err != nil {
+		return Image{}, fmt.Errorf("error reading file: %w", err)
+	}
+	thumb := s.thumbnail(ctx, file)
+
+	metadata := copyMetadata(uploadMetadata(file, thumb))
+	if name, ok := original.Metadata[originalNameKey]; ok {
+		metadata[originalNameKey] = name
+	}
+	for k, v := range um.objectMetadata(nil) {
+		metadata[k] = v
+	}
+
+	if err := s.storage.Replace(ctx, id, filepath.Base(original.Name), file, metadata, generation); err != nil {
+		return Image{}, fmt.Errorf("error replacing file: %w", err)
+	}
+
+	s.storeThumbnail(ctx, id, thumb)
+	s.dropVariants(ctx, id)
+	s.contents.of(ctx).add(id, sum)
+
+	fs, err := s.storage.Read(ctx, id)
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to read files %s: %w", id, err)
+	}
+	img, _ := originalFile(fs)
+	updated := NewImage(img)
+	s.notify(ctx, ImageEvent{Action: actionUpdated, ID: id, Size: updated.SizeBytes, ContentType: contentType, image: &updated})
+
+	return updated, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// transform posts body to the transform endpoint of image id.
+func transform(t *testing.T, server *Server, id, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/image/"+id+":transform", strings.NewReader(body)))
+	return w
+}
+
+// contentSize returns the dimensions of the content of image id.
+func contentSize(t *testing.T, server *Server, id string) image.Point {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/"+id+"/content", nil))
+	cfg, _, err := image.DecodeConfig(w.Body)
+	if err != nil {
+		t.Fatalf("could not decode %s: %s", id, err)
+	}
+	return image.Pt(cfg.Width, cfg.Height)
+}
+
+func TestRotate(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	for degrees, want := range map[int][]color.NRGBA{
+		90:  {red, blue},
+		180: {blue, red},
+		270: {blue, red},
+	} {
+		got := rotate(src, degrees)
+		var pixels []color.NRGBA
+		for y := 0; y < got.Bounds().Dy(); y++ {
+			for x := 0; x < got.Bounds().Dx(); x++ {
+				pixels = append(pixels, color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA))
+			}
+		}
+		if len(pixels) != 2 || pixels[0] != want[0] || pixels[1] != want[1] {
+			t.Errorf("%d: expected: %v, got: %v", degrees, want, pixels)
+		}
+		if tall := got.Bounds().Dy() == 2; tall != (degrees != 180) {
+			t.Errorf("%d: unexpected bounds %v", degrees, got.Bounds())
+		}
+	}
+}
+
+func TestTransformInPlace(t *testing.T) {
+	server, ms := newResizeServer(t)
+	fs, _ := ms.Read(context.Background(), "wide")
+	original, _ := originalFile(fs)
+	if err := ms.UpdateMetadata(context.Background(), original.Name, map[string]string{tagsKey: "kept"}); err != nil {
+		t.Fatalf("could not tag wide: %s", err)
+	}
+	thumb := []byte("stale")
+	ms.PutObject(context.Background(), thumbnailName("wide"), bytes.NewReader(thumb), "image/png")
+
+	// The crop is of the rotated image, which it wouldn't fit before.
+	w := transform(t, server, "wide", `{"rotate": 90, "crop": {"x": 10, "y": 0, "w": 150, "h": 300}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var img Image
+	json.Unmarshal(w.Body.Bytes(), &img)
+	if img.Name != "wide" || img.ContentType != "image/png" || len(img.Tags) != 1 || img.Tags[0] != "kept" {
+		t.Fatalf("expected wide, still a tagged PNG, got: %+v", img)
+	}
+	if got := contentSize(t, server, "wide"); got != image.Pt(150, 300) {
+		t.Fatalf("expected 150x300, got: %v", got)
+	}
+	if obj, err := ms.OpenObject(context.Background(), thumbnailName("wide")); err == nil {
+		var b bytes.Buffer
+		b.ReadFrom(obj)
+		obj.Close()
+		if bytes.Equal(b.Bytes(), thumb) {
+			t.Fatalf("expected the thumbnail to be made again")
+		}
+	}
+
+	// In the other order, the crop doesn't fit.
+	w = transform(t, server, "wide", `{"crop": {"x": 0, "y": 0, "w": 300, "h": 150}, "rotate": 90}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
+
+func TestTransformToDestination(t *testing.T) {
+	server, _ := newResizeServer(t)
+
+	w := transform(t, server, "wide", `{"rotate": -90, "destination": "tall.png"}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/api/v1/image/tall" {
+		t.Fatalf("expected tall to be created, got: %v %s", w.Code, w.Body.String())
+	}
+	if got := contentSize(t, server, "tall"); got != image.Pt(200, 400) {
+		t.Fatalf("expected 200x400, got: %v", got)
+	}
+	if got := contentSize(t, server, "wide"); got != image.Pt(400, 200) {
+		t.Fatalf("expected wide to be left alone, got: %v", got)
+	}
+
+	w = transform(t, server, "wide", `{"rotate": 180, "destination": "tall.png"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	server, ms := newResizeServer(t)
+	if _, err := ms.Create(context.Background(), "broken.png", newMemoryFile([]byte("not an image")), CreateOptions{}); err != nil {
+		t.Fatalf("could not create broken.png: %s", err)
+	}
+
+	for body, want := range map[string]int{
+		`{"rotate": 45}`: http.StatusBadRequest,
+		`{"crop": {"x": 0, "y": 0, "w": 0, "h": 10}}`:    http.StatusBadRequest,
+		`{"crop": {"x": 390, "y": 0, "w": 20, "h": 10}}`: http.StatusBadRequest,
+		`{"rotate": 90, "flip": true}`:                   http.StatusBadRequest,
+		`{}`:                                             http.StatusBadRequest,
+		`[]`:                                             http.StatusBadRequest,
+		`{"rotate": 90, "destination": "other.jpg"}`:       http.StatusBadRequest,
+		`{"rotate": 90, "destination": "../../etc/x.png"}`: http.StatusCreated,
+	} {
+		if w := transform(t, server, "wide", body); w.Code != want {
+			t.Errorf("%s: expected: %v, got: %v %s", body, want, w.Code, w.Body.String())
+		}
+	}
+
+	if w := transform(t, server, "nope", `{"rotate": 90}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+	if w := transform(t, server, "broken", `{"rotate": 90}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected: %v, got: %v", http.StatusUnprocessableEntity, w.Code)
+	}
+}
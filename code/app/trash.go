@@ -0,0 +1,206 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashPrefix is where deleted images wait to be restored or purged.
+const trashPrefix = "trash"
+
+// deletedKey is the metadata key trashed objects record their deletion
+// time under.
+const deletedKey = "deleted"
+
+// trashRetention is how long deleted images are kept before cleanup purges
+// them. Zero keeps them until they are restored.
+var trashRetention = 30 * 24 * time.Hour
+
+// trashDir holds the objects of trashed image id.
+func trashDir(id string) string {
+	return fmt.Sprintf("%s/%s", trashPrefix, id)
+}
+
+// TrashedImage is a deleted image that can still be restored.
+type TrashedImage struct {
+	Name        string     `json:"name"`
+	SizeBytes   int64      `json:"sizeBytes,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Deleted     time.Time  `json:"deleted"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+type TrashedImages []TrashedImage
+
+// NewTrashedImages converts the objects in the trash to one TrashedImage
+// for each original among them.
+func NewTrashedImages(fs CSFiles) TrashedImages {
+	ts := TrashedImages{}
+	for _, f := range fs {
+		if strings.Index(f.Name, "original.") < 0 {
+			continue
+		}
+
+		name := strings.TrimPrefix(f.Name, trashPrefix+"/")
+		name = name[:strings.LastIndex(name, "/")]
+
+		// Objects that lost their stamp count from when they were moved.
+		deleted, err := time.Parse(time.RFC3339, f.Metadata[deletedKey])
+		if err != nil {
+			deleted = f.Updated
+		}
+
+		t := TrashedImage{
+			Name:        name,
+			SizeBytes:   f.Size,
+			ContentType: f.ContentType,
+			Deleted:     deleted,
+		}
+		if trashRetention > 0 {
+			expires := deleted.Add(trashRetention)
+			t.Expires = &expires
+		}
+		ts = append(ts, t)
+	}
+
+	return ts
+}
+
+// JSON marshalls the content of TrashedImages to json.
+func (ts TrashedImages) JSON() (string, error) {
+	bytes, err := json.Marshal(ts)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of TrashedImages to json.
+func (ts TrashedImages) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(ts)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// trashImage moves image id to the trash, on condition its original is at
+// generation unless that is 0. Its thumbnail stays where it is so that it
+// comes back with it, but cached variants are dropped.
+func (s *Server) trashImage(ctx context.Context, id string, generation int64) error {
+	if err := s.storage.Trash(ctx, id, time.Now(), generation); err != nil {
+		return err
+	}
+	s.contents.of(ctx).forget(id)
+	s.dropVariants(ctx, id)
+
+	return nil
+}
+
+// purgeImage removes trashed image id for good, along with its thumbnail
+// unless a new image has been stored under the same id since.
+func (s *Server) purgeImage(ctx context.Context, id string) error {
+	if err := s.storage.Purge(ctx, id); err != nil {
+		return err
+	}
+
+	if _, err := s.storage.Read(ctx, id); err != ErrNotFound {
+		return nil
+	}
+	if err := s.storage.DeleteObject(ctx, thumbnailName(id)); err != nil && err != ErrNotFound {
+		weblog(fmt.Sprintf("error deleting thumbnail for %s: %s", id, err))
+	}
+
+	return nil
+}
+
+// purgeTrash purges, as part of sw, every image deleted before before.
+func (s *Server) purgeTrash(ctx context.Context, sw *sweep, before time.Time) error {
+	if err := sw.wait(ctx); err != nil {
+		return err
+	}
+	fs, err := s.storage.ListTrash(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range NewTrashedImages(fs) {
+		if !t.Deleted.Before(before) {
+			continue
+		}
+		err := sw.remove(ctx, &sw.report.Trash, trashDir(t.Name), func() error {
+			return s.purgeImage(ctx, t.Name)
+		})
+		if err != nil {
+			return fmt.Errorf("error purging %s: %w", t.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) trashListHandler(w http.ResponseWriter, r *http.Request) {
+	fs, err := s.storage.ListTrash(r.Context())
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to list trash: %v", err))
+		return
+	}
+
+	writeJSON(w, NewTrashedImages(fs), http.StatusOK)
+}
+
+func (s *Server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := s.storage.Restore(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err == ErrConflict {
+		writeJSON(w, Message{Text: "conflict", Details: fmt.Sprintf("image id: %s already exists", id)}, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to restore %s: %v", id, err))
+		return
+	}
+	s.notify(r.Context(), ImageEvent{Action: actionCreated, ID: id})
+
+	fs, err := s.storage.Read(r.Context(), id)
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to read files %s: %v", id, err))
+		return
+	}
+
+	is, _ := NewImages(fs)
+	if len(is) < 1 {
+		writeJSON(w, Message{Text: "image restored", Details: fmt.Sprintf("image id: %s", id)}, http.StatusOK)
+		return
+	}
+	s.contents.of(r.Context()).add(id, is[0].ETag)
+
+	writeJSON(w, is[0], http.StatusOK)
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+
+	tests := []struct {
+		method string
+		target string
+		want   int
+	}{
+		{method: http.MethodDelete, target: "/api/v1/image/a", want: http.StatusNoContent},
+		{method: http.MethodGet, target: "/api/v1/image/a", want: http.StatusNotFound},
+		{method: http.MethodDelete, target: "/api/v1/image/a", want: http.StatusNotFound},
+		{method: http.MethodPost, target: "/api/v1/trash/missing:restore", want: http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != tc.want {
+			t.Fatalf("%s %s expected: %v, got: %v", tc.method, tc.target, tc.want, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	page := ImagePage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if len(page.Images) != 1 || page.Images[0].Name != "b" {
+		t.Fatalf("expected only b to be listed, got: %+v", page.Images)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/trash", nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	trashed := TrashedImages{}
+	if err := json.Unmarshal(w.Body.Bytes(), &trashed); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if len(trashed) != 1 || trashed[0].Name != "a" || trashed[0].Deleted.IsZero() {
+		t.Fatalf("expected a in the trash, got: %+v", trashed)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/trash/a:restore", nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if img.Name != "a" {
+		t.Fatalf("expected: %v, got: %v", "a", img.Name)
+	}
+
+	fs, err := ms.Read(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	for _, f := range fs {
+		if _, ok := f.Metadata[deletedKey]; ok {
+			t.Fatalf("expected %s to lose its deletion time, got: %v", f.Name, f.Metadata)
+		}
+	}
+}
+
+func TestRestoreConflict(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+
+	if err := ms.Trash(context.Background(), "a", time.Now(), 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := ms.Create(context.Background(), "a.png", newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/trash/a:restore", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected: %v, got: %v", http.StatusConflict, w.Code)
+	}
+}
+
+func TestHardDelete(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png")
+	server := NewServer(ms)
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/v1/image/a?hard=true", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v", http.StatusNoContent, w.Code)
+	}
+
+	fs, err := ms.ListTrash(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(fs) != 0 {
+		t.Fatalf("expected nothing in the trash, got: %v", fs)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	ms := newTestMemoryStorage(t, "old.png", "new.png")
+	server := NewServer(ms)
+
+	now := time.Now()
+	if err := ms.Trash(context.Background(), "old", now.Add(-48*time.Hour), 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := ms.Trash(context.Background(), "new", now, 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	sw := &sweep{}
+	if err := server.purgeTrash(context.Background(), sw, now.Add(-24*time.Hour)); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if sw.report.Trash != 1 {
+		t.Fatalf("expected: %v, got: %v", 1, sw.report.Trash)
+	}
+
+	fs, err := ms.ListTrash(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	trashed := NewTrashedImages(fs)
+	if len(trashed) != 1 || trashed[0].Name != "new" {
+		t.Fatalf("expected only new to be left, got: %+v", trashed)
+	}
+}
+
+func TestFileStorageTrash(t *testing.T) {
+	fs, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("could not create storage: %s", err)
+	}
+	if _, err := fs.Create(context.Background(), "a.png", newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+		t.Fatalf("could not create a.png: %s", err)
+	}
+
+	deleted := time.Now().UTC().Truncate(time.Second)
+	if err := fs.Trash(context.Background(), "a", deleted, 0); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := fs.Read(context.Background(), "a"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrNotFound, err)
+	}
+
+	files, err := fs.ListTrash(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	trashed := NewTrashedImages(files)
+	if len(trashed) != 1 || !trashed[0].Deleted.Equal(deleted) {
+		t.Fatalf("expected a deleted at %v, got: %+v", deleted, trashed)
+	}
+
+	if err := fs.Restore(context.Background(), "a"); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := fs.Read(context.Background(), "a"); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := fs.Purge(context.Background(), "a"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrNotFound, err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ttlHeader gives an upload a time to live, as the ttl form field does.
+const ttlHeader = "X-Image-TTL"
+
+// expiresKey is the metadata key the time an image expires is kept under,
+// in RFC 3339.
+const expiresKey = "expires"
+
+// ttlNever is the time to live that keeps an image for good.
+const ttlNever = "never"
+
+// ErrExpired is returned for images that have expired but haven't been
+// deleted yet.
+var ErrExpired = errors.New("image has expired")
+
+// setTTL makes the image expire ttl from now, a duration like 24h, or with
+// ttlNever not at all. An empty ttl changes nothing.
+func (um *userMetadata) setTTL(ttl string) error {
+	switch ttl {
+	case "":
+		return nil
+	case ttlNever:
+		um.Expires = time.Time{}
+		return nil
+	}
+
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid ttl %q: want a duration like 24h, or %s", ttl, ttlNever)
+	}
+	um.Expires = time.Now().Add(d).UTC().Truncate(time.Second)
+
+	return nil
+}
+
+// expired reports whether i had expired by now.
+func expired(i Image, now time.Time) bool {
+	return i.Expires != nil && !i.Expires.After(now)
+}
+
+// purgeExpired deletes, as part of sw, every image that had expired by
+// now. Each is deleted on condition it is still the one that expired, so
+// that an image stored under the same id since is left alone.
+func (s *Server) purgeExpired(ctx context.Context, sw *sweep, now time.Time) error {
+	if err := sw.wait(ctx); err != nil {
+		return err
+	}
+	gone := Images{}
+	err := s.storage.Walk(ctx, "", func(f CSFile) error {
+		is, _ := NewImages(CSFiles{f})
+		if len(is) == 1 && expired(is[0], now) {
+			gone = append(gone, is[0])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, i := range gone {
+		id, generation := i.ID, i.Generation
+		err := sw.remove(ctx, &sw.report.Expired, imageDir(id), func() error {
+			if err := s.deleteImage(ctx, id, generation); err != nil {
+				return err
+			}
+			s.notify(ctx, ImageEvent{Action: actionDeleted, ID: id})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
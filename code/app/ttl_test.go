@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expire makes image id of ms have expired a minute ago.
+func expire(t *testing.T, ms *MemoryStorage, id string) {
+	t.Helper()
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	if err := ms.UpdateMetadata(context.Background(), "processed/"+id+"/original.png", map[string]string{expiresKey: past}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+}
+
+func patchTTL(server *Server, id, ttl string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/api/v1/image/"+id, strings.NewReader(`{"ttl": "`+ttl+`"}`)))
+	return w
+}
+
+func TestTTLOnUpload(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	start := time.Now().Truncate(time.Second)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, uploadWithFields(t, http.MethodPost, "/api/v1/image", "form.png", map[string]string{"ttl": "24h"}))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	img := readImage(t, server, "form")
+	if img.Expires == nil || img.Expires.Before(start.Add(24*time.Hour)) || img.Expires.After(time.Now().Add(24*time.Hour)) {
+		t.Fatalf("expected form to expire in a day, got: %v", img.Expires)
+	}
+
+	r := newRawPutRequest("/api/v1/image/raw", "image/png", testPNG(t))
+	r.Header.Set(ttlHeader, "1h")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if img := readImage(t, server, "raw"); img.Expires == nil || img.Expires.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("expected raw to expire in an hour, got: %v", img.Expires)
+	}
+
+	// Without one, or with never, images are kept for good.
+	for name, fields := range map[string]map[string]string{"plain": nil, "never": {"ttl": ttlNever}} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, uploadWithFields(t, http.MethodPost, "/api/v1/image?force=true", name+".png", fields))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s expected: %v, got: %v %s", name, http.StatusCreated, w.Code, w.Body.String())
+		}
+		if img := readImage(t, server, name); img.Expires != nil {
+			t.Fatalf("%s: expected no expiry, got: %v", name, img.Expires)
+		}
+	}
+
+	for _, ttl := range []string{"soon", "-1h", "0s"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, uploadWithFields(t, http.MethodPost, "/api/v1/image?force=true", "bad.png", map[string]string{"ttl": ttl}))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("ttl %q expected: %v, got: %v", ttl, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestExpiredImages(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+	expire(t, ms, "a")
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image", nil))
+	page := ImagePage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Images) != 1 || page.Images[0].ID != "b" {
+		t.Fatalf("expected only b to be listed, got: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil))
+	msg := ErrorMessage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); w.Code != http.StatusGone || err != nil || msg.Code != codeGone {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusGone, w.Code, w.Body.String())
+	}
+
+	// Its expiry can still be put off.
+	if w := patchTTL(server, "a", ttlNever); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if img := readImage(t, server, "a"); img.Expires != nil {
+		t.Fatalf("expected no expiry, got: %v", img.Expires)
+	}
+	if w := patchTTL(server, "a", "2h"); w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if img := readImage(t, server, "a"); img.Expires == nil || !img.Expires.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("expected a to expire in 2 hours, got: %v", img.Expires)
+	}
+	if w := patchTTL(server, "a", "later"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestCleanupExpired(t *testing.T) {
+	ms := newTestMemoryStorage(t, "a.png", "b.png")
+	server := NewServer(ms)
+	expire(t, ms, "a")
+
+	if report := server.cleanup(context.Background(), true); report.Expired != 1 {
+		t.Fatalf("expected a dry run to find a, got: %+v", report)
+	}
+	if _, err := ms.Read(context.Background(), "a"); err != nil {
+		t.Fatalf("expected a dry run to keep a, got: %s", err)
+	}
+
+	if report := server.cleanup(context.Background(), false); report.Expired != 1 || len(report.Errors) > 0 {
+		t.Fatalf("expected a to be deleted, got: %+v", report)
+	}
+	if _, err := ms.Read(context.Background(), "a"); err != ErrNotFound {
+		t.Fatalf("expected: %v, got: %v", ErrNotFound, err)
+	}
+	if _, err := ms.Read(context.Background(), "b"); err != nil {
+		t.Fatalf("expected b to be kept, got: %s", err)
+	}
+}
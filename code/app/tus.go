@@ -0,0 +1,512 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// The tus resumable upload protocol, https://tus.io/protocols/resumable-upload.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	// tusContentType is the only body PATCH requests may have.
+	tusContentType = "application/offset+octet-stream"
+)
+
+// tusPrefix is where uploads in progress keep their state, so that any
+// instance can carry on with an upload another one started.
+const tusPrefix = "tus"
+
+// uploadExpiry is how long an unfinished upload is kept after it was last
+// added to, before cleanup removes it.
+var uploadExpiry = 24 * time.Hour
+
+// tusDir holds the state of upload id, and tusInfo the tusUpload itself.
+// The data sent so far is kept as one object per PATCH, named after the
+// offset it starts at.
+func tusDir(id string) string {
+	return fmt.Sprintf("%s/%s", tusPrefix, id)
+}
+
+func tusInfo(id string) string {
+	return tusDir(id) + "/info"
+}
+
+func tusPart(id string, offset int64) string {
+	return fmt.Sprintf("%s/part-%020d", tusDir(id), offset)
+}
+
+// tusUpload is an upload in progress.
+type tusUpload struct {
+	Length      int64  `json:"length"`
+	Offset      int64  `json:"offset"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType,omitempty"`
+	// Metadata is the Upload-Metadata it was created with, to hand back.
+	Metadata string `json:"metadata,omitempty"`
+	// Parts are the offsets of the objects holding the data, in order.
+	Parts   []int64   `json:"parts,omitempty"`
+	Expires time.Time `json:"expires"`
+	// Image is the image the upload was stored as, once it is complete.
+	Image string `json:"image,omitempty"`
+}
+
+// tus wraps a tus handler, answering clients that speak another version of
+// the protocol with a 412 and marking every response as tus.
+func tus(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			writeErrorMsg(w, http.StatusPreconditionFailed, fmt.Errorf("unsupported Tus-Resumable %q, want %s", r.Header.Get("Tus-Resumable"), tusVersion))
+			return
+		}
+		h(w, r)
+	})
+}
+
+// tusOptionsHandler tells clients what the server supports.
+func (s *Server) tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, a comma separated
+// list of keys each followed by a base64 value.
+func parseTusMetadata(v string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		fields := strings.Fields(pair)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid Upload-Metadata %q", pair)
+		}
+		value := []byte{}
+		if len(fields) == 2 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return nil, fmt.Errorf("invalid Upload-Metadata value for %s: %v", fields[0], err)
+			}
+		}
+		m[fields[0]] = string(value)
+	}
+
+	return m, nil
+}
+
+// tusCreateHandler starts an upload of Upload-Length bytes. Its name and
+// type come from the filename and filetype in Upload-Metadata, which most
+// clients fill in, or name and type, which the rest do. A name without an
+// extension gets the one for its type.
+func (s *Server) tusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, invalidArgument(fmt.Errorf("invalid Upload-Length %q", r.Header.Get("Upload-Length"))))
+		return
+	}
+	if length > maxUploadBytes {
+		writeError(w, tooLarge(fmt.Errorf("upload too large, limit is %d bytes", maxUploadBytes)))
+		return
+	}
+
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	upload := tusUpload{
+		Length:      length,
+		Name:        meta["filename"],
+		ContentType: meta["filetype"],
+		Metadata:    r.Header.Get("Upload-Metadata"),
+		Expires:     time.Now().Add(uploadExpiry).UTC(),
+	}
+	if upload.Name == "" {
+		upload.Name = meta["name"]
+	}
+	if upload.ContentType == "" {
+		upload.ContentType = meta["type"]
+	}
+	if upload.ContentType == "" {
+		upload.ContentType = mime.TypeByExtension(filepath.Ext(upload.Name))
+	}
+	upload.ContentType, _, _ = mime.ParseMediaType(upload.ContentType)
+	if upload.Name == "" {
+		writeError(w, invalidArgument(errors.New("a filename is required in Upload-Metadata")))
+		return
+	}
+	if filepath.Ext(upload.Name) == "" {
+		upload.Name += extensionFor(upload.ContentType)
+	}
+	if _, err := sanitizeFilename(upload.Name); err != nil {
+		writeError(w, invalidArgument(err))
+		return
+	}
+	if err := s.checkDeclaredType(upload.ContentType); err != nil {
+		msg := InvalidType{
+			Text:    "invalid image type",
+			Details: err.Error(),
+			Allowed: allowedMimeTypes.Slice(),
+		}
+		writeJSON(w, msg, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id := uuid.NewString()
+	if err := s.saveUpload(r.Context(), id, upload); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/upload/"+id)
+	w.Header().Set("Upload-Expires", upload.Expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusHeadHandler tells a client how much of an upload has arrived, so that
+// it can carry on from there.
+func (s *Server) tusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	upload, err := s.loadUpload(r.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeUploadHeaders(w, upload)
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatchHandler adds the body to an upload at Upload-Offset, which has
+// to be where the upload is up to. Whatever arrives before the connection
+// drops is kept. The PATCH that completes the upload stores the image,
+// checking it like any other upload, and gives its location in
+// Content-Location.
+//
+// Clients send one PATCH to an upload at a time, so nothing stops two
+// instances adding to the same upload at once.
+func (s *Server) tusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != tusContentType {
+		writeErrorMsg(w, http.StatusUnsupportedMediaType, fmt.Errorf("PATCH bodies must be %s", tusContentType))
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, invalidArgument(fmt.Errorf("invalid Upload-Offset %q", r.Header.Get("Upload-Offset"))))
+		return
+	}
+
+	ctx := r.Context()
+	upload, err := s.loadUpload(ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if offset != upload.Offset {
+		writeErrorMsg(w, http.StatusConflict, fmt.Errorf("upload %s is at offset %d, not %d", id, upload.Offset, offset))
+		return
+	}
+
+	if upload.Offset < upload.Length {
+		n, err := s.appendUpload(ctx, id, &upload, r.Body)
+		if err != nil && n == 0 {
+			writeError(w, err)
+			return
+		}
+		if err != nil {
+			// What did arrive is kept for the client to carry on from.
+			weblog(fmt.Sprintf("upload %s cut short at %d bytes: %s", id, upload.Offset, err))
+			writeUploadHeaders(w, upload)
+			writeResponse(w, http.StatusNoContent, "")
+			return
+		}
+	}
+
+	if upload.Offset == upload.Length && upload.Image == "" {
+		img, status, err := s.completeUpload(ctx, id, &upload)
+		if err != nil {
+			writeUploadError(w, status, err)
+			return
+		}
+		w.Header().Set("Content-Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(img.Name)))
+	}
+
+	writeUploadHeaders(w, upload)
+	writeResponse(w, http.StatusNoContent, "")
+}
+
+// tusDeleteHandler abandons an upload.
+func (s *Server) tusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := s.loadUpload(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := s.storage.DeleteObjects(r.Context(), tusDir(id)); err != nil {
+		writeError(w, fmt.Errorf("failed to delete upload %s: %w", id, err))
+		return
+	}
+
+	writeResponse(w, http.StatusNoContent, "")
+}
+
+// writeUploadHeaders says where upload is up to.
+func writeUploadHeaders(w http.ResponseWriter, upload tusUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.Format(http.TimeFormat))
+	if upload.Image != "" {
+		w.Header().Set("Content-Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(upload.Image)))
+	}
+}
+
+// appendUpload stores body as the next part of upload id, moving upload on
+// by however much of it was stored. It returns how many bytes that was.
+func (s *Server) appendUpload(ctx context.Context, id string, upload *tusUpload, body io.Reader) (int64, error) {
+	f, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return 0, fmt.Errorf("could not buffer upload: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	remaining := upload.Length - upload.Offset
+	n, readErr := io.Copy(f, io.LimitReader(body, remaining+1))
+	if n > remaining {
+		return 0, tooLarge(fmt.Errorf("upload %s is %d bytes, and has %d to go", id, upload.Length, remaining))
+	}
+	if n == 0 {
+		return 0, readErr
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("could not buffer upload: %w", err)
+	}
+
+	if err := s.storage.PutObject(ctx, tusPart(id, upload.Offset), f, "application/octet-stream"); err != nil {
+		return 0, fmt.Errorf("failed to store upload %s: %w", id, err)
+	}
+	next := *upload
+	next.Parts = append(append([]int64{}, upload.Parts...), upload.Offset)
+	next.Offset += n
+	next.Expires = time.Now().Add(uploadExpiry).UTC()
+	if err := s.saveUpload(ctx, id, next); err != nil {
+		return 0, err
+	}
+	*upload = next
+
+	return n, readErr
+}
+
+// completeUpload stores the image upload id was for. Once it is stored, the
+// parts are dropped but upload is kept until it expires, so that a client
+// that missed the answer can find the image. An upload that isn't an image
+// that may be stored is dropped altogether.
+func (s *Server) completeUpload(ctx context.Context, id string, upload *tusUpload) (Image, int, error) {
+	readers := []io.Reader{}
+	for _, offset := range upload.Parts {
+		offset := offset
+		readers = append(readers, &lazyObject{open: func() (io.ReadCloser, error) {
+			return s.storage.OpenObject(ctx, tusPart(id, offset))
+		}})
+	}
+
+	file, err := spool(io.MultiReader(readers...))
+	if err != nil {
+		return Image{}, http.StatusInternalServerError, fmt.Errorf("failed to assemble upload %s: %w", id, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	img, status, err := s.storeFile(ctx, upload.Name, upload.ContentType, file, uploadOptions{})
+	if status >= http.StatusBadRequest && status < http.StatusInternalServerError {
+		if derr := s.storage.DeleteObjects(ctx, tusDir(id)); derr != nil {
+			weblog(fmt.Sprintf("error deleting upload %s: %s", id, derr))
+		}
+	}
+	if err != nil {
+		return Image{}, status, err
+	}
+
+	upload.Image = img.Name
+	if err := s.saveUpload(ctx, id, *upload); err != nil {
+		weblog(fmt.Sprintf("error saving upload %s: %s", id, err))
+	}
+	for _, offset := range upload.Parts {
+		if err := s.storage.DeleteObject(ctx, tusPart(id, offset)); err != nil && err != ErrNotFound {
+			weblog(fmt.Sprintf("error deleting upload %s: %s", id, err))
+		}
+	}
+
+	return img, status, nil
+}
+
+// lazyObject opens an object when it is first read, and closes it once it
+// has all been read.
+type lazyObject struct {
+	open func() (io.ReadCloser, error)
+	rc   io.ReadCloser
+}
+
+func (o *lazyObject) Read(p []byte) (int, error) {
+	if o.rc == nil {
+		rc, err := o.open()
+		if err != nil {
+			return 0, err
+		}
+		o.rc = rc
+	}
+
+	n, err := o.rc.Read(p)
+	if err == io.EOF {
+		o.rc.Close()
+	}
+	return n, err
+}
+
+// loadUpload reads the state of upload id, which is ErrNotFound once it
+// has expired.
+func (s *Server) loadUpload(ctx context.Context, id string) (tusUpload, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return tusUpload{}, fmt.Errorf("upload %s: %w", id, ErrNotFound)
+	}
+
+	upload, err := s.readUpload(ctx, id)
+	if err != nil {
+		return upload, err
+	}
+	if time.Now().After(upload.Expires) {
+		return upload, fmt.Errorf("upload %s expired: %w", id, ErrNotFound)
+	}
+
+	return upload, nil
+}
+
+// readUpload reads the state of upload id, expired or not.
+func (s *Server) readUpload(ctx context.Context, id string) (tusUpload, error) {
+	upload := tusUpload{}
+	obj, err := s.storage.OpenObject(ctx, tusInfo(id))
+	if err == ErrNotFound {
+		return upload, fmt.Errorf("upload %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return upload, fmt.Errorf("failed to read upload %s: %w", id, err)
+	}
+	defer obj.Close()
+
+	if err := json.NewDecoder(obj).Decode(&upload); err != nil {
+		return upload, fmt.Errorf("failed to read upload %s: %w", id, err)
+	}
+
+	return upload, nil
+}
+
+// saveUpload writes the state of upload id.
+func (s *Server) saveUpload(ctx context.Context, id string, upload tusUpload) error {
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("could not marshal upload %s: %w", id, err)
+	}
+	if err := s.storage.PutObject(ctx, tusInfo(id), bytes.NewReader(b), "application/json"); err != nil {
+		return fmt.Errorf("failed to save upload %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// purgeUploads removes, as part of sw, every upload that expired before
+// now. Parts whose upload has lost its state go once they are as old as an
+// upload is kept for.
+func (s *Server) purgeUploads(ctx context.Context, sw *sweep, now time.Time) error {
+	if err := sw.wait(ctx); err != nil {
+		return err
+	}
+	fs, err := s.storage.ListObjects(ctx, tusPrefix)
+	if err != nil {
+		return err
+	}
+
+	ids := []string{}
+	updated := map[string]time.Time{}
+	hasInfo := map[string]bool{}
+	for _, f := range fs {
+		dir, file := path.Split(strings.TrimPrefix(f.Name, tusPrefix+"/"))
+		id := strings.TrimSuffix(dir, "/")
+		if _, ok := updated[id]; !ok {
+			ids = append(ids, id)
+		}
+		if f.Updated.After(updated[id]) {
+			updated[id] = f.Updated
+		}
+		hasInfo[id] = hasInfo[id] || file == "info"
+	}
+
+	for _, id := range ids {
+		expires := updated[id].Add(uploadExpiry)
+		if hasInfo[id] {
+			if err := sw.wait(ctx); err != nil {
+				return err
+			}
+			upload, err := s.readUpload(ctx, id)
+			if err != nil {
+				weblog(fmt.Sprintf("error reading upload %s: %s", id, err))
+				continue
+			}
+			expires = upload.Expires
+		}
+		if !expires.Before(now) {
+			continue
+		}
+
+		err := sw.remove(ctx, &sw.report.Uploads, tusDir(id), func() error {
+			return s.storage.DeleteObjects(ctx, tusDir(id))
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting upload %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
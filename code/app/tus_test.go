@@ -0,0 +1,262 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTusRequest(method, target string, body []byte, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+// createTusUpload starts an upload of length bytes called filename,
+// returning its location.
+func createTusUpload(t *testing.T, server *Server, filename string, length int) string {
+	t.Helper()
+
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte(filename))
+	r := newTusRequest(http.MethodPost, "/api/v1/upload/", nil, map[string]string{
+		"Upload-Length":   fmt.Sprint(length),
+		"Upload-Metadata": meta,
+	})
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Tus-Resumable"); got != tusVersion {
+		t.Fatalf("expected: %v, got: %v", tusVersion, got)
+	}
+
+	return w.Header().Get("Location")
+}
+
+func patchTusUpload(server *Server, location string, offset int, body []byte) *httptest.ResponseRecorder {
+	r := newTusRequest(http.MethodPatch, location, body, map[string]string{
+		"Content-Type":  tusContentType,
+		"Upload-Offset": fmt.Sprint(offset),
+	})
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+func TestTusUpload(t *testing.T) {
+	ms := newTestMemoryStorage(t)
+	png := testPNG(t)
+	half := len(png) / 2
+
+	location := createTusUpload(t, NewServer(ms), "resumed.png", len(png))
+	if !strings.HasPrefix(location, "/api/v1/upload/") {
+		t.Fatalf("expected an upload location, got: %v", location)
+	}
+
+	w := patchTusUpload(NewServer(ms), location, 0, png[:half])
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Upload-Offset"); got != fmt.Sprint(half) {
+		t.Fatalf("expected: %v, got: %v", half, got)
+	}
+
+	// Another instance finds where the upload is up to.
+	server := NewServer(ms)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newTusRequest(http.MethodHead, location, nil, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != fmt.Sprint(half) {
+		t.Fatalf("expected offset %d, got: %v %v", half, w.Code, w.Header())
+	}
+	if got := w.Header().Get("Upload-Length"); got != fmt.Sprint(len(png)) {
+		t.Fatalf("expected: %v, got: %v", len(png), got)
+	}
+
+	w = patchTusUpload(server, location, 0, png[half:])
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected: %v, got: %v", http.StatusConflict, w.Code)
+	}
+
+	w = patchTusUpload(server, location, half, png[half:])
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Location"); got != "/api/v1/image/resumed" {
+		t.Fatalf("expected: %v, got: %v", "/api/v1/image/resumed", got)
+	}
+
+	obj, err := ms.Open(context.Background(), "resumed")
+	if err != nil {
+		t.Fatalf("expected the upload to be stored, got: %s", err)
+	}
+	defer obj.Close()
+	got, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if !bytes.Equal(got, png) {
+		t.Fatalf("expected the assembled upload to be the image")
+	}
+
+	fs, err := ms.ListObjects(context.Background(), tusPrefix)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(fs) != 1 {
+		t.Fatalf("expected only the upload's state to be left, got: %v", fs)
+	}
+
+	// A client that missed the answer can still find the image.
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newTusRequest(http.MethodHead, location, nil, nil))
+	if got := w.Header().Get("Content-Location"); got != "/api/v1/image/resumed" {
+		t.Fatalf("expected: %v, got: %v", "/api/v1/image/resumed", got)
+	}
+}
+
+func TestTusUploadRejected(t *testing.T) {
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+
+	location := createTusUpload(t, server, "fake.png", 2)
+	w := patchTusUpload(server, location, 0, []byte("MZ"))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+	}
+	if fs, _ := ms.ListObjects(context.Background(), tusPrefix); len(fs) != 0 {
+		t.Fatalf("expected the upload to be dropped, got: %v", fs)
+	}
+
+	location = createTusUpload(t, server, "short.png", 2)
+	if w := patchTusUpload(server, location, 0, []byte("abc")); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected: %v, got: %v", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	r := newTusRequest(http.MethodPatch, location, []byte("ab"), map[string]string{"Upload-Offset": "0"})
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected: %v, got: %v", http.StatusUnsupportedMediaType, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newTusRequest(http.MethodDelete, location, nil, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v", http.StatusNoContent, w.Code)
+	}
+	if w := patchTusUpload(server, location, 0, []byte("ab")); w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+	if w := patchTusUpload(server, "/api/v1/upload/not-an-upload", 0, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected: %v, got: %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestTusCreate(t *testing.T) {
+	old := maxUploadBytes
+	maxUploadBytes = 1024
+	defer func() { maxUploadBytes = old }()
+
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	type test struct {
+		headers map[string]string
+		status  int
+	}
+
+	tests := map[string]test{
+		"name and type": {
+			headers: map[string]string{"Upload-Length": "10", "Upload-Metadata": "name " + encode("a") + ",type " + encode("image/png")},
+			status:  http.StatusCreated,
+		},
+		"too large": {
+			headers: map[string]string{"Upload-Length": "1025", "Upload-Metadata": "filename " + encode("a.png")},
+			status:  http.StatusRequestEntityTooLarge,
+		},
+		"no length":   {headers: map[string]string{"Upload-Metadata": "filename " + encode("a.png")}, status: http.StatusBadRequest},
+		"no filename": {headers: map[string]string{"Upload-Length": "10"}, status: http.StatusBadRequest},
+		"bad metadata": {
+			headers: map[string]string{"Upload-Length": "10", "Upload-Metadata": "filename not*base64"},
+			status:  http.StatusBadRequest,
+		},
+		"not an image": {
+			headers: map[string]string{"Upload-Length": "10", "Upload-Metadata": "filename " + encode("notes.txt")},
+			status:  http.StatusUnsupportedMediaType,
+		},
+	}
+
+	server := NewServer(newTestMemoryStorage(t))
+	for name, c := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, newTusRequest(http.MethodPost, "/api/v1/upload/", nil, c.headers))
+
+		if w.Code != c.status {
+			t.Fatalf("%s expected: %v, got: %v %s", name, c.status, w.Code, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/upload/", nil)
+	r.Header.Set("Upload-Length", "10")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("Tus-Version") != tusVersion {
+		t.Fatalf("expected a 412 naming the version, got: %v %v", w.Code, w.Header())
+	}
+
+	r = httptest.NewRequest(http.MethodOptions, "/api/v1/upload/", nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Header().Get("Tus-Max-Size") != "1024" || !strings.Contains(w.Header().Get("Tus-Extension"), "creation") {
+		t.Fatalf("expected the server's capabilities, got: %v", w.Header())
+	}
+}
+
+func TestPurgeUploads(t *testing.T) {
+	ms := newTestMemoryStorage(t)
+	server := NewServer(ms)
+
+	location := createTusUpload(t, server, "a.png", 10)
+	patchTusUpload(server, location, 0, []byte("12345"))
+	createTusUpload(t, server, "b.png", 10)
+	if err := ms.PutObject(context.Background(), tusPrefix+"/lost/part-0", strings.NewReader("x"), ""); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	sw := &sweep{}
+	if err := server.purgeUploads(context.Background(), sw, time.Now()); err != nil || sw.report.Uploads != 0 {
+		t.Fatalf("expected nothing to expire yet, got: %v %v", sw.report.Uploads, err)
+	}
+
+	if err := server.purgeUploads(context.Background(), sw, time.Now().Add(uploadExpiry+time.Minute)); err != nil || sw.report.Uploads != 3 {
+		t.Fatalf("expected: 3, got: %v %v", sw.report.Uploads, err)
+	}
+	if fs, _ := ms.ListObjects(context.Background(), tusPrefix); len(fs) != 0 {
+		t.Fatalf("expected every upload to be gone, got: %v", fs)
+	}
+}
@@ -0,0 +1,551 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultMimeTypes are the types of image accepted unless
+// ALLOWED_MIME_TYPES says otherwise.
+var defaultMimeTypes = []string{"image/png", "image/jpeg", "image/gif"}
+
+var (
+	allowedMimeTypes       = NewMimeMap(defaultMimeTypes)
+	maxUploadBytes   int64 = 10 << 20
+)
+
+// How new images get their ids, set from ID_STRATEGY: from the name of the
+// uploaded file, or a random UUID, with the filename kept in the metadata.
+const (
+	idStrategyFilename = "filename"
+	idStrategyUUID     = "uuid"
+)
+
+var idStrategy = idStrategyFilename
+
+// objectName is the name an upload called name is stored under.
+func objectName(name string) string {
+	if idStrategy == idStrategyUUID {
+		return uuid.NewString() + filepath.Ext(name)
+	}
+
+	return name
+}
+
+// uploadReadError is the error for a multipart upload that couldn't be
+// read: one that went over maxUploadBytes, or isn't a form.
+func uploadReadError(err error) error {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return tooLarge(fmt.Errorf("upload too large, limit is %d bytes", maxUploadBytes))
+	}
+
+	return invalidArgument(fmt.Errorf("invalid multipart form: %v", err))
+}
+
+// spool copies an upload from src into a temporary file, rewound and ready
+// to store, which the caller must close and remove. Uploads of more than
+// maxUploadBytes are turned down with a 413.
+func spool(src io.Reader) (*os.File, error) {
+	return spoolUpTo(src, maxUploadBytes)
+}
+
+// spoolUpTo is spool with a limit of its own.
+func spoolUpTo(src io.Reader, limit int64) (*os.File, error) {
+	f, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("could not buffer upload: %w", err)
+	}
+
+	n, err := io.Copy(f, io.LimitReader(src, limit+1))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes), err == nil && n > limit:
+		err = tooLarge(fmt.Errorf("upload too large, limit is %d bytes", limit))
+	case err != nil:
+		err = fmt.Errorf("could not buffer upload: %w", err)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// parseMimeTypes splits a comma separated list of MIME types, checking that
+// each of them is well formed.
+func parseMimeTypes(s string) ([]string, error) {
+	types := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		mt, _, err := mime.ParseMediaType(v)
+		if err != nil || !strings.Contains(mt, "/") {
+			return nil, fmt.Errorf("%q is not a valid MIME type", v)
+		}
+		types = append(types, mt)
+	}
+
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no MIME types given")
+	}
+
+	return types, nil
+}
+
+// sniffLen is the most bytes http.DetectContentType will look at.
+const sniffLen = 512
+
+// validMimeType reports whether file holds an allowed image type. When it
+// isn't valid, the error response has already been written to w.
+func validMimeType(ctx context.Context, w http.ResponseWriter, file multipart.File, declared string) bool {
+	if status, err := checkMimeType(ctx, file, declared); err != nil {
+		writeUploadError(w, status, err)
+		return false
+	}
+
+	return true
+}
+
+// checkMimeType sniffs the type of file from its content rather than trusting
+// the client, and checks that it is allowed and agrees with the declared
+// type. On failure it returns the status to respond with. file is rewound so
+// it can be read again from the start.
+func checkMimeType(ctx context.Context, file multipart.File, declared string) (int, error) {
+	_, span := startSpan(ctx, "checkMimeType")
+	defer span.End()
+
+	detected, err := sniffMimeType(file)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+
+	if !allowedMimeTypes.Valid(detected) {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("%s is not an allowed type", detected)
+	}
+
+	if declared != detected {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("declared type %s does not match detected type %s", declared, detected)
+	}
+
+	return http.StatusOK, nil
+}
+
+func sniffMimeType(file multipart.File) (string, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	// Which http.DetectContentType knows nothing of.
+	if t := sniffHEIF(buf[:n]); t != "" {
+		return t, nil
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// uploadMetadata is the metadata stored with an upload: its dimensions, and
+// for a GIF its frames, so listing doesn't need the pixels, and whether it
+// has a thumbnail. It leaves the file rewound.
+func uploadMetadata(file multipart.File, thumb *thumbnail) map[string]string {
+	m := thumb.metadata()
+
+	cfg, format, err := image.DecodeConfig(file)
+	if _, serr := file.Seek(0, io.SeekStart); serr != nil && err == nil {
+		err = serr
+	}
+	if err != nil {
+		return m
+	}
+
+	m = copyMetadata(m)
+	m["width"] = strconv.Itoa(cfg.Width)
+	m["height"] = strconv.Itoa(cfg.Height)
+	if format == "gif" {
+		frames, err := frameMetadata(file)
+		if err != nil {
+			logJSON(SeverityWarning, LogEntry{Message: fmt.Sprintf("could not count the frames of a GIF: %s", err)})
+		}
+		for k, v := range frames {
+			m[k] = v
+		}
+	}
+
+	return m
+}
+
+// maxFilenameLength is the longest filename an upload can have.
+const maxFilenameLength = 255
+
+// checkFilename rejects names that can't be stored as an image: anything
+// with a path in it, without an id or extension, or with control characters.
+func checkFilename(name string) error {
+	if name == "" || len(name) > maxFilenameLength {
+		return fmt.Errorf("invalid filename %q: want 1 to %d characters", name, maxFilenameLength)
+	}
+	if strings.ContainsAny(name, "/\\") || name != filepath.Base(name) {
+		return fmt.Errorf("invalid filename %q: must not contain a path", name)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) > -1 {
+		return fmt.Errorf("invalid filename %q: must not contain control characters", name)
+	}
+	if id := imageID(name); id == "" || id == "." || filepath.Ext(name) == "" {
+		return fmt.Errorf("invalid filename %q: want a name and an extension", name)
+	}
+
+	return nil
+}
+
+// reservedNameChars are the characters Cloud Storage advises against in
+// object names, plus % so that encoding them stays reversible.
+const reservedNameChars = "%#[]*?"
+
+// sanitizeFilename makes the name a client uploaded a file under into one
+// that is safe to store: it drops any directories and control characters,
+// normalizes the unicode, percent-encodes the characters Cloud Storage
+// treats specially and shortens it to maxFilenameLength, keeping the
+// extension. Names that can't be salvaged are rejected with the reason.
+func sanitizeFilename(name string) (string, error) {
+	// Browsers on Windows may send the whole path, with either separator.
+	base := path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if base == "/" {
+		base = ""
+	}
+
+	base = cleanName(base)
+	if strings.Trim(base, ".") == "" {
+		return "", fmt.Errorf("invalid filename %q: want a name", name)
+	}
+
+	if len(base) > maxFilenameLength {
+		ext := filepath.Ext(base)
+		stem := strings.TrimSuffix(base, ext)
+		if len(ext) >= maxFilenameLength {
+			return "", fmt.Errorf("invalid filename %q: extension is too long", name)
+		}
+		stem = stem[:maxFilenameLength-len(ext)]
+		// Don't cut a character, or an escape, in half.
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		if i := strings.LastIndex(stem, "%"); i > -1 && i > len(stem)-3 {
+			stem = stem[:i]
+		}
+		base = stem + ext
+	}
+
+	if err := checkFilename(base); err != nil {
+		return "", err
+	}
+
+	return base, nil
+}
+
+// cleanName drops the control characters from name, normalizes its unicode
+// and percent-encodes the characters Cloud Storage treats specially.
+func cleanName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(name))
+	name = strings.TrimSpace(name)
+
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(reservedNameChars, r) {
+			fmt.Fprintf(&b, "%%%02X", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// memoryFile adapts a byte slice to multipart.File.
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
+
+func newMemoryFile(b []byte) memoryFile {
+	return memoryFile{bytes.NewReader(b)}
+}
+
+// storeFile validates and stores file, uploaded as name. On failure it
+// returns the status to respond with.
+func (s *Server) storeFile(ctx context.Context, name, declared string, file multipart.File, opts uploadOptions) (Image, int, error) {
+	name, err := sanitizeFilename(name)
+	if err != nil {
+		return Image{}, http.StatusBadRequest, err
+	}
+
+	return s.storeObject(ctx, objectName(name), name, declared, file, opts)
+}
+
+// uploadOptions control how an upload is stored.
+type uploadOptions struct {
+	// Overwrite replaces an image with the same id rather than failing.
+	Overwrite bool
+	// Force stores the upload even when the same content is already
+	// stored. Otherwise the image that has it is returned instead.
+	Force bool
+	// KeepExif stores a JPEG's metadata even when stripExif is set.
+	KeepExif bool
+	// Metadata holds the tags and metadata the client gave the image.
+	Metadata userMetadata
+	// MD5 is what the client says the upload's MD5 is, from its
+	// Content-MD5. The upload is turned down if it doesn't match.
+	MD5 []byte
+	// IfGeneration only overwrites an image whose original is at that
+	// generation, from an If-Match.
+	IfGeneration int64
+	// Watermarked is set for uploads made from an image already stored,
+	// which has the watermark if uploads get one.
+	Watermarked bool
+	// Replace has an Overwrite go through storage's Replace, so that the
+	// image must still be there, rather than creating it again if it
+	// isn't.
+	Replace bool
+}
+
+// storeObject stores file, uploaded as original, under the name stored.
+// When it turns out to be a copy of an image that is already stored, that
+// image is returned with a 200 instead.
+func (s *Server) storeObject(ctx context.Context, stored, original, declared string, file multipart.File, opts uploadOptions) (Image, int, error) {
+	if status, err := checkNotEmpty(file); err != nil {
+		return Image{}, status, err
+	}
+	if status, err := checkContentMD5(file, opts.MD5); err != nil {
+		return Image{}, status, err
+	}
+	file, format, status, err := s.convertHEIF(ctx, file, declared)
+	if err != nil {
+		return Image{}, status, err
+	}
+	if format != "" {
+		stored, declared = jpegName(stored), "image/jpeg"
+	}
+	if status, err := checkMimeType(ctx, file, declared); err != nil {
+		return Image{}, status, err
+	}
+	if status, err := checkDimensions(file); err != nil {
+		return Image{}, status, err
+	}
+	if status, err := checkAnimated(file); err != nil {
+		return Image{}, status, err
+	}
+	if status, err := s.moderate(ctx, file, declared); err != nil {
+		return Image{}, status, err
+	}
+	file, status, err = stripUploadExif(file, declared, opts.KeepExif)
+	if err != nil {
+		return Image{}, status, err
+	}
+	if !opts.Watermarked {
+		if file, err = s.watermarkUpload(ctx, file); err != nil {
+			return Image{}, http.StatusInternalServerError, fmt.Errorf("error watermarking file: %v", err)
+		}
+	}
+
+	sum, err := contentSum(file)
+	if err != nil {
+		return Image{}, http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+	if !opts.Overwrite && !opts.Force {
+		img, ok, err := s.findDuplicate(ctx, sum)
+		if err != nil {
+			// Storing a copy is better than failing the upload.
+			weblog(fmt.Sprintf("could not check %s for duplicates: %s", original, err))
+		} else if ok {
+			img.Deduplicated = true
+			return img, http.StatusOK, nil
+		}
+	}
+
+	thumb := s.thumbnail(ctx, file)
+	phash, hashed := uploadHash(file, thumb)
+
+	co := CreateOptions{Overwrite: opts.Overwrite, Metadata: copyMetadata(uploadMetadata(file, thumb)), IfGeneration: opts.IfGeneration}
+	if stored != original {
+		co.Metadata[originalNameKey] = original
+	}
+	if format != "" {
+		co.Metadata[originalFormatKey] = format
+	}
+	// A forced upload is known to be a copy, so it isn't warned about
+	// looking like one.
+	var similar []string
+	if hashed {
+		co.Metadata[perceptualHashKey] = formatHash(phash)
+		if !opts.Force {
+			similar = s.similarTo(ctx, imageID(stored), phash)
+		}
+	}
+	for k, v := range opts.Metadata.objectMetadata(nil) {
+		co.Metadata[k] = v
+	}
+	var f CSFile
+	if opts.Replace {
+		f, err = s.replaceObject(ctx, stored, file, co)
+	} else {
+		f, err = s.storage.Create(ctx, stored, file, co)
+	}
+	if err == ErrNotFound {
+		return Image{}, http.StatusNotFound, fmt.Errorf("image id: %s not found", imageID(stored))
+	}
+	if err == ErrConflict {
+		return Image{}, http.StatusConflict, fmt.Errorf("image id: %s already exists", imageID(stored))
+	}
+	if err == ErrPrecondition {
+		return Image{}, http.StatusPreconditionFailed, fmt.Errorf("image id: %s has been changed since", imageID(stored))
+	}
+	if err != nil {
+		return Image{}, http.StatusInternalServerError, fmt.Errorf("image couldn't be created: %v", err)
+	}
+
+	s.storeThumbnail(ctx, imageID(stored), thumb)
+	if opts.Overwrite {
+		s.dropVariants(ctx, imageID(stored))
+	}
+
+	img := NewImage(f)
+	s.contents.of(ctx).add(img.Name, sum)
+	if hashed {
+		s.contents.of(ctx).hashed(img.Name, phash)
+	}
+	img.SimilarTo = similar
+
+	action, status := actionCreated, http.StatusCreated
+	if opts.Replace {
+		action, status = actionUpdated, http.StatusOK
+	}
+	s.notify(ctx, ImageEvent{Action: action, ID: img.Name, Size: img.SizeBytes, ContentType: img.ContentType, image: &img})
+	// A new image's original can only be the upload, but one it overwrote
+	// may still be there until the new one is processed.
+	etag := ""
+	if opts.Overwrite {
+		etag = sum
+	}
+	s.label(ctx, img.Name, etag)
+	s.placehold(ctx, img.Name, etag)
+
+	return img, status, nil
+}
+
+// replaceObject stores file over the image stored as stored, which must
+// exist, and returns its original as it is now.
+func (s *Server) replaceObject(ctx context.Context, stored string, file multipart.File, co CreateOptions) (CSFile, error) {
+	id := imageID(stored)
+	if err := s.storage.Replace(ctx, id, stored, file, co.Metadata, co.IfGeneration); err != nil {
+		return CSFile{}, err
+	}
+
+	fs, err := s.storage.Read(ctx, id)
+	if err != nil {
+		return CSFile{}, err
+	}
+	f, ok := originalFile(fs)
+	if !ok {
+		return CSFile{}, fmt.Errorf("image %s has no original after replacing it", id)
+	}
+
+	return f, nil
+}
+
+// writeUploadError writes the response for a failed upload.
+func writeUploadError(w http.ResponseWriter, status int, err error) {
+	if writeModerationError(w, status, err) {
+		return
+	}
+
+	switch status {
+	case http.StatusUnsupportedMediaType:
+		msg := InvalidType{Text: "invalid image type", Details: err.Error(), Allowed: allowedMimeTypes.Slice()}
+		writeJSON(w, msg, status)
+	case http.StatusConflict:
+		writeJSON(w, Message{Text: "conflict", Details: err.Error()}, status)
+	default:
+		writeErrorMsg(w, status, err)
+	}
+}
+
+// UploadResult is the outcome of storing one file from a multiple file
+// upload.
+type UploadResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Image  *Image `json:"image,omitempty"`
+}
+
+// UploadResults is the response to a multiple file upload.
+type UploadResults []UploadResult
+
+// JSON marshalls the content of UploadResults to json.
+func (u UploadResults) JSON() (string, error) {
+	bytes, err := json.Marshal(u)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of UploadResults to json.
+func (u UploadResults) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(u)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCreateMultipleFiles(t *testing.T) {
+	type test struct {
+		parts      []testPart
+		want       int
+		wantStatus []int
+	}
+
+	png := testPNG(t)
+
+	tests := []test{
+		{
+			parts: []testPart{
+				{"myFile", "a.png", "image/png", png},
+				{"myFile", "b.png", "image/png", png},
+				{"other", "c.png", "image/png", png},
+			},
+			want:       http.StatusCreated,
+			wantStatus: []int{http.StatusCreated, http.StatusCreated, http.StatusCreated},
+		},
+		{
+			parts: []testPart{
+				{"myFile", "a.png", "image/png", png},
+				{"myFile", "evil.exe", "image/png", []byte("MZ")},
+				{"myFile", "a.png", "image/png", png},
+			},
+			want:       http.StatusOK,
+			wantStatus: []int{http.StatusCreated, http.StatusUnsupportedMediaType, http.StatusConflict},
+		},
+	}
+
+	for _, c := range tests {
+		server := NewServer(NewMemoryStorage())
+
+		r := newMultipartRequest(t, http.MethodPost, "/api/v1/image?force=true", c.parts...)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("expected: %v, got: %v", c.want, w.Code)
+		}
+
+		results := UploadResults{}
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+		}
+
+		got := []int{}
+		for i, res := range results {
+			got = append(got, res.Status)
+			if res.Name != c.parts[i].filename {
+				t.Fatalf("expected: %v, got: %v", c.parts[i].filename, res.Name)
+			}
+			if (res.Status == http.StatusCreated) != (res.Image != nil) {
+				t.Fatalf("expected an image only for successful uploads, got: %+v", res)
+			}
+			if (res.Status == http.StatusCreated) == (res.Error != "") {
+				t.Fatalf("expected an error only for failed uploads, got: %+v", res)
+			}
+		}
+
+		if !reflect.DeepEqual(c.wantStatus, got) {
+			t.Fatalf("expected: %v, got: %v", c.wantStatus, got)
+		}
+	}
+}
+
+func TestCreateSingleFileUnchanged(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "a.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("expected a single image in the response, got %q: %s", w.Body.String(), err)
+	}
+
+	r = newUploadRequest(t, http.MethodPost, "/api/v1/image", "evil.exe", "image/png", []byte("MZ"))
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected: %v, got: %v", http.StatusUnsupportedMediaType, w.Code)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	type test struct {
+		input   string
+		want    string
+		wantErr bool
+	}
+
+	long := strings.Repeat("a", maxFilenameLength)
+
+	tests := []test{
+		{input: "cat.png", want: "cat.png"},
+		{input: "../../etc/passwd.png", want: "passwd.png"},
+		{input: `C:\Users\me\cat.png`, want: "cat.png"},
+		{input: "ca\x00t\n.png", want: "cat.png"},
+		{input: "  cat.png ", want: "cat.png"},
+		{input: "cafe\u0301.png", want: "caf\u00e9.png"},
+		{input: "a#b[1]?.png", want: "a%23b%5B1%5D%3F.png"},
+		{input: "100%.png", want: "100%25.png"},
+		{input: long + ".png", want: long[:maxFilenameLength-4] + ".png"},
+		{input: strings.Repeat("\u00e9", maxFilenameLength) + ".png", want: strings.Repeat("\u00e9", (maxFilenameLength-4)/2) + ".png"},
+		{input: strings.Repeat("#", maxFilenameLength) + ".png", want: strings.Repeat("%23", (maxFilenameLength-4)/3) + ".png"},
+		{input: "", wantErr: true},
+		{input: "..", wantErr: true},
+		{input: "dir/...", wantErr: true},
+		{input: "cat", wantErr: true},
+		{input: "cat." + long, wantErr: true},
+	}
+
+	for _, c := range tests {
+		got, err := sanitizeFilename(c.input)
+		if (err != nil) != c.wantErr {
+			t.Fatalf("%q: expected error: %v, got: %v", c.input, c.wantErr, err)
+		}
+		if got != c.want {
+			t.Fatalf("%q: expected: %q, got: %q", c.input, c.want, got)
+		}
+	}
+}
+
+func TestCreateSanitizesFilename(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "my #1.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if img.Name != "my %231" {
+		t.Fatalf("expected: %q, got: %q", "my %231", img.Name)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, w.Header().Get("Location"), nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the image at its location, got: %v", w.Code)
+	}
+
+	r = newUploadRequest(t, http.MethodPut, "/api/v1/image/my%20%25231", "...", "image/png", testPNG(t))
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestCreateWithUUIDs(t *testing.T) {
+	idStrategy = idStrategyUUID
+	t.Cleanup(func() { idStrategy = idStrategyFilename })
+
+	server := NewServer(NewMemoryStorage())
+
+	r := newUploadRequest(t, http.MethodPost, "/api/v1/image", "holiday.png", "image/png", testPNG(t))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	img := Image{}
+	if err := json.Unmarshal(w.Body.Bytes(), &img); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if _, err := uuid.Parse(img.ID); err != nil || img.Name != img.ID {
+		t.Fatalf("expected a uuid id, got: %+v", img)
+	}
+	if img.OriginalName != "holiday.png" {
+		t.Fatalf("expected: %q, got: %q", "holiday.png", img.OriginalName)
+	}
+
+	// A second upload of the same name is a new image, not a conflict.
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image?force=true", "holiday.png", "image/png", testPNG(t)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPut, "/api/v1/image/"+img.ID, "beach.png", "image/png", testPNG(t)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/"+img.ID+"/content?download=true", nil))
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=beach.png` {
+		t.Fatalf("expected the uploaded name, got: %q", cd)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/image/"+img.ID, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v, got: %v", http.StatusNoContent, w.Code)
+	}
+}
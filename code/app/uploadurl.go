@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// uploadURLTTL is how long a signed upload URL lasts.
+const uploadURLTTL = 15 * time.Minute
+
+// UploadURLRequest asks for somewhere to upload a file directly.
+type UploadURLRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+}
+
+// UploadURL tells a client where to PUT a file, and the id the image will
+// have once it's there. The request must carry the given headers.
+type UploadURL struct {
+	ID      string            `json:"id"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Expires time.Time         `json:"expires"`
+}
+
+// JSON marshalls the content of UploadURL to json.
+func (u UploadURL) JSON() (string, error) {
+	bytes, err := json.Marshal(u)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of UploadURL to json.
+func (u UploadURL) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(u)
+	if err != nil {
+		return []byte{}, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// localUploadURL stands in for a signed upload URL for backends without a
+// bucket to upload to.
+func localUploadURL(name string, expires time.Time) string {
+	return fmt.Sprintf("/api/v1/uploads/%s?expires=%s", url.PathEscape(name), strconv.FormatInt(expires.Unix(), 10))
+}
+
+func (s *Server) uploadURLHandler(w http.ResponseWriter, r *http.Request) {
+	req := UploadURLRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return
+	}
+
+	filename, err := sanitizeFilename(req.Filename)
+	if err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.checkDeclaredType(req.ContentType); err != nil {
+		writeUploadError(w, http.StatusUnsupportedMediaType, err)
+		return
+	}
+
+	name := objectName(filename)
+	id := imageID(name)
+	if _, err := s.storage.Read(r.Context(), id); err != ErrNotFound {
+		if err != nil {
+			writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("could not check for image %s: %v", id, err))
+			return
+		}
+		writeUploadError(w, http.StatusConflict, fmt.Errorf("image id: %s already exists", id))
+		return
+	}
+
+	expires := time.Now().Add(uploadURLTTL).UTC().Truncate(time.Second)
+	u, err := s.storage.SignedUploadURL(r.Context(), name, req.ContentType, expires)
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("failed to sign upload url for %s: %v", name, err))
+		return
+	}
+
+	resp := UploadURL{
+		ID:      id,
+		URL:     u,
+		Method:  http.MethodPut,
+		Headers: map[string]string{"Content-Type": req.ContentType},
+		Expires: expires,
+	}
+	writeJSON(w, resp, http.StatusOK)
+}
+
+// directUploadHandler takes the raw body PUT to a URL from localUploadURL,
+// for backends that can't be uploaded to directly.
+func (s *Server) directUploadHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["filename"]
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		writeErrorMsg(w, http.StatusForbidden, fmt.Errorf("upload url for %s has expired", name))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeErrorMsg(w, http.StatusRequestEntityTooLarge, fmt.Errorf("upload too large, limit is %d bytes", maxUploadBytes))
+		return
+	}
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, fmt.Errorf("error reading upload: %v", err))
+		return
+	}
+
+	// The name was settled on when the URL was handed out, so it is only
+	// checked, not cleaned up again.
+	if err := checkFilename(name); err != nil {
+		writeErrorMsg(w, http.StatusBadRequest, err)
+		return
+	}
+
+	img, status, err := s.storeObject(r.Context(), name, name, r.Header.Get("Content-Type"), newMemoryFile(body), uploadOptions{})
+	if err != nil {
+		writeUploadError(w, status, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/image/%s", url.PathEscape(img.Name)))
+	writeJSON(w, img, http.StatusCreated)
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckFilename(t *testing.T) {
+	type test struct {
+		input   string
+		wantErr bool
+	}
+
+	tests := []test{
+		{input: "cat.png"},
+		{input: "2024-06-01 screenshot.jpeg"},
+		{input: "", wantErr: true},
+		{input: "../cat.png", wantErr: true},
+		{input: "dir/cat.png", wantErr: true},
+		{input: `dir\cat.png`, wantErr: true},
+		{input: "cat", wantErr: true},
+		{input: ".png", wantErr: true},
+		{input: "cat\n.png", wantErr: true},
+		{input: strings.Repeat("a", maxFilenameLength) + ".png", wantErr: true},
+	}
+
+	for _, c := range tests {
+		if err := checkFilename(c.input); (err != nil) != c.wantErr {
+			t.Fatalf("%q: expected error: %v, got: %v", c.input, c.wantErr, err)
+		}
+	}
+}
+
+func TestUploadURLHandler(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "taken.png"))
+
+	type test struct {
+		body string
+		want int
+	}
+
+	tests := []test{
+		{body: `{"filename": "new.png", "contentType": "image/png"}`, want: http.StatusOK},
+		{body: `{"filename": "new.txt", "contentType": "text/plain"}`, want: http.StatusUnsupportedMediaType},
+		{body: `{"filename": "../..", "contentType": "image/png"}`, want: http.StatusBadRequest},
+		{body: `{"filename": "taken.png", "contentType": "image/png"}`, want: http.StatusConflict},
+		{body: `not json`, want: http.StatusBadRequest},
+	}
+
+	for _, c := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/image/upload-url", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != c.want {
+			t.Fatalf("%s: expected: %v, got: %v", c.body, c.want, w.Code)
+		}
+	}
+}
+
+func TestDirectUpload(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	body := `{"filename": "direct.png", "contentType": "image/png"}`
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/image/upload-url", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	u := UploadURL{}
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatalf("could not unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if u.ID != "direct" || u.Method != http.MethodPut {
+		t.Fatalf("expected: %v, got: %+v", "a PUT for direct", u)
+	}
+
+	r = httptest.NewRequest(u.Method, u.URL, bytes.NewReader(testPNG(t)))
+	for k, v := range u.Headers {
+		r.Header.Set(k, v)
+	}
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected: %v, got: %v", http.StatusCreated, w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/image/direct/content", nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if !bytes.Equal(w.Body.Bytes(), testPNG(t)) {
+		t.Fatalf("expected the uploaded image back, got %d bytes", w.Body.Len())
+	}
+
+	expired := localUploadURL("late.png", time.Now().Add(-time.Minute))
+	r = httptest.NewRequest(http.MethodPut, expired, bytes.NewReader(testPNG(t)))
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected: %v, got: %v", http.StatusForbidden, w.Code)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"strings"
+	"time"
+)
+
+type userKey struct{}
+
+// withUser returns a copy of ctx for the signed in user uid.
+func withUser(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, userKey{}, uid)
+}
+
+// userFrom returns the user ctx is for, or "" if nobody signed in.
+func userFrom(ctx context.Context) string {
+	uid, _ := ctx.Value(userKey{}).(string)
+	return uid
+}
+
+// scopeOf returns what everything kept between requests must be kept
+// apart by: the tenant and user ctx is for.
+func scopeOf(ctx context.Context) string {
+	return tenantFrom(ctx) + "/" + userFrom(ctx)
+}
+
+// detachedScope returns a context for work that outlives the request ctx,
+// for the same tenant and user.
+func detachedScope(ctx context.Context) context.Context {
+	return withUser(withTenant(context.Background(), tenantFrom(ctx)), userFrom(ctx))
+}
+
+// UserStorage wraps s so that each user only sees their own images. The
+// images of a signed in user are stored under users/{uid}/, which is added
+// to the ids and object names they ask for and taken off those handed back,
+// so that everybody else's images are simply not found. Calls made without
+// a user, such as cleaning the trash, see everything.
+func UserStorage(s Storage) Storage {
+	return userStorage{s}
+}
+
+type userStorage struct {
+	Storage
+}
+
+// userDir is where the images of uid are stored.
+func userDir(uid string) string {
+	return "users/" + uid + "/"
+}
+
+// id returns the id image id of the user ctx is for is stored under.
+func (userStorage) id(ctx context.Context, id string) string {
+	if uid := userFrom(ctx); uid != "" {
+		return userDir(uid) + id
+	}
+	return id
+}
+
+// object returns the name of the object called name for the user ctx is
+// for. Objects are kept under a directory, like processed/, and the user's
+// own directory goes inside that, as it does for their images.
+func (userStorage) object(ctx context.Context, name string) string {
+	uid := userFrom(ctx)
+	if uid == "" {
+		return name
+	}
+
+	dir, rest, ok := strings.Cut(name, "/")
+	if !ok {
+		return dir + "/" + strings.TrimSuffix(userDir(uid), "/")
+	}
+	return dir + "/" + userDir(uid) + rest
+}
+
+// files hands back those of fs that belong to the user ctx is for, named
+// as that user knows them.
+func (us userStorage) files(ctx context.Context, fs CSFiles) CSFiles {
+	uid := userFrom(ctx)
+	if uid == "" {
+		return fs
+	}
+
+	own := CSFiles{}
+	for _, f := range fs {
+		dir, rest, _ := strings.Cut(f.Name, "/")
+		if !strings.HasPrefix(rest, userDir(uid)) {
+			continue
+		}
+		f.Name = dir + "/" + strings.TrimPrefix(rest, userDir(uid))
+		own = append(own, f)
+	}
+	return own
+}
+
+func (us userStorage) file(ctx context.Context, f CSFile) CSFile {
+	if fs := us.files(ctx, CSFiles{f}); len(fs) == 1 {
+		return fs[0]
+	}
+	return f
+}
+
+func (us userStorage) List(ctx context.Context, prefix string, pageSize int, pageToken string) (CSFiles, string, error) {
+	fs, next, err := us.Storage.List(ctx, us.id(ctx, prefix), pageSize, pageToken)
+	return us.files(ctx, fs), next, err
+}
+
+func (us userStorage) Walk(ctx context.Context, prefix string, fn func(CSFile) error) error {
+	return us.Storage.Walk(ctx, us.id(ctx, prefix), func(f CSFile) error {
+		if fs := us.files(ctx, CSFiles{f}); len(fs) == 1 {
+			return fn(fs[0])
+		}
+		return nil
+	})
+}
+
+func (us userStorage) Read(ctx context.Context, id string) (CSFiles, error) {
+	fs, err := us.Storage.Read(ctx, us.id(ctx, id))
+	return us.files(ctx, fs), err
+}
+
+func (us userStorage) Open(ctx context.Context, id string) (*CSReader, error) {
+	return us.Storage.Open(ctx, us.id(ctx, id))
+}
+
+func (us userStorage) Versions(ctx context.Context, id string) (CSFiles, error) {
+	fs, err := us.Storage.Versions(ctx, us.id(ctx, id))
+	return us.files(ctx, fs), err
+}
+
+func (us userStorage) OpenVersion(ctx context.Context, id string, generation int64) (*CSReader, error) {
+	return us.Storage.OpenVersion(ctx, us.id(ctx, id), generation)
+}
+
+func (us userStorage) Create(ctx context.Context, name string, file multipart.File, opts CreateOptions) (CSFile, error) {
+	f, err := us.Storage.Create(ctx, us.id(ctx, name), file, opts)
+	return us.file(ctx, f), err
+}
+
+func (us userStorage) Replace(ctx context.Context, id, filename string, file multipart.File, metadata map[string]string, generation int64) error {
+	return us.Storage.Replace(ctx, us.id(ctx, id), filename, file, metadata, generation)
+}
+
+func (us userStorage) Delete(ctx context.Context, id string, generation int64) error {
+	return us.Storage.Delete(ctx, us.id(ctx, id), generation)
+}
+
+func (us userStorage) Rename(ctx context.Context, id, newID string, overwrite bool) error {
+	return us.Storage.Rename(ctx, us.id(ctx, id), us.id(ctx, newID), overwrite)
+}
+
+func (us userStorage) Copy(ctx context.Context, id, newID string, overwrite bool) error {
+	return us.Storage.Copy(ctx, us.id(ctx, id), us.id(ctx, newID), overwrite)
+}
+
+func (us userStorage) Trash(ctx context.Context, id string, deleted time.Time, generation int64) error {
+	return us.Storage.Trash(ctx, us.id(ctx, id), deleted, generation)
+}
+
+func (us userStorage) Restore(ctx context.Context, id string) error {
+	return us.Storage.Restore(ctx, us.id(ctx, id))
+}
+
+func (us userStorage) ListTrash(ctx context.Context) (CSFiles, error) {
+	fs, err := us.Storage.ListTrash(ctx)
+	return us.files(ctx, fs), err
+}
+
+func (us userStorage) Purge(ctx context.Context, id string) error {
+	return us.Storage.Purge(ctx, us.id(ctx, id))
+}
+
+func (us userStorage) SignedURL(ctx context.Context, id string, expires time.Time) (string, error) {
+	return us.Storage.SignedURL(ctx, us.id(ctx, id), expires)
+}
+
+func (us userStorage) SignedUploadURL(ctx context.Context, name, contentType string, expires time.Time) (string, error) {
+	return us.Storage.SignedUploadURL(ctx, us.id(ctx, name), contentType, expires)
+}
+
+func (us userStorage) PutObject(ctx context.Context, name string, r io.Reader, contentType string) error {
+	return us.Storage.PutObject(ctx, us.object(ctx, name), r, contentType)
+}
+
+func (us userStorage) OpenObject(ctx context.Context, name string) (*CSReader, error) {
+	return us.Storage.OpenObject(ctx, us.object(ctx, name))
+}
+
+func (us userStorage) UpdateMetadata(ctx context.Context, name string, metadata map[string]string) error {
+	return us.Storage.UpdateMetadata(ctx, us.object(ctx, name), metadata)
+}
+
+func (us userStorage) DeleteObject(ctx context.Context, name string) error {
+	return us.Storage.DeleteObject(ctx, us.object(ctx, name))
+}
+
+func (us userStorage) ListObjects(ctx context.Context, dir string) (CSFiles, error) {
+	fs, err := us.Storage.ListObjects(ctx, us.object(ctx, dir))
+	return us.files(ctx, fs), err
+}
+
+func (us userStorage) DeleteObjects(ctx context.Context, dir string) error {
+	return us.Storage.DeleteObjects(ctx, us.object(ctx, dir))
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+// minWidth and minHeight are the smallest an upload can be, from MIN_WIDTH
+// and MIN_HEIGHT, 0 for no minimum. maxPixels is the most pixels it can
+// have, from MAX_PIXELS, so that a file that is small on disk can't decode
+// to an image too big to hold in memory.
+var (
+	minWidth, minHeight int
+	maxPixels           int64 = 50 * 1000 * 1000
+)
+
+// checkNotEmpty turns away a file with nothing in it, which is what a client
+// with a bad file handle sends. On failure it returns the status to respond
+// with. file is rewound so it can be read again from the start.
+func checkNotEmpty(file multipart.File) (int, error) {
+	n, err := file.Read(make([]byte, 1))
+	if err != nil && err != io.EOF {
+		return http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error reading file: %v", err)
+	}
+	if n == 0 {
+		return http.StatusBadRequest, fmt.Errorf("empty file: got 0 bytes")
+	}
+
+	return http.StatusOK, nil
+}
+
+// checkPixels checks the dimensions of an image against maxPixels.
+func checkPixels(width, height int) error {
+	if n := int64(width) * int64(height); n > maxPixels {
+		return fmt.Errorf("image too large: %dx%d is %d pixels, over the maximum of %d", width, height, n, maxPixels)
+	}
+	return nil
+}
+
+// checkDimensions reads the dimensions of file from its header, without
+// decoding it, and checks them against the minimums and maxPixels. On
+// failure it returns the status to respond with. Files whose dimensions
+// can't be read are let through, to fail wherever they would have. file is
+// rewound so it can be read again from the start.
+func checkDimensions(file multipart.File) (int, error) {
+	cfg, _, err := image.DecodeConfig(file)
+	if _, serr := file.Seek(0, io.SeekStart); serr != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error reading file: %v", serr)
+	}
+	if err != nil {
+		return http.StatusOK, nil
+	}
+
+	if err := checkPixels(cfg.Width, cfg.Height); err != nil {
+		return http.StatusRequestEntityTooLarge, err
+	}
+	if cfg.Width < minWidth {
+		return http.StatusBadRequest, fmt.Errorf("image too small: %d pixels wide, under the minimum width of %d", cfg.Width, minWidth)
+	}
+	if cfg.Height < minHeight {
+		return http.StatusBadRequest, fmt.Errorf("image too small: %d pixels high, under the minimum height of %d", cfg.Height, minHeight)
+	}
+
+	return http.StatusOK, nil
+}
+
+// decodeImage decodes the image in r, as image.Decode does, once the
+// dimensions in its header have been checked against maxPixels, so that a
+// decompression bomb fails before it is decoded.
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	var head bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &head))
+	if err == nil {
+		if err := checkPixels(cfg.Width, cfg.Height); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// What was read of the header, then the rest. A header that couldn't
+	// be read fails again here, saying what is wrong with it.
+	return image.Decode(io.MultiReader(&head, r))
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	byteorder "encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pngOf encodes a blank PNG of width by height. With claimed set, its header
+// claims those dimensions instead, as a decompression bomb's would.
+func pngOf(t *testing.T, width, height int, claimed image.Point) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("could not encode test image: %s", err)
+	}
+	data := buf.Bytes()
+	if claimed != (image.Point{}) {
+		// The signature, then the IHDR chunk's length and type, then its
+		// width, height, the rest of it and its checksum.
+		byteorder.BigEndian.PutUint32(data[16:], uint32(claimed.X))
+		byteorder.BigEndian.PutUint32(data[20:], uint32(claimed.Y))
+		byteorder.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	}
+	return data
+}
+
+func TestUploadValidation(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	oldWidth, oldHeight := minWidth, minHeight
+	minWidth, minHeight = 20, 10
+	defer func() { minWidth, minHeight = oldWidth, oldHeight }()
+
+	for name, c := range map[string]struct {
+		content []byte
+		want    int
+		msg     string
+	}{
+		"empty":  {nil, http.StatusBadRequest, "empty file: got 0 bytes"},
+		"narrow": {pngOf(t, 10, 40, image.Point{}), http.StatusBadRequest, "10 pixels wide, under the minimum width of 20"},
+		"short":  {pngOf(t, 40, 5, image.Point{}), http.StatusBadRequest, "5 pixels high, under the minimum height of 10"},
+		"bomb":   {pngOf(t, 40, 40, image.Pt(100000, 100000)), http.StatusRequestEntityTooLarge, "100000x100000 is 10000000000 pixels, over the maximum of 50000000"},
+		"fine":   {pngOf(t, 20, 10, image.Point{}), http.StatusCreated, ""},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", name+".png", "image/png", c.content))
+		if w.Code != c.want || !strings.Contains(w.Body.String(), c.msg) {
+			t.Errorf("%s: expected: %v %q, got: %v %s", name, c.want, c.msg, w.Code, w.Body.String())
+		}
+	}
+
+	// However the upload comes.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newRawPutRequest("/api/v1/image/raw", "image/png", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "empty file") {
+		t.Errorf("expected: %v, got: %v %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, newUploadRequest(t, http.MethodPut, "/api/v1/image/fine", "fine.png", "image/png", pngOf(t, 10, 10, image.Point{})))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "minimum width") {
+		t.Errorf("expected: %v, got: %v %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	if img, format, err := decodeImage(bytes.NewReader(pngOf(t, 40, 30, image.Point{}))); err != nil || format != "png" || img.Bounds().Dx() != 40 {
+		t.Fatalf("expected a 40 pixel wide PNG, got: %v %v", format, err)
+	}
+
+	// Everything that decodes an image turns away a bomb before it does.
+	bomb := pngOf(t, 40, 40, image.Pt(100000, 100000))
+	if _, _, err := decodeImage(bytes.NewReader(bomb)); err == nil || !strings.Contains(err.Error(), "image too large") {
+		t.Fatalf("expected the image to be too large, got: %v", err)
+	}
+	server := NewServer(NewMemoryStorage())
+	if _, _, err := server.transformImage(context.Background(), bomb, []transformOp{{rotate: 90}}); err == nil {
+		t.Fatalf("expected an error transforming")
+	}
+	if _, _, err := server.resizeImage(context.Background(), bomb, resizeOptions{Width: 10}); err == nil {
+		t.Fatalf("expected an error resizing")
+	}
+	if _, _, err := makeThumbnail(bytes.NewReader(bomb), 10); err == nil {
+		t.Fatalf("expected an error making a thumbnail")
+	}
+	if _, err := perceptualHash(bytes.NewReader(bomb)); err == nil {
+		t.Fatalf("expected an error hashing")
+	}
+	if _, _, ok := placeholders(bytes.NewReader(bomb)); ok {
+		t.Fatalf("expected no placeholders")
+	}
+}
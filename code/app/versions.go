@@ -0,0 +1,214 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ImageVersion is one generation of an image's original that the bucket
+// has kept.
+type ImageVersion struct {
+	Generation  int64     `json:"generation,string"`
+	SizeBytes   int64     `json:"sizeBytes"`
+	ContentType string    `json:"contentType,omitempty"`
+	Created     time.Time `json:"created"`
+	Current     bool      `json:"current"`
+	Content     string    `json:"content"`
+}
+
+// ImageVersions are the kept generations of image ID, oldest first.
+type ImageVersions struct {
+	ID       string         `json:"id"`
+	Versions []ImageVersion `json:"versions"`
+}
+
+// NewImageVersions converts the kept originals of image id to
+// ImageVersions, marking the one at current as such.
+func NewImageVersions(id string, fs CSFiles, current int64) ImageVersions {
+	vs := ImageVersions{ID: id, Versions: []ImageVersion{}}
+	for _, f := range fs {
+		vs.Versions = append(vs.Versions, ImageVersion{
+			Generation:  f.Generation,
+			SizeBytes:   f.Size,
+			ContentType: f.ContentType,
+			Created:     f.Created,
+			Current:     f.Generation == current,
+			Content:     fmt.Sprintf("/api/v1/image/%s/versions/%d/content", url.PathEscape(id), f.Generation),
+		})
+	}
+
+	return vs
+}
+
+// JSON marshalls the content of ImageVersions to json.
+func (vs ImageVersions) JSON() (string, error) {
+	bytes, err := vs.JSONBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of ImageVersions to json.
+func (vs ImageVersions) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(vs)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// generationVar parses the generation in the path of r.
+func generationVar(r *http.Request) (int64, error) {
+	g := mux.Vars(r)["generation"]
+	generation, err := strconv.ParseInt(g, 10, 64)
+	if err != nil || generation <= 0 {
+		return 0, invalidArgument(fmt.Errorf("invalid generation %q", g))
+	}
+
+	return generation, nil
+}
+
+// versionsHandler lists the generations of an image that are kept. Only a
+// bucket with object versioning keeps any, so anything else answers 501.
+func (s *Server) versionsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	fs, err := s.storage.Versions(r.Context(), id)
+	if err == ErrNotFound {
+		writeNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to list versions of %s: %w", id, err))
+		return
+	}
+
+	// A deleted image has versions but none of them is current.
+	var current int64
+	live, err := s.storage.Read(r.Context(), id)
+	if err != nil && err != ErrNotFound {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", id, err))
+		return
+	}
+	if f, ok := originalFile(live); ok {
+		current = f.Generation
+	}
+
+	writeJSON(w, NewImageVersions(id, fs, current), http.StatusOK)
+}
+
+// versionContentHandler serves the bytes of one generation of an image.
+func (s *Server) versionContentHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	generation, err := generationVar(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	obj, err := s.storage.OpenVersion(r.Context(), id, generation)
+	if err == ErrNotFound {
+		writeErrorMsg(w, http.StatusNotFound, fmt.Errorf("image id: %s has no version %d", id, generation))
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to open version %d of %s: %w", generation, id, err))
+		return
+	}
+	defer obj.Close()
+
+	writeObject(w, r, obj)
+}
+
+// restoreVersionHandler makes an old generation of an image current again
+// by writing it back over the image, along with the metadata it had then.
+// The generation written over is kept too, so a restore can be undone the
+// same way. An image that has been deleted is restored from the trash, not
+// from here.
+func (s *Server) restoreVersionHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	generation, err := generationVar(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ifGeneration, err := ifMatch(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	obj, err := s.storage.OpenVersion(r.Context(), id, generation)
+	if err == ErrNotFound {
+		writeErrorMsg(w, http.StatusNotFound, fmt.Errorf("image id: %s has no version %d", id, generation))
+		return
+	}
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to open version %d of %s: %w", generation, id, err))
+		return
+	}
+	file, err := s.stageFile(r.Context(), obj, obj.ContentType, maxUploadBytes)
+	obj.Close()
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read version %d of %s: %w", generation, id, err))
+		return
+	}
+	defer file.drop()
+
+	sum, err := contentSum(file)
+	if err != nil {
+		writeError(w, fmt.Errorf("error reading file: %w", err))
+		return
+	}
+	thumb := s.thumbnail(r.Context(), file)
+
+	if err := s.storage.Replace(r.Context(), id, obj.Filename, file, obj.Metadata, ifGeneration); err != nil {
+		if err == ErrNotFound {
+			writeNotFound(w, id)
+			return
+		}
+		writeError(w, fmt.Errorf("error restoring version %d of %s: %w", generation, id, err))
+		return
+	}
+
+	s.storeThumbnail(r.Context(), id, thumb)
+	s.dropVariants(r.Context(), id)
+	s.contents.of(r.Context()).add(id, sum)
+	s.notify(r.Context(), ImageEvent{Action: actionUpdated, ID: id, Size: obj.Size, ContentType: obj.ContentType})
+
+	fs, err := s.storage.Read(r.Context(), id)
+	if err != nil {
+		writeError(w, fmt.Errorf("failed to read files %s: %w", id, err))
+		return
+	}
+	is, _ := NewImages(fs)
+	if len(is) < 1 {
+		writeError(w, fmt.Errorf("image %s has no original after restoring it", id))
+		return
+	}
+	w.Header().Set("ETag", imageETag(is[0]))
+	writeJSON(w, is[0], http.StatusOK)
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func listVersions(t *testing.T, server *Server, id string) ImageVersions {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/"+id+"/versions", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	vs := ImageVersions{}
+	if err := json.Unmarshal(w.Body.Bytes(), &vs); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	return vs
+}
+
+func TestVersions(t *testing.T) {
+	ms := NewMemoryStorage()
+	ms.EnableVersioning()
+	if _, err := ms.Create(context.Background(), "a.png", newMemoryFile(testPNG(t)), CreateOptions{}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	server := NewServer(ms)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("could not encode PNG: %s", err)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, newRawPutRequest("/api/v1/image/a", "image/png", buf.Bytes()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	vs := listVersions(t, server, "a")
+	if len(vs.Versions) != 2 || vs.Versions[0].Current || !vs.Versions[1].Current {
+		t.Fatalf("expected the replaced version and the current one, got: %+v", vs)
+	}
+	first := vs.Versions[0]
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, first.Content, nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), testPNG(t)) {
+		t.Fatalf("expected the first version's content, got: %v", w.Code)
+	}
+
+	restore := fmt.Sprintf("/api/v1/image/a/versions/%d:restore", first.Generation)
+	r := httptest.NewRequest(http.MethodPost, restore, nil)
+	r.Header.Set("If-Match", `"1"`)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected: %v, got: %v", http.StatusPreconditionFailed, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, restore, nil))
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a/content", nil))
+	if !bytes.Equal(w.Body.Bytes(), testPNG(t)) {
+		t.Fatalf("expected the first version to be current again")
+	}
+
+	// Restoring keeps what it wrote over.
+	if vs := listVersions(t, server, "a"); len(vs.Versions) != 3 || !vs.Versions[2].Current {
+		t.Fatalf("expected 3 versions, the restored one current, got: %+v", vs)
+	}
+
+	for target, status := range map[string]int{
+		"/api/v1/image/a/versions/1/content":       http.StatusNotFound,
+		"/api/v1/image/a/versions/0/content":       http.StatusBadRequest,
+		"/api/v1/image/missing/versions":           http.StatusNotFound,
+		"/api/v1/image/missing/versions/1/content": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != status {
+			t.Fatalf("GET %s expected: %v, got: %v", target, status, w.Code)
+		}
+	}
+}
+
+func TestVersionsDisabled(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/v1/image/a/versions", nil),
+		httptest.NewRequest(http.MethodGet, "/api/v1/image/a/versions/1/content", nil),
+		httptest.NewRequest(http.MethodPost, "/api/v1/image/a/versions/1:restore", nil),
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusNotImplemented {
+			t.Fatalf("%s %s expected: %v, got: %v", r.Method, r.URL.Path, http.StatusNotImplemented, w.Code)
+		}
+		msg := ErrorMessage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil || msg.Code != codeUnimplemented {
+			t.Fatalf("expected code %s, got: %s", codeUnimplemented, w.Body.String())
+		}
+	}
+}
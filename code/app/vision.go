@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	vision "google.golang.org/api/vision/v1"
+)
+
+// likelihoods are the values SafeSearch gives for each category, from
+// least to most likely.
+var likelihoods = []string{"UNKNOWN", "VERY_UNLIKELY", "UNLIKELY", "POSSIBLE", "LIKELY", "VERY_LIKELY"}
+
+// likelihoodRank is where v comes in likelihoods, or -1 if it isn't one.
+func likelihoodRank(v string) int {
+	for i, l := range likelihoods {
+		if l == v {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// parseLikelihood reads a threshold like LIKELY, in any case.
+func parseLikelihood(v string) (string, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	if likelihoodRank(v) < 1 {
+		return "", fmt.Errorf("invalid likelihood %q: want one of %s", v, strings.Join(likelihoods[1:], ", "))
+	}
+
+	return v, nil
+}
+
+// VisionModerator checks uploads with the Cloud Vision SafeSearch API,
+// turning down those that are adult or violent with at least the
+// likelihood of its threshold.
+type VisionModerator struct {
+	images    *vision.ImagesService
+	threshold string
+}
+
+// NewVisionModerator returns a moderator that rejects uploads at least
+// threshold likely to be adult or violent.
+func NewVisionModerator(ctx context.Context, threshold string) (*VisionModerator, error) {
+	svc, err := vision.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create vision client: %s", err)
+	}
+
+	return &VisionModerator{images: svc.Images, threshold: threshold}, nil
+}
+
+// Moderate sends the upload in r to SafeSearch.
+func (m *VisionModerator) Moderate(ctx context.Context, r io.Reader, contentType string) (Verdict, error) {
+	res, err := annotate(ctx, m.images, r, &vision.Feature{Type: "SAFE_SEARCH_DETECTION"})
+	if err != nil {
+		return Verdict{}, err
+	}
+	if res.SafeSearchAnnotation == nil {
+		return Verdict{}, errors.New("vision returned no SafeSearch annotation")
+	}
+
+	return safeSearchVerdict(res.SafeSearchAnnotation, m.threshold), nil
+}
+
+// annotate has vision look for feature in the image in r. Images are sent
+// inline, which the API takes up to 10 MB of, the default upload limit.
+func annotate(ctx context.Context, images *vision.ImagesService, r io.Reader, feature *vision.Feature) (*vision.AnnotateImageResponse, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+
+	req := &vision.BatchAnnotateImagesRequest{Requests: []*vision.AnnotateImageRequest{{
+		Image:    &vision.Image{Content: base64.StdEncoding.EncodeToString(data)},
+		Features: []*vision.Feature{feature},
+	}}}
+	res, err := images.Annotate(req).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("could not call vision: %w", err)
+	}
+	if len(res.Responses) == 0 {
+		return nil, errors.New("vision returned no response")
+	}
+	if e := res.Responses[0].Error; e != nil {
+		return nil, fmt.Errorf("vision could not annotate image: %s", e.Message)
+	}
+
+	return res.Responses[0], nil
+}
+
+// safeSearchVerdict turns down images at least threshold likely to be
+// adult or violent, giving the likelihood of every category.
+func safeSearchVerdict(a *vision.SafeSearchAnnotation, threshold string) Verdict {
+	v := Verdict{Allowed: true, Scores: map[string]string{
+		"adult":    a.Adult,
+		"violence": a.Violence,
+		"racy":     a.Racy,
+		"medical":  a.Medical,
+		"spoof":    a.Spoof,
+	}}
+
+	limit := likelihoodRank(threshold)
+	for _, l := range []string{a.Adult, a.Violence} {
+		if likelihoodRank(l) >= limit {
+			v.Allowed = false
+		}
+	}
+
+	return v
+}
+
+// VisionLabeler labels images with Cloud Vision label detection.
+type VisionLabeler struct {
+	images *vision.ImagesService
+	max    int
+}
+
+// NewVisionLabeler returns a labeler that asks for up to max labels.
+func NewVisionLabeler(ctx context.Context, max int) (*VisionLabeler, error) {
+	svc, err := vision.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create vision client: %s", err)
+	}
+
+	return &VisionLabeler{images: svc.Images, max: max}, nil
+}
+
+// Label sends the image in r to label detection, which gives the labels
+// most confident first.
+func (l *VisionLabeler) Label(ctx context.Context, r io.Reader, contentType string) ([]string, error) {
+	res, err := annotate(ctx, l.images, r, &vision.Feature{Type: "LABEL_DETECTION", MaxResults: int64(l.max)})
+	if err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for _, a := range res.LabelAnnotations {
+		labels = append(labels, a.Description)
+	}
+
+	return labels, nil
+}
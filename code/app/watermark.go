@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// When images are watermarked, from WATERMARK_MODE: as they are served,
+// leaving the originals as they were, or as they are uploaded, for good.
+const (
+	watermarkServe  = "serve"
+	watermarkUpload = "upload"
+)
+
+// Where on an image the watermark goes, from WATERMARK_POSITION.
+const (
+	positionTopLeft     = "top-left"
+	positionTopRight    = "top-right"
+	positionBottomLeft  = "bottom-left"
+	positionBottomRight = "bottom-right"
+	positionCenter      = "center"
+)
+
+// watermarkPositions are the positions WATERMARK_POSITION can name.
+var watermarkPositions = []string{positionTopLeft, positionTopRight, positionBottomLeft, positionBottomRight, positionCenter}
+
+// The defaults of WATERMARK_OPACITY, WATERMARK_SCALE and
+// WATERMARK_MIN_SIZE.
+const (
+	defaultWatermarkOpacity = 0.5
+	defaultWatermarkScale   = 0.2
+	defaultWatermarkMinSize = 200
+)
+
+// validPosition reports whether position is one of watermarkPositions.
+func validPosition(position string) bool {
+	for _, p := range watermarkPositions {
+		if p == position {
+			return true
+		}
+	}
+	return false
+}
+
+// watermarkObjectPrefix marks a WATERMARK that is an object in storage,
+// rather than a file.
+const watermarkObjectPrefix = "object:"
+
+// Watermark is a logo stamped onto images: Scale times as wide as them,
+// at Position, with Opacity. Images with an edge shorter than MinSize are
+// left alone.
+type Watermark struct {
+	Image    image.Image
+	Mode     string
+	Position string
+	Opacity  float64
+	Scale    float64
+	MinSize  int
+
+	// key tells this watermark apart from others in the names of the
+	// variants made with it, so that changing it doesn't serve old ones.
+	key string
+}
+
+// LoadWatermark reads the watermark image from source: a file, or with the
+// object: prefix an object in storage.
+func LoadWatermark(ctx context.Context, source string, storage Storage) (image.Image, error) {
+	var r io.ReadCloser
+	var err error
+	if name := strings.TrimPrefix(source, watermarkObjectPrefix); name != source {
+		r, err = storage.OpenObject(ctx, name)
+	} else {
+		r, err = os.Open(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open watermark %s: %w", source, err)
+	}
+	defer r.Close()
+
+	img, _, err := decodeImage(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode watermark %s: %s", source, err)
+	}
+
+	return img, nil
+}
+
+// SetWatermark has images stamped with wm, as they are served or uploaded
+// according to its mode.
+func (s *Server) SetWatermark(wm Watermark) {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s %g %g %d", wm.Position, wm.Opacity, wm.Scale, wm.MinSize)
+	b := wm.Image.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := wm.Image.At(x, y).RGBA()
+			fmt.Fprint(h, r, g, bl, a)
+		}
+	}
+	wm.key = fmt.Sprintf("%08x", h.Sum32())
+
+	s.watermark = &wm
+}
+
+// servesWatermarked reports whether images are watermarked as they are
+// served.
+func (s *Server) servesWatermarked() bool {
+	return s.watermark != nil && s.watermark.Mode == watermarkServe
+}
+
+// apply returns img with the watermark on it, or false if it is too small
+// to take one.
+func (wm *Watermark) apply(img image.Image) (image.Image, bool) {
+	b := img.Bounds()
+	if b.Dx() < wm.MinSize || b.Dy() < wm.MinSize {
+		return img, false
+	}
+
+	mb := wm.Image.Bounds()
+	w := int(float64(b.Dx()) * wm.Scale)
+	h := w * mb.Dy() / mb.Dx()
+	if h > b.Dy() {
+		w, h = w*b.Dy()/h, b.Dy()
+	}
+	if w < 1 || h < 1 {
+		return img, false
+	}
+
+	margin := b.Dx() / 50
+	if b.Dy() < b.Dx() {
+		margin = b.Dy() / 50
+	}
+	var at image.Point
+	switch wm.Position {
+	case positionTopLeft:
+		at = image.Pt(margin, margin)
+	case positionTopRight:
+		at = image.Pt(b.Dx()-w-margin, margin)
+	case positionBottomLeft:
+		at = image.Pt(margin, b.Dy()-h-margin)
+	case positionCenter:
+		at = image.Pt((b.Dx()-w)/2, (b.Dy()-h)/2)
+	default:
+		at = image.Pt(b.Dx()-w-margin, b.Dy()-h-margin)
+	}
+
+	mark := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(mark, mark.Bounds(), wm.Image, mb, draw.Src, nil)
+
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	opacity := image.NewUniform(color.Alpha{A: uint8(wm.Opacity*255 + 0.5)})
+	draw.DrawMask(dst, mark.Bounds().Add(at), mark, image.Point{}, opacity, image.Point{}, draw.Over)
+
+	return dst, true
+}
+
+// watermarkUpload returns file, an upload, with the watermark baked into
+// it when uploads are watermarked. Uploads that can't be, because they are
+// small, animated or can't be decoded, are stored as they are.
+func (s *Server) watermarkUpload(ctx context.Context, file multipart.File) (multipart.File, error) {
+	if s.watermark == nil || s.watermark.Mode != watermarkUpload {
+		return file, nil
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if animated(data) {
+		return file, nil
+	}
+	img, format, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return file, nil
+	}
+
+	marked, ok := s.watermark.apply(img)
+	if !ok {
+		return file, nil
+	}
+	out, _, err := s.encodeAs(ctx, marked, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMemoryFile(out), nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// whiteMark is a watermark of solid white, stamped at half opacity onto
+// images with both edges at least 100 pixels.
+func whiteMark(mode string) Watermark {
+	mark := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for i := range mark.Pix {
+		mark.Pix[i] = 255
+	}
+
+	return Watermark{
+		Image:    mark,
+		Mode:     mode,
+		Position: positionBottomRight,
+		Opacity:  0.5,
+		Scale:    defaultWatermarkScale,
+		MinSize:  100,
+	}
+}
+
+func TestWatermarkApply(t *testing.T) {
+	wm := whiteMark(watermarkServe)
+
+	small := image.NewRGBA(image.Rect(0, 0, 99, 400))
+	if got, ok := wm.apply(small); ok || got != small {
+		t.Fatalf("expected a small image to be left alone")
+	}
+
+	black := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for i := 3; i < len(black.Pix); i += 4 {
+		black.Pix[i] = 255
+	}
+	got, ok := wm.apply(black)
+	if !ok {
+		t.Fatalf("expected the image to be watermarked")
+	}
+	if got.Bounds() != black.Bounds() {
+		t.Fatalf("expected bounds: %v, got: %v", black.Bounds(), got.Bounds())
+	}
+
+	// A fifth as wide as the image, inset by the margin from its bottom
+	// right corner, and half see-through.
+	for _, c := range []struct {
+		at   image.Point
+		want int
+	}{
+		{image.Pt(0, 0), 0},
+		{image.Pt(399, 199), 0},
+		{image.Pt(350, 150), 128},
+		{image.Pt(300, 150), 0},
+	} {
+		if g := int(color.GrayModel.Convert(got.At(c.at.X, c.at.Y)).(color.Gray).Y); g < c.want-2 || g > c.want+2 {
+			t.Errorf("%v: expected about %d, got: %d", c.at, c.want, g)
+		}
+	}
+}
+
+func TestWatermarkServe(t *testing.T) {
+	server, ms := newResizeServer(t)
+	server.SetWatermark(whiteMark(watermarkServe))
+	fs, _ := ms.Read(context.Background(), "wide")
+	original, _ := originalFile(fs)
+	obj, err := ms.OpenObject(context.Background(), original.Name)
+	if err != nil {
+		t.Fatalf("could not open wide: %s", err)
+	}
+	var want bytes.Buffer
+	want.ReadFrom(obj)
+	obj.Close()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content", nil))
+	if w.Code != http.StatusOK || bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+		t.Fatalf("expected a watermarked image, got: %v", w.Code)
+	}
+	if _, err := ms.OpenObject(context.Background(), variantName("wide", resizeOptions{Fit: fitInside, Watermark: server.watermark})); err != nil {
+		t.Fatalf("expected the watermarked variant to be cached, got: %s", err)
+	}
+
+	// Only admins can see past the watermark.
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content?watermark=false", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected: %v, got: %v", http.StatusUnauthorized, w.Code)
+	}
+
+	server.RequireAPIKey([]string{"secret"}, false)
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content?watermark=false", nil)
+	r.Header.Set(apiKeyHeader, "secret")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+		t.Fatalf("expected the original, got: %v", w.Code)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "private" {
+		t.Fatalf("expected: private, got: %q", cc)
+	}
+}
+
+func TestWatermarkUpload(t *testing.T) {
+	ms := NewMemoryStorage()
+	server := NewServer(ms)
+	server.SetWatermark(whiteMark(watermarkUpload))
+
+	var tiny bytes.Buffer
+	if err := png.Encode(&tiny, image.NewRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatalf("could not encode test image: %s", err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		content []byte
+		marked  bool
+	}{
+		{"photo", testPNG(t), true},
+		{"tiny", tiny.Bytes(), false},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, newUploadRequest(t, http.MethodPost, "/api/v1/image", c.name+".png", "image/png", c.content))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: expected: %v, got: %v %s", c.name, http.StatusCreated, w.Code, w.Body.String())
+		}
+
+		// Serving leaves it as it was stored.
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/"+c.name+"/content", nil))
+		if marked := !bytes.Equal(w.Body.Bytes(), c.content); marked != c.marked {
+			t.Errorf("%s: expected marked to be %v, got: %v", c.name, c.marked, marked)
+		}
+	}
+}
+
+func TestLoadConfigWatermarkErrors(t *testing.T) {
+	_, err := LoadConfig(envMap(map[string]string{
+		"WATERMARK":          "logo.png",
+		"WATERMARK_MODE":     "always",
+		"WATERMARK_POSITION": "middle",
+		"WATERMARK_OPACITY":  "1.5",
+	}))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, want := range []string{"WATERMARK_MODE", "WATERMARK_POSITION", "WATERMARK_OPACITY"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%s", want, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// signatureHeader carries the HMAC-SHA256 of a webhook body, keyed with the
+// shared secret, as "sha256=" followed by its hex.
+const signatureHeader = "X-Scaler-Signature"
+
+var (
+	// webhookQueueSize is how many deliveries can wait to be sent before
+	// new ones are dropped.
+	webhookQueueSize = 100
+	// webhookWorkers is how many deliveries are sent at once.
+	webhookWorkers = 4
+	// webhookAttempts is how many times a delivery is tried in all.
+	webhookAttempts = 3
+	// webhookBaseDelay is the wait before the first retry of a delivery,
+	// doubling for every one after.
+	webhookBaseDelay = time.Second
+	// webhookTimeout bounds each attempt at a delivery.
+	webhookTimeout = 10 * time.Second
+)
+
+// WebhookPublisher POSTs events to a set of URLs, signed so the receivers
+// can tell they came from us. Deliveries are queued and sent in the
+// background, so a slow or dead receiver holds up nothing but itself.
+type WebhookPublisher struct {
+	urls    []string
+	secret  []byte
+	client  *http.Client
+	metrics *Metrics
+
+	queue chan delivery
+	wg    sync.WaitGroup
+}
+
+// delivery is an event on its way to a single URL.
+type delivery struct {
+	url  string
+	id   string
+	body []byte
+}
+
+// NewWebhookPublisher returns a publisher sending to urls, signing with
+// secret. Deliveries that fail for good are counted in m, which can be nil.
+func NewWebhookPublisher(urls []string, secret string, m *Metrics) *WebhookPublisher {
+	p := &WebhookPublisher{
+		urls:    urls,
+		secret:  []byte(secret),
+		client:  &http.Client{},
+		metrics: m,
+		queue:   make(chan delivery, webhookQueueSize),
+	}
+
+	for n := 0; n < webhookWorkers; n++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for d := range p.queue {
+				p.deliver(d)
+			}
+		}()
+	}
+
+	return p
+}
+
+// Publish queues e for every URL. It fails if the queue is full, in which
+// case the event is dropped for the URLs it couldn't be queued for.
+func (p *WebhookPublisher) Publish(ctx context.Context, e CloudEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %s", err)
+	}
+
+	dropped := 0
+	for _, u := range p.urls {
+		select {
+		case p.queue <- delivery{url: u, id: e.ID, body: body}:
+		default:
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		return fmt.Errorf("webhook queue is full, dropped %d of %d deliveries", dropped, len(p.urls))
+	}
+
+	return nil
+}
+
+// Close waits for the deliveries already queued to be sent.
+func (p *WebhookPublisher) Close() {
+	close(p.queue)
+	p.wg.Wait()
+}
+
+// deliver sends d, trying again with backoff while the receiver fails in a
+// way that might pass.
+func (p *WebhookPublisher) deliver(d delivery) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		var retryable bool
+		if retryable, err = p.send(d); err == nil || !retryable {
+			break
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(backoff(webhookBaseDelay, attempt))
+		}
+	}
+
+	if err != nil {
+		weblog(fmt.Sprintf("error delivering event %s to webhook %s: %s", d.id, d.url, err))
+		p.metrics.webhookFailed()
+	}
+}
+
+// send makes a single attempt at d, reporting whether a failure is worth
+// trying again.
+func (p *WebhookPublisher) send(d delivery) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return false, fmt.Errorf("could not create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=UTF-8")
+	req.Header.Set(signatureHeader, sign(p.secret, d.body))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
+
+// sign returns the signature of body for the signature header.
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
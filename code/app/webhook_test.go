@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func setWebhookRetries(t *testing.T, attempts int) {
+	t.Helper()
+	oldAttempts, oldDelay := webhookAttempts, webhookBaseDelay
+	webhookAttempts, webhookBaseDelay = attempts, time.Millisecond
+	t.Cleanup(func() { webhookAttempts, webhookBaseDelay = oldAttempts, oldDelay })
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	setWebhookRetries(t, 3)
+
+	type test struct {
+		statuses []int
+		calls    int
+		failures float64
+	}
+
+	tests := map[string]test{
+		"delivered": {statuses: []int{http.StatusOK}, calls: 1},
+		"retried":   {statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent}, calls: 3},
+		"gave up":   {statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, calls: 3, failures: 1},
+		"rejected":  {statuses: []int{http.StatusBadRequest}, calls: 1, failures: 1},
+	}
+
+	for name, c := range tests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			calls := 0
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if got, want := r.Header.Get(signatureHeader), sign([]byte("shh"), body); got != want {
+					t.Errorf("expected signature: %v, got: %v", want, got)
+				}
+
+				var e CloudEvent
+				if err := json.Unmarshal(body, &e); err != nil || e.Data.ID != "a" {
+					t.Errorf("expected an event for a, got: %s", body)
+				}
+
+				mu.Lock()
+				status := c.statuses[calls]
+				calls++
+				mu.Unlock()
+				w.WriteHeader(status)
+			}))
+			defer receiver.Close()
+
+			m := NewMetrics()
+			p := NewWebhookPublisher([]string{receiver.URL}, "shh", m)
+			if err := p.Publish(context.Background(), NewCloudEvent(ImageEvent{Action: actionCreated, ID: "a"})); err != nil {
+				t.Fatalf("expected no error, got: %s", err)
+			}
+			p.Close()
+
+			if calls != c.calls {
+				t.Fatalf("expected: %v calls, got: %v", c.calls, calls)
+			}
+			if got := testutil.ToFloat64(m.webhooks); got != c.failures {
+				t.Fatalf("expected: %v failures, got: %v", c.failures, got)
+			}
+		})
+	}
+}
+
+func TestWebhookPublisherQueueFull(t *testing.T) {
+	oldSize, oldWorkers := webhookQueueSize, webhookWorkers
+	webhookQueueSize, webhookWorkers = 1, 0
+	t.Cleanup(func() { webhookQueueSize, webhookWorkers = oldSize, oldWorkers })
+
+	p := NewWebhookPublisher([]string{"http://example.com/a", "http://example.com/b"}, "shh", nil)
+	if err := p.Publish(context.Background(), NewCloudEvent(ImageEvent{Action: actionDeleted, ID: "a"})); err == nil {
+		t.Fatalf("expected an error when the queue is full, got none")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webpTimeout bounds how long an encoder can take over one image.
+const webpTimeout = 30 * time.Second
+
+// errWebPDisabled turns away requests for WebP when there is nothing to
+// encode it with.
+var errWebPDisabled = errors.New("WebP output isn't supported: WebP encoding isn't enabled on this server")
+
+// WebPEncoder encodes images as WebP, which neither the standard library
+// nor golang.org/x/image can write. A quality of 100 asks for lossless
+// WebP.
+type WebPEncoder interface {
+	EncodeWebP(ctx context.Context, img image.Image, quality int) ([]byte, error)
+}
+
+// SetWebPEncoder has images converted to WebP with e when it is asked for,
+// or when browsers accept it and no other format is. WebP originals stay
+// WebP when they are transformed. Without one, ?format=webp is refused and
+// WebP originals become PNGs.
+func (s *Server) SetWebPEncoder(e WebPEncoder) {
+	s.webp = e
+}
+
+// CommandWebPEncoder encodes with a program run as
+// `Path -quiet -q quality in -o out`, or with -lossless in place of -q for
+// a quality of 100, such as libwebp's cwebp.
+type CommandWebPEncoder struct {
+	Path string
+}
+
+// NewCommandWebPEncoder returns a CommandWebPEncoder for the program at
+// path, or by that name on the PATH.
+func NewCommandWebPEncoder(path string) (*CommandWebPEncoder, error) {
+	p, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not find %s: %w", path, err)
+	}
+
+	return &CommandWebPEncoder{Path: p}, nil
+}
+
+// EncodeWebP writes img to a PNG for the program to encode, and returns
+// the WebP it writes.
+func (e *CommandWebPEncoder) EncodeWebP(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "webp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.webp")
+	f, err := os.Create(in)
+	if err != nil {
+		return nil, err
+	}
+	err = png.Encode(f, img)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-quiet", "-q", strconv.Itoa(quality)}
+	if quality >= 100 {
+		args = []string{"-quiet", "-lossless"}
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Path, append(args, in, "-o", out)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	return os.ReadFile(out)
+}
+
+// encodeWebP encodes img as WebP at quality with the server's encoder.
+func (s *Server) encodeWebP(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	if s.webp == nil {
+		return nil, errWebPDisabled
+	}
+
+	ctx, span := startSpan(ctx, "encodeWebP")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, webpTimeout)
+	defer cancel()
+
+	data, err := s.webp.EncodeWebP(ctx, img, quality)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode image: %s", err)
+	}
+
+	return data, nil
+}
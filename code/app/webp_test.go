@@ -0,0 +1,179 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testWebP stands in for what an encoder writes. It is smaller than any
+// image it is made from in these tests.
+var testWebP = []byte("RIFF\x0c\x00\x00\x00WEBPVP8L")
+
+// fakeWebPEncoder encodes anything as webp, or fails with err.
+type fakeWebPEncoder struct {
+	webp []byte
+	err  error
+}
+
+func (e fakeWebPEncoder) EncodeWebP(ctx context.Context, img image.Image, quality int) ([]byte, error) {
+	return e.webp, e.err
+}
+
+func TestConvertedContentWebP(t *testing.T) {
+	server, ms := newResizeServer(t)
+
+	// Without an encoder WebP is refused when asked for, and isn't offered.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content?format=webp", nil))
+	if w.Code != http.StatusNotImplemented || !strings.Contains(w.Body.String(), "WebP encoding isn't enabled") {
+		t.Fatalf("expected: %v, got: %v %s", http.StatusNotImplemented, w.Code, w.Body.String())
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content", nil)
+	r.Header.Set("Accept", "image/webp,*/*")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Vary") != "" {
+		t.Fatalf("expected the PNG, got: %v %s %q", w.Code, w.Header().Get("Content-Type"), w.Header().Values("Vary"))
+	}
+
+	server.SetWebPEncoder(fakeWebPEncoder{webp: testWebP})
+	for _, c := range []struct {
+		query, accept, want string
+	}{
+		{"format=webp", "", "image/webp"},
+		{"format=jpeg&quality=50", "image/webp", "image/jpeg"},
+		{"format=png&w=10", "image/webp", "image/png"},
+		{"w=10", "image/webp,*/*", "image/webp"},
+		{"", "image/avif,image/webp,*/*", "image/webp"},
+		{"", "image/webp;q=0", "image/png"},
+		{"", "*/*", "image/png"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content?"+c.query, nil)
+		r.Header.Set("Accept", c.accept)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != c.want {
+			t.Fatalf("%s %s: expected: %s, got: %v %s", c.query, c.accept, c.want, w.Code, w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("%s %s: expected Vary: Accept, got: %q", c.query, c.accept, w.Header().Values("Vary"))
+		}
+		if c.want == "image/webp" && !bytes.Equal(w.Body.Bytes(), testWebP) {
+			t.Errorf("%s %s: expected the encoded WebP, got: %q", c.query, c.accept, w.Body.Bytes())
+		}
+	}
+
+	for _, opts := range []resizeOptions{
+		{Fit: fitInside, Format: formatWebP, Quality: defaultQuality},
+		{Width: 10, Fit: fitInside, Format: formatWebP, Quality: defaultQuality, Negotiated: true},
+		{Fit: fitInside, Format: formatWebP, Quality: defaultQuality, Negotiated: true},
+	} {
+		if _, err := ms.OpenObject(context.Background(), variantName("wide", opts)); err != nil {
+			t.Errorf("expected %s to be cached, got: %s", variantName("wide", opts), err)
+		}
+	}
+
+	// A failed conversion that was asked for is an error; a negotiated one
+	// falls back on the original.
+	server, _ = newResizeServer(t)
+	server.SetWebPEncoder(fakeWebPEncoder{err: errors.New("bad image")})
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content", nil)
+	r.Header.Set("Accept", "image/webp")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("expected the original, got: %v %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestConvertedContentWebPNotSmaller(t *testing.T) {
+	server, ms := newResizeServer(t)
+	server.SetWebPEncoder(fakeWebPEncoder{webp: make([]byte, 1<<20)})
+	original, err := ms.OpenObject(context.Background(), "processed/wide/original.png")
+	if err != nil {
+		t.Fatalf("could not open test image: %s", err)
+	}
+	defer original.Close()
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/image/wide/content", nil)
+		r.Header.Set("Accept", "image/webp")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || int64(w.Body.Len()) != original.Size {
+			t.Fatalf("expected the original, got: %v %s %d bytes", w.Code, w.Header().Get("Content-Type"), w.Body.Len())
+		}
+	}
+}
+
+func TestEncodeAsWebP(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+
+	// A WebP can only stay one with an encoder.
+	if _, contentType, err := server.encodeAs(context.Background(), img, "webp"); err != nil || contentType != "image/png" {
+		t.Fatalf("expected a PNG, got: %s %v", contentType, err)
+	}
+	server.SetWebPEncoder(fakeWebPEncoder{webp: testWebP})
+	data, contentType, err := server.encodeAs(context.Background(), img, "webp")
+	if err != nil || contentType != "image/webp" || !bytes.Equal(data, testWebP) {
+		t.Fatalf("expected the encoded WebP, got: %s %v", contentType, err)
+	}
+}
+
+func TestCommandWebPEncoder(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "encoded.webp")
+	if err := os.WriteFile(src, testWebP, 0o644); err != nil {
+		t.Fatalf("could not write test image: %s", err)
+	}
+	// Stands in for cwebp: -quiet -q 85 in -o out, or -quiet -lossless in
+	// -o out.
+	script := filepath.Join(dir, "cwebp")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n[ \"$1\" = -quiet ] || exit 1\nshift\n[ \"$1\" = -q ] && shift\nshift\n[ -s \"$1\" ] && [ \"$2\" = -o ] && cp "+src+" \"$3\"\n"), 0o755); err != nil {
+		t.Fatalf("could not write test script: %s", err)
+	}
+
+	e, err := NewCommandWebPEncoder(script)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for _, quality := range []int{defaultQuality, 100} {
+		got, err := e.EncodeWebP(context.Background(), img, quality)
+		if err != nil || !bytes.Equal(got, testWebP) {
+			t.Fatalf("quality %d: expected the WebP, got: %d bytes, %v", quality, len(got), err)
+		}
+	}
+	if _, err := e.EncodeWebP(context.Background(), image.NewRGBA(image.Rect(0, 0, 0, 0)), defaultQuality); err == nil {
+		t.Fatalf("expected an error for a failed encoding")
+	}
+
+	if _, err := NewCommandWebPEncoder(filepath.Join(dir, "missing")); err == nil {
+		t.Fatalf("expected an error for a missing program")
+	}
+}
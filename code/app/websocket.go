@@ -0,0 +1,289 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketPath is where clients follow changes over a WebSocket.
+const socketPath = "/api/v1/ws"
+
+// maxSocketMessageBytes bounds the commands a client can send.
+const maxSocketMessageBytes = 4 << 10
+
+// socketWriteWait bounds how long a write to a client can take, so that
+// one that has stopped reading can't hold its connection open.
+const socketWriteWait = 10 * time.Second
+
+// socketPingInterval is how often a client is pinged. One that sends
+// nothing back, not even a pong, for twice that long is disconnected.
+var socketPingInterval = 30 * time.Second
+
+// SocketCommand is what a client can send: subscribe, to only be told of
+// images whose id starts with Prefix, picking up after LastEventID if it
+// is set, and ping.
+type SocketCommand struct {
+	Type        string `json:"type"`
+	Prefix      string `json:"prefix,omitempty"`
+	LastEventID string `json:"lastEventId,omitempty"`
+}
+
+// SocketMessage is what a client is sent: a change to an image, typed by
+// its action as the server-sent events are, a reset if changes were
+// missed, or the answer to a command, which is subscribed, pong or error.
+type SocketMessage struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	Image  *Image `json:"image,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// clientMessage is a message read from a client.
+type clientMessage struct {
+	kind int
+	data []byte
+}
+
+// writeMessage writes m to conn as a text message, giving up after
+// socketWriteWait.
+func writeMessage(conn *websocket.Conn, m SocketMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+	return conn.WriteJSON(m)
+}
+
+// writeClose sends conn a close message with code and reason.
+func writeClose(conn *websocket.Conn, code int, reason string) error {
+	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(socketWriteWait))
+}
+
+// unwrapHijacker finds the writer that can take over the connection behind
+// w, looking through the writers middleware wraps it in.
+func unwrapHijacker(w http.ResponseWriter) (http.ResponseWriter, error) {
+	for {
+		if _, ok := w.(http.Hijacker); ok {
+			return w, nil
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, errors.New("connection can't be taken over")
+		}
+		w = u.Unwrap()
+	}
+}
+
+// checkSocketOrigin reports whether the page r comes from, if it comes from
+// one, can connect: one from an origin CORS allows or, without CORS, from
+// the server's own host.
+func (s *Server) checkSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if s.socketOrigins != nil {
+		return s.socketOrigins(origin)
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// socketHandler upgrades the request to a WebSocket pushing the same
+// changes the server-sent events do, from the same bus, and taking the
+// commands in SocketCommand. Pages can only connect from the origins CORS
+// allows. A single goroutine writes to the connection, so that answers and
+// changes never interleave, while another reads from it. Reads are backed
+// up to the client while the writer is busy, and a client too slow to keep
+// up with the changes is dropped with a close it can come back from using
+// the id of the last change it saw.
+func (s *Server) socketHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case !websocket.IsWebSocketUpgrade(r) || r.Header.Get("Sec-WebSocket-Key") == "":
+		writeError(w, invalidArgument(errors.New("expected a WebSocket handshake")))
+		return
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeErrorMsg(w, http.StatusUpgradeRequired, errors.New("only WebSocket version 13 is supported"))
+		return
+	}
+
+	hw, err := unwrapHijacker(w)
+	if err != nil {
+		writeErrorMsg(w, http.StatusInternalServerError, err)
+		return
+	}
+	scope := scopeOf(r.Context())
+	sub, _, err := s.events.subscribe(scope, "")
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(eventRetry.Seconds())))
+		writeErrorMsg(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout: socketWriteWait,
+		CheckOrigin:      s.checkSocketOrigin,
+		Error: func(_ http.ResponseWriter, _ *http.Request, status int, reason error) {
+			writeErrorMsg(w, status, reason)
+		},
+	}
+	conn, err := upgrader.Upgrade(hw, r, nil)
+	if err != nil {
+		// The upgrader has answered already.
+		s.events.unsubscribe(sub)
+		return
+	}
+	defer conn.Close()
+
+	s.sockets.Add(1)
+	defer s.sockets.Done()
+	s.metrics.subscribed("websocket")
+	defer s.metrics.unsubscribed("websocket")
+
+	in := make(chan clientMessage, 8)
+	done := make(chan struct{})
+	var reading sync.WaitGroup
+	reading.Add(1)
+	go func() {
+		defer reading.Done()
+		readSocket(conn, in, done)
+	}()
+
+	s.serveSocket(conn, scope, sub, in)
+	close(done)
+	conn.Close()
+	reading.Wait()
+}
+
+// readSocket hands the messages read from conn to in until the client
+// closes the connection or goes quiet for two ping intervals. Anything from
+// the client, pongs included, shows it is still there. Pings and closes are
+// answered as they are read, and in is closed once nothing more is to
+// come. Sends give up once done is closed.
+func readSocket(conn *websocket.Conn, in chan<- clientMessage, done <-chan struct{}) {
+	defer close(in)
+
+	conn.SetReadLimit(maxSocketMessageBytes)
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * socketPingInterval))
+	})
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * socketPingInterval))
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		select {
+		case in <- clientMessage{kind, data}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// serveSocket writes to conn until the client goes or the bus lets it go,
+// pinging it every socketPingInterval, sending it the changes in scope
+// that sub yields and answering what readSocket hands over on in.
+func (s *Server) serveSocket(conn *websocket.Conn, scope string, sub *subscriber, in <-chan clientMessage) {
+	defer func() { s.events.unsubscribe(sub) }()
+
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+
+	prefix := ""
+	send := func(e busEvent) error {
+		if e.action == actionReset {
+			return writeMessage(conn, SocketMessage{Type: actionReset, ID: s.events.id(e.seq)})
+		}
+		if !strings.HasPrefix(e.image.ID, prefix) {
+			return nil
+		}
+		img := e.image
+		return writeMessage(conn, SocketMessage{Type: e.action, ID: s.events.id(e.seq), Image: &img})
+	}
+
+	for {
+		var err error
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			if m.kind != websocket.TextMessage {
+				err = writeMessage(conn, SocketMessage{Type: "error", Error: "commands are sent as text"})
+				break
+			}
+			cmd := SocketCommand{}
+			if jerr := json.Unmarshal(m.data, &cmd); jerr != nil {
+				err = writeMessage(conn, SocketMessage{Type: "error", Error: fmt.Sprintf("invalid command: %s", jerr)})
+				break
+			}
+			switch cmd.Type {
+			case "ping":
+				err = writeMessage(conn, SocketMessage{Type: "pong"})
+			case "subscribe":
+				prefix = cmd.Prefix
+				var missed []busEvent
+				if cmd.LastEventID != "" {
+					s.events.unsubscribe(sub)
+					if sub, missed, err = s.events.subscribe(scope, cmd.LastEventID); err != nil {
+						writeClose(conn, websocket.CloseGoingAway, err.Error())
+						return
+					}
+				}
+				err = writeMessage(conn, SocketMessage{Type: "subscribed", Prefix: prefix})
+				for _, e := range missed {
+					if err == nil {
+						err = send(e)
+					}
+				}
+			default:
+				err = writeMessage(conn, SocketMessage{Type: "error", Error: fmt.Sprintf("unknown command %q: want subscribe or ping", cmd.Type)})
+			}
+		case e, ok := <-sub.events:
+			if !ok {
+				if sub.evicted {
+					s.metrics.evicted("websocket")
+					writeClose(conn, websocket.CloseTryAgainLater, "too slow to keep up with changes")
+				} else {
+					writeClose(conn, websocket.CloseGoingAway, "server is shutting down")
+				}
+				return
+			}
+			err = send(e)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WaitForSockets blocks until every WebSocket has been closed, as they all
+// are once CloseEvents has been called.
+func (s *Server) WaitForSockets() {
+	s.sockets.Wait()
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialSocket connects to the WebSocket of ts, from a page at origin if it
+// isn't "", returning the response to the handshake if it fails.
+func dialSocket(t *testing.T, ts *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+
+	h := http.Header{}
+	if origin != "" {
+		h.Set("Origin", origin)
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+socketPath, h)
+	if err != nil {
+		return nil, resp, err
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return ws, resp, nil
+}
+
+// mustDialSocket connects to the WebSocket of ts.
+func mustDialSocket(t *testing.T, ts *httptest.Server) *websocket.Conn {
+	t.Helper()
+
+	ws, _, err := dialSocket(t, ts, "")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	return ws
+}
+
+// command sends cmd over ws and returns the next message.
+func command(t *testing.T, ws *websocket.Conn, cmd interface{}) SocketMessage {
+	t.Helper()
+
+	if err := ws.WriteJSON(cmd); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	return receive(t, ws)
+}
+
+func receive(t *testing.T, ws *websocket.Conn) SocketMessage {
+	t.Helper()
+
+	m := SocketMessage{}
+	if err := ws.ReadJSON(&m); err != nil {
+		t.Fatalf("expected a message, got: %s", err)
+	}
+	return m
+}
+
+func TestSocket(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	ws := mustDialSocket(t, ts)
+	defer ws.Close()
+
+	if m := command(t, ws, SocketCommand{Type: "ping"}); m.Type != "pong" {
+		t.Fatalf("expected a pong, got: %+v", m)
+	}
+	for _, cmd := range []interface{}{"nonsense", SocketCommand{Type: "shout"}} {
+		if m := command(t, ws, cmd); m.Type != "error" || m.Error == "" {
+			t.Fatalf("expected an error, got: %+v", m)
+		}
+	}
+
+	if m := command(t, ws, SocketCommand{Type: "subscribe", Prefix: "b"}); m.Type != "subscribed" || m.Prefix != "b" {
+		t.Fatalf("expected to be subscribed to b, got: %+v", m)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		server.ServeHTTP(httptest.NewRecorder(), newUploadRequest(t, http.MethodPost, "/api/v1/image?force=true", name, "image/png", testPNG(t)))
+	}
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/api/v1/image/b", nil))
+
+	created := receive(t, ws)
+	if created.Type != actionCreated || created.Image == nil || created.Image.ID != "b" || created.ID == "" {
+		t.Fatalf("expected b to be created, got: %+v", created)
+	}
+	if m := receive(t, ws); m.Type != actionDeleted || m.Image.ID != "b" {
+		t.Fatalf("expected b to be deleted, got: %+v", m)
+	}
+
+	// Subscribing again from an earlier change replays what came after it.
+	if m := command(t, ws, SocketCommand{Type: "subscribe", LastEventID: created.ID}); m.Type != "subscribed" {
+		t.Fatalf("expected to be subscribed, got: %+v", m)
+	}
+	if m := receive(t, ws); m.Type != actionDeleted || m.Image.ID != "b" {
+		t.Fatalf("expected the delete of b to be replayed, got: %+v", m)
+	}
+}
+
+func TestSocketHandshake(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, socketPath, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected: %v, got: %v", http.StatusBadRequest, w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, socketPath, nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", "8")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusUpgradeRequired || w.Header().Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("expected: %v, got: %v", http.StatusUpgradeRequired, w.Code)
+	}
+}
+
+func TestSocketOrigin(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// Without CORS, only pages from the server itself.
+	if _, resp, err := dialSocket(t, ts, "https://evil.example.com"); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected: %v, got: %v", http.StatusForbidden, err)
+	}
+	ws, _, err := dialSocket(t, ts, ts.URL)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	ws.Close()
+
+	server.EnableCORS([]string{"https://*.example.com"}, corsHeaders, corsMethods)
+	for origin, want := range map[string]bool{
+		"https://app.example.com": true,
+		"https://evil.test":       false,
+		"":                        true,
+	} {
+		ws, resp, err := dialSocket(t, ts, origin)
+		if want && err != nil || !want && (err == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Fatalf("%q expected allowed: %v, got: %v", origin, want, err)
+		}
+		if ws != nil {
+			ws.Close()
+		}
+	}
+}
+
+func TestSocketShutdown(t *testing.T) {
+	server := NewServer(NewMemoryStorage())
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	ws := mustDialSocket(t, ts)
+	defer ws.Close()
+	if m := command(t, ws, SocketCommand{Type: "ping"}); m.Type != "pong" {
+		t.Fatalf("expected a pong, got: %+v", m)
+	}
+
+	server.CloseEvents()
+	m := SocketMessage{}
+	if err := ws.ReadJSON(&m); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected the socket to be closed, got: %v %+v", err, m)
+	}
+	server.WaitForSockets()
+}
+
+func TestSocketTooBig(t *testing.T) {
+	ts := httptest.NewServer(NewServer(NewMemoryStorage()))
+	defer ts.Close()
+	ws := mustDialSocket(t, ts)
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, make([]byte, maxSocketMessageBytes+1)); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected the socket to be closed, got: %v", err)
+	}
+}
+
+func TestSocketKeepAlive(t *testing.T) {
+	defer func(d time.Duration) { socketPingInterval = d }(socketPingInterval)
+	socketPingInterval = 20 * time.Millisecond
+
+	ts := httptest.NewServer(NewServer(NewMemoryStorage()))
+	defer ts.Close()
+	ws := mustDialSocket(t, ts)
+	defer ws.Close()
+
+	// A client that answers the pings is kept.
+	pinged := make(chan struct{}, 16)
+	ws.SetPingHandler(func(data string) error {
+		pinged <- struct{}{}
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go ws.ReadMessage()
+	for i := 0; i < 5; i++ {
+		select {
+		case <-pinged:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected to be pinged")
+		}
+	}
+	ws.Close()
+
+	// One that never answers them is let go.
+	ws = mustDialSocket(t, ts)
+	defer ws.Close()
+	ws.SetPingHandler(func(string) error { return nil })
+	start := time.Now()
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatalf("expected the connection to be closed")
+	}
+	if time.Since(start) < 2*socketPingInterval {
+		t.Fatalf("expected the client to be given two ping intervals")
+	}
+}
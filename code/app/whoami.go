@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/google/uuid"
+)
+
+// servedByHeader names the process that answered a request, once
+// EnableServedBy has been called.
+const servedByHeader = "X-Served-By"
+
+// Instance identifies the process serving requests, and where it runs.
+type Instance struct {
+	// ProcessID is made up when the process starts, so it tells apart
+	// instances that share everything else.
+	ProcessID string `json:"processId"`
+	// InstanceID, Region and Project come from the metadata server, and
+	// are left out when not running on Google Cloud.
+	InstanceID string    `json:"instanceId,omitempty"`
+	Region     string    `json:"region,omitempty"`
+	Project    string    `json:"project,omitempty"`
+	Service    string    `json:"service,omitempty"`
+	Revision   string    `json:"revision,omitempty"`
+	Hostname   string    `json:"hostname"`
+	Started    time.Time `json:"started"`
+}
+
+// WhoAmI is what /api/v1/whoami answers with.
+type WhoAmI struct {
+	Instance
+	// Requests counts the requests this process has served, this one
+	// included.
+	Requests uint64 `json:"requests"`
+}
+
+// JSON marshalls the content of WhoAmI to json.
+func (wa WhoAmI) JSON() (string, error) {
+	bytes, err := wa.JSONBytes()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// JSONBytes marshalls the content of WhoAmI to json.
+func (wa WhoAmI) JSONBytes() ([]byte, error) {
+	bytes, err := json.Marshal(wa)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal json for response: %s", err)
+	}
+
+	return bytes, nil
+}
+
+// newInstance describes this process from what it knows without asking
+// anyone: a new id, its host and the service and revision Cloud Run sets.
+func newInstance() Instance {
+	i := Instance{
+		ProcessID: uuid.NewString(),
+		Service:   os.Getenv("K_SERVICE"),
+		Revision:  os.Getenv("K_REVISION"),
+		Started:   time.Now().UTC(),
+	}
+	i.Hostname, _ = os.Hostname()
+
+	return i
+}
+
+// LookupInstance fills in what the metadata server knows of the instance.
+// Off Google Cloud there is none, and the instance is left as it is. It
+// should be called before the server starts serving.
+func (s *Server) LookupInstance() {
+	if !metadata.OnGCE() {
+		return
+	}
+
+	var err error
+	if s.instance.InstanceID, err = metadata.InstanceID(); err != nil {
+		log.Printf("could not look up instance id: %s", err)
+	}
+	if s.instance.Project, err = metadata.ProjectID(); err != nil {
+		log.Printf("could not look up project: %s", err)
+	}
+	// Cloud Run gives the region as projects/NUMBER/regions/REGION.
+	if region, err := metadata.Get("instance/region"); err == nil {
+		s.instance.Region = path.Base(region)
+	}
+}
+
+// EnableServedBy adds an X-Served-By header naming the process to every
+// response apart from the health endpoints.
+func (s *Server) EnableServedBy() {
+	s.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(servedByHeader, s.instance.ProcessID)
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+func (s *Server) whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, WhoAmI{Instance: s.instance, Requests: s.requests.Load()}, http.StatusOK)
+}
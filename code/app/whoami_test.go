@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func whoami(t *testing.T, server *Server) WhoAmI {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/whoami", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, w.Code)
+	}
+
+	wa := WhoAmI{}
+	if err := json.Unmarshal(w.Body.Bytes(), &wa); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	return wa
+}
+
+func TestWhoAmI(t *testing.T) {
+	t.Setenv("K_REVISION", "scaler-00002")
+	server := NewServer(NewMemoryStorage())
+
+	first := whoami(t, server)
+	if first.ProcessID == "" || first.Started.IsZero() {
+		t.Fatalf("expected a process id and start time, got: %+v", first)
+	}
+	if first.Revision != "scaler-00002" {
+		t.Fatalf("expected: scaler-00002, got: %s", first.Revision)
+	}
+	if first.Requests != 1 {
+		t.Fatalf("expected the first request to be counted, got: %d", first.Requests)
+	}
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/image", nil))
+	second := whoami(t, server)
+	if second.ProcessID != first.ProcessID || second.Requests != 3 {
+		t.Fatalf("expected the same process on its third request, got: %+v", second)
+	}
+
+	if other := NewServer(NewMemoryStorage()); other.instance.ProcessID == first.ProcessID {
+		t.Fatalf("expected each process to get its own id")
+	}
+}
+
+func TestServedBy(t *testing.T) {
+	server := NewServer(newTestMemoryStorage(t, "a.png"))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/image/a", nil))
+	if got := w.Header().Get(servedByHeader); got != "" {
+		t.Fatalf("expected no %s by default, got: %s", servedByHeader, got)
+	}
+
+	server.EnableServedBy()
+	for _, target := range []string{"/api/v1/image/a", "/api/v1/image/missing"} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if got := w.Header().Get(servedByHeader); got != server.instance.ProcessID {
+			t.Fatalf("%s expected %s: %s, got: %q", target, servedByHeader, server.instance.ProcessID, got)
+		}
+	}
+}
@@ -21,10 +21,12 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 )
 
 // Global API clients used across function invocations.
@@ -45,19 +47,24 @@ func init() {
 // GCSEvent is the payload of a GCS event. Please refer to the docs for
 // additional information regarding GCS events.
 type GCSEvent struct {
-	Bucket   string `json:"bucket"`
-	Name     string `json:"name"`
-	SelfLink string `json:"selfLink"`
+	Bucket   string            `json:"bucket"`
+	Name     string            `json:"name"`
+	SelfLink string            `json:"selfLink"`
+	Metadata map[string]string `json:"metadata"`
 }
 
 // OnFileUpload prints a message when a file is changed in a Cloud Storage bucket.
 func OnFileUpload(ctx context.Context, e GCSEvent) error {
 	log.Printf("Processing file: %s", e.Name)
 
-	tPath, oPath, err := newPaths(ctx, e)
-	if err != nil {
-		log.Printf("error: %s", err)
-		return err
+	tPath, oPath := thumbnailPath(e.Name), originalPath(e.Name)
+	if !replaces(e) {
+		var err error
+		tPath, oPath, err = newPaths(ctx, e)
+		if err != nil {
+			log.Printf("error: %s", err)
+			return err
+		}
 	}
 
 	if strings.Index(e.Name, "uploads/") == 0 {
@@ -80,10 +87,22 @@ func OnFileUpload(ctx context.Context, e GCSEvent) error {
 			return err
 		}
 
+		if replaces(e) {
+			if err := removeStale(ctx, e.Bucket, oPath); err != nil {
+				log.Printf("error: %s", err)
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// replaces reports whether the upload is an update of an existing image, in
+// which case it should be processed over the top of it.
+func replaces(e GCSEvent) bool {
+	return e.Metadata["replace"] == "true"
+}
+
 func makePublic(ctx context.Context, bucket, file string) error {
 	obj := storageClient.Bucket(bucket).Object(file)
 	return obj.ACL().Set(ctx, storage.AllUsers, "READER")
@@ -103,16 +122,15 @@ func newPaths(ctx context.Context, e GCSEvent) (string, string, error) {
 	i := 0
 	for doesExist {
 		i++
-		t = thumbnailPath(e.Name)
-		t = strings.Replace(t, "/thumbnail", fmt.Sprintf("_%d/thumbnail", i), 1)
+		name := suffixedName(e.Name, i)
+		t = thumbnailPath(name)
 		doesExist, err = exists(ctx, e.Bucket, t)
 		if err != nil {
 			return "", "", err
 		}
 
 		if !doesExist {
-			o = originalPath(e.Name)
-			o = strings.Replace(o, "/original", fmt.Sprintf("_%d/original", i), 1)
+			o = originalPath(name)
 		}
 
 	}
@@ -120,6 +138,51 @@ func newPaths(ctx context.Context, e GCSEvent) (string, string, error) {
 	return t, o, nil
 }
 
+// removeStale deletes the files processed from an earlier version of an
+// image that the new one, whose original is at oPath, didn't overwrite
+// because their extension differs. It is only done once the new original
+// is in place, so that the image always has one.
+func removeStale(ctx context.Context, bucket, oPath string) error {
+	dir, ext := path.Dir(oPath)+"/", filepath.Ext(oPath)
+
+	it := storageClient.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: dir, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error listing %s: %s", dir, err)
+		}
+		if !stale(attrs.Name, ext) {
+			continue
+		}
+
+		err = storageClient.Bucket(bucket).Object(attrs.Name).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return fmt.Errorf("error deleting  %s: %s", attrs.Name, err)
+		}
+	}
+}
+
+// stale reports whether name, an object in the processed folder of an
+// image, is an original or thumbnail left from a version of it with an
+// extension other than ext.
+func stale(name, ext string) bool {
+	base := path.Base(name)
+	if !strings.HasPrefix(base, "original.") && !strings.HasPrefix(base, "thumbnail.") {
+		return false
+	}
+	return filepath.Ext(base) != ext
+}
+
+// suffixedName is name with _i added before its extension, for the i-th
+// duplicate of an upload.
+func suffixedName(name string, i int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
 // exists sees if a file exists already in a Cloud Storage
 func exists(ctx context.Context, bucket, file string) (bool, error) {
 	obj := storageClient.Bucket(bucket).Object(file)
@@ -177,16 +240,22 @@ func thumbnail(ctx context.Context, e GCSEvent, dest string) error {
 	return nil
 }
 
+// thumbnailPath is where the thumbnail of upload name goes. Uploads keep
+// the folders they are in below uploads/, so that an image's id is the
+// same as the name it was uploaded under.
 func thumbnailPath(name string) string {
-	ext := filepath.Ext(name)
-	newBase := strings.Replace(filepath.Base(name), ext, "/thumbnail"+ext, 1)
-	newPath := "processed/" + newBase
-	return newPath
+	return processedPath(name, "thumbnail")
 }
 
+// originalPath is where upload name goes once it is processed.
 func originalPath(name string) string {
-	ext := filepath.Ext(name)
-	newBase := strings.Replace(filepath.Base(name), ext, "/original"+ext, 1)
-	newPath := "processed/" + newBase
-	return newPath
+	return processedPath(name, "original")
+}
+
+// processedPath names the file called kind in the processed/ folder of
+// upload name, keeping its extension.
+func processedPath(name, kind string) string {
+	id := strings.TrimPrefix(name, "uploads/")
+	ext := filepath.Ext(id)
+	return "processed/" + strings.TrimSuffix(id, ext) + "/" + kind + ext
 }
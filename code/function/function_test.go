@@ -26,6 +26,11 @@ func TestThumbnailPath(t *testing.T) {
 
 	tests := []test{
 		{input: "uploads/ColtReto.png", want: "processed/ColtReto/thumbnail.png"},
+		{input: "uploads/events/2024/photo.png", want: "processed/events/2024/photo/thumbnail.png"},
+		{input: "uploads/users/alice/x.png", want: "processed/users/alice/x/thumbnail.png"},
+		{input: "uploads/users/bob/x.png", want: "processed/users/bob/x/thumbnail.png"},
+		{input: "uploads/photo.png.png", want: "processed/photo.png/thumbnail.png"},
+		{input: "uploads/README", want: "processed/README/thumbnail"},
 	}
 
 	for _, c := range tests {
@@ -44,6 +49,11 @@ func TestOrginalPath(t *testing.T) {
 
 	tests := []test{
 		{input: "uploads/ColtReto.png", want: "processed/ColtReto/original.png"},
+		{input: "uploads/events/2024/photo.png", want: "processed/events/2024/photo/original.png"},
+		{input: "uploads/users/alice/x.png", want: "processed/users/alice/x/original.png"},
+		{input: "uploads/users/bob/x.png", want: "processed/users/bob/x/original.png"},
+		{input: "uploads/photo.png.png", want: "processed/photo.png/original.png"},
+		{input: "uploads/README", want: "processed/README/original"},
 	}
 
 	for _, c := range tests {
@@ -53,3 +63,64 @@ func TestOrginalPath(t *testing.T) {
 		}
 	}
 }
+
+func TestSuffixedName(t *testing.T) {
+	type test struct {
+		input string
+		want  string
+	}
+
+	tests := []test{
+		{input: "uploads/ColtReto.png", want: "processed/ColtReto_2/original.png"},
+		{input: "uploads/thumbnails/photo.png", want: "processed/thumbnails/photo_2/original.png"},
+		{input: "uploads/users/alice/x.png", want: "processed/users/alice/x_2/original.png"},
+	}
+
+	for _, c := range tests {
+		got := originalPath(suffixedName(c.input, 2))
+		if !(c.want == got) {
+			t.Fatalf("expected: %v, got: %v", c.want, got)
+		}
+	}
+}
+
+func TestStale(t *testing.T) {
+	type test struct {
+		input string
+		want  bool
+	}
+
+	tests := []test{
+		{input: "processed/ColtReto/original.png", want: false},
+		{input: "processed/ColtReto/thumbnail.png", want: false},
+		{input: "processed/ColtReto/original.jpg", want: true},
+		{input: "processed/ColtReto/thumbnail.jpg", want: true},
+		{input: "processed/ColtReto/notes.jpg", want: false},
+	}
+
+	for _, c := range tests {
+		got := stale(c.input, ".png")
+		if !(c.want == got) {
+			t.Fatalf("%s expected: %v, got: %v", c.input, c.want, got)
+		}
+	}
+}
+
+func TestReplaces(t *testing.T) {
+	type test struct {
+		input GCSEvent
+		want  bool
+	}
+
+	tests := []test{
+		{input: GCSEvent{Name: "uploads/ColtReto.png"}, want: false},
+		{input: GCSEvent{Name: "uploads/ColtReto.png", Metadata: map[string]string{"replace": "true"}}, want: true},
+	}
+
+	for _, c := range tests {
+		got := replaces(c.input)
+		if !(c.want == got) {
+			t.Fatalf("expected: %v, got: %v", c.want, got)
+		}
+	}
+}
@@ -2,4 +2,7 @@ module example.com/cloudfunction
 
 go 1.16
 
-require cloud.google.com/go/storage v1.18.2 // indirect
+require (
+	cloud.google.com/go/storage v1.18.2
+	google.golang.org/api v0.58.0
+)